@@ -46,6 +46,8 @@ func main() {
 		PricePerRequest: 100, // Price in smallest currency unit (e.g., cents)
 		Currency:        "USD",
 		ExemptPaths:     []string{"/api/public", "/health"},
+		// Accept "valid_" test tokens; set PaymentVerifier in production
+		TestMode: true,
 	}
 
 	// Wrap the mux with the X402 seller middleware
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// healthEndpoint reports backend health. It is served outside the payment
+// middleware so it never requires payment.
+const healthEndpoint = "/gateway/health"
+
+// healthCheckOptions configures active backend health checks
+type healthCheckOptions struct {
+	// Path is requested on the backend; a 2xx-4xx response counts as healthy
+	Path string
+
+	// Interval between checks
+	Interval time.Duration
+
+	// Timeout for a single check
+	Timeout time.Duration
+
+	// FailureThreshold is the number of consecutive failures before the
+	// backend is marked unhealthy (default: 1)
+	FailureThreshold int
+
+	// RetryAfter is advertised to clients while the backend is unhealthy
+	RetryAfter time.Duration
+}
+
+// backendHealth tracks the health of a single backend
+type backendHealth struct {
+	mu                  sync.RWMutex
+	checkURL            string
+	opts                healthCheckOptions
+	client              *http.Client
+	healthy             bool
+	lastCheck           time.Time
+	lastSuccess         time.Time
+	lastError           string
+	consecutiveFailures int
+}
+
+// backendHealthStatus is the JSON body served at healthEndpoint
+type backendHealthStatus struct {
+	Backend             string     `json:"backend"`
+	Healthy             bool       `json:"healthy"`
+	LastCheck           *time.Time `json:"last_check,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
+// newBackendHealth creates a health checker for the backend. The backend is
+// assumed healthy until a check says otherwise.
+func newBackendHealth(backendURL string, opts healthCheckOptions) (*backendHealth, error) {
+	base, err := url.Parse(backendURL)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 2 * time.Second
+	}
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = 1
+	}
+	if opts.RetryAfter <= 0 {
+		opts.RetryAfter = opts.Interval
+	}
+
+	ref, err := url.Parse(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &backendHealth{
+		checkURL: base.ResolveReference(ref).String(),
+		opts:     opts,
+		client:   &http.Client{Timeout: opts.Timeout},
+		healthy:  true,
+	}, nil
+}
+
+// run checks the backend immediately and then every Interval until ctx is done
+func (h *backendHealth) run(ctx context.Context) {
+	ticker := time.NewTicker(h.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		h.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check performs a single health check and records the result
+func (h *backendHealth) check(ctx context.Context) {
+	err := h.probe(ctx)
+	now := time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastCheck = now
+	if err == nil {
+		h.healthy = true
+		h.lastSuccess = now
+		h.lastError = ""
+		h.consecutiveFailures = 0
+		return
+	}
+
+	h.lastError = err.Error()
+	h.consecutiveFailures++
+	if h.consecutiveFailures >= h.opts.FailureThreshold {
+		h.healthy = false
+	}
+}
+
+// probe requests the health path on the backend
+func (h *backendHealth) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, h.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.checkURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("health check returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// isHealthy reports the last known backend state
+func (h *backendHealth) isHealthy() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.healthy
+}
+
+// status returns a snapshot of the backend health
+func (h *backendHealth) status() backendHealthStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	s := backendHealthStatus{
+		Backend:             h.checkURL,
+		Healthy:             h.healthy,
+		LastError:           h.lastError,
+		ConsecutiveFailures: h.consecutiveFailures,
+	}
+	if !h.lastCheck.IsZero() {
+		t := h.lastCheck
+		s.LastCheck = &t
+	}
+	if !h.lastSuccess.IsZero() {
+		t := h.lastSuccess
+		s.LastSuccess = &t
+	}
+	return s
+}
+
+// middleware short-circuits with 503 while the backend is unhealthy. It must
+// wrap the payment middleware so nobody pays for a dead upstream.
+func (h *backendHealth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.isHealthy() {
+			retryAfter := int(h.opts.RetryAfter.Round(time.Second) / time.Second)
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":       "Backend unavailable",
+				"retry_after": retryAfter,
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handler serves the health state as JSON
+func (h *backendHealth) handler(w http.ResponseWriter, r *http.Request) {
+	status := h.status()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGateway_UnhealthyBackendSkipsVerification(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	health, err := newBackendHealth(backend.URL, healthCheckOptions{Path: "/health"})
+	if err != nil {
+		t.Fatalf("Failed to create health checker: %v", err)
+	}
+
+	verifications := 0
+	handler, err := newGatewayHandler(gatewayOptions{
+		BackendURL: backend.URL,
+		Price:      100,
+		Currency:   "USD",
+		Health:     health,
+		PaymentVerifier: func(token string) (bool, error) {
+			verifications++
+			return true, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build handler: %v", err)
+	}
+
+	health.check(context.Background())
+	if !health.isHealthy() {
+		t.Fatal("Expected backend to be healthy")
+	}
+
+	// Kill the backend
+	backend.Close()
+	health.check(context.Background())
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("Authorization", "Bearer valid_token")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header")
+	}
+	if verifications != 0 {
+		t.Errorf("Expected no payment verification, got %d", verifications)
+	}
+}
+
+func TestGateway_HealthEndpoint(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	health, err := newBackendHealth(backend.URL, healthCheckOptions{Path: "/health", FailureThreshold: 2})
+	if err != nil {
+		t.Fatalf("Failed to create health checker: %v", err)
+	}
+	handler, err := newGatewayHandler(gatewayOptions{
+		BackendURL: backend.URL,
+		Price:      100,
+		Currency:   "USD",
+		Health:     health,
+		TestMode:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build handler: %v", err)
+	}
+
+	// One failure is below the threshold
+	health.check(context.Background())
+	if !health.isHealthy() {
+		t.Error("Expected backend to stay healthy below the failure threshold")
+	}
+	health.check(context.Background())
+
+	// Health endpoint is served without payment
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", healthEndpoint, nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 from health endpoint, got %d", w.Code)
+	}
+
+	var status backendHealthStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode health status: %v", err)
+	}
+	if status.Healthy {
+		t.Error("Expected unhealthy status")
+	}
+	if status.LastCheck == nil {
+		t.Error("Expected last check timestamp")
+	}
+	if status.ConsecutiveFailures != 2 {
+		t.Errorf("Expected 2 consecutive failures, got %d", status.ConsecutiveFailures)
+	}
+}
+
+func TestBackendHealth_Recovers(t *testing.T) {
+	healthy := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	health, err := newBackendHealth(backend.URL, healthCheckOptions{Path: "/health"})
+	if err != nil {
+		t.Fatalf("Failed to create health checker: %v", err)
+	}
+
+	health.check(context.Background())
+	if health.isHealthy() {
+		t.Error("Expected backend to be unhealthy")
+	}
+
+	healthy = true
+	health.check(context.Background())
+	if !health.isHealthy() {
+		t.Error("Expected backend to recover after a successful check")
+	}
+	if health.status().LastSuccess == nil {
+		t.Error("Expected last success timestamp")
+	}
+}
@@ -2,25 +2,110 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/siddimore/x402-seller-middleware/pkg/x402"
 )
 
+// gatewayOptions holds the settings needed to build the gateway handler
+type gatewayOptions struct {
+	BackendURL      string
+	PaymentEndpoint string
+	Price           int64
+	Currency        string
+	ExemptPaths     []string
+
+	// ACMEEnabled exempts the HTTP-01 challenge path from payment
+	ACMEEnabled bool
+
+	// Response cache (served only after payment is verified)
+	CacheEnabled    bool
+	CacheTTL        time.Duration
+	CacheMaxEntries int
+	CacheMaxBody    int64
+
+	// Health, when set, short-circuits with 503 before payment while the
+	// backend is down and serves its state at healthEndpoint
+	Health *backendHealth
+
+	// PaymentVerifier verifies payment tokens; required unless TestMode is set
+	PaymentVerifier func(token string) (bool, error)
+
+	// TestMode accepts any token starting with "valid_" (development only)
+	TestMode bool
+
+	// TrustedProxies may set X-Forwarded-For; headers from anyone else are replaced
+	TrustedProxies []*net.IPNet
+
+	// PayerClaimsSecret, if set, signs the X-Payment-Claims header sent to
+	// the backend (verify with x402.VerifyGatewayClaims)
+	PayerClaimsSecret []byte
+
+	// Body size limits (0 = unlimited)
+	MaxRequestBodyBytes  int64
+	MaxResponseBodyBytes int64
+
+	// Operational state surfaced by the admin API (all optional)
+	Metering   x402.MeteringStore
+	Ledger     x402.PaymentLedger
+	Exemptions *x402.ExemptionList
+}
+
 func main() {
 	// Configuration flags
 	listenAddr := flag.String("listen", ":8402", "Gateway listen address")
 	backendURL := flag.String("backend", "", "Backend URL to proxy to (e.g., http://localhost:3000)")
 	paymentEndpoint := flag.String("payment-url", "", "Payment verification endpoint")
+	verifyURL := flag.String("verify-url", "", "Payment verification service URL (required unless -test-mode)")
+	testMode := flag.Bool("test-mode", false, "Accept any token starting with valid_ (development only)")
 	price := flag.Int64("price", 100, "Price per request in smallest currency unit")
 	currency := flag.String("currency", "USD", "Currency code")
 	exemptPaths := flag.String("exempt", "/health,/favicon.ico", "Comma-separated exempt paths")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated CIDRs of proxies allowed to set X-Forwarded-For")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 15*time.Second, "Time to wait for in-flight requests on shutdown")
+
+	// TLS flags
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file (enables HTTPS)")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	acmeDomains := flag.String("acme-domains", "", "Comma-separated domains to obtain certificates for via ACME (Let's Encrypt)")
+	acmeCacheDir := flag.String("acme-cache-dir", "acme-cache", "Directory used to cache ACME certificates")
+	acmeEmail := flag.String("acme-email", "", "Contact email registered with the ACME provider")
+	httpRedirectAddr := flag.String("http-redirect", ":80", "Plain HTTP listen address that redirects to HTTPS (empty to disable)")
+
+	// Cache flags
+	cacheEnabled := flag.Bool("cache", false, "Cache backend GET responses (payment is still required on every request)")
+	cacheTTL := flag.Duration("cache-ttl", 0, "TTL for responses without Cache-Control max-age (0 caches only explicit max-age)")
+	cacheMaxEntries := flag.Int("cache-max-entries", 1000, "Maximum number of cached responses")
+	cacheMaxBody := flag.Int64("cache-max-body", 1<<20, "Largest response body to cache, in bytes")
+
+	// Size limit flags
+	maxRequestBody := flag.Int64("max-request-body", 10<<20, "Largest request body accepted, in bytes (0 for unlimited)")
+	maxResponseBody := flag.Int64("max-response-body", 0, "Largest backend response body relayed, in bytes (0 for unlimited)")
+
+	// Admin flags
+	adminListen := flag.String("admin-listen", "", "Admin API listen address, e.g. 127.0.0.1:9402 (empty to disable)")
+	adminKey := flag.String("admin-key", "", "API key required by the admin API")
+
+	// Payer identity flags
+	payerClaimsSecret := flag.String("payer-claims-secret", "", "Secret that signs the X-Payment-Claims header sent to the backend (empty to disable)")
+
+	// Health check flags
+	healthPath := flag.String("health-path", "", "Backend path to poll for health checks (empty to disable)")
+	healthInterval := flag.Duration("health-interval", 10*time.Second, "Interval between backend health checks")
+	healthTimeout := flag.Duration("health-timeout", 2*time.Second, "Timeout for a single backend health check")
+	healthThreshold := flag.Int("health-threshold", 1, "Consecutive failed checks before the backend is marked unhealthy")
 
 	flag.Parse()
 
@@ -31,18 +116,230 @@ func main() {
 	if env := os.Getenv("X402_PAYMENT_ENDPOINT"); env != "" {
 		*paymentEndpoint = env
 	}
+	if env := os.Getenv("X402_VERIFY_URL"); env != "" {
+		*verifyURL = env
+	}
 	if env := os.Getenv("X402_LISTEN_ADDR"); env != "" {
 		*listenAddr = env
 	}
+	if env := os.Getenv("X402_ACME_DOMAINS"); env != "" {
+		*acmeDomains = env
+	}
+	if env := os.Getenv("X402_ADMIN_KEY"); env != "" {
+		*adminKey = env
+	}
+	if env := os.Getenv("X402_PAYER_CLAIMS_SECRET"); env != "" {
+		*payerClaimsSecret = env
+	}
 
 	if *backendURL == "" {
 		log.Fatal("Backend URL is required. Use -backend flag or X402_BACKEND_URL env var")
 	}
 
+	tlsOpts := tlsOptions{
+		CertFile:     *tlsCert,
+		KeyFile:      *tlsKey,
+		ACMEDomains:  splitList(*acmeDomains),
+		ACMECacheDir: *acmeCacheDir,
+		ACMEEmail:    *acmeEmail,
+		RedirectAddr: *httpRedirectAddr,
+	}
+	if err := tlsOpts.validate(); err != nil {
+		log.Fatalf("Invalid TLS configuration: %v", err)
+	}
+
+	trusted, err := x402.ParseTrustedProxies(splitList(*trustedProxies))
+	if err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+
+	var health *backendHealth
+	if *healthPath != "" {
+		var err error
+		health, err = newBackendHealth(*backendURL, healthCheckOptions{
+			Path:             *healthPath,
+			Interval:         *healthInterval,
+			Timeout:          *healthTimeout,
+			FailureThreshold: *healthThreshold,
+		})
+		if err != nil {
+			log.Fatalf("Invalid health check configuration: %v", err)
+		}
+	}
+
+	if *adminListen != "" && *adminKey == "" {
+		log.Fatal("-admin-key (or X402_ADMIN_KEY) is required with -admin-listen")
+	}
+
+	var (
+		metering   x402.MeteringStore
+		ledger     x402.PaymentLedger
+		exemptions *x402.ExemptionList
+	)
+	if *adminListen != "" {
+		metering = x402.NewInMemoryMeteringStore(0, *currency)
+		ledger = x402.NewInMemoryPaymentLedger(0)
+		exemptions = x402.NewExemptionList()
+	}
+
+	var verifier func(token string) (bool, error)
+	if *verifyURL != "" {
+		verifier = x402.NewHTTPVerifier(x402.VerifierConfig{Endpoint: *verifyURL})
+	}
+	if *testMode {
+		log.Println("⚠️  Test mode: any token starting with valid_ is accepted. Never use in production.")
+	}
+
+	handler, err := newGatewayHandler(gatewayOptions{
+		BackendURL:      *backendURL,
+		PaymentEndpoint: *paymentEndpoint,
+		Price:           *price,
+		Currency:        *currency,
+		ExemptPaths:     splitList(*exemptPaths),
+		ACMEEnabled:     tlsOpts.acmeEnabled(),
+		CacheEnabled:    *cacheEnabled,
+		CacheTTL:        *cacheTTL,
+		CacheMaxEntries: *cacheMaxEntries,
+		CacheMaxBody:    *cacheMaxBody,
+		Health:          health,
+		TrustedProxies:  trusted,
+		PaymentVerifier: verifier,
+		TestMode:        *testMode,
+
+		PayerClaimsSecret: []byte(*payerClaimsSecret),
+
+		MaxRequestBodyBytes:  *maxRequestBody,
+		MaxResponseBodyBytes: *maxResponseBody,
+
+		Metering:   metering,
+		Ledger:     ledger,
+		Exemptions: exemptions,
+	})
+	if err != nil {
+		log.Fatalf("Invalid gateway configuration: %v", err)
+	}
+
+	server := &http.Server{
+		Addr:              *listenAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	var adminServer *http.Server
+	if *adminListen != "" {
+		// Flag values stand in for the config; secrets are redacted by the handler
+		flags := make(map[string]string)
+		flag.VisitAll(func(f *flag.Flag) { flags[f.Name] = f.Value.String() })
+
+		adminServer = &http.Server{
+			Addr: *adminListen,
+			Handler: x402.AdminHandler(x402.AdminDeps{
+				APIKey:     *adminKey,
+				Metering:   metering,
+				Ledger:     ledger,
+				Exemptions: exemptions,
+				Config:     flags,
+			}),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+	}
+
+	var redirectServer *http.Server
+	if tlsOpts.enabled() {
+		redirectHandler, err := tlsOpts.configure(server)
+		if err != nil {
+			log.Fatalf("Failed to configure TLS: %v", err)
+		}
+		if tlsOpts.RedirectAddr != "" {
+			redirectServer = &http.Server{
+				Addr:              tlsOpts.RedirectAddr,
+				Handler:           redirectHandler,
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+		}
+	}
+
+	log.Printf("🚀 X402 Payment Gateway starting on %s", *listenAddr)
+	log.Printf("🔗 Proxying to: %s", *backendURL)
+	log.Printf("💰 Price: %d %s per request", *price, *currency)
+	log.Printf("🔓 Exempt paths: %s", *exemptPaths)
+	if *cacheEnabled {
+		log.Printf("🗄️  Response cache enabled (%d entries, %d byte bodies)", *cacheMaxEntries, *cacheMaxBody)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if health != nil {
+		log.Printf("🩺 Checking backend health at %s every %s", *healthPath, *healthInterval)
+		go health.run(ctx)
+	}
+
+	errCh := make(chan error, 3)
+
+	go func() {
+		var err error
+		if tlsOpts.enabled() {
+			log.Printf("🔒 TLS enabled (%s)", tlsOpts.mode())
+			// Certificates come from TLSConfig (files are loaded there too)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+	}()
+
+	if redirectServer != nil {
+		go func() {
+			log.Printf("↪️  Redirecting HTTP on %s to HTTPS", redirectServer.Addr)
+			if err := redirectServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errCh <- err
+			}
+		}()
+	}
+
+	if adminServer != nil {
+		go func() {
+			log.Printf("🛠️  Admin API on %s", adminServer.Addr)
+			if err := adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errCh <- err
+			}
+		}()
+	}
+
+	select {
+	case err := <-errCh:
+		log.Fatalf("Gateway failed: %v", err)
+	case <-ctx.Done():
+	}
+
+	log.Printf("🛑 Shutting down (waiting up to %s for in-flight requests)", *shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	if redirectServer != nil {
+		if err := redirectServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Redirect server shutdown: %v", err)
+		}
+	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Admin server shutdown: %v", err)
+		}
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Gateway shutdown: %v", err)
+	}
+}
+
+// newGatewayHandler builds the reverse proxy wrapped with the x402 middleware
+func newGatewayHandler(opts gatewayOptions) (http.Handler, error) {
 	// Parse backend URL
-	target, err := url.Parse(*backendURL)
+	target, err := url.Parse(opts.BackendURL)
 	if err != nil {
-		log.Fatalf("Invalid backend URL: %v", err)
+		return nil, err
 	}
 
 	// Create reverse proxy
@@ -51,27 +348,93 @@ func main() {
 	// Custom director to preserve original host header option
 	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
+		clientIP := x402.ClientIPFromRequest(req, opts.TrustedProxies)
+		if !x402.IsTrustedPeer(req, opts.TrustedProxies) {
+			// Forwarding headers from untrusted peers are spoofable; the proxy
+			// appends the peer address to a clean X-Forwarded-For
+			req.Header.Del("X-Forwarded-For")
+		}
 		originalDirector(req)
 		req.Header.Set("X-Forwarded-Host", req.Host)
 		req.Header.Set("X-Origin-Host", target.Host)
+		req.Header.Set("X-Real-IP", clientIP)
+	}
+
+	exempt := opts.ExemptPaths
+	if opts.ACMEEnabled {
+		// Certificate issuance must never be charged for. Copy first so the
+		// caller's slice is never appended to.
+		exempt = append(append([]string(nil), opts.ExemptPaths...), acmeChallengePrefix)
 	}
 
 	// Configure X402 middleware
 	config := x402.Config{
-		PaymentEndpoint: *paymentEndpoint,
-		AcceptedMethods: []string{"Bearer", "Token", "X402"},
-		PricePerRequest: *price,
-		Currency:        *currency,
-		ExemptPaths:     strings.Split(*exemptPaths, ","),
+		PaymentEndpoint:   opts.PaymentEndpoint,
+		AcceptedMethods:   []string{"Bearer", "Token", "X402"},
+		PricePerRequest:   opts.Price,
+		Currency:          opts.Currency,
+		ExemptPaths:       exempt,
+		PaymentVerifier:   opts.PaymentVerifier,
+		TestMode:          opts.TestMode,
+		Ledger:            opts.Ledger,
+		DynamicExemptions: opts.Exemptions,
+		PayerHeaders:      x402.PayerHeaders{ClaimsSecret: opts.PayerClaimsSecret},
+
+		MaxRequestBodyBytes:  opts.MaxRequestBodyBytes,
+		MaxResponseBodyBytes: opts.MaxResponseBodyBytes,
+		OnBodyLimitExceeded: func(event x402.BodyLimitEvent) {
+			log.Printf("⚠️  %s body limit exceeded on %s %s (%d > %d bytes)",
+				event.Direction, event.Method, event.Endpoint, event.Size, event.Limit)
+		},
+	}
+
+	var backend http.Handler = proxy
+	if opts.CacheEnabled {
+		// The cache sits inside the payment middleware so hits are still charged
+		backend = x402.CacheMiddleware(proxy, x402.CacheConfig{
+			Store:        x402.NewInMemoryLRUCache(opts.CacheMaxEntries),
+			DefaultTTL:   opts.CacheTTL,
+			MaxBodyBytes: opts.CacheMaxBody,
+		})
+	}
+
+	// Refuse to start without a way to verify payments
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
 
 	// Wrap proxy with X402 payment middleware
-	handler := x402.Middleware(proxy, config)
+	handler := x402.Middleware(backend, config)
+	if opts.Metering != nil {
+		// Outside payment so 402s show up in the stats too
+		handler = x402.MeteringMiddleware(handler, x402.MeteringConfig{
+			Store:          opts.Metering,
+			Currency:       opts.Currency,
+			TrustedProxies: opts.TrustedProxies,
+		})
+	}
+	if opts.Health == nil {
+		return handler, nil
+	}
 
-	log.Printf("🚀 X402 Payment Gateway starting on %s", *listenAddr)
-	log.Printf("🔗 Proxying to: %s", *backendURL)
-	log.Printf("💰 Price: %d %s per request", *price, *currency)
-	log.Printf("🔓 Exempt paths: %s", *exemptPaths)
+	// Health gating happens before payment so buyers never pay for a dead upstream
+	gated := opts.Health.middleware(handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == healthEndpoint {
+			opts.Health.handler(w, r)
+			return
+		}
+		gated.ServeHTTP(w, r)
+	}), nil
+}
 
-	log.Fatal(http.ListenAndServe(*listenAddr, handler))
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
 }
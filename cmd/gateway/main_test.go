@@ -0,0 +1,319 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402"
+)
+
+func newTestBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("backend:" + r.URL.Path))
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestGateway_ACMEChallengeBypassesPayment(t *testing.T) {
+	backend := newTestBackend(t)
+
+	// Spare capacity the challenge prefix must not be appended into
+	exempt := make([]string, 1, 2)
+	exempt[0] = "/health"
+	handler, err := newGatewayHandler(gatewayOptions{
+		BackendURL:  backend.URL,
+		Price:       100,
+		Currency:    "USD",
+		ExemptPaths: exempt,
+		ACMEEnabled: true,
+		TestMode:    true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build handler: %v", err)
+	}
+	if extra := exempt[:2][1]; extra != "" {
+		t.Errorf("Expected the caller's ExemptPaths left alone, got %q appended", extra)
+	}
+
+	req := httptest.NewRequest("GET", "/.well-known/acme-challenge/some-token", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected ACME challenge to bypass payment with 200, got %d", w.Code)
+	}
+
+	// Protected paths still require payment
+	req = httptest.NewRequest("GET", "/api/data", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 for protected path, got %d", w.Code)
+	}
+}
+
+func TestGateway_RequiresVerifierOutsideTestMode(t *testing.T) {
+	backend := newTestBackend(t)
+
+	if _, err := newGatewayHandler(gatewayOptions{BackendURL: backend.URL, Price: 100}); err == nil {
+		t.Error("Expected an error without a verifier or test mode")
+	}
+}
+
+func TestGateway_ACMEChallengeNotExemptWithoutACME(t *testing.T) {
+	backend := newTestBackend(t)
+
+	handler, err := newGatewayHandler(gatewayOptions{
+		BackendURL: backend.URL,
+		Price:      100,
+		Currency:   "USD",
+		TestMode:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build handler: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/.well-known/acme-challenge/some-token", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 when ACME is disabled, got %d", w.Code)
+	}
+}
+
+func TestTLSOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    tlsOptions
+		wantErr bool
+	}{
+		{"disabled", tlsOptions{}, false},
+		{"cert and key", tlsOptions{CertFile: "c.pem", KeyFile: "k.pem"}, false},
+		{"cert without key", tlsOptions{CertFile: "c.pem"}, true},
+		{"acme", tlsOptions{ACMEDomains: []string{"api.example.com"}, ACMECacheDir: "cache"}, false},
+		{"acme without cache", tlsOptions{ACMEDomains: []string{"api.example.com"}}, true},
+		{"acme and cert", tlsOptions{CertFile: "c.pem", KeyFile: "k.pem", ACMEDomains: []string{"api.example.com"}, ACMECacheDir: "cache"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		listen string
+		want   string
+	}{
+		{":443", "https://api.example.com/api/data?x=1"},
+		{":8402", "https://api.example.com:8402/api/data?x=1"},
+		{"0.0.0.0:8443", "https://api.example.com:8443/api/data?x=1"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://api.example.com:80/api/data?x=1", nil)
+		w := httptest.NewRecorder()
+
+		redirectToHTTPS(tt.listen)(w, req)
+
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("%s: expected 301, got %d", tt.listen, w.Code)
+		}
+		if loc := w.Header().Get("Location"); loc != tt.want {
+			t.Errorf("%s: unexpected redirect location: %s", tt.listen, loc)
+		}
+	}
+}
+
+func TestTLSOptions_ACMEHandlerServesChallenge(t *testing.T) {
+	opts := tlsOptions{
+		ACMEDomains:  []string{"api.example.com"},
+		ACMECacheDir: t.TempDir(),
+	}
+	server := &http.Server{}
+
+	handler, err := opts.configure(server)
+	if err != nil {
+		t.Fatalf("configure failed: %v", err)
+	}
+	if server.TLSConfig == nil || server.TLSConfig.GetCertificate == nil {
+		t.Fatal("Expected autocert TLS config")
+	}
+
+	// Non-challenge requests are redirected
+	req := httptest.NewRequest("GET", "http://api.example.com/api/data", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusMovedPermanently {
+		t.Errorf("Expected redirect for non-challenge path, got %d", w.Code)
+	}
+
+	// Unknown challenge tokens are answered by autocert, never redirected or charged
+	req = httptest.NewRequest("GET", "http://api.example.com/.well-known/acme-challenge/unknown", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code == http.StatusMovedPermanently || w.Code == http.StatusPaymentRequired {
+		t.Errorf("Expected autocert to handle challenge path, got %d", w.Code)
+	}
+}
+
+func TestGateway_CacheServesPaidRequests(t *testing.T) {
+	calls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Write([]byte("backend:" + r.URL.Path))
+	}))
+	defer backend.Close()
+
+	handler, err := newGatewayHandler(gatewayOptions{
+		BackendURL:      backend.URL,
+		Price:           100,
+		Currency:        "USD",
+		CacheEnabled:    true,
+		CacheMaxEntries: 10,
+		TestMode:        true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build handler: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("Authorization", "Bearer valid_token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("Expected second paid request to be served from cache, backend called %d times", calls)
+	}
+
+	// Unpaid requests never see cached content
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 for unpaid request, got %d", w.Code)
+	}
+}
+
+func TestGateway_OversizedRequestNeverReachesBackend(t *testing.T) {
+	backendCalled := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalled = true
+	}))
+	defer backend.Close()
+
+	handler, err := newGatewayHandler(gatewayOptions{
+		BackendURL:          backend.URL,
+		Price:               100,
+		Currency:            "USD",
+		MaxRequestBodyBytes: 16,
+		TestMode:            true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build handler: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/upload", strings.NewReader(strings.Repeat("x", 1024)))
+	req.Header.Set("Authorization", "Bearer valid_token")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d", w.Code)
+	}
+	if backendCalled {
+		t.Error("Expected backend never to see the oversized body")
+	}
+}
+
+func TestGateway_ForwardedForHandling(t *testing.T) {
+	var gotXFF, gotRealIP string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotXFF = r.Header.Get("X-Forwarded-For")
+		gotRealIP = r.Header.Get("X-Real-IP")
+	}))
+	defer backend.Close()
+
+	trusted, _ := x402.ParseTrustedProxies([]string{"10.0.0.0/8"})
+	handler, err := newGatewayHandler(gatewayOptions{
+		BackendURL:     backend.URL,
+		Price:          100,
+		Currency:       "USD",
+		ExemptPaths:    []string{"/public"},
+		TrustedProxies: trusted,
+		TestMode:       true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build handler: %v", err)
+	}
+
+	// Untrusted peer: spoofed header is replaced
+	req := httptest.NewRequest("GET", "/public", nil)
+	req.RemoteAddr = "203.0.113.5:1234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if gotXFF != "203.0.113.5" || gotRealIP != "203.0.113.5" {
+		t.Errorf("Expected spoofed XFF to be stripped, got XFF=%q X-Real-IP=%q", gotXFF, gotRealIP)
+	}
+
+	// Trusted peer: chain is preserved and extended
+	req = httptest.NewRequest("GET", "/public", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if gotXFF != "198.51.100.7, 10.0.0.1" || gotRealIP != "198.51.100.7" {
+		t.Errorf("Expected trusted chain to be kept, got XFF=%q X-Real-IP=%q", gotXFF, gotRealIP)
+	}
+}
+
+func TestGateway_SignsPayerClaimsForBackend(t *testing.T) {
+	secret := []byte("shared-secret")
+	claims := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims <- r.Header.Get("X-Payment-Claims")
+	}))
+	t.Cleanup(backend.Close)
+
+	handler, err := newGatewayHandler(gatewayOptions{
+		BackendURL:        backend.URL,
+		Price:             100,
+		Currency:          "USD",
+		TestMode:          true,
+		PayerClaimsSecret: secret,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build handler: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("Authorization", "Bearer valid_token")
+	req.Header.Set("X-Payment-Claims", "forged")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	got, err := x402.VerifyGatewayClaims(<-claims, secret, time.Minute)
+	if err != nil {
+		t.Fatalf("Expected the backend to receive signed claims, got %v", err)
+	}
+	if got.Amount != 100 || got.Resource != "/api/data" {
+		t.Errorf("Unexpected claims %+v", got)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeChallengePrefix is the path used for ACME HTTP-01 challenges.
+// It is exempt from payment so certificate issuance never receives a 402.
+const acmeChallengePrefix = "/.well-known/acme-challenge/"
+
+// tlsOptions configures HTTPS termination for the gateway
+type tlsOptions struct {
+	// Static certificate files
+	CertFile string
+	KeyFile  string
+
+	// ACME (autocert) settings
+	ACMEDomains  []string
+	ACMECacheDir string
+	ACMEEmail    string
+
+	// RedirectAddr is the plain HTTP address that redirects to HTTPS
+	// and answers HTTP-01 challenges in ACME mode
+	RedirectAddr string
+}
+
+// enabled reports whether the gateway should serve HTTPS
+func (o tlsOptions) enabled() bool {
+	return o.CertFile != "" || o.acmeEnabled()
+}
+
+// acmeEnabled reports whether certificates are obtained via ACME
+func (o tlsOptions) acmeEnabled() bool {
+	return len(o.ACMEDomains) > 0
+}
+
+// mode returns a short description for logging
+func (o tlsOptions) mode() string {
+	if o.acmeEnabled() {
+		return "acme"
+	}
+	return "certificate files"
+}
+
+// validate checks that the TLS flags are consistent
+func (o tlsOptions) validate() error {
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return errors.New("-tls-cert and -tls-key must be set together")
+	}
+	if o.CertFile != "" && o.acmeEnabled() {
+		return errors.New("-tls-cert/-tls-key cannot be combined with -acme-domains")
+	}
+	if o.acmeEnabled() && o.ACMECacheDir == "" {
+		return errors.New("-acme-cache-dir is required with -acme-domains")
+	}
+	return nil
+}
+
+// configure sets up TLS on the server and returns the handler for the
+// plain HTTP listener: ACME challenges are answered and everything else
+// is redirected to HTTPS on the server's port.
+func (o tlsOptions) configure(server *http.Server) (http.Handler, error) {
+	redirect := redirectToHTTPS(server.Addr)
+	if !o.acmeEnabled() {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig = &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+		}
+		return redirect, nil
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(o.ACMEDomains...),
+		Cache:      autocert.DirCache(o.ACMECacheDir),
+		Email:      o.ACMEEmail,
+	}
+	server.TLSConfig = manager.TLSConfig()
+	server.TLSConfig.MinVersion = tls.VersionTLS12
+
+	return manager.HTTPHandler(redirect), nil
+}
+
+// redirectToHTTPS returns a handler permanently redirecting plain HTTP
+// requests to HTTPS served on listenAddr, keeping its port unless it is 443
+func redirectToHTTPS(listenAddr string) http.HandlerFunc {
+	_, port, err := net.SplitHostPort(listenAddr)
+	if err != nil || port == "443" {
+		port = ""
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	}
+}
@@ -0,0 +1,472 @@
+// X402 CLI - Probe, pay for and decode x402-protected endpoints while
+// developing a seller
+//
+//	x402 probe <url>                  Show what a URL charges
+//	x402 pay <url>                    Pay for a URL and print the response
+//	x402 mint-token                   Mint an edge or test-mode token
+//	x402 decode <base64>              Decode a payload, requirement or token
+//
+// Every command accepts --json for scripting.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402"
+	"github.com/siddimore/x402-seller-middleware/pkg/x402/client"
+	"github.com/siddimore/x402-seller-middleware/pkg/x402/edge"
+)
+
+const usage = `Usage: x402 <command> [flags]
+
+Commands:
+  probe <url>        Fetch a URL and print its payment requirements
+  pay <url>          Pay for a URL with a test signer, token or payer service
+  mint-token         Mint an HMAC edge token (or a test-mode token with -test)
+  decode <base64>    Decode a payment payload, requirements header or token
+
+Run "x402 <command> -h" for the command's flags.
+`
+
+// commands maps subcommand names to their implementations
+var commands = map[string]func(args []string, out io.Writer) error{
+	"probe":      runProbe,
+	"pay":        runPay,
+	"mint-token": runMintToken,
+	"decode":     runDecode,
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the command in args and returns the process exit code
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "x402: unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+	if err := command(args[1:], stdout); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(stderr, "x402 %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// newFlagSet creates a command's flag set; parse errors are returned, not fatal
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("x402 "+name, flag.ContinueOnError)
+}
+
+// parseWithArg parses flags placed before or after a single positional argument
+func parseWithArg(fs *flag.FlagSet, args []string, name string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() == 0 {
+		return "", fmt.Errorf("missing <%s>", name)
+	}
+	arg := fs.Arg(0)
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return "", err
+	}
+	if fs.NArg() > 0 {
+		return "", fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	return arg, nil
+}
+
+// headerFlags collects repeated -H "Name: value" flags
+type headerFlags http.Header
+
+func (h headerFlags) String() string { return "" }
+
+func (h headerFlags) Set(value string) error {
+	name, val, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("header %q is not Name: value", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(name), strings.TrimSpace(val))
+	return nil
+}
+
+// requestFlags are shared by probe and pay
+type requestFlags struct {
+	method  string
+	body    string
+	headers headerFlags
+	json    bool
+}
+
+func (f *requestFlags) register(fs *flag.FlagSet) {
+	f.headers = headerFlags{}
+	fs.StringVar(&f.method, "X", "GET", "HTTP method")
+	fs.StringVar(&f.body, "d", "", "Request body")
+	fs.Var(f.headers, "H", "Request header \"Name: value\" (repeatable)")
+	fs.BoolVar(&f.json, "json", false, "Print JSON")
+}
+
+func (f *requestFlags) request(ctx context.Context, url string) (*http.Request, error) {
+	var body io.Reader
+	if f.body != "" {
+		body = strings.NewReader(f.body)
+	}
+	req, err := http.NewRequestWithContext(ctx, f.method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range f.headers {
+		req.Header[name] = values
+	}
+	return req, nil
+}
+
+// runProbe fetches a URL without paying and prints what it charges
+func runProbe(args []string, out io.Writer) error {
+	fs := newFlagSet("probe")
+	var flags requestFlags
+	flags.register(fs)
+	url, err := parseWithArg(fs, args, "url")
+	if err != nil {
+		return err
+	}
+
+	req, err := flags.request(context.Background(), url)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPaymentRequired {
+		if flags.json {
+			return writeJSON(out, map[string]interface{}{"status": resp.StatusCode, "paymentRequired": false})
+		}
+		fmt.Fprintf(out, "%s: %s (no payment required)\n", url, resp.Status)
+		return nil
+	}
+	required, err := client.ParsePaymentRequired(resp)
+	if err != nil {
+		return fmt.Errorf("402 without x402 requirements: %w", err)
+	}
+	if flags.json {
+		return writeJSON(out, required)
+	}
+	fmt.Fprintf(out, "%s: %s\n", url, resp.Status)
+	if required.Error != "" {
+		fmt.Fprintf(out, "error: %s\n", required.Error)
+	}
+	printAccepts(out, required.Accepts)
+	return nil
+}
+
+// printAccepts writes payment options as a table
+func printAccepts(out io.Writer, accepts []x402.PaymentRequirements) {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCHEME\tNETWORK\tAMOUNT\tASSET\tPAY TO\tDESCRIPTION")
+	for _, option := range accepts {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", option.Scheme, option.Network, option.MaxAmountRequired,
+			dash(option.Asset), dash(option.PayTo), option.Description)
+	}
+	tw.Flush()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// runPay pays for a URL through the client transport and prints the result
+func runPay(args []string, out io.Writer) error {
+	fs := newFlagSet("pay")
+	var flags requestFlags
+	flags.register(fs)
+	token := fs.String("token", "", "Send this proof instead of signing (e.g. from mint-token)")
+	payerURL := fs.String("payer-url", "", "Signing service: receives the chosen requirement as JSON, answers {\"payment\": \"<proof>\"}")
+	maxAmount := fs.Int64("max", 0, "Maximum price per request (0 = no cap)")
+	networks := fs.String("networks", "", "Comma-separated preferred networks")
+	budget := fs.Int64("budget", 0, "Maximum total to pay (0 = unlimited)")
+	dryRun := fs.Bool("dry-run", false, "Select an option but do not pay")
+	url, err := parseWithArg(fs, args, "url")
+	if err != nil {
+		return err
+	}
+
+	var payer client.Payer = testSigner{}
+	switch {
+	case *token != "" && *payerURL != "":
+		return errors.New("-token and -payer-url are mutually exclusive")
+	case *token != "":
+		payer = staticPayer(*token)
+	case *payerURL != "":
+		payer = &remotePayer{url: *payerURL, client: &http.Client{Timeout: 30 * time.Second}}
+	}
+
+	policy := client.Policy{MaxAmount: *maxAmount}
+	if *networks != "" {
+		policy.PreferredNetworks = strings.Split(*networks, ",")
+	}
+	httpClient := client.NewClient(client.Config{Payer: payer, Policy: policy, Budget: *budget, DryRun: *dryRun})
+
+	ctx, receipt := client.WithReceipt(context.Background())
+	req, err := flags.request(ctx, url)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if flags.json {
+		result := payResult{Status: resp.StatusCode, Paid: receipt.Paid, DryRun: receipt.DryRun, Settlement: receipt.Settlement, Body: string(body)}
+		if receipt.Paid || receipt.DryRun {
+			result.Amount = receipt.Amount
+			result.Requirement = &receipt.Requirement
+		}
+		return writeJSON(out, result)
+	}
+	fmt.Fprintf(out, "%s: %s\n", url, resp.Status)
+	switch {
+	case receipt.DryRun:
+		fmt.Fprintf(out, "dry run: would pay %d on %s/%s to %s\n", receipt.Amount, receipt.Requirement.Scheme, receipt.Requirement.Network, dash(receipt.Requirement.PayTo))
+	case receipt.Paid:
+		fmt.Fprintf(out, "paid %d on %s/%s\n", receipt.Amount, receipt.Requirement.Scheme, receipt.Requirement.Network)
+	}
+	if s := receipt.Settlement; s != nil {
+		fmt.Fprintf(out, "settlement: success=%t transaction=%s network=%s\n", s.Success, dash(s.Transaction), dash(s.Network))
+	}
+	fmt.Fprintf(out, "\n%s\n", body)
+	return nil
+}
+
+// payResult is pay's --json output
+type payResult struct {
+	Status      int                       `json:"status"`
+	Paid        bool                      `json:"paid"`
+	DryRun      bool                      `json:"dryRun,omitempty"`
+	Amount      int64                     `json:"amount,omitempty"`
+	Requirement *x402.PaymentRequirements `json:"requirement,omitempty"`
+	Settlement  *client.Settlement        `json:"settlement,omitempty"`
+	Body        string                    `json:"body"`
+}
+
+// testSigner makes "valid_" proofs, which sellers and gateways in test mode
+// accept
+type testSigner struct{}
+
+func (testSigner) Pay(ctx context.Context, requirement x402.PaymentRequirements) (string, error) {
+	return "valid_" + randomHex(8), nil
+}
+
+// staticPayer always presents the same proof
+type staticPayer string
+
+func (p staticPayer) Pay(ctx context.Context, requirement x402.PaymentRequirements) (string, error) {
+	return string(p), nil
+}
+
+// remotePayer asks a signing service (a wallet or facilitator) for the proof
+type remotePayer struct {
+	url    string
+	client *http.Client
+}
+
+func (p *remotePayer) Pay(ctx context.Context, requirement x402.PaymentRequirements) (string, error) {
+	body, err := json.Marshal(requirement)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("payer service returned %s", resp.Status)
+	}
+	var result struct {
+		Payment string `json:"payment"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("invalid payer service response: %w", err)
+	}
+	if result.Payment == "" {
+		return "", errors.New("payer service returned no payment")
+	}
+	return result.Payment, nil
+}
+
+// runMintToken mints an edge token, or a test-mode token with -test
+func runMintToken(args []string, out io.Writer) error {
+	fs := newFlagSet("mint-token")
+	secret := fs.String("secret", os.Getenv("X402_EDGE_SIGNING_SECRET"), "Edge signing secret (env X402_EDGE_SIGNING_SECRET)")
+	test := fs.Bool("test", false, "Mint a \"valid_\" token for test mode instead")
+	payer := fs.String("payer", "", "Payer recorded in the token")
+	resource := fs.String("resource", "", "Path prefix the token unlocks (empty = all)")
+	amount := fs.Int64("amount", 0, "Amount paid in the smallest currency unit")
+	ttl := fs.Duration("ttl", time.Hour, "Token lifetime")
+	asJSON := fs.Bool("json", false, "Print JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	var token string
+	var claims *edge.EdgeTokenClaims
+	if *test {
+		token = "valid_" + randomHex(16)
+	} else {
+		if *secret == "" {
+			return errors.New("-secret is required (or use -test)")
+		}
+		now := time.Now()
+		claims = &edge.EdgeTokenClaims{
+			Payer:     *payer,
+			Resource:  *resource,
+			Amount:    *amount,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(*ttl).Unix(),
+		}
+		var err error
+		if token, err = edge.MintEdgeToken(*secret, *claims); err != nil {
+			return err
+		}
+	}
+
+	if *asJSON {
+		return writeJSON(out, struct {
+			Token  string                `json:"token"`
+			Claims *edge.EdgeTokenClaims `json:"claims,omitempty"`
+		}{token, claims})
+	}
+	fmt.Fprintln(out, token)
+	return nil
+}
+
+// runDecode decodes a base64 payment payload, PAYMENT-REQUIRED header,
+// X-PAYMENT-RESPONSE header or edge token (without checking its signature)
+func runDecode(args []string, out io.Writer) error {
+	fs := newFlagSet("decode")
+	asJSON := fs.Bool("json", false, "Print JSON")
+	value, err := parseWithArg(fs, args, "base64")
+	if err != nil {
+		return err
+	}
+
+	kind, decoded, err := decodeValue(strings.TrimSpace(value))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return writeJSON(out, struct {
+			Kind  string          `json:"kind"`
+			Value json.RawMessage `json:"value"`
+		}{kind, decoded})
+	}
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, decoded, "", "  "); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s:\n%s\n", kind, pretty.Bytes())
+	if kind == "payment requirements" {
+		var required x402.PaymentRequiredResponse
+		if json.Unmarshal(decoded, &required) == nil {
+			fmt.Fprintln(out)
+			printAccepts(out, required.Accepts)
+		}
+	}
+	return nil
+}
+
+// decodeValue decodes value's JSON and names what it is
+func decodeValue(value string) (string, json.RawMessage, error) {
+	if strings.HasPrefix(value, edge.EdgeTokenPrefix) {
+		payload, _, _ := strings.Cut(strings.TrimPrefix(value, edge.EdgeTokenPrefix), ".")
+		data, err := base64.RawURLEncoding.DecodeString(payload)
+		if err != nil || !json.Valid(data) {
+			return "", nil, errors.New("malformed edge token")
+		}
+		return "edge token (signature not checked)", data, nil
+	}
+
+	data, err := decodeBase64(value)
+	if err != nil || !json.Valid(data) {
+		return "", nil, errors.New("not base64-encoded JSON")
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil {
+		return "json", data, nil
+	}
+	switch {
+	case fields["accepts"] != nil:
+		return "payment requirements", data, nil
+	case fields["scheme"] != nil && fields["network"] != nil:
+		return "payment payload", data, nil
+	case fields["success"] != nil:
+		return "settlement response", data, nil
+	}
+	return "json", data, nil
+}
+
+// decodeBase64 accepts standard and URL-safe base64, padded or not
+func decodeBase64(value string) ([]byte, error) {
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if data, err := encoding.DecodeString(value); err == nil {
+			return data, nil
+		}
+	}
+	return nil, errors.New("invalid base64")
+}
+
+func writeJSON(out io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402"
+	"github.com/siddimore/x402-seller-middleware/pkg/x402/edge"
+)
+
+// newTestSeller starts a test-mode seller charging 100 for /api paths
+func newTestSeller(t *testing.T) *httptest.Server {
+	t.Helper()
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-PAYMENT-RESPONSE", base64.StdEncoding.EncodeToString([]byte(`{"success":true,"transaction":"0xabc"}`)))
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte("data:" + string(body)))
+	})
+	seller := httptest.NewServer(x402.Middleware(api, x402.Config{
+		PricePerRequest: 100,
+		Currency:        "USD",
+		PaymentEndpoint: "0xSeller",
+		ExemptPaths:     []string{"/health"},
+		TestMode:        true,
+	}))
+	t.Cleanup(seller.Close)
+	return seller
+}
+
+func TestProbe(t *testing.T) {
+	seller := newTestSeller(t)
+
+	var out bytes.Buffer
+	if err := runProbe([]string{seller.URL + "/api/data"}, &out); err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "exact") || !strings.Contains(out.String(), "base-sepolia") || !strings.Contains(out.String(), "100") {
+		t.Errorf("Expected the accepts table, got:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := runProbe([]string{seller.URL + "/api/data", "--json"}, &out); err != nil {
+		t.Fatalf("probe --json failed: %v", err)
+	}
+	var required x402.PaymentRequiredResponse
+	if err := json.Unmarshal(out.Bytes(), &required); err != nil || len(required.Accepts) != 1 {
+		t.Fatalf("Expected requirements JSON, got %v: %s", err, out.String())
+	}
+	if required.Accepts[0].MaxAmountRequired != "100" {
+		t.Errorf("Expected 100, got %s", required.Accepts[0].MaxAmountRequired)
+	}
+
+	out.Reset()
+	if err := runProbe([]string{seller.URL + "/health"}, &out); err != nil || !strings.Contains(out.String(), "no payment required") {
+		t.Errorf("Expected a free path to be reported, got %v: %s", err, out.String())
+	}
+}
+
+func TestPay(t *testing.T) {
+	seller := newTestSeller(t)
+
+	var out bytes.Buffer
+	if err := runPay([]string{"-X", "POST", "-d", "hello", seller.URL + "/api/data", "--json"}, &out); err != nil {
+		t.Fatalf("pay failed: %v", err)
+	}
+	var result payResult
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("Expected JSON, got %v: %s", err, out.String())
+	}
+	if result.Status != http.StatusOK || !result.Paid || result.Amount != 100 || result.Body != "data:hello" {
+		t.Errorf("Unexpected result %+v", result)
+	}
+	if result.Settlement == nil || result.Settlement.Transaction != "0xabc" {
+		t.Errorf("Expected the settlement, got %+v", result.Settlement)
+	}
+
+	out.Reset()
+	if err := runPay([]string{"-dry-run", seller.URL + "/api/data"}, &out); err != nil {
+		t.Fatalf("pay -dry-run failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "402") || !strings.Contains(out.String(), "would pay 100") {
+		t.Errorf("Expected a dry run, got:\n%s", out.String())
+	}
+
+	if err := runPay([]string{"-max", "50", seller.URL + "/api/data"}, io.Discard); err == nil {
+		t.Error("Expected an error when the price exceeds -max")
+	}
+}
+
+func TestPay_RemotePayer(t *testing.T) {
+	seller := newTestSeller(t)
+	var asked x402.PaymentRequirements
+	signer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&asked)
+		w.Write([]byte(`{"payment":"valid_from_signer"}`))
+	}))
+	defer signer.Close()
+
+	var out bytes.Buffer
+	if err := runPay([]string{"-payer-url", signer.URL, seller.URL + "/api/data"}, &out); err != nil {
+		t.Fatalf("pay failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "200 OK") || asked.MaxAmountRequired != "100" {
+		t.Errorf("Expected the signer to be asked for the 100 option, got %+v:\n%s", asked, out.String())
+	}
+}
+
+func TestMintToken(t *testing.T) {
+	var out bytes.Buffer
+	if err := runMintToken([]string{"-secret", "s3cret", "-payer", "0xPayer", "-resource", "/api", "-amount", "100"}, &out); err != nil {
+		t.Fatalf("mint-token failed: %v", err)
+	}
+	claims, err := edge.ParseEdgeToken("s3cret", strings.TrimSpace(out.String()), time.Now(), 0)
+	if err != nil {
+		t.Fatalf("Expected a valid edge token, got %v", err)
+	}
+	if claims.Payer != "0xPayer" || claims.Resource != "/api" || claims.Amount != 100 {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+
+	out.Reset()
+	if err := runMintToken([]string{"-test"}, &out); err != nil || !strings.HasPrefix(out.String(), "valid_") {
+		t.Errorf("Expected a test-mode token, got %v %q", err, out.String())
+	}
+
+	if err := runMintToken(nil, io.Discard); err == nil {
+		t.Error("Expected an error without a secret")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	payload := base64.StdEncoding.EncodeToString([]byte(`{"scheme":"exact","network":"base","payer":"0xPayer"}`))
+	required := base64.StdEncoding.EncodeToString([]byte(`{"x402Version":1,"accepts":[{"scheme":"exact","network":"base","maxAmountRequired":"100"}]}`))
+	token, _ := edge.MintEdgeToken("s3cret", edge.EdgeTokenClaims{Payer: "0xPayer", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+
+	tests := []struct {
+		input string
+		kind  string
+	}{
+		{payload, "payment payload"},
+		{required, "payment requirements"},
+		{token, "edge token (signature not checked)"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := runDecode([]string{"--json", tt.input}, &out); err != nil {
+			t.Errorf("%s: decode failed: %v", tt.kind, err)
+			continue
+		}
+		var result struct {
+			Kind  string          `json:"kind"`
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(out.Bytes(), &result); err != nil || result.Kind != tt.kind {
+			t.Errorf("Expected kind %q, got %q (%v)", tt.kind, result.Kind, err)
+		}
+	}
+
+	if err := runDecode([]string{"not base64!"}, io.Discard); err == nil {
+		t.Error("Expected an error for invalid input")
+	}
+}
+
+func TestRun_UnknownCommand(t *testing.T) {
+	var stderr bytes.Buffer
+	if code := run([]string{"refund"}, io.Discard, &stderr); code != 2 || !strings.Contains(stderr.String(), "unknown command") {
+		t.Errorf("Expected exit 2 with usage, got %d: %s", code, stderr.String())
+	}
+}
@@ -0,0 +1,42 @@
+//go:build js && wasm
+
+// Cloudflare Worker entry point for the x402 edge handler.
+//
+// Build with TinyGo (smaller binary, recommended for Workers):
+//
+//	make edge-worker
+//
+// or with the standard toolchain:
+//
+//	make edge-wasm
+//
+// worker.mjs sets globalThis.X402_CONFIG (an EdgeConfig JSON string) from the
+// Worker environment before starting the Go runtime, then calls
+// globalThis.x402HandleRequest for every incoming request.
+package main
+
+import (
+	"encoding/json"
+	"syscall/js"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402/edge"
+)
+
+func main() {
+	var config edge.EdgeConfig
+	if raw := js.Global().Get("X402_CONFIG"); raw.Type() == js.TypeString {
+		if err := json.Unmarshal([]byte(raw.String()), &config); err != nil {
+			js.Global().Get("console").Call("error", "x402: invalid X402_CONFIG: "+err.Error())
+		}
+	}
+	if err := config.Validate(); err != nil {
+		// Refuse to start rather than serve with no way to verify payments
+		js.Global().Get("console").Call("error", "x402: "+err.Error())
+		return
+	}
+
+	edge.RegisterWorkerHandler("x402HandleRequest", edge.NewEdgeHandler(config))
+
+	// Keep the Go runtime alive to serve callbacks
+	select {}
+}
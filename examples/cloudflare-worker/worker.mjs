@@ -0,0 +1,46 @@
+// Cloudflare Worker shim for the x402 edge handler compiled to WebAssembly.
+// wasm_exec.js must match the toolchain used to build x402.wasm:
+//   TinyGo: $(tinygo env TINYGOROOT)/targets/wasm_exec.js
+//   Go:     $(go env GOROOT)/lib/wasm/wasm_exec.js (misc/wasm before Go 1.24)
+import "./wasm_exec.js";
+import wasmModule from "./x402.wasm";
+
+let ready;
+
+function start(env) {
+  if (!ready) {
+    globalThis.X402_CONFIG = env.X402_CONFIG || "{}";
+    const go = new Go();
+    ready = WebAssembly.instantiate(wasmModule, go.importObject).then((instance) => {
+      go.run(instance);
+    });
+  }
+  return ready;
+}
+
+export default {
+  async fetch(request, env) {
+    await start(env);
+
+    const headers = {};
+    for (const [k, v] of request.headers) headers[k] = v;
+    const body = ["GET", "HEAD"].includes(request.method) ? "" : await request.clone().text();
+
+    const result = await globalThis.x402HandleRequest({
+      method: request.method,
+      url: request.url,
+      headers,
+      body,
+    });
+
+    if (!result.forward) {
+      return new Response(result.body, { status: result.status, headers: result.headers });
+    }
+
+    // Paid or exempt: fetch the origin and attach the payment headers
+    const origin = await fetch(request);
+    const response = new Response(origin.body, origin);
+    for (const [k, v] of Object.entries(result.headers)) response.headers.set(k, v);
+    return response;
+  },
+};
@@ -83,11 +83,13 @@ func main() {
 			"/health",
 			"/api/preview/", // Preview endpoints are free
 		},
-		// Optional: Custom payment verifier
+		// Test mode accepts any "valid_" token so the example runs without a
+		// payment service. In production, drop it and set a verifier:
 		// PaymentVerifier: x402.NewHTTPVerifier(x402.VerifierConfig{
 		// 	Endpoint: "https://your-payment-service.com/verify",
 		// 	APIKey:   os.Getenv("PAYMENT_API_KEY"),
 		// }),
+		TestMode: true,
 	}
 
 	// Wrap with x402 middleware
@@ -136,7 +138,7 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 		"payment": map[string]interface{}{
 			"price":    100,
 			"currency": "USD",
-			"methods":  []string{"Bearer token", "X-Payment-Token header", "payment_token query param"},
+			"methods":  []string{"Bearer token", "X-Payment-Token header"},
 		},
 	})
 }
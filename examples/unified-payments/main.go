@@ -25,8 +25,8 @@ func main() {
 	// =====================================
 	config := x402.UnifiedPaymentConfig{
 		// Pricing
-		PricePerRequest: 100,   // $0.01 in cents (or 100 USDC units)
-		Currency:        "USD", // Primary currency
+		Price:    "0.01", // 1 cent on Stripe, 10000 USDC units on-chain
+		Currency: "USD",  // Primary currency
 
 		// Crypto settings
 		CryptoEnabled: true,
@@ -48,21 +48,25 @@ func main() {
 
 		// Callbacks
 		OnPaymentSuccess: func(ctx context.Context, payment *x402.CompletedPayment) {
-			log.Printf("Payment successful: %s via %s ($%.2f)",
+			log.Printf("Payment successful: %s via %s (%d %s smallest units)",
 				payment.ID,
 				payment.Rail,
-				float64(payment.Amount)/100,
+				payment.Amount,
+				payment.Currency,
 			)
 		},
-
-		// Exempt paths that don't require payment
-		ExemptPaths: []string{
-			"/health",
-			"/",
-			"/api/payment-methods",
-			"/api/onboarding/",
-			"/stripe/webhook",
+		OnPaymentFailure: func(ctx context.Context, failure *x402.PaymentFailure) {
+			log.Printf("Payment failed: %v", failure)
 		},
+
+		// Exempt paths that don't require payment. ExemptPaths match by
+		// prefix, so never list "/" here; the standard endpoints are exempted
+		// exactly through DynamicExemptions below.
+		ExemptPaths:       []string{"/health"},
+		DynamicExemptions: x402.NewExemptionList(),
+
+		// Saved preferences reorder the 402 for customers sending X-Customer-ID
+		PaymentPrefs: x402.NewInMemoryPaymentPrefsStore(),
 	}
 
 	// AI agent-specific config
@@ -75,9 +79,9 @@ func main() {
 		PreAuthStore:     x402.NewInMemoryPreAuthStore(),
 	}
 
-	// Create onboarding handler for payment method setup
-	prefsStore := x402.NewInMemoryPaymentPrefsStore()
-	onboarding := x402.NewOnboardingHandler(config, prefsStore)
+	// Create onboarding handler for payment method setup, saving to
+	// config.PaymentPrefs
+	onboarding := x402.NewOnboardingHandler(config, nil)
 
 	// =====================================
 	// Set up routes
@@ -99,28 +103,18 @@ func main() {
 	// Payment onboarding endpoints (exempt)
 	// =====================================
 
-	// List available payment methods
-	mux.HandleFunc("/api/payment-methods", onboarding.ListPaymentMethods)
-
-	// Set customer's preferred payment method
-	mux.HandleFunc("/api/onboarding/preferences", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			onboarding.GetPreferences(w, r)
-		case "POST":
-			onboarding.SetPreferredMethod(w, r)
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
-	})
-
-	// Create Stripe setup intent for saving card
-	mux.HandleFunc("/api/onboarding/stripe/setup", onboarding.CreateStripeSetupIntent)
-
-	// Stripe webhook handler
+	// Payment methods, preferences, Stripe setup and the Stripe webhook,
+	// mounted under /x402/ and exempted from payment
+	deps := x402.StandardEndpointDeps{Onboarding: onboarding}
 	if config.FiatEnabled && config.StripeSecretKey != "" {
-		stripeRail := x402.NewStripeRail(config.StripeSecretKey, config.StripeWebhookSecret)
-		mux.Handle("/stripe/webhook", stripeRail.WebhookHandler())
+		deps.Stripe = x402.NewStripeRail(config.StripeSecretKey, config.StripeWebhookSecret)
+	}
+	routes, err := x402.MountStandardEndpoints(mux, deps, x402.MountOptions{Exemptions: config.DynamicExemptions})
+	if err != nil {
+		log.Fatalf("Failed to mount payment endpoints: %v", err)
+	}
+	for _, route := range routes {
+		log.Printf("Mounted %s", route)
 	}
 
 	// =====================================
@@ -227,8 +221,8 @@ curl -X GET https://api.example.com/api/premium/data \
     <div class="card">
         <h2>API Endpoints</h2>
         <ul>
-            <li><code>GET /api/payment-methods</code> - List available payment methods</li>
-            <li><code>POST /api/onboarding/preferences</code> - Set preferred payment method</li>
+            <li><code>GET /x402/payment-methods</code> - List available payment methods</li>
+            <li><code>POST /x402/onboarding/preferences</code> - Set preferred payment method</li>
             <li><code>GET /api/premium/data</code> - Premium data (requires payment)</li>
             <li><code>GET /api/premium/ai-analysis</code> - AI analysis (requires payment)</li>
         </ul>
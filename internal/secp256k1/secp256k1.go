@@ -0,0 +1,103 @@
+// Package secp256k1 is Ethereum signing and recovery for the MCP signer and
+// x402's wallet signature checks. The curve arithmetic, RFC 6979 nonces and
+// low-s normalization are dcrd's constant-time secp256k1 implementation;
+// this package only adapts its compact signatures to Ethereum's r || s || v
+// layout and derives addresses.
+package secp256k1
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"golang.org/x/crypto/sha3"
+)
+
+var (
+	// N is the curve order; private keys are in [1, N-1]
+	N = secp256k1.S256().N
+
+	// HalfN is N/2; Ethereum signatures have s <= HalfN
+	HalfN = new(big.Int).Rsh(N, 1)
+)
+
+// privateKey converts key, which must be in [1, N-1]
+func privateKey(key *big.Int) (*secp256k1.PrivateKey, error) {
+	if key == nil || key.Sign() <= 0 || key.Cmp(N) >= 0 {
+		return nil, errors.New("private key out of range")
+	}
+	buf := make([]byte, 32)
+	key.FillBytes(buf)
+	return secp256k1.PrivKeyFromBytes(buf), nil
+}
+
+// Address returns the 20-byte Ethereum address of private key, or nil if
+// the key is out of range
+func Address(key *big.Int) []byte {
+	priv, err := privateKey(key)
+	if err != nil {
+		return nil
+	}
+	return ethAddress(priv.PubKey())
+}
+
+// ethAddress derives the 20-byte Ethereum address of a public key
+func ethAddress(pub *secp256k1.PublicKey) []byte {
+	// Uncompressed keys are 0x04 || X || Y; the address hashes X || Y
+	return Keccak256(pub.SerializeUncompressed()[1:])[12:]
+}
+
+// Keccak256 hashes the concatenation of data
+func Keccak256(data ...[]byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// Sign signs a 32-byte hash and returns r || s || v with v in {27, 28}.
+// The nonce is derived per RFC 6979 and s is normalized to the lower half
+// of the curve order, as Ethereum requires.
+func Sign(hash []byte, key *big.Int) ([]byte, error) {
+	if len(hash) != 32 {
+		return nil, errors.New("hash must be 32 bytes")
+	}
+	priv, err := privateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer priv.Zero()
+
+	// Compact signatures are v || r || s, v = 27 + recovery ID for
+	// uncompressed keys
+	compact := ecdsa.SignCompact(priv, hash, false)
+	sig := make([]byte, 65)
+	copy(sig, compact[1:])
+	sig[64] = compact[0]
+	return sig, nil
+}
+
+// Recover returns the address that produced a 65-byte signature over hash
+func Recover(hash, sig []byte) ([]byte, error) {
+	if len(hash) != 32 || len(sig) != 65 {
+		return nil, errors.New("invalid hash or signature length")
+	}
+	v := sig[64]
+	if v >= 27 {
+		v -= 27
+	}
+	if v > 3 {
+		return nil, errors.New("invalid recovery id")
+	}
+
+	compact := make([]byte, 65)
+	compact[0] = 27 + v
+	copy(compact[1:], sig[:64])
+	pub, _, err := ecdsa.RecoverCompact(compact, hash)
+	if err != nil {
+		return nil, errors.New("invalid signature")
+	}
+	return ethAddress(pub), nil
+}
@@ -0,0 +1,117 @@
+package mcp
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402"
+)
+
+// ============================================================================
+// KNOWN API REGISTRY
+// KnownAPIs tells the agent which APIs it is meant to use. With
+// AllowOnlyKnownAPIs set, tools that make outbound requests refuse any URL
+// outside those base URLs.
+// ============================================================================
+
+func (s *Server) handleListAPIs(ctx context.Context, args map[string]interface{}) (*ToolResult, error) {
+	data := listAPIsData{AllowOnlyKnownAPIs: s.config.AllowOnlyKnownAPIs, APIs: []apiResource{}}
+	for _, api := range s.config.KnownAPIs {
+		data.APIs = append(data.APIs, s.apiSnapshot(api))
+	}
+
+	if len(data.APIs) == 0 {
+		text := "No APIs are configured. Use `x402_discover` on any x402 API URL."
+		if s.config.AllowOnlyKnownAPIs {
+			text = "No APIs are configured, so no paid calls are allowed."
+		}
+		return structuredResult(text, text, data), nil
+	}
+
+	result := "# Known APIs\n\n"
+	if s.config.AllowOnlyKnownAPIs {
+		result += "Only these APIs may be called.\n\n"
+	}
+	for _, snapshot := range data.APIs {
+		api := snapshot.KnownAPI
+		result += fmt.Sprintf("## %s\n\n- **Base URL**: %s\n", api.Name, api.BaseURL)
+		if api.Description != "" {
+			result += fmt.Sprintf("- **Description**: %s\n", api.Description)
+		}
+		if !snapshot.Discovered {
+			result += "- **Costs**: unknown, use `x402_discover` to fetch pricing\n\n"
+			continue
+		}
+		result += "\n| Endpoint | Method | Cost |\n|----------|--------|------|\n"
+		for _, ep := range snapshot.Endpoints {
+			result += fmt.Sprintf("| %s | %s | %d %s |\n", ep.Path, ep.Method, ep.Cost, ep.Currency)
+		}
+		result += "\n"
+	}
+	summary := fmt.Sprintf("%d known APIs.", len(data.APIs))
+	if s.config.AllowOnlyKnownAPIs {
+		summary = fmt.Sprintf("%d known APIs; calls to other URLs are refused.", len(data.APIs))
+	}
+	return structuredResult(strings.TrimRight(result, "\n"), summary, data), nil
+}
+
+// listAPIsData is the structured result of x402_list_apis
+type listAPIsData struct {
+	AllowOnlyKnownAPIs bool          `json:"allowOnlyKnownApis"`
+	APIs               []apiResource `json:"apis"`
+}
+
+// checkAllowedURL returns an error result if AllowOnlyKnownAPIs is set and
+// rawURL is not under a known API's base URL
+func (s *Server) checkAllowedURL(rawURL string) *ToolResult {
+	if !s.config.AllowOnlyKnownAPIs || s.isKnownURL(rawURL) {
+		return nil
+	}
+	return errorResult(x402.ErrCodeInvalidRequest, fmt.Sprintf("%s is not a known API. Use `x402_list_apis` to see which APIs may be called.", rawURL))
+}
+
+// isKnownURL matches scheme and host exactly and the base path on a segment
+// boundary, so https://api.example.com/v1 does not allow /v10 or another host
+func (s *Server) isKnownURL(rawURL string) bool {
+	_, ok := s.knownAPIFor(rawURL)
+	return ok
+}
+
+// knownAPIFor returns the known API whose base URL rawURL is under
+func (s *Server) knownAPIFor(rawURL string) (KnownAPI, bool) {
+	target, err := url.Parse(rawURL)
+	if err != nil || target.Host == "" {
+		return KnownAPI{}, false
+	}
+
+	for _, api := range s.config.KnownAPIs {
+		base, err := url.Parse(api.BaseURL)
+		if err != nil || base.Host == "" {
+			continue
+		}
+		if !strings.EqualFold(base.Scheme, target.Scheme) || !strings.EqualFold(base.Host, target.Host) {
+			continue
+		}
+		basePath := strings.TrimSuffix(base.Path, "/")
+		targetPath := path.Clean("/" + target.Path)
+		if basePath == "" || targetPath == basePath || strings.HasPrefix(targetPath, basePath+"/") {
+			return api, true
+		}
+	}
+	return KnownAPI{}, false
+}
+
+// apiLabel names the API rawURL belongs to: its KnownAPIs name, or else its
+// scheme and host
+func (s *Server) apiLabel(rawURL string) string {
+	if api, ok := s.knownAPIFor(rawURL); ok {
+		return api.Name
+	}
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		return u.Scheme + "://" + u.Host
+	}
+	return rawURL
+}
@@ -0,0 +1,84 @@
+package mcp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAllowOnlyKnownAPIsRejectsOtherURLs(t *testing.T) {
+	api := newPaidAPI(t, `{"data":"premium"}`)
+	defer api.Close()
+
+	server := NewServer(ServerConfig{
+		HTTPClient:         api.Client(),
+		Signer:             testSigner(""),
+		KnownAPIs:          []KnownAPI{{Name: "premium", BaseURL: api.URL + "/api"}},
+		AllowOnlyKnownAPIs: true,
+	})
+	createBudget(t, server, 5000)
+	ctx := context.Background()
+
+	denied := []string{
+		"https://evil.example.com/api/data",
+		api.URL + "/apix/data",
+		api.URL + "/api/../admin",
+		api.URL + "/other",
+	}
+	for _, url := range denied {
+		for _, tool := range []string{"x402_call", "x402_discover", "x402_estimate"} {
+			result, _ := server.CallTool(ctx, tool, map[string]interface{}{"url": url})
+			if !result.IsError || !strings.Contains(result.Content[0].Text, "not a known API") {
+				t.Errorf("Expected %s to refuse %s, got: %s", tool, url, result.Content[0].Text)
+			}
+		}
+	}
+
+	result, _ := server.CallTool(ctx, "x402_call", map[string]interface{}{"url": api.URL + "/api/data"})
+	if result.IsError {
+		t.Errorf("Expected known API call to succeed, got: %s", result.Content[0].Text)
+	}
+}
+
+func TestKnownAPIsNotEnforcedByDefault(t *testing.T) {
+	server := NewServer(ServerConfig{
+		KnownAPIs: []KnownAPI{{Name: "weather", BaseURL: "https://weather.example.com"}},
+	})
+	if denied := server.checkAllowedURL("https://other.example.com/data"); denied != nil {
+		t.Errorf("Expected allowlist to be off by default, got: %s", denied.Content[0].Text)
+	}
+}
+
+func TestListAPIs(t *testing.T) {
+	server := NewServer(ServerConfig{
+		KnownAPIs: []KnownAPI{
+			{Name: "weather", BaseURL: "https://weather.example.com", Description: "Forecasts"},
+			{Name: "news", BaseURL: "https://news.example.com"},
+		},
+	})
+	server.cache["https://weather.example.com"] = &APIDiscoveryCache{
+		URL:       "https://weather.example.com",
+		Endpoints: []DiscoveredEndpoint{{Path: "/forecast", Method: "GET", Cost: 250, Currency: "USDC"}},
+		CachedAt:  time.Now(),
+		ExpiresAt: time.Now().Add(time.Minute),
+	}
+
+	result, err := server.CallTool(context.Background(), "x402_list_apis", map[string]interface{}{})
+	if err != nil || result.IsError {
+		t.Fatalf("Expected success, got %v %+v", err, result)
+	}
+	var list listAPIsData
+	decodeStructured(t, result, &list)
+	if len(list.APIs) != 2 || !list.APIs[0].Discovered || list.APIs[0].Endpoints[0].Cost != 250 || list.APIs[1].Discovered {
+		t.Errorf("Unexpected structured list: %+v", list)
+	}
+
+	result, _ = server.CallTool(context.Background(), "x402_list_apis", map[string]interface{}{"output": "markdown"})
+	text := result.Content[0].Text
+	for _, want := range []string{"weather", "Forecasts", "| /forecast | GET | 250 USDC |", "news", "unknown"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected list to contain %q, got:\n%s", want, text)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package mcp
+
+import (
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// DISCOVERY CACHE
+// Entries expire after DiscoveryCacheTTL and the cache holds at most
+// DiscoveryCacheMaxEntries APIs. An entry is dropped as soon as a paid call
+// is quoted a price that differs from the cached one, so the agent never
+// keeps planning with stale costs.
+// ============================================================================
+
+// cachedDiscovery returns the unexpired cache entry for baseURL
+func (s *Server) cachedDiscovery(baseURL string) (*APIDiscoveryCache, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cached, ok := s.cache[baseURL]
+	if !ok || !time.Now().Before(cached.ExpiresAt) {
+		return nil, false
+	}
+	return cached, true
+}
+
+// cacheDiscovery stores entry, evicting expired entries and then the oldest
+// ones to stay within DiscoveryCacheMaxEntries
+func (s *Server) cacheDiscovery(entry *APIDiscoveryCache) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cache[entry.URL] = entry
+	if len(s.cache) <= s.config.DiscoveryCacheMaxEntries {
+		return
+	}
+
+	now := time.Now()
+	for key, cached := range s.cache {
+		if !now.Before(cached.ExpiresAt) {
+			delete(s.cache, key)
+		}
+	}
+	for len(s.cache) > s.config.DiscoveryCacheMaxEntries {
+		var oldest string
+		for key, cached := range s.cache {
+			if oldest == "" || cached.CachedAt.Before(s.cache[oldest].CachedAt) {
+				oldest = key
+			}
+		}
+		delete(s.cache, oldest)
+	}
+}
+
+// invalidateOnPriceChange drops cache entries that list the called endpoint
+// at a different price than the 402 just quoted. It returns the base URLs
+// that were invalidated.
+func (s *Server) invalidateOnPriceChange(method, rawURL string, cost int64) []string {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stale []string
+	for key, cached := range s.cache {
+		for _, ep := range cachedEndpoints(cached, method, target) {
+			if ep.Cost != cost {
+				delete(s.cache, key)
+				stale = append(stale, cached.URL)
+				break
+			}
+		}
+	}
+	return stale
+}
+
+// cachedCost returns the price unexpired discovery results list for the
+// endpoint, so x402_call can refuse calls over max_cost without making them
+func (s *Server) cachedCost(method, rawURL string) (int64, bool) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return 0, false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	for _, cached := range s.cache {
+		if !now.Before(cached.ExpiresAt) {
+			continue
+		}
+		if endpoints := cachedEndpoints(cached, method, target); len(endpoints) > 0 {
+			return endpoints[0].Cost, true
+		}
+	}
+	return 0, false
+}
+
+// cachedEndpoints returns the endpoints of cached that target and method
+// call
+func cachedEndpoints(cached *APIDiscoveryCache, method string, target *url.URL) []DiscoveredEndpoint {
+	base, err := url.Parse(cached.URL)
+	if err != nil || !strings.EqualFold(base.Host, target.Host) {
+		return nil
+	}
+	basePath := strings.TrimSuffix(base.Path, "/")
+	if !strings.HasPrefix(target.Path, basePath) {
+		return nil
+	}
+	relative := strings.TrimPrefix(target.Path, basePath)
+
+	var matched []DiscoveredEndpoint
+	for _, ep := range cached.Endpoints {
+		if ep.Path != relative && ep.Path != target.Path {
+			continue
+		}
+		if ep.Method != "" && !strings.EqualFold(ep.Method, method) {
+			continue
+		}
+		matched = append(matched, ep)
+	}
+	return matched
+}
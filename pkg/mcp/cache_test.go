@@ -0,0 +1,146 @@
+package mcp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402"
+)
+
+// newDiscoverableAPI serves /ai/discover advertising /api/data at
+// advertised, while the endpoint itself charges 1000
+func newDiscoverableAPI(t *testing.T, advertised int64, discoveries *int32) *httptest.Server {
+	t.Helper()
+
+	paid := x402.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":"premium"}`))
+	}), x402.Config{PayTo: "0xseller", PricePerRequest: 1000, Network: "base-sepolia", TestMode: true})
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ai/discover" {
+			paid.ServeHTTP(w, r)
+			return
+		}
+		atomic.AddInt32(discoveries, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"endpoints":[{"path":"/api/data","method":"GET","cost":%d,"currency":"USDC"}]}`, advertised)
+	}))
+}
+
+func TestDiscoverRefreshBypassesCache(t *testing.T) {
+	var discoveries int32
+	api := newDiscoverableAPI(t, 1000, &discoveries)
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client()})
+	ctx := context.Background()
+
+	server.CallTool(ctx, "x402_discover", map[string]interface{}{"url": api.URL})
+	server.CallTool(ctx, "x402_discover", map[string]interface{}{"url": api.URL})
+	if n := atomic.LoadInt32(&discoveries); n != 1 {
+		t.Fatalf("Expected second discovery to be cached, got %d requests", n)
+	}
+
+	result, _ := server.CallTool(ctx, "x402_discover", map[string]interface{}{"url": api.URL, "refresh": true})
+	if n := atomic.LoadInt32(&discoveries); n != 2 {
+		t.Errorf("Expected refresh to query the API, got %d requests", n)
+	}
+	var discovery discoveryData
+	decodeStructured(t, result, &discovery)
+	if len(discovery.Endpoints) != 1 || discovery.Endpoints[0].Cost != 1000 {
+		t.Errorf("Expected refreshed endpoints, got %+v", discovery.Endpoints)
+	}
+}
+
+func TestCallInvalidatesCacheOnPriceChange(t *testing.T) {
+	var discoveries int32
+	api := newDiscoverableAPI(t, 500, &discoveries)
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client()})
+	ctx := context.Background()
+	createBudget(t, server, 5000)
+
+	server.CallTool(ctx, "x402_discover", map[string]interface{}{"url": api.URL})
+	if _, ok := server.cachedDiscovery(api.URL); !ok {
+		t.Fatal("Expected discovery to be cached")
+	}
+
+	// No signer, so the call stops after reading the 402 quote of 1000
+	server.CallTool(ctx, "x402_call", map[string]interface{}{"url": api.URL + "/api/data"})
+	if _, ok := server.cachedDiscovery(api.URL); ok {
+		t.Error("Expected cache entry to be invalidated after the price changed")
+	}
+
+	server.CallTool(ctx, "x402_discover", map[string]interface{}{"url": api.URL})
+	if n := atomic.LoadInt32(&discoveries); n != 2 {
+		t.Errorf("Expected rediscovery after invalidation, got %d requests", n)
+	}
+}
+
+func TestCallKeepsCacheWhenPriceMatches(t *testing.T) {
+	var discoveries int32
+	api := newDiscoverableAPI(t, 1000, &discoveries)
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client()})
+	ctx := context.Background()
+	createBudget(t, server, 5000)
+
+	server.CallTool(ctx, "x402_discover", map[string]interface{}{"url": api.URL})
+	server.CallTool(ctx, "x402_call", map[string]interface{}{"url": api.URL + "/api/data"})
+	if _, ok := server.cachedDiscovery(api.URL); !ok {
+		t.Error("Expected cache entry to survive a call at the cached price")
+	}
+}
+
+func TestDiscoveryCacheLimits(t *testing.T) {
+	server := NewServer(ServerConfig{DiscoveryCacheTTL: time.Minute, DiscoveryCacheMaxEntries: 2})
+
+	now := time.Now()
+	for i, u := range []string{"https://a.example", "https://b.example", "https://c.example"} {
+		server.cacheDiscovery(&APIDiscoveryCache{
+			URL:       u,
+			CachedAt:  now.Add(time.Duration(i) * time.Second),
+			ExpiresAt: now.Add(server.config.DiscoveryCacheTTL),
+		})
+	}
+
+	if len(server.cache) != 2 {
+		t.Fatalf("Expected 2 cached entries, got %d", len(server.cache))
+	}
+	if _, ok := server.cachedDiscovery("https://a.example"); ok {
+		t.Error("Expected oldest entry to be evicted")
+	}
+	if _, ok := server.cachedDiscovery("https://c.example"); !ok {
+		t.Error("Expected newest entry to be kept")
+	}
+}
+
+func TestDiscoverRendersFreeEndpoints(t *testing.T) {
+	discovery := x402.AIDiscoveryHandler(x402.AIFirstConfig{
+		Endpoints:   []x402.APIEndpoint{{Path: "/api/data", Method: "GET", Cost: 100, Currency: "USDC"}},
+		ExemptPaths: []string{"/health"},
+	})
+	api := httptest.NewServer(discovery)
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client()})
+	result, _ := server.CallTool(context.Background(), "x402_discover", map[string]interface{}{"url": api.URL})
+	var data discoveryData
+	decodeStructured(t, result, &data)
+	if len(data.FreeEndpoints) != 1 || data.FreeEndpoints[0].Path != "/health" {
+		t.Errorf("Expected /health listed as free, got %+v", data.FreeEndpoints)
+	}
+
+	result, _ = server.CallTool(context.Background(), "x402_discover", map[string]interface{}{"url": api.URL, "output": OutputMarkdown})
+	if !strings.Contains(result.Content[0].Text, "| /health* | any | exempt |") {
+		t.Errorf("Expected the free endpoint rendered, got: %s", result.Content[0].Text)
+	}
+}
@@ -0,0 +1,417 @@
+package mcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// CONFIG FILE
+// LoadConfig reads ServerConfig from JSON or YAML so the CLI does not need a
+// flag per option. String values may reference environment variables as
+// ${VAR} to keep secrets such as privateKey out of the file.
+//
+//	{
+//	  "privateKey": "${X402_PRIVATE_KEY}",
+//	  "network": "base",
+//	  "defaultBudget": 100000,
+//	  "maxBudgetPerCall": 5000,
+//	  "allowOnlyKnownApis": true,
+//	  "knownApis": [{"name": "weather", "baseUrl": "https://weather.example.com"}],
+//	  "storage": "~/.x402/mcp.json"
+//	}
+// ============================================================================
+
+// fileConfig is the on-disk form of ServerConfig
+type fileConfig struct {
+	WalletAddress      string     `json:"walletAddress"`
+	PrivateKey         string     `json:"privateKey"`
+	Network            string     `json:"network"`
+	Facilitator        string     `json:"facilitator"`
+	DefaultBudget      int64      `json:"defaultBudget"`
+	MaxBudgetPerCall   int64      `json:"maxBudgetPerCall"`
+	ConfirmAbove       int64      `json:"confirmAbove"`
+	DailySpendLimit    int64      `json:"dailySpendLimit"`
+	Currency           string     `json:"currency"`
+	KnownAPIs          []KnownAPI `json:"knownApis"`
+	AllowOnlyKnownAPIs bool       `json:"allowOnlyKnownApis"`
+	MaxResponseBytes   int        `json:"maxResponseBytes"`
+	ResponseHeaders    []string   `json:"responseHeaders"`
+	SessionIdleTimeout string     `json:"sessionIdleTimeout"` // Go duration, e.g. "30m"
+	AllowedOrigins     []string   `json:"allowedOrigins"`
+	Storage            string     `json:"storage"` // Path for FileStorage
+	MarkdownOutput     bool       `json:"markdownOutput"`
+
+	DiscoveryCacheTTL        string `json:"discoveryCacheTtl"` // Go duration, e.g. "10m"
+	DiscoveryCacheMaxEntries int    `json:"discoveryCacheMaxEntries"`
+}
+
+// LoadConfig reads a ServerConfig from path. Files ending in .yaml or .yml
+// are parsed as YAML (block mappings and sequences, scalars, and comments;
+// anchors and multi-line strings are not supported); anything else as JSON.
+// References to unset environment variables are an error.
+func LoadConfig(path string) (ServerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ServerConfig{}, err
+	}
+
+	var raw interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		raw, err = parseYAML(string(data))
+	default:
+		err = json.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return ServerConfig{}, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	var missing []string
+	raw = expandEnv(raw, &missing)
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return ServerConfig{}, fmt.Errorf("%s references unset environment variables: %s", path, strings.Join(missing, ", "))
+	}
+
+	// Round-trip through JSON so both formats share fileConfig's field names
+	normalized, err := json.Marshal(raw)
+	if err != nil {
+		return ServerConfig{}, err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(normalized)))
+	decoder.DisallowUnknownFields()
+	var fc fileConfig
+	if err := decoder.Decode(&fc); err != nil {
+		return ServerConfig{}, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	config := ServerConfig{
+		WalletAddress:      fc.WalletAddress,
+		PrivateKey:         fc.PrivateKey,
+		Network:            fc.Network,
+		Facilitator:        fc.Facilitator,
+		DefaultBudget:      fc.DefaultBudget,
+		MaxBudgetPerCall:   fc.MaxBudgetPerCall,
+		ConfirmAbove:       fc.ConfirmAbove,
+		DailySpendLimit:    fc.DailySpendLimit,
+		Currency:           fc.Currency,
+		KnownAPIs:          fc.KnownAPIs,
+		AllowOnlyKnownAPIs: fc.AllowOnlyKnownAPIs,
+		MaxResponseBytes:   fc.MaxResponseBytes,
+		ResponseHeaders:    fc.ResponseHeaders,
+		AllowedOrigins:     fc.AllowedOrigins,
+		MarkdownOutput:     fc.MarkdownOutput,
+
+		DiscoveryCacheMaxEntries: fc.DiscoveryCacheMaxEntries,
+	}
+	if fc.SessionIdleTimeout != "" {
+		if config.SessionIdleTimeout, err = time.ParseDuration(fc.SessionIdleTimeout); err != nil {
+			return ServerConfig{}, fmt.Errorf("sessionIdleTimeout: %w", err)
+		}
+	}
+	if fc.DiscoveryCacheTTL != "" {
+		if config.DiscoveryCacheTTL, err = time.ParseDuration(fc.DiscoveryCacheTTL); err != nil {
+			return ServerConfig{}, fmt.Errorf("discoveryCacheTtl: %w", err)
+		}
+	}
+	for i, api := range config.KnownAPIs {
+		if api.Name == "" || api.BaseURL == "" {
+			return ServerConfig{}, fmt.Errorf("knownApis[%d]: name and baseUrl are required", i)
+		}
+	}
+	if fc.Storage != "" {
+		storagePath := fc.Storage
+		if rest, ok := strings.CutPrefix(storagePath, "~/"); ok {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return ServerConfig{}, err
+			}
+			storagePath = filepath.Join(home, rest)
+		}
+		if config.Storage, err = NewFileStorage(storagePath); err != nil {
+			return ServerConfig{}, fmt.Errorf("storage: %w", err)
+		}
+	}
+	return config, nil
+}
+
+// expandEnv replaces ${VAR} and $VAR in every string value of v
+func expandEnv(v interface{}, missing *[]string) interface{} {
+	switch val := v.(type) {
+	case string:
+		return os.Expand(val, func(name string) string {
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				*missing = append(*missing, name)
+			}
+			return value
+		})
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = expandEnv(item, missing)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = expandEnv(item, missing)
+		}
+	}
+	return v
+}
+
+// ============================================================================
+// YAML SUBSET
+// ============================================================================
+
+type yamlLine struct {
+	indent int
+	text   string
+	num    int
+}
+
+// parseYAML parses the block-style YAML subset used by config files into
+// the same map/slice/scalar values encoding/json produces
+func parseYAML(src string) (interface{}, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(strings.TrimLeft(raw, " "), "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		text := strings.TrimRight(stripYAMLComment(raw), " ")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		lines = append(lines, yamlLine{indent: len(text) - len(trimmed), text: trimmed, num: i + 1})
+	}
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+
+	p := &yamlParser{lines: lines}
+	value, err := p.parseBlock(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].num)
+	}
+	return value, nil
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	if isYAMLSequenceItem(p.lines[p.pos].text) {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	items := []interface{}{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent != indent || !isYAMLSequenceItem(line.text) {
+			break
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+
+		switch {
+		case rest == "":
+			p.pos++
+			if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+				items = append(items, nil)
+				continue
+			}
+			item, err := p.parseBlock(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+
+		case yamlKeyIndex(rest) >= 0:
+			// "- key: value" starts a mapping indented to where the key begins
+			p.lines[p.pos] = yamlLine{indent: line.indent + len(line.text) - len(rest), text: rest, num: line.num}
+			item, err := p.parseMapping(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+
+		default:
+			value, err := parseYAMLScalar(rest, line.num)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+			p.pos++
+		}
+	}
+	return items, nil
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.num)
+		}
+		if isYAMLSequenceItem(line.text) {
+			break
+		}
+
+		idx := yamlKeyIndex(line.text)
+		if idx < 0 {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", line.num)
+		}
+		key, err := parseYAMLKey(line.text[:idx], line.num)
+		if err != nil {
+			return nil, err
+		}
+		rest := strings.TrimSpace(line.text[idx+1:])
+		p.pos++
+
+		if rest != "" {
+			if m[key], err = parseYAMLScalar(rest, line.num); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Nested block: deeper indentation, or a sequence at the same level
+		switch {
+		case p.pos < len(p.lines) && p.lines[p.pos].indent > indent:
+			m[key], err = p.parseBlock(p.lines[p.pos].indent)
+		case p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYAMLSequenceItem(p.lines[p.pos].text):
+			m[key], err = p.parseSequence(indent)
+		default:
+			m[key] = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func isYAMLSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// yamlKeyIndex returns the index of the ':' ending a mapping key, or -1
+func yamlKeyIndex(text string) int {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 {
+				quote = c
+			}
+		case c == ':' && (i == len(text)-1 || text[i+1] == ' '):
+			return i
+		}
+	}
+	return -1
+}
+
+func parseYAMLKey(raw string, num int) (string, error) {
+	key := strings.TrimSpace(raw)
+	if len(key) > 0 && (key[0] == '"' || key[0] == '\'') {
+		value, err := parseYAMLScalar(key, num)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprint(value), nil
+	}
+	return key, nil
+}
+
+func parseYAMLScalar(raw string, num int) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		value, err := strconv.Unquote(raw)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid quoted string", num)
+		}
+		return value, nil
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return nil, fmt.Errorf("line %d: invalid quoted string", num)
+		}
+		return strings.ReplaceAll(raw[1:len(raw)-1], "''", "'"), nil
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return nil, fmt.Errorf("line %d: unterminated flow sequence", num)
+		}
+		items := []interface{}{}
+		inner := strings.TrimSpace(raw[1 : len(raw)-1])
+		if inner == "" {
+			return items, nil
+		}
+		for _, part := range strings.Split(inner, ",") {
+			item, err := parseYAMLScalar(strings.TrimSpace(part), num)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case strings.HasPrefix(raw, "{"), strings.HasPrefix(raw, "&"), strings.HasPrefix(raw, "*"),
+		strings.HasPrefix(raw, "|"), strings.HasPrefix(raw, ">"):
+		return nil, fmt.Errorf("line %d: unsupported YAML syntax %q", num, raw)
+	}
+
+	switch raw {
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	case "null", "Null", "NULL", "~":
+		return nil, nil
+	}
+	if n, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(raw, 64); err == nil {
+		return f, nil
+	}
+	return raw, nil
+}
+
+// stripYAMLComment removes a trailing "# comment" outside quotes
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" :-[,", line[i-1]) >= 0):
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' '):
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,106 @@
+package mcp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	t.Setenv("TEST_X402_KEY", "0xsecret")
+	path := writeConfig(t, "mcp.json", `{
+		"privateKey": "${TEST_X402_KEY}",
+		"network": "base-sepolia",
+		"defaultBudget": 50000,
+		"maxBudgetPerCall": 2000,
+		"allowOnlyKnownApis": true,
+		"sessionIdleTimeout": "10m",
+		"discoveryCacheTtl": "1m",
+		"discoveryCacheMaxEntries": 20,
+		"knownApis": [{"name": "weather", "baseUrl": "https://weather.example.com", "description": "Forecasts"}]
+	}`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.PrivateKey != "0xsecret" {
+		t.Errorf("Expected expanded private key, got %s", config.PrivateKey)
+	}
+	if config.DefaultBudget != 50000 || config.MaxBudgetPerCall != 2000 {
+		t.Errorf("Expected budget limits 50000/2000, got %d/%d", config.DefaultBudget, config.MaxBudgetPerCall)
+	}
+	if !config.AllowOnlyKnownAPIs || len(config.KnownAPIs) != 1 || config.KnownAPIs[0].BaseURL != "https://weather.example.com" {
+		t.Errorf("Expected known API allowlist, got %+v", config.KnownAPIs)
+	}
+	if config.SessionIdleTimeout != 10*time.Minute {
+		t.Errorf("Expected 10m idle timeout, got %v", config.SessionIdleTimeout)
+	}
+	if config.DiscoveryCacheTTL != time.Minute || config.DiscoveryCacheMaxEntries != 20 {
+		t.Errorf("Expected discovery cache 1m/20, got %v/%d", config.DiscoveryCacheTTL, config.DiscoveryCacheMaxEntries)
+	}
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	t.Setenv("TEST_X402_KEY", "0xsecret")
+	path := writeConfig(t, "mcp.yaml", `# x402 MCP server
+privateKey: ${TEST_X402_KEY}
+network: "base"
+defaultBudget: 100000 # 0.10 USDC
+allowOnlyKnownApis: true
+allowedOrigins: [https://app.example.com, "https://admin.example.com"]
+knownApis:
+  - name: weather
+    baseUrl: https://weather.example.com
+    description: 'Weather # forecasts'
+  - name: news
+    baseUrl: https://news.example.com
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.PrivateKey != "0xsecret" || config.Network != "base" || config.DefaultBudget != 100000 {
+		t.Errorf("Unexpected scalars: %+v", config)
+	}
+	if len(config.AllowedOrigins) != 2 || config.AllowedOrigins[1] != "https://admin.example.com" {
+		t.Errorf("Expected 2 allowed origins, got %v", config.AllowedOrigins)
+	}
+	if len(config.KnownAPIs) != 2 {
+		t.Fatalf("Expected 2 known APIs, got %d", len(config.KnownAPIs))
+	}
+	if config.KnownAPIs[0].Description != "Weather # forecasts" || config.KnownAPIs[1].Name != "news" {
+		t.Errorf("Unexpected known APIs: %+v", config.KnownAPIs)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	os.Unsetenv("TEST_X402_MISSING")
+
+	tests := []struct {
+		name, file, content, want string
+	}{
+		{"unset env var", "a.json", `{"privateKey": "${TEST_X402_MISSING}"}`, "TEST_X402_MISSING"},
+		{"unknown field", "b.json", `{"privateKeyFile": "key.hex"}`, "unknown field"},
+		{"known API without URL", "c.yaml", "knownApis:\n  - name: weather\n", "baseUrl"},
+		{"bad indentation", "d.yaml", "network: base\n   currency: USDC\n", "line 2"},
+	}
+	for _, tt := range tests {
+		_, err := LoadConfig(writeConfig(t, tt.file, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !unix
+
+package mcp
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// lockFileTimeout bounds how long a writer waits for another process
+const lockFileTimeout = 10 * time.Second
+
+// lockFile holds path as an exclusive lock by creating it; platforms without
+// flock fall back to O_EXCL creation
+func lockFile(path string) (func(), error) {
+	deadline := time.Now().Add(lockFileTimeout)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			f.Close()
+			return func() { _ = os.Remove(path) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("timed out waiting for storage lock " + path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
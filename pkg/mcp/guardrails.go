@@ -0,0 +1,205 @@
+package mcp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402"
+)
+
+// ============================================================================
+// SPENDING GUARDRAILS
+// Operator limits that apply on top of session budgets:
+//
+//	MaxBudgetPerCall  no single call may cost more
+//	DailySpendLimit   total charged per UTC day, across all sessions
+//	ConfirmAbove      calls costing more need a one-time confirmation token
+// ============================================================================
+
+// ErrCodeConfirmationRequired marks a paid call held for human confirmation
+const ErrCodeConfirmationRequired = "CONFIRMATION_REQUIRED"
+
+// confirmationTTL is how long a confirmation token can be redeemed
+const confirmationTTL = 5 * time.Minute
+
+// pendingConfirmation is a paid call awaiting approval
+type pendingConfirmation struct {
+	sessionID string
+	method    string
+	url       string
+	cost      int64
+	expiresAt time.Time
+}
+
+// confirmationData is the structured result of a call held for confirmation
+type confirmationData struct {
+	ConfirmationRequired bool      `json:"confirmationRequired"`
+	ConfirmationToken    string    `json:"confirmationToken"`
+	URL                  string    `json:"url"`
+	Method               string    `json:"method"`
+	Cost                 int64     `json:"cost"`
+	Currency             string    `json:"currency"`
+	ExpiresAt            time.Time `json:"expiresAt"`
+}
+
+// checkCallLimits enforces MaxBudgetPerCall on a quoted cost
+func (s *Server) checkCallLimits(cost int64) *ToolResult {
+	limit := s.config.MaxBudgetPerCall
+	if limit <= 0 || cost <= limit {
+		return nil
+	}
+	return errorResult(x402.ErrCodeInsufficientBudget, fmt.Sprintf(
+		"Cost (%d %s) exceeds the per-call limit of %d %s set by the operator. Use a cheaper endpoint or request less data.",
+		cost, s.config.Currency, limit, s.config.Currency,
+	)).withDetails(map[string]string{
+		"cost":             strconv.FormatInt(cost, 10),
+		"maxBudgetPerCall": strconv.FormatInt(limit, 10),
+	})
+}
+
+// requireConfirmation returns a confirmation-required result unless cost is
+// under ConfirmAbove or token approves this exact call. Tokens are single
+// use and bound to the session, method, URL, and a maximum cost.
+func (s *Server) requireConfirmation(sessionID, method, url string, cost int64, token string) *ToolResult {
+	if s.config.ConfirmAbove <= 0 || cost <= s.config.ConfirmAbove {
+		return nil
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if token != "" {
+		pending, ok := s.confirmations[token]
+		delete(s.confirmations, token)
+		if ok && now.Before(pending.expiresAt) && pending.sessionID == sessionID &&
+			pending.method == method && pending.url == url && cost <= pending.cost {
+			return nil
+		}
+	}
+
+	for t, pending := range s.confirmations {
+		if !now.Before(pending.expiresAt) {
+			delete(s.confirmations, t)
+		}
+	}
+
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	data := confirmationData{
+		ConfirmationRequired: true,
+		ConfirmationToken:    "confirm_" + hex.EncodeToString(b),
+		URL:                  url,
+		Method:               method,
+		Cost:                 cost,
+		Currency:             s.config.Currency,
+		ExpiresAt:            now.Add(confirmationTTL),
+	}
+	s.confirmations[data.ConfirmationToken] = pendingConfirmation{
+		sessionID: sessionID,
+		method:    method,
+		url:       url,
+		cost:      cost,
+		expiresAt: data.ExpiresAt,
+	}
+
+	note := ""
+	if token != "" {
+		note = "The confirmation token was invalid, expired, or already used. "
+	}
+	summary := fmt.Sprintf(
+		"Confirmation required: %s %s costs %d %s, above the %d %s approval threshold. %sAsk the user to approve, then repeat the call with confirmation_token %q (valid for %s). Nothing was charged.",
+		method, url, cost, data.Currency, s.config.ConfirmAbove, data.Currency, note, data.ConfirmationToken, confirmationTTL,
+	)
+	markdown := fmt.Sprintf(
+		"# ⚠️ Confirmation Required\n\n- **URL**: %s %s\n- **Cost**: %d %s\n- **Threshold**: %d %s\n- **Confirmation Token**: `%s`\n\n%sAsk the user to approve this payment, then call `x402_call` again with `confirmation_token`.",
+		method, url, cost, data.Currency, s.config.ConfirmAbove, data.Currency, data.ConfirmationToken, note,
+	)
+	return structuredResult(markdown, summary, data)
+}
+
+// reserveDaily counts cost against DailySpendLimit until the call settles
+func (s *Server) reserveDaily(cost int64) *ToolResult {
+	if s.config.DailySpendLimit <= 0 {
+		return nil
+	}
+
+	s.dailyMu.Lock()
+	defer s.dailyMu.Unlock()
+
+	dayStart := time.Now().UTC().Truncate(24 * time.Hour)
+	spent, err := s.spentSince(dayStart)
+	if err != nil {
+		return errorResult(x402.ErrCodeServerError, fmt.Sprintf("Failed to read today's spending: %v", err))
+	}
+
+	limit := s.config.DailySpendLimit
+	if spent+s.dailyInFlight+cost > limit {
+		available := limit - spent - s.dailyInFlight
+		if available < 0 {
+			available = 0
+		}
+		result := errorResult(x402.ErrCodeRateLimited, fmt.Sprintf(
+			"Daily spending limit reached: %d of %d %s left today, this call costs %d. The limit resets at 00:00 UTC.",
+			available, limit, s.config.Currency, cost,
+		)).withDetails(map[string]string{
+			"dailySpendLimit": strconv.FormatInt(limit, 10),
+			"spentToday":      strconv.FormatInt(spent, 10),
+			"cost":            strconv.FormatInt(cost, 10),
+		})
+		if data, ok := result.data.(toolErrorData); ok {
+			data.Error.RetryAfter = int(time.Until(dayStart.Add(24*time.Hour)).Seconds()) + 1
+			result.data = data
+		}
+		return result
+	}
+
+	s.dailyInFlight += cost
+	return nil
+}
+
+// settleDaily releases a reservation made by reserveDaily
+func (s *Server) settleDaily(tx Transaction, charged bool) {
+	if s.config.DailySpendLimit <= 0 {
+		return
+	}
+
+	s.dailyMu.Lock()
+	defer s.dailyMu.Unlock()
+
+	s.dailyInFlight -= tx.Amount
+	if charged && s.config.Storage == nil {
+		day := tx.Timestamp.UTC().Format("2006-01-02")
+		if s.dailyDay != day {
+			s.dailyDay, s.dailySpent = day, 0
+		}
+		s.dailySpent += tx.Amount
+	}
+}
+
+// spentSince totals charged calls since dayStart. With Storage the
+// transaction log is the source of truth, so the limit survives restarts and
+// is shared by servers using the same store.
+func (s *Server) spentSince(dayStart time.Time) (int64, error) {
+	if s.config.Storage == nil {
+		if s.dailyDay != dayStart.Format("2006-01-02") {
+			return 0, nil
+		}
+		return s.dailySpent, nil
+	}
+
+	txs, err := s.config.Storage.ListTransactions(TransactionFilter{Since: dayStart})
+	if err != nil {
+		return 0, err
+	}
+	var spent int64
+	for _, tx := range txs {
+		if tx.Success {
+			spent += tx.Amount
+		}
+	}
+	return spent, nil
+}
@@ -0,0 +1,149 @@
+package mcp
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402"
+)
+
+func TestMaxBudgetPerCallRejectsExpensiveCalls(t *testing.T) {
+	api := newPaidAPI(t, `{"data":"premium"}`)
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client(), Signer: testSigner(""), MaxBudgetPerCall: 500})
+	createBudget(t, server, 5000)
+
+	result, _ := server.CallTool(context.Background(), "x402_call", map[string]interface{}{"url": api.URL + "/api/data"})
+	var data toolErrorData
+	decodeStructured(t, result, &data)
+	if !result.IsError || data.Error.Code != x402.ErrCodeInsufficientBudget || data.Error.Action != "reduce_scope" {
+		t.Errorf("Expected per-call limit rejection, got %+v", data.Error)
+	}
+	if data.Error.Details["maxBudgetPerCall"] != "500" {
+		t.Errorf("Expected limit in details, got %v", data.Error.Details)
+	}
+	if server.budgets[DefaultSessionID].Remaining != 5000 {
+		t.Errorf("Expected nothing charged, got %d remaining", server.budgets[DefaultSessionID].Remaining)
+	}
+}
+
+func TestConfirmAboveTokenRoundTrip(t *testing.T) {
+	api := newPaidAPI(t, `{"data":"premium"}`)
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client(), Signer: testSigner(""), ConfirmAbove: 500})
+	createBudget(t, server, 5000)
+	ctx := context.Background()
+	url := api.URL + "/api/data"
+
+	result, _ := server.CallTool(ctx, "x402_call", map[string]interface{}{"url": url})
+	var held confirmationData
+	decodeStructured(t, result, &held)
+	if result.IsError || !held.ConfirmationRequired || held.ConfirmationToken == "" || held.Cost != 1000 {
+		t.Fatalf("Expected confirmation-required result, got %+v", held)
+	}
+	if server.budgets[DefaultSessionID].Remaining != 5000 {
+		t.Error("Expected nothing charged before confirmation")
+	}
+
+	// A token only approves the call it was issued for
+	result, _ = server.CallTool(ctx, "x402_call", map[string]interface{}{
+		"url":                api.URL + "/api/other",
+		"confirmation_token": held.ConfirmationToken,
+	})
+	var other confirmationData
+	decodeStructured(t, result, &other)
+	if !other.ConfirmationRequired {
+		t.Error("Expected token for another URL to be rejected")
+	}
+
+	// The mismatched attempt consumed the first token; confirm a fresh one
+	result, _ = server.CallTool(ctx, "x402_call", map[string]interface{}{"url": url})
+	decodeStructured(t, result, &held)
+	result, _ = server.CallTool(ctx, "x402_call", map[string]interface{}{
+		"url":                url,
+		"confirmation_token": held.ConfirmationToken,
+	})
+	var paid callData
+	decodeStructured(t, result, &paid)
+	if result.IsError || !paid.Paid || paid.Amount != 1000 {
+		t.Fatalf("Expected confirmed call to pay, got %+v", paid)
+	}
+
+	// Tokens are single use
+	result, _ = server.CallTool(ctx, "x402_call", map[string]interface{}{
+		"url":                url,
+		"confirmation_token": held.ConfirmationToken,
+	})
+	var reused confirmationData
+	decodeStructured(t, result, &reused)
+	if !reused.ConfirmationRequired {
+		t.Error("Expected reused token to require confirmation again")
+	}
+	if server.budgets[DefaultSessionID].Remaining != 4000 {
+		t.Errorf("Expected exactly one charge, got %d remaining", server.budgets[DefaultSessionID].Remaining)
+	}
+}
+
+func TestDailySpendLimit(t *testing.T) {
+	api := newPaidAPI(t, `{"data":"premium"}`)
+	defer api.Close()
+
+	storage, err := NewFileStorage(filepath.Join(t.TempDir(), "mcp.json"))
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	config := ServerConfig{HTTPClient: api.Client(), Signer: testSigner(""), DailySpendLimit: 1500, Storage: storage}
+	ctx := context.Background()
+	args := map[string]interface{}{"url": api.URL + "/api/data"}
+
+	server := NewServer(config)
+	createBudget(t, server, 5000)
+	if result, _ := server.CallTool(ctx, "x402_call", args); result.IsError {
+		t.Fatalf("Expected first call under the limit to succeed: %s", result.Content[0].Text)
+	}
+
+	result, _ := server.CallTool(ctx, "x402_call", args)
+	var data toolErrorData
+	decodeStructured(t, result, &data)
+	if !result.IsError || data.Error.Code != x402.ErrCodeRateLimited || data.Error.RetryAfter <= 0 {
+		t.Errorf("Expected daily limit rejection with retryAfter, got %+v", data.Error)
+	}
+
+	// Today's spending is read from storage, so a restart does not reset it
+	restarted := NewServer(config)
+	result, _ = restarted.CallTool(ctx, "x402_call", args)
+	if !result.IsError {
+		t.Error("Expected daily limit to survive a restart")
+	}
+	if restarted.budgets[DefaultSessionID].Remaining != 4000 {
+		t.Errorf("Expected rejected call not to reserve budget, got %d remaining", restarted.budgets[DefaultSessionID].Remaining)
+	}
+}
+
+func TestDailySpendLimitInMemory(t *testing.T) {
+	api := newPaidAPI(t, `{"data":"premium"}`)
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client(), Signer: testSigner(""), DailySpendLimit: 2000})
+	ctx := context.Background()
+	args := map[string]interface{}{"url": api.URL + "/api/data"}
+
+	// The limit spans sessions
+	for _, session := range []string{"a", "b", "c"} {
+		sctx := WithSession(ctx, session)
+		server.CallTool(sctx, "x402_budget", map[string]interface{}{"action": "create", "amount": float64(5000)})
+		result, _ := server.CallTool(sctx, "x402_call", args)
+		if session == "c" && !result.IsError {
+			t.Error("Expected third call to exceed the daily limit")
+		}
+		if session != "c" && result.IsError {
+			t.Errorf("Expected call in session %s to succeed: %s", session, result.Content[0].Text)
+		}
+	}
+	if server.dailyInFlight != 0 {
+		t.Errorf("Expected no in-flight reservations, got %d", server.dailyInFlight)
+	}
+}
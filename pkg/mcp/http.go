@@ -0,0 +1,352 @@
+package mcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// TRANSPORT: STREAMABLE HTTP
+// https://modelcontextprotocol.io/specification/2025-03-26/basic/transports
+//
+//	POST   /mcp  client messages (single or batch); responses as JSON or SSE
+//	GET    /mcp  SSE stream for server-to-client notifications
+//	DELETE /mcp  end the session
+// ============================================================================
+
+// maxMessageBytes bounds a POSTed JSON-RPC message or batch
+const maxMessageBytes = 4 << 20
+
+// sseKeepAlive is how often idle SSE streams get a comment line so proxies
+// do not time them out
+const sseKeepAlive = 15 * time.Second
+
+// errNoStream is returned by Notify when the session has no open SSE stream
+var errNoStream = errors.New("no open stream for session")
+
+// ListenHTTP serves the streamable HTTP transport at /mcp on addr
+func (s *Server) ListenHTTP(addr string) error {
+	return s.HTTPServer(addr).ListenAndServe()
+}
+
+// HTTPServer returns an *http.Server serving HTTPHandler at /mcp. Open SSE
+// streams are closed when the server shuts down so Shutdown can complete.
+func (s *Server) HTTPServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/mcp", s.HTTPHandler())
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	srv.RegisterOnShutdown(s.closeAllStreams)
+	return srv
+}
+
+// HTTPHandler serves the streamable HTTP transport. The initialize response
+// sets Mcp-Session-Id, which every later request must send.
+func (s *Server) HTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.originAllowed(r) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			s.handleHTTPPost(w, r)
+		case http.MethodGet:
+			s.handleHTTPStream(w, r)
+		case http.MethodDelete:
+			if !s.EndSession(r.Header.Get(SessionHeader)) {
+				http.Error(w, "Unknown session", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func (s *Server) handleHTTPPost(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxMessageBytes))
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	messages, batch, err := decodeMessages(body)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		s.sendError(json.NewEncoder(w), nil, ParseError, "Parse error")
+		return
+	}
+
+	initialize := false
+	for _, msg := range messages {
+		if msg.Method == "initialize" {
+			initialize = true
+		}
+	}
+
+	var sessionID string
+	if initialize {
+		sessionID = s.newSession()
+		w.Header().Set(SessionHeader, sessionID)
+	} else {
+		sessionID = r.Header.Get(SessionHeader)
+		status, message := http.StatusOK, ""
+		switch {
+		case sessionID == "":
+			status, message = http.StatusBadRequest, "Missing "+SessionHeader+" header"
+		case !s.touchSession(sessionID):
+			status, message = http.StatusNotFound, "Unknown or expired session"
+		}
+		if status != http.StatusOK {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			s.sendError(json.NewEncoder(w), messages[0].ID, InvalidRequest, message)
+			return
+		}
+	}
+
+	ctx := WithSession(r.Context(), sessionID)
+	var responses []json.RawMessage
+	for _, msg := range messages {
+		if msg.Method == "" {
+			// A response to a server request; nothing is awaiting it
+			continue
+		}
+		var buf bytes.Buffer
+		s.handleRequestContext(ctx, json.NewEncoder(&buf), msg)
+		if buf.Len() > 0 {
+			responses = append(responses, json.RawMessage(bytes.TrimSpace(buf.Bytes())))
+		}
+	}
+
+	// Only notifications and responses: acknowledge without a body
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if !acceptsJSON(r) && accepts(r, "text/event-stream") {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		for _, resp := range responses {
+			writeSSEEvent(w, resp)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if batch {
+		_ = json.NewEncoder(w).Encode(responses)
+		return
+	}
+	_, _ = w.Write(append(responses[0], '\n'))
+}
+
+// handleHTTPStream holds an SSE stream open for server-to-client messages
+func (s *Server) handleHTTPStream(w http.ResponseWriter, r *http.Request) {
+	if !accepts(r, "text/event-stream") {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "GET requires Accept: text/event-stream", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := r.Header.Get(SessionHeader)
+	if sessionID == "" {
+		http.Error(w, "Missing "+SessionHeader+" header", http.StatusBadRequest)
+		return
+	}
+	if !s.touchSession(sessionID) {
+		http.Error(w, "Unknown or expired session", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := s.openStream(sessionID)
+	if ch == nil {
+		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.dropStream(sessionID, ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(w, ": stream open\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeSSEEvent(w, msg)
+			flusher.Flush()
+		case <-keepAlive.C:
+			_, _ = io.WriteString(w, ": ping\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Notify sends a JSON-RPC notification to every open SSE stream of a session
+func (s *Server) Notify(sessionID, method string, params interface{}) error {
+	msg, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+
+	streams := s.streams[sessionID]
+	if len(streams) == 0 {
+		return errNoStream
+	}
+	for ch := range streams {
+		select {
+		case ch <- msg:
+		default:
+			// Slow reader: drop rather than block the caller
+		}
+	}
+	return nil
+}
+
+func (s *Server) openStream(sessionID string) chan []byte {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+
+	if s.streamsClosed {
+		return nil
+	}
+	ch := make(chan []byte, 16)
+	if s.streams[sessionID] == nil {
+		s.streams[sessionID] = make(map[chan []byte]struct{})
+	}
+	s.streams[sessionID][ch] = struct{}{}
+	return ch
+}
+
+func (s *Server) dropStream(sessionID string, ch chan []byte) {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+
+	if _, ok := s.streams[sessionID][ch]; ok {
+		delete(s.streams[sessionID], ch)
+		close(ch)
+	}
+	if len(s.streams[sessionID]) == 0 {
+		delete(s.streams, sessionID)
+	}
+}
+
+// closeStreams ends all SSE streams of a session
+func (s *Server) closeStreams(sessionID string) {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+
+	for ch := range s.streams[sessionID] {
+		close(ch)
+	}
+	delete(s.streams, sessionID)
+}
+
+// closeAllStreams ends every SSE stream and refuses new ones (server shutdown)
+func (s *Server) closeAllStreams() {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+
+	s.streamsClosed = true
+	for id, streams := range s.streams {
+		for ch := range streams {
+			close(ch)
+		}
+		delete(s.streams, id)
+	}
+}
+
+// originAllowed guards against DNS rebinding: browsers always send Origin
+func (s *Server) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(s.config.AllowedOrigins) > 0 {
+		for _, allowed := range s.config.AllowedOrigins {
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// decodeMessages parses a single JSON-RPC message or a batch
+func decodeMessages(body []byte) ([]*JSONRPCRequest, bool, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var batch []*JSONRPCRequest
+		if err := json.Unmarshal(trimmed, &batch); err != nil {
+			return nil, true, err
+		}
+		if len(batch) == 0 {
+			return nil, true, errors.New("empty batch")
+		}
+		return batch, true, nil
+	}
+
+	var msg JSONRPCRequest
+	if err := json.Unmarshal(trimmed, &msg); err != nil {
+		return nil, false, err
+	}
+	return []*JSONRPCRequest{&msg}, false, nil
+}
+
+func writeSSEEvent(w io.Writer, data []byte) {
+	_, _ = fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+}
+
+// acceptsJSON treats a missing Accept header as JSON for older clients
+func acceptsJSON(r *http.Request) bool {
+	return r.Header.Get("Accept") == "" || accepts(r, "application/json") || accepts(r, "*/*")
+}
+
+func accepts(r *http.Request, mediaType string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.EqualFold(strings.TrimSpace(strings.SplitN(part, ";", 2)[0]), mediaType) {
+			return true
+		}
+	}
+	return false
+}
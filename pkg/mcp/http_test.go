@@ -0,0 +1,239 @@
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mcpClient drives the streamable HTTP transport like an MCP client
+type mcpClient struct {
+	t         *testing.T
+	url       string
+	sessionID string
+}
+
+func (c *mcpClient) post(body string) *http.Response {
+	c.t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, c.url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	if c.sessionID != "" {
+		req.Header.Set(SessionHeader, c.sessionID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("Request failed: %v", err)
+	}
+	return resp
+}
+
+func (c *mcpClient) call(body string) JSONRPCResponse {
+	c.t.Helper()
+	resp := c.post(body)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	var rpcResp JSONRPCResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		c.t.Fatalf("Invalid response: %v", err)
+	}
+	if rpcResp.Error != nil {
+		c.t.Fatalf("Unexpected JSON-RPC error: %+v", rpcResp.Error)
+	}
+	return rpcResp
+}
+
+func TestStreamableHTTPFlow(t *testing.T) {
+	server := NewServer(ServerConfig{})
+	ts := httptest.NewServer(server.HTTPHandler())
+	defer ts.Close()
+
+	client := &mcpClient{t: t, url: ts.URL}
+
+	// initialize issues a session and negotiates the protocol revision
+	resp := client.post(`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"protocolVersion":"2025-03-26"}}`)
+	client.sessionID = resp.Header.Get(SessionHeader)
+	var initResp JSONRPCResponse
+	json.NewDecoder(resp.Body).Decode(&initResp)
+	resp.Body.Close()
+	if client.sessionID == "" {
+		t.Fatal("Expected Mcp-Session-Id on initialize")
+	}
+	if v := initResp.Result.(map[string]interface{})["protocolVersion"]; v != "2025-03-26" {
+		t.Errorf("Expected negotiated version 2025-03-26, got %v", v)
+	}
+
+	// Notifications are accepted without a body
+	resp = client.post(`{"jsonrpc":"2.0","method":"notifications/initialized"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("Expected 202 for notification, got %d", resp.StatusCode)
+	}
+
+	list := client.call(`{"jsonrpc":"2.0","id":2,"method":"tools/list"}`)
+	if tools := list.Result.(map[string]interface{})["tools"].([]interface{}); len(tools) != 6 {
+		t.Errorf("Expected 6 tools, got %d", len(tools))
+	}
+
+	call := client.call(`{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"name":"x402_budget","arguments":{"action":"create","amount":1000}}}`)
+	if call.Result.(map[string]interface{})["isError"] == true {
+		t.Errorf("Expected tool call to succeed: %+v", call.Result)
+	}
+	if server.budgets[client.sessionID] == nil {
+		t.Error("Expected budget on the HTTP session")
+	}
+
+	// Batches get a batch of responses (notifications omitted)
+	resp = client.post(`[{"jsonrpc":"2.0","id":4,"method":"ping"},{"jsonrpc":"2.0","method":"notifications/cancelled"},{"jsonrpc":"2.0","id":5,"method":"tools/list"}]`)
+	var batch []JSONRPCResponse
+	json.NewDecoder(resp.Body).Decode(&batch)
+	resp.Body.Close()
+	if len(batch) != 2 {
+		t.Errorf("Expected 2 batch responses, got %d", len(batch))
+	}
+}
+
+func TestStreamableHTTPSSE(t *testing.T) {
+	server := NewServer(ServerConfig{})
+	ts := httptest.NewServer(server.HTTPHandler())
+	defer ts.Close()
+
+	client := &mcpClient{t: t, url: ts.URL}
+	resp := client.post(`{"jsonrpc":"2.0","id":1,"method":"initialize"}`)
+	resp.Body.Close()
+	client.sessionID = resp.Header.Get(SessionHeader)
+
+	// SSE-only clients get responses as events
+	req, _ := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader(`{"jsonrpc":"2.0","id":2,"method":"ping"}`))
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set(SessionHeader, client.sessionID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected SSE response, got %s", ct)
+	}
+	event := readSSEData(t, bufio.NewReader(resp.Body))
+	resp.Body.Close()
+	if !strings.Contains(event, `"id":2`) {
+		t.Errorf("Expected ping response event, got %s", event)
+	}
+
+	// GET opens the server-to-client stream
+	streamReq, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	streamReq.Header.Set("Accept", "text/event-stream")
+	streamReq.Header.Set(SessionHeader, client.sessionID)
+	stream, err := http.DefaultClient.Do(streamReq)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer stream.Body.Close()
+	reader := bufio.NewReader(stream.Body)
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, ":") {
+		t.Fatalf("Expected stream open comment, got %q", line)
+	}
+
+	if err := server.Notify(client.sessionID, "notifications/message", map[string]string{"level": "info", "data": "budget low"}); err != nil {
+		t.Fatalf("Unexpected notify error: %v", err)
+	}
+	event = readSSEData(t, reader)
+	if !strings.Contains(event, "notifications/message") || !strings.Contains(event, "budget low") {
+		t.Errorf("Expected notification event, got %s", event)
+	}
+
+	// Ending the session closes the stream
+	del, _ := http.NewRequest(http.MethodDelete, ts.URL, nil)
+	del.Header.Set(SessionHeader, client.sessionID)
+	delResp, _ := http.DefaultClient.Do(del)
+	delResp.Body.Close()
+	done := make(chan struct{})
+	go func() {
+		for {
+			if _, err := reader.ReadString('\n'); err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected stream to close when the session ends")
+	}
+
+	if err := server.Notify(client.sessionID, "notifications/message", nil); err == nil {
+		t.Error("Expected error notifying a closed session")
+	}
+}
+
+func readSSEData(t *testing.T, reader *bufio.Reader) string {
+	t.Helper()
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Stream ended: %v", err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+func TestStreamableHTTPRejectsForeignOrigin(t *testing.T) {
+	server := NewServer(ServerConfig{})
+	ts := httptest.NewServer(server.HTTPHandler())
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"initialize"}`))
+	req.Header.Set("Origin", "https://evil.example.com")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for foreign origin, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPServerShutdownClosesStreams(t *testing.T) {
+	server := NewServer(ServerConfig{})
+	srv := server.HTTPServer("127.0.0.1:0")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go srv.Serve(ln)
+	url := "http://" + ln.Addr().String() + "/mcp"
+
+	client := &mcpClient{t: t, url: url}
+	resp := client.post(`{"jsonrpc":"2.0","id":1,"method":"initialize"}`)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set(SessionHeader, resp.Header.Get(SessionHeader))
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer stream.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Expected graceful shutdown with an open stream, got %v", err)
+	}
+}
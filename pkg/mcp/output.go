@@ -0,0 +1,123 @@
+package mcp
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402"
+)
+
+// ============================================================================
+// TOOL OUTPUT
+// Tools return a one-line summary for the model plus the exact data as JSON,
+// so amounts and IDs never have to be scraped out of markdown. The original
+// markdown is kept for clients that render it (MarkdownOutput or
+// "output": "markdown").
+// ============================================================================
+
+// Output modes for the "output" tool argument
+const (
+	OutputStructured = "structured"
+	OutputMarkdown   = "markdown"
+)
+
+// outputProperty is added to every tool's input schema
+var outputProperty = Property{
+	Type:        "string",
+	Description: "Result format: structured (summary plus JSON data) or markdown",
+	Enum:        []string{OutputStructured, OutputMarkdown},
+}
+
+// toolErrorData is the JSON body of a failed tool call
+type toolErrorData struct {
+	Error x402.AIError `json:"error"`
+}
+
+// structuredResult builds a result from its markdown rendering, a plain
+// summary, and the machine-readable data
+func structuredResult(markdown, summary string, data interface{}) *ToolResult {
+	return &ToolResult{
+		Content: []ContentBlock{{Type: "text", Text: markdown}},
+		summary: summary,
+		data:    data,
+	}
+}
+
+// errorResult reports a failed tool call with a pkg/x402 AIError code
+func errorResult(code, message string) *ToolResult {
+	text := "❌ Error: " + message
+	return &ToolResult{
+		Content: []ContentBlock{{Type: "text", Text: text}},
+		IsError: true,
+		summary: text,
+		data: toolErrorData{Error: x402.AIError{
+			Code:      code,
+			Message:   message,
+			Retryable: code == x402.ErrCodeServerError || code == x402.ErrCodeRateLimited,
+			Action:    errorAction(code),
+		}},
+	}
+}
+
+// withDetails adds context (e.g. required and available amounts) to an error
+func (r *ToolResult) withDetails(details map[string]string) *ToolResult {
+	if data, ok := r.data.(toolErrorData); ok {
+		data.Error.Details = details
+		r.data = data
+	}
+	return r
+}
+
+// errorAction suggests what the agent should do next
+func errorAction(code string) string {
+	switch code {
+	case x402.ErrCodeServerError, x402.ErrCodeRateLimited:
+		return "retry"
+	case x402.ErrCodePaymentRequired:
+		return "pay"
+	case x402.ErrCodeInsufficientBudget:
+		return "reduce_scope"
+	default:
+		return "abort"
+	}
+}
+
+// outputMode resolves the "output" argument against the server default
+func (s *Server) outputMode(args map[string]interface{}) (string, error) {
+	mode, _ := args["output"].(string)
+	switch mode {
+	case "":
+		if s.config.MarkdownOutput {
+			return OutputMarkdown, nil
+		}
+		return OutputStructured, nil
+	case OutputStructured, OutputMarkdown:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("output must be %q or %q", OutputStructured, OutputMarkdown)
+	}
+}
+
+// formatResult renders result for mode. Structured results carry a summary
+// block followed by a JSON block, and the data as StructuredContent.
+func (s *Server) formatResult(result *ToolResult, mode string) *ToolResult {
+	if mode == OutputMarkdown || result.data == nil {
+		return result
+	}
+
+	encoded, err := json.Marshal(result.data)
+	if err != nil {
+		return result
+	}
+	summary := result.summary
+	if summary == "" && len(result.Content) > 0 {
+		summary = result.Content[0].Text
+	}
+
+	result.Content = []ContentBlock{
+		{Type: "text", Text: summary},
+		{Type: "text", Text: string(encoded)},
+	}
+	result.StructuredContent = result.data
+	return result
+}
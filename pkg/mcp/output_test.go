@@ -0,0 +1,115 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402"
+)
+
+// decodeStructured checks a structured result has a summary and a JSON
+// block and decodes the JSON into v
+func decodeStructured(t *testing.T, result *ToolResult, v interface{}) {
+	t.Helper()
+	if len(result.Content) != 2 {
+		t.Fatalf("Expected summary and JSON blocks, got %d blocks", len(result.Content))
+	}
+	if result.StructuredContent == nil {
+		t.Error("Expected structuredContent to be set")
+	}
+	if err := json.Unmarshal([]byte(result.Content[1].Text), v); err != nil {
+		t.Fatalf("JSON block does not parse: %v\n%s", err, result.Content[1].Text)
+	}
+}
+
+func TestStructuredBudgetStatus(t *testing.T) {
+	server := NewServer(ServerConfig{})
+	ctx := context.Background()
+	createBudget(t, server, 5000)
+
+	result, _ := server.CallTool(ctx, "x402_budget", map[string]interface{}{"action": "status"})
+	if strings.Contains(result.Content[0].Text, "|") || strings.Contains(result.Content[0].Text, "**") {
+		t.Errorf("Expected a plain summary, got %s", result.Content[0].Text)
+	}
+
+	var status map[string]interface{}
+	decodeStructured(t, result, &status)
+	for field, want := range map[string]interface{}{"active": true, "total": 5000.0, "spent": 0.0, "remaining": 5000.0, "currency": "USDC"} {
+		if status[field] != want {
+			t.Errorf("Expected %s = %v, got %v", field, want, status[field])
+		}
+	}
+}
+
+func TestStructuredDiscovery(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"endpoints":[{"path":"/forecast","method":"GET","description":"Forecast","cost":250,"currency":"USDC"}]}`))
+	}))
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client()})
+	result, _ := server.CallTool(context.Background(), "x402_discover", map[string]interface{}{"url": api.URL})
+
+	var discovery discoveryData
+	decodeStructured(t, result, &discovery)
+	if discovery.URL != api.URL || !discovery.PaymentRequired {
+		t.Errorf("Unexpected discovery: %+v", discovery)
+	}
+	if len(discovery.Endpoints) != 1 || discovery.Endpoints[0].Cost != 250 || discovery.Endpoints[0].Path != "/forecast" {
+		t.Errorf("Expected exact endpoint costs, got %+v", discovery.Endpoints)
+	}
+}
+
+func TestStructuredErrorCodes(t *testing.T) {
+	server := NewServer(ServerConfig{})
+	ctx := context.Background()
+
+	tests := []struct {
+		tool string
+		args map[string]interface{}
+		code string
+	}{
+		{"x402_call", map[string]interface{}{"url": "https://api.example.com"}, x402.ErrCodeInsufficientBudget},
+		{"x402_budget", map[string]interface{}{"action": "explode"}, x402.ErrCodeInvalidRequest},
+		{"x402_discover", map[string]interface{}{}, x402.ErrCodeInvalidRequest},
+		{"x402_history", map[string]interface{}{"output": "xml"}, x402.ErrCodeInvalidRequest},
+	}
+	for _, tt := range tests {
+		result, _ := server.CallTool(ctx, tt.tool, tt.args)
+		if !result.IsError {
+			t.Errorf("%s: expected isError", tt.tool)
+			continue
+		}
+		var data toolErrorData
+		decodeStructured(t, result, &data)
+		if data.Error.Code != tt.code {
+			t.Errorf("%s: expected code %s, got %s", tt.tool, tt.code, data.Error.Code)
+		}
+	}
+}
+
+func TestMarkdownOutputCompatibility(t *testing.T) {
+	server := NewServer(ServerConfig{MarkdownOutput: true})
+	createBudget(t, server, 5000)
+
+	result, _ := server.CallTool(context.Background(), "x402_budget", map[string]interface{}{"action": "status"})
+	if len(result.Content) != 1 || result.StructuredContent != nil {
+		t.Fatalf("Expected a single markdown block, got %+v", result)
+	}
+	if !strings.Contains(result.Content[0].Text, "**Remaining**: 5000") {
+		t.Errorf("Expected markdown status, got %s", result.Content[0].Text)
+	}
+
+	// Callers can still opt in per call
+	result, _ = server.CallTool(context.Background(), "x402_budget", map[string]interface{}{"action": "status", "output": "structured"})
+	var status budgetResource
+	decodeStructured(t, result, &status)
+	if status.Remaining != 5000 {
+		t.Errorf("Expected 5000 remaining, got %d", status.Remaining)
+	}
+}
@@ -0,0 +1,319 @@
+package mcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ============================================================================
+// PAYMENT SIGNING
+// ============================================================================
+
+// PaymentRequirement is one entry of the "accepts" list in an x402 402 response
+type PaymentRequirement struct {
+	Scheme            string                 `json:"scheme"`
+	Network           string                 `json:"network"`
+	MaxAmountRequired string                 `json:"maxAmountRequired"`
+	Resource          string                 `json:"resource"`
+	Description       string                 `json:"description"`
+	PayTo             string                 `json:"payTo"`
+	MaxTimeoutSeconds int                    `json:"maxTimeoutSeconds"`
+	Asset             string                 `json:"asset,omitempty"`
+	Extra             map[string]interface{} `json:"extra,omitempty"`
+}
+
+// PaymentSigner turns a payment requirement into an X-PAYMENT header value
+// (a base64-encoded x402 payment payload)
+type PaymentSigner interface {
+	SignPayment(ctx context.Context, requirement PaymentRequirement) (string, error)
+}
+
+// PaymentSignerFunc adapts a function to PaymentSigner
+type PaymentSignerFunc func(ctx context.Context, requirement PaymentRequirement) (string, error)
+
+// SignPayment calls f
+func (f PaymentSignerFunc) SignPayment(ctx context.Context, requirement PaymentRequirement) (string, error) {
+	return f(ctx, requirement)
+}
+
+// SettlementResponse is the decoded X-PAYMENT-RESPONSE header
+type SettlementResponse struct {
+	Success     bool   `json:"success"`
+	Transaction string `json:"transaction,omitempty"`
+	Network     string `json:"network,omitempty"`
+	Payer       string `json:"payer,omitempty"`
+	ErrorReason string `json:"errorReason,omitempty"`
+}
+
+// ============================================================================
+// HELPERS
+// ============================================================================
+
+// callMethods are the methods x402_call accepts
+var callMethods = []string{"GET", "POST", "PUT", "DELETE", "PATCH"}
+
+// blockedCallHeaders are headers agents may not set on x402_call: the
+// server sets payment, identity and budget headers itself, and transport
+// headers come from the request
+var blockedCallHeaders = map[string]bool{
+	"Authorization":           true, // Pays for Bearer-scheme APIs
+	"Cookie":                  true,
+	"Host":                    true,
+	"Content-Length":          true,
+	"Transfer-Encoding":       true,
+	"Connection":              true,
+	"Stripe-Signature":        true,
+	"X-Request-Id":            true,
+	"X-Real-Ip":               true,
+	"X-Session-Id":            true,
+	"X-Session-Token":         true,
+	"X-Session-Key":           true,
+	"X-Subscription-Id":       true,
+	"X-Wallet-Signature":      true,
+	"X-Internal-Bot":          true,
+	"X-Admin-Key":             true,
+	"X-402-Token":             true,
+	"X-Ai-Agent":              true,
+	"X-Agent-Id":              true,
+	"X-Agent-Budget":          true,
+	"X-Stripe-Payment-Intent": true,
+}
+
+// blockedCallHeaderPrefixes block whole families of payment and identity
+// headers (X-PAYMENT, X-Payment-Token, PAYMENT-SIGNATURE, X-Payer-Address...)
+var blockedCallHeaderPrefixes = []string{"X-Payment", "Payment-", "X-Payer-", "X-Forwarded-"}
+
+// callHeaderBlocked reports whether agents may not set header
+func callHeaderBlocked(header string) bool {
+	header = http.CanonicalHeaderKey(header)
+	if blockedCallHeaders[header] {
+		return true
+	}
+	for _, prefix := range blockedCallHeaderPrefixes {
+		if strings.HasPrefix(header, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// callRequest is an x402_call request, built from the tool arguments once so
+// the paid retry repeats it exactly
+type callRequest struct {
+	method  string
+	url     string
+	header  http.Header
+	body    []byte
+	saveTo  string   // Resource name for the response body (save_to)
+	ignored []string // Blocked headers the agent tried to set
+}
+
+// parseCallRequest reads x402_call's url, method, headers, body and save_to. A body
+// that isn't a string is sent as JSON. Blocked headers are dropped and
+// listed in ignored.
+func parseCallRequest(args map[string]interface{}) (*callRequest, error) {
+	call := &callRequest{header: make(http.Header)}
+	call.url, _ = args["url"].(string)
+
+	method, _ := args["method"].(string)
+	call.method = strings.ToUpper(method)
+	if call.method == "" {
+		call.method = "GET"
+	}
+	allowed := false
+	for _, m := range callMethods {
+		allowed = allowed || m == call.method
+	}
+	if !allowed {
+		return nil, fmt.Errorf("method must be one of %s", strings.Join(callMethods, ", "))
+	}
+
+	call.saveTo, _ = args["save_to"].(string)
+	if call.saveTo != "" && !validResponseName(call.saveTo) {
+		return nil, fmt.Errorf("save_to must be 1-%d letters, digits, '.', '_' or '-'", maxResponseNameLength)
+	}
+
+	switch body := args["body"].(type) {
+	case nil:
+	case string:
+		call.body = []byte(body)
+	default:
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("body cannot be encoded as JSON: %w", err)
+		}
+		call.body = encoded
+	}
+
+	headers, _ := args["headers"].(map[string]interface{})
+	for name, v := range headers {
+		if callHeaderBlocked(name) {
+			call.ignored = append(call.ignored, http.CanonicalHeaderKey(name))
+			continue
+		}
+		switch value := v.(type) {
+		case string:
+			call.header.Set(name, value)
+		case float64, bool:
+			call.header.Set(name, fmt.Sprint(value))
+		}
+	}
+	sort.Strings(call.ignored)
+
+	if len(call.body) > 0 && call.header.Get("Content-Type") == "" {
+		if json.Valid(call.body) {
+			call.header.Set("Content-Type", "application/json")
+		} else {
+			call.header.Set("Content-Type", "text/plain; charset=utf-8")
+		}
+	}
+	return call, nil
+}
+
+// newRequest builds the outgoing request; each call gets a fresh body
+func (c *callRequest) newRequest(ctx context.Context) (*http.Request, error) {
+	var reader io.Reader
+	if len(c.body) > 0 {
+		reader = bytes.NewReader(c.body)
+	}
+	req, err := http.NewRequestWithContext(ctx, c.method, c.url, reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range c.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("X-AI-Agent", "true")
+	return req, nil
+}
+
+// DefaultResponseHeaders are the response headers x402_call returns to
+// agents when ServerConfig.ResponseHeaders is empty
+var DefaultResponseHeaders = []string{
+	"Content-Type", "Content-Length", "Location", "Retry-After", "ETag", "Last-Modified", "Cache-Control", "Link",
+	"X-Request-ID", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset",
+	"X-Total-Count", "X-Next-Cursor",
+}
+
+// responseHeaders picks the configured ResponseHeaders out of resp
+func (s *Server) responseHeaders(resp *http.Response) map[string]string {
+	headers := make(map[string]string)
+	for _, name := range s.config.ResponseHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			headers[http.CanonicalHeaderKey(name)] = value
+		}
+	}
+	return headers
+}
+
+// parsePaymentRequired reads the requirements from a 402 response body (or
+// the data of an agent-format body), falling back to the base64
+// PAYMENT-REQUIRED header
+func parsePaymentRequired(resp *http.Response) ([]PaymentRequirement, error) {
+	var x402Resp struct {
+		Accepts []PaymentRequirement `json:"accepts"`
+		Data    struct {
+			Accepts []PaymentRequirement `json:"accepts"`
+		} `json:"data"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&x402Resp)
+	if len(x402Resp.Accepts) == 0 {
+		x402Resp.Accepts = x402Resp.Data.Accepts
+	}
+	if err != nil || len(x402Resp.Accepts) == 0 {
+		header := resp.Header.Get("PAYMENT-REQUIRED")
+		if header == "" {
+			if err != nil {
+				return nil, errors.New("failed to parse 402 response")
+			}
+			return nil, errors.New("API returned 402 but no payment options available")
+		}
+		decoded, decErr := base64.StdEncoding.DecodeString(header)
+		if decErr != nil || json.Unmarshal(decoded, &x402Resp) != nil {
+			return nil, errors.New("failed to parse 402 response")
+		}
+	}
+	if len(x402Resp.Accepts) == 0 {
+		return nil, errors.New("API returned 402 but no payment options available")
+	}
+	return x402Resp.Accepts, nil
+}
+
+// selectRequirement prefers the option on the configured network
+func (s *Server) selectRequirement(requirements []PaymentRequirement) PaymentRequirement {
+	if s.config.Network != "" {
+		for _, r := range requirements {
+			if r.Network == s.config.Network {
+				return r
+			}
+		}
+	}
+	return requirements[0]
+}
+
+// parseSettlementResponse decodes an X-PAYMENT-RESPONSE header (nil if absent or invalid)
+func parseSettlementResponse(header string) *SettlementResponse {
+	if header == "" {
+		return nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		decoded = []byte(header)
+	}
+	var settlement SettlementResponse
+	if err := json.Unmarshal(decoded, &settlement); err != nil {
+		return nil
+	}
+	return &settlement
+}
+
+// responseBody is an API response body read for a tool result
+type responseBody struct {
+	text      string // At most MaxResponseBytes, with a note when truncated
+	truncated bool   // text is not the whole body
+	saved     []byte // Up to MaxSavedResponseBytes, when the call has save_to
+
+	savedTruncated bool // saved is not the whole body either
+}
+
+// readResponseBody reads at most MaxResponseBytes of the body for a tool
+// result, or MaxSavedResponseBytes when the body is also being saved
+func (s *Server) readResponseBody(resp *http.Response, save bool) (responseBody, error) {
+	limit := int64(s.config.MaxResponseBytes)
+	readLimit := limit
+	if save && int64(s.config.MaxSavedResponseBytes) > readLimit {
+		readLimit = int64(s.config.MaxSavedResponseBytes)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, readLimit+1))
+
+	var body responseBody
+	if save {
+		body.saved = data
+		if int64(len(data)) > readLimit {
+			body.saved, body.savedTruncated = data[:readLimit], true
+		}
+	}
+	body.truncated = int64(len(data)) > limit
+	body.text = string(data)
+	if body.truncated {
+		body.text = string(data[:limit]) + fmt.Sprintf("\n\n[truncated at %d bytes]", limit)
+	}
+	return body, err
+}
+
+// newRequestID generates an ID sent as X-Request-ID on paid calls
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return "req_" + hex.EncodeToString(b)
+}
@@ -0,0 +1,410 @@
+package mcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402"
+)
+
+// newPaidAPI starts an x402-protected API that accepts payloads paying the
+// configured payTo and reports settlement in X-PAYMENT-RESPONSE
+func newPaidAPI(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settlement, _ := json.Marshal(SettlementResponse{Success: true, Transaction: "0xabc", Network: "base-sepolia"})
+		w.Header().Set("X-PAYMENT-RESPONSE", base64.StdEncoding.EncodeToString(settlement))
+		w.Header().Set("X-Request-ID", r.Header.Get("X-Request-ID"))
+		w.Write([]byte(body))
+	})
+
+	return httptest.NewServer(x402.Middleware(api, x402.Config{
+		PayTo:           "0xseller",
+		PricePerRequest: 1000,
+		Network:         "base-sepolia",
+		PaymentVerifier: func(token string) (bool, error) {
+			decoded, err := base64.StdEncoding.DecodeString(token)
+			if err != nil {
+				return false, nil
+			}
+			var payload map[string]string
+			if err := json.Unmarshal(decoded, &payload); err != nil {
+				return false, nil
+			}
+			return payload["payTo"] == "0xseller" && payload["amount"] == "1000", nil
+		},
+	}))
+}
+
+// testSigner pays whatever the requirement asks, optionally to a different address
+func testSigner(payTo string) PaymentSigner {
+	return PaymentSignerFunc(func(ctx context.Context, req PaymentRequirement) (string, error) {
+		to := payTo
+		if to == "" {
+			to = req.PayTo
+		}
+		payload, _ := json.Marshal(map[string]string{"payTo": to, "amount": req.MaxAmountRequired})
+		return base64.StdEncoding.EncodeToString(payload), nil
+	})
+}
+
+func createBudget(t *testing.T, server *Server, amount int64) {
+	t.Helper()
+	server.CallTool(context.Background(), "x402_budget", map[string]interface{}{
+		"action": "create",
+		"amount": float64(amount),
+	})
+}
+
+func TestCallPaysAndReturnsResponse(t *testing.T) {
+	api := newPaidAPI(t, `{"data":"premium"}`)
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client(), Signer: testSigner("")})
+	createBudget(t, server, 5000)
+
+	result, err := server.CallTool(context.Background(), "x402_call", map[string]interface{}{
+		"url": api.URL + "/api/data",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.IsError {
+		t.Fatalf("Expected success, got error: %s", result.Content[0].Text)
+	}
+	if !strings.Contains(result.Content[0].Text, `{"data":"premium"}`) {
+		t.Errorf("Expected API response in result, got %s", result.Content[0].Text)
+	}
+
+	budget := server.budgets["default"]
+	if budget.Spent != 1000 || budget.Remaining != 4000 {
+		t.Errorf("Expected spent 1000 remaining 4000, got %d/%d", budget.Spent, budget.Remaining)
+	}
+	if len(budget.Transactions) != 1 {
+		t.Fatalf("Expected 1 transaction, got %d", len(budget.Transactions))
+	}
+	tx := budget.Transactions[0]
+	if !tx.Success || tx.TxHash != "0xabc" || tx.Endpoint != "/api/data" {
+		t.Errorf("Unexpected transaction: %+v", tx)
+	}
+	if !strings.HasPrefix(tx.RequestID, "req_") {
+		t.Errorf("Expected request ID echoed by the API, got %q", tx.RequestID)
+	}
+}
+
+func TestCallRejectedPaymentRefunds(t *testing.T) {
+	api := newPaidAPI(t, "ok")
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client(), Signer: testSigner("0xsomeoneelse")})
+	createBudget(t, server, 5000)
+
+	result, _ := server.CallTool(context.Background(), "x402_call", map[string]interface{}{
+		"url": api.URL + "/api/data",
+	})
+	if !result.IsError {
+		t.Fatal("Expected error when the API rejects the payment")
+	}
+
+	budget := server.budgets["default"]
+	if budget.Spent != 0 || budget.Remaining != 5000 {
+		t.Errorf("Expected full refund, got spent %d remaining %d", budget.Spent, budget.Remaining)
+	}
+	if len(budget.Transactions) != 1 || budget.Transactions[0].Success {
+		t.Errorf("Expected one failed transaction, got %+v", budget.Transactions)
+	}
+}
+
+func TestCallSignerErrorRefunds(t *testing.T) {
+	api := newPaidAPI(t, "ok")
+	defer api.Close()
+
+	signer := PaymentSignerFunc(func(ctx context.Context, req PaymentRequirement) (string, error) {
+		return "", errors.New("wallet locked")
+	})
+	server := NewServer(ServerConfig{HTTPClient: api.Client(), Signer: signer})
+	createBudget(t, server, 5000)
+
+	result, _ := server.CallTool(context.Background(), "x402_call", map[string]interface{}{
+		"url": api.URL + "/api/data",
+	})
+	if !result.IsError || !strings.Contains(result.Content[0].Text, "wallet locked") {
+		t.Errorf("Expected signer error, got %s", result.Content[0].Text)
+	}
+	if budget := server.budgets["default"]; budget.Remaining != 5000 {
+		t.Errorf("Expected remaining 5000, got %d", budget.Remaining)
+	}
+}
+
+func TestCallWithoutSigner(t *testing.T) {
+	api := newPaidAPI(t, "ok")
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client()})
+	createBudget(t, server, 5000)
+
+	result, _ := server.CallTool(context.Background(), "x402_call", map[string]interface{}{
+		"url": api.URL + "/api/data",
+	})
+	if !result.IsError {
+		t.Error("Expected error without a signer")
+	}
+	if budget := server.budgets["default"]; budget.Remaining != 5000 {
+		t.Errorf("Expected remaining 5000, got %d", budget.Remaining)
+	}
+}
+
+func TestCallTruncatesResponse(t *testing.T) {
+	api := newPaidAPI(t, strings.Repeat("x", 100))
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client(), Signer: testSigner(""), MaxResponseBytes: 10})
+	createBudget(t, server, 5000)
+
+	result, _ := server.CallTool(context.Background(), "x402_call", map[string]interface{}{
+		"url": api.URL + "/api/data",
+	})
+	text := result.Content[0].Text
+	if strings.Contains(text, strings.Repeat("x", 11)) || !strings.Contains(text, "[truncated at 10 bytes]") {
+		t.Errorf("Expected truncated response, got %s", text)
+	}
+}
+
+func TestHistoryRecordsEveryAttempt(t *testing.T) {
+	api := newPaidAPI(t, "ok")
+	defer api.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	server := NewServer(ServerConfig{
+		HTTPClient: api.Client(),
+		Signer:     testSigner(""),
+		KnownAPIs:  []KnownAPI{{Name: "paid", BaseURL: api.URL}},
+	})
+	createBudget(t, server, 2500)
+
+	call := func(url string, maxCost float64) {
+		args := map[string]interface{}{"url": url}
+		if maxCost > 0 {
+			args["max_cost"] = maxCost
+		}
+		server.CallTool(context.Background(), "x402_call", args)
+	}
+	call(api.URL+"/api/data", 0)
+	call(api.URL+"/api/data", 500) // over max_cost
+	call(api.URL+"/api/data", 0)
+	call(api.URL+"/api/data", 0) // over budget: 500 left
+	call(broken.URL+"/api/data", 0)
+
+	result, _ := server.CallTool(context.Background(), "x402_history", map[string]interface{}{"limit": float64(2), "output": "markdown"})
+	data, ok := result.data.(historyData)
+	if !ok {
+		t.Fatalf("Expected history data, got %T", result.data)
+	}
+	if len(data.Transactions) != 2 {
+		t.Errorf("Expected the listing limited to 2, got %d", len(data.Transactions))
+	}
+	if data.Attempts != 5 || data.Succeeded != 2 || data.Failed != 3 || data.SuccessRate != 0.4 {
+		t.Errorf("Expected 2 of 5 attempts to succeed, got %+v", data)
+	}
+	if data.AverageCost != 1000 || data.TotalSpent != 2000 {
+		t.Errorf("Expected average cost 1000 and 2000 spent, got %d and %d", data.AverageCost, data.TotalSpent)
+	}
+	if len(data.ByAPI) != 2 || data.ByAPI[0] != (apiSpend{API: "paid", Calls: 4, Failed: 2, Spent: 2000}) ||
+		data.ByAPI[1] != (apiSpend{API: broken.URL, Calls: 1, Failed: 1}) {
+		t.Errorf("Unexpected spend by API: %+v", data.ByAPI)
+	}
+
+	var reasons []string
+	for _, tx := range server.budgets["default"].Transactions {
+		reasons = append(reasons, tx.Reason)
+	}
+	want := []string{"", ReasonOverMaxCost, "", ReasonOverBudget, ReasonHTTPError}
+	if strings.Join(reasons, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected reasons %q, got %q", want, reasons)
+	}
+	if !strings.Contains(result.Content[0].Text, "❌ over_budget") || !strings.Contains(result.Content[0].Text, "40%") {
+		t.Errorf("Expected failures and the success rate in the history, got %s", result.Content[0].Text)
+	}
+}
+
+func TestMaxCostCheckedBeforeCalling(t *testing.T) {
+	var hits int
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.WriteHeader(http.StatusPaymentRequired)
+	}))
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client(), Signer: testSigner("")})
+	createBudget(t, server, 5000)
+	server.cacheDiscovery(&APIDiscoveryCache{
+		URL:       api.URL,
+		Endpoints: []DiscoveredEndpoint{{Path: "/api/report", Method: "GET", Cost: 2000}},
+		CachedAt:  time.Now(),
+		ExpiresAt: time.Now().Add(time.Minute),
+	})
+
+	result, _ := server.CallTool(context.Background(), "x402_call", map[string]interface{}{
+		"url":      api.URL + "/api/report",
+		"max_cost": float64(1000),
+	})
+	if !result.IsError || !strings.Contains(result.Content[0].Text, "max_cost") {
+		t.Errorf("Expected a max_cost refusal, got %s", result.Content[0].Text)
+	}
+	if hits != 0 {
+		t.Errorf("Expected the API not to be called, got %d requests", hits)
+	}
+	txs := server.budgets["default"].Transactions
+	if len(txs) != 1 || txs[0].Reason != ReasonOverMaxCost || txs[0].Amount != 2000 || txs[0].Success {
+		t.Errorf("Expected the refusal in the history, got %+v", txs)
+	}
+}
+
+func TestCallPaidPOSTWithJSONBody(t *testing.T) {
+	type seen struct {
+		method, contentType, body, custom, payer string
+		paid                                     bool
+	}
+	var requests []seen
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/api/jobs/1")
+		w.Header().Set("X-Internal", "hidden")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"job":1}`))
+	})
+	paywall := x402.Middleware(api, x402.Config{
+		PayTo:           "0xseller",
+		PricePerRequest: 1000,
+		Network:         "base-sepolia",
+		PaymentVerifier: func(token string) (bool, error) { return token != "", nil },
+	})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, seen{r.Method, r.Header.Get("Content-Type"), string(body), r.Header.Get("X-Custom"), r.Header.Get("X-Payer-Address"), r.Header.Get("X-PAYMENT") != ""})
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		paywall.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: ts.Client(), Signer: testSigner("")})
+	createBudget(t, server, 5000)
+
+	result, _ := server.CallTool(context.Background(), "x402_call", map[string]interface{}{
+		"url":     ts.URL + "/api/jobs",
+		"method":  "post",
+		"body":    map[string]interface{}{"prompt": "hello"},
+		"headers": map[string]interface{}{"X-Custom": "yes", "X-Payer-Address": "0xspoofed", "x-payment": "forged"},
+	})
+	data, ok := result.data.(callData)
+	if result.IsError || !ok {
+		t.Fatalf("Expected a paid call, got %s", result.Content[0].Text)
+	}
+	if !data.Paid || data.Status != http.StatusCreated || data.Body != `{"job":1}` || data.Method != "POST" {
+		t.Errorf("Unexpected call result: %+v", data)
+	}
+	if data.Headers["Location"] != "/api/jobs/1" || data.Headers["Content-Type"] != "application/json" || data.Headers["X-Internal"] != "" {
+		t.Errorf("Expected selected response headers, got %v", data.Headers)
+	}
+	if strings.Join(data.IgnoredHeaders, ",") != "X-Payer-Address,X-Payment" {
+		t.Errorf("Expected the payment and identity headers to be ignored, got %v", data.IgnoredHeaders)
+	}
+
+	// The 402 probe and the paid retry carry the same request
+	if len(requests) != 2 || requests[0].paid || !requests[1].paid {
+		t.Fatalf("Expected an unpaid probe then a paid retry, got %+v", requests)
+	}
+	for _, r := range requests {
+		if r.method != "POST" || r.contentType != "application/json" || r.body != `{"prompt":"hello"}` || r.custom != "yes" || r.payer != "" {
+			t.Errorf("Unexpected request: %+v", r)
+		}
+	}
+}
+
+func TestCallRejectsUnknownMethod(t *testing.T) {
+	server := NewServer(ServerConfig{})
+	createBudget(t, server, 5000)
+
+	result, _ := server.CallTool(context.Background(), "x402_call", map[string]interface{}{
+		"url":    "https://api.example.com/data",
+		"method": "TRACE",
+	})
+	if !result.IsError || !strings.Contains(result.Content[0].Text, "method must be one of") {
+		t.Errorf("Expected an invalid method error, got %s", result.Content[0].Text)
+	}
+}
+
+func TestCallSavesTruncatedBodyAsResource(t *testing.T) {
+	api := newPaidAPI(t, strings.Repeat("x", 100))
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client(), Signer: testSigner(""), MaxResponseBytes: 10})
+	createBudget(t, server, 5000)
+
+	result, _ := server.CallTool(context.Background(), "x402_call", map[string]interface{}{
+		"url":     api.URL + "/api/data",
+		"save_to": "big-report",
+	})
+	data, ok := result.data.(callData)
+	if result.IsError || !ok {
+		t.Fatalf("Expected a paid call, got %s", result.Content[0].Text)
+	}
+	if !data.Truncated || data.Resource != "x402://responses/big-report" || !strings.HasPrefix(data.Body, strings.Repeat("x", 10)+"\n\n[truncated") {
+		t.Errorf("Expected a truncated body saved as a resource, got %+v", data.callResponse)
+	}
+	if data.Headers["X-Request-Id"] != data.RequestID {
+		t.Errorf("Expected X-Request-ID among the response headers, got %v", data.Headers)
+	}
+
+	contents, ok, err := server.ReadResource(context.Background(), data.Resource)
+	if !ok || err != nil || contents.Text != strings.Repeat("x", 100) {
+		t.Fatalf("Expected the full body in the resource, got %+v, %v, %v", contents, ok, err)
+	}
+
+	// Other sessions cannot read it
+	other := WithSession(context.Background(), "other")
+	if _, ok, _ := server.ReadResource(other, data.Resource); ok {
+		t.Error("Expected saved responses to be private to the session")
+	}
+}
+
+func TestCallResponseHeadersConfigurable(t *testing.T) {
+	api := newPaidAPI(t, "ok")
+	defer api.Close()
+
+	server := NewServer(ServerConfig{
+		HTTPClient:      api.Client(),
+		Signer:          testSigner(""),
+		ResponseHeaders: []string{"x-payment-response"},
+	})
+	createBudget(t, server, 5000)
+
+	result, _ := server.CallTool(context.Background(), "x402_call", map[string]interface{}{
+		"url": api.URL + "/api/data",
+	})
+	data := result.data.(callData)
+	if data.Headers["X-Payment-Response"] == "" || data.Headers["X-Request-Id"] != "" || data.Truncated {
+		t.Errorf("Expected only the configured headers, got %+v", data.callResponse)
+	}
+
+	result, _ = server.CallTool(context.Background(), "x402_call", map[string]interface{}{
+		"url":     api.URL + "/api/data",
+		"save_to": "../budget",
+	})
+	if !result.IsError || !strings.Contains(result.Content[0].Text, "save_to must be") {
+		t.Errorf("Expected an invalid save_to error, got %s", result.Content[0].Text)
+	}
+}
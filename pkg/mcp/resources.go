@@ -0,0 +1,380 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// RESOURCES
+// Read-only views of the session's spending that clients can attach to
+// context without a tool call. Subscribers to x402://budget and
+// x402://transactions are notified after every paid call. Response bodies
+// saved by x402_call's save_to are read from x402://responses/{name}.
+// ============================================================================
+
+// Resource URIs
+const (
+	BudgetResourceURI       = "x402://budget"
+	TransactionsResourceURI = "x402://transactions"
+	apiResourcePrefix       = "x402://apis/"
+	responseResourcePrefix  = "x402://responses/"
+)
+
+// ResourceNotFound is the MCP error code for an unknown resource URI
+const ResourceNotFound = -32002
+
+// transactionsResourceLimit bounds the history returned by x402://transactions
+const transactionsResourceLimit = 50
+
+// maxSavedResponses bounds the bodies saved per session; the oldest is
+// dropped first
+const maxSavedResponses = 20
+
+// maxResponseNameLength bounds a save_to name
+const maxResponseNameLength = 64
+
+// Resource describes a readable resource
+type Resource struct {
+	URI         string `json:"uri"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"`
+}
+
+// ResourceContents is the body of a read resource
+type ResourceContents struct {
+	URI      string `json:"uri"`
+	MimeType string `json:"mimeType,omitempty"`
+	Text     string `json:"text"`
+}
+
+// budgetResource is the JSON shape of x402://budget
+type budgetResource struct {
+	Active       bool      `json:"active"`
+	Total        int64     `json:"total"`
+	Spent        int64     `json:"spent"`
+	Remaining    int64     `json:"remaining"`
+	Currency     string    `json:"currency"`
+	Transactions int       `json:"transactions"`
+	BudgetID     string    `json:"budgetId,omitempty"`
+	CreatedAt    time.Time `json:"createdAt,omitempty"`
+	LastUsedAt   time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// apiResource is the JSON shape of x402://apis/{name}
+type apiResource struct {
+	KnownAPI
+	Discovered bool                 `json:"discovered"`
+	CachedAt   *time.Time           `json:"cachedAt,omitempty"`
+	Endpoints  []DiscoveredEndpoint `json:"endpoints"`
+}
+
+// ListResources returns the budget, transaction, and known API resources
+func (s *Server) ListResources() []Resource {
+	resources := []Resource{
+		{
+			URI:         BudgetResourceURI,
+			Name:        "Budget",
+			Description: "Current spending budget of this session",
+			MimeType:    "application/json",
+		},
+		{
+			URI:         TransactionsResourceURI,
+			Name:        "Transactions",
+			Description: "Recent paid calls made in this session",
+			MimeType:    "application/json",
+		},
+	}
+	for _, api := range s.config.KnownAPIs {
+		resources = append(resources, Resource{
+			URI:         apiResourcePrefix + url.PathEscape(api.Name),
+			Name:        api.Name,
+			Description: api.Description,
+			MimeType:    "application/json",
+		})
+	}
+	return resources
+}
+
+// ReadResource returns the contents of uri for the caller's session. ok is
+// false if the URI is unknown.
+func (s *Server) ReadResource(ctx context.Context, uri string) (contents *ResourceContents, ok bool, err error) {
+	var data interface{}
+
+	switch {
+	case uri == BudgetResourceURI:
+		data = s.budgetSnapshot(ctx)
+
+	case uri == TransactionsResourceURI:
+		filter := TransactionFilter{SessionID: SessionFromContext(ctx), Limit: transactionsResourceLimit}
+		txs, err := s.sessionTransactions(ctx, filter)
+		if err != nil {
+			return nil, true, err
+		}
+		data = map[string]interface{}{"transactions": txs}
+
+	case strings.HasPrefix(uri, responseResourcePrefix):
+		saved, found := s.savedResponse(SessionFromContext(ctx), uri)
+		if !found {
+			return nil, false, nil
+		}
+		return &ResourceContents{URI: uri, MimeType: saved.mimeType, Text: string(saved.body)}, true, nil
+
+	case strings.HasPrefix(uri, apiResourcePrefix):
+		name, err := url.PathUnescape(strings.TrimPrefix(uri, apiResourcePrefix))
+		if err != nil {
+			return nil, false, nil
+		}
+		api, found := s.knownAPI(name)
+		if !found {
+			return nil, false, nil
+		}
+		data = s.apiSnapshot(api)
+
+	default:
+		return nil, false, nil
+	}
+
+	text, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return nil, true, err
+	}
+	return &ResourceContents{URI: uri, MimeType: "application/json", Text: string(text)}, true, nil
+}
+
+func (s *Server) budgetSnapshot(ctx context.Context) budgetResource {
+	return s.describeBudget(s.sessionBudget(ctx))
+}
+
+// describeBudget returns the JSON view of budget (inactive if nil)
+func (s *Server) describeBudget(budget *Budget) budgetResource {
+	if budget == nil {
+		return budgetResource{Currency: s.config.Currency}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return budgetResource{
+		Active:       true,
+		Total:        budget.Total,
+		Spent:        budget.Spent,
+		Remaining:    budget.Remaining,
+		Currency:     budget.Currency,
+		Transactions: len(budget.Transactions),
+		BudgetID:     budget.PreAuthID,
+		CreatedAt:    budget.CreatedAt,
+		LastUsedAt:   budget.LastUsedAt,
+	}
+}
+
+// sessionTransactions reads history from Storage when configured, otherwise
+// from the in-memory budget
+func (s *Server) sessionTransactions(ctx context.Context, filter TransactionFilter) ([]Transaction, error) {
+	if s.config.Storage != nil {
+		txs, err := s.config.Storage.ListTransactions(filter)
+		if txs == nil {
+			txs = []Transaction{}
+		}
+		return txs, err
+	}
+
+	budget := s.sessionBudget(ctx)
+	if budget == nil {
+		return []Transaction{}, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return filterTransactions(budget.Transactions, filter), nil
+}
+
+func (s *Server) knownAPI(name string) (KnownAPI, bool) {
+	for _, api := range s.config.KnownAPIs {
+		if api.Name == name {
+			return api, true
+		}
+	}
+	return KnownAPI{}, false
+}
+
+// apiSnapshot combines a known API with its unexpired discovery cache entry
+func (s *Server) apiSnapshot(api KnownAPI) apiResource {
+	out := apiResource{KnownAPI: api, Endpoints: []DiscoveredEndpoint{}}
+
+	s.mu.RLock()
+	cached := s.cache[api.BaseURL]
+	s.mu.RUnlock()
+
+	if cached != nil && time.Now().Before(cached.ExpiresAt) {
+		cachedAt := cached.CachedAt
+		out.Discovered = true
+		out.CachedAt = &cachedAt
+		out.Endpoints = cached.Endpoints
+	}
+	return out
+}
+
+// ============================================================================
+// SAVED RESPONSES
+// ============================================================================
+
+// savedResponse is a response body stored by x402_call's save_to
+type savedResponse struct {
+	uri      string
+	mimeType string
+	body     []byte
+}
+
+// validResponseName reports whether name can be used as a save_to name
+func validResponseName(name string) bool {
+	if name == "" || len(name) > maxResponseNameLength {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// saveResponse stores body for sessionID under name, replacing an earlier
+// body of the same name, and returns its resource URI
+func (s *Server) saveResponse(sessionID, name, mimeType string, body []byte) string {
+	uri := responseResourcePrefix + name
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var saved []savedResponse
+	for _, r := range s.responses[sessionID] {
+		if r.uri != uri {
+			saved = append(saved, r)
+		}
+	}
+	saved = append(saved, savedResponse{uri: uri, mimeType: mimeType, body: body})
+	if len(saved) > maxSavedResponses {
+		saved = saved[len(saved)-maxSavedResponses:]
+	}
+	s.responses[sessionID] = saved
+	return uri
+}
+
+// savedResponse returns the body sessionID saved as uri
+func (s *Server) savedResponse(sessionID, uri string) (savedResponse, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, r := range s.responses[sessionID] {
+		if r.uri == uri {
+			return r, true
+		}
+	}
+	return savedResponse{}, false
+}
+
+// ============================================================================
+// SUBSCRIPTIONS
+// ============================================================================
+
+// subscribe records that sessionID wants updates for uri
+func (s *Server) subscribe(sessionID, uri string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.subscriptions[sessionID] == nil {
+		s.subscriptions[sessionID] = make(map[string]bool)
+	}
+	s.subscriptions[sessionID][uri] = true
+}
+
+func (s *Server) unsubscribe(sessionID, uri string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.subscriptions[sessionID], uri)
+	if len(s.subscriptions[sessionID]) == 0 {
+		delete(s.subscriptions, sessionID)
+	}
+}
+
+// resourcesUpdated notifies sessionID of changes to any subscribed uris
+func (s *Server) resourcesUpdated(sessionID string, uris ...string) {
+	s.mu.RLock()
+	var changed []string
+	for _, uri := range uris {
+		if s.subscriptions[sessionID][uri] {
+			changed = append(changed, uri)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(changed)
+	for _, uri := range changed {
+		// Delivered over the session's open stream; dropped if there is none
+		_ = s.Notify(sessionID, "notifications/resources/updated", map[string]string{"uri": uri})
+	}
+}
+
+// ============================================================================
+// REQUEST HANDLING
+// ============================================================================
+
+func (s *Server) handleResourcesList(encoder *json.Encoder, req *JSONRPCRequest) {
+	s.sendResult(encoder, req.ID, map[string]interface{}{
+		"resources": s.ListResources(),
+	})
+}
+
+func (s *Server) handleResourcesRead(ctx context.Context, encoder *json.Encoder, req *JSONRPCRequest) {
+	var params struct {
+		URI string `json:"uri"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil || params.URI == "" {
+		s.sendError(encoder, req.ID, InvalidParams, "uri is required")
+		return
+	}
+
+	contents, ok, err := s.ReadResource(ctx, params.URI)
+	switch {
+	case !ok:
+		s.sendError(encoder, req.ID, ResourceNotFound, "Resource not found: "+params.URI)
+	case err != nil:
+		s.sendError(encoder, req.ID, InternalError, err.Error())
+	default:
+		s.sendResult(encoder, req.ID, map[string]interface{}{
+			"contents": []*ResourceContents{contents},
+		})
+	}
+}
+
+func (s *Server) handleResourcesSubscribe(ctx context.Context, encoder *json.Encoder, req *JSONRPCRequest, subscribe bool) {
+	var params struct {
+		URI string `json:"uri"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil || params.URI == "" {
+		s.sendError(encoder, req.ID, InvalidParams, "uri is required")
+		return
+	}
+
+	sessionID := SessionFromContext(ctx)
+	if subscribe {
+		if params.URI != BudgetResourceURI && params.URI != TransactionsResourceURI {
+			s.sendError(encoder, req.ID, ResourceNotFound, "Resource does not support subscriptions: "+params.URI)
+			return
+		}
+		s.subscribe(sessionID, params.URI)
+	} else {
+		s.unsubscribe(sessionID, params.URI)
+	}
+	s.sendResult(encoder, req.ID, map[string]interface{}{})
+}
@@ -0,0 +1,136 @@
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResourcesList(t *testing.T) {
+	server := NewServer(ServerConfig{
+		KnownAPIs: []KnownAPI{{Name: "weather", BaseURL: "https://weather.example.com", Description: "Forecasts"}},
+	})
+
+	resources := server.ListResources()
+	if len(resources) != 3 {
+		t.Fatalf("Expected 3 resources, got %d", len(resources))
+	}
+	uris := map[string]bool{}
+	for _, r := range resources {
+		uris[r.URI] = true
+	}
+	for _, uri := range []string{BudgetResourceURI, TransactionsResourceURI, "x402://apis/weather"} {
+		if !uris[uri] {
+			t.Errorf("Expected resource %s", uri)
+		}
+	}
+}
+
+func TestResourcesRead(t *testing.T) {
+	server := NewServer(ServerConfig{
+		KnownAPIs: []KnownAPI{{Name: "weather", BaseURL: "https://weather.example.com"}},
+	})
+	ctx := context.Background()
+
+	contents, ok, err := server.ReadResource(ctx, BudgetResourceURI)
+	if !ok || err != nil {
+		t.Fatalf("Expected budget resource, got ok=%v err=%v", ok, err)
+	}
+	var budget budgetResource
+	json.Unmarshal([]byte(contents.Text), &budget)
+	if budget.Active {
+		t.Error("Expected inactive budget before create")
+	}
+
+	createBudget(t, server, 5000)
+	contents, _, _ = server.ReadResource(ctx, BudgetResourceURI)
+	json.Unmarshal([]byte(contents.Text), &budget)
+	if !budget.Active || budget.Remaining != 5000 {
+		t.Errorf("Expected active budget with 5000 remaining, got %+v", budget)
+	}
+
+	server.cache["https://weather.example.com"] = &APIDiscoveryCache{
+		URL:       "https://weather.example.com",
+		Endpoints: []DiscoveredEndpoint{{Path: "/forecast", Method: "GET", Cost: 100}},
+		CachedAt:  time.Now(),
+		ExpiresAt: time.Now().Add(time.Minute),
+	}
+	contents, ok, _ = server.ReadResource(ctx, "x402://apis/weather")
+	if !ok {
+		t.Fatal("Expected API resource")
+	}
+	var api apiResource
+	json.Unmarshal([]byte(contents.Text), &api)
+	if !api.Discovered || len(api.Endpoints) != 1 || api.Endpoints[0].Path != "/forecast" {
+		t.Errorf("Expected cached discovery data, got %+v", api)
+	}
+
+	if _, ok, _ := server.ReadResource(ctx, "x402://apis/unknown"); ok {
+		t.Error("Expected unknown API to be not found")
+	}
+}
+
+func TestResourcesReadOverJSONRPC(t *testing.T) {
+	server := NewServer(ServerConfig{})
+
+	var buf strings.Builder
+	server.handleRequest(json.NewEncoder(&buf), &JSONRPCRequest{
+		JSONRPC: "2.0",
+		ID:      1,
+		Method:  "resources/read",
+		Params:  json.RawMessage(`{"uri":"x402://nope"}`),
+	})
+	var resp JSONRPCResponse
+	json.Unmarshal([]byte(buf.String()), &resp)
+	if resp.Error == nil || resp.Error.Code != ResourceNotFound {
+		t.Errorf("Expected ResourceNotFound, got %+v", resp.Error)
+	}
+}
+
+func TestResourceUpdatedAfterPaidCall(t *testing.T) {
+	api := newPaidAPI(t, `{"data":"premium"}`)
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client(), Signer: testSigner("")})
+	ts := httptest.NewServer(server.HTTPHandler())
+	defer ts.Close()
+
+	client := &mcpClient{t: t, url: ts.URL}
+	resp := client.post(`{"jsonrpc":"2.0","id":1,"method":"initialize"}`)
+	resp.Body.Close()
+	client.sessionID = resp.Header.Get(SessionHeader)
+
+	client.call(`{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"x402_budget","arguments":{"action":"create","amount":5000}}}`)
+	client.call(`{"jsonrpc":"2.0","id":3,"method":"resources/subscribe","params":{"uri":"x402://budget"}}`)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set(SessionHeader, client.sessionID)
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer stream.Body.Close()
+	reader := bufio.NewReader(stream.Body)
+	reader.ReadString('\n')
+
+	client.call(`{"jsonrpc":"2.0","id":4,"method":"tools/call","params":{"name":"x402_call","arguments":{"url":"` + api.URL + `/api/data"}}}`)
+
+	event := readSSEData(t, reader)
+	if !strings.Contains(event, "notifications/resources/updated") || !strings.Contains(event, BudgetResourceURI) {
+		t.Errorf("Expected budget update notification, got %s", event)
+	}
+
+	read := client.call(`{"jsonrpc":"2.0","id":5,"method":"resources/read","params":{"uri":"x402://budget"}}`)
+	text := read.Result.(map[string]interface{})["contents"].([]interface{})[0].(map[string]interface{})["text"].(string)
+	var budget budgetResource
+	json.Unmarshal([]byte(text), &budget)
+	if budget.Spent != 1000 || budget.Remaining != 4000 {
+		t.Errorf("Expected spent 1000 / remaining 4000, got %+v", budget)
+	}
+}
@@ -0,0 +1,31 @@
+package mcp
+
+import (
+	"math/big"
+
+	"github.com/siddimore/x402-seller-middleware/internal/secp256k1"
+)
+
+// Curve arithmetic lives in internal/secp256k1, which x402 also uses to
+// check wallet signatures
+
+var (
+	secpN     = secp256k1.N
+	secpHalfN = secp256k1.HalfN
+)
+
+func keccak256(data ...[]byte) []byte {
+	return secp256k1.Keccak256(data...)
+}
+
+func signSecp256k1(hash []byte, key *big.Int) ([]byte, error) {
+	return secp256k1.Sign(hash, key)
+}
+
+func recoverAddress(hash, sig []byte) ([]byte, error) {
+	return secp256k1.Recover(hash, sig)
+}
+
+func keyAddress(key *big.Int) []byte {
+	return secp256k1.Address(key)
+}
@@ -5,25 +5,32 @@
 // Usage:
 //
 //	server := mcp.NewServer(mcp.ServerConfig{
-//	    WalletAddress: "0x...",
+//	    PrivateKey:    os.Getenv("X402_PRIVATE_KEY"), // signs EIP-3009 payments
 //	    Network:       "base",
 //	    Facilitator:   "https://facilitator.example.com",
 //	})
 //	server.ListenStdio() // For CLI usage
 //	// or
-//	server.ListenHTTP(":8080") // For HTTP transport
+//	server.ListenHTTP(":8080") // Streamable HTTP transport at /mcp
 package mcp
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402"
 )
 
 // ============================================================================
@@ -85,10 +92,16 @@ type Property struct {
 	Default     any      `json:"default,omitempty"`
 }
 
-// ToolResult is the result of a tool call
+// ToolResult is the result of a tool call. In structured output mode the
+// content is a text summary followed by the same data as JSON, which is
+// also set as StructuredContent.
 type ToolResult struct {
-	Content []ContentBlock `json:"content"`
-	IsError bool           `json:"isError,omitempty"`
+	Content           []ContentBlock `json:"content"`
+	StructuredContent interface{}    `json:"structuredContent,omitempty"`
+	IsError           bool           `json:"isError,omitempty"`
+
+	summary string      // Replaces the markdown content in structured mode
+	data    interface{} // Machine-readable result
 }
 
 // ContentBlock is a piece of content in a tool result
@@ -105,7 +118,7 @@ type ContentBlock struct {
 type ServerConfig struct {
 	// Wallet configuration
 	WalletAddress string // Your wallet address for payments
-	PrivateKey    string // Private key for signing (optional, for auto-pay)
+	PrivateKey    string // Hex secp256k1 key; used to build Signer when Signer is nil
 
 	// Network configuration
 	Network     string // "base", "base-sepolia", "ethereum"
@@ -116,11 +129,72 @@ type ServerConfig struct {
 	MaxBudgetPerCall int64  // Maximum spend per single call
 	Currency         string // "USDC", "ETH", etc.
 
+	// ConfirmAbove holds calls costing more than this until the client
+	// repeats them with the returned confirmation token (0 = never)
+	ConfirmAbove int64
+
+	// DailySpendLimit caps the total charged per UTC day across all sessions
+	// (0 = unlimited). With Storage it is computed from the transaction log.
+	DailySpendLimit int64
+
 	// Known APIs (pre-configured endpoints)
 	KnownAPIs []KnownAPI
 
+	// AllowOnlyKnownAPIs makes x402_call, x402_discover, and x402_estimate
+	// refuse URLs outside the KnownAPIs base URLs
+	AllowOnlyKnownAPIs bool
+
 	// HTTP client for making requests
 	HTTPClient *http.Client
+
+	// Signer builds the X-PAYMENT header for paid calls. Defaults to an
+	// EIP-3009 signer over PrivateKey; without either, x402_call reports the
+	// price but cannot pay.
+	Signer PaymentSigner
+
+	// MaxResponseBytes truncates API responses returned in tool results
+	// (default 64KB)
+	MaxResponseBytes int
+
+	// MaxSavedResponseBytes bounds a body saved with x402_call's save_to
+	// argument (default 4MB)
+	MaxSavedResponseBytes int
+
+	// ResponseHeaders lists the response headers x402_call returns
+	// (default DefaultResponseHeaders)
+	ResponseHeaders []string
+
+	// MaxMessageBytes bounds a message read by ListenStdio; longer ones are
+	// answered with an error and skipped (default 4MB)
+	MaxMessageBytes int
+
+	// PreAuthStore, if set, backs session budgets with the store used by the
+	// seller's /ai/budget endpoint so both see the same balances
+	PreAuthStore x402.PreAuthStore
+
+	// SessionIdleTimeout drops idle HTTP sessions and their budgets (default 30m)
+	SessionIdleTimeout time.Duration
+
+	// AllowedOrigins lists browser origins accepted by the HTTP transport.
+	// Empty allows only requests whose Origin matches the Host (or no Origin),
+	// which blocks DNS-rebinding attacks on local servers.
+	AllowedOrigins []string
+
+	// Storage persists budgets and transactions across restarts (optional).
+	// Saved budgets are loaded by NewServer and can be resumed by session ID.
+	Storage Storage
+
+	// MarkdownOutput restores the original markdown-only tool results.
+	// Callers can still choose per call with the "output" argument.
+	MarkdownOutput bool
+
+	// DiscoveryCacheTTL is how long x402_discover results are reused
+	// (default 5m)
+	DiscoveryCacheTTL time.Duration
+
+	// DiscoveryCacheMaxEntries bounds the number of cached APIs; the oldest
+	// entries are evicted first (default 100)
+	DiscoveryCacheMaxEntries int
 }
 
 // KnownAPI represents a pre-configured API endpoint
@@ -133,41 +207,92 @@ type KnownAPI struct {
 
 // Server is the MCP server for x402 payments
 type Server struct {
-	config  ServerConfig
-	mu      sync.RWMutex
-	budgets map[string]*Budget // sessionID -> budget
-	cache   map[string]*APIDiscoveryCache
+	config   ServerConfig
+	mu       sync.RWMutex
+	budgets  map[string]*Budget   // sessionID -> budget
+	sessions map[string]time.Time // HTTP sessionID -> last activity
+	cache    map[string]*APIDiscoveryCache
+
+	subscriptions map[string]map[string]bool // sessionID -> subscribed resource URIs
+	responses     map[string][]savedResponse // sessionID -> bodies saved by x402_call, oldest first
+	confirmations map[string]pendingConfirmation
+
+	dailyMu       sync.Mutex
+	dailyInFlight int64  // Reserved by calls that have not settled
+	dailyDay      string // UTC day of dailySpent (without Storage)
+	dailySpent    int64
+
+	signerErr  error // Why PrivateKey could not be used, reported on paid calls
+	storageErr error // Why saved state could not be loaded; budget tools refuse to run
+	persistMu  sync.Mutex
+
+	streamMu      sync.Mutex
+	streams       map[string]map[chan []byte]struct{} // sessionID -> open SSE streams
+	streamsClosed bool
 }
 
 // Budget tracks spending for a session
 type Budget struct {
-	SessionID    string
-	Total        int64
-	Spent        int64
-	Remaining    int64
-	Currency     string
-	CreatedAt    time.Time
-	LastUsedAt   time.Time
-	Transactions []Transaction
+	SessionID    string        `json:"sessionId"`
+	Total        int64         `json:"total"`
+	Spent        int64         `json:"spent"`
+	Remaining    int64         `json:"remaining"`
+	Currency     string        `json:"currency"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	LastUsedAt   time.Time     `json:"lastUsedAt"`
+	Transactions []Transaction `json:"transactions,omitempty"`
+
+	// PreAuthID links the budget to a PreAuthStore budget; balances then
+	// live in the store
+	PreAuthID string `json:"preAuthId,omitempty"`
+
+	OwnsPreAuth bool `json:"ownsPreAuth,omitempty"` // Created by this session, deleted from the store on close
 }
 
-// Transaction records a payment
+// Transaction records an x402_call attempt. Success is set when the payment
+// was charged; Reason says why an attempt fell short. Field names match
+// case-insensitively when decoding, so state saved before the JSON tags were
+// added still loads.
 type Transaction struct {
-	Timestamp time.Time
-	API       string
-	Endpoint  string
-	Amount    int64
-	Currency  string
-	Success   bool
-	RequestID string
+	SessionID string    `json:"sessionId"`
+	Timestamp time.Time `json:"timestamp"`
+	API       string    `json:"api"`
+	Endpoint  string    `json:"endpoint"`
+	Amount    int64     `json:"amount"`
+	Currency  string    `json:"currency"`
+	Success   bool      `json:"success"`
+	RequestID string    `json:"requestId,omitempty"`
+	Network   string    `json:"network,omitempty"` // Network the payment settled on
+	TxHash    string    `json:"txHash,omitempty"`  // Settlement transaction from X-PAYMENT-RESPONSE
+	Reason    string    `json:"reason,omitempty"`  // Why the attempt failed (Reason*)
+}
+
+// Why an x402_call attempt failed, as recorded in Transaction.Reason
+const (
+	ReasonOverMaxCost          = "over_max_cost"         // Price above the call's max_cost
+	ReasonOverBudget           = "over_budget"           // Price above the session's remaining budget
+	ReasonOverLimit            = "over_limit"            // Price above MaxBudgetPerCall or DailySpendLimit
+	ReasonConfirmationRequired = "confirmation_required" // Held for ConfirmAbove approval
+	ReasonBudgetUnavailable    = "budget_unavailable"    // The budget store failed
+	ReasonNoSigner             = "no_signer"             // No signer to pay with
+	ReasonSigningFailed        = "signing_failed"        // The signer refused the payment
+	ReasonInvalidQuote         = "invalid_quote"         // The 402 could not be understood
+	ReasonPaymentRejected      = "payment_rejected"      // The API answered the payment with another 402
+	ReasonHTTPError            = "http_error"            // The request failed or returned an error status
+)
+
+// succeeded reports whether the attempt was a paid, successful call
+func (tx Transaction) succeeded() bool {
+	return tx.Success && tx.Reason == ""
 }
 
 // APIDiscoveryCache caches API discovery results
 type APIDiscoveryCache struct {
-	URL       string
-	Endpoints []DiscoveredEndpoint
-	CachedAt  time.Time
-	ExpiresAt time.Time
+	URL           string
+	Endpoints     []DiscoveredEndpoint
+	FreeEndpoints []x402.FreeEndpoint
+	CachedAt      time.Time
+	ExpiresAt     time.Time
 }
 
 // DiscoveredEndpoint represents a discovered API endpoint
@@ -190,17 +315,65 @@ func NewServer(config ServerConfig) *Server {
 	if config.DefaultBudget == 0 {
 		config.DefaultBudget = 100000 // 0.10 USDC in smallest units
 	}
+	if config.MaxResponseBytes == 0 {
+		config.MaxResponseBytes = 64 * 1024
+	}
+	if config.MaxSavedResponseBytes == 0 {
+		config.MaxSavedResponseBytes = 4 << 20
+	}
+	if len(config.ResponseHeaders) == 0 {
+		config.ResponseHeaders = DefaultResponseHeaders
+	}
+	if config.MaxMessageBytes == 0 {
+		config.MaxMessageBytes = 4 << 20
+	}
+	if config.SessionIdleTimeout == 0 {
+		config.SessionIdleTimeout = 30 * time.Minute
+	}
+	if config.DiscoveryCacheTTL == 0 {
+		config.DiscoveryCacheTTL = 5 * time.Minute
+	}
+	if config.DiscoveryCacheMaxEntries == 0 {
+		config.DiscoveryCacheMaxEntries = 100
+	}
 
-	return &Server{
-		config:  config,
-		budgets: make(map[string]*Budget),
-		cache:   make(map[string]*APIDiscoveryCache),
+	var signerErr error
+	if config.Signer == nil && config.PrivateKey != "" {
+		local, err := NewLocalSigner(config.PrivateKey)
+		switch {
+		case err != nil:
+			signerErr = fmt.Errorf("invalid PrivateKey: %w", err)
+		case config.WalletAddress != "" && !strings.EqualFold(config.WalletAddress, local.Address()):
+			signerErr = fmt.Errorf("PrivateKey belongs to %s, not WalletAddress %s", local.Address(), config.WalletAddress)
+		default:
+			config.Signer = NewExactPaymentSigner(local)
+			if config.WalletAddress == "" {
+				config.WalletAddress = local.Address()
+			}
+		}
+	}
+
+	s := &Server{
+		config:    config,
+		budgets:   make(map[string]*Budget),
+		sessions:  make(map[string]time.Time),
+		cache:     make(map[string]*APIDiscoveryCache),
+		streams:   make(map[string]map[chan []byte]struct{}),
+		signerErr: signerErr,
+
+		subscriptions: make(map[string]map[string]bool),
+		responses:     make(map[string][]savedResponse),
+		confirmations: make(map[string]pendingConfirmation),
+	}
+	if config.Storage != nil {
+		s.storageErr = s.loadBudgets()
 	}
+	return s
 }
 
 // GetTools returns the list of available tools
 func (s *Server) GetTools() []Tool {
-	return []Tool{
+	tools := []Tool{
 		{
 			Name:        "x402_discover",
 			Description: "Discover available paid API endpoints and their costs. Use this before calling a paid API to understand pricing.",
@@ -211,10 +384,22 @@ func (s *Server) GetTools() []Tool {
 						Type:        "string",
 						Description: "Base URL of the API to discover (e.g., https://api.example.com)",
 					},
+					"refresh": {
+						Type:        "boolean",
+						Description: "Ignore cached results and query the API again",
+					},
 				},
 				Required: []string{"url"},
 			},
 		},
+		{
+			Name:        "x402_list_apis",
+			Description: "List the APIs you are configured to use, with descriptions and any known endpoint costs.",
+			InputSchema: InputSchema{
+				Type:       "object",
+				Properties: map[string]Property{},
+			},
+		},
 		{
 			Name:        "x402_call",
 			Description: "Call a paid API endpoint with automatic x402 payment handling. The payment will be deducted from your pre-authorized budget.",
@@ -233,35 +418,47 @@ func (s *Server) GetTools() []Tool {
 					},
 					"headers": {
 						Type:        "object",
-						Description: "Additional headers to send (optional)",
+						Description: "Additional headers to send (optional). Payment, identity, and budget headers are set by the server and ignored here.",
 					},
 					"body": {
 						Type:        "string",
-						Description: "Request body for POST/PUT/PATCH requests (optional)",
+						Description: "Request body for POST/PUT/PATCH requests (optional). Sent as JSON when it parses as JSON, unless headers set Content-Type.",
 					},
 					"max_cost": {
 						Type:        "number",
 						Description: "Maximum cost willing to pay for this call (in smallest currency unit)",
 					},
+					"save_to": {
+						Type:        "string",
+						Description: "Also save the full response body as the resource x402://responses/{save_to} (letters, digits, '.', '_' and '-'), for bodies too large for the result",
+					},
+					"confirmation_token": {
+						Type:        "string",
+						Description: "Token from a confirmation-required result, sent once the user has approved the payment",
+					},
 				},
 				Required: []string{"url"},
 			},
 		},
 		{
 			Name:        "x402_budget",
-			Description: "Manage your x402 spending budget. Create, check, or top up your pre-authorized budget.",
+			Description: "Manage your x402 spending budget. Create, check, or top up your pre-authorized budget, or attach one created through the API's /ai/budget endpoint.",
 			InputSchema: InputSchema{
 				Type: "object",
 				Properties: map[string]Property{
 					"action": {
 						Type:        "string",
 						Description: "Action to perform",
-						Enum:        []string{"create", "status", "topup", "close"},
+						Enum:        []string{"create", "status", "topup", "close", "attach"},
 					},
 					"amount": {
 						Type:        "number",
 						Description: "Amount for create/topup actions (in smallest currency unit)",
 					},
+					"budget_id": {
+						Type:        "string",
+						Description: "Existing pre-authorized budget ID for the attach action",
+					},
 				},
 				Required: []string{"action"},
 			},
@@ -287,7 +484,7 @@ func (s *Server) GetTools() []Tool {
 		},
 		{
 			Name:        "x402_history",
-			Description: "View your x402 payment history and spending analytics.",
+			Description: "View your x402 payment history and spending analytics: every call attempt, including refused and failed ones, with success rate, average cost, and spend per API.",
 			InputSchema: InputSchema{
 				Type: "object",
 				Properties: map[string]Property{
@@ -296,17 +493,53 @@ func (s *Server) GetTools() []Tool {
 						Description: "Maximum number of transactions to return",
 						Default:     10,
 					},
+					"api": {
+						Type:        "string",
+						Description: "Only show calls whose URL contains this text (optional)",
+					},
+					"since": {
+						Type:        "string",
+						Description: "Only show calls at or after this RFC 3339 time (optional)",
+					},
+					"until": {
+						Type:        "string",
+						Description: "Only show calls at or before this RFC 3339 time (optional)",
+					},
 				},
 			},
 		},
 	}
+
+	for i := range tools {
+		tools[i].InputSchema.Properties["output"] = outputProperty
+	}
+	return tools
 }
 
 // CallTool handles a tool call
 func (s *Server) CallTool(ctx context.Context, name string, args map[string]interface{}) (*ToolResult, error) {
+	mode, err := s.outputMode(args)
+	if err != nil {
+		return s.formatResult(errorResult(x402.ErrCodeInvalidRequest, err.Error()), OutputStructured), nil
+	}
+
+	result, err := s.callTool(ctx, name, args)
+	if err != nil {
+		return nil, err
+	}
+	return s.formatResult(result, mode), nil
+}
+
+func (s *Server) callTool(ctx context.Context, name string, args map[string]interface{}) (*ToolResult, error) {
+	if s.storageErr != nil && (name == "x402_call" || name == "x402_budget" || name == "x402_history") {
+		return errorResult(x402.ErrCodeServerError, fmt.Sprintf("Budget storage unavailable: %v", s.storageErr)), nil
+	}
+
 	switch name {
 	case "x402_discover":
 		return s.handleDiscover(ctx, args)
+	case "x402_list_apis":
+		return s.handleListAPIs(ctx, args)
 	case "x402_call":
 		return s.handleCall(ctx, args)
 	case "x402_budget":
@@ -327,23 +560,24 @@ func (s *Server) CallTool(ctx context.Context, name string, args map[string]inte
 func (s *Server) handleDiscover(ctx context.Context, args map[string]interface{}) (*ToolResult, error) {
 	url, ok := args["url"].(string)
 	if !ok {
-		return errorResult("url is required"), nil
+		return errorResult(x402.ErrCodeInvalidRequest, "url is required"), nil
+	}
+	if denied := s.checkAllowedURL(url); denied != nil {
+		return denied, nil
 	}
 
 	// Check cache
-	s.mu.RLock()
-	cached, ok := s.cache[url]
-	s.mu.RUnlock()
-
-	if ok && time.Now().Before(cached.ExpiresAt) {
-		return s.formatDiscoveryResult(cached), nil
+	if refresh, _ := args["refresh"].(bool); !refresh {
+		if cached, ok := s.cachedDiscovery(url); ok {
+			return s.formatDiscoveryResult(cached), nil
+		}
 	}
 
 	// Discover API
 	discoveryURL := url + "/ai/discover"
 	req, err := http.NewRequestWithContext(ctx, "GET", discoveryURL, nil)
 	if err != nil {
-		return errorResult(fmt.Sprintf("Failed to create request: %v", err)), nil
+		return errorResult(x402.ErrCodeInvalidRequest, fmt.Sprintf("Failed to create request: %v", err)), nil
 	}
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("X-AI-Agent", "true")
@@ -360,22 +594,23 @@ func (s *Server) handleDiscover(ctx context.Context, args map[string]interface{}
 	}
 
 	var discovery struct {
-		Endpoints []DiscoveredEndpoint `json:"endpoints"`
+		Endpoints     []DiscoveredEndpoint `json:"endpoints"`
+		FreeEndpoints []x402.FreeEndpoint  `json:"freeEndpoints"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
-		return errorResult(fmt.Sprintf("Failed to parse discovery response: %v", err)), nil
+		return errorResult(x402.ErrCodeServerError, fmt.Sprintf("Failed to parse discovery response: %v", err)), nil
 	}
 
 	// Cache result
+	now := time.Now()
 	cacheEntry := &APIDiscoveryCache{
-		URL:       url,
-		Endpoints: discovery.Endpoints,
-		CachedAt:  time.Now(),
-		ExpiresAt: time.Now().Add(5 * time.Minute),
+		URL:           url,
+		Endpoints:     discovery.Endpoints,
+		FreeEndpoints: discovery.FreeEndpoints,
+		CachedAt:      now,
+		ExpiresAt:     now.Add(s.config.DiscoveryCacheTTL),
 	}
-	s.mu.Lock()
-	s.cache[url] = cacheEntry
-	s.mu.Unlock()
+	s.cacheDiscovery(cacheEntry)
 
 	return s.formatDiscoveryResult(cacheEntry), nil
 }
@@ -387,28 +622,23 @@ func (s *Server) discoverVia402(ctx context.Context, baseURL string) (*ToolResul
 
 	resp, err := s.config.HTTPClient.Do(req)
 	if err != nil {
-		return errorResult(fmt.Sprintf("Failed to connect to API: %v", err)), nil
+		return errorResult(x402.ErrCodeServerError, fmt.Sprintf("Failed to connect to API: %v", err)), nil
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusPaymentRequired {
-		return textResult(fmt.Sprintf("API at %s does not require payment (status: %d)", baseURL, resp.StatusCode)), nil
+		text := fmt.Sprintf("API at %s does not require payment (status: %d)", baseURL, resp.StatusCode)
+		return structuredResult(text, text, discoveryData{URL: baseURL, Status: resp.StatusCode}), nil
 	}
 
 	// Parse x402 response
 	var x402Resp struct {
-		X402Version int `json:"x402Version"`
-		Accepts     []struct {
-			Scheme            string `json:"scheme"`
-			Network           string `json:"network"`
-			MaxAmountRequired string `json:"maxAmountRequired"`
-			PayTo             string `json:"payTo"`
-			Description       string `json:"description"`
-		} `json:"accepts"`
+		X402Version int                  `json:"x402Version"`
+		Accepts     []PaymentRequirement `json:"accepts"`
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&x402Resp); err != nil {
-		return errorResult("API returned 402 but response is not x402 compliant"), nil
+		return errorResult(x402.ErrCodeServerError, "API returned 402 but response is not x402 compliant"), nil
 	}
 
 	// Format result
@@ -427,23 +657,27 @@ func (s *Server) discoverVia402(ctx context.Context, baseURL string) (*ToolResul
 
 	result += "\n\nUse `x402_call` to make a paid request to this API."
 
-	return textResult(result), nil
+	return structuredResult(result,
+		fmt.Sprintf("%s requires x402 payment; %d payment options.", baseURL, len(x402Resp.Accepts)),
+		discoveryData{URL: baseURL, PaymentRequired: true, Status: resp.StatusCode, Accepts: x402Resp.Accepts},
+	), nil
 }
 
 func (s *Server) handleCall(ctx context.Context, args map[string]interface{}) (*ToolResult, error) {
-	url, _ := args["url"].(string)
-	method, _ := args["method"].(string)
-	if method == "" {
-		method = "GET"
+	call, err := parseCallRequest(args)
+	if err != nil {
+		return errorResult(x402.ErrCodeInvalidRequest, err.Error()), nil
 	}
+	url, method := call.url, call.method
 
-	// Check budget
-	s.mu.RLock()
-	budget := s.budgets["default"]
-	s.mu.RUnlock()
+	if denied := s.checkAllowedURL(url); denied != nil {
+		return denied, nil
+	}
 
+	// Check budget
+	budget := s.sessionBudget(ctx)
 	if budget == nil {
-		return errorResult("No budget set. Use x402_budget to create a spending budget first."), nil
+		return errorResult(x402.ErrCodeInsufficientBudget, "No budget set. Use x402_budget to create a spending budget first."), nil
 	}
 
 	maxCost := int64(0)
@@ -452,96 +686,308 @@ func (s *Server) handleCall(ctx context.Context, args map[string]interface{}) (*
 	}
 
 	// First, make request to get 402 requirements
-	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	req, err := call.newRequest(ctx)
 	if err != nil {
-		return errorResult(fmt.Sprintf("Invalid URL: %v", err)), nil
+		return errorResult(x402.ErrCodeInvalidRequest, fmt.Sprintf("Invalid URL: %v", err)), nil
 	}
-	req.Header.Set("X-AI-Agent", "true")
-	req.Header.Set("X-Agent-Budget", fmt.Sprintf("%d", budget.Remaining))
+
+	// Every attempt is recorded, so x402_history shows near-misses too
+	tx := Transaction{
+		SessionID: budget.SessionID,
+		API:       url,
+		Endpoint:  req.URL.Path,
+		Currency:  budget.Currency,
+		RequestID: newRequestID(),
+	}
+	refuse := func(reason string, cost int64, result *ToolResult) (*ToolResult, error) {
+		tx.Amount, tx.Reason = cost, reason
+		s.recordAttempt(budget, tx)
+		return result, nil
+	}
+
+	// A price already known from discovery is checked before calling at all
+	if maxCost > 0 {
+		if cost, ok := s.cachedCost(method, url); ok && cost > maxCost {
+			return refuse(ReasonOverMaxCost, cost, overMaxCost(cost, maxCost))
+		}
+	}
+
+	s.mu.RLock()
+	advertised := budget.Remaining
+	s.mu.RUnlock()
+	if maxCost > 0 && maxCost < advertised {
+		advertised = maxCost
+	}
+	req.Header.Set("X-Agent-Budget", fmt.Sprintf("%d", advertised))
 
 	resp, err := s.config.HTTPClient.Do(req)
 	if err != nil {
-		return errorResult(fmt.Sprintf("Request failed: %v", err)), nil
+		return refuse(ReasonHTTPError, 0, errorResult(x402.ErrCodeServerError, fmt.Sprintf("Request failed: %v", err)))
 	}
 	defer resp.Body.Close()
 
 	// If not 402, return response directly
 	if resp.StatusCode != http.StatusPaymentRequired {
-		body, _ := io.ReadAll(resp.Body)
-		return textResult(fmt.Sprintf("Response (Status %d):\n\n%s", resp.StatusCode, string(body))), nil
+		text, response := s.describeResponse(ctx, call, resp)
+		if resp.StatusCode >= 400 {
+			tx.Amount, tx.Reason = 0, ReasonHTTPError
+			s.recordAttempt(budget, tx)
+		}
+		markdown := fmt.Sprintf("Response (Status %d):\n\n%s", resp.StatusCode, text)
+		return structuredResult(markdown, markdown, callData{
+			URL:          url,
+			Method:       method,
+			Status:       resp.StatusCode,
+			callResponse: response,
+		}), nil
 	}
 
 	// Parse 402 response
-	var x402Resp struct {
-		Accepts []struct {
-			MaxAmountRequired string `json:"maxAmountRequired"`
-			Network           string `json:"network"`
-			PayTo             string `json:"payTo"`
-		} `json:"accepts"`
+	requirements, err := parsePaymentRequired(resp)
+	if err != nil {
+		return refuse(ReasonInvalidQuote, 0, errorResult(x402.ErrCodeServerError, err.Error()))
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&x402Resp); err != nil {
-		return errorResult("Failed to parse 402 response"), nil
+	requirement := s.selectRequirement(requirements)
+	tx.Network = requirement.Network
+
+	// Get cost
+	var cost int64
+	if _, err := fmt.Sscanf(requirement.MaxAmountRequired, "%d", &cost); err != nil {
+		return refuse(ReasonInvalidQuote, 0, errorResult(x402.ErrCodeServerError, "Failed to parse cost"))
 	}
 
-	if len(x402Resp.Accepts) == 0 {
-		return errorResult("API returned 402 but no payment options available"), nil
+	// The quote is authoritative; drop discovery results that disagree
+	s.invalidateOnPriceChange(method, url, cost)
+
+	// Check max cost limit
+	if maxCost > 0 && cost > maxCost {
+		return refuse(ReasonOverMaxCost, cost, overMaxCost(cost, maxCost))
 	}
 
-	// Get cost
-	var cost int64
-	if _, err := fmt.Sscanf(x402Resp.Accepts[0].MaxAmountRequired, "%d", &cost); err != nil {
-		return errorResult("Failed to parse cost"), nil
+	if limited := s.checkCallLimits(cost); limited != nil {
+		return refuse(ReasonOverLimit, cost, limited)
 	}
 
-	// Check budget
-	if cost > budget.Remaining {
-		return errorResult(fmt.Sprintf(
+	if s.config.Signer == nil {
+		if s.signerErr != nil {
+			return refuse(ReasonNoSigner, cost, errorResult(x402.ErrCodePaymentRequired, fmt.Sprintf("Payment signer unavailable: %v", s.signerErr)))
+		}
+		return refuse(ReasonNoSigner, cost, errorResult(x402.ErrCodePaymentRequired, "No payment signer configured. Set ServerConfig.PrivateKey or Signer to enable paid calls."))
+	}
+
+	if limited := s.reserveDaily(cost); limited != nil {
+		return refuse(ReasonOverLimit, cost, limited)
+	}
+	token, _ := args["confirmation_token"].(string)
+	if held := s.requireConfirmation(budget.SessionID, method, url, cost, token); held != nil {
+		s.settleDaily(Transaction{Amount: cost}, false)
+		return refuse(ReasonConfirmationRequired, cost, held)
+	}
+
+	// Reserve the cost up front so concurrent calls cannot overspend;
+	// it is refunded if the paid call does not go through
+	if err := s.reserve(budget, cost); err != nil {
+		s.settleDaily(Transaction{Amount: cost}, false)
+		if !errors.Is(err, x402.ErrInsufficientBudget) {
+			return refuse(ReasonBudgetUnavailable, cost, errorResult(x402.ErrCodeServerError, fmt.Sprintf("Failed to reserve budget: %v", err)))
+		}
+		s.mu.RLock()
+		remaining := budget.Remaining
+		s.mu.RUnlock()
+		return refuse(ReasonOverBudget, cost, errorResult(x402.ErrCodeInsufficientBudget, fmt.Sprintf(
 			"Insufficient budget. Required: %d, Available: %d. Use x402_budget to top up.",
-			cost, budget.Remaining,
-		)), nil
+			cost, remaining,
+		)).withDetails(map[string]string{
+			"required":  strconv.FormatInt(cost, 10),
+			"available": strconv.FormatInt(remaining, 10),
+		}))
 	}
+	tx.Amount = cost
 
-	// Check max cost limit
-	if maxCost > 0 && cost > maxCost {
-		return errorResult(fmt.Sprintf(
-			"Cost (%d) exceeds your max_cost limit (%d). Increase limit or skip this call.",
-			cost, maxCost,
-		)), nil
-	}
-
-	// TODO: In production, this would:
-	// 1. Sign the payment transaction
-	// 2. Submit to facilitator
-	// 3. Get payment proof
-	// 4. Retry request with payment header
-
-	// For now, simulate payment
-	s.mu.Lock()
-	budget.Spent += cost
-	budget.Remaining -= cost
-	budget.LastUsedAt = time.Now()
-	budget.Transactions = append(budget.Transactions, Transaction{
-		Timestamp: time.Now(),
-		API:       url,
-		Amount:    cost,
-		Currency:  budget.Currency,
-		Success:   true,
-	})
-	s.mu.Unlock()
+	payment, err := s.config.Signer.SignPayment(ctx, requirement)
+	if err != nil {
+		tx.Reason = ReasonSigningFailed
+		s.settleCall(budget, tx, false)
+		return errorResult(x402.ErrCodeInvalidPayment, fmt.Sprintf("Failed to sign payment: %v", err)), nil
+	}
+
+	// Retry the original request with the payment attached
+	paidReq, err := call.newRequest(ctx)
+	if err != nil {
+		tx.Reason = ReasonHTTPError
+		s.settleCall(budget, tx, false)
+		return errorResult(x402.ErrCodeInvalidRequest, fmt.Sprintf("Invalid URL: %v", err)), nil
+	}
+	paidReq.Header.Set("X-PAYMENT", payment)
+	paidReq.Header.Set("X-Request-ID", tx.RequestID)
+
+	paidResp, err := s.config.HTTPClient.Do(paidReq)
+	if err != nil {
+		tx.Reason = ReasonHTTPError
+		s.settleCall(budget, tx, false)
+		return errorResult(x402.ErrCodeServerError, fmt.Sprintf("Paid request failed: %v", err)), nil
+	}
+	defer paidResp.Body.Close()
+
+	if id := paidResp.Header.Get("X-Request-ID"); id != "" {
+		tx.RequestID = id
+	}
+	settlement := parseSettlementResponse(paidResp.Header.Get("X-PAYMENT-RESPONSE"))
+	if settlement != nil {
+		tx.TxHash = settlement.Transaction
+		if settlement.Network != "" {
+			tx.Network = settlement.Network
+		}
+	}
+	text, response := s.describeResponse(ctx, call, paidResp)
+
+	// A non-2xx response is only charged when the seller reports the
+	// payment as settled; otherwise the reservation is refunded
+	paid := paidResp.StatusCode >= 200 && paidResp.StatusCode < 300
+	charged := paid || (settlement != nil && settlement.Success)
+	switch {
+	case paidResp.StatusCode == http.StatusPaymentRequired:
+		tx.Reason = ReasonPaymentRejected
+	case !paid:
+		tx.Reason = ReasonHTTPError
+	}
+	s.settleCall(budget, tx, charged)
+
+	if !paid {
+		if paidResp.StatusCode == http.StatusPaymentRequired {
+			return errorResult(x402.ErrCodeInvalidPayment, "Payment was rejected by the API. Your budget was not charged."), nil
+		}
+		note := "Your budget was not charged."
+		if charged {
+			note = fmt.Sprintf("The payment of %d %s was settled.", cost, budget.Currency)
+		}
+		return errorResult(x402.ErrCodeServerError, fmt.Sprintf("Paid request returned status %d. %s\n\n%s", paidResp.StatusCode, note, response.Body)), nil
+	}
+
+	s.mu.RLock()
+	remaining := budget.Remaining
+	s.mu.RUnlock()
 
-	// Make paid request (simulated)
 	result := "# Payment Processed\n\n"
 	result += fmt.Sprintf("- **Amount**: %d %s\n", cost, budget.Currency)
-	result += fmt.Sprintf("- **Remaining Budget**: %d %s\n", budget.Remaining, budget.Currency)
-	result += "\n---\n\n"
-	result += "⚠️ **Note**: In production, this would make the actual paid API call and return the response.\n"
-	result += "Payment signing requires wallet integration."
+	result += fmt.Sprintf("- **Remaining Budget**: %d %s\n", remaining, budget.Currency)
+	result += fmt.Sprintf("- **Request ID**: %s\n", tx.RequestID)
+	if tx.TxHash != "" {
+		result += fmt.Sprintf("- **Transaction**: %s\n", tx.TxHash)
+	}
+	result += fmt.Sprintf("\n## Response (Status %d)\n\n%s", paidResp.StatusCode, text)
+
+	return structuredResult(result,
+		fmt.Sprintf("Paid %d %s for %s %s (status %d); %d %s remaining.\n\n%s",
+			cost, budget.Currency, method, url, paidResp.StatusCode, remaining, budget.Currency, text),
+		callData{
+			URL:          url,
+			Method:       method,
+			Status:       paidResp.StatusCode,
+			Paid:         true,
+			Amount:       cost,
+			Currency:     budget.Currency,
+			Remaining:    &remaining,
+			RequestID:    tx.RequestID,
+			Transaction:  tx.TxHash,
+			Network:      tx.Network,
+			callResponse: response,
+		},
+	), nil
+}
+
+// describeResponse reads resp for x402_call's result, saving the body as a
+// resource when the call has save_to. text renders the selected headers, the
+// (possibly truncated) body, and notes about truncation and ignored headers.
+func (s *Server) describeResponse(ctx context.Context, call *callRequest, resp *http.Response) (text string, out callResponse) {
+	body, _ := s.readResponseBody(resp, call.saveTo != "")
+	out = callResponse{
+		Headers:        s.responseHeaders(resp),
+		Body:           body.text,
+		Truncated:      body.truncated,
+		IgnoredHeaders: call.ignored,
+	}
+
+	text = formatHeaders(out.Headers) + out.Body
+	if call.saveTo != "" {
+		out.Resource = s.saveResponse(SessionFromContext(ctx), call.saveTo, resp.Header.Get("Content-Type"), body.saved)
+		text += fmt.Sprintf("\n\nFull body saved as resource %s", out.Resource)
+		if body.savedTruncated {
+			text += fmt.Sprintf(" (cut at %d bytes)", s.config.MaxSavedResponseBytes)
+		}
+	} else if body.truncated {
+		text += "\n\nCall again with save_to to read the full body as a resource."
+	}
+	return text + ignoredNote(call.ignored), out
+}
 
-	return textResult(result), nil
+// formatHeaders lists response headers above a response body
+func formatHeaders(headers map[string]string) string {
+	if len(headers) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := ""
+	for _, name := range names {
+		out += fmt.Sprintf("%s: %s\n", name, headers[name])
+	}
+	return out + "\n"
+}
+
+// ignoredNote tells the agent which of its headers were not sent
+func ignoredNote(ignored []string) string {
+	if len(ignored) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\n\nNot sent (set by the server): %s", strings.Join(ignored, ", "))
+}
+
+// overMaxCost refuses a call whose price is above its max_cost
+func overMaxCost(cost, maxCost int64) *ToolResult {
+	return errorResult(x402.ErrCodeInsufficientBudget, fmt.Sprintf(
+		"Cost (%d) exceeds your max_cost limit (%d). Increase limit or skip this call.",
+		cost, maxCost,
+	)).withDetails(map[string]string{
+		"cost":    strconv.FormatInt(cost, 10),
+		"maxCost": strconv.FormatInt(maxCost, 10),
+	})
+}
+
+// callData is the structured result of x402_call
+type callData struct {
+	URL         string `json:"url"`
+	Method      string `json:"method"`
+	Status      int    `json:"status"`
+	Paid        bool   `json:"paid"`
+	Amount      int64  `json:"amount,omitempty"`
+	Currency    string `json:"currency,omitempty"`
+	Remaining   *int64 `json:"remaining,omitempty"`
+	RequestID   string `json:"requestId,omitempty"`
+	Transaction string `json:"transaction,omitempty"`
+	Network     string `json:"network,omitempty"`
+
+	callResponse
+}
+
+// callResponse is the part of callData describing the API's response
+type callResponse struct {
+	Headers        map[string]string `json:"headers,omitempty"`        // ResponseHeaders present on the response
+	Body           string            `json:"body"`                     // At most MaxResponseBytes
+	Truncated      bool              `json:"truncated,omitempty"`      // Body was cut at MaxResponseBytes
+	Resource       string            `json:"resource,omitempty"`       // URI of the body saved with save_to
+	IgnoredHeaders []string          `json:"ignoredHeaders,omitempty"` // Blocked headers that were not sent
 }
 
 func (s *Server) handleBudget(ctx context.Context, args map[string]interface{}) (*ToolResult, error) {
 	action, _ := args["action"].(string)
+	sessionID := SessionFromContext(ctx)
+	if action != "status" {
+		defer s.resourcesUpdated(sessionID, BudgetResourceURI)
+	}
 
 	switch action {
 	case "create":
@@ -550,9 +996,8 @@ func (s *Server) handleBudget(ctx context.Context, args map[string]interface{})
 			amount = int64(a)
 		}
 
-		s.mu.Lock()
-		s.budgets["default"] = &Budget{
-			SessionID:  "default",
+		budget := &Budget{
+			SessionID:  sessionID,
 			Total:      amount,
 			Spent:      0,
 			Remaining:  amount,
@@ -560,30 +1005,98 @@ func (s *Server) handleBudget(ctx context.Context, args map[string]interface{})
 			CreatedAt:  time.Now(),
 			LastUsedAt: time.Now(),
 		}
+
+		if s.config.PreAuthStore != nil {
+			pre := &x402.PreAuthBudget{
+				AgentID:       sessionID,
+				WalletAddress: s.config.WalletAddress,
+				TotalBudget:   amount,
+				Currency:      s.config.Currency,
+				ExpiresAt:     time.Now().Add(24 * time.Hour),
+			}
+			if err := s.config.PreAuthStore.Create(pre); err != nil {
+				return errorResult(x402.ErrCodeServerError, fmt.Sprintf("Failed to create budget: %v", err)), nil
+			}
+			budget.PreAuthID = pre.ID
+			budget.OwnsPreAuth = true
+		}
+
+		s.mu.Lock()
+		s.budgets[sessionID] = budget
 		s.mu.Unlock()
+		if err := s.persistBudget(budget); err != nil {
+			return errorResult(x402.ErrCodeServerError, fmt.Sprintf("Failed to save budget: %v", err)), nil
+		}
 
-		return textResult(fmt.Sprintf(
+		return structuredResult(fmt.Sprintf(
 			"✅ Budget created!\n\n- **Total**: %d %s\n- **Available**: %d %s\n\nYou can now use `x402_call` to make paid API requests.",
 			amount, s.config.Currency, amount, s.config.Currency,
-		)), nil
+		), fmt.Sprintf("Budget created with %d %s available.", amount, s.config.Currency), s.describeBudget(budget)), nil
 
-	case "status":
-		s.mu.RLock()
-		budget := s.budgets["default"]
-		s.mu.RUnlock()
+	case "attach":
+		if s.config.PreAuthStore == nil {
+			return errorResult(x402.ErrCodeInvalidRequest, "This server has no shared budget store to attach from."), nil
+		}
+		budgetID, _ := args["budget_id"].(string)
+		if budgetID == "" {
+			return errorResult(x402.ErrCodeInvalidRequest, "budget_id is required for attach"), nil
+		}
+		pre, err := s.config.PreAuthStore.Get(budgetID)
+		if err != nil {
+			return errorResult(x402.ErrCodeNotFound, fmt.Sprintf("Budget %s not found", budgetID)), nil
+		}
+
+		currency := pre.Currency
+		if currency == "" {
+			currency = s.config.Currency
+		}
+		budget := &Budget{
+			SessionID:  sessionID,
+			Currency:   currency,
+			CreatedAt:  pre.CreatedAt,
+			LastUsedAt: time.Now(),
+			PreAuthID:  pre.ID,
+		}
+		if err := s.syncPreAuth(budget); err != nil {
+			return errorResult(x402.ErrCodeNotFound, fmt.Sprintf("Budget %s not found", budgetID)), nil
+		}
 
+		s.mu.Lock()
+		s.budgets[sessionID] = budget
+		s.mu.Unlock()
+		if err := s.persistBudget(budget); err != nil {
+			return errorResult(x402.ErrCodeServerError, fmt.Sprintf("Failed to save budget: %v", err)), nil
+		}
+
+		data := s.describeBudget(budget)
+		return structuredResult(fmt.Sprintf(
+			"✅ Budget attached!\n\n- **Budget ID**: %s\n- **Available**: %d %s",
+			data.BudgetID, data.Remaining, data.Currency,
+		), fmt.Sprintf("Budget %s attached with %d %s available.", data.BudgetID, data.Remaining, data.Currency), data), nil
+
+	case "status":
+		budget := s.sessionBudget(ctx)
+		data := s.describeBudget(budget)
 		if budget == nil {
-			return textResult("No budget set. Use `x402_budget` with action `create` to set up a spending budget."), nil
+			text := "No budget set. Use `x402_budget` with action `create` to set up a spending budget."
+			return structuredResult(text, text, data), nil
 		}
 
-		return textResult(fmt.Sprintf(
+		result := fmt.Sprintf(
 			"# Budget Status\n\n- **Total**: %d %s\n- **Spent**: %d %s\n- **Remaining**: %d %s\n- **Transactions**: %d\n- **Created**: %s",
-			budget.Total, budget.Currency,
-			budget.Spent, budget.Currency,
-			budget.Remaining, budget.Currency,
-			len(budget.Transactions),
-			budget.CreatedAt.Format(time.RFC3339),
-		)), nil
+			data.Total, data.Currency,
+			data.Spent, data.Currency,
+			data.Remaining, data.Currency,
+			data.Transactions,
+			data.CreatedAt.Format(time.RFC3339),
+		)
+		if data.BudgetID != "" {
+			result += fmt.Sprintf("\n- **Budget ID**: %s", data.BudgetID)
+		}
+		return structuredResult(result, fmt.Sprintf(
+			"%d of %d %s remaining (%d spent over %d transactions).",
+			data.Remaining, data.Total, data.Currency, data.Spent, data.Transactions,
+		), data), nil
 
 	case "topup":
 		amount := int64(0)
@@ -591,55 +1104,93 @@ func (s *Server) handleBudget(ctx context.Context, args map[string]interface{})
 			amount = int64(a)
 		}
 		if amount <= 0 {
-			return errorResult("amount is required for topup"), nil
+			return errorResult(x402.ErrCodeInvalidRequest, "amount is required for topup"), nil
 		}
 
 		s.mu.Lock()
-		budget := s.budgets["default"]
+		budget := s.budgets[sessionID]
+		if budget != nil && budget.PreAuthID != "" {
+			s.mu.Unlock()
+			return errorResult(x402.ErrCodeInvalidRequest, "Shared budgets are topped up through the API's /ai/budget endpoint."), nil
+		}
 		if budget == nil {
 			budget = &Budget{
-				SessionID: "default",
+				SessionID: sessionID,
 				Currency:  s.config.Currency,
 				CreatedAt: time.Now(),
 			}
-			s.budgets["default"] = budget
+			s.budgets[sessionID] = budget
 		}
 		budget.Total += amount
 		budget.Remaining += amount
 		budget.LastUsedAt = time.Now()
+		total, remaining := budget.Total, budget.Remaining
 		s.mu.Unlock()
+		if err := s.persistBudget(budget); err != nil {
+			return errorResult(x402.ErrCodeServerError, fmt.Sprintf("Failed to save budget: %v", err)), nil
+		}
 
-		return textResult(fmt.Sprintf(
+		return structuredResult(fmt.Sprintf(
 			"✅ Budget topped up!\n\n- **Added**: %d %s\n- **New Total**: %d %s\n- **Available**: %d %s",
 			amount, s.config.Currency,
-			budget.Total, budget.Currency,
-			budget.Remaining, budget.Currency,
-		)), nil
+			total, budget.Currency,
+			remaining, budget.Currency,
+		), fmt.Sprintf("Added %d %s; %d %s available.", amount, budget.Currency, remaining, budget.Currency),
+			s.describeBudget(budget)), nil
 
 	case "close":
+		budget := s.sessionBudget(ctx)
+
 		s.mu.Lock()
-		budget := s.budgets["default"]
-		delete(s.budgets, "default")
+		delete(s.budgets, sessionID)
 		s.mu.Unlock()
 
 		if budget == nil {
-			return textResult("No budget to close."), nil
+			return structuredResult("No budget to close.", "No budget to close.", closeData{Currency: s.config.Currency}), nil
+		}
+		if s.config.Storage != nil {
+			if err := s.config.Storage.DeleteBudget(sessionID); err != nil {
+				return errorResult(x402.ErrCodeServerError, fmt.Sprintf("Failed to delete saved budget: %v", err)), nil
+			}
+		}
+		if budget.OwnsPreAuth {
+			_ = s.config.PreAuthStore.Delete(budget.PreAuthID)
 		}
 
-		return textResult(fmt.Sprintf(
+		snapshot := s.describeBudget(budget)
+		data := closeData{
+			Closed:       true,
+			Spent:        snapshot.Spent,
+			Refunded:     snapshot.Remaining,
+			Currency:     snapshot.Currency,
+			Transactions: snapshot.Transactions,
+		}
+		return structuredResult(fmt.Sprintf(
 			"✅ Budget closed!\n\n- **Total Spent**: %d %s\n- **Refunded**: %d %s\n- **Transactions**: %d",
-			budget.Spent, budget.Currency,
-			budget.Remaining, budget.Currency,
-			len(budget.Transactions),
-		)), nil
+			data.Spent, data.Currency,
+			data.Refunded, data.Currency,
+			data.Transactions,
+		), fmt.Sprintf("Budget closed: %d %s spent, %d %s refunded.", data.Spent, data.Currency, data.Refunded, data.Currency), data), nil
 
 	default:
-		return errorResult("Invalid action. Use: create, status, topup, or close"), nil
+		return errorResult(x402.ErrCodeInvalidRequest, "Invalid action. Use: create, status, topup, close, or attach"), nil
 	}
 }
 
+// closeData is the structured result of closing a budget
+type closeData struct {
+	Closed       bool   `json:"closed"`
+	Spent        int64  `json:"spent"`
+	Refunded     int64  `json:"refunded"`
+	Currency     string `json:"currency"`
+	Transactions int    `json:"transactions"`
+}
+
 func (s *Server) handleEstimate(ctx context.Context, args map[string]interface{}) (*ToolResult, error) {
 	url, _ := args["url"].(string)
+	if denied := s.checkAllowedURL(url); denied != nil {
+		return denied, nil
+	}
 
 	// Make request to get 402
 	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
@@ -647,63 +1198,113 @@ func (s *Server) handleEstimate(ctx context.Context, args map[string]interface{}
 
 	resp, err := s.config.HTTPClient.Do(req)
 	if err != nil {
-		return errorResult(fmt.Sprintf("Failed to connect: %v", err)), nil
+		return errorResult(x402.ErrCodeServerError, fmt.Sprintf("Failed to connect: %v", err)), nil
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusPaymentRequired {
-		return textResult(fmt.Sprintf("This endpoint does not require payment (status: %d)", resp.StatusCode)), nil
+		text := fmt.Sprintf("This endpoint does not require payment (status: %d)", resp.StatusCode)
+		return structuredResult(text, text, estimateData{URL: url, Status: resp.StatusCode}), nil
 	}
 
 	var x402Resp struct {
-		Accepts []struct {
-			MaxAmountRequired string `json:"maxAmountRequired"`
-			Network           string `json:"network"`
-			Description       string `json:"description"`
-		} `json:"accepts"`
+		Accepts []PaymentRequirement `json:"accepts"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&x402Resp); err != nil {
-		return errorResult("Failed to parse estimate response"), nil
+		return errorResult(x402.ErrCodeServerError, "Failed to parse estimate response"), nil
 	}
 
 	if len(x402Resp.Accepts) == 0 {
-		return errorResult("Could not determine cost"), nil
+		return errorResult(x402.ErrCodeServerError, "Could not determine cost"), nil
 	}
 
 	accept := x402Resp.Accepts[0]
-	return textResult(fmt.Sprintf(
+	data := estimateData{
+		URL:             url,
+		Status:          resp.StatusCode,
+		PaymentRequired: true,
+		Network:         accept.Network,
+		Description:     accept.Description,
+		Accepts:         x402Resp.Accepts,
+	}
+	data.Cost, _ = strconv.ParseInt(accept.MaxAmountRequired, 10, 64)
+
+	return structuredResult(fmt.Sprintf(
 		"# Cost Estimate\n\n- **URL**: %s\n- **Cost**: %s\n- **Network**: %s\n- **Description**: %s",
 		url, accept.MaxAmountRequired, accept.Network, accept.Description,
-	)), nil
+	), fmt.Sprintf("%s costs %s on %s.", url, accept.MaxAmountRequired, accept.Network), data), nil
+}
+
+// estimateData is the structured result of x402_estimate
+type estimateData struct {
+	URL             string               `json:"url"`
+	Status          int                  `json:"status"`
+	PaymentRequired bool                 `json:"paymentRequired"`
+	Cost            int64                `json:"cost,omitempty"`
+	Network         string               `json:"network,omitempty"`
+	Description     string               `json:"description,omitempty"`
+	Accepts         []PaymentRequirement `json:"accepts,omitempty"`
 }
 
 func (s *Server) handleHistory(ctx context.Context, args map[string]interface{}) (*ToolResult, error) {
-	limit := 10
+	filter := TransactionFilter{
+		SessionID: SessionFromContext(ctx),
+		Limit:     10,
+	}
 	if l, ok := args["limit"].(float64); ok {
-		limit = int(l)
+		filter.Limit = int(l)
+	}
+	filter.API, _ = args["api"].(string)
+	for key, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		raw, _ := args[key].(string)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return errorResult(x402.ErrCodeInvalidRequest, fmt.Sprintf("%s must be an RFC 3339 time", key)), nil
+		}
+		*dst = t
 	}
 
-	s.mu.RLock()
-	budget := s.budgets["default"]
-	s.mu.RUnlock()
+	budget := s.sessionBudget(ctx)
 
-	if budget == nil || len(budget.Transactions) == 0 {
-		return textResult("No transaction history."), nil
+	// Stats cover every matching attempt; limit only trims the listing
+	limit := filter.Limit
+	filter.Limit = 0
+	txs, err := s.sessionTransactions(ctx, filter)
+	if err != nil {
+		return errorResult(x402.ErrCodeServerError, fmt.Sprintf("Failed to read history: %v", err)), nil
+	}
+
+	data := s.historyStats(txs)
+	data.Currency = s.config.Currency
+	if budget != nil {
+		snapshot := s.describeBudget(budget)
+		data.TotalSpent, data.Currency = snapshot.Spent, snapshot.Currency
+	}
+	if limit > 0 && len(txs) > limit {
+		txs = txs[len(txs)-limit:]
+	}
+	data.Transactions = txs
+
+	if len(txs) == 0 {
+		return structuredResult("No transaction history.", "No transaction history.", data), nil
 	}
 
 	result := "# Transaction History\n\n"
 	result += "| Time | API | Amount | Status |\n"
 	result += "|------|-----|--------|--------|\n"
 
-	start := len(budget.Transactions) - limit
-	if start < 0 {
-		start = 0
-	}
-
-	for i := len(budget.Transactions) - 1; i >= start; i-- {
-		tx := budget.Transactions[i]
+	for i := len(txs) - 1; i >= 0; i-- {
+		tx := txs[i]
 		status := "✅"
-		if !tx.Success {
+		switch {
+		case tx.Success && tx.Reason != "":
+			status = "⚠️ charged, " + tx.Reason
+		case !tx.Success && tx.Reason != "":
+			status = "❌ " + tx.Reason
+		case !tx.Success:
 			status = "❌"
 		}
 		result += fmt.Sprintf("| %s | %s | %d %s | %s |\n",
@@ -715,27 +1316,144 @@ func (s *Server) handleHistory(ctx context.Context, args map[string]interface{})
 		)
 	}
 
-	result += fmt.Sprintf("\n**Total Spent**: %d %s", budget.Spent, budget.Currency)
+	result += "\n## Summary\n\n"
+	result += fmt.Sprintf("- **Attempts**: %d (%d succeeded, %d failed)\n", data.Attempts, data.Succeeded, data.Failed)
+	result += fmt.Sprintf("- **Success Rate**: %.0f%%\n", data.SuccessRate*100)
+	result += fmt.Sprintf("- **Average Cost**: %d %s\n", data.AverageCost, data.Currency)
+	if budget != nil {
+		result += fmt.Sprintf("- **Total Spent**: %d %s\n", data.TotalSpent, data.Currency)
+	}
 
-	return textResult(result), nil
+	result += "\n## Spend by API\n\n"
+	result += "| API | Calls | Failed | Spent |\n"
+	result += "|-----|-------|--------|-------|\n"
+	for _, api := range data.ByAPI {
+		result += fmt.Sprintf("| %s | %d | %d | %d %s |\n", api.API, api.Calls, api.Failed, api.Spent, data.Currency)
+	}
+
+	return structuredResult(result,
+		fmt.Sprintf("%d attempts, %d failed (%.0f%% success); average cost %d %s; %d %s spent in total.",
+			data.Attempts, data.Failed, data.SuccessRate*100, data.AverageCost, data.Currency, data.TotalSpent, data.Currency),
+		data,
+	), nil
+}
+
+// historyData is the structured result of x402_history
+type historyData struct {
+	Transactions []Transaction `json:"transactions"`
+	TotalSpent   int64         `json:"totalSpent"`
+	Currency     string        `json:"currency"`
+
+	Attempts    int        `json:"attempts"`
+	Succeeded   int        `json:"succeeded"`
+	Failed      int        `json:"failed"`
+	SuccessRate float64    `json:"successRate"` // Succeeded over Attempts
+	AverageCost int64      `json:"averageCost"` // Of the calls charged
+	ByAPI       []apiSpend `json:"byApi"`
+}
+
+// apiSpend is one API's share of the history
+type apiSpend struct {
+	API    string `json:"api"` // Known API name, or scheme and host
+	Calls  int    `json:"calls"`
+	Failed int    `json:"failed"`
+	Spent  int64  `json:"spent"`
+}
+
+// historyStats summarizes txs, with the APIs that cost the most first
+func (s *Server) historyStats(txs []Transaction) historyData {
+	var data historyData
+	var charged, spent int64
+	byAPI := map[string]*apiSpend{}
+	for _, tx := range txs {
+		label := s.apiLabel(tx.API)
+		api, ok := byAPI[label]
+		if !ok {
+			api = &apiSpend{API: label}
+			byAPI[label] = api
+		}
+		api.Calls++
+		data.Attempts++
+		if tx.succeeded() {
+			data.Succeeded++
+		} else {
+			data.Failed++
+			api.Failed++
+		}
+		if tx.Success {
+			charged++
+			spent += tx.Amount
+			api.Spent += tx.Amount
+		}
+	}
+	if data.Attempts > 0 {
+		data.SuccessRate = float64(data.Succeeded) / float64(data.Attempts)
+	}
+	if charged > 0 {
+		data.AverageCost = spent / charged
+	}
+
+	data.ByAPI = make([]apiSpend, 0, len(byAPI))
+	for _, api := range byAPI {
+		data.ByAPI = append(data.ByAPI, *api)
+	}
+	sort.Slice(data.ByAPI, func(i, j int) bool {
+		if data.ByAPI[i].Spent != data.ByAPI[j].Spent {
+			return data.ByAPI[i].Spent > data.ByAPI[j].Spent
+		}
+		return data.ByAPI[i].API < data.ByAPI[j].API
+	})
+	return data
 }
 
 // ============================================================================
 // TRANSPORT: STDIO (for CLI usage)
 // ============================================================================
 
-// ListenStdio starts the server on stdin/stdout (standard MCP transport)
+// ListenStdio starts the server on stdin/stdout (standard MCP transport).
+// The connection is a single session whose budget is discarded on return.
 func (s *Server) ListenStdio() error {
-	reader := bufio.NewReader(os.Stdin)
-	encoder := json.NewEncoder(os.Stdout)
+	return s.serveStdio(os.Stdin, os.Stdout)
+}
 
-	for {
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			if err == io.EOF {
-				return nil
+// serveStdio serves newline-delimited JSON-RPC messages from in, writing
+// responses to out. Each request runs on its own goroutine, so a slow
+// x402_call doesn't hold up pings or other calls; responses are written
+// whole, in the order requests finish. It returns once in is exhausted and
+// the requests in flight have been answered.
+func (s *Server) serveStdio(in io.Reader, out io.Writer) error {
+	writer := &lockedWriter{w: out}
+	encoder := json.NewEncoder(writer)
+
+	ctx := WithSession(context.Background(), stdioSessionID)
+	defer s.EndSession(stdioSessionID)
+
+	// Notifications for the session are interleaved with responses
+	if notifications := s.openStream(stdioSessionID); notifications != nil {
+		go func() {
+			for msg := range notifications {
+				_, _ = writer.Write(append(msg, '\n'))
 			}
-			return err
+		}()
+	}
+
+	var tooLong bool
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, min(64*1024, s.config.MaxMessageBytes)), s.config.MaxMessageBytes)
+	scanner.Split(skipLongLines(s.config.MaxMessageBytes, &tooLong))
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	inFlight := newInFlightRequests()
+	for scanner.Scan() {
+		if tooLong {
+			tooLong = false
+			s.sendError(encoder, nil, InvalidRequest, fmt.Sprintf("Message exceeds %d bytes", s.config.MaxMessageBytes))
+			continue
+		}
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
 		}
 
 		var req JSONRPCRequest
@@ -744,37 +1462,129 @@ func (s *Server) ListenStdio() error {
 			continue
 		}
 
-		s.handleRequest(encoder, &req)
+		// Notifications are handled in order; only cancellations need any
+		// action
+		if req.ID == nil {
+			if id, ok := cancelledRequest(&req); ok {
+				inFlight.cancel(id)
+			}
+			continue
+		}
+
+		reqCtx, done := inFlight.start(ctx, req.ID)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer done()
+
+			// Buffered so the response is written in one piece, or not at
+			// all if the client cancelled the request
+			var response bytes.Buffer
+			s.handleRequestContext(reqCtx, json.NewEncoder(&response), &req)
+			if reqCtx.Err() == nil {
+				_, _ = writer.Write(response.Bytes())
+			}
+		}()
 	}
+	return scanner.Err()
 }
 
-// ============================================================================
-// TRANSPORT: HTTP (for web usage)
-// ============================================================================
-
-// ListenHTTP starts the server on HTTP
-func (s *Server) ListenHTTP(addr string) error {
-	http.HandleFunc("/mcp", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
+// skipLongLines is bufio.ScanLines, except that lines over limit bytes are
+// discarded instead of failing the scan: an empty token stands in for each,
+// with tooLong set.
+func skipLongLines(limit int, tooLong *bool) bufio.SplitFunc {
+	discarding := false
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if discarding {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 && !atEOF {
+				return len(data), nil, nil
+			}
+			if i < 0 {
+				i = len(data) - 1
+			}
+			discarding, *tooLong = false, true
+			return i + 1, []byte{}, nil
 		}
-
-		var req JSONRPCRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			_ = json.NewEncoder(w).Encode(JSONRPCResponse{
-				JSONRPC: "2.0",
-				Error:   &JSONRPCError{Code: ParseError, Message: "Parse error"},
-			})
-			return
+		if !atEOF && len(data) >= limit && bytes.IndexByte(data, '\n') < 0 {
+			discarding = true
+			return len(data), nil, nil
 		}
+		return bufio.ScanLines(data, atEOF)
+	}
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		s.handleRequest(json.NewEncoder(w), &req)
-	})
+// inFlightRequests are the stdio requests being handled, by ID, so they can
+// be cancelled
+type inFlightRequests struct {
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+func newInFlightRequests() *inFlightRequests {
+	return &inFlightRequests{cancels: make(map[string]context.CancelFunc)}
+}
+
+// requestKey distinguishes IDs by type as well as value, so "1" and 1 are
+// different requests
+func requestKey(id interface{}) string {
+	key, _ := json.Marshal(id)
+	return string(key)
+}
 
-	return http.ListenAndServe(addr, nil)
+// start returns the context to handle request id with, and the func to call
+// once it's answered
+func (f *inFlightRequests) start(ctx context.Context, id interface{}) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	key := requestKey(id)
+	f.mu.Lock()
+	f.cancels[key] = cancel
+	f.mu.Unlock()
+	return ctx, func() {
+		f.mu.Lock()
+		delete(f.cancels, key)
+		f.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancel cancels request id's context, if it's still in flight
+func (f *inFlightRequests) cancel(id interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cancel, ok := f.cancels[requestKey(id)]; ok {
+		cancel()
+	}
+}
+
+// cancelledRequest returns the ID a cancellation notification names: MCP's
+// notifications/cancelled or the LSP-style $/cancelRequest
+func cancelledRequest(req *JSONRPCRequest) (interface{}, bool) {
+	var params struct {
+		RequestID interface{} `json:"requestId"`
+		ID        interface{} `json:"id"`
+	}
+	switch req.Method {
+	case "notifications/cancelled":
+		_ = json.Unmarshal(req.Params, &params)
+		return params.RequestID, params.RequestID != nil
+	case "$/cancelRequest":
+		_ = json.Unmarshal(req.Params, &params)
+		return params.ID, params.ID != nil
+	}
+	return nil, false
+}
+
+// lockedWriter serializes whole-message writes to stdout
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
 }
 
 // ============================================================================
@@ -782,27 +1592,72 @@ func (s *Server) ListenHTTP(addr string) error {
 // ============================================================================
 
 func (s *Server) handleRequest(encoder *json.Encoder, req *JSONRPCRequest) {
+	s.handleRequestContext(context.Background(), encoder, req)
+}
+
+func (s *Server) handleRequestContext(ctx context.Context, encoder *json.Encoder, req *JSONRPCRequest) {
+	// Notifications (no id) never get a response. The ones clients send
+	// (initialized, cancelled) need no action here; the stdio transport
+	// handles cancellation before dispatching.
+	if req.ID == nil {
+		return
+	}
+
 	switch req.Method {
 	case "initialize":
 		s.handleInitialize(encoder, req)
+	case "ping":
+		s.sendResult(encoder, req.ID, map[string]interface{}{})
 	case "tools/list":
 		s.handleToolsList(encoder, req)
 	case "tools/call":
-		s.handleToolsCall(encoder, req)
+		s.handleToolsCall(ctx, encoder, req)
+	case "resources/list":
+		s.handleResourcesList(encoder, req)
+	case "resources/read":
+		s.handleResourcesRead(ctx, encoder, req)
+	case "resources/subscribe":
+		s.handleResourcesSubscribe(ctx, encoder, req, true)
+	case "resources/unsubscribe":
+		s.handleResourcesSubscribe(ctx, encoder, req, false)
 	default:
 		s.sendError(encoder, req.ID, MethodNotFound, "Method not found")
 	}
 }
 
+// supportedProtocolVersions lists MCP revisions this server speaks, newest first
+var supportedProtocolVersions = []string{"2025-06-18", "2025-03-26", "2024-11-05"}
+
 func (s *Server) handleInitialize(encoder *json.Encoder, req *JSONRPCRequest) {
+	var params struct {
+		ProtocolVersion string `json:"protocolVersion"`
+	}
+	_ = json.Unmarshal(req.Params, &params)
+
+	// Echo the client's revision when supported, otherwise offer our newest.
+	// Clients that send none predate negotiation and get the original revision.
+	version := "2024-11-05"
+	if params.ProtocolVersion != "" {
+		version = supportedProtocolVersions[0]
+		for _, v := range supportedProtocolVersions {
+			if v == params.ProtocolVersion {
+				version = v
+			}
+		}
+	}
+
 	result := map[string]interface{}{
-		"protocolVersion": "2024-11-05",
+		"protocolVersion": version,
 		"serverInfo": map[string]string{
 			"name":    "x402-mcp-server",
 			"version": "1.0.0",
 		},
 		"capabilities": map[string]interface{}{
 			"tools": map[string]bool{},
+			"resources": map[string]bool{
+				"subscribe":   true,
+				"listChanged": false,
+			},
 		},
 	}
 	s.sendResult(encoder, req.ID, result)
@@ -815,7 +1670,7 @@ func (s *Server) handleToolsList(encoder *json.Encoder, req *JSONRPCRequest) {
 	s.sendResult(encoder, req.ID, result)
 }
 
-func (s *Server) handleToolsCall(encoder *json.Encoder, req *JSONRPCRequest) {
+func (s *Server) handleToolsCall(ctx context.Context, encoder *json.Encoder, req *JSONRPCRequest) {
 	var params struct {
 		Name      string                 `json:"name"`
 		Arguments map[string]interface{} `json:"arguments"`
@@ -825,7 +1680,7 @@ func (s *Server) handleToolsCall(encoder *json.Encoder, req *JSONRPCRequest) {
 		return
 	}
 
-	result, err := s.CallTool(context.Background(), params.Name, params.Arguments)
+	result, err := s.CallTool(ctx, params.Name, params.Arguments)
 	if err != nil {
 		s.sendError(encoder, req.ID, InternalError, err.Error())
 		return
@@ -854,6 +1709,17 @@ func (s *Server) sendError(encoder *json.Encoder, id interface{}, code int, mess
 // HELPERS
 // ============================================================================
 
+// discoveryData is the structured result of x402_discover
+type discoveryData struct {
+	URL             string               `json:"url"`
+	PaymentRequired bool                 `json:"paymentRequired"`
+	Status          int                  `json:"status,omitempty"`
+	Endpoints       []DiscoveredEndpoint `json:"endpoints,omitempty"`
+	FreeEndpoints   []x402.FreeEndpoint  `json:"freeEndpoints,omitempty"`
+	Accepts         []PaymentRequirement `json:"accepts,omitempty"`
+	CachedAt        *time.Time           `json:"cachedAt,omitempty"`
+}
+
 func (s *Server) formatDiscoveryResult(cache *APIDiscoveryCache) *ToolResult {
 	result := fmt.Sprintf("# API Discovery: %s\n\n", cache.URL)
 	result += "## Available Endpoints:\n\n"
@@ -865,20 +1731,28 @@ func (s *Server) formatDiscoveryResult(cache *APIDiscoveryCache) *ToolResult {
 			ep.Path, ep.Method, ep.Cost, ep.Currency, ep.Description)
 	}
 
-	return textResult(result)
-}
-
-func textResult(text string) *ToolResult {
-	return &ToolResult{
-		Content: []ContentBlock{{Type: "text", Text: text}},
+	// Free endpoints cost nothing to call, so agents needn't probe them
+	if len(cache.FreeEndpoints) > 0 {
+		result += "\n## Free Endpoints:\n\n"
+		result += "| Endpoint | Method | Why |\n"
+		result += "|----------|--------|-----|\n"
+		for _, ep := range cache.FreeEndpoints {
+			path, method := ep.Path, ep.Method
+			if ep.Prefix {
+				path += "*"
+			}
+			if method == "" {
+				method = "any"
+			}
+			result += fmt.Sprintf("| %s | %s | %s |\n", path, method, ep.Reason)
+		}
 	}
-}
 
-func errorResult(message string) *ToolResult {
-	return &ToolResult{
-		Content: []ContentBlock{{Type: "text", Text: "❌ Error: " + message}},
-		IsError: true,
-	}
+	cachedAt := cache.CachedAt
+	return structuredResult(result,
+		fmt.Sprintf("Found %d paid and %d free endpoints at %s.", len(cache.Endpoints), len(cache.FreeEndpoints), cache.URL),
+		discoveryData{URL: cache.URL, PaymentRequired: true, Endpoints: cache.Endpoints, FreeEndpoints: cache.FreeEndpoints, CachedAt: &cachedAt},
+	)
 }
 
 func truncateURL(url string, max int) string {
@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -30,16 +33,17 @@ func TestGetTools(t *testing.T) {
 
 	tools := server.GetTools()
 
-	if len(tools) != 5 {
-		t.Errorf("Expected 5 tools, got %d", len(tools))
+	if len(tools) != 6 {
+		t.Errorf("Expected 6 tools, got %d", len(tools))
 	}
 
 	expectedTools := map[string]bool{
-		"x402_discover": false,
-		"x402_call":     false,
-		"x402_budget":   false,
-		"x402_estimate": false,
-		"x402_history":  false,
+		"x402_discover":  false,
+		"x402_call":      false,
+		"x402_budget":    false,
+		"x402_estimate":  false,
+		"x402_history":   false,
+		"x402_list_apis": false,
 	}
 
 	for _, tool := range tools {
@@ -354,8 +358,8 @@ func TestToolsList(t *testing.T) {
 
 	result := listResp.Result.(map[string]interface{})
 	tools := result["tools"].([]interface{})
-	if len(tools) != 5 {
-		t.Errorf("Expected 5 tools, got %d", len(tools))
+	if len(tools) != 6 {
+		t.Errorf("Expected 6 tools, got %d", len(tools))
 	}
 }
 
@@ -426,3 +430,130 @@ func TestCacheExpiry(t *testing.T) {
 		t.Error("Should have made fresh discovery request")
 	}
 }
+
+// stdioPipe runs server's stdio transport over in-memory pipes, returning a
+// writer for requests and a channel of responses
+func stdioPipe(t *testing.T, server *Server) (io.WriteCloser, <-chan JSONRPCResponse) {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.serveStdio(inR, outW)
+		outW.Close()
+	}()
+
+	responses := make(chan JSONRPCResponse, 10)
+	go func() {
+		defer close(responses)
+		decoder := json.NewDecoder(outR)
+		for {
+			var resp JSONRPCResponse
+			if err := decoder.Decode(&resp); err != nil {
+				return
+			}
+			responses <- resp
+		}
+	}()
+	t.Cleanup(func() {
+		inW.Close()
+		if err := <-done; err != nil {
+			t.Errorf("serveStdio failed: %v", err)
+		}
+	})
+	return inW, responses
+}
+
+// slowAPI answers discovery requests once release is closed, reporting each
+// request on started and each whose client gave up on cancelled
+func slowAPI(t *testing.T, release <-chan struct{}, started, cancelled chan<- struct{}) *httptest.Server {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-release:
+			w.WriteHeader(http.StatusOK)
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		}
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func nextResponse(t *testing.T, responses <-chan JSONRPCResponse) JSONRPCResponse {
+	t.Helper()
+	select {
+	case resp, ok := <-responses:
+		if !ok {
+			t.Fatal("Expected a response, got end of output")
+		}
+		return resp
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a response")
+	}
+	return JSONRPCResponse{}
+}
+
+func TestStdio_ConcurrentRequests(t *testing.T) {
+	release := make(chan struct{})
+	api := slowAPI(t, release, make(chan struct{}, 2), make(chan struct{}, 2))
+	in, responses := stdioPipe(t, NewServer(ServerConfig{}))
+
+	fmt.Fprintf(in, `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"x402_discover","arguments":{"url":%q}}}`+"\n", api.URL)
+	fmt.Fprint(in, `{"jsonrpc":"2.0","method":"notifications/unknown"}`+"\n")
+	fmt.Fprint(in, `{"jsonrpc":"2.0","id":2,"method":"ping"}`+"\n")
+
+	// The ping is answered while the discovery is still waiting
+	if resp := nextResponse(t, responses); resp.ID != float64(2) || resp.Error != nil {
+		t.Errorf("Expected the ping's response first, got %+v", resp)
+	}
+	close(release)
+	if resp := nextResponse(t, responses); resp.ID != float64(1) {
+		t.Errorf("Expected the discovery's response, got %+v", resp)
+	}
+}
+
+func TestStdio_CancelRequest(t *testing.T) {
+	started, cancelled := make(chan struct{}, 2), make(chan struct{}, 2)
+	api := slowAPI(t, make(chan struct{}), started, cancelled)
+	in, responses := stdioPipe(t, NewServer(ServerConfig{}))
+
+	fmt.Fprintf(in, `{"jsonrpc":"2.0","id":"call","method":"tools/call","params":{"name":"x402_discover","arguments":{"url":%q}}}`+"\n", api.URL)
+	<-started
+	fmt.Fprint(in, `{"jsonrpc":"2.0","method":"notifications/cancelled","params":{"requestId":"call"}}`+"\n")
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the API request to be cancelled")
+	}
+
+	// Cancelled requests get no response
+	fmt.Fprint(in, `{"jsonrpc":"2.0","id":3,"method":"ping"}`+"\n")
+	if resp := nextResponse(t, responses); resp.ID != float64(3) {
+		t.Errorf("Expected only the ping's response, got %+v", resp)
+	}
+}
+
+func TestStdio_MaxMessageBytes(t *testing.T) {
+	in, responses := stdioPipe(t, NewServer(ServerConfig{MaxMessageBytes: 1024}))
+
+	fmt.Fprintf(in, `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"x402_call","arguments":{"body":%q}}}`+"\n", strings.Repeat("x", 4096))
+	fmt.Fprint(in, `{"jsonrpc":"2.0","id":2,"method":"ping"}`+"\n")
+
+	if resp := nextResponse(t, responses); resp.Error == nil || resp.Error.Code != InvalidRequest {
+		t.Errorf("Expected an invalid request error for the long message, got %+v", resp)
+	}
+	if resp := nextResponse(t, responses); resp.ID != float64(2) || resp.Error != nil {
+		t.Errorf("Expected the ping to be answered after the long message, got %+v", resp)
+	}
+}
+
+func TestStdio_LargeMessage(t *testing.T) {
+	in, responses := stdioPipe(t, NewServer(ServerConfig{}))
+
+	// Far past bufio.Reader's and Scanner's default buffers
+	fmt.Fprintf(in, `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"x402_budget","arguments":{"action":"status","padding":%q}}}`+"\n", strings.Repeat("x", 256*1024))
+	if resp := nextResponse(t, responses); resp.ID != float64(1) || resp.Error != nil {
+		t.Errorf("Expected the large message to be handled, got %+v", resp)
+	}
+}
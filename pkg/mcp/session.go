@@ -0,0 +1,272 @@
+package mcp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402"
+)
+
+// ============================================================================
+// SESSIONS
+// Budgets are scoped to the MCP session that created them. Stdio has one
+// implicit session per ListenStdio call; the HTTP transport assigns an ID
+// in the initialize response and expects it back in the Mcp-Session-Id header.
+// ============================================================================
+
+// DefaultSessionID is used for tool calls that carry no session
+const DefaultSessionID = "default"
+
+// SessionHeader carries the session ID on the HTTP transport
+const SessionHeader = "Mcp-Session-Id"
+
+// stdioSessionID is the implicit session of the stdio transport
+const stdioSessionID = "stdio"
+
+type sessionContextKey struct{}
+
+// WithSession scopes tool calls made with ctx to sessionID
+func WithSession(ctx context.Context, sessionID string) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, sessionID)
+}
+
+// SessionFromContext returns the session of ctx (DefaultSessionID if none)
+func SessionFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(sessionContextKey{}).(string); ok && id != "" {
+		return id
+	}
+	return DefaultSessionID
+}
+
+// newSession registers an HTTP session and drops idle ones
+func (s *Server) newSession() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	id := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-s.config.SessionIdleTimeout)
+	for sid, lastSeen := range s.sessions {
+		if lastSeen.Before(cutoff) {
+			delete(s.sessions, sid)
+			delete(s.budgets, sid)
+			delete(s.responses, sid)
+		}
+	}
+	s.sessions[id] = time.Now()
+	return id
+}
+
+// touchSession marks an HTTP session active; false if unknown or expired.
+// A session whose budget was saved to Storage is resumed.
+func (s *Server) touchSession(id string) bool {
+	if s.restoreBudget(id) != nil {
+		s.mu.Lock()
+		if _, ok := s.sessions[id]; !ok {
+			s.sessions[id] = time.Now()
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lastSeen, ok := s.sessions[id]
+	if !ok {
+		return false
+	}
+	if time.Since(lastSeen) > s.config.SessionIdleTimeout {
+		delete(s.sessions, id)
+		delete(s.budgets, id)
+		delete(s.responses, id)
+		return false
+	}
+	s.sessions[id] = time.Now()
+	return true
+}
+
+// EndSession discards a session and its in-memory budget. Budgets held in
+// Storage or a shared PreAuthStore are kept there, so the session can be
+// resumed later. Returns false if the session was unknown.
+func (s *Server) EndSession(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, registered := s.sessions[id]
+	_, hasBudget := s.budgets[id]
+	delete(s.sessions, id)
+	delete(s.budgets, id)
+	delete(s.subscriptions, id)
+	delete(s.responses, id)
+	s.closeStreams(id)
+	return registered || hasBudget
+}
+
+// ============================================================================
+// SESSION BUDGETS
+// ============================================================================
+
+// sessionBudget returns the budget of the caller's session (nil if none),
+// refreshed from the PreAuthStore when it is a shared budget
+func (s *Server) sessionBudget(ctx context.Context) *Budget {
+	budget := s.restoreBudget(SessionFromContext(ctx))
+
+	if budget != nil && budget.PreAuthID != "" {
+		_ = s.syncPreAuth(budget)
+	}
+	return budget
+}
+
+// restoreBudget returns the in-memory budget of a session, reloading it
+// from Storage if it was dropped (e.g. by EndSession)
+func (s *Server) restoreBudget(sessionID string) *Budget {
+	s.mu.RLock()
+	budget := s.budgets[sessionID]
+	s.mu.RUnlock()
+	if budget != nil || s.config.Storage == nil {
+		return budget
+	}
+
+	saved, err := s.config.Storage.LoadBudgets()
+	if err != nil {
+		return nil
+	}
+	for _, b := range saved {
+		if b.SessionID != sessionID {
+			continue
+		}
+		if txs, err := s.config.Storage.ListTransactions(TransactionFilter{SessionID: sessionID}); err == nil {
+			b.Transactions = txs
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if existing := s.budgets[sessionID]; existing != nil {
+			return existing
+		}
+		s.budgets[sessionID] = b
+		return b
+	}
+	return nil
+}
+
+// loadBudgets restores all saved budgets and their transactions
+func (s *Server) loadBudgets() error {
+	saved, err := s.config.Storage.LoadBudgets()
+	if err != nil {
+		return err
+	}
+	for _, b := range saved {
+		txs, err := s.config.Storage.ListTransactions(TransactionFilter{SessionID: b.SessionID})
+		if err != nil {
+			return err
+		}
+		b.Transactions = txs
+		s.budgets[b.SessionID] = b
+	}
+	return nil
+}
+
+// persistBudget saves a snapshot of budget. Snapshots are taken and written
+// under persistMu so the last write always reflects the latest state.
+func (s *Server) persistBudget(budget *Budget) error {
+	if s.config.Storage == nil {
+		return nil
+	}
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+
+	s.mu.RLock()
+	snapshot := *budget
+	snapshot.Transactions = nil
+	s.mu.RUnlock()
+
+	return s.config.Storage.SaveBudget(&snapshot)
+}
+
+// syncPreAuth copies balances of a shared budget from the PreAuthStore
+func (s *Server) syncPreAuth(budget *Budget) error {
+	pre, err := s.config.PreAuthStore.Get(budget.PreAuthID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	budget.Total = pre.TotalBudget
+	budget.Remaining = pre.Remaining
+	budget.Spent = pre.TotalSpent
+	return nil
+}
+
+// reserve takes cost out of budget ahead of a paid call
+func (s *Server) reserve(budget *Budget, cost int64) error {
+	if budget.PreAuthID != "" {
+		if err := s.config.PreAuthStore.Deduct(budget.PreAuthID, cost); err != nil {
+			_ = s.syncPreAuth(budget)
+			return err
+		}
+		return s.syncPreAuth(budget)
+	}
+
+	s.mu.Lock()
+	if cost > budget.Remaining {
+		s.mu.Unlock()
+		return x402.ErrInsufficientBudget
+	}
+	budget.Remaining -= cost
+	s.mu.Unlock()
+
+	// Persist the reservation so a crash mid-call cannot overspend
+	return s.persistBudget(budget)
+}
+
+// recordAttempt records a call that failed before anything was reserved
+func (s *Server) recordAttempt(budget *Budget, tx Transaction) {
+	s.mu.Lock()
+	tx.Timestamp = time.Now()
+	budget.LastUsedAt = tx.Timestamp
+	budget.Transactions = append(budget.Transactions, tx)
+	s.mu.Unlock()
+
+	if s.config.Storage != nil {
+		_ = s.config.Storage.AppendTransaction(tx)
+		_ = s.persistBudget(budget)
+	}
+	s.resourcesUpdated(budget.SessionID, TransactionsResourceURI)
+}
+
+// settleCall records a paid call and refunds its reservation if it was not charged
+func (s *Server) settleCall(budget *Budget, tx Transaction, charged bool) {
+	if !charged && budget.PreAuthID != "" {
+		_ = s.config.PreAuthStore.Refund(budget.PreAuthID, tx.Amount)
+	}
+
+	s.mu.Lock()
+	tx.Timestamp = time.Now()
+	tx.Success = charged
+	if budget.PreAuthID == "" {
+		if charged {
+			budget.Spent += tx.Amount
+		} else {
+			budget.Remaining += tx.Amount
+		}
+	}
+	budget.LastUsedAt = tx.Timestamp
+	budget.Transactions = append(budget.Transactions, tx)
+	s.mu.Unlock()
+
+	if budget.PreAuthID != "" {
+		_ = s.syncPreAuth(budget)
+	}
+	if s.config.Storage != nil {
+		_ = s.config.Storage.AppendTransaction(tx)
+		_ = s.persistBudget(budget)
+	}
+	s.settleDaily(tx, charged)
+	s.resourcesUpdated(budget.SessionID, BudgetResourceURI, TransactionsResourceURI)
+}
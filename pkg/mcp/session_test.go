@@ -0,0 +1,210 @@
+package mcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402"
+)
+
+func TestSessionsHaveIndependentBudgets(t *testing.T) {
+	api := newPaidAPI(t, "ok")
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client(), Signer: testSigner("")})
+	alice := WithSession(context.Background(), "alice")
+	bob := WithSession(context.Background(), "bob")
+
+	server.CallTool(alice, "x402_budget", map[string]interface{}{"action": "create", "amount": float64(5000)})
+	server.CallTool(bob, "x402_budget", map[string]interface{}{"action": "create", "amount": float64(3000)})
+
+	result, _ := server.CallTool(alice, "x402_call", map[string]interface{}{"url": api.URL + "/api/data"})
+	if result.IsError {
+		t.Fatalf("Expected paid call to succeed: %s", result.Content[0].Text)
+	}
+
+	if got := server.budgets["alice"].Remaining; got != 4000 {
+		t.Errorf("Expected alice remaining 4000, got %d", got)
+	}
+	if got := server.budgets["bob"].Remaining; got != 3000 {
+		t.Errorf("Expected bob's budget untouched at 3000, got %d", got)
+	}
+	if len(server.budgets["bob"].Transactions) != 0 {
+		t.Error("Expected bob to have no transactions")
+	}
+
+	server.CallTool(bob, "x402_budget", map[string]interface{}{"action": "close"})
+	if server.budgets["alice"] == nil {
+		t.Error("Closing bob's budget should not affect alice")
+	}
+	if server.budgets[DefaultSessionID] != nil {
+		t.Error("Expected no default budget")
+	}
+}
+
+func TestSessionsConcurrentCalls(t *testing.T) {
+	api := newPaidAPI(t, "ok")
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client(), Signer: testSigner("")})
+	sessions := []string{"s1", "s2"}
+	for _, id := range sessions {
+		server.CallTool(WithSession(context.Background(), id), "x402_budget", map[string]interface{}{"action": "create", "amount": float64(3500)})
+	}
+
+	var wg sync.WaitGroup
+	for _, id := range sessions {
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				server.CallTool(WithSession(context.Background(), id), "x402_call", map[string]interface{}{"url": api.URL + "/api/data"})
+			}(id)
+		}
+	}
+	wg.Wait()
+
+	for _, id := range sessions {
+		budget := server.budgets[id]
+		if budget.Spent != 3000 || budget.Remaining != 500 {
+			t.Errorf("Session %s: expected 3 paid calls (spent 3000, remaining 500), got %d/%d", id, budget.Spent, budget.Remaining)
+		}
+	}
+}
+
+func postMCP(t *testing.T, url, sessionID string, req JSONRPCRequest) (*http.Response, JSONRPCResponse) {
+	t.Helper()
+	body, _ := json.Marshal(req)
+	httpReq, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if sessionID != "" {
+		httpReq.Header.Set(SessionHeader, sessionID)
+	}
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var rpcResp JSONRPCResponse
+	json.NewDecoder(resp.Body).Decode(&rpcResp)
+	return resp, rpcResp
+}
+
+func budgetCall(action string, amount int) JSONRPCRequest {
+	params, _ := json.Marshal(map[string]interface{}{
+		"name":      "x402_budget",
+		"arguments": map[string]interface{}{"action": action, "amount": amount},
+	})
+	return JSONRPCRequest{JSONRPC: "2.0", ID: 2, Method: "tools/call", Params: params}
+}
+
+func TestHTTPHandlerSessions(t *testing.T) {
+	server := NewServer(ServerConfig{})
+	ts := httptest.NewServer(server.HTTPHandler())
+	defer ts.Close()
+
+	initialize := JSONRPCRequest{JSONRPC: "2.0", ID: 1, Method: "initialize"}
+	resp1, _ := postMCP(t, ts.URL, "", initialize)
+	resp2, _ := postMCP(t, ts.URL, "", initialize)
+	s1, s2 := resp1.Header.Get(SessionHeader), resp2.Header.Get(SessionHeader)
+	if s1 == "" || s2 == "" || s1 == s2 {
+		t.Fatalf("Expected two distinct session IDs, got %q and %q", s1, s2)
+	}
+
+	postMCP(t, ts.URL, s1, budgetCall("create", 1000))
+	postMCP(t, ts.URL, s2, budgetCall("create", 2000))
+
+	if server.budgets[s1].Total != 1000 || server.budgets[s2].Total != 2000 {
+		t.Errorf("Expected per-session budgets 1000/2000, got %d/%d", server.budgets[s1].Total, server.budgets[s2].Total)
+	}
+
+	// Missing and unknown session IDs are rejected
+	if resp, _ := postMCP(t, ts.URL, "", budgetCall("status", 0)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 without session header, got %d", resp.StatusCode)
+	}
+	if resp, _ := postMCP(t, ts.URL, "bogus", budgetCall("status", 0)); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown session, got %d", resp.StatusCode)
+	}
+
+	// DELETE ends the session and drops its budget
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL, nil)
+	req.Header.Set(SessionHeader, s1)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", resp.StatusCode)
+	}
+	if server.budgets[s1] != nil {
+		t.Error("Expected session budget to be dropped")
+	}
+	if resp, _ := postMCP(t, ts.URL, s1, budgetCall("status", 0)); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 after session end, got %d", resp.StatusCode)
+	}
+}
+
+func TestPreAuthStoreBridge(t *testing.T) {
+	store := x402.NewInMemoryPreAuthStore()
+
+	// Budget created through the seller's /ai/budget endpoint
+	budgetAPI := httptest.NewServer(x402.AIBudgetHandler(store, x402.AIFirstConfig{}))
+	defer budgetAPI.Close()
+	resp, err := http.Post(budgetAPI.URL, "application/json", strings.NewReader(`{"agentId":"agent-1","budget":5000}`))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	var created x402.PreAuthBudget
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+
+	api := newPaidAPI(t, "ok")
+	defer api.Close()
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client(), Signer: testSigner(""), PreAuthStore: store})
+	ctx := WithSession(context.Background(), "s1")
+
+	result, _ := server.CallTool(ctx, "x402_budget", map[string]interface{}{"action": "attach", "budget_id": created.ID})
+	if result.IsError {
+		t.Fatalf("Expected attach to succeed: %s", result.Content[0].Text)
+	}
+
+	result, _ = server.CallTool(ctx, "x402_call", map[string]interface{}{"url": api.URL + "/api/data"})
+	if result.IsError {
+		t.Fatalf("Expected paid call to succeed: %s", result.Content[0].Text)
+	}
+
+	stored, _ := store.Get(created.ID)
+	if stored.Remaining != 4000 || stored.TotalSpent != 1000 {
+		t.Errorf("Expected store to reflect the paid call (4000/1000), got %d/%d", stored.Remaining, stored.TotalSpent)
+	}
+
+	// Spending through the seller is visible to the MCP session
+	store.Deduct(created.ID, 500)
+	result, _ = server.CallTool(ctx, "x402_budget", map[string]interface{}{"action": "status"})
+	var status budgetResource
+	decodeStructured(t, result, &status)
+	if status.Remaining != 3500 {
+		t.Errorf("Expected status to show 3500 remaining, got %d", status.Remaining)
+	}
+
+	// Budgets created by a session are written to the store
+	other := WithSession(context.Background(), "s2")
+	server.CallTool(other, "x402_budget", map[string]interface{}{"action": "create", "amount": float64(2000)})
+	if b, err := store.GetByAgentID("s2"); err != nil || b.TotalBudget != 2000 {
+		t.Errorf("Expected session budget in the store, got %+v (%v)", b, err)
+	}
+
+	// Ending a session leaves attached budgets in the store
+	server.EndSession("s1")
+	if _, err := store.Get(created.ID); err != nil {
+		t.Error("Expected shared budget to survive session end")
+	}
+}
@@ -0,0 +1,321 @@
+package mcp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// EIP-3009 SIGNING
+// Builds "exact" scheme payloads: an EIP-712 signed transferWithAuthorization
+// that the facilitator submits on-chain.
+// ============================================================================
+
+// TransferAuthorization is the EIP-3009 transferWithAuthorization message.
+// Numeric fields are decimal strings, nonce is 0x-prefixed 32-byte hex.
+type TransferAuthorization struct {
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Value       string `json:"value"`
+	ValidAfter  string `json:"validAfter"`
+	ValidBefore string `json:"validBefore"`
+	Nonce       string `json:"nonce"`
+}
+
+// EIP3009Params is everything needed to sign a transferWithAuthorization
+type EIP3009Params struct {
+	Authorization TransferAuthorization
+
+	// EIP-712 domain of the token contract
+	TokenName         string // e.g. "USD Coin"
+	TokenVersion      string // e.g. "2"
+	ChainID           int64
+	VerifyingContract string // Token contract address
+}
+
+// ExactEVMPayload is the "payload" object of an exact-scheme EVM payment
+type ExactEVMPayload struct {
+	Signature     string                `json:"signature"`
+	Authorization TransferAuthorization `json:"authorization"`
+}
+
+// Signer signs EIP-3009 authorizations. LocalSigner holds the key in
+// process; implementations backed by a KMS or HSM can satisfy the same
+// interface without exposing the key.
+type Signer interface {
+	// Address is the 0x-prefixed payer address
+	Address() string
+
+	// Sign3009 signs params and returns the 0x-prefixed 65-byte signature
+	// together with the payload to send
+	Sign3009(ctx context.Context, params EIP3009Params) (string, *ExactEVMPayload, error)
+}
+
+// LocalSigner signs with an in-memory secp256k1 private key
+type LocalSigner struct {
+	key     *big.Int
+	address string
+}
+
+// NewLocalSigner creates a signer from a hex private key (with or without 0x)
+func NewLocalSigner(privateKeyHex string) (*LocalSigner, error) {
+	raw, err := hex.DecodeString(strings.TrimPrefix(privateKeyHex, "0x"))
+	if err != nil || len(raw) != 32 {
+		return nil, errors.New("private key must be 32 bytes of hex")
+	}
+	key := new(big.Int).SetBytes(raw)
+	if key.Sign() == 0 || key.Cmp(secpN) >= 0 {
+		return nil, errors.New("private key out of range")
+	}
+
+	return &LocalSigner{
+		key:     key,
+		address: checksumAddress(keyAddress(key)),
+	}, nil
+}
+
+// Address returns the EIP-55 checksummed address of the key
+func (s *LocalSigner) Address() string {
+	return s.address
+}
+
+// Sign3009 signs the EIP-712 typed data for transferWithAuthorization
+func (s *LocalSigner) Sign3009(ctx context.Context, params EIP3009Params) (string, *ExactEVMPayload, error) {
+	digest, err := TransferWithAuthorizationDigest(params)
+	if err != nil {
+		return "", nil, err
+	}
+	sig, err := signSecp256k1(digest, s.key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	signature := "0x" + hex.EncodeToString(sig)
+	return signature, &ExactEVMPayload{
+		Signature:     signature,
+		Authorization: params.Authorization,
+	}, nil
+}
+
+// ============================================================================
+// EIP-712 HASHING
+// ============================================================================
+
+var (
+	eip712DomainTypeHash = keccak256([]byte("EIP712Domain(string name,string version,uint256 chainId,address verifyingContract)"))
+
+	transferWithAuthorizationTypeHash = keccak256([]byte(
+		"TransferWithAuthorization(address from,address to,uint256 value,uint256 validAfter,uint256 validBefore,bytes32 nonce)",
+	))
+)
+
+// TransferWithAuthorizationDigest returns the EIP-712 hash that is signed
+// for params
+func TransferWithAuthorizationDigest(params EIP3009Params) ([]byte, error) {
+	contract, err := encodeAddress(params.VerifyingContract)
+	if err != nil {
+		return nil, fmt.Errorf("verifying contract: %w", err)
+	}
+	domainSeparator := keccak256(
+		eip712DomainTypeHash,
+		keccak256([]byte(params.TokenName)),
+		keccak256([]byte(params.TokenVersion)),
+		encodeUint(big.NewInt(params.ChainID)),
+		contract,
+	)
+
+	auth := params.Authorization
+	fields := make([][]byte, 0, 7)
+	fields = append(fields, transferWithAuthorizationTypeHash)
+	for _, addr := range []string{auth.From, auth.To} {
+		encoded, err := encodeAddress(addr)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, encoded)
+	}
+	for _, num := range []string{auth.Value, auth.ValidAfter, auth.ValidBefore} {
+		n, ok := new(big.Int).SetString(num, 10)
+		if !ok || n.Sign() < 0 {
+			return nil, fmt.Errorf("invalid uint256 %q", num)
+		}
+		fields = append(fields, encodeUint(n))
+	}
+	nonce, err := hex.DecodeString(strings.TrimPrefix(auth.Nonce, "0x"))
+	if err != nil || len(nonce) != 32 {
+		return nil, errors.New("nonce must be 32 bytes of hex")
+	}
+	fields = append(fields, nonce)
+
+	return keccak256([]byte{0x19, 0x01}, domainSeparator, keccak256(fields...)), nil
+}
+
+// encodeAddress left-pads a hex address to a 32-byte ABI word
+func encodeAddress(addr string) ([]byte, error) {
+	raw, err := hex.DecodeString(strings.TrimPrefix(addr, "0x"))
+	if err != nil || len(raw) != 20 {
+		return nil, fmt.Errorf("invalid address %q", addr)
+	}
+	word := make([]byte, 32)
+	copy(word[12:], raw)
+	return word, nil
+}
+
+func encodeUint(n *big.Int) []byte {
+	word := make([]byte, 32)
+	n.FillBytes(word)
+	return word
+}
+
+// checksumAddress formats a 20-byte address per EIP-55
+func checksumAddress(addr []byte) string {
+	lower := hex.EncodeToString(addr)
+	hash := hex.EncodeToString(keccak256([]byte(lower)))
+
+	out := []byte(lower)
+	for i, c := range out {
+		if c >= 'a' && hash[i] >= '8' {
+			out[i] = c - 32
+		}
+	}
+	return "0x" + string(out)
+}
+
+// ============================================================================
+// EXACT SCHEME PAYMENT SIGNER
+// ============================================================================
+
+// ExactPaymentSigner implements PaymentSigner for the "exact" EVM scheme
+// by signing an EIP-3009 authorization with Signer
+type ExactPaymentSigner struct {
+	Signer Signer
+
+	// Now is the clock used for validAfter/validBefore (default time.Now)
+	Now func() time.Time
+}
+
+// NewExactPaymentSigner wraps a Signer as a PaymentSigner
+func NewExactPaymentSigner(signer Signer) *ExactPaymentSigner {
+	return &ExactPaymentSigner{Signer: signer, Now: time.Now}
+}
+
+// SignPayment builds the base64 X-PAYMENT value for requirement
+func (e *ExactPaymentSigner) SignPayment(ctx context.Context, requirement PaymentRequirement) (string, error) {
+	if requirement.Scheme != "" && requirement.Scheme != "exact" {
+		return "", fmt.Errorf("unsupported payment scheme %q", requirement.Scheme)
+	}
+
+	chainID, ok := chainIDForNetwork(requirement.Network)
+	if !ok {
+		return "", fmt.Errorf("unsupported network %q", requirement.Network)
+	}
+	asset := requirement.Asset
+	if asset == "" {
+		asset = defaultUSDCAddresses[requirement.Network]
+	}
+	if asset == "" {
+		return "", fmt.Errorf("no asset address for network %q", requirement.Network)
+	}
+
+	name, version := tokenDomain(requirement)
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	now := time.Now
+	if e.Now != nil {
+		now = e.Now
+	}
+	timeout := requirement.MaxTimeoutSeconds
+	if timeout <= 0 {
+		timeout = 60
+	}
+	issued := now().Unix()
+
+	params := EIP3009Params{
+		Authorization: TransferAuthorization{
+			From:        e.Signer.Address(),
+			To:          requirement.PayTo,
+			Value:       requirement.MaxAmountRequired,
+			ValidAfter:  strconv.FormatInt(issued-600, 10), // tolerate chain clock drift
+			ValidBefore: strconv.FormatInt(issued+int64(timeout), 10),
+			Nonce:       "0x" + hex.EncodeToString(nonce),
+		},
+		TokenName:         name,
+		TokenVersion:      version,
+		ChainID:           chainID,
+		VerifyingContract: asset,
+	}
+
+	_, payload, err := e.Signer.Sign3009(ctx, params)
+	if err != nil {
+		return "", err
+	}
+
+	encoded, err := json.Marshal(map[string]interface{}{
+		"x402Version": 1,
+		"scheme":      "exact",
+		"network":     requirement.Network,
+		"payload":     payload,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(encoded), nil
+}
+
+// tokenDomain returns the EIP-712 name/version, preferring the values the
+// seller advertises in requirement.Extra
+func tokenDomain(requirement PaymentRequirement) (string, string) {
+	name, version := "USD Coin", "2"
+	if requirement.Network == "base-sepolia" || requirement.Network == "eip155:84532" {
+		name = "USDC"
+	}
+	if n, ok := requirement.Extra["name"].(string); ok && n != "" {
+		name = n
+	}
+	if v, ok := requirement.Extra["version"].(string); ok && v != "" {
+		version = v
+	}
+	return name, version
+}
+
+// chainIDs maps x402 network names to EVM chain IDs
+var chainIDs = map[string]int64{
+	"ethereum":     1,
+	"base":         8453,
+	"base-sepolia": 84532,
+	"optimism":     10,
+	"arbitrum":     42161,
+	"polygon":      137,
+}
+
+// defaultUSDCAddresses is used when a requirement omits the asset
+var defaultUSDCAddresses = map[string]string{
+	"ethereum":     "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48",
+	"base":         "0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913",
+	"base-sepolia": "0x036CbD53842c5426634e7929541eC2318f3dCF7e",
+}
+
+// chainIDForNetwork accepts both names ("base") and CAIP-2 ("eip155:8453")
+func chainIDForNetwork(network string) (int64, bool) {
+	if id, ok := chainIDs[network]; ok {
+		return id, true
+	}
+	if rest, ok := strings.CutPrefix(network, "eip155:"); ok {
+		id, err := strconv.ParseInt(rest, 10, 64)
+		return id, err == nil
+	}
+	return 0, false
+}
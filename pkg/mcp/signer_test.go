@@ -0,0 +1,184 @@
+package mcp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Well-known test key (web3.js documentation); never fund it
+const testPrivateKey = "0x4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318"
+
+func TestKeccak256Vectors(t *testing.T) {
+	if got := hex.EncodeToString(keccak256(nil)); got != "c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470" {
+		t.Errorf("Unexpected keccak256(\"\"): %s", got)
+	}
+	// TRANSFER_WITH_AUTHORIZATION_TYPEHASH from the USDC FiatTokenV2 contract
+	if got := hex.EncodeToString(transferWithAuthorizationTypeHash); got != "7c7c6cdb67a18743f49ec6fa9b35f50d52ed05cbed4cc592e13b44501c1a2267" {
+		t.Errorf("Unexpected transferWithAuthorization typehash: %s", got)
+	}
+}
+
+func TestLocalSignerAddress(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{testPrivateKey, "0x2c7536E3605D9C16a7a3D7b1898e529396a65c23"},
+		{"0000000000000000000000000000000000000000000000000000000000000001", "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf"},
+	}
+
+	for _, tt := range tests {
+		signer, err := NewLocalSigner(tt.key)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if signer.Address() != tt.want {
+			t.Errorf("Expected %s, got %s", tt.want, signer.Address())
+		}
+	}
+
+	for _, bad := range []string{"", "0x1234", strings.Repeat("0", 64), strings.Repeat("f", 64)} {
+		if _, err := NewLocalSigner(bad); err == nil {
+			t.Errorf("Expected error for key %q", bad)
+		}
+	}
+}
+
+func testParams(from string) EIP3009Params {
+	return EIP3009Params{
+		Authorization: TransferAuthorization{
+			From:        from,
+			To:          "0x1234567890123456789012345678901234567890",
+			Value:       "1000",
+			ValidAfter:  "1700000000",
+			ValidBefore: "1700000060",
+			Nonce:       "0x" + strings.Repeat("ab", 32),
+		},
+		TokenName:         "USDC",
+		TokenVersion:      "2",
+		ChainID:           84532,
+		VerifyingContract: "0x036CbD53842c5426634e7929541eC2318f3dCF7e",
+	}
+}
+
+func TestSign3009RecoversSigner(t *testing.T) {
+	signer, _ := NewLocalSigner(testPrivateKey)
+	params := testParams(signer.Address())
+
+	signature, payload, err := signer.Sign3009(context.Background(), params)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if payload.Signature != signature || payload.Authorization != params.Authorization {
+		t.Error("Expected payload to carry the signature and authorization")
+	}
+
+	sig, _ := hex.DecodeString(strings.TrimPrefix(signature, "0x"))
+	if len(sig) != 65 || (sig[64] != 27 && sig[64] != 28) {
+		t.Fatalf("Expected 65-byte signature with v in {27,28}, got %x", sig)
+	}
+	if s := new(big.Int).SetBytes(sig[32:64]); s.Cmp(secpHalfN) > 0 {
+		t.Error("Expected low-s signature")
+	}
+
+	digest, _ := TransferWithAuthorizationDigest(params)
+	addr, err := recoverAddress(digest, sig)
+	if err != nil {
+		t.Fatalf("Unexpected recovery error: %v", err)
+	}
+	if checksumAddress(addr) != signer.Address() {
+		t.Errorf("Expected signature to recover to %s, got %s", signer.Address(), checksumAddress(addr))
+	}
+
+	// Deterministic (RFC 6979)
+	again, _, _ := signer.Sign3009(context.Background(), params)
+	if again != signature {
+		t.Error("Expected deterministic signatures for identical input")
+	}
+
+	// A different message must not recover to the signer
+	params.Authorization.Value = "1001"
+	other, _ := TransferWithAuthorizationDigest(params)
+	if addr, _ := recoverAddress(other, sig); addr != nil && checksumAddress(addr) == signer.Address() {
+		t.Error("Signature should not verify for a modified authorization")
+	}
+}
+
+func TestExactPaymentSigner(t *testing.T) {
+	signer, _ := NewLocalSigner(testPrivateKey)
+	paymentSigner := NewExactPaymentSigner(signer)
+	paymentSigner.Now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	header, err := paymentSigner.SignPayment(context.Background(), PaymentRequirement{
+		Scheme:            "exact",
+		Network:           "base-sepolia",
+		MaxAmountRequired: "2500",
+		PayTo:             "0x1234567890123456789012345678901234567890",
+		MaxTimeoutSeconds: 120,
+		Asset:             "0x036CbD53842c5426634e7929541eC2318f3dCF7e",
+		Extra:             map[string]interface{}{"name": "USDC", "version": "2"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		t.Fatalf("Expected base64 payload: %v", err)
+	}
+	var decoded struct {
+		X402Version int             `json:"x402Version"`
+		Scheme      string          `json:"scheme"`
+		Network     string          `json:"network"`
+		Payload     ExactEVMPayload `json:"payload"`
+	}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatalf("Invalid payload JSON: %v", err)
+	}
+
+	auth := decoded.Payload.Authorization
+	if decoded.X402Version != 1 || decoded.Scheme != "exact" || decoded.Network != "base-sepolia" {
+		t.Errorf("Unexpected envelope: %+v", decoded)
+	}
+	if auth.From != signer.Address() || auth.Value != "2500" || auth.ValidBefore != "1700000120" || auth.ValidAfter != "1699999400" {
+		t.Errorf("Unexpected authorization: %+v", auth)
+	}
+	if len(auth.Nonce) != 66 {
+		t.Errorf("Expected 32-byte nonce, got %s", auth.Nonce)
+	}
+
+	params := EIP3009Params{
+		Authorization:     auth,
+		TokenName:         "USDC",
+		TokenVersion:      "2",
+		ChainID:           84532,
+		VerifyingContract: "0x036CbD53842c5426634e7929541eC2318f3dCF7e",
+	}
+	digest, _ := TransferWithAuthorizationDigest(params)
+	sig, _ := hex.DecodeString(strings.TrimPrefix(decoded.Payload.Signature, "0x"))
+	if addr, err := recoverAddress(digest, sig); err != nil || checksumAddress(addr) != signer.Address() {
+		t.Errorf("Expected payload signature to recover to signer, got %x (%v)", addr, err)
+	}
+
+	if _, err := paymentSigner.SignPayment(context.Background(), PaymentRequirement{Network: "solana", MaxAmountRequired: "1"}); err == nil {
+		t.Error("Expected error for non-EVM network")
+	}
+}
+
+func TestNewServerWithPrivateKey(t *testing.T) {
+	server := NewServer(ServerConfig{PrivateKey: testPrivateKey})
+	if server.config.Signer == nil || server.config.WalletAddress != "0x2c7536E3605D9C16a7a3D7b1898e529396a65c23" {
+		t.Errorf("Expected signer from PrivateKey, got wallet %q", server.config.WalletAddress)
+	}
+
+	mismatched := NewServer(ServerConfig{PrivateKey: testPrivateKey, WalletAddress: "0x1234567890123456789012345678901234567890"})
+	if mismatched.config.Signer != nil || mismatched.signerErr == nil {
+		t.Error("Expected mismatched WalletAddress to disable signing")
+	}
+}
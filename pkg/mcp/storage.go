@@ -0,0 +1,360 @@
+package mcp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// STORAGE
+// Budgets and transactions are flushed on every mutation so a restart does
+// not lose an agent's remaining funds or spending history.
+// ============================================================================
+
+// Storage persists session budgets and the transaction log
+type Storage interface {
+	SaveBudget(budget *Budget) error
+	DeleteBudget(sessionID string) error
+	LoadBudgets() ([]*Budget, error)
+	AppendTransaction(tx Transaction) error
+	ListTransactions(filter TransactionFilter) ([]Transaction, error)
+}
+
+// TransactionFilter selects transactions; zero fields match everything
+type TransactionFilter struct {
+	SessionID string
+	API       string // Substring of the called URL
+	Since     time.Time
+	Until     time.Time
+	Limit     int // Most recent N (0 = all)
+}
+
+// Matches reports whether tx passes the filter (ignoring Limit)
+func (f TransactionFilter) Matches(tx Transaction) bool {
+	if f.SessionID != "" && tx.SessionID != f.SessionID {
+		return false
+	}
+	if f.API != "" && !strings.Contains(tx.API, f.API) {
+		return false
+	}
+	if !f.Since.IsZero() && tx.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && tx.Timestamp.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// filterTransactions applies f to txs (oldest first) and keeps the last Limit
+func filterTransactions(txs []Transaction, f TransactionFilter) []Transaction {
+	out := make([]Transaction, 0, len(txs))
+	for _, tx := range txs {
+		if f.Matches(tx) {
+			out = append(out, tx)
+		}
+	}
+	if f.Limit > 0 && len(out) > f.Limit {
+		out = out[len(out)-f.Limit:]
+	}
+	return out
+}
+
+// ============================================================================
+// JSON FILE STORAGE
+// ============================================================================
+
+// FileStorage keeps state in a single JSON file. Writes go to a temp file
+// that is renamed into place, and a lock file serializes writers across
+// processes sharing the path.
+type FileStorage struct {
+	path string
+	mu   sync.Mutex
+}
+
+// fileState is the on-disk layout of FileStorage
+type fileState struct {
+	Budgets      map[string]*Budget `json:"budgets"`
+	Transactions []Transaction      `json:"transactions"`
+}
+
+// NewFileStorage creates storage at path, creating parent directories
+func NewFileStorage(path string) (*FileStorage, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStorage{path: path}, nil
+}
+
+// SaveBudget writes budget (without its transactions, which are logged separately)
+func (f *FileStorage) SaveBudget(budget *Budget) error {
+	cp := *budget
+	cp.Transactions = nil
+	return f.update(func(state *fileState) {
+		state.Budgets[cp.SessionID] = &cp
+	})
+}
+
+// DeleteBudget removes a session's budget; its transactions are kept
+func (f *FileStorage) DeleteBudget(sessionID string) error {
+	return f.update(func(state *fileState) {
+		delete(state.Budgets, sessionID)
+	})
+}
+
+// LoadBudgets returns all saved budgets sorted by session ID
+func (f *FileStorage) LoadBudgets() ([]*Budget, error) {
+	state, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	budgets := make([]*Budget, 0, len(state.Budgets))
+	for _, b := range state.Budgets {
+		budgets = append(budgets, b)
+	}
+	sort.Slice(budgets, func(i, j int) bool { return budgets[i].SessionID < budgets[j].SessionID })
+	return budgets, nil
+}
+
+// AppendTransaction adds tx to the log
+func (f *FileStorage) AppendTransaction(tx Transaction) error {
+	return f.update(func(state *fileState) {
+		state.Transactions = append(state.Transactions, tx)
+	})
+}
+
+// ListTransactions returns matching transactions, oldest first
+func (f *FileStorage) ListTransactions(filter TransactionFilter) ([]Transaction, error) {
+	state, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	return filterTransactions(state.Transactions, filter), nil
+}
+
+// read loads the file under the process lock
+func (f *FileStorage) read() (*fileState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	unlock, err := lockFile(f.path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return f.load()
+}
+
+// update applies fn to the current state and writes it back atomically
+func (f *FileStorage) update(fn func(state *fileState)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	unlock, err := lockFile(f.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := f.load()
+	if err != nil {
+		return err
+	}
+	fn(state)
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+func (f *FileStorage) load() (*fileState, error) {
+	state := &fileState{Budgets: make(map[string]*Budget)}
+
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Budgets == nil {
+		state.Budgets = make(map[string]*Budget)
+	}
+	return state, nil
+}
+
+// ============================================================================
+// SQL STORAGE
+// ============================================================================
+
+// SQLStorage persists to a database/sql handle. The schema and queries
+// target SQLite; register a driver (e.g. modernc.org/sqlite or
+// github.com/mattn/go-sqlite3) and pass the opened *sql.DB.
+type SQLStorage struct {
+	db *sql.DB
+}
+
+// NewSQLStorage creates the tables if needed
+func NewSQLStorage(db *sql.DB) (*SQLStorage, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS mcp_budgets (
+			session_id TEXT PRIMARY KEY,
+			data       TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS mcp_transactions (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			session_id TEXT NOT NULL,
+			api        TEXT NOT NULL,
+			timestamp  INTEGER NOT NULL,
+			data       TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS mcp_transactions_session ON mcp_transactions (session_id, timestamp);
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLStorage{db: db}, nil
+}
+
+// SaveBudget upserts budget (without its transactions)
+func (s *SQLStorage) SaveBudget(budget *Budget) error {
+	cp := *budget
+	cp.Transactions = nil
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO mcp_budgets (session_id, data) VALUES (?, ?)
+		 ON CONFLICT (session_id) DO UPDATE SET data = excluded.data`,
+		cp.SessionID, string(data),
+	)
+	return err
+}
+
+// DeleteBudget removes a session's budget; its transactions are kept
+func (s *SQLStorage) DeleteBudget(sessionID string) error {
+	_, err := s.db.Exec(`DELETE FROM mcp_budgets WHERE session_id = ?`, sessionID)
+	return err
+}
+
+// LoadBudgets returns all saved budgets sorted by session ID
+func (s *SQLStorage) LoadBudgets() ([]*Budget, error) {
+	rows, err := s.db.Query(`SELECT data FROM mcp_budgets ORDER BY session_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var budgets []*Budget
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var b Budget
+		if err := json.Unmarshal([]byte(data), &b); err != nil {
+			return nil, err
+		}
+		budgets = append(budgets, &b)
+	}
+	return budgets, rows.Err()
+}
+
+// AppendTransaction adds tx to the log
+func (s *SQLStorage) AppendTransaction(tx Transaction) error {
+	data, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO mcp_transactions (session_id, api, timestamp, data) VALUES (?, ?, ?, ?)`,
+		tx.SessionID, tx.API, tx.Timestamp.UnixNano(), string(data),
+	)
+	return err
+}
+
+// ListTransactions returns matching transactions, oldest first
+func (s *SQLStorage) ListTransactions(filter TransactionFilter) ([]Transaction, error) {
+	query := `SELECT data FROM mcp_transactions WHERE 1 = 1`
+	var args []interface{}
+	if filter.SessionID != "" {
+		query += ` AND session_id = ?`
+		args = append(args, filter.SessionID)
+	}
+	if filter.API != "" {
+		query += ` AND instr(api, ?) > 0`
+		args = append(args, filter.API)
+	}
+	if !filter.Since.IsZero() {
+		query += ` AND timestamp >= ?`
+		args = append(args, filter.Since.UnixNano())
+	}
+	if !filter.Until.IsZero() {
+		query += ` AND timestamp <= ?`
+		args = append(args, filter.Until.UnixNano())
+	}
+	query += ` ORDER BY id DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var txs []Transaction
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var tx Transaction
+		if err := json.Unmarshal([]byte(data), &tx); err != nil {
+			return nil, err
+		}
+		txs = append(txs, tx)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Query is newest first so LIMIT keeps the most recent; return oldest first
+	for i, j := 0, len(txs)-1; i < j; i, j = i+1, j-1 {
+		txs[i], txs[j] = txs[j], txs[i]
+	}
+	return txs, nil
+}
@@ -0,0 +1,156 @@
+package mcp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStorageRestoresStateAfterRestart(t *testing.T) {
+	api := newPaidAPI(t, "ok")
+	defer api.Close()
+
+	path := filepath.Join(t.TempDir(), "mcp", "state.json")
+	storage, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	server := NewServer(ServerConfig{HTTPClient: api.Client(), Signer: testSigner(""), Storage: storage})
+	ctx := WithSession(context.Background(), "agent-1")
+	server.CallTool(ctx, "x402_budget", map[string]interface{}{"action": "create", "amount": float64(5000)})
+	for i := 0; i < 2; i++ {
+		if result, _ := server.CallTool(ctx, "x402_call", map[string]interface{}{"url": api.URL + "/api/data"}); result.IsError {
+			t.Fatalf("Expected paid call to succeed: %s", result.Content[0].Text)
+		}
+	}
+
+	// Restart on the same file
+	storage2, _ := NewFileStorage(path)
+	restarted := NewServer(ServerConfig{HTTPClient: api.Client(), Signer: testSigner(""), Storage: storage2})
+
+	budget := restarted.budgets["agent-1"]
+	if budget == nil {
+		t.Fatal("Expected budget to be restored")
+	}
+	if budget.Total != 5000 || budget.Spent != 2000 || budget.Remaining != 3000 {
+		t.Errorf("Expected 5000/2000/3000, got %d/%d/%d", budget.Total, budget.Spent, budget.Remaining)
+	}
+	if len(budget.Transactions) != 2 || budget.Transactions[0].RequestID == "" {
+		t.Errorf("Expected 2 restored transactions, got %+v", budget.Transactions)
+	}
+
+	result, _ := restarted.CallTool(ctx, "x402_history", map[string]interface{}{"output": "markdown"})
+	if strings.Count(result.Content[0].Text, "✅") != 2 {
+		t.Errorf("Expected history to list 2 calls, got %s", result.Content[0].Text)
+	}
+
+	// No temp files left behind by atomic writes
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".tmp") {
+			t.Errorf("Unexpected leftover temp file %s", e.Name())
+		}
+	}
+}
+
+func TestStorageCloseAndResume(t *testing.T) {
+	storage, _ := NewFileStorage(filepath.Join(t.TempDir(), "state.json"))
+	server := NewServer(ServerConfig{Storage: storage})
+	ctx := WithSession(context.Background(), "s1")
+
+	server.CallTool(ctx, "x402_budget", map[string]interface{}{"action": "create", "amount": float64(1000)})
+
+	// Ending the session drops it from memory but the saved budget resumes
+	server.EndSession("s1")
+	if server.budgets["s1"] != nil {
+		t.Fatal("Expected budget to be dropped from memory")
+	}
+	if !server.touchSession("s1") || server.budgets["s1"] == nil {
+		t.Error("Expected saved session to resume")
+	}
+
+	// Closing deletes the saved budget
+	server.CallTool(ctx, "x402_budget", map[string]interface{}{"action": "close"})
+	if budgets, _ := storage.LoadBudgets(); len(budgets) != 0 {
+		t.Errorf("Expected no saved budgets after close, got %d", len(budgets))
+	}
+}
+
+func TestHistoryFilters(t *testing.T) {
+	storage, _ := NewFileStorage(filepath.Join(t.TempDir(), "state.json"))
+	now := time.Now()
+	txs := []Transaction{
+		{SessionID: "s1", API: "https://weather.example.com/today", Timestamp: now.Add(-2 * time.Hour), Amount: 10, Success: true},
+		{SessionID: "s1", API: "https://news.example.com/latest", Timestamp: now.Add(-time.Hour), Amount: 20, Success: true},
+		{SessionID: "s1", API: "https://weather.example.com/week", Timestamp: now, Amount: 30, Success: true},
+		{SessionID: "s2", API: "https://weather.example.com/today", Timestamp: now, Amount: 40, Success: true},
+	}
+	for _, tx := range txs {
+		storage.AppendTransaction(tx)
+	}
+
+	tests := []struct {
+		name   string
+		filter TransactionFilter
+		want   []int64
+	}{
+		{"session", TransactionFilter{SessionID: "s1"}, []int64{10, 20, 30}},
+		{"api", TransactionFilter{SessionID: "s1", API: "weather"}, []int64{10, 30}},
+		{"since", TransactionFilter{SessionID: "s1", Since: now.Add(-90 * time.Minute)}, []int64{20, 30}},
+		{"until", TransactionFilter{SessionID: "s1", Until: now.Add(-90 * time.Minute)}, []int64{10}},
+		{"limit keeps most recent", TransactionFilter{SessionID: "s1", Limit: 2}, []int64{20, 30}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := storage.ListTransactions(tt.filter)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Expected %d transactions, got %d", len(tt.want), len(got))
+			}
+			for i, tx := range got {
+				if tx.Amount != tt.want[i] {
+					t.Errorf("Expected amount %d at %d, got %d", tt.want[i], i, tx.Amount)
+				}
+			}
+		})
+	}
+
+	server := NewServer(ServerConfig{Storage: storage})
+	result, _ := server.CallTool(WithSession(context.Background(), "s1"), "x402_history", map[string]interface{}{
+		"api": "news",
+	})
+	var history historyData
+	decodeStructured(t, result, &history)
+	if len(history.Transactions) == 0 {
+		t.Error("Expected news calls in history")
+	}
+	for _, tx := range history.Transactions {
+		if !strings.Contains(tx.API, "news.example.com") {
+			t.Errorf("Expected only news calls, got %s", tx.API)
+		}
+	}
+
+	result, _ = server.CallTool(context.Background(), "x402_history", map[string]interface{}{"since": "yesterday"})
+	if !result.IsError {
+		t.Error("Expected error for invalid since")
+	}
+}
+
+func TestCorruptStorageBlocksBudgetTools(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	os.WriteFile(path, []byte("{not json"), 0o600)
+	storage, _ := NewFileStorage(path)
+
+	server := NewServer(ServerConfig{Storage: storage})
+	result, _ := server.CallTool(context.Background(), "x402_budget", map[string]interface{}{"action": "create"})
+	if !result.IsError {
+		t.Error("Expected budget tools to refuse to run on unreadable storage")
+	}
+}
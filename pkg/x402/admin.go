@@ -0,0 +1,713 @@
+// Package x402 - Admin Endpoints
+// Operational visibility for sellers: request stats, the payment ledger and
+// its reconciliation, pre-authorized budgets, a sanitized config dump, temporary path
+// exemptions for incident response, coupon codes, and payer allow/deny
+// lists. Mount on a separate, private listener:
+//
+//	admin := x402.AdminHandler(x402.AdminDeps{APIKey: key, Metering: store, Ledger: ledger})
+//	go http.ListenAndServe("127.0.0.1:9402", admin)
+package x402
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Temporary Exemptions
+// ============================================================================
+
+// ExemptionList holds path exemptions added at runtime. Set it on
+// Config.DynamicExemptions so the middleware honors it.
+type ExemptionList struct {
+	mu    sync.RWMutex
+	paths map[string]time.Time // path prefix -> expiry (zero = no expiry)
+	exact map[string]bool      // paths exempt only when matched exactly
+}
+
+// TemporaryExemption describes an active runtime exemption
+type TemporaryExemption struct {
+	Path      string     `json:"path"`
+	Exact     bool       `json:"exact,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// NewExemptionList creates an empty exemption list
+func NewExemptionList() *ExemptionList {
+	return &ExemptionList{
+		paths: make(map[string]time.Time),
+		exact: make(map[string]bool),
+	}
+}
+
+// AddExact exempts path itself, not the paths below it, until removed
+func (e *ExemptionList) AddExact(path string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.exact[path] = true
+}
+
+// Add exempts a path prefix for ttl (0 = until removed)
+func (e *ExemptionList) Add(path string, ttl time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var expiry time.Time
+	if ttl > 0 {
+		expiry = time.Now().Add(ttl)
+	}
+	e.paths[path] = expiry
+}
+
+// Remove drops an exemption
+func (e *ExemptionList) Remove(path string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.paths, path)
+	delete(e.exact, path)
+}
+
+// IsExempt reports whether path matches an active exemption (prefix match,
+// like Config.ExemptPaths, or an exact path)
+func (e *ExemptionList) IsExempt(path string) bool {
+	if e == nil {
+		return false
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.exact[path] {
+		return true
+	}
+	now := time.Now()
+	for prefix, expiry := range e.paths {
+		if !expiry.IsZero() && now.After(expiry) {
+			continue
+		}
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns active exemptions sorted by path
+func (e *ExemptionList) List() []TemporaryExemption {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	now := time.Now()
+	list := make([]TemporaryExemption, 0, len(e.paths))
+	for path, expiry := range e.paths {
+		if !expiry.IsZero() && now.After(expiry) {
+			continue
+		}
+		ex := TemporaryExemption{Path: path}
+		if !expiry.IsZero() {
+			t := expiry
+			ex.ExpiresAt = &t
+		}
+		list = append(list, ex)
+	}
+	for path := range e.exact {
+		list = append(list, TemporaryExemption{Path: path, Exact: true})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list
+}
+
+// ============================================================================
+// Admin Handler
+// ============================================================================
+
+// AdminDeps wires the stores exposed by AdminHandler. Nil stores are
+// reported as 404 on their endpoint.
+type AdminDeps struct {
+	// APIKey authenticates requests (Authorization: Bearer <key> or X-Admin-Key).
+	// An empty key rejects every request.
+	APIKey string
+
+	Metering   MeteringStore
+	Ledger     PaymentLedger
+	Budgets    PreAuthStore
+	Sessions   SessionStore
+	Prefs      PaymentPrefsStore // Listed at /admin/preferences if it is a PaymentPrefsLister
+	Exemptions *ExemptionList
+	Coupons    CouponStore
+
+	// PayerPolicy is the store behind AccessPolicy.Payers, editable at runtime
+	PayerPolicy PayerPolicyEditor
+
+	// RailMetrics reports each rail's health at /admin/rails
+	RailMetrics *RailMetrics
+
+	// Refunds refunds ledger payments at /admin/refunds
+	Refunds *PaymentRefunds
+
+	// Audit, if set, records budget suspensions and resumptions made here
+	Audit *AuditLog
+
+	// Tenants, if set, serves stats, budgets, sessions and preferences from
+	// the stores of the tenant the admin request is for, in place of
+	// Metering, Budgets, Sessions and Prefs
+	Tenants *TenantStores
+
+	// Config is dumped at /admin/config with secrets redacted and
+	// functions omitted. Typically a Config or UnifiedPaymentConfig.
+	Config interface{}
+}
+
+// forTenant returns deps with r's tenant's stores, if there are tenants
+func (deps AdminDeps) forTenant(r *http.Request) AdminDeps {
+	if deps.Tenants != nil {
+		tenant := deps.Tenants.Tenant(r)
+		deps.Metering = deps.Tenants.Metering(tenant)
+		deps.Budgets = deps.Tenants.Budgets(tenant)
+		deps.Sessions = deps.Tenants.Sessions(tenant)
+		deps.Prefs = deps.Tenants.Prefs(tenant)
+	}
+	return deps
+}
+
+// AdminHandler returns the admin API:
+//
+//	GET  /admin/stats     - metering report (same query params as MetricsHandler)
+//	GET  /admin/config    - sanitized configuration
+//	GET  /admin/payments  - payment ledger (?payer=&endpoint=&status=&limit=)
+//	GET  /admin/reconciliation - verified vs settled report (?start=&end=, RFC3339; default last 24h)
+//	GET  /admin/budgets   - pre-authorized budgets (?payer=&active=&createdAfter=&createdBefore=&pageToken=&limit=)
+//	POST /admin/budgets   - {"id": "budget_...", "suspended": false, "reason": "..."}
+//	GET  /admin/sessions  - sessions (same query params as budgets)
+//	GET  /admin/preferences - customers' payment preferences (?pageToken=&limit=)
+//	GET  /admin/exempt    - active temporary exemptions
+//	POST /admin/exempt    - {"path": "/api/x", "ttlSeconds": 600, "remove": false}
+//	GET  /admin/coupons   - coupons and their redemption counts
+//	POST /admin/coupons   - {"code": "LAUNCH", "percentOff": 50, "maxRedemptions": 100}
+//	GET  /admin/payers    - payer policy entries
+//	POST /admin/payers    - {"entry": "0xabc... or 10.0.0.0/8", "decision": "deny", "remove": false}
+//	GET  /admin/rails     - each rail's health: recent success rate and latency, last error
+//	POST /admin/refunds   - {"paymentId": "pay_...", "amount": 500, "reason": "..."} (amount optional; Idempotency-Key honored)
+func AdminHandler(deps AdminDeps) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		deps := deps.forTenant(r)
+		if deps.Metering == nil {
+			http.NotFound(w, r)
+			return
+		}
+		MetricsHandler(deps.Metering)(w, r)
+	})
+
+	mux.HandleFunc("/admin/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, SanitizeConfig(deps.Config))
+	})
+
+	mux.HandleFunc("/admin/payments", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if deps.Ledger == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		q := r.URL.Query()
+		filter := LedgerFilter{
+			PayerID:  q.Get("payer"),
+			Endpoint: q.Get("endpoint"),
+			Status:   q.Get("status"),
+			Limit:    100,
+		}
+		if limit, err := strconv.Atoi(q.Get("limit")); err == nil && limit > 0 {
+			filter.Limit = limit
+		}
+		if start, err := time.Parse(time.RFC3339, q.Get("start")); err == nil {
+			filter.StartTime = &start
+		}
+		if end, err := time.Parse(time.RFC3339, q.Get("end")); err == nil {
+			filter.EndTime = &end
+		}
+
+		records, err := deps.Ledger.List(filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+			"payments": records,
+			"count":    len(records),
+		})
+	})
+
+	mux.HandleFunc("/admin/reconciliation", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if deps.Ledger == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		end := time.Now()
+		if q := r.URL.Query().Get("end"); q != "" {
+			parsed, err := time.Parse(time.RFC3339, q)
+			if err != nil {
+				http.Error(w, "Invalid request: end must be RFC3339", http.StatusBadRequest)
+				return
+			}
+			end = parsed
+		}
+		start := end.Add(-24 * time.Hour)
+		if q := r.URL.Query().Get("start"); q != "" {
+			parsed, err := time.Parse(time.RFC3339, q)
+			if err != nil {
+				http.Error(w, "Invalid request: start must be RFC3339", http.StatusBadRequest)
+				return
+			}
+			start = parsed
+		}
+
+		report, err := ReconciliationConfig{Ledger: deps.Ledger, Metering: deps.Metering}.Report(start, end)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, report)
+	})
+
+	mux.HandleFunc("/admin/budgets", func(w http.ResponseWriter, r *http.Request) {
+		deps := deps.forTenant(r)
+		if deps.Budgets == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req struct {
+				ID        string `json:"id"`
+				Suspended bool   `json:"suspended"`
+				Reason    string `json:"reason"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+				http.Error(w, "Invalid request: id is required", http.StatusBadRequest)
+				return
+			}
+
+			var changed bool
+			var err error
+			decision := AuditResumed
+			if req.Suspended {
+				decision = AuditSuspended
+				changed, err = deps.Budgets.Suspend(req.ID, req.Reason)
+			} else {
+				changed, err = deps.Budgets.Resume(req.ID)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+			budget, err := deps.Budgets.Get(req.ID)
+			if err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+			if changed {
+				deps.Audit.Record(r, AuditEvent{Decision: decision, Reason: "admin", Payer: budget.AgentID, PaymentID: budget.ID, Metadata: adminReason(req.Reason)})
+			}
+			writeAdminJSON(w, http.StatusOK, budget)
+			return
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		filter, pageToken, limit, err := ParseListFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		budgets, next, err := deps.Budgets.ListBudgets(filter, pageToken, limit)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+			"budgets":       budgets,
+			"count":         len(budgets),
+			"nextPageToken": next,
+		})
+	})
+
+	mux.HandleFunc("/admin/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		deps := deps.forTenant(r)
+		if deps.Sessions == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		filter, pageToken, limit, err := ParseListFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		sessions, next, err := deps.Sessions.ListSessions(filter, pageToken, limit)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+			"sessions":      sessions,
+			"count":         len(sessions),
+			"nextPageToken": next,
+		})
+	})
+
+	mux.HandleFunc("/admin/preferences", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		deps := deps.forTenant(r)
+		lister, ok := deps.Prefs.(PaymentPrefsLister)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		_, pageToken, limit, err := ParseListFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		prefs, next, err := lister.ListPrefs(r.Context(), pageToken, limit)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+			"preferences":   prefs,
+			"count":         len(prefs),
+			"nextPageToken": next,
+		})
+	})
+
+	mux.HandleFunc("/admin/exempt", func(w http.ResponseWriter, r *http.Request) {
+		if deps.Exemptions == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+				"exemptions": deps.Exemptions.List(),
+			})
+
+		case http.MethodPost:
+			var req struct {
+				Path       string `json:"path"`
+				TTLSeconds int    `json:"ttlSeconds"`
+				Remove     bool   `json:"remove"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !strings.HasPrefix(req.Path, "/") {
+				http.Error(w, "Invalid request: path must start with /", http.StatusBadRequest)
+				return
+			}
+
+			if req.Remove {
+				deps.Exemptions.Remove(req.Path)
+			} else {
+				deps.Exemptions.Add(req.Path, time.Duration(req.TTLSeconds)*time.Second)
+			}
+			writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+				"exemptions": deps.Exemptions.List(),
+			})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/admin/coupons", func(w http.ResponseWriter, r *http.Request) {
+		if deps.Coupons == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			coupons, err := deps.Coupons.List()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+				"coupons": coupons,
+				"count":   len(coupons),
+			})
+
+		case http.MethodPost:
+			var coupon Coupon
+			if err := json.NewDecoder(r.Body).Decode(&coupon); err != nil {
+				http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			created, err := deps.Coupons.Create(coupon)
+			if errors.Is(err, ErrCouponExists) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeAdminJSON(w, http.StatusCreated, created)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/admin/payers", func(w http.ResponseWriter, r *http.Request) {
+		if deps.PayerPolicy == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req struct {
+				Entry    string        `json:"entry"`
+				Decision PayerDecision `json:"decision"`
+				Remove   bool          `json:"remove"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			var err error
+			if req.Remove {
+				err = deps.PayerPolicy.RemoveEntry(req.Entry)
+			} else {
+				err = deps.PayerPolicy.SetEntry(req.Entry, req.Decision)
+			}
+			if err != nil {
+				http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		entries, err := deps.PayerPolicy.Entries()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+			"entries": entries,
+		})
+	})
+
+	mux.HandleFunc("/admin/rails", func(w http.ResponseWriter, r *http.Request) {
+		if deps.RailMetrics == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+			"rails": deps.RailMetrics.Snapshot(),
+		})
+	})
+
+	mux.HandleFunc("/admin/refunds", func(w http.ResponseWriter, r *http.Request) {
+		if deps.Refunds == nil {
+			http.NotFound(w, r)
+			return
+		}
+		deps.Refunds.ServeHTTP(w, r)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(r, deps.APIKey) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="x402-admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// adminReason carries an admin's note into the audit event
+func adminReason(reason string) map[string]string {
+	if reason == "" {
+		return nil
+	}
+	return map[string]string{"note": reason}
+}
+
+// adminAuthorized checks the admin API key in constant time
+func adminAuthorized(r *http.Request, apiKey string) bool {
+	if apiKey == "" {
+		return false
+	}
+
+	provided := r.Header.Get("X-Admin-Key")
+	if auth := r.Header.Get("Authorization"); provided == "" && strings.HasPrefix(auth, "Bearer ") {
+		provided = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(apiKey)) == 1
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// ============================================================================
+// Config Sanitization
+// ============================================================================
+
+// redactedValue replaces secret values in SanitizeConfig output
+const redactedValue = "[REDACTED]"
+
+// secretFieldMarkers identify field names whose values must not be exposed
+var secretFieldMarkers = []string{"secret", "password", "apikey", "privatekey", "token", "credential"}
+
+// SanitizeConfig converts a config struct into a JSON-friendly map with
+// secret-looking fields redacted and functions/channels omitted
+func SanitizeConfig(config interface{}) interface{} {
+	if config == nil {
+		return map[string]interface{}{}
+	}
+	return sanitizeValue(reflect.ValueOf(config), 0)
+}
+
+// maxSanitizeDepth guards against pointer cycles in config values
+const maxSanitizeDepth = 10
+
+func sanitizeValue(v reflect.Value, depth int) interface{} {
+	if depth > maxSanitizeDepth {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return sanitizeValue(v.Elem(), depth+1)
+
+	case reflect.Struct:
+		if t, ok := v.Interface().(time.Time); ok {
+			return t
+		}
+		out := make(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() || !isSerializable(v.Field(i)) {
+				continue
+			}
+			if isSecretField(field.Name) {
+				if !v.Field(i).IsZero() {
+					out[field.Name] = redactedValue
+				}
+				continue
+			}
+			out[field.Name] = sanitizeValue(v.Field(i), depth+1)
+		}
+		return out
+
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		out := make(map[string]interface{})
+		iter := v.MapRange()
+		for iter.Next() {
+			key := iter.Key()
+			if key.Kind() != reflect.String || !isSerializable(iter.Value()) {
+				continue
+			}
+			if isSecretField(key.String()) {
+				out[key.String()] = redactedValue
+				continue
+			}
+			out[key.String()] = sanitizeValue(iter.Value(), depth+1)
+		}
+		return out
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		out := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if isSerializable(v.Index(i)) {
+				out = append(out, sanitizeValue(v.Index(i), depth+1))
+			}
+		}
+		return out
+
+	default:
+		return v.Interface()
+	}
+}
+
+// isSerializable reports whether a value can appear in the config dump
+func isSerializable(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return false
+	case reflect.Interface:
+		if v.IsNil() {
+			return true
+		}
+		// Stores and other behavior-carrying interfaces are not config
+		return v.Elem().Kind() != reflect.Ptr && isSerializable(v.Elem())
+	}
+	return true
+}
+
+// isSecretField reports whether a field name looks like it holds a secret.
+// Separators are ignored so "api-key", "api_key" and "APIKey" all match.
+func isSecretField(name string) bool {
+	lower := strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(name))
+	if strings.HasSuffix(lower, "key") {
+		return true
+	}
+	for _, marker := range secretFieldMarkers {
+		if strings.Contains(lower, marker) {
+			return true
+		}
+	}
+	return false
+}
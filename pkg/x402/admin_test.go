@@ -0,0 +1,264 @@
+package x402
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestAdminHandler() (http.Handler, AdminDeps) {
+	deps := AdminDeps{
+		APIKey:     "admin_secret",
+		Metering:   NewInMemoryMeteringStore(100, "USDC"),
+		Ledger:     NewInMemoryPaymentLedger(100),
+		Budgets:    NewInMemoryPreAuthStore(),
+		Sessions:   NewInMemorySessionStore(),
+		Exemptions: NewExemptionList(),
+		Coupons:    NewInMemoryCouponStore(),
+
+		PayerPolicy: NewInMemoryPayerPolicyStore(),
+	}
+	return AdminHandler(deps), deps
+}
+
+func adminRequest(method, path, body string) *http.Request {
+	var req *http.Request
+	if body != "" {
+		req = httptest.NewRequest(method, path, strings.NewReader(body))
+	} else {
+		req = httptest.NewRequest(method, path, nil)
+	}
+	req.Header.Set("Authorization", "Bearer admin_secret")
+	return req
+}
+
+func TestAdminHandler_RequiresAuth(t *testing.T) {
+	handler, _ := newTestAdminHandler()
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   int
+	}{
+		{"missing key", "", "", http.StatusUnauthorized},
+		{"wrong key", "Authorization", "Bearer wrong", http.StatusUnauthorized},
+		{"bearer key", "Authorization", "Bearer admin_secret", http.StatusOK},
+		{"admin key header", "X-Admin-Key", "admin_secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/admin/stats", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("Expected %d, got %d", tt.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestAdminHandler_EmptyKeyRejectsAll(t *testing.T) {
+	handler := AdminHandler(AdminDeps{Metering: NewInMemoryMeteringStore(10, "USDC")})
+
+	req := httptest.NewRequest("GET", "/admin/stats", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 when no API key is configured, got %d", w.Code)
+	}
+}
+
+func TestAdminHandler_ConfigRedactsSecrets(t *testing.T) {
+	config := testConfig()
+	config.PaymentVerifier = func(token string) (bool, error) { return true, nil }
+
+	handler := AdminHandler(AdminDeps{
+		APIKey: "admin_secret",
+		Config: struct {
+			Config
+			StripeSecretKey string
+			WebhookSecret   string
+			Flags           map[string]string
+		}{
+			Config:          config,
+			StripeSecretKey: "sk_live_abc",
+			WebhookSecret:   "whsec_abc",
+			Flags:           map[string]string{"admin-key": "admin_secret", "price": "100"},
+		},
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("GET", "/admin/config", ""))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	for _, secret := range []string{"sk_live_abc", "whsec_abc", "admin_secret"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("Config dump leaked secret %q: %s", secret, body)
+		}
+	}
+	if !strings.Contains(body, redactedValue) {
+		t.Error("Expected redacted markers in config dump")
+	}
+	if strings.Contains(body, "PaymentVerifier") {
+		t.Error("Expected functions to be omitted from config dump")
+	}
+	if !strings.Contains(body, "0x1234567890123456789012345678901234567890") {
+		t.Error("Expected non-secret fields to be present")
+	}
+}
+
+func TestAdminHandler_Payments(t *testing.T) {
+	handler, deps := newTestAdminHandler()
+	deps.Ledger.Record(PaymentRecord{Endpoint: "/api/a", PayerID: "0xabc", Amount: 100})
+	deps.Ledger.Record(PaymentRecord{Endpoint: "/api/b", PayerID: "0xdef", Amount: 200})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("GET", "/admin/payments?payer=0xabc", ""))
+
+	var resp struct {
+		Payments []PaymentRecord `json:"payments"`
+		Count    int             `json:"count"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Count != 1 || resp.Payments[0].Endpoint != "/api/a" {
+		t.Errorf("Expected one payment for 0xabc, got %+v", resp.Payments)
+	}
+}
+
+func TestAdminHandler_Budgets(t *testing.T) {
+	handler, deps := newTestAdminHandler()
+	deps.Budgets.Create(&PreAuthBudget{AgentID: "agent-1", TotalBudget: 1000})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("GET", "/admin/budgets", ""))
+
+	var resp struct {
+		Budgets []PreAuthBudget `json:"budgets"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Budgets) != 1 || resp.Budgets[0].AgentID != "agent-1" {
+		t.Errorf("Expected agent-1 budget, got %+v", resp.Budgets)
+	}
+}
+
+func TestAdminHandler_TemporaryExemption(t *testing.T) {
+	handler, deps := newTestAdminHandler()
+
+	config := testConfig()
+	config.DynamicExemptions = deps.Exemptions
+	protected := Middleware(createTestHandler(), config)
+
+	w := httptest.NewRecorder()
+	protected.ServeHTTP(w, httptest.NewRequest("GET", "/api/incident", nil))
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402 before exemption, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("POST", "/admin/exempt", `{"path": "/api/incident", "ttlSeconds": 600}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 adding exemption, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	protected.ServeHTTP(w, httptest.NewRequest("GET", "/api/incident", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 after exemption, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("POST", "/admin/exempt", `{"path": "/api/incident", "remove": true}`))
+
+	w = httptest.NewRecorder()
+	protected.ServeHTTP(w, httptest.NewRequest("GET", "/api/incident", nil))
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 after removing exemption, got %d", w.Code)
+	}
+
+	// Invalid paths are rejected
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("POST", "/admin/exempt", `{"path": "api"}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid path, got %d", w.Code)
+	}
+}
+
+func TestAdminHandler_Coupons(t *testing.T) {
+	handler, deps := newTestAdminHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("POST", "/admin/coupons", `{"code": "launch", "percentOff": 50, "maxRedemptions": 100}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 creating coupon, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("POST", "/admin/coupons", `{"code": "LAUNCH", "percentOff": 10}`))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for duplicate code, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("POST", "/admin/coupons", `{"code": "BAD", "percentOff": 150}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid coupon, got %d", w.Code)
+	}
+
+	deps.Coupons.Redeem("LAUNCH", "/api/data")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("GET", "/admin/coupons", ""))
+	var body struct {
+		Coupons []Coupon `json:"coupons"`
+	}
+	json.NewDecoder(w.Body).Decode(&body)
+	if len(body.Coupons) != 1 || body.Coupons[0].Code != "LAUNCH" || body.Coupons[0].Redemptions != 1 {
+		t.Errorf("Expected LAUNCH with 1 redemption, got %+v", body.Coupons)
+	}
+}
+
+func TestAdminHandler_PayerPolicy(t *testing.T) {
+	handler, deps := newTestAdminHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("POST", "/admin/payers", `{"entry": "0xFRAUD", "decision": "deny"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 adding entry, got %d", w.Code)
+	}
+	if decision, _ := deps.PayerPolicy.Check(Payer{Address: "0xfraud"}); decision != PayerDeny {
+		t.Errorf("Expected 0xfraud to be denied, got %s", decision)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("POST", "/admin/payers", `{"entry": "0xfraud", "remove": true}`))
+	var body struct {
+		Entries []PayerPolicyEntry `json:"entries"`
+	}
+	json.NewDecoder(w.Body).Decode(&body)
+	if len(body.Entries) != 0 {
+		t.Errorf("Expected no entries after removal, got %+v", body.Entries)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("POST", "/admin/payers", `{"entry": "10.0.0.0/8", "decision": "block"}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid decision, got %d", w.Code)
+	}
+}
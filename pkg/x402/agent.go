@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -36,6 +37,78 @@ var aiAgentPatterns = []*regexp.Regexp{
 	regexp.MustCompile(`(?i)mcp-client`), // Model Context Protocol clients
 }
 
+// AgentDetector reports whether a request comes from an AI agent
+type AgentDetector func(r *http.Request) bool
+
+// detect runs d, or the built-in User-Agent and header checks if d is nil
+func (d AgentDetector) detect(r *http.Request) bool {
+	if d == nil {
+		return isAIAgent(r)
+	}
+	return d(r)
+}
+
+// 402 body formats for Config.PaymentRequiredFormat
+const (
+	FormatAuto  = ""      // AIResponse for agents, PaymentRequiredResponse otherwise
+	FormatX402  = "x402"  // Always PaymentRequiredResponse
+	FormatAgent = "agent" // Always AIResponse
+)
+
+// agentFormat reports whether a 402 to r gets the AIResponse body
+func (c Config) agentFormat(r *http.Request) bool {
+	switch c.PaymentRequiredFormat {
+	case FormatAgent:
+		return true
+	case FormatX402:
+		return false
+	}
+	return c.AgentDetector.detect(r)
+}
+
+// agentPaymentRequired wraps a 402 response in the AIResponse envelope
+// agents parse: a PAYMENT_REQUIRED error saying how to pay, with the x402
+// response itself as data for clients that sign requirements
+func (c Config) agentPaymentRequired(r *http.Request, response PaymentRequiredResponse) AIResponse {
+	req := response.Accepts[0]
+	payment := &PaymentAction{
+		Required:  true,
+		Amount:    c.PricePerRequest,
+		Currency:  c.Currency,
+		PayTo:     req.PayTo,
+		Network:   req.Network,
+		Asset:     req.Asset,
+		Endpoint:  req.Resource,
+		ExpiresAt: response.ValidUntil,
+	}
+	ext := extensionsFor(r, c.Extensions)
+	if ext != nil && ext.PreAuth != nil {
+		payment.PreAuthAvailable = true
+		payment.PreAuthEndpoint = ext.PreAuth.Endpoint
+		payment.PreAuthMinBudget = ext.PreAuth.MinBudget
+	}
+
+	aiErr := &AIError{
+		Code:        ErrCodePaymentRequired,
+		Message:     response.Error,
+		Retryable:   false,
+		Action:      "pay",
+		PaymentInfo: payment,
+	}
+	if response.Code != "" {
+		aiErr.Details = map[string]string{"reason": response.Code}
+	}
+	return AIResponse{
+		Success: false,
+		Data:    response,
+		Error:   aiErr,
+		Meta: AIMetadata{
+			RequestID: generateRequestID(r),
+			Timestamp: c.clock().Format(time.RFC3339),
+		},
+	}
+}
+
 // isAIAgent detects if the request is from an AI agent
 func isAIAgent(r *http.Request) bool {
 	// Check explicit header
@@ -70,8 +143,11 @@ type AIAgentConfig struct {
 	// EnableCostEstimation adds cost estimates to responses
 	EnableCostEstimation bool
 
-	// EnableAutoRetryHints provides retry guidance in 402 responses
+	// EnableAutoRetryHints provides retry guidance in 402 responses,
+	// computed by RetryPolicy (the default policy if nil). RetryPolicy also
+	// times the Retry-After of requests Priority sheds.
 	EnableAutoRetryHints bool
+	RetryPolicy          *RetryPolicy
 
 	// EnableBatchPricing offers discounts for batch requests
 	EnableBatchPricing bool
@@ -93,6 +169,10 @@ type AIAgentConfig struct {
 
 	// Currency for pricing
 	Currency string
+
+	// Priority, if set, prices requests by X-Agent-Priority and sheds
+	// low-priority ones when the server is saturated
+	Priority *PriorityPolicy
 }
 
 // AIAgentHeaders contains headers specifically for AI agent communication
@@ -201,8 +281,30 @@ type RetryStrategy struct {
 func AIAgentMiddleware(next http.Handler, x402Config Config, agentConfig AIAgentConfig) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Detect if this is an AI agent
-		isAgent := isAIAgent(r)
+		isAgent := x402Config.AgentDetector.detect(r)
 
+		// Admit by priority, shedding low-priority agents under load
+		level := PriorityNormal
+		if isAgent {
+			level = priority(r.Header.Get("X-Agent-Priority"))
+		}
+		done, admitted := agentConfig.Priority.admit(level)
+		if !admitted {
+			x402Config.Audit.Record(r, AuditEvent{Decision: AuditRejected, Reason: "load_shed"})
+			shedRequest(w, r, agentConfig.Priority, agentConfig.RetryPolicy)
+			return
+		}
+		defer done()
+
+		// Price by priority, here and in the payment middleware inside
+		x402Config := x402Config
+		if m := agentConfig.Priority.multiplier(level); isAgent && m != 1 {
+			r = withPriceMultiplier(r, m)
+			x402Config.PricePerRequest = scalePrice(r, x402Config.PricePerRequest)
+			w.Header().Set("X-Price-Multiplier", strconv.FormatFloat(m, 'f', -1, 64))
+		}
+
+		var retry *RetryStrategy
 		if isAgent {
 			// Parse agent headers
 			agentHeaders := ParseAIAgentHeaders(r)
@@ -210,6 +312,7 @@ func AIAgentMiddleware(next http.Handler, x402Config Config, agentConfig AIAgent
 			// Budget check
 			if agentConfig.EnableBudgetAwareness && agentHeaders.AgentBudget > 0 {
 				if x402Config.PricePerRequest > agentHeaders.AgentBudget {
+					x402Config.Audit.Record(r, AuditEvent{Decision: AuditPaymentRequired, Reason: "agent_budget", RequiredAmount: x402Config.PricePerRequest, Currency: x402Config.Currency})
 					sendBudgetExceededResponse(w, x402Config, agentConfig, agentHeaders)
 					return
 				}
@@ -233,13 +336,21 @@ func AIAgentMiddleware(next http.Handler, x402Config Config, agentConfig AIAgent
 
 			// Mark as AI agent request for downstream handlers
 			r.Header.Set("X-AI-Agent-Detected", "true")
+
+			// Payment middleware inside this one explains batching and retries
+			ext := agentConfig.extensions()
+			if agentConfig.EnableAutoRetryHints {
+				strategy := agentConfig.RetryPolicy.Strategy(r, http.StatusPaymentRequired)
+				retry, ext.Retry = &strategy, &strategy
+			}
+			r = advertise(r, ext)
 		}
 
 		// Wrap response writer to capture for post-processing
 		wrapped := &aiAgentResponseWriter{
 			ResponseWriter: w,
 			isAgent:        isAgent,
-			config:         agentConfig,
+			retry:          retry,
 			startTime:      time.Now(),
 		}
 
@@ -257,18 +368,15 @@ func AIAgentMiddleware(next http.Handler, x402Config Config, agentConfig AIAgent
 type aiAgentResponseWriter struct {
 	http.ResponseWriter
 	isAgent   bool
-	config    AIAgentConfig
+	retry     *RetryStrategy // The hints advertised in 402 bodies
 	startTime time.Time
 	written   bool
 }
 
 func (w *aiAgentResponseWriter) WriteHeader(code int) {
-	if !w.written && w.isAgent && code == http.StatusPaymentRequired {
-		// Add retry hints for 402 responses
-		if w.config.EnableAutoRetryHints {
-			w.Header().Set("X-Recommended-Retry", "5")
-			w.Header().Set("Retry-After", "5")
-		}
+	if !w.written && w.isAgent && code == http.StatusPaymentRequired && w.retry != nil {
+		// The headers agree with the body's retry hints
+		setRetryHeaders(w, *w.retry)
 	}
 	w.written = true
 	w.ResponseWriter.WriteHeader(code)
@@ -293,10 +401,20 @@ func sendBudgetExceededResponse(w http.ResponseWriter, x402Config Config, agentC
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("X-Budget-Exceeded", "true")
+	setPaymentRequiredHeaders(w, x402Config.Realm, nil, nil)
 	w.WriteHeader(http.StatusPaymentRequired)
 	_ = json.NewEncoder(w).Encode(response)
 }
 
+// extensions are the batch pricing hints agents are offered
+func (c AIAgentConfig) extensions() PaymentExtensions {
+	var ext PaymentExtensions
+	if c.EnableBatchPricing {
+		ext.Batch = &BatchInfo{Discount: c.BatchDiscount, MinBatchSize: c.MinBatchSize}
+	}
+	return ext
+}
+
 // calculateBatchPrice calculates discounted price for batch requests
 func calculateBatchPrice(basePrice int64, batchSize int, discountPercent int) int64 {
 	if discountPercent <= 0 || discountPercent > 100 {
@@ -356,6 +474,10 @@ type CostEstimate struct {
 	Currency      string       `json:"currency"`
 	Factors       []CostFactor `json:"factors,omitempty"`
 	ValidUntil    time.Time    `json:"validUntil"`
+
+	// Quote, from QuoteHandler, is sent back as X-Price-Quote to be charged
+	// EstimatedCost until ValidUntil
+	Quote string `json:"quote,omitempty"`
 }
 
 // CostFactor breaks down cost components
@@ -374,20 +496,10 @@ func CostEstimateHandler(pricing map[string]int64, currency string) http.Handler
 			method = "GET"
 		}
 
-		key := strings.ToUpper(method) + ":" + endpoint
-		cost, ok := pricing[key]
-		if !ok {
-			// Try just endpoint
-			cost, ok = pricing[endpoint]
-			if !ok {
-				cost = pricing["default"]
-			}
-		}
-
 		estimate := CostEstimate{
 			Endpoint:      endpoint,
 			Method:        method,
-			EstimatedCost: cost,
+			EstimatedCost: estimateCost(pricing, method, endpoint),
 			Currency:      currency,
 			ValidUntil:    time.Now().Add(5 * time.Minute),
 		}
@@ -397,6 +509,17 @@ func CostEstimateHandler(pricing map[string]int64, currency string) http.Handler
 	}
 }
 
+// estimateCost looks up "METHOD:endpoint", then endpoint, then "default"
+func estimateCost(pricing map[string]int64, method, endpoint string) int64 {
+	if cost, ok := pricing[strings.ToUpper(method)+":"+endpoint]; ok {
+		return cost
+	}
+	if cost, ok := pricing[endpoint]; ok {
+		return cost
+	}
+	return pricing["default"]
+}
+
 // AgentWelcomeInfo provides onboarding information for AI agents
 type AgentWelcomeInfo struct {
 	Service          string              `json:"service"`
@@ -437,8 +560,20 @@ type AgentPricingInfo struct {
 	FreeEndpoints   []string `json:"freeEndpoints,omitempty"`
 }
 
-// AgentWelcomeHandler returns service info optimized for AI agents
+// AgentWelcomeHandler returns service info optimized for AI agents. Endpoints
+// that don't require payment are added to Pricing.FreeEndpoints.
 func AgentWelcomeHandler(info AgentWelcomeInfo) http.HandlerFunc {
+	info.Pricing.FreeEndpoints = append([]string(nil), info.Pricing.FreeEndpoints...)
+	for _, ep := range info.Endpoints {
+		if ep.RequiresPayment && ep.Cost != 0 {
+			continue
+		}
+		free := FreeEndpoint{Path: ep.Path, Method: ep.Method}.String()
+		if !slices.Contains(info.Pricing.FreeEndpoints, free) {
+			info.Pricing.FreeEndpoints = append(info.Pricing.FreeEndpoints, free)
+		}
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("X-AI-Agent-Optimized", "true")
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -118,7 +119,7 @@ func TestAIAgentMiddleware_DetectsAgent(t *testing.T) {
 			}
 			w.WriteHeader(http.StatusOK)
 		}),
-		Config{PricePerRequest: 100, Currency: "USDC"},
+		Config{PricePerRequest: 100, Currency: "USDC", TestMode: true},
 		AIAgentConfig{
 			EnableBudgetAwareness: true,
 			EnableCostEstimation:  true,
@@ -148,7 +149,7 @@ func TestAIAgentMiddleware_BudgetExceeded(t *testing.T) {
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusOK)
 		}),
-		Config{PricePerRequest: 1000, Currency: "USDC"},
+		Config{PricePerRequest: 1000, Currency: "USDC", TestMode: true},
 		AIAgentConfig{
 			EnableBudgetAwareness: true,
 			Currency:              "USDC",
@@ -176,7 +177,7 @@ func TestAIAgentMiddleware_BatchPricing(t *testing.T) {
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusOK)
 		}),
-		Config{PricePerRequest: 100, Currency: "USDC"},
+		Config{PricePerRequest: 100, Currency: "USDC", TestMode: true},
 		AIAgentConfig{
 			EnableBatchPricing: true,
 			BatchDiscount:      10, // 10% discount
@@ -287,3 +288,21 @@ func TestAgentWelcomeHandler(t *testing.T) {
 		t.Errorf("Expected service 'Test API', got %s", response.Service)
 	}
 }
+
+func TestAgentWelcomeHandler_ListsFreeEndpoints(t *testing.T) {
+	handler := AgentWelcomeHandler(AgentWelcomeInfo{
+		Endpoints: []AgentEndpointInfo{
+			{Path: "/api/data", Method: "GET", Cost: 100, RequiresPayment: true},
+			{Path: "/health", Method: "GET"},
+		},
+		Pricing: AgentPricingInfo{FreeEndpoints: []string{"GET /health", "/docs*"}},
+	})
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	var response AgentWelcomeInfo
+	json.NewDecoder(rr.Body).Decode(&response)
+	if got := strings.Join(response.Pricing.FreeEndpoints, ","); got != "GET /health,/docs*" {
+		t.Errorf("Expected the free endpoint listed once beside the hand-listed ones, got %q", got)
+	}
+}
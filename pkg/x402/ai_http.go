@@ -9,11 +9,15 @@
 package x402
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 )
@@ -51,6 +55,15 @@ type AIMetadata struct {
 	Cost         *Cost      `json:"cost,omitempty"`
 	RateLimit    *RateLimit `json:"rateLimit,omitempty"`
 	Idempotent   bool       `json:"idempotent,omitempty"`
+
+	// BudgetWarning is set on the response to the request that took the
+	// agent's budget to its low balance threshold
+	BudgetWarning *BudgetWarning `json:"budgetWarning,omitempty"`
+
+	// Budget and Session report the pre-authorized budget or session that
+	// paid for the request (see SendAISuccessFor)
+	Budget  *BudgetStatus  `json:"budget,omitempty"`
+	Session *SessionStatus `json:"session,omitempty"`
 }
 
 // Cost breakdown for the request
@@ -102,6 +115,8 @@ const (
 	ErrCodeServerError         = "SERVER_ERROR"
 	ErrCodeNotFound            = "NOT_FOUND"
 	ErrCodeIdempotencyConflict = "IDEMPOTENCY_CONFLICT"
+	ErrCodeBudgetSuspended     = "BUDGET_SUSPENDED"
+	ErrCodeMalformedProof      = "MALFORMED_PROOF"
 )
 
 // ============================================================================
@@ -151,6 +166,10 @@ type APIEndpoint struct {
 	CostUnit    string             `json:"costUnit"` // "per_call", "per_token"
 	Tags        []string           `json:"tags,omitempty"`
 	RateLimit   *EndpointRateLimit `json:"rateLimit,omitempty"`
+
+	// MimeType and OutputSchema describe the response; see DescribeEndpoints
+	MimeType     string                 `json:"mimeType,omitempty"`
+	OutputSchema map[string]interface{} `json:"outputSchema,omitempty"`
 }
 
 // EndpointParam defines an API parameter
@@ -242,8 +261,9 @@ type MCPCost struct {
 
 // MCPToolsResponse is the response for listing available tools
 type MCPToolsResponse struct {
-	Tools       []MCPTool      `json:"tools"`
-	PaymentInfo MCPPaymentInfo `json:"paymentInfo"`
+	Tools         []MCPTool      `json:"tools"`
+	PaymentInfo   MCPPaymentInfo `json:"paymentInfo"`
+	FreeEndpoints []FreeEndpoint `json:"freeEndpoints"`
 }
 
 // MCPPaymentInfo provides payment context for MCP clients
@@ -314,23 +334,77 @@ type PreAuthBudget struct {
 	// Usage tracking
 	TotalSpent   int64 `json:"totalSpent"`
 	RequestCount int64 `json:"requestCount"`
+
+	// LowBalanceThreshold, if set, warns the agent when Remaining falls to
+	// it (X-Budget-Low and a low_balance alert)
+	LowBalanceThreshold int64 `json:"lowBalanceThreshold,omitempty"`
+
+	// Suspended budgets refuse deductions until an admin resumes them
+	Suspended     bool       `json:"suspended,omitempty"`
+	SuspendedAt   *time.Time `json:"suspendedAt,omitempty"`
+	SuspendReason string     `json:"suspendReason,omitempty"`
 }
 
-// PreAuthStore interface for budget storage
+// clone returns a copy of the budget that shares no maps or pointers with it
+func (b *PreAuthBudget) clone() *PreAuthBudget {
+	cp := *b
+	if b.SuspendedAt != nil {
+		at := *b.SuspendedAt
+		cp.SuspendedAt = &at
+	}
+	if b.Metadata != nil {
+		cp.Metadata = make(map[string]string, len(b.Metadata))
+		for k, v := range b.Metadata {
+			cp.Metadata[k] = v
+		}
+	}
+	return &cp
+}
+
+// ErrBudgetSuspended is returned when deducting from a suspended budget
+var ErrBudgetSuspended = errors.New("budget suspended")
+
+// PreAuthStore interface for budget storage. Budgets returned by any method
+// must be copies: requests read them without holding the store's lock while
+// other requests deduct from the same budget.
 type PreAuthStore interface {
 	Create(budget *PreAuthBudget) error
 	Get(id string) (*PreAuthBudget, error)
 	GetByAgentID(agentID string) (*PreAuthBudget, error)
 	Deduct(id string, amount int64) error
+
+	// DeductIfAvailable deducts amount if the budget covers it and returns
+	// the updated budget. With ErrInsufficientBudget or ErrBudgetSuspended
+	// it returns the budget unchanged, so callers can report what remains.
+	DeductIfAvailable(id string, amount int64) (*PreAuthBudget, error)
+
+	// Suspend and Resume flip the budget's suspension and report whether
+	// it changed, so concurrent callers act on a change only once
+	Suspend(id, reason string) (bool, error)
+	Resume(id string) (bool, error)
+
 	Refund(id string, amount int64) error
 	Delete(id string) error
+	List() ([]*PreAuthBudget, error)
+
+	// ListBudgets returns up to limit budgets matching filter, oldest
+	// first, starting after pageToken ("" for the first page). The returned
+	// token fetches the next page and is "" on the last.
+	ListBudgets(filter ListFilter, pageToken string, limit int) ([]*PreAuthBudget, string, error)
 }
 
-// InMemoryPreAuthStore is a simple in-memory implementation
+// InMemoryPreAuthStore is a simple in-memory implementation. It keeps each
+// budget's history (see BudgetHistoryStore).
 type InMemoryPreAuthStore struct {
+	// HistorySize is how many entries each budget keeps (default
+	// DefaultBudgetHistorySize)
+	HistorySize int
+
 	mu      sync.RWMutex
 	budgets map[string]*PreAuthBudget
 	byAgent map[string]string // agentID -> budgetID
+	history map[string][]BudgetEntry
+	seq     int64
 }
 
 // NewInMemoryPreAuthStore creates a new pre-auth store
@@ -338,6 +412,7 @@ func NewInMemoryPreAuthStore() *InMemoryPreAuthStore {
 	return &InMemoryPreAuthStore{
 		budgets: make(map[string]*PreAuthBudget),
 		byAgent: make(map[string]string),
+		history: make(map[string][]BudgetEntry),
 	}
 }
 
@@ -351,7 +426,7 @@ func (s *InMemoryPreAuthStore) Create(budget *PreAuthBudget) error {
 	budget.CreatedAt = time.Now()
 	budget.Remaining = budget.TotalBudget
 
-	s.budgets[budget.ID] = budget
+	s.budgets[budget.ID] = budget.clone()
 	if budget.AgentID != "" {
 		s.byAgent[budget.AgentID] = budget.ID
 	}
@@ -364,9 +439,9 @@ func (s *InMemoryPreAuthStore) Get(id string) (*PreAuthBudget, error) {
 
 	budget, ok := s.budgets[id]
 	if !ok {
-		return nil, fmt.Errorf("budget not found")
+		return nil, ErrBudgetNotFound
 	}
-	return budget, nil
+	return budget.clone(), nil
 }
 
 func (s *InMemoryPreAuthStore) GetByAgentID(agentID string) (*PreAuthBudget, error) {
@@ -375,26 +450,53 @@ func (s *InMemoryPreAuthStore) GetByAgentID(agentID string) (*PreAuthBudget, err
 
 	budgetID, ok := s.byAgent[agentID]
 	if !ok {
-		return nil, fmt.Errorf("no budget for agent")
+		return nil, fmt.Errorf("no budget for agent %q: %w", agentID, ErrBudgetNotFound)
 	}
-	return s.budgets[budgetID], nil
+	return s.budgets[budgetID].clone(), nil
 }
 
 func (s *InMemoryPreAuthStore) Deduct(id string, amount int64) error {
+	_, err := s.DeductIfAvailable(id, amount)
+	return err
+}
+
+// DeductIfAvailable checks and deducts under one lock and returns a copy of
+// the budget
+func (s *InMemoryPreAuthStore) DeductIfAvailable(id string, amount int64) (*PreAuthBudget, error) {
+	return s.DeductEntry(id, BudgetEntry{Amount: amount})
+}
+
+// Suspend marks the budget suspended with reason
+func (s *InMemoryPreAuthStore) Suspend(id, reason string) (bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	budget, ok := s.budgets[id]
 	if !ok {
-		return fmt.Errorf("budget not found")
+		return false, ErrBudgetNotFound
 	}
-	if budget.Remaining < amount {
-		return fmt.Errorf("insufficient budget")
+	if budget.Suspended {
+		return false, nil
 	}
-	budget.Remaining -= amount
-	budget.TotalSpent += amount
-	budget.RequestCount++
-	return nil
+	now := time.Now()
+	budget.Suspended, budget.SuspendedAt, budget.SuspendReason = true, &now, reason
+	return true, nil
+}
+
+// Resume clears the budget's suspension
+func (s *InMemoryPreAuthStore) Resume(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	budget, ok := s.budgets[id]
+	if !ok {
+		return false, ErrBudgetNotFound
+	}
+	if !budget.Suspended {
+		return false, nil
+	}
+	budget.Suspended, budget.SuspendedAt, budget.SuspendReason = false, nil, ""
+	return true, nil
 }
 
 func (s *InMemoryPreAuthStore) Refund(id string, amount int64) error {
@@ -403,10 +505,11 @@ func (s *InMemoryPreAuthStore) Refund(id string, amount int64) error {
 
 	budget, ok := s.budgets[id]
 	if !ok {
-		return fmt.Errorf("budget not found")
+		return ErrBudgetNotFound
 	}
 	budget.Remaining += amount
 	budget.TotalSpent -= amount
+	s.record(budget, BudgetEntry{Amount: -amount, Result: BudgetResultRefunded})
 	return nil
 }
 
@@ -419,11 +522,46 @@ func (s *InMemoryPreAuthStore) Delete(id string) error {
 		delete(s.byAgent, budget.AgentID)
 	}
 	delete(s.budgets, id)
+	delete(s.history, id)
 	return nil
 }
 
+// List returns copies of all budgets, oldest first
+func (s *InMemoryPreAuthStore) List() ([]*PreAuthBudget, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	budgets := make([]*PreAuthBudget, 0, len(s.budgets))
+	for _, b := range s.budgets {
+		budgets = append(budgets, b.clone())
+	}
+	sort.Slice(budgets, func(i, j int) bool {
+		return budgets[i].CreatedAt.Before(budgets[j].CreatedAt)
+	})
+	return budgets, nil
+}
+
+// ListBudgets returns a page of budgets matching filter
+func (s *InMemoryPreAuthStore) ListBudgets(filter ListFilter, pageToken string, limit int) ([]*PreAuthBudget, string, error) {
+	s.mu.RLock()
+	now := time.Now()
+	var matched []*PreAuthBudget
+	for _, b := range s.budgets {
+		active := !b.Suspended && (b.ExpiresAt.IsZero() || now.Before(b.ExpiresAt))
+		if filter.matches([]string{b.AgentID, b.WalletAddress}, active, b.CreatedAt) {
+			matched = append(matched, b.clone())
+		}
+	}
+	s.mu.RUnlock()
+
+	return paginate(matched, func(b *PreAuthBudget) pageKey {
+		return pageKey{created: b.CreatedAt, id: b.ID}
+	}, pageToken, limit)
+}
+
 func generateBudgetID() string {
 	b := make([]byte, 16)
+	_, _ = rand.Read(b)
 	return "budget_" + hex.EncodeToString(b)
 }
 
@@ -523,11 +661,91 @@ type AIFirstConfig struct {
 
 	// Pricing
 	DefaultCost int64
+
+	// MethodPricing, if set, overrides endpoint costs by HTTP method
+	MethodPricing MethodPricing
+
+	// MaxTimeoutSeconds is how long payment instructions are valid (default 60)
+	MaxTimeoutSeconds int
+
+	// Realm is the WWW-Authenticate realm on 402 responses (default "x402")
+	Realm string
+
+	// Audit, if set, records pre-authorized budget decisions
+	Audit *AuditLog
+
+	// TaskSpend, if set, totals paid requests per X-Agent-Task-ID and
+	// returns the running total in X-Task-Spent
+	TaskSpend TaskSpendStore
+
+	// Alerts, if set, watches pre-authorized budget spend
+	Alerts *SpendingAlerts
+
+	// Quotes, if set, honors the price of a signed quote sent in
+	// X-Price-Quote when it is below the endpoint's cost
+	Quotes *QuoteSigner
+
+	// DiscoverySigner, if set, signs AIDiscoveryHandler's documents in
+	// X-Discovery-Signature
+	DiscoverySigner *DiscoverySigner
+
+	// RequirePayment charges requests no budget covers: they need an inline
+	// X-PAYMENT (or PAYMENT-SIGNATURE) proof that PaymentVerifier accepts,
+	// and get a PAYMENT_REQUIRED AIError otherwise. Without it they reach
+	// next unpaid, for a payment middleware inside this one to charge.
+	RequirePayment  bool
+	PaymentVerifier func(token string) (bool, error)
+
+	// ExemptPaths (prefixes) and DynamicExemptions are served without
+	// payment when RequirePayment is set, e.g. the budget endpoint
+	ExemptPaths       []string
+	DynamicExemptions *ExemptionList
+
+	// Budgets are closed through AIBudgetHandler's DELETE by their agent
+	// (X-Agent-ID plus an X-Wallet-Signature of BudgetCloseMessage, over
+	// X-Close-Nonce and X-Close-Timestamp, that WalletVerifier accepts) or
+	// an admin presenting AdminKey. Refunder returns what is left; without
+	// one, only spent budgets can be closed.
+	AdminKey       string
+	WalletVerifier WalletVerifier
+	Refunder       BudgetRefunder
+
+	// Tenants, if set, keeps budgets (in place of PreAuthStore) and
+	// idempotency keys separate for each tenant
+	Tenants *TenantStores
+}
+
+// preAuthEnabled reports whether requests may be charged to budgets
+func (config AIFirstConfig) preAuthEnabled() bool {
+	return config.EnablePreAuth && (config.PreAuthStore != nil || config.Tenants != nil)
+}
+
+// idempotencyKey is r's Idempotency-Key, scoped to its tenant
+func (config AIFirstConfig) idempotencyKey(r *http.Request) string {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" || config.Tenants == nil {
+		return key
+	}
+	return config.Tenants.Tenant(r) + "/" + key
 }
 
-// AIFirstMiddleware provides AI-optimized request handling
+// AIFirstMiddleware provides AI-optimized request handling.
+//
+// With RequirePayment it is a complete payment middleware. Otherwise it only
+// charges pre-authorized budgets and admits everything else, so it must wrap
+// the middleware that charges everyone else. Requests it charged carry the
+// request header X-Payment-Verified: true (a client's own is removed), and x402
+// middleware inside it passes them through uncharged; see "Composing
+// Middleware" in docs/UNIFIED_PAYMENTS.md.
 func AIFirstMiddleware(next http.Handler, config AIFirstConfig) http.Handler {
+	guard := &composition{name: "AIFirstMiddleware"}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An x402 middleware outside this one already handled payment
+		if guard.passThrough(w, r, next) {
+			return
+		}
+
 		start := time.Now()
 		requestID := generateRequestID(r)
 
@@ -538,7 +756,7 @@ func AIFirstMiddleware(next http.Handler, config AIFirstConfig) http.Handler {
 
 		// Check idempotency key
 		if config.EnableIdempotency && config.IdempotencyStore != nil {
-			if idempKey := r.Header.Get("Idempotency-Key"); idempKey != "" {
+			if idempKey := config.idempotencyKey(r); idempKey != "" {
 				if record, _ := config.IdempotencyStore.Get(idempKey); record != nil {
 					// Return cached response
 					for k, v := range record.Headers {
@@ -552,16 +770,54 @@ func AIFirstMiddleware(next http.Handler, config AIFirstConfig) http.Handler {
 			}
 		}
 
+		// Only this middleware may mark the request paid
+		r.Header.Del("X-Payment-Verified")
+
+		if config.RequirePayment {
+			if reason := exemption(r, config.ExemptPaths, config.DynamicExemptions, config.MethodPricing); reason != "" {
+				config.Audit.Record(r, AuditEvent{Decision: AuditExempt, Reason: reason})
+				next.ServeHTTP(w, decide(reportExempt(r), guard.name))
+				return
+			}
+		}
+		proof := defaultProtocol.proof(r)
+		paid := false
+
 		// Check pre-authorized budget
-		if config.EnablePreAuth && config.PreAuthStore != nil {
+		budgets := config.Tenants.budgetsFor(r, config.PreAuthStore)
+		if config.preAuthEnabled() {
 			agentID := r.Header.Get("X-Agent-ID")
 			if agentID != "" {
-				budget, err := config.PreAuthStore.GetByAgentID(agentID)
+				budget, err := budgets.GetByAgentID(agentID)
 				if err == nil && budget != nil {
-					cost := getCostForPath(r.URL.Path, r.Method, config.Endpoints, config.DefaultCost)
+					cost, quote := config.quotedCost(r)
 
-					if budget.Remaining < cost {
-						sendAIError(w, requestID, start, AIError{
+					// Check and deduct in one step; budget is the store's answer
+					budget, err = deductBudget(budgets, budget.ID, cost, r, requestID)
+					if err != nil {
+						config.Quotes.release(quote)
+					}
+					switch {
+					case err == nil:
+						config.Audit.Record(r, AuditEvent{Decision: AuditVerified, Rail: "pre-auth", Payer: agentID, RequiredAmount: cost, Currency: config.Currency, PaymentID: budget.ID})
+
+						// Add budget info to headers
+						w.Header().Set("X-Budget-Remaining", fmt.Sprintf("%d", budget.Remaining))
+						w.Header().Set("X-Budget-Deducted", fmt.Sprintf("%d", cost))
+						recordTaskSpend(config.TaskSpend, w, r, cost, config.Currency)
+						config.Alerts.record(r, budgets, budget, cost)
+						warnLowBalance(w, config.Alerts, budget, cost)
+
+						// Mark as paid
+						r = withBudgetStatus(r, budget)
+						r = reportPayment(r, RequestPaymentInfo{Paid: true, Type: PaymentTypeBudget, PaymentID: budget.ID, Payer: agentID, Gross: cost, Net: cost, Currency: config.Currency})
+						r.Header.Set("X-Payment-Verified", "true")
+						paid = true
+					case errors.Is(err, ErrInsufficientBudget) && config.RequirePayment && proof != "":
+						// The budget falls short; the inline proof pays instead
+					case errors.Is(err, ErrInsufficientBudget):
+						config.Audit.Record(r, AuditEvent{Decision: AuditPaymentRequired, Reason: "insufficient_budget", Payer: agentID, RequiredAmount: cost, Currency: config.Currency, PaymentID: budget.ID})
+						sendAIError(w, config.Realm, requestID, start, AIError{
 							Code:      ErrCodeInsufficientBudget,
 							Message:   "Pre-authorized budget exhausted",
 							Retryable: false,
@@ -577,16 +833,18 @@ func AIFirstMiddleware(next http.Handler, config AIFirstConfig) http.Handler {
 								Currency:         config.Currency,
 								PayTo:            config.PayTo,
 								Network:          config.Network,
+								ExpiresAt:        paymentDeadline(time.Now(), config.MaxTimeoutSeconds).Unix(),
 								PreAuthAvailable: true,
 								PreAuthEndpoint:  "/ai/budget",
 							},
 						})
 						return
-					}
-
-					// Deduct from budget
-					if err := config.PreAuthStore.Deduct(budget.ID, cost); err != nil {
-						sendAIError(w, requestID, start, AIError{
+					case errors.Is(err, ErrBudgetSuspended):
+						config.Audit.Record(r, AuditEvent{Decision: AuditRejected, Reason: "budget_suspended", Payer: agentID, RequiredAmount: cost, Currency: config.Currency, PaymentID: budget.ID})
+						sendAIError(w, config.Realm, requestID, start, budgetSuspendedError(budget))
+						return
+					default:
+						sendAIError(w, config.Realm, requestID, start, AIError{
 							Code:       ErrCodeServerError,
 							Message:    "Failed to deduct from budget",
 							Retryable:  true,
@@ -595,17 +853,30 @@ func AIFirstMiddleware(next http.Handler, config AIFirstConfig) http.Handler {
 						})
 						return
 					}
-
-					// Add budget info to headers (budget.Remaining is already updated by Deduct)
-					w.Header().Set("X-Budget-Remaining", fmt.Sprintf("%d", budget.Remaining))
-					w.Header().Set("X-Budget-Deducted", fmt.Sprintf("%d", cost))
-
-					// Mark as paid
-					r.Header.Set("X-Payment-Verified", "true")
 				}
 			}
 		}
 
+		if !paid && config.RequirePayment {
+			cost, ok := config.payInline(w, r, proof, requestID, start)
+			if !ok {
+				return
+			}
+			if cost > 0 {
+				r = reportPayment(r, RequestPaymentInfo{Paid: true, Network: config.Network, Gross: cost, Net: cost, Currency: config.Currency})
+			}
+		}
+
+		// Unpaid requests are left to payment middleware inside this one
+		if paid || config.RequirePayment {
+			r = decide(r, guard.name)
+		}
+
+		// Payment middleware inside this one offers the budget endpoint
+		if !paid && config.preAuthEnabled() {
+			r = advertise(r, PaymentExtensions{PreAuth: &PreAuthInfo{Endpoint: "/ai/budget"}})
+		}
+
 		// Wrap response for idempotency caching
 		wrapped := &aiResponseRecorder{
 			ResponseWriter: w,
@@ -617,7 +888,7 @@ func AIFirstMiddleware(next http.Handler, config AIFirstConfig) http.Handler {
 
 		// Store idempotency record
 		if config.EnableIdempotency && config.IdempotencyStore != nil {
-			if idempKey := r.Header.Get("Idempotency-Key"); idempKey != "" {
+			if idempKey := config.idempotencyKey(r); idempKey != "" {
 				headers := make(map[string]string)
 				for k := range wrapped.Header() {
 					headers[k] = wrapped.Header().Get(k)
@@ -637,6 +908,98 @@ func AIFirstMiddleware(next http.Handler, config AIFirstConfig) http.Handler {
 	})
 }
 
+// payInline charges a request no budget covered with its inline proof,
+// answering with a 402 AIError if there is none or it is refused. It reports
+// what was charged and whether the request may proceed.
+func (config AIFirstConfig) payInline(w http.ResponseWriter, r *http.Request, proof, requestID string, start time.Time) (int64, bool) {
+	cost, quote := config.quotedCost(r)
+	if cost <= 0 {
+		return 0, true
+	}
+
+	payment := &PaymentAction{
+		Required:         true,
+		Amount:           cost,
+		Currency:         config.Currency,
+		PayTo:            config.PayTo,
+		Network:          config.Network,
+		Asset:            config.Asset,
+		ExpiresAt:        paymentDeadline(time.Now(), config.MaxTimeoutSeconds).Unix(),
+		PreAuthAvailable: config.preAuthEnabled(),
+	}
+	if payment.PreAuthAvailable {
+		payment.PreAuthEndpoint = "/ai/budget"
+	}
+
+	if proof == "" {
+		config.Quotes.release(quote)
+		config.Audit.Record(r, AuditEvent{Decision: AuditPaymentRequired, RequiredAmount: cost, Currency: config.Currency})
+		sendAIError(w, config.Realm, requestID, start, AIError{
+			Code:        ErrCodePaymentRequired,
+			Message:     "Payment required: send an X-PAYMENT proof or use a pre-authorized budget",
+			Retryable:   true,
+			Action:      "pay",
+			PaymentInfo: payment,
+		})
+		return 0, false
+	}
+
+	var valid bool
+	var err error
+	if config.PaymentVerifier != nil {
+		valid, err = config.PaymentVerifier(proof)
+	}
+	if err != nil || !valid {
+		config.Quotes.release(quote)
+		reason := FailureInvalidPayment
+		if err != nil {
+			reason = FailureRailError
+		}
+		config.Audit.recordPaymentRequired(r, &PaymentFailure{Stage: StageVerify, Reason: reason, ExpectedAmount: cost}, proof,
+			AuditEvent{RequiredAmount: cost, Currency: config.Currency})
+		sendAIError(w, config.Realm, requestID, start, AIError{
+			Code:        ErrCodeInvalidPayment,
+			Message:     "Payment proof was not accepted",
+			Retryable:   true,
+			Action:      "pay",
+			PaymentInfo: payment,
+		})
+		return 0, false
+	}
+
+	config.Audit.Record(r, AuditEvent{Decision: AuditVerified, RequiredAmount: cost, Currency: config.Currency, PayloadHash: hashPayload(proof)})
+	w.Header().Set("X-Payment-Verified", "true")
+	r.Header.Set("X-Payment-Verified", "true")
+	recordTaskSpend(config.TaskSpend, w, r, cost, config.Currency)
+	return cost, true
+}
+
+// quotedCost is what r costs: its endpoint's cost, or the price of a quote
+// it carries that is lower. A quote is claimed here, so charges that fail
+// must release it.
+func (config AIFirstConfig) quotedCost(r *http.Request) (int64, *PriceQuote) {
+	current := getCostForPath(r.URL.Path, r.Method, config.Endpoints, config.MethodPricing, config.DefaultCost)
+	cost, quote, _ := config.Quotes.price(r, config.Currency, current)
+	if config.Quotes.claim(quote) != nil {
+		return current, nil
+	}
+	return cost, quote
+}
+
+// budgetSuspendedError tells an agent its budget is suspended
+func budgetSuspendedError(budget *PreAuthBudget) AIError {
+	return AIError{
+		Code:      ErrCodeBudgetSuspended,
+		Message:   "Pre-authorized budget is suspended",
+		Retryable: false,
+		Action:    "abort",
+		Details: map[string]string{
+			"budgetId": budget.ID,
+			"reason":   budget.SuspendReason,
+		},
+	}
+}
+
 type aiResponseRecorder struct {
 	http.ResponseWriter
 	statusCode int
@@ -660,16 +1023,38 @@ func generateRequestID(r *http.Request) string {
 	return "req_" + hex.EncodeToString(h.Sum(nil))[:16]
 }
 
-func getCostForPath(path, method string, endpoints []APIEndpoint, defaultCost int64) int64 {
+// getCostForPath returns the cost of method on path: the matching
+// endpoint's cost (HEAD priced like GET; endpoint paths may have ServeMux
+// wildcards) or defaultCost, then any MethodPricing override
+func getCostForPath(path, method string, endpoints []APIEndpoint, pricing MethodPricing, defaultCost int64) int64 {
+	cost, found := defaultCost, false
 	for _, ep := range endpoints {
-		if ep.Path == path && ep.Method == method {
-			return ep.Cost
+		if ep.matches(method, path) {
+			cost, found = ep.Cost, true
+			break
+		}
+	}
+	if !found && method == http.MethodHead {
+		for _, ep := range endpoints {
+			if ep.matches(http.MethodGet, path) {
+				cost = ep.Cost
+				break
+			}
 		}
 	}
-	return defaultCost
+	return pricing.Price(method, path, cost)
 }
 
-func sendAIError(w http.ResponseWriter, requestID string, start time.Time, err AIError) {
+// sendAIError writes err as an AIResponse; payment errors are 402s with the
+// standard payment headers for realm
+func sendAIError(w http.ResponseWriter, realm, requestID string, start time.Time, err AIError) {
+	// Payment instructions without a deadline get the default one
+	if err.PaymentInfo != nil && err.PaymentInfo.ExpiresAt == 0 {
+		info := *err.PaymentInfo
+		info.ExpiresAt = paymentDeadline(time.Now(), 0).Unix()
+		err.PaymentInfo = &info
+	}
+
 	response := AIResponse{
 		Success: false,
 		Error:   &err,
@@ -683,8 +1068,11 @@ func sendAIError(w http.ResponseWriter, requestID string, start time.Time, err A
 	w.Header().Set("Content-Type", "application/json")
 
 	switch err.Code {
-	case ErrCodePaymentRequired, ErrCodeInsufficientBudget:
+	case ErrCodePaymentRequired, ErrCodeInsufficientBudget, ErrCodeInvalidPayment:
+		setPaymentRequiredHeaders(w, realm, []string{"exact"}, nil)
 		w.WriteHeader(http.StatusPaymentRequired)
+	case ErrCodeBudgetSuspended:
+		w.WriteHeader(http.StatusForbidden)
 	case ErrCodeRateLimited:
 		w.WriteHeader(http.StatusTooManyRequests)
 	case ErrCodeNotFound:
@@ -700,15 +1088,19 @@ func sendAIError(w http.ResponseWriter, requestID string, start time.Time, err A
 
 // SendAISuccess sends a successful AI response
 func SendAISuccess(w http.ResponseWriter, requestID string, start time.Time, data interface{}, cost *Cost) {
+	sendAISuccess(w, AIMetadata{RequestID: requestID, Cost: cost}, start, data)
+}
+
+// sendAISuccess sends data with meta, completed with the timing and any
+// budget warning
+func sendAISuccess(w http.ResponseWriter, meta AIMetadata, start time.Time, data interface{}) {
+	meta.Timestamp = time.Now().Format(time.RFC3339)
+	meta.ProcessingMs = time.Since(start).Milliseconds()
+	meta.BudgetWarning = budgetWarningFrom(w.Header())
 	response := AIResponse{
 		Success: true,
 		Data:    data,
-		Meta: AIMetadata{
-			RequestID:    requestID,
-			Timestamp:    time.Now().Format(time.RFC3339),
-			ProcessingMs: time.Since(start).Milliseconds(),
-			Cost:         cost,
-		},
+		Meta:    meta,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -729,11 +1121,12 @@ func AIDiscoveryHandler(config AIFirstConfig) http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("X-AI-Optimized", "true")
 
+		var document interface{}
 		switch format {
 		case "openai":
 			// Return OpenAI function calling format
 			functions := GenerateOpenAIFunctions(config.Endpoints)
-			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			document = map[string]interface{}{
 				"functions": functions,
 				"payment": map[string]interface{}{
 					"protocol":        "x402",
@@ -743,12 +1136,13 @@ func AIDiscoveryHandler(config AIFirstConfig) http.HandlerFunc {
 					"preAuth":         config.EnablePreAuth,
 					"preAuthEndpoint": "/ai/budget",
 				},
-			})
+				"freeEndpoints": config.freeEndpoints(),
+			}
 
 		case "mcp":
 			// Return MCP tool format
 			tools := GenerateMCPTools(config.Endpoints)
-			response := MCPToolsResponse{
+			document = MCPToolsResponse{
 				Tools: tools,
 				PaymentInfo: MCPPaymentInfo{
 					Protocol:        "x402",
@@ -758,12 +1152,12 @@ func AIDiscoveryHandler(config AIFirstConfig) http.HandlerFunc {
 					PreAuthEndpoint: "/ai/budget",
 					SessionEndpoint: "/sessions",
 				},
+				FreeEndpoints: config.freeEndpoints(),
 			}
-			_ = json.NewEncoder(w).Encode(response)
 
 		default:
 			// Return full discovery info
-			discovery := map[string]interface{}{
+			document = map[string]interface{}{
 				"name":    "AI-First x402 API",
 				"version": "1.0",
 				"protocol": map[string]interface{}{
@@ -778,7 +1172,8 @@ func AIDiscoveryHandler(config AIFirstConfig) http.HandlerFunc {
 					"payTo":    config.PayTo,
 					"asset":    config.Asset,
 				},
-				"endpoints": config.Endpoints,
+				"endpoints":     config.Endpoints,
+				"freeEndpoints": config.freeEndpoints(),
 				"schemas": map[string]interface{}{
 					"openai": "/ai/discover?format=openai",
 					"mcp":    "/ai/discover?format=mcp",
@@ -792,25 +1187,31 @@ func AIDiscoveryHandler(config AIFirstConfig) http.HandlerFunc {
 					"batch-requests",
 				},
 			}
-			_ = json.NewEncoder(w).Encode(discovery)
 		}
+
+		config.DiscoverySigner.sign(w, document)
+		_ = json.NewEncoder(w).Encode(document)
 	}
 }
 
-// AIBudgetHandler manages pre-authorized budgets
-func AIBudgetHandler(store PreAuthStore, config AIFirstConfig) http.HandlerFunc {
+// AIBudgetHandler manages pre-authorized budgets, in the request tenant's
+// store if config has Tenants
+func AIBudgetHandler(budgets PreAuthStore, config AIFirstConfig) http.HandlerFunc {
+	closes := &budgetCloses{}
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
+		store := config.Tenants.budgetsFor(r, budgets)
 
 		switch r.Method {
 		case http.MethodPost:
 			// Create new budget
 			var req struct {
-				AgentID       string `json:"agentId"`
-				WalletAddress string `json:"walletAddress"`
-				Budget        int64  `json:"budget"`
-				PaymentProof  string `json:"paymentProof"` // x402 payment proof
-				ExpiresIn     string `json:"expiresIn"`    // e.g., "24h", "7d"
+				AgentID             string `json:"agentId"`
+				WalletAddress       string `json:"walletAddress"`
+				Budget              int64  `json:"budget"`
+				PaymentProof        string `json:"paymentProof"`        // x402 payment proof
+				ExpiresIn           string `json:"expiresIn"`           // e.g., "24h", "7d"
+				LowBalanceThreshold int64  `json:"lowBalanceThreshold"` // Warn when remaining falls to this
 			}
 			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 				http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
@@ -827,11 +1228,12 @@ func AIBudgetHandler(store PreAuthStore, config AIFirstConfig) http.HandlerFunc
 			}
 
 			budget := &PreAuthBudget{
-				AgentID:       req.AgentID,
-				WalletAddress: req.WalletAddress,
-				TotalBudget:   req.Budget,
-				Currency:      config.Currency,
-				ExpiresAt:     time.Now().Add(expiry),
+				AgentID:             req.AgentID,
+				WalletAddress:       req.WalletAddress,
+				TotalBudget:         req.Budget,
+				Currency:            config.Currency,
+				ExpiresAt:           time.Now().Add(expiry),
+				LowBalanceThreshold: req.LowBalanceThreshold,
 			}
 
 			if err := store.Create(budget); err != nil {
@@ -860,7 +1262,7 @@ func AIBudgetHandler(store PreAuthStore, config AIFirstConfig) http.HandlerFunc
 			}
 
 			if err != nil {
-				http.Error(w, `{"error":"budget not found"}`, http.StatusNotFound)
+				writeBudgetError(w, err)
 				return
 			}
 
@@ -874,23 +1276,52 @@ func AIBudgetHandler(store PreAuthStore, config AIFirstConfig) http.HandlerFunc
 				return
 			}
 
+			if closes.closed(budgetID) {
+				w.WriteHeader(http.StatusConflict)
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": ErrBudgetClosing.Error()})
+				return
+			}
 			budget, err := store.Get(budgetID)
 			if err != nil {
-				http.Error(w, `{"error":"budget not found"}`, http.StatusNotFound)
+				writeBudgetError(w, err)
 				return
 			}
 
-			// TODO: Process refund for remaining balance
+			closer := config.budgetCloser(r, budget, closes)
+			if closer == "" {
+				config.Audit.Record(r, AuditEvent{Decision: AuditRejected, Reason: "budget_close_unauthorized", Payer: r.Header.Get("X-Agent-ID"), PaymentID: budget.ID})
+				http.Error(w, `{"error":"not authorized to close this budget"}`, http.StatusForbidden)
+				return
+			}
 
-			if err := store.Delete(budgetID); err != nil {
-				http.Error(w, `{"error":"failed to delete budget"}`, http.StatusInternalServerError)
+			budget, reference, err := config.closeBudget(r.Context(), store, budgetID)
+			if errors.Is(err, ErrBudgetClosing) {
+				w.WriteHeader(http.StatusConflict)
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 				return
 			}
+			if err != nil {
+				log.Printf("x402: close budget %s: %v", budgetID, err)
+				w.WriteHeader(errorStatus(err))
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": "failed to refund and close budget"})
+				return
+			}
+			closes.remember("closed:" + budgetID)
+			config.Audit.Record(r, AuditEvent{
+				Decision:        AuditRefunded,
+				Reason:          "budget_closed",
+				Payer:           closer,
+				PresentedAmount: budget.Remaining,
+				Currency:        budget.Currency,
+				PaymentID:       budget.ID,
+				TransactionID:   reference,
+			})
 
 			_ = json.NewEncoder(w).Encode(map[string]interface{}{
-				"deleted":    true,
-				"refunded":   budget.Remaining,
-				"totalSpent": budget.TotalSpent,
+				"deleted":         true,
+				"refunded":        budget.Remaining,
+				"refundReference": reference,
+				"totalSpent":      budget.TotalSpent,
 			})
 
 		default:
@@ -898,3 +1329,13 @@ func AIBudgetHandler(store PreAuthStore, config AIFirstConfig) http.HandlerFunc
 		}
 	}
 }
+
+// writeBudgetError answers a failed budget lookup: 404 for unknown budgets,
+// otherwise the error's status
+func writeBudgetError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, `{"error":"budget not found"}`, http.StatusNotFound)
+		return
+	}
+	http.Error(w, `{"error":"failed to load budget"}`, errorStatus(err))
+}
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -154,6 +156,103 @@ func TestPreAuthStore_InsufficientBudget(t *testing.T) {
 	}
 }
 
+func TestPreAuthStore_ConcurrentGetAndDeduct(t *testing.T) {
+	store := NewInMemoryPreAuthStore()
+	budget := &PreAuthBudget{
+		AgentID:     "agent_race",
+		TotalBudget: 1000,
+		Currency:    "USDC",
+		ExpiresAt:   time.Now().Add(time.Hour),
+		Metadata:    map[string]string{"team": "search"},
+	}
+	store.Create(budget)
+
+	// 200 deductions of 10 against a budget of 1000, racing with readers
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 200; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			updated, err := store.DeductIfAvailable(budget.ID, 10)
+			if err == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+				updated.Metadata["last"] = "caller"
+			} else if err != ErrInsufficientBudget {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			got, err := store.GetByAgentID("agent_race")
+			if err != nil {
+				t.Errorf("Failed to get budget: %v", err)
+				return
+			}
+			json.Marshal(got)
+			got.Remaining = 0
+		}()
+	}
+	wg.Wait()
+
+	final, _ := store.Get(budget.ID)
+	if succeeded != 100 {
+		t.Errorf("Expected 100 deductions, got %d", succeeded)
+	}
+	if final.Remaining != 0 || final.TotalSpent != 1000 || final.RequestCount != 100 {
+		t.Errorf("Expected 0 remaining, 1000 spent, 100 requests, got %d, %d, %d",
+			final.Remaining, final.TotalSpent, final.RequestCount)
+	}
+	if _, ok := final.Metadata["last"]; ok {
+		t.Error("Expected caller changes to a returned budget not to reach the store")
+	}
+}
+
+func TestAIFirstMiddleware_ConcurrentPreAuth(t *testing.T) {
+	preAuthStore := NewInMemoryPreAuthStore()
+	preAuthStore.Create(&PreAuthBudget{
+		AgentID:     "busy_agent",
+		TotalBudget: 1000,
+		Currency:    "USDC",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	})
+
+	handler := AIFirstMiddleware(createTestHandler(), AIFirstConfig{
+		EnablePreAuth: true,
+		PreAuthStore:  preAuthStore,
+		DefaultCost:   100,
+		Endpoints:     []APIEndpoint{{Path: "/api/test", Method: "GET", Cost: 100}},
+	})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	remaining := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "/api/test", nil)
+			req.Header.Set("X-Agent-ID", "busy_agent")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code == http.StatusOK {
+				mu.Lock()
+				remaining[rr.Header().Get("X-Budget-Remaining")] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Each paid request reports the balance its own deduction left
+	if len(remaining) != 10 {
+		t.Errorf("Expected 10 distinct remaining balances, got %v", remaining)
+	}
+}
+
 func TestIdempotencyStore(t *testing.T) {
 	store := NewInMemoryIdempotencyStore()
 
@@ -571,3 +670,113 @@ func TestAIError_Structure(t *testing.T) {
 		t.Errorf("Expected payment amount 100, got %d", parsed.PaymentInfo.Amount)
 	}
 }
+
+func TestAIFirstMiddleware_RequirePayment(t *testing.T) {
+	store := NewInMemoryPreAuthStore()
+	store.Create(&PreAuthBudget{AgentID: "funded_agent", TotalBudget: 150, Currency: "USDC"})
+
+	var reached int
+	handler := AIFirstMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached++
+		w.WriteHeader(http.StatusOK)
+	}), AIFirstConfig{
+		PayTo:           "0xSeller",
+		Network:         "base",
+		Currency:        "USDC",
+		Asset:           "0xUSDC",
+		DefaultCost:     100,
+		EnablePreAuth:   true,
+		PreAuthStore:    store,
+		RequirePayment:  true,
+		PaymentVerifier: func(token string) (bool, error) { return token == "signed_proof", nil },
+		ExemptPaths:     []string{"/ai/budget"},
+	})
+	send := func(path, agent, proof string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if agent != "" {
+			req.Header.Set("X-Agent-ID", agent)
+		}
+		if proof != "" {
+			req.Header.Set("X-PAYMENT", proof)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// No budget and no proof: a structured 402 with payment instructions
+	rr := send("/api/data", "", "")
+	if rr.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402, got %d", rr.Code)
+	}
+	var resp AIResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("Expected an AIResponse, got %v", err)
+	}
+	info := resp.Error.PaymentInfo
+	if resp.Error.Code != ErrCodePaymentRequired || info == nil || info.Amount != 100 || info.PayTo != "0xSeller" || info.Asset != "0xUSDC" || !info.PreAuthAvailable {
+		t.Errorf("Unexpected 402 body %+v %+v", resp.Error, info)
+	}
+
+	if rr := send("/api/data", "", "forged"); rr.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected a refused proof to get 402, got %d", rr.Code)
+	}
+	if rr := send("/api/data", "", "signed_proof"); rr.Code != http.StatusOK || rr.Header().Get("X-Payment-Verified") != "true" {
+		t.Errorf("Expected a valid proof to be served, got %d", rr.Code)
+	}
+
+	// The budget pays until it falls short; then the proof pays
+	if rr := send("/api/data", "funded_agent", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected the budget to cover the request, got %d", rr.Code)
+	}
+	if rr := send("/api/data", "funded_agent", ""); rr.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected an exhausted budget without a proof to get 402, got %d", rr.Code)
+	}
+	if rr := send("/api/data", "funded_agent", "signed_proof"); rr.Code != http.StatusOK {
+		t.Errorf("Expected the proof to pay when the budget falls short, got %d", rr.Code)
+	}
+
+	if rr := send("/ai/budget", "", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected the exempt budget endpoint to be free, got %d", rr.Code)
+	}
+	if reached != 4 {
+		t.Errorf("Expected only paid and exempt requests to reach the handler, got %d", reached)
+	}
+}
+
+func TestAIDiscoveryHandler_ListsFreeEndpoints(t *testing.T) {
+	dynamic := NewExemptionList()
+	dynamic.AddExact("/preview")
+	config := AIFirstConfig{
+		Endpoints: []APIEndpoint{
+			{Path: "/api/data", Method: "GET", Name: "data", Cost: 100, Currency: "USDC"},
+			{Path: "/api/ping", Method: "GET", Name: "ping", Cost: 0, Currency: "USDC"},
+		},
+		ExemptPaths:       []string{"/health", "/onboarding/"},
+		DynamicExemptions: dynamic,
+		MethodPricing:     MethodPricing{{Path: "/api/items", FreeMethods: []string{"get"}}},
+		DefaultCost:       100,
+	}
+	want := []FreeEndpoint{
+		{Path: "/health", Prefix: true, Reason: FreeReasonExempt},
+		{Path: "/onboarding/", Prefix: true, Reason: FreeReasonExempt},
+		{Path: "/preview", Reason: FreeReasonExempt},
+		{Path: "/api/items", Method: "GET", Prefix: true, Reason: FreeReasonMethod},
+		{Path: "/api/ping", Method: "GET", Reason: FreeReasonZeroPrice},
+	}
+
+	for _, format := range []string{"", "openai", "mcp"} {
+		rr := httptest.NewRecorder()
+		AIDiscoveryHandler(config).ServeHTTP(rr, httptest.NewRequest("GET", "/ai/discover?format="+format, nil))
+
+		var response struct {
+			FreeEndpoints []FreeEndpoint `json:"freeEndpoints"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to parse the %q format: %v", format, err)
+		}
+		if !reflect.DeepEqual(response.FreeEndpoints, want) {
+			t.Errorf("Format %q: expected free endpoints %+v, got %+v", format, want, response.FreeEndpoints)
+		}
+	}
+}
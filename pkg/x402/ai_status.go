@@ -0,0 +1,88 @@
+// Package x402 - Agent Status
+// An agent paying from a pre-authorized budget or a session wants to know
+// what is left without scraping headers. The middleware that charged the
+// request puts the budget or session status in its context, and
+// SendAISuccessFor reports it in the response metadata. The X-Budget-* and
+// X-Session-* headers carry the same values.
+package x402
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// BudgetStatus is the pre-authorized budget a request was charged to
+type BudgetStatus struct {
+	ID         string `json:"id"`
+	Remaining  int64  `json:"remaining"`
+	TotalSpent int64  `json:"totalSpent"`
+	Currency   string `json:"currency,omitempty"`
+}
+
+// SessionStatus is the session a request was served under
+type SessionStatus struct {
+	ID                string    `json:"id"`
+	Type              string    `json:"type"`
+	RemainingRequests *int64    `json:"remainingRequests,omitempty"` // Request-based sessions
+	RemainingSeconds  int64     `json:"remainingSeconds"`
+	ExpiresAt         time.Time `json:"expiresAt"`
+}
+
+type budgetStatusKey struct{}
+type sessionStatusKey struct{}
+
+// withBudgetStatus records on r the budget (as returned by the store) that
+// paid for it
+func withBudgetStatus(r *http.Request, budget *PreAuthBudget) *http.Request {
+	status := &BudgetStatus{
+		ID:         budget.ID,
+		Remaining:  budget.Remaining,
+		TotalSpent: budget.TotalSpent,
+		Currency:   budget.Currency,
+	}
+	return r.WithContext(context.WithValue(r.Context(), budgetStatusKey{}, status))
+}
+
+// withSessionStatus records on r the session (as counted) it is served under
+func withSessionStatus(r *http.Request, session *Session) *http.Request {
+	status := &SessionStatus{
+		ID:               session.ID,
+		Type:             string(session.SessionType),
+		RemainingSeconds: int64(time.Until(session.ExpiresAt).Seconds()),
+		ExpiresAt:        session.ExpiresAt,
+	}
+	if status.RemainingSeconds < 0 {
+		status.RemainingSeconds = 0
+	}
+	if session.SessionType == SessionTypeRequests {
+		remaining := session.MaxRequests - session.UsedRequests
+		status.RemainingRequests = &remaining
+	}
+	return r.WithContext(context.WithValue(r.Context(), sessionStatusKey{}, status))
+}
+
+// BudgetStatusFrom returns the budget AIFirstMiddleware or
+// AIAgentPaymentMiddleware charged r to, or nil
+func BudgetStatusFrom(r *http.Request) *BudgetStatus {
+	status, _ := r.Context().Value(budgetStatusKey{}).(*BudgetStatus)
+	return status
+}
+
+// SessionStatusFrom returns the session SessionMiddleware served r under, or
+// nil
+func SessionStatusFrom(r *http.Request) *SessionStatus {
+	status, _ := r.Context().Value(sessionStatusKey{}).(*SessionStatus)
+	return status
+}
+
+// SendAISuccessFor is SendAISuccess for r, reporting the budget or session
+// that paid for it in the metadata
+func SendAISuccessFor(w http.ResponseWriter, r *http.Request, requestID string, start time.Time, data interface{}, cost *Cost) {
+	sendAISuccess(w, AIMetadata{
+		RequestID: requestID,
+		Cost:      cost,
+		Budget:    BudgetStatusFrom(r),
+		Session:   SessionStatusFrom(r),
+	}, start, data)
+}
@@ -0,0 +1,85 @@
+package x402
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// statusHandler answers with SendAISuccessFor
+var statusHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	SendAISuccessFor(w, r, "req_1", time.Now(), map[string]string{"ok": "yes"}, &Cost{Amount: 100, Currency: "USD"})
+})
+
+func TestAIMetadata_BudgetMatchesHeaders(t *testing.T) {
+	store := NewInMemoryPreAuthStore()
+	store.Create(&PreAuthBudget{AgentID: "agent-1", TotalBudget: 1000, Currency: "USD"})
+	budget, _ := store.GetByAgentID("agent-1")
+	handler := AIFirstMiddleware(statusHandler, AIFirstConfig{
+		PreAuthStore:  store,
+		EnablePreAuth: true,
+		DefaultCost:   100,
+		Currency:      "USD",
+	})
+
+	for i := 1; i <= 2; i++ {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-Agent-ID", "agent-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		var resp AIResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		status := resp.Meta.Budget
+		if status == nil || status.ID != budget.ID || status.TotalSpent != int64(100*i) || status.Currency != "USD" {
+			t.Fatalf("Expected the budget in meta, got %+v", status)
+		}
+		if header := w.Header().Get("X-Budget-Remaining"); header != strconv.FormatInt(status.Remaining, 10) || status.Remaining != 1000-int64(100*i) {
+			t.Errorf("Expected meta remaining %d to match X-Budget-Remaining %s", status.Remaining, header)
+		}
+		if resp.Meta.Session != nil {
+			t.Errorf("Expected no session, got %+v", resp.Meta.Session)
+		}
+	}
+
+	// Unpaid requests report no budget
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+	var resp AIResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Meta.Budget != nil || w.Header().Get("X-Budget-Remaining") != "" {
+		t.Errorf("Expected no budget for an unpaid request, got %+v", resp.Meta.Budget)
+	}
+}
+
+func TestAIMetadata_SessionMatchesHeaders(t *testing.T) {
+	store := NewInMemorySessionStore()
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	store.CreateSession(&Session{ID: "sess-1", SessionType: SessionTypeRequests, MaxRequests: 5, ExpiresAt: expires})
+	handler := SessionMiddleware(statusHandler, SessionConfig{Store: store})
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-Session-ID", "sess-1")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var resp AIResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	status := resp.Meta.Session
+	if status == nil || status.ID != "sess-1" || status.RemainingRequests == nil || !status.ExpiresAt.Equal(expires) {
+		t.Fatalf("Expected the session in meta, got %+v", status)
+	}
+	if header := w.Header().Get("X-Session-Remaining"); header != strconv.FormatInt(*status.RemainingRequests, 10)+" requests" || *status.RemainingRequests != 4 {
+		t.Errorf("Expected meta remaining %d to match X-Session-Remaining %q", *status.RemainingRequests, header)
+	}
+	if header := w.Header().Get("X-Session-Expires"); header != status.ExpiresAt.Format(time.RFC3339) {
+		t.Errorf("Expected meta expiry to match X-Session-Expires %q", header)
+	}
+}
@@ -0,0 +1,192 @@
+// Package x402 - Multiple Assets
+// Config.Asset names a single token, but a seller may take several on one
+// network (USDC and DAI on Base). AcceptedAssets lists them per network; each
+// becomes its own accepts entry, priced in that token's decimals, and a
+// payment is verified against the entry for the asset it claims. Stablecoins
+// are taken at par with the configured currency.
+package x402
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// AssetRef identifies a token accepted on a network. Contract and Decimals
+// may be left empty for tokens in the built-in registry (see LookupAsset).
+type AssetRef struct {
+	Symbol   string `json:"symbol"`
+	Contract string `json:"contract"`
+	Decimals int    `json:"decimals"`
+}
+
+// knownAssets are token contracts by CAIP-2 network and symbol
+var knownAssets = map[NetworkType]map[string]string{
+	NetworkBaseMainnet: {
+		"USDC": "0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913",
+		"DAI":  "0x50c5725949A6F0c72E6C4a641F24049A917DB0Cb",
+	},
+	NetworkBaseSepolia: {
+		"USDC": "0x036CbD53842c5426634e7929541eC2318f3dCF7e",
+	},
+	NetworkEthereumMainnet: {
+		"USDC": "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48",
+		"USDT": "0xdAC17F958D2ee523a2206206994597C13D831ec7",
+		"DAI":  "0x6B175474E89094C44Da98b954EedeAC495271d0F",
+	},
+}
+
+// LookupAsset returns the registry entry for symbol on network, which may be
+// given by name ("base") or in CAIP-2 form
+func LookupAsset(network NetworkType, symbol string) (AssetRef, bool) {
+	symbol = strings.ToUpper(symbol)
+	contract, ok := knownAssets[canonicalEVMNetwork(string(network))][symbol]
+	if !ok {
+		return AssetRef{}, false
+	}
+	return AssetRef{Symbol: symbol, Contract: contract, Decimals: tokenDecimals[symbol]}, true
+}
+
+// resolve fills in Contract and Decimals from the registry
+func (a AssetRef) resolve(network NetworkType) (AssetRef, error) {
+	if a.Symbol == "" {
+		return a, fmt.Errorf("x402: asset %s on %s needs a Symbol", a.Contract, network)
+	}
+	known, ok := LookupAsset(network, a.Symbol)
+	if a.Contract == "" {
+		if !ok {
+			return a, fmt.Errorf("x402: no contract for asset %q on %s", a.Symbol, network)
+		}
+		a.Contract = known.Contract
+	}
+	if a.Decimals == 0 {
+		decimals, ok := tokenDecimals[strings.ToUpper(a.Symbol)]
+		if !ok {
+			return a, fmt.Errorf("x402: Decimals required for asset %q on %s", a.Symbol, network)
+		}
+		a.Decimals = decimals
+	}
+	return a, nil
+}
+
+// matches reports whether claim, a contract or symbol from a payload, names a
+func (a AssetRef) matches(claim string) bool {
+	return strings.EqualFold(claim, a.Contract) || strings.EqualFold(claim, a.Symbol)
+}
+
+// extra describes the asset in a requirement's Extra
+func (a AssetRef) extra() map[string]interface{} {
+	return map[string]interface{}{
+		"symbol":   a.Symbol,
+		"decimals": a.Decimals,
+	}
+}
+
+// validateAcceptedAssets reports assets that cannot be resolved
+func validateAcceptedAssets(assets map[NetworkType][]AssetRef) error {
+	for network, refs := range assets {
+		for _, ref := range refs {
+			if _, err := ref.resolve(network); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// acceptedAssets returns the resolved assets accepted on network, in declared
+// order, or nil if it accepts only the default asset
+func acceptedAssets(assets map[NetworkType][]AssetRef, network NetworkType) []AssetRef {
+	refs, ok := networkEntry(assets, network)
+	if !ok {
+		return nil
+	}
+	resolved := make([]AssetRef, 0, len(refs))
+	for _, ref := range refs {
+		if ref, err := ref.resolve(network); err == nil {
+			resolved = append(resolved, ref)
+		}
+	}
+	return resolved
+}
+
+// claimedAsset returns the asset a payload claims. A payload that names no
+// asset is taken to mean the only one, if there is just one.
+func claimedAsset(assets []AssetRef, claim string) (AssetRef, bool) {
+	if claim == "" {
+		if len(assets) == 1 {
+			return assets[0], true
+		}
+		return AssetRef{}, false
+	}
+	for _, asset := range assets {
+		if asset.matches(claim) {
+			return asset, true
+		}
+	}
+	return AssetRef{}, false
+}
+
+// scaleAmount converts amount from one number of decimals to another,
+// rounding up so a price is never undercharged
+func scaleAmount(amount int64, from, to int) *big.Int {
+	scaled := big.NewInt(amount)
+	if to >= from {
+		return scaled.Mul(scaled, pow10(to-from))
+	}
+	divisor := pow10(from - to)
+	quotient, remainder := new(big.Int).QuoRem(scaled, divisor, new(big.Int))
+	if remainder.Sign() > 0 {
+		quotient.Add(quotient, big.NewInt(1))
+	}
+	return quotient
+}
+
+// assetOptions lists one unified option and accepts entry per asset offered
+// on network through rail. amount is the crypto price in CryptoDecimals.
+// Options whose amount does not fit an int64 (large prices in 18-decimal
+// tokens) are left out.
+func (c UnifiedPaymentConfig) assetOptions(rail PaymentRail, network NetworkType, assets []AssetRef, amount int64, resource string, maxTimeout int, expiresAt int64) ([]PaymentOption, []PaymentRequirements) {
+	var options []PaymentOption
+	var accepts []PaymentRequirements
+	domainName, domainVersion, chainID := getEIP712DomainInfo(network)
+	for _, asset := range assets {
+		scaled := scaleAmount(amount, c.cryptoDecimals(), asset.Decimals)
+		if !scaled.IsInt64() {
+			continue
+		}
+		options = append(options, PaymentOption{
+			Rail:         RailEVMCrypto,
+			DisplayName:  fmt.Sprintf("Pay with %s (%s)", asset.Symbol, networkDisplayName(network)),
+			Type:         RailTypeCrypto,
+			Scheme:       c.CryptoScheme,
+			Network:      string(network),
+			Amount:       scaled.Int64(),
+			Currency:     asset.Symbol,
+			PayTo:        c.CryptoPayTo,
+			Asset:        asset.Contract,
+			EstimatedFee: estimateFee(rail, scaled.Int64(), asset.Symbol), // Gas paid by sender
+		})
+
+		// The EIP-712 domain hints describe USDC only
+		extra := asset.extra()
+		extra["chainId"] = chainID
+		if asset.Symbol == "USDC" {
+			extra["name"] = domainName
+			extra["version"] = domainVersion
+		}
+		accepts = append(accepts, PaymentRequirements{
+			Scheme:            c.CryptoScheme,
+			Network:           string(network),
+			MaxAmountRequired: scaled.String(),
+			Resource:          resource,
+			Description:       c.Description,
+			PayTo:             c.CryptoPayTo,
+			MaxTimeoutSeconds: maxTimeout,
+			Asset:             asset.Contract,
+			ExpiresAt:         expiresAt,
+			Extra:             extra,
+		})
+	}
+	return options, accepts
+}
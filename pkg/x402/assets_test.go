@@ -0,0 +1,157 @@
+package x402
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	baseUSDC = "0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913"
+	baseDAI  = "0x50c5725949A6F0c72E6C4a641F24049A917DB0Cb"
+)
+
+// assetScheme accepts a payment only if it was verified against the DAI entry
+type assetScheme struct {
+	verified []PaymentRequirements
+}
+
+func (s *assetScheme) Type() SchemeType                 { return SchemeExact }
+func (s *assetScheme) SupportedNetworks() []NetworkType { return []NetworkType{NetworkBaseMainnet} }
+
+func (s *assetScheme) Verify(ctx context.Context, payload *PaymentPayload, requirements *PaymentRequirements) (*VerificationResult, error) {
+	s.verified = append(s.verified, *requirements)
+	valid := requirements.Asset == baseDAI && requirements.MaxAmountRequired == "10000000000000000"
+	return &VerificationResult{Valid: valid, Network: payload.Network}, nil
+}
+
+func (s *assetScheme) Settle(ctx context.Context, payload *PaymentPayload, requirements *PaymentRequirements) (*SettlementResult, error) {
+	return &SettlementResult{Success: true}, nil
+}
+
+func assetTestConfig(scheme PaymentScheme) MultiSchemeConfig {
+	registry := NewSchemeRegistry()
+	registry.Register(scheme)
+	return MultiSchemeConfig{
+		Config: Config{
+			PayTo:           "0xseller",
+			PricePerRequest: 10000, // 0.01 USDC
+			Currency:        "USDC",
+		},
+		AcceptedSchemes:  []SchemeType{SchemeExact},
+		AcceptedNetworks: []NetworkType{NetworkBaseMainnet},
+		AcceptedAssets: map[NetworkType][]AssetRef{
+			"base": {{Symbol: "USDC"}, {Symbol: "DAI"}},
+		},
+		SchemeRegistry: registry,
+	}
+}
+
+func TestMultiSchemeConfig_AcceptedAssets(t *testing.T) {
+	config := assetTestConfig(&assetScheme{})
+	requirements := config.BuildMultiSchemeRequirements("/api/test")
+
+	if len(requirements) != 2 {
+		t.Fatalf("Expected two accepts entries for Base, got %d", len(requirements))
+	}
+	if requirements[0].Asset != baseUSDC || requirements[0].MaxAmountRequired != "10000" {
+		t.Errorf("Expected USDC first at 10000, got %s at %s", requirements[0].Asset, requirements[0].MaxAmountRequired)
+	}
+	if requirements[1].Asset != baseDAI || requirements[1].MaxAmountRequired != "10000000000000000" {
+		t.Errorf("Expected DAI at 18 decimals, got %s at %s", requirements[1].Asset, requirements[1].MaxAmountRequired)
+	}
+	if requirements[1].Extra["symbol"] != "DAI" || requirements[1].Extra["decimals"] != 18 {
+		t.Errorf("Expected the DAI symbol and decimals in extra, got %v", requirements[1].Extra)
+	}
+}
+
+func TestMultiSchemeMiddleware_VerifiesClaimedAsset(t *testing.T) {
+	scheme := &assetScheme{}
+	handler := MultiSchemeMiddleware(createTestHandler(), assetTestConfig(scheme))
+
+	pay := func(asset string) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(PaymentPayload{Scheme: SchemeExact, Network: NetworkBaseMainnet, Payer: "0xpayer", Asset: asset})
+		req := httptest.NewRequest("GET", "/api/test", nil)
+		req.Header.Set("X-PAYMENT", base64.StdEncoding.EncodeToString(payload))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := pay("DAI"); w.Code != http.StatusOK {
+		t.Errorf("Expected the DAI payment to verify, got %d", w.Code)
+	}
+	if w := pay(baseUSDC); w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected a USDC payment to be checked against the USDC entry and refused, got %d", w.Code)
+	}
+	if len(scheme.verified) != 2 || scheme.verified[0].Asset != baseDAI || scheme.verified[1].Asset != baseUSDC {
+		t.Errorf("Expected each payment verified against its own asset, got %+v", scheme.verified)
+	}
+
+	// Unaccepted or ambiguous assets are refused before verification
+	for _, asset := range []string{"USDT", ""} {
+		w := pay(asset)
+		var response PaymentRequiredResponse
+		json.NewDecoder(w.Body).Decode(&response)
+		if w.Code != http.StatusPaymentRequired || !strings.HasPrefix(response.Error, "Payment currency does not match") {
+			t.Errorf("Asset %q: expected a currency mismatch 402, got %d %q", asset, w.Code, response.Error)
+		}
+	}
+	if len(scheme.verified) != 2 {
+		t.Errorf("Expected no further verification, got %d", len(scheme.verified))
+	}
+}
+
+func TestMultiSchemeMiddleware_RejectsUnknownAsset(t *testing.T) {
+	config := assetTestConfig(&assetScheme{})
+	config.AcceptedAssets = map[NetworkType][]AssetRef{NetworkBaseMainnet: {{Symbol: "WIDGET"}}}
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for an asset with no contract")
+		}
+	}()
+	MultiSchemeMiddleware(createTestHandler(), config)
+}
+
+func TestUnifiedPaymentOptions_AssetSymbols(t *testing.T) {
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		PricePerRequest: 10000,
+		Currency:        "USD",
+		CryptoEnabled:   true,
+		CryptoPayTo:     "0xseller",
+		CryptoAsset:     baseUSDC,
+		CryptoScheme:    "exact",
+		CryptoNetworks:  []NetworkType{NetworkBaseMainnet, NetworkBaseSepolia},
+		CryptoAssets: map[NetworkType][]AssetRef{
+			NetworkBaseMainnet: {{Symbol: "USDC"}, {Symbol: "DAI"}},
+		},
+		RailRegistry: NewRailRegistry(),
+	})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/test", nil))
+
+	var response PaymentOptionsResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Invalid 402 body: %v", err)
+	}
+	var names []string
+	for _, option := range response.Options {
+		names = append(names, option.DisplayName)
+	}
+	want := []string{"Pay with USDC (Base)", "Pay with DAI (Base)", "Pay with Crypto (Base Sepolia)"}
+	if len(names) != len(want) {
+		t.Fatalf("Expected options %v, got %v", want, names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("Expected option %d to be %q, got %q", i, want[i], names[i])
+		}
+	}
+	if response.Options[1].Amount != 10000000000000000 || response.Accepts[1].Asset != baseDAI {
+		t.Errorf("Expected DAI at 18 decimals, got %d on %s", response.Options[1].Amount, response.Accepts[1].Asset)
+	}
+}
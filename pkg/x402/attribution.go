@@ -0,0 +1,68 @@
+// Package x402 - Free With Attribution
+// Endpoints priced at zero still go through the x402 handshake, so agents
+// register and the seller learns who uses them. A zero-priced request needs
+// an attribution: an unsigned X-PAYMENT payload naming the payer, or an
+// X-Payer-Address or X-Agent-ID header. Without one it gets a 402 asking for
+// it; with one it is served and metered at amount 0. Config.AllowAnonymousFree
+// serves anonymous requests too.
+package x402
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// PaymentMethodAttribution is the X-Payment-Method of zero-priced requests
+// served on an attribution
+const PaymentMethodAttribution = "attribution"
+
+// attributionRequired is the 402 error sent to anonymous zero-priced requests
+const attributionRequired = "This resource is free with attribution: send an X-PAYMENT payload naming the payer, or an X-Agent-ID header"
+
+// attribution names who a zero-priced request is from, or "" if it is
+// anonymous. Payloads aren't verified: nothing is charged.
+func attribution(r *http.Request, token string, maxBytes int) string {
+	if token != "" {
+		if payload, err := parsePaymentPayload(token, maxBytes); err == nil && payload.Payer != "" {
+			return payload.Payer
+		}
+	}
+	if payer := r.Header.Get("X-Payer-Address"); payer != "" {
+		return payer
+	}
+	if agent := r.Header.Get("X-Agent-ID"); agent != "" {
+		return "agent:" + agent
+	}
+	return ""
+}
+
+// serveAttributed serves a zero-priced request with next and reports true,
+// or reports false for an anonymous request config doesn't allow
+func serveAttributed(w http.ResponseWriter, r *http.Request, config Config, next http.Handler) bool {
+	payer := attribution(r, extractPaymentToken(r, config), config.MaxProofBytes)
+	if payer == "" && !config.AllowAnonymousFree {
+		return false
+	}
+
+	method := PaymentMethodAttribution
+	if payer == "" {
+		method = PaymentMethodFree
+	}
+	config.Audit.Record(r, AuditEvent{Decision: AuditFree, Reason: method, Payer: payer})
+	w.Header().Set("X-Payment-Method", method)
+
+	// Metering records the attributed payer with amount 0
+	info, r := paymentInfoFor(r)
+	info.Payer = payer
+	config.PayerHeaders.set(r, GatewayClaims{Rail: method, Payer: payer, Resource: redactedRequestURI(r.URL), Timestamp: config.clock().Unix()})
+	next.ServeHTTP(w, r)
+	return true
+}
+
+// priceDescription describes a price in 402 requirements
+func priceDescription(price int64, currency string) string {
+	if price == 0 {
+		return "Free with attribution: identify yourself with a payer address or agent ID"
+	}
+	return fmt.Sprintf("Payment of %d %s required", price, currency)
+}
@@ -0,0 +1,116 @@
+package x402
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func freeHandler(config Config) (http.Handler, *InMemoryMeteringStore) {
+	store := NewInMemoryMeteringStore(0, "USD")
+	return MeteringMiddleware(Middleware(createTestHandler(), config), MeteringConfig{
+		Store:           store,
+		Currency:        "USD",
+		PricePerRequest: config.PricePerRequest,
+	}), store
+}
+
+func TestFree_RejectsAnonymousRequests(t *testing.T) {
+	config := testConfig()
+	config.PricePerRequest = 0
+	handler, _ := freeHandler(config)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402 for an anonymous request, got %d", w.Code)
+	}
+
+	var response PaymentRequiredResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if response.Error != attributionRequired {
+		t.Errorf("Expected the attribution to be asked for, got %q", response.Error)
+	}
+	if len(response.Accepts) != 1 || response.Accepts[0].MaxAmountRequired != "0" || response.Accepts[0].Description != priceDescription(0, "USD") {
+		t.Errorf("Expected a free requirement, got %+v", response.Accepts)
+	}
+}
+
+func TestFree_ServesAttributedRequests(t *testing.T) {
+	config := testConfig()
+	config.PricePerRequest = 0
+	config.TestMode = false
+	config.PaymentVerifier = func(token string) (bool, error) {
+		t.Error("Expected attributions not to be verified")
+		return false, nil
+	}
+	handler, store := freeHandler(config)
+
+	// An unsigned payload naming the payer is enough
+	payload, _ := json.Marshal(PaymentPayload{Scheme: "exact", Network: "base-sepolia", Payer: "0xagent"})
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-PAYMENT", base64.StdEncoding.EncodeToString(payload))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("X-Payment-Method") != PaymentMethodAttribution {
+		t.Fatalf("Expected the attributed request served, got %d %q", w.Code, w.Header().Get("X-Payment-Method"))
+	}
+
+	// So is an agent ID
+	req = httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-Agent-ID", "agent-7")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the agent's request served, got %d", w.Code)
+	}
+
+	report, _ := store.GetMetrics(MetricsFilter{})
+	if report.TotalRequests != 2 || report.TotalRevenue != 0 {
+		t.Errorf("Expected 2 requests metered at 0, got %d for %d", report.TotalRequests, report.TotalRevenue)
+	}
+	payers := map[string]bool{}
+	for _, payer := range report.TopPayers {
+		payers[payer.PayerID] = true
+	}
+	if !payers["0xagent"] || !payers["agent:agent-7"] {
+		t.Errorf("Expected both callers attributed, got %+v", report.TopPayers)
+	}
+}
+
+func TestFree_AllowAnonymousFree(t *testing.T) {
+	config := testConfig()
+	config.PricePerRequest = 0
+	config.AllowAnonymousFree = true
+	handler, store := freeHandler(config)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+	if w.Code != http.StatusOK || w.Header().Get("X-Payment-Method") != PaymentMethodFree {
+		t.Errorf("Expected the anonymous request served free, got %d %q", w.Code, w.Header().Get("X-Payment-Method"))
+	}
+	if report, _ := store.GetMetrics(MetricsFilter{}); report.TotalRequests != 1 || report.TotalRevenue != 0 {
+		t.Errorf("Expected 1 request metered at 0, got %d for %d", report.TotalRequests, report.TotalRevenue)
+	}
+}
+
+func TestFree_MultiSchemeRejectsAnonymousRequests(t *testing.T) {
+	config := MultiSchemeConfig{Config: Config{PayTo: "0xseller", Currency: "USDC"}, SchemeRegistry: NewSchemeRegistry()}
+	handler := MultiSchemeMiddleware(createTestHandler(), config)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 for an anonymous request, got %d", w.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-Payer-Address", "0xagent")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the attributed request served, got %d", w.Code)
+	}
+}
@@ -0,0 +1,304 @@
+// Package x402 - Audit Log
+// Compliance needs an append-only record of every payment decision: what was
+// presented, what was required, why it was accepted or refused and who paid.
+// The middlewares report each decision to an AuditLog, which hashes payment
+// payloads (they are bearer credentials), applies redaction and writes the
+// event to an AuditSink such as a size-rotated JSON-lines file.
+package x402
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit decisions
+const (
+	AuditPaymentRequired = "payment_required" // A 402 was issued
+	AuditVerified        = "verified"         // A payment was accepted
+	AuditRejected        = "rejected"         // A payment (or payer) was refused
+	AuditCaptured        = "captured"         // A verified payment was captured
+	AuditRefunded        = "refunded"         // A payment was refunded
+	AuditExempt          = "exempt"           // The request needed no payment
+	AuditFree            = "free"             // The request was granted for free
+	AuditFailOpen        = "fail_open"        // A timed-out payment was served anyway
+	AuditSuspended       = "suspended"        // A pre-authorized budget was suspended
+	AuditResumed         = "resumed"          // A suspended budget was resumed
+)
+
+// AuditEvent is one payment decision
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Decision string    `json:"decision"`
+	Method   string    `json:"method"`
+	Resource string    `json:"resource"`
+	ClientIP string    `json:"clientIp,omitempty"`
+
+	// Reason explains the decision (a FailureReason, exemption kind or
+	// free grant kind)
+	Reason string       `json:"reason,omitempty"`
+	Stage  FailureStage `json:"stage,omitempty"`
+
+	Rail  string `json:"rail,omitempty"`
+	Payer string `json:"payer,omitempty"`
+
+	// RequiredAmount is the price in PricePerRequest units; Required lists
+	// per-rail amounts when the rails quote in different units
+	RequiredAmount  int64            `json:"requiredAmount,omitempty"`
+	Required        map[string]int64 `json:"required,omitempty"`
+	PresentedAmount int64            `json:"presentedAmount,omitempty"`
+	Currency        string           `json:"currency,omitempty"`
+
+	// PayloadHash is the SHA-256 of the presented proof, never the proof
+	PayloadHash string `json:"payloadHash,omitempty"`
+
+	PaymentID     string            `json:"paymentId,omitempty"`
+	TransactionID string            `json:"transactionId,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+}
+
+// AuditSink stores audit events
+type AuditSink interface {
+	Write(event AuditEvent) error
+}
+
+// AuditLog reports payment decisions to Sink
+type AuditLog struct {
+	Sink AuditSink
+
+	// RedactFields replaces these event fields with [REDACTED] before they
+	// are written: "payer", "clientIp", "paymentId", "transactionId", any
+	// Metadata key, or "query" to drop query strings from resources
+	RedactFields []string
+
+	// TrustedProxies decide when X-Forwarded-For is believed for ClientIP
+	TrustedProxies []*net.IPNet
+
+	// now is stubbed in tests
+	now func() time.Time
+}
+
+// Record writes event, filling in the time and request details and applying
+// redaction. Write failures are logged; they never fail the request.
+func (a *AuditLog) Record(r *http.Request, event AuditEvent) {
+	if a == nil || a.Sink == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	if a.now != nil {
+		event.Time = a.now().UTC()
+	}
+	if r != nil {
+		event.Method = r.Method
+		event.Resource = redactedRequestURI(r.URL)
+		event.ClientIP = ClientIPFromRequest(r, a.TrustedProxies)
+	}
+	a.redact(&event)
+	if err := a.Sink.Write(event); err != nil {
+		log.Printf("x402: audit write failed: %v", err)
+	}
+}
+
+// redact applies RedactFields to event
+func (a *AuditLog) redact(event *AuditEvent) {
+	for _, field := range a.RedactFields {
+		switch field {
+		case "payer":
+			redactField(&event.Payer)
+		case "clientIp":
+			redactField(&event.ClientIP)
+		case "paymentId":
+			redactField(&event.PaymentID)
+		case "transactionId":
+			redactField(&event.TransactionID)
+		case "query":
+			event.Resource, _, _ = strings.Cut(event.Resource, "?")
+		default:
+			if _, ok := event.Metadata[field]; ok {
+				metadata := make(map[string]string, len(event.Metadata))
+				for k, v := range event.Metadata {
+					metadata[k] = v
+				}
+				metadata[field] = redactedValue
+				event.Metadata = metadata
+			}
+		}
+	}
+}
+
+// exemption reports why r needs no payment ("path" or "method"), or ""
+func exemption(r *http.Request, exemptPaths []string, dynamic *ExemptionList, pricing MethodPricing) string {
+	switch {
+	case isExemptPath(r.URL.Path, exemptPaths) || dynamic.IsExempt(r.URL.Path):
+		return "path"
+	case pricing.free(r):
+		return "method"
+	}
+	return ""
+}
+
+// recordFailure reports a refused payment
+func (a *AuditLog) recordFailure(r *http.Request, failure *PaymentFailure, payload string) {
+	a.Record(r, AuditEvent{
+		Decision:        AuditRejected,
+		Reason:          failure.Reason,
+		Stage:           failure.Stage,
+		Rail:            failure.Rail,
+		Payer:           failure.Payer,
+		RequiredAmount:  failure.ExpectedAmount,
+		PresentedAmount: failure.PresentedAmount,
+		PayloadHash:     hashPayload(payload),
+	})
+}
+
+// recordPaymentRequired reports a 402, after the refusal that caused it
+func (a *AuditLog) recordPaymentRequired(r *http.Request, failure *PaymentFailure, payload string, event AuditEvent) {
+	if failure != nil {
+		a.recordFailure(r, failure, payload)
+	}
+	event.Decision = AuditPaymentRequired
+	a.Record(r, event)
+}
+
+func redactField(value *string) {
+	if *value != "" {
+		*value = redactedValue
+	}
+}
+
+// hashPayload returns the audit fingerprint of a payment proof
+func hashPayload(payload string) string {
+	if payload == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(payload))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// InMemoryAuditSink keeps events in memory (for testing and development)
+type InMemoryAuditSink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+// NewInMemoryAuditSink creates an empty in-memory sink
+func NewInMemoryAuditSink() *InMemoryAuditSink {
+	return &InMemoryAuditSink{}
+}
+
+// Write appends event
+func (s *InMemoryAuditSink) Write(event AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+// Events returns the events written so far, oldest first
+func (s *InMemoryAuditSink) Events() []AuditEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]AuditEvent(nil), s.events...)
+}
+
+// FileAuditSink appends events as JSON lines to a file. When the file would
+// grow past its size limit it is renamed with a timestamp suffix and a new one is
+// started, so no event is ever rewritten.
+type FileAuditSink struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+
+	// now is stubbed in tests
+	now func() time.Time
+}
+
+// NewFileAuditSink opens (or creates) path for appending. maxBytes 0
+// disables rotation.
+func NewFileAuditSink(path string, maxBytes int64) (*FileAuditSink, error) {
+	s := &FileAuditSink{path: path, maxBytes: maxBytes}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileAuditSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("x402: open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("x402: open audit log: %w", err)
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+// Write appends event as one JSON line, rotating first if needed
+func (s *FileAuditSink) Write(event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return fmt.Errorf("x402: audit log %s is closed", s.path)
+	}
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// rotate moves the current file aside and starts a new one
+func (s *FileAuditSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	rotated := s.path + "." + now().UTC().Format("20060102T150405.000000000Z")
+	if err := os.Rename(s.path, rotated); err != nil {
+		// Keep appending to the current file rather than losing events
+		if openErr := s.open(); openErr != nil {
+			return openErr
+		}
+		return fmt.Errorf("x402: rotate audit log: %w", err)
+	}
+	return s.open()
+}
+
+// Close closes the file; later writes fail
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
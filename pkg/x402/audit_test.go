@@ -0,0 +1,145 @@
+package x402
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func auditDecisions(events []AuditEvent) string {
+	var decisions []string
+	for _, event := range events {
+		decisions = append(decisions, event.Decision)
+	}
+	return strings.Join(decisions, ",")
+}
+
+func TestAudit_PaidRequestOrdering(t *testing.T) {
+	sink := NewInMemoryAuditSink()
+	registry := NewRailRegistry()
+	registry.Register(&payerRail{EVMCryptoRail: NewEVMCryptoRail("", nil), payer: "0xPayer"})
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		PricePerRequest: 100,
+		CryptoEnabled:   true,
+		CryptoNetworks:  []NetworkType{NetworkBaseSepolia},
+		RailRegistry:    registry,
+		Audit:           &AuditLog{Sink: sink},
+	})
+
+	// Unpaid, then paid
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/data", nil))
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-PAYMENT", "secret-payload")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	events := sink.Events()
+	if got := auditDecisions(events); got != "payment_required,verified,captured" {
+		t.Fatalf("Expected payment_required,verified,captured, got %s", got)
+	}
+	verified := events[1]
+	if verified.Payer != "0xPayer" || verified.Rail != "evm-crypto" || verified.RequiredAmount != 100 || verified.Method != "GET" {
+		t.Errorf("Unexpected verified event %+v", verified)
+	}
+	if verified.PayloadHash != hashPayload("secret-payload") || strings.Contains(verified.PayloadHash, "secret") {
+		t.Errorf("Expected the payload to be hashed, got %q", verified.PayloadHash)
+	}
+	if events[0].Required["evm-crypto"] != 100 {
+		t.Errorf("Expected the 402 to record what was required, got %v", events[0].Required)
+	}
+}
+
+func TestAudit_MiddlewareDecisions(t *testing.T) {
+	sink := NewInMemoryAuditSink()
+	config := testConfig()
+	config.Audit = &AuditLog{Sink: sink}
+	handler := Middleware(createTestHandler(), config)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/public/info", nil))
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-PAYMENT", "forged")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-PAYMENT", "valid_token")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	events := sink.Events()
+	if got := auditDecisions(events); got != "exempt,rejected,payment_required,verified" {
+		t.Fatalf("Expected exempt,rejected,payment_required,verified, got %s", got)
+	}
+	if events[0].Reason != "path" {
+		t.Errorf("Expected a path exemption, got %q", events[0].Reason)
+	}
+	if events[1].Reason != FailureInvalidPayment || events[1].PayloadHash != hashPayload("forged") {
+		t.Errorf("Unexpected rejection %+v", events[1])
+	}
+}
+
+func TestAudit_Redaction(t *testing.T) {
+	sink := NewInMemoryAuditSink()
+	audit := &AuditLog{Sink: sink, RedactFields: []string{"payer", "clientIp", "query", "coupon"}}
+
+	req := httptest.NewRequest("GET", "/api/data?email=a@example.com", nil)
+	audit.Record(req, AuditEvent{Decision: AuditVerified, Payer: "0xPayer", Metadata: map[string]string{"coupon": "VIP", "tier": "gold"}})
+
+	event := sink.Events()[0]
+	if event.Payer != redactedValue || event.ClientIP != redactedValue {
+		t.Errorf("Expected payer and client IP to be redacted, got %q %q", event.Payer, event.ClientIP)
+	}
+	if event.Resource != "/api/data" {
+		t.Errorf("Expected the query to be dropped, got %q", event.Resource)
+	}
+	if event.Metadata["coupon"] != redactedValue || event.Metadata["tier"] != "gold" {
+		t.Errorf("Expected only the coupon to be redacted, got %v", event.Metadata)
+	}
+}
+
+func TestFileAuditSink_Rotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := NewFileAuditSink(path, 200)
+	if err != nil {
+		t.Fatalf("NewFileAuditSink failed: %v", err)
+	}
+	defer sink.Close()
+	tick := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	sink.now = func() time.Time {
+		tick = tick.Add(time.Second)
+		return tick
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := sink.Write(AuditEvent{Decision: AuditVerified, Resource: "/api/data", PayloadHash: hashPayload("payload")}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	files, _ := filepath.Glob(path + "*")
+	if len(files) < 2 {
+		t.Fatalf("Expected the log to rotate, got %v", files)
+	}
+	lines := 0
+	for _, name := range files {
+		f, _ := os.Open(name)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var event AuditEvent
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				t.Errorf("Expected JSON lines in %s, got %q", name, scanner.Text())
+			}
+			lines++
+		}
+		f.Close()
+		if info, _ := os.Stat(name); info.Size() > 200 {
+			t.Errorf("Expected %s to stay under 200 bytes, got %d", name, info.Size())
+		}
+	}
+	if lines != 5 {
+		t.Errorf("Expected all 5 events to be kept, got %d", lines)
+	}
+}
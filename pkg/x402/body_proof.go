@@ -0,0 +1,119 @@
+// Package x402 - Body Proofs
+// Some clients can't set custom headers (webhooks, form posts from hosted
+// tools) and send the payment proof in the JSON body instead, e.g.
+// {"x402Payment": {...}, "query": "..."}. With a BodyProof set, the payment
+// middlewares read a bounded prefix of JSON bodies for the proof field and
+// restore the body byte for byte for the handler. Bodies larger than the
+// limit are never buffered beyond it, and their proof must be in a header.
+package x402
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Body proof defaults
+const (
+	DefaultBodyProofField    = "x402Payment"
+	DefaultBodyProofMaxBytes = 64 << 10
+)
+
+// BodyProof reads payment proofs from JSON request bodies. Headers take
+// precedence over the body.
+type BodyProof struct {
+	// Field is the top-level field holding the proof (default
+	// DefaultBodyProofField): a payment payload object, or a string holding
+	// what the X-PAYMENT header would
+	Field string
+
+	// MaxBytes is the largest body inspected (default
+	// DefaultBodyProofMaxBytes). Only this much is buffered; larger bodies
+	// are passed on unread.
+	MaxBytes int64
+}
+
+type bodyProofKey struct{}
+
+func (b *BodyProof) field() string {
+	if b.Field != "" {
+		return b.Field
+	}
+	return DefaultBodyProofField
+}
+
+func (b *BodyProof) maxBytes() int64 {
+	if b.MaxBytes > 0 {
+		return b.MaxBytes
+	}
+	return DefaultBodyProofMaxBytes
+}
+
+// read returns r with any proof in its JSON body on its context and the
+// body restored, or r itself if b is nil or the body isn't inspected
+func (b *BodyProof) read(r *http.Request) *http.Request {
+	if b == nil || r.Body == nil || r.Body == http.NoBody || !jsonContent(r.Header.Get("Content-Type")) {
+		return r
+	}
+	if r.ContentLength > b.maxBytes() {
+		return r
+	}
+
+	prefix, err := io.ReadAll(io.LimitReader(r.Body, b.maxBytes()+1))
+	if err != nil || int64(len(prefix)) > b.maxBytes() {
+		// Too large to inspect: pass on what was read followed by the rest
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(prefix), r.Body), r.Body}
+		return r
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(prefix))
+
+	token := bodyProofToken(prefix, b.field())
+	if token == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), bodyProofKey{}, token))
+}
+
+// bodyProofToken is the proof in body's field, as a header would carry it
+func bodyProofToken(body []byte, field string) string {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return ""
+	}
+	raw, ok := fields[field]
+	if !ok {
+		return ""
+	}
+	var token string
+	if json.Unmarshal(raw, &token) == nil {
+		return token
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+		return base64.StdEncoding.EncodeToString(raw)
+	}
+	return ""
+}
+
+// bodyProof returns the proof BodyProof found in r's body, if any
+func bodyProof(r *http.Request) string {
+	token, _ := r.Context().Value(bodyProofKey{}).(string)
+	return token
+}
+
+// jsonContent reports whether contentType is JSON
+func jsonContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
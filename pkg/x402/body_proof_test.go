@@ -0,0 +1,95 @@
+package x402
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// echoHandler writes back the request body it received
+func echoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+}
+
+func TestBodyProof_ExtractsProofAndKeepsBody(t *testing.T) {
+	var tokens []string
+	config := testConfig()
+	config.TestMode = false
+	config.PaymentVerifier = func(token string) (bool, error) {
+		tokens = append(tokens, token)
+		return true, nil
+	}
+	config.BodyProof = &BodyProof{}
+	handler := Middleware(echoHandler(), config)
+
+	bodies := []string{
+		`{"x402Payment": "valid_token", "query": "weather"}`,
+		`{"query": "weather", "x402Payment": {"scheme": "exact", "payer": "0xagent"}}`,
+	}
+	for _, body := range bodies {
+		req := httptest.NewRequest("POST", "/api/data", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the body proof accepted, got %d", w.Code)
+		}
+		if w.Body.String() != body {
+			t.Errorf("Expected the handler to get the original body %q, got %q", body, w.Body)
+		}
+	}
+
+	payload, _ := base64.StdEncoding.DecodeString(tokens[1])
+	if tokens[0] != "valid_token" || string(payload) != `{"scheme": "exact", "payer": "0xagent"}` {
+		t.Errorf("Expected the string proof as is and the object base64-encoded, got %q", tokens)
+	}
+}
+
+func TestBodyProof_OptInAndLimits(t *testing.T) {
+	config := testConfig()
+	limited := config
+	limited.BodyProof = &BodyProof{Field: "payment", MaxBytes: 64}
+
+	tests := []struct {
+		name        string
+		config      Config
+		contentType string
+		body        string
+		want        int
+	}{
+		{"disabled", config, "application/json", `{"x402Payment": "valid_1"}`, http.StatusPaymentRequired},
+		{"custom field", limited, "application/json", `{"payment": "valid_1"}`, http.StatusOK},
+		{"not JSON", limited, "application/x-www-form-urlencoded", `{"payment": "valid_1"}`, http.StatusPaymentRequired},
+		{"too large", limited, "application/json", `{"payment": "valid_1", "data": "` + strings.Repeat("x", 64) + `"}`, http.StatusPaymentRequired},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/api/data", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", tt.contentType)
+		w := httptest.NewRecorder()
+		Middleware(echoHandler(), tt.config).ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, w.Code)
+		}
+	}
+}
+
+func TestBodyProof_LargeBodyPassedOnWhole(t *testing.T) {
+	body := `{"x402Payment": "valid_1", "data": "` + strings.Repeat("x", 1000) + `"}`
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.ContentLength = -1 // Streamed, so the limit is found by reading
+
+	req = (&BodyProof{MaxBytes: 100}).read(req)
+	if bodyProof(req) != "" {
+		t.Error("Expected a body over the limit not to be inspected")
+	}
+	if got, _ := io.ReadAll(req.Body); string(got) != body {
+		t.Errorf("Expected the whole body passed on, got %d of %d bytes", len(got), len(body))
+	}
+}
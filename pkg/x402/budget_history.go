@@ -0,0 +1,214 @@
+// Package x402 - Budget History
+// A budget used to keep only TotalSpent and RequestCount, so when an agent
+// disputed a charge there was no way to show which requests spent its
+// budget. Stores that implement BudgetHistoryStore record every deduction
+// attempt and refund alongside the balance change, under the same lock, and
+// AIBudgetHistoryHandler serves the entries newest first.
+package x402
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultBudgetHistorySize is how many entries a budget keeps by default
+const DefaultBudgetHistorySize = 100
+
+// Budget entry results
+const (
+	BudgetResultDeducted     = "deducted"            // The amount was taken from the budget
+	BudgetResultInsufficient = "insufficient_budget" // The budget could not cover the amount
+	BudgetResultSuspended    = "suspended"           // The budget was suspended
+	BudgetResultRefunded     = "refunded"            // The amount was returned to the budget
+)
+
+// BudgetEntry is one deduction attempt or refund against a budget
+type BudgetEntry struct {
+	// Seq orders a budget's entries; later entries have larger Seq
+	Seq       int64     `json:"seq"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// Amount is what the request cost, negative for refunds. Only
+	// deducted and refunded entries changed the balance.
+	Amount    int64  `json:"amount"`
+	Resource  string `json:"resource,omitempty"` // e.g. "GET /api/data"
+	RequestID string `json:"requestId,omitempty"`
+	Result    string `json:"result"`
+	Remaining int64  `json:"remaining"` // Balance after the entry
+}
+
+// BudgetHistoryStore is a PreAuthStore that keeps a bounded history per
+// budget. Deduct, DeductIfAvailable and Refund record entries too, without a
+// resource or request ID.
+type BudgetHistoryStore interface {
+	PreAuthStore
+
+	// DeductEntry is DeductIfAvailable for entry.Amount, recording entry
+	// with its result in the same step
+	DeductEntry(id string, entry BudgetEntry) (*PreAuthBudget, error)
+
+	// History returns up to limit of the budget's entries, newest first,
+	// starting after pageToken ("" for the newest). The returned token
+	// fetches the next page and is "" on the last.
+	History(id, pageToken string, limit int) ([]BudgetEntry, string, error)
+}
+
+// budgetEntry describes the request r, known to clients as requestID
+func budgetEntry(r *http.Request, requestID string, amount int64) BudgetEntry {
+	if requestID == "" {
+		requestID = r.Header.Get("X-Request-ID")
+	}
+	return BudgetEntry{
+		Amount:    amount,
+		Resource:  r.Method + " " + r.URL.Path,
+		RequestID: requestID,
+	}
+}
+
+// deductBudget deducts amount from budget id for r, recording the request
+// in the budget's history if the store keeps one
+func deductBudget(store PreAuthStore, id string, amount int64, r *http.Request, requestID string) (*PreAuthBudget, error) {
+	if history, ok := store.(BudgetHistoryStore); ok {
+		return history.DeductEntry(id, budgetEntry(r, requestID, amount))
+	}
+	return store.DeductIfAvailable(id, amount)
+}
+
+// budgetResult names the outcome of a deduction that returned err
+func budgetResult(err error) string {
+	switch {
+	case errors.Is(err, ErrBudgetSuspended):
+		return BudgetResultSuspended
+	case errors.Is(err, ErrInsufficientBudget):
+		return BudgetResultInsufficient
+	}
+	return BudgetResultDeducted
+}
+
+// DeductEntry deducts entry.Amount if the budget covers it and records entry
+func (s *InMemoryPreAuthStore) DeductEntry(id string, entry BudgetEntry) (*PreAuthBudget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	budget, ok := s.budgets[id]
+	if !ok {
+		return nil, ErrBudgetNotFound
+	}
+	var err error
+	switch {
+	case budget.Suspended:
+		err = ErrBudgetSuspended
+	case budget.Remaining < entry.Amount:
+		err = ErrInsufficientBudget
+	default:
+		budget.Remaining -= entry.Amount
+		budget.TotalSpent += entry.Amount
+		budget.RequestCount++
+	}
+	entry.Result = budgetResult(err)
+	s.record(budget, entry)
+	return budget.clone(), err
+}
+
+// record appends entry to budget's history, dropping the oldest entry past
+// HistorySize. The caller holds s.mu.
+func (s *InMemoryPreAuthStore) record(budget *PreAuthBudget, entry BudgetEntry) {
+	size := s.HistorySize
+	if size <= 0 {
+		size = DefaultBudgetHistorySize
+	}
+	s.seq++
+	entry.Seq = s.seq
+	entry.Timestamp = time.Now()
+	entry.Remaining = budget.Remaining
+
+	entries := append(s.history[budget.ID], entry)
+	if len(entries) > size {
+		entries = append(entries[:0:0], entries[len(entries)-size:]...)
+	}
+	s.history[budget.ID] = entries
+}
+
+// History returns a page of the budget's entries, newest first
+func (s *InMemoryPreAuthStore) History(id, pageToken string, limit int) ([]BudgetEntry, string, error) {
+	before := int64(-1)
+	if pageToken != "" {
+		seq, err := strconv.ParseInt(pageToken, 10, 64)
+		if err != nil || seq <= 0 {
+			return nil, "", ErrInvalidPageToken
+		}
+		before = seq
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.budgets[id]; !ok {
+		return nil, "", ErrBudgetNotFound
+	}
+	entries := s.history[id]
+	limit = listLimit(limit)
+	page := make([]BudgetEntry, 0, min(limit, len(entries)))
+	for i := len(entries) - 1; i >= 0 && len(page) < limit; i-- {
+		if before < 0 || entries[i].Seq < before {
+			page = append(page, entries[i])
+		}
+	}
+	next := ""
+	if len(page) == limit && page[limit-1].Seq > entries[0].Seq {
+		next = strconv.FormatInt(page[limit-1].Seq, 10)
+	}
+	return page, next, nil
+}
+
+// AIBudgetHistoryHandler serves a budget's history, newest first:
+// GET ?id=...&limit=...&pageToken=... Stores that keep no history answer 501.
+func AIBudgetHistoryHandler(budgets PreAuthStore, config AIFirstConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+			return
+		}
+		history, ok := config.Tenants.budgetsFor(r, budgets).(BudgetHistoryStore)
+		if !ok {
+			http.Error(w, `{"error":"budget history not kept"}`, http.StatusNotImplemented)
+			return
+		}
+
+		q := r.URL.Query()
+		budgetID := q.Get("id")
+		if budgetID == "" {
+			http.Error(w, `{"error":"id required"}`, http.StatusBadRequest)
+			return
+		}
+		limit := 0
+		if value := q.Get("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				http.Error(w, `{"error":"limit must be a positive number"}`, http.StatusBadRequest)
+				return
+			}
+			limit = parsed
+		}
+
+		entries, next, err := history.History(budgetID, q.Get("pageToken"), limit)
+		switch {
+		case errors.Is(err, ErrInvalidPageToken):
+			http.Error(w, `{"error":"invalid page token"}`, http.StatusBadRequest)
+			return
+		case err != nil:
+			writeBudgetError(w, err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"budgetId":      budgetID,
+			"entries":       entries,
+			"count":         len(entries),
+			"nextPageToken": next,
+		})
+	}
+}
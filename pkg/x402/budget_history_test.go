@@ -0,0 +1,126 @@
+package x402
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type budgetHistoryPage struct {
+	Entries       []BudgetEntry `json:"entries"`
+	Count         int           `json:"count"`
+	NextPageToken string        `json:"nextPageToken"`
+}
+
+func getBudgetHistory(t *testing.T, handler http.Handler, query string) (int, budgetHistoryPage) {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/ai/budget/history?"+query, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var page budgetHistoryPage
+	json.NewDecoder(w.Body).Decode(&page)
+	return w.Code, page
+}
+
+func TestBudgetHistory_RecordsRequests(t *testing.T) {
+	store := NewInMemoryPreAuthStore()
+	budget := &PreAuthBudget{AgentID: "agent-1", TotalBudget: 250, Currency: "USD"}
+	store.Create(budget)
+	config := AIFirstConfig{PreAuthStore: store, EnablePreAuth: true, DefaultCost: 100, Currency: "USD"}
+	handler := AIFirstMiddleware(createTestHandler(), config)
+
+	var requestIDs []string
+	for _, path := range []string{"/api/a", "/api/b", "/api/c"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Agent-ID", "agent-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		requestIDs = append(requestIDs, w.Header().Get("X-Request-ID"))
+	}
+	store.Refund(budget.ID, 100)
+
+	code, page := getBudgetHistory(t, AIBudgetHistoryHandler(store, config), "id="+budget.ID)
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	want := []BudgetEntry{
+		{Amount: -100, Result: BudgetResultRefunded, Remaining: 150},
+		{Amount: 100, Resource: "GET /api/c", RequestID: requestIDs[2], Result: BudgetResultInsufficient, Remaining: 50},
+		{Amount: 100, Resource: "GET /api/b", RequestID: requestIDs[1], Result: BudgetResultDeducted, Remaining: 50},
+		{Amount: 100, Resource: "GET /api/a", RequestID: requestIDs[0], Result: BudgetResultDeducted, Remaining: 150},
+	}
+	if len(page.Entries) != len(want) {
+		t.Fatalf("Expected %d entries, got %+v", len(want), page.Entries)
+	}
+	for i, entry := range page.Entries {
+		w := want[i]
+		if entry.Amount != w.Amount || entry.Resource != w.Resource || entry.RequestID != w.RequestID ||
+			entry.Result != w.Result || entry.Remaining != w.Remaining || entry.Timestamp.IsZero() {
+			t.Errorf("Entry %d: expected %+v, got %+v", i, w, entry)
+		}
+		if i > 0 && entry.Seq >= page.Entries[i-1].Seq {
+			t.Errorf("Expected entries newest first, got seq %d after %d", entry.Seq, page.Entries[i-1].Seq)
+		}
+	}
+}
+
+func TestBudgetHistory_CapAndPages(t *testing.T) {
+	store := NewInMemoryPreAuthStore()
+	store.HistorySize = 5
+	budget := &PreAuthBudget{AgentID: "agent-1", TotalBudget: 100}
+	store.Create(budget)
+	for i := 0; i < 8; i++ {
+		store.Deduct(budget.ID, 1)
+	}
+
+	entries, next, err := store.History(budget.ID, "", 3)
+	if err != nil || len(entries) != 3 || next == "" {
+		t.Fatalf("Expected a first page of 3 with a token, got %d %q %v", len(entries), next, err)
+	}
+	if entries[0].Remaining != 92 || entries[2].Remaining != 94 {
+		t.Errorf("Expected the newest three entries, got %+v", entries)
+	}
+	rest, next, err := store.History(budget.ID, next, 3)
+	if err != nil || len(rest) != 2 || next != "" {
+		t.Fatalf("Expected the last 2 of the 5 kept entries, got %d %q %v", len(rest), next, err)
+	}
+	if rest[1].Remaining != 96 {
+		t.Errorf("Expected the oldest kept entry to leave 96, got %+v", rest[1])
+	}
+
+	store.Delete(budget.ID)
+	if _, _, err := store.History(budget.ID, "", 0); err != ErrBudgetNotFound {
+		t.Errorf("Expected %v for a deleted budget, got %v", ErrBudgetNotFound, err)
+	}
+}
+
+// historylessStore keeps no budget history
+type historylessStore struct {
+	PreAuthStore
+}
+
+func TestAIBudgetHistoryHandler_Errors(t *testing.T) {
+	store := NewInMemoryPreAuthStore()
+	budget := &PreAuthBudget{TotalBudget: 100}
+	store.Create(budget)
+	handler := AIBudgetHistoryHandler(store, AIFirstConfig{})
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		query   string
+		want    int
+	}{
+		{"no id", handler, "", http.StatusBadRequest},
+		{"unknown budget", handler, "id=budget_missing", http.StatusNotFound},
+		{"bad limit", handler, "id=" + budget.ID + "&limit=x", http.StatusBadRequest},
+		{"bad page token", handler, "id=" + budget.ID + "&pageToken=abc", http.StatusBadRequest},
+		{"no history kept", AIBudgetHistoryHandler(historylessStore{store}, AIFirstConfig{}), "id=" + budget.ID, http.StatusNotImplemented},
+	}
+	for _, tt := range tests {
+		if code, _ := getBudgetHistory(t, tt.handler, tt.query); code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, code)
+		}
+	}
+}
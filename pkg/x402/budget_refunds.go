@@ -0,0 +1,284 @@
+// Package x402 - Budget Refunds
+// Closing a pre-authorized budget returns what is left of it to the payer.
+// Only the owner (the budget's agent, signing with its wallet) or an admin
+// may close one. The budget is frozen while the refund is made and deleted
+// only once the refund has a reference, so a failed refund loses nothing.
+// Only one close of a budget runs at a time, and an owner's signature
+// closes once.
+package x402
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BudgetPaymentIDKey is the budget Metadata key naming the payment that
+// funded it, which RailRefunder refunds
+const BudgetPaymentIDKey = "paymentId"
+
+// BudgetRefunder returns amount of a closing budget to its payer and returns
+// a reference for the refund
+type BudgetRefunder interface {
+	RefundBudget(ctx context.Context, budget *PreAuthBudget, amount int64) (string, error)
+}
+
+// WalletVerifier reports whether signature is address's signature of message
+type WalletVerifier func(address, message, signature string) (bool, error)
+
+// BudgetClosingReason is the SuspendReason of a budget being closed
+const BudgetClosingReason = "closing"
+
+// BudgetCloseMaxAge is how far the timestamp of an owner's close signature
+// may be from the server's clock
+const BudgetCloseMaxAge = 5 * time.Minute
+
+// ErrBudgetClosing is returned for closing a budget that is already being
+// closed, was just closed, or is suspended
+var ErrBudgetClosing = kindOf(ErrConflict, "budget is suspended or already closing")
+
+// BudgetCloseMessage is the message a budget's wallet signs (sent as
+// X-Wallet-Signature, with X-Close-Nonce and X-Close-Timestamp) to close
+// it. nonce is any string unique to the close; timestamp is in Unix
+// seconds, within BudgetCloseMaxAge of the server's clock.
+func BudgetCloseMessage(budgetID, nonce string, timestamp int64) string {
+	return fmt.Sprintf("x402 close budget %s nonce %s at %d", budgetID, nonce, timestamp)
+}
+
+// RailRefunder refunds budgets through the rail that took the funding
+// payment, e.g. a Stripe refund of its PaymentIntent
+type RailRefunder struct {
+	Rail PaymentRail
+}
+
+// RefundBudget refunds amount of the payment named by the budget's
+// BudgetPaymentIDKey metadata
+func (r RailRefunder) RefundBudget(ctx context.Context, budget *PreAuthBudget, amount int64) (string, error) {
+	paymentID := budget.Metadata[BudgetPaymentIDKey]
+	if paymentID == "" {
+		return "", fmt.Errorf("budget %s has no funding payment to refund", budget.ID)
+	}
+	refund, err := r.Rail.RefundPayment(ctx, &RefundPaymentRequest{
+		PaymentID: paymentID,
+		Amount:    amount,
+		Reason:    "requested_by_customer",
+	})
+	if err != nil {
+		return "", err
+	}
+	return refund.RefundID, nil
+}
+
+// RefundQueueItem is a crypto refund waiting to be sent, of a budget or of
+// a ledger payment
+type RefundQueueItem struct {
+	ID            string     `json:"id"`
+	BudgetID      string     `json:"budgetId,omitempty"`
+	PaymentID     string     `json:"paymentId,omitempty"`
+	WalletAddress string     `json:"walletAddress"`
+	Amount        int64      `json:"amount"`
+	Currency      string     `json:"currency"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	SentAt        *time.Time `json:"sentAt,omitempty"`
+	Transaction   string     `json:"transaction,omitempty"`
+}
+
+// RefundQueue queues refunds to payers' wallets for an operator or payout
+// job to send on-chain, since a facilitator can't send funds back itself
+type RefundQueue struct {
+	mu    sync.Mutex
+	items []*RefundQueueItem
+}
+
+// NewRefundQueue creates an empty refund queue
+func NewRefundQueue() *RefundQueue {
+	return &RefundQueue{}
+}
+
+// RefundBudget queues amount for the budget's wallet
+func (q *RefundQueue) RefundBudget(ctx context.Context, budget *PreAuthBudget, amount int64) (string, error) {
+	if budget.WalletAddress == "" {
+		return "", fmt.Errorf("budget %s has no wallet to refund", budget.ID)
+	}
+	return q.add(&RefundQueueItem{
+		BudgetID:      budget.ID,
+		WalletAddress: budget.WalletAddress,
+		Amount:        amount,
+		Currency:      budget.Currency,
+	}), nil
+}
+
+// RefundRecord queues amount of a ledger payment for its payer's wallet
+func (q *RefundQueue) RefundRecord(ctx context.Context, record PaymentRecord, amount int64) (string, error) {
+	if record.PayerID == "" {
+		return "", fmt.Errorf("payment %s has no payer to refund", record.ID)
+	}
+	return q.add(&RefundQueueItem{
+		PaymentID:     record.ID,
+		WalletAddress: record.PayerID,
+		Amount:        amount,
+		Currency:      record.Currency,
+	}), nil
+}
+
+// add queues item and returns its new ID
+func (q *RefundQueue) add(item *RefundQueueItem) string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	item.ID = "refund_" + hex.EncodeToString(b)
+	item.CreatedAt = time.Now()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, item)
+	return item.ID
+}
+
+// Pending returns the refunds not yet sent, oldest first
+func (q *RefundQueue) Pending() []RefundQueueItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var pending []RefundQueueItem
+	for _, item := range q.items {
+		if item.SentAt == nil {
+			pending = append(pending, *item)
+		}
+	}
+	return pending
+}
+
+// MarkSent records the transaction that paid refund id
+func (q *RefundQueue) MarkSent(id, transaction string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, item := range q.items {
+		if item.ID == id {
+			now := time.Now()
+			item.SentAt, item.Transaction = &now, transaction
+			return nil
+		}
+	}
+	return kindOf(ErrNotFound, "refund not found")
+}
+
+// budgetCloses remembers the close signatures used and the budgets closed
+// for twice BudgetCloseMaxAge, past which no signature for them is accepted
+type budgetCloses struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // "nonce:<budget>:<nonce>" or "closed:<budget>" -> when forgotten
+
+	// now is stubbed in tests
+	now func() time.Time
+}
+
+func (c *budgetCloses) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// remember records key, reporting false if it already was
+func (c *budgetCloses) remember(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock()
+	if c.seen == nil {
+		c.seen = make(map[string]time.Time)
+	}
+	for k, forget := range c.seen {
+		if !now.Before(forget) {
+			delete(c.seen, k)
+		}
+	}
+	if _, ok := c.seen[key]; ok {
+		return false
+	}
+	c.seen[key] = now.Add(2 * BudgetCloseMaxAge)
+	return true
+}
+
+// closed reports whether budget id was closed recently
+func (c *budgetCloses) closed(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	forget, ok := c.seen["closed:"+id]
+	return ok && c.clock().Before(forget)
+}
+
+// budgetCloser is who may close budget: "admin", the budget's agent ID, or
+// "" if the request proves neither. An owner's signature must be fresh and
+// is accepted once.
+func (config AIFirstConfig) budgetCloser(r *http.Request, budget *PreAuthBudget, closes *budgetCloses) string {
+	if adminAuthorized(r, config.AdminKey) {
+		return "admin"
+	}
+
+	agentID := r.Header.Get("X-Agent-ID")
+	signature := r.Header.Get("X-Wallet-Signature")
+	nonce := r.Header.Get("X-Close-Nonce")
+	timestamp, err := strconv.ParseInt(r.Header.Get("X-Close-Timestamp"), 10, 64)
+	if agentID == "" || agentID != budget.AgentID || budget.WalletAddress == "" || signature == "" || nonce == "" || err != nil || config.WalletVerifier == nil {
+		return ""
+	}
+	if age := closes.clock().Sub(time.Unix(timestamp, 0)); age > BudgetCloseMaxAge || age < -BudgetCloseMaxAge {
+		return ""
+	}
+	valid, err := config.WalletVerifier(budget.WalletAddress, BudgetCloseMessage(budget.ID, nonce, timestamp), signature)
+	if err != nil || !valid || !closes.remember("nonce:"+budget.ID+":"+nonce) {
+		return ""
+	}
+	return agentID
+}
+
+// closeBudget refunds what is left of budget id and deletes it, returning
+// the final budget and the refund reference ("" if nothing was left). The
+// budget is suspended while the refund is made, and resumed if it fails;
+// a budget already suspended, by another close or otherwise, is refused
+// with ErrBudgetClosing.
+func (config AIFirstConfig) closeBudget(ctx context.Context, store PreAuthStore, id string) (*PreAuthBudget, string, error) {
+	suspended, err := store.Suspend(id, BudgetClosingReason)
+	if err != nil {
+		return nil, "", err
+	}
+	if !suspended {
+		return nil, "", ErrBudgetClosing
+	}
+	restore := func() {
+		_, _ = store.Resume(id)
+	}
+
+	// Read the balance only once no more deductions can land
+	budget, err := store.Get(id)
+	if err != nil {
+		restore()
+		return nil, "", err
+	}
+
+	var reference string
+	if budget.Remaining > 0 {
+		if config.Refunder == nil {
+			restore()
+			return nil, "", errors.New("no refunder configured")
+		}
+		reference, err = config.Refunder.RefundBudget(ctx, budget, budget.Remaining)
+		if err != nil {
+			restore()
+			return nil, "", fmt.Errorf("refund budget %s: %w", id, err)
+		}
+	}
+
+	if err := store.Delete(id); err != nil {
+		return nil, "", fmt.Errorf("delete refunded budget %s (refund %s): %w", id, reference, err)
+	}
+	return budget, reference, nil
+}
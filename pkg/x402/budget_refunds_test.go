@@ -0,0 +1,219 @@
+package x402
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// walletVerifier accepts "signed:<address>:<message>" signatures
+func walletVerifier(address, message, signature string) (bool, error) {
+	return signature == "signed:"+address+":"+message, nil
+}
+
+// ownerClose signs a close of budget id by agentID with wallet at timestamp
+func ownerClose(agentID, wallet, id, nonce string, timestamp int64) map[string]string {
+	return map[string]string{
+		"X-Agent-ID":         agentID,
+		"X-Wallet-Signature": "signed:" + wallet + ":" + BudgetCloseMessage(id, nonce, timestamp),
+		"X-Close-Nonce":      nonce,
+		"X-Close-Timestamp":  strconv.FormatInt(timestamp, 10),
+	}
+}
+
+func newClosableBudget(t *testing.T) (*InMemoryPreAuthStore, *PreAuthBudget) {
+	t.Helper()
+	store := NewInMemoryPreAuthStore()
+	budget := &PreAuthBudget{
+		AgentID:       "agent-1",
+		WalletAddress: "0xWallet",
+		TotalBudget:   1000,
+		Currency:      "USD",
+		Metadata:      map[string]string{BudgetPaymentIDKey: "pi_funding"},
+	}
+	store.Create(budget)
+	store.Deduct(budget.ID, 300)
+	return store, budget
+}
+
+func deleteBudget(handler http.Handler, id string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("DELETE", "/ai/budget?id="+id, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestAIBudgetHandler_OwnerCloseQueuesRefund(t *testing.T) {
+	store, budget := newClosableBudget(t)
+	queue := NewRefundQueue()
+	sink := NewInMemoryAuditSink()
+	handler := AIBudgetHandler(store, AIFirstConfig{
+		WalletVerifier: walletVerifier,
+		Refunder:       queue,
+		Audit:          &AuditLog{Sink: sink},
+	})
+
+	w := deleteBudget(handler, budget.ID, ownerClose("agent-1", "0xWallet", budget.ID, "n1", time.Now().Unix()))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the owner to close the budget, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Refunded        int64  `json:"refunded"`
+		RefundReference string `json:"refundReference"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+
+	pending := queue.Pending()
+	if len(pending) != 1 || pending[0].Amount != 700 || pending[0].WalletAddress != "0xWallet" || pending[0].ID != resp.RefundReference {
+		t.Errorf("Expected a queued refund of 700 matching the response, got %+v and %+v", pending, resp)
+	}
+	if _, err := store.Get(budget.ID); err == nil {
+		t.Error("Expected the budget to be deleted")
+	}
+	if got := auditDecisions(sink.Events()); got != AuditRefunded {
+		t.Errorf("Expected a refunded audit event, got %s", got)
+	}
+
+	if err := queue.MarkSent(resp.RefundReference, "0xtx"); err != nil || len(queue.Pending()) != 0 {
+		t.Errorf("Expected the refund to leave the queue once sent, got %v", err)
+	}
+}
+
+func TestAIBudgetHandler_StrangerCannotClose(t *testing.T) {
+	store, budget := newClosableBudget(t)
+	queue := NewRefundQueue()
+	sink := NewInMemoryAuditSink()
+	handler := AIBudgetHandler(store, AIFirstConfig{
+		AdminKey:       "admin_secret",
+		WalletVerifier: walletVerifier,
+		Refunder:       queue,
+		Audit:          &AuditLog{Sink: sink},
+	})
+
+	for _, headers := range []map[string]string{
+		{},
+		{"X-Agent-ID": "agent-1"},
+		ownerClose("agent-1", "0xOther", budget.ID, "n1", time.Now().Unix()),
+		ownerClose("agent-2", "0xWallet", budget.ID, "n2", time.Now().Unix()),
+		ownerClose("agent-1", "0xWallet", budget.ID, "n3", time.Now().Add(-2*BudgetCloseMaxAge).Unix()),
+		{"X-Admin-Key": "wrong"},
+	} {
+		if w := deleteBudget(handler, budget.ID, headers); w.Code != http.StatusForbidden {
+			t.Errorf("%v: expected 403, got %d", headers, w.Code)
+		}
+	}
+
+	if stored, err := store.Get(budget.ID); err != nil || stored.Remaining != 700 || stored.Suspended {
+		t.Errorf("Expected the budget untouched, got %+v (%v)", stored, err)
+	}
+	if len(queue.Pending()) != 0 {
+		t.Error("Expected no refunds")
+	}
+	events := sink.Events()
+	if len(events) != 6 || events[0].Decision != AuditRejected || events[0].Reason != "budget_close_unauthorized" {
+		t.Errorf("Expected an audited rejection per attempt, got %+v", events)
+	}
+}
+
+func TestAIBudgetHandler_AdminCloseRefundsThroughRail(t *testing.T) {
+	var refunded string
+	fail := true
+	stripeAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error":{"type":"api_error","message":"down"}}`)
+			return
+		}
+		r.ParseForm()
+		refunded = r.Form.Get("payment_intent") + ":" + r.Form.Get("amount")
+		fmt.Fprint(w, `{"id":"re_123","amount":700,"status":"succeeded"}`)
+	}))
+	defer stripeAPI.Close()
+	stripe := NewStripeRail("sk_test", "")
+	stripe.BaseURL = stripeAPI.URL
+
+	store, budget := newClosableBudget(t)
+	handler := AIBudgetHandler(store, AIFirstConfig{AdminKey: "admin_secret", Refunder: RailRefunder{Rail: stripe}})
+	admin := map[string]string{"Authorization": "Bearer admin_secret"}
+
+	// A failed refund keeps the budget, usable as before
+	if w := deleteBudget(handler, budget.ID, admin); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 while Stripe is down, got %d", w.Code)
+	}
+	if stored, err := store.Get(budget.ID); err != nil || stored.Suspended {
+		t.Fatalf("Expected the budget kept and unfrozen, got %+v (%v)", stored, err)
+	}
+
+	fail = false
+	w := deleteBudget(handler, budget.ID, admin)
+	if w.Code != http.StatusOK || refunded != "pi_funding:700" {
+		t.Fatalf("Expected the admin to close with a Stripe refund of 700, got %d and %q", w.Code, refunded)
+	}
+	var resp map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp["refundReference"] != "re_123" {
+		t.Errorf("Expected the Stripe refund ID, got %v", resp)
+	}
+}
+
+func TestAIBudgetHandler_ClosesOnce(t *testing.T) {
+	store, budget := newClosableBudget(t)
+	queue := NewRefundQueue()
+	handler := AIBudgetHandler(store, AIFirstConfig{AdminKey: "admin_secret", WalletVerifier: walletVerifier, Refunder: queue})
+
+	// A budget already closing is refused, not refunded again
+	store.Suspend(budget.ID, BudgetClosingReason)
+	if w := deleteBudget(handler, budget.ID, map[string]string{"Authorization": "Bearer admin_secret"}); w.Code != http.StatusConflict {
+		t.Errorf("Expected a close of a closing budget refused with 409, got %d", w.Code)
+	}
+	store.Resume(budget.ID)
+
+	// Concurrent closes refund once
+	var wg sync.WaitGroup
+	codes := make(chan int, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- deleteBudget(handler, budget.ID, map[string]string{"Authorization": "Bearer admin_secret"}).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	ok := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			ok++
+		} else if code != http.StatusConflict && code != http.StatusNotFound {
+			t.Errorf("Expected losing closes refused, got %d", code)
+		}
+	}
+	if pending := queue.Pending(); ok != 1 || len(pending) != 1 || pending[0].Amount != 700 {
+		t.Errorf("Expected one close refunding 700, got %d closes and %+v", ok, pending)
+	}
+	if w := deleteBudget(handler, budget.ID, map[string]string{"Authorization": "Bearer admin_secret"}); w.Code != http.StatusConflict {
+		t.Errorf("Expected a closed budget refused with 409, got %d", w.Code)
+	}
+}
+
+func TestAIBudgetHandler_OwnerSignatureNotReplayed(t *testing.T) {
+	store, budget := newClosableBudget(t)
+	handler := AIBudgetHandler(store, AIFirstConfig{WalletVerifier: walletVerifier})
+	headers := ownerClose("agent-1", "0xWallet", budget.ID, "n1", time.Now().Unix())
+
+	// Without a refunder the unspent budget can't close, leaving it to retry
+	if w := deleteBudget(handler, budget.ID, headers); w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected the close to fail without a refunder, got %d", w.Code)
+	}
+	if w := deleteBudget(handler, budget.ID, headers); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a replayed signature refused, got %d", w.Code)
+	}
+}
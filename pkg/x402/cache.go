@@ -0,0 +1,413 @@
+// Package x402 - Response Caching
+// Caches backend responses for paid, idempotent GET requests. Place the cache
+// INSIDE the payment middleware so every request is still verified and charged
+// while the backend is spared repeated work:
+//
+//	handler := x402.Middleware(x402.CacheMiddleware(backend, cacheConfig), config)
+//
+// Paid requests carry the payer's credentials, so the backend marks the
+// responses every payer may share with Cache-Control: public or s-maxage.
+package x402
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachedResponse is a stored backend response
+type CachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	StoredAt   time.Time
+	ExpiresAt  time.Time
+
+	// Vary lists the request headers the response varies on. An entry
+	// stored under the base key with Vary set is a marker pointing at
+	// the per-variant entries.
+	Vary []string
+}
+
+// CacheStore defines the interface for response cache storage
+type CacheStore interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, resp *CachedResponse)
+	Delete(key string)
+}
+
+// InMemoryLRUCache is an in-memory CacheStore with least-recently-used eviction
+type InMemoryLRUCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+type lruEntry struct {
+	key  string
+	resp *CachedResponse
+}
+
+// NewInMemoryLRUCache creates a new LRU cache holding at most maxEntries responses
+func NewInMemoryLRUCache(maxEntries int) *InMemoryLRUCache {
+	if maxEntries <= 0 {
+		maxEntries = 1000
+	}
+	return &InMemoryLRUCache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// Get returns a cached response, dropping it if expired
+func (c *InMemoryLRUCache) Get(key string) (*CachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*lruEntry)
+	if time.Now().After(entry.resp.ExpiresAt) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return entry.resp, true
+}
+
+// Set stores a response, evicting the least recently used entry when full
+func (c *InMemoryLRUCache) Set(key string, resp *CachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*lruEntry).resp = resp
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, resp: resp})
+	if c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// Delete removes a cached response
+func (c *InMemoryLRUCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+// Len returns the number of cached entries
+func (c *InMemoryLRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// CacheConfig configures the response cache middleware
+type CacheConfig struct {
+	// Store holds cached responses (defaults to a 1000-entry in-memory LRU)
+	Store CacheStore
+
+	// DefaultTTL applies when the backend sends no max-age.
+	// Zero means only responses with an explicit max-age are cached.
+	DefaultTTL time.Duration
+
+	// MaxBodyBytes is the largest response body that will be cached (default 1 MB)
+	MaxBodyBytes int64
+}
+
+// CacheMiddleware caches 200 responses to GET requests keyed by path, query
+// and the request headers named in the response's Vary header. Cache-Control
+// from the backend is honored: no-store, no-cache and private responses are
+// never stored, and max-age/s-maxage set the TTL. Requests with an
+// Authorization or X-Payment-Payer header are only stored when the response
+// is marked public or has an s-maxage. Only the headers next sets are
+// stored, without those naming a payer, so one payer's payment headers and
+// cookies are never served to another.
+func CacheMiddleware(next http.Handler, config CacheConfig) http.Handler {
+	if config.Store == nil {
+		config.Store = NewInMemoryLRUCache(1000)
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = 1 << 20
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		baseKey := r.URL.Path + "?" + r.URL.RawQuery
+
+		// Clients may ask to skip the cached copy
+		if !hasCacheDirective(r.Header, "no-cache") {
+			if cached, ok := lookupCachedResponse(config.Store, baseKey, r); ok {
+				writeCachedResponse(w, cached)
+				return
+			}
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		rec := &cacheRecorder{
+			ResponseWriter: w,
+			statusCode:     http.StatusOK,
+			limit:          config.MaxBodyBytes,
+			outer:          w.Header().Clone(),
+		}
+		next.ServeHTTP(rec, r)
+
+		if rec.statusCode != http.StatusOK || rec.overflow {
+			return
+		}
+
+		// Only what next wrote is stored: the payment middleware's headers
+		// around it, such as a receipt cookie, belong to this payer
+		header := rec.backendHeader()
+		ttl, ok := cacheTTL(header, config.DefaultTTL)
+		if !ok {
+			return
+		}
+
+		// Responses to a credentialed or identified payer are theirs alone
+		// unless the backend says they may be shared
+		if personalRequest(r) && !hasCacheDirective(header, "public") && !hasCacheDirective(header, "s-maxage") {
+			return
+		}
+
+		vary := parseVary(header)
+		for _, v := range vary {
+			if v == "*" {
+				return
+			}
+		}
+		for name := range header {
+			if payerResponseHeader(name) {
+				header.Del(name)
+			}
+		}
+
+		now := time.Now()
+		resp := &CachedResponse{
+			StatusCode: rec.statusCode,
+			Header:     header,
+			Body:       rec.body.Bytes(),
+			StoredAt:   now,
+			ExpiresAt:  now.Add(ttl),
+		}
+
+		if len(vary) == 0 {
+			config.Store.Set(baseKey, resp)
+			return
+		}
+
+		config.Store.Set(baseKey, &CachedResponse{Vary: vary, StoredAt: now, ExpiresAt: now.Add(ttl)})
+		config.Store.Set(variantCacheKey(baseKey, vary, r), resp)
+	})
+}
+
+// lookupCachedResponse resolves the base key, following Vary markers
+func lookupCachedResponse(store CacheStore, baseKey string, r *http.Request) (*CachedResponse, bool) {
+	cached, ok := store.Get(baseKey)
+	if !ok {
+		return nil, false
+	}
+	if len(cached.Vary) == 0 {
+		return cached, true
+	}
+	return store.Get(variantCacheKey(baseKey, cached.Vary, r))
+}
+
+// variantCacheKey extends the base key with the values of the Vary headers
+func variantCacheKey(baseKey string, vary []string, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(baseKey)
+	for _, name := range vary {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// writeCachedResponse replays a cached response
+func writeCachedResponse(w http.ResponseWriter, cached *CachedResponse) {
+	for k, values := range cached.Header {
+		// Payment headers belong to the current request, not the cached one
+		if w.Header().Get(k) != "" {
+			continue
+		}
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("Age", strconv.FormatInt(int64(time.Since(cached.StoredAt).Seconds()), 10))
+	w.WriteHeader(cached.StatusCode)
+	_, _ = w.Write(cached.Body)
+}
+
+// cacheTTL derives the cache lifetime from the response's Cache-Control
+func cacheTTL(header http.Header, defaultTTL time.Duration) (time.Duration, bool) {
+	if header.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if hasCacheDirective(header, directive) {
+			return 0, false
+		}
+	}
+
+	// s-maxage takes precedence for shared caches like this one
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if v, ok := cacheDirectiveValue(header, name); ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs <= 0 {
+				return 0, false
+			}
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+
+	if defaultTTL > 0 {
+		return defaultTTL, true
+	}
+	return 0, false
+}
+
+// personalRequest reports whether r carries credentials or the identity of
+// the payer, as Authorization or the X-Payment-Payer header does
+func personalRequest(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.Header.Get(DefaultPayerHeader) != ""
+}
+
+// hasCacheDirective reports whether Cache-Control contains the directive
+func hasCacheDirective(header http.Header, directive string) bool {
+	_, ok := cacheDirectiveValue(header, directive)
+	return ok
+}
+
+// cacheDirectiveValue returns the value of a Cache-Control directive
+func cacheDirectiveValue(header http.Header, directive string) (string, bool) {
+	for _, line := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if strings.EqualFold(name, directive) {
+				return strings.Trim(value, `"`), true
+			}
+		}
+	}
+	return "", false
+}
+
+// parseVary returns the canonical, sorted header names from Vary
+func parseVary(header http.Header) []string {
+	var vary []string
+	for _, line := range header.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+	return vary
+}
+
+// payerResponseHeaders are prefixes of the headers payment and agent
+// middlewares set for one payer: their payment, balance, session and spend.
+// They are never stored, even if next copies them.
+var payerResponseHeaders = []string{
+	"X-Payment-", "X-Session-", "X-Subscription-", "X-Budget-", "X-Task-",
+	"X-Remaining-Budget", "X-Coupon-", "X-Current-Tier", "X-Actual-Cost",
+	"X-Price-Multiplier", "Payment-Response", "X-Cache",
+}
+
+// payerResponseHeader reports whether a response header is one payer's
+func payerResponseHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, prefix := range payerResponseHeaders {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheRecorder tees the response body into a bounded buffer, and snapshots
+// the headers next sends
+type cacheRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+	limit      int64
+	overflow   bool
+	outer      http.Header // Headers set before next ran
+	sent       http.Header // Headers when next wrote the header
+}
+
+// backendHeader returns the headers next set or changed
+func (r *cacheRecorder) backendHeader() http.Header {
+	sent := r.sent
+	if sent == nil {
+		sent = r.Header()
+	}
+	header := make(http.Header)
+	for name, values := range sent {
+		if !slices.Equal(values, r.outer[name]) {
+			header[name] = slices.Clone(values)
+		}
+	}
+	return header
+}
+
+func (r *cacheRecorder) WriteHeader(code int) {
+	if r.sent == nil {
+		r.sent = r.Header().Clone()
+		r.statusCode = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *cacheRecorder) Write(b []byte) (int, error) {
+	if r.sent == nil {
+		r.sent = r.Header().Clone()
+	}
+	if !r.overflow {
+		if int64(r.body.Len()+len(b)) > r.limit {
+			r.overflow = true
+			r.body.Reset()
+		} else {
+			r.body.Write(b)
+		}
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush supports streaming responses through the cache
+func (r *cacheRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,339 @@
+package x402
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingBackend returns a handler that counts calls and echoes the Accept header
+func countingBackend(calls *int, cacheControl string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content:" + r.URL.RawQuery))
+	})
+}
+
+func TestCacheMiddleware_HitAndMiss(t *testing.T) {
+	calls := 0
+	handler := CacheMiddleware(countingBackend(&calls, "max-age=60"), CacheConfig{})
+
+	req := httptest.NewRequest("GET", "/api/data?x=1", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("Expected X-Cache MISS, got %s", w.Header().Get("X-Cache"))
+	}
+
+	req = httptest.NewRequest("GET", "/api/data?x=1", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected X-Cache HIT, got %s", w.Header().Get("X-Cache"))
+	}
+	if w.Body.String() != "content:x=1" {
+		t.Errorf("Unexpected cached body: %s", w.Body.String())
+	}
+	if calls != 1 {
+		t.Errorf("Expected backend to be called once, got %d", calls)
+	}
+
+	// Different query is a different key
+	req = httptest.NewRequest("GET", "/api/data?x=2", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("Expected MISS for different query, got %s", w.Header().Get("X-Cache"))
+	}
+}
+
+func TestCacheMiddleware_TTLExpiry(t *testing.T) {
+	calls := 0
+	store := NewInMemoryLRUCache(10)
+	handler := CacheMiddleware(countingBackend(&calls, "max-age=60"), CacheConfig{Store: store})
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/data", nil))
+
+	// Expire the entry
+	cached, ok := store.Get("/api/data?")
+	if !ok {
+		t.Fatal("Expected response to be cached")
+	}
+	cached.ExpiresAt = time.Now().Add(-time.Second)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+
+	if w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("Expected MISS after expiry, got %s", w.Header().Get("X-Cache"))
+	}
+	if calls != 2 {
+		t.Errorf("Expected backend to be called twice, got %d", calls)
+	}
+}
+
+func TestCacheMiddleware_NonGETBypass(t *testing.T) {
+	calls := 0
+	handler := CacheMiddleware(countingBackend(&calls, "max-age=60"), CacheConfig{})
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/data", nil))
+		if w.Header().Get("X-Cache") != "" {
+			t.Errorf("Expected no X-Cache header for POST, got %s", w.Header().Get("X-Cache"))
+		}
+	}
+
+	if calls != 2 {
+		t.Errorf("Expected POST to bypass cache, backend called %d times", calls)
+	}
+}
+
+func TestCacheMiddleware_HonorsCacheControl(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		defaultTTL   time.Duration
+		wantCached   bool
+	}{
+		{"max-age", "max-age=60", 0, true},
+		{"s-maxage", "public, s-maxage=30", 0, true},
+		{"no-store", "no-store", time.Minute, false},
+		{"private", "private, max-age=60", time.Minute, false},
+		{"no-cache", "no-cache", time.Minute, false},
+		{"no header with default TTL", "", time.Minute, true},
+		{"no header without default TTL", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			handler := CacheMiddleware(countingBackend(&calls, tt.cacheControl), CacheConfig{DefaultTTL: tt.defaultTTL})
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/data", nil))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/data", nil))
+
+			if got := calls == 1; got != tt.wantCached {
+				t.Errorf("Expected cached=%v, backend called %d times", tt.wantCached, calls)
+			}
+		})
+	}
+}
+
+func TestCacheMiddleware_OnlyCaches200(t *testing.T) {
+	calls := 0
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(http.StatusNotFound)
+	})
+	handler := CacheMiddleware(backend, CacheConfig{})
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing", nil))
+
+	if calls != 2 {
+		t.Errorf("Expected non-200 responses not to be cached, backend called %d times", calls)
+	}
+}
+
+func TestCacheMiddleware_MaxBodyBytes(t *testing.T) {
+	calls := 0
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(strings.Repeat("x", 100)))
+	})
+	handler := CacheMiddleware(backend, CacheConfig{MaxBodyBytes: 50})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/big", nil))
+	if w.Body.Len() != 100 {
+		t.Errorf("Expected full body to be streamed, got %d bytes", w.Body.Len())
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/big", nil))
+
+	if calls != 2 {
+		t.Errorf("Expected oversized body not to be cached, backend called %d times", calls)
+	}
+}
+
+func TestCacheMiddleware_Vary(t *testing.T) {
+	calls := 0
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept")
+		w.Write([]byte(r.Header.Get("Accept")))
+	})
+	handler := CacheMiddleware(backend, CacheConfig{})
+
+	get := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	get("application/json")
+	get("text/plain")
+	w := get("application/json")
+
+	if w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected HIT for repeated Accept value, got %s", w.Header().Get("X-Cache"))
+	}
+	if w.Body.String() != "application/json" {
+		t.Errorf("Expected variant body, got %s", w.Body.String())
+	}
+	if calls != 2 {
+		t.Errorf("Expected one backend call per variant, got %d", calls)
+	}
+}
+
+func TestCacheMiddleware_PersonalRequests(t *testing.T) {
+	get := func(handler http.Handler, header, value string) string {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set(header, value)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Header().Get("X-Cache")
+	}
+
+	for _, header := range []string{"Authorization", DefaultPayerHeader} {
+		// Private by default, even with a max-age
+		calls := 0
+		handler := CacheMiddleware(countingBackend(&calls, "max-age=60"), CacheConfig{DefaultTTL: time.Minute})
+		get(handler, header, "alice")
+		if got := get(handler, header, "bob"); got != "MISS" || calls != 2 {
+			t.Errorf("%s: expected alice's response not served to bob, got %s after %d calls", header, got, calls)
+		}
+
+		// Shared when the backend says so
+		for _, cacheControl := range []string{"public, max-age=60", "s-maxage=60"} {
+			calls = 0
+			handler = CacheMiddleware(countingBackend(&calls, cacheControl), CacheConfig{})
+			get(handler, header, "alice")
+			if got := get(handler, header, "bob"); got != "HIT" || calls != 1 {
+				t.Errorf("%s: expected a %q response shared, got %s after %d calls", header, cacheControl, got, calls)
+			}
+		}
+	}
+}
+
+func TestCacheMiddleware_BehindPayment(t *testing.T) {
+	calls := 0
+	handler := Middleware(CacheMiddleware(countingBackend(&calls, "public, max-age=60"), CacheConfig{}), testConfig())
+
+	// Prime the cache with a paid request
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("Authorization", "Bearer valid_token")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Cached content must still require payment
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 for unpaid request to cached path, got %d", w.Code)
+	}
+	if calls != 1 {
+		t.Errorf("Expected backend to be called once, got %d", calls)
+	}
+}
+
+// proofPayerRail accepts every payment, paid by the payer its proof names
+type proofPayerRail struct {
+	*EVMCryptoRail
+}
+
+func (p *proofPayerRail) VerifyPayment(ctx context.Context, req *VerifyPaymentRequest) (*PaymentVerification, error) {
+	return &PaymentVerification{Valid: true, PaymentID: "pay_" + req.PaymentPayload, Amount: req.ExpectedAmount, Payer: req.PaymentPayload}, nil
+}
+
+func TestCacheMiddleware_PayerHeadersNotShared(t *testing.T) {
+	calls := 0
+	store := NewInMemoryLRUCache(10)
+	registry := NewRailRegistry()
+	registry.Register(&proofPayerRail{NewEVMCryptoRail("", nil)})
+	handler := UnifiedPaymentMiddleware(CacheMiddleware(countingBackend(&calls, "public, max-age=60"), CacheConfig{Store: store}), UnifiedPaymentConfig{
+		PricePerRequest: 100,
+		CryptoEnabled:   true,
+		CryptoPayTo:     "0xseller",
+		CryptoNetworks:  []NetworkType{NetworkBaseSepolia},
+		RailRegistry:    registry,
+		TaskSpend:       NewInMemoryTaskSpendStore(TaskSpendLimits{}),
+		ReceiptCookies:  NewReceiptCookies([]byte("receipt_secret_key"), "/", time.Hour),
+	})
+
+	pay := func(payer, task string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-PAYMENT", payer)
+		if task != "" {
+			req.Header.Set(TaskIDHeader, task)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Payer A's response carries their spend, payment and receipt cookie
+	a := pay("0xA", "task-a")
+	if a.Header().Get("X-Task-Spent") == "" || a.Header().Get("Set-Cookie") == "" {
+		t.Fatalf("Expected payer A's spend and receipt, got %v", a.Header())
+	}
+	cached, ok := store.Get("/api/data?")
+	if !ok {
+		t.Fatal("Expected the response cached despite the receipt cookie")
+	}
+	for name := range cached.Header {
+		if payerResponseHeader(name) || name == "Set-Cookie" {
+			t.Errorf("Expected %s not stored, got %v", name, cached.Header)
+		}
+	}
+
+	// Payer B gets the cached content with only their own headers
+	b := pay("0xB", "")
+	if b.Header().Get("X-Cache") != "HIT" || calls != 1 {
+		t.Fatalf("Expected payer B served from the cache, got %q after %d calls", b.Header().Get("X-Cache"), calls)
+	}
+	if spent := b.Header().Get("X-Task-Spent"); spent != "" {
+		t.Errorf("Expected no task spend for payer B, got payer A's %q", spent)
+	}
+	if id := b.Header().Get("X-Payment-ID"); id != "pay_0xB" {
+		t.Errorf("Expected payer B's payment ID, got %q", id)
+	}
+	if b.Header().Get("Set-Cookie") == a.Header().Get("Set-Cookie") {
+		t.Error("Expected payer B's own receipt cookie, got payer A's")
+	}
+}
+
+func TestInMemoryLRUCache_Eviction(t *testing.T) {
+	cache := NewInMemoryLRUCache(2)
+	expires := time.Now().Add(time.Minute)
+
+	cache.Set("a", &CachedResponse{ExpiresAt: expires})
+	cache.Set("b", &CachedResponse{ExpiresAt: expires})
+	cache.Get("a") // a is now most recently used
+	cache.Set("c", &CachedResponse{ExpiresAt: expires})
+
+	if _, ok := cache.Get("b"); ok {
+		t.Error("Expected least recently used entry to be evicted")
+	}
+	if _, ok := cache.Get("a"); !ok {
+		t.Error("Expected recently used entry to remain")
+	}
+	if cache.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", cache.Len())
+	}
+}
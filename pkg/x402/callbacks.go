@@ -0,0 +1,191 @@
+// Package x402 - Callback Delivery
+// OnPaymentSuccess and the other user callbacks used to run inline, so a slow
+// one added its latency to every paid request and a panicking one failed a
+// request whose money had already moved. Callbacks now run through a
+// CallbackRunner: inline by default, or on a bounded worker pool. Either way
+// a panic is logged and the request carries on.
+package x402
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+)
+
+// Callback modes
+const (
+	CallbackSync  = "sync"  // Run callbacks in the request (default)
+	CallbackAsync = "async" // Queue callbacks for a pool of workers
+)
+
+// Default async worker pool
+const (
+	DefaultCallbackWorkers   = 4
+	DefaultCallbackQueueSize = 1024
+)
+
+// validateCallbackMode reports an unknown callback mode
+func validateCallbackMode(mode string) error {
+	switch mode {
+	case "", CallbackSync, CallbackAsync:
+		return nil
+	}
+	return fmt.Errorf("x402: callback Mode must be %q or %q, got %q", CallbackSync, CallbackAsync, mode)
+}
+
+// CallbackRunner runs user callbacks. A nil runner runs them inline.
+//
+// In CallbackAsync mode callbacks get a context that outlives the request but
+// keeps its values; they must not read the request body. Every queued
+// callback runs at least once before Shutdown returns: a callback that finds
+// the queue full, or arrives after Shutdown, runs inline instead.
+type CallbackRunner struct {
+	Mode string
+
+	// Workers and QueueSize bound the async pool (defaults
+	// DefaultCallbackWorkers and DefaultCallbackQueueSize)
+	Workers   int
+	QueueSize int
+
+	start   sync.Once
+	mu      sync.RWMutex
+	queue   chan func()
+	closed  bool
+	pending sync.WaitGroup
+}
+
+// NewCallbackRunner creates a runner in mode with the default pool
+func NewCallbackRunner(mode string) *CallbackRunner {
+	return &CallbackRunner{Mode: mode}
+}
+
+// Validate reports an unknown Mode
+func (c *CallbackRunner) Validate() error {
+	if c == nil {
+		return nil
+	}
+	return validateCallbackMode(c.Mode)
+}
+
+func (c *CallbackRunner) async() bool {
+	return c != nil && c.Mode == CallbackAsync
+}
+
+// context returns the context callbacks for a request with ctx get
+func (c *CallbackRunner) context(ctx context.Context) context.Context {
+	if c.async() {
+		return context.WithoutCancel(ctx)
+	}
+	return ctx
+}
+
+// run calls fn, the callback named name, as the mode says
+func (c *CallbackRunner) run(name string, fn func()) {
+	call := func() {
+		defer recoverCallback(name)
+		fn()
+	}
+	if !c.async() {
+		call()
+		return
+	}
+
+	c.start.Do(c.startWorkers)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		call()
+		return
+	}
+	c.pending.Add(1)
+	select {
+	case c.queue <- func() { defer c.pending.Done(); call() }:
+	default:
+		c.pending.Done()
+		call()
+	}
+}
+
+func (c *CallbackRunner) startWorkers() {
+	workers, size := c.Workers, c.QueueSize
+	if workers <= 0 {
+		workers = DefaultCallbackWorkers
+	}
+	if size <= 0 {
+		size = DefaultCallbackQueueSize
+	}
+	c.queue = make(chan func(), size)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for fn := range c.queue {
+				fn()
+			}
+		}()
+	}
+}
+
+// Shutdown stops queueing callbacks and waits until the queued ones have run,
+// or ctx is done. Call it after http.Server.Shutdown so callbacks of requests
+// still in flight are delivered.
+func (c *CallbackRunner) Shutdown(ctx context.Context) error {
+	if !c.async() {
+		return nil
+	}
+	c.start.Do(c.startWorkers)
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// recoverCallback logs a panic in the callback named name instead of letting
+// it fail a request that has already been paid for
+func recoverCallback(name string) {
+	if v := recover(); v != nil {
+		log.Printf("x402: %s callback panicked: %v\n%s", name, v, debug.Stack())
+	}
+}
+
+// reportFailure delivers failure to onFailure, if set
+func reportFailure(c *CallbackRunner, onFailure func(context.Context, *PaymentFailure), r *http.Request, failure *PaymentFailure) {
+	if onFailure == nil {
+		return
+	}
+	ctx := c.context(r.Context())
+	c.run("OnPaymentFailure", func() { onFailure(ctx, failure) })
+}
+
+// paymentFailed delivers a refused payment to OnPaymentFailure and, past
+// extraction, OnPaymentFailed
+func (c UnifiedPaymentConfig) paymentFailed(r *http.Request, failure *PaymentFailure) {
+	reportFailure(c.Callbacks, c.OnPaymentFailure, r, failure)
+	if onFailed := c.OnPaymentFailed; onFailed != nil && failure.Stage != StageExtract {
+		req := r.WithContext(c.Callbacks.context(r.Context()))
+		c.Callbacks.run("OnPaymentFailed", func() { onFailed(req.Context(), failure.Err, req) })
+	}
+}
+
+// paymentSucceeded delivers payment to OnPaymentSuccess
+func (c UnifiedPaymentConfig) paymentSucceeded(r *http.Request, payment *CompletedPayment) {
+	if onSuccess := c.OnPaymentSuccess; onSuccess != nil {
+		ctx := c.Callbacks.context(r.Context())
+		c.Callbacks.run("OnPaymentSuccess", func() { onSuccess(ctx, payment) })
+	}
+}
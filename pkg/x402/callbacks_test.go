@@ -0,0 +1,181 @@
+package x402
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newCallbackHandler(config UnifiedPaymentConfig) http.Handler {
+	registry := NewRailRegistry()
+	registry.Register(&countingRail{EVMCryptoRail: NewEVMCryptoRail("", nil)})
+	config.Price = "0.01"
+	config.CryptoEnabled = true
+	config.RailRegistry = registry
+	return UnifiedPaymentMiddleware(createTestHandler(), config)
+}
+
+func payOnce(handler http.Handler) int {
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-PAYMENT", "payload")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestCallbacks_PanicDoesNotFailRequest(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	for _, mode := range []string{CallbackSync, CallbackAsync} {
+		runner := NewCallbackRunner(mode)
+		handler := newCallbackHandler(UnifiedPaymentConfig{
+			Callbacks:        runner,
+			OnPaymentSuccess: func(ctx context.Context, payment *CompletedPayment) { panic("ledger down") },
+			OnPaymentFailure: func(ctx context.Context, failure *PaymentFailure) { panic("metrics down") },
+		})
+
+		if code := payOnce(handler); code != http.StatusOK {
+			t.Errorf("%s: expected the paid request served despite the panic, got %d", mode, code)
+		}
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-PAYMENT-PROOF", "!!!")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected a 400 despite the panic, got %d", mode, w.Code)
+		}
+		runner.Shutdown(context.Background())
+	}
+	for _, want := range []string{"OnPaymentSuccess callback panicked: ledger down", "OnPaymentFailure callback panicked: metrics down"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("Expected %q logged, got %q", want, logs.String())
+		}
+	}
+}
+
+func TestCallbacks_AsyncDeliveredBeforeShutdown(t *testing.T) {
+	release := make(chan struct{})
+	var delivered atomic.Int64
+	runner := &CallbackRunner{Mode: CallbackAsync, Workers: 2}
+	handler := newCallbackHandler(UnifiedPaymentConfig{
+		Callbacks: runner,
+		OnPaymentSuccess: func(ctx context.Context, payment *CompletedPayment) {
+			<-release
+			if ctx.Err() == nil {
+				delivered.Add(1)
+			}
+		},
+	})
+
+	// Requests don't wait for their callbacks
+	for i := 0; i < 5; i++ {
+		if code := payOnce(handler); code != http.StatusOK {
+			t.Fatalf("Request %d: expected 200, got %d", i, code)
+		}
+	}
+	if n := delivered.Load(); n != 0 {
+		t.Fatalf("Expected callbacks still queued, got %d delivered", n)
+	}
+
+	// Shutdown waits for every queued callback
+	done := make(chan error)
+	go func() { done <- runner.Shutdown(context.Background()) }()
+	select {
+	case <-done:
+		t.Fatal("Expected Shutdown to wait for queued callbacks")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Expected a clean shutdown, got %v", err)
+	}
+	if n := delivered.Load(); n != 5 {
+		t.Errorf("Expected 5 callbacks delivered with live contexts, got %d", n)
+	}
+
+	// Late requests' callbacks run inline
+	payOnce(handler)
+	if n := delivered.Load(); n != 6 {
+		t.Errorf("Expected a callback after shutdown delivered inline, got %d", n)
+	}
+}
+
+func TestCallbackRunner_FullQueueRunsInline(t *testing.T) {
+	runner := &CallbackRunner{Mode: CallbackAsync, Workers: 1, QueueSize: 1}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	runner.run("test", func() { close(started); <-release })
+	<-started
+	runner.run("test", func() { <-release }) // fills the queue
+
+	inline := false
+	runner.run("test", func() { inline = true })
+	if !inline {
+		t.Error("Expected a callback finding the queue full run inline")
+	}
+	close(release)
+	runner.Shutdown(context.Background())
+}
+
+func TestCallbackRunner_ShutdownDeadline(t *testing.T) {
+	runner := NewCallbackRunner(CallbackAsync)
+	release := make(chan struct{})
+	defer close(release)
+	runner.run("test", func() { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := runner.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestCallbacks_PanickingAlert(t *testing.T) {
+	store := NewInMemoryPreAuthStore()
+	store.Create(&PreAuthBudget{AgentID: "agent-1", TotalBudget: 10000, Currency: "USD"})
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	alerted := 0
+	handler := AIFirstMiddleware(createTestHandler(), AIFirstConfig{
+		PreAuthStore:  store,
+		EnablePreAuth: true,
+		DefaultCost:   100,
+		Currency:      "USD",
+		Alerts: &SpendingAlerts{
+			MaxPerHour: 100,
+			OnAlert: func(alert SpendAlert) {
+				alerted++
+				panic("pager down")
+			},
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-Agent-ID", "agent-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected 200 despite the panicking alert, got %d", i, w.Code)
+		}
+	}
+	if alerted != 1 {
+		t.Errorf("Expected one alert, got %d", alerted)
+	}
+}
+
+func TestCallbackRunner_Validate(t *testing.T) {
+	if err := (UnifiedPaymentConfig{Callbacks: &CallbackRunner{Mode: "later"}}).Validate(); err == nil {
+		t.Error("Expected an unknown callback mode refused")
+	}
+}
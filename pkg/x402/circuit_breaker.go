@@ -0,0 +1,241 @@
+// Package x402 - Circuit Breaker
+// A flapping facilitator makes every request wait out the full rail timeout
+// before failing. A CircuitBreaker counts consecutive rail errors and, past
+// a threshold, opens that rail's circuit: verifications and captures on it
+// fail fast into FailMode, and it is left out of 402 options so clients
+// aren't offered a payment that can't be verified. After OpenDuration a few
+// probe calls are let through; if they succeed the circuit closes again.
+package x402
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a rail's circuit
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"    // Calls go through
+	CircuitOpen     CircuitState = "open"      // Calls fail fast
+	CircuitHalfOpen CircuitState = "half-open" // Probe calls go through
+)
+
+// Circuit breaker defaults
+const (
+	DefaultCircuitFailureThreshold = 5
+	DefaultCircuitOpenDuration     = 30 * time.Second
+)
+
+// ErrCircuitOpen is the error of rail calls skipped because the rail's
+// circuit is open
+var ErrCircuitOpen = kindOf(ErrRailUnavailable, "payment rail circuit is open")
+
+// CircuitBreaker stops calling rails that keep failing
+type CircuitBreaker struct {
+	// FailureThreshold is how many consecutive errors open a rail's circuit
+	// (default DefaultCircuitFailureThreshold). Declined payments aren't
+	// errors.
+	FailureThreshold int
+
+	// OpenDuration is how long a circuit stays open before probing the rail
+	// (default DefaultCircuitOpenDuration)
+	OpenDuration time.Duration
+
+	// HalfOpenProbes is how many calls are let through to probe a rail, all
+	// of which must succeed to close its circuit (default 1)
+	HalfOpenProbes int
+
+	// Metrics, if set, counts state changes and reports each rail's state in
+	// its RailHealth
+	Metrics *RailMetrics
+
+	// OnStateChange, if set, is called on every state change, under the
+	// breaker's lock: it must not call the breaker
+	OnStateChange func(rail string, from, to CircuitState)
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+
+	// now is stubbed in tests
+	now func() time.Time
+}
+
+// circuit is one rail's breaker state
+type circuit struct {
+	state     CircuitState
+	failures  int // Consecutive, while closed
+	openedAt  time.Time
+	probes    int // Let through while half-open
+	successes int // Of the probes
+}
+
+// NewCircuitBreaker creates a breaker opening after threshold consecutive
+// errors for openDuration
+func NewCircuitBreaker(threshold int, openDuration time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{FailureThreshold: threshold, OpenDuration: openDuration}
+}
+
+func (b *CircuitBreaker) clock() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
+
+func (b *CircuitBreaker) threshold() int {
+	if b.FailureThreshold > 0 {
+		return b.FailureThreshold
+	}
+	return DefaultCircuitFailureThreshold
+}
+
+func (b *CircuitBreaker) openDuration() time.Duration {
+	if b.OpenDuration > 0 {
+		return b.OpenDuration
+	}
+	return DefaultCircuitOpenDuration
+}
+
+func (b *CircuitBreaker) halfOpenProbes() int {
+	if b.HalfOpenProbes > 0 {
+		return b.HalfOpenProbes
+	}
+	return 1
+}
+
+// circuit returns rail's circuit, creating a closed one. Callers hold mu.
+func (b *CircuitBreaker) circuit(rail string) *circuit {
+	if b.circuits == nil {
+		b.circuits = make(map[string]*circuit)
+	}
+	c, ok := b.circuits[rail]
+	if !ok {
+		c = &circuit{state: CircuitClosed}
+		b.circuits[rail] = c
+	}
+	return c
+}
+
+// State returns rail's circuit state
+func (b *CircuitBreaker) State(rail string) CircuitState {
+	if b == nil {
+		return CircuitClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.circuit(rail).state
+}
+
+// available reports whether rail should be offered: its circuit is closed,
+// or due to be probed
+func (b *CircuitBreaker) available(rail string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuit(rail)
+	return c.state != CircuitOpen || b.clock().Sub(c.openedAt) >= b.openDuration()
+}
+
+// reopensIn is how long until rail's open circuit lets a probe through (0
+// if it isn't open)
+func (b *CircuitBreaker) reopensIn(rail string) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuit(rail)
+	if c.state != CircuitOpen {
+		return 0
+	}
+	if wait := b.openDuration() - b.clock().Sub(c.openedAt); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// rails lists the rails the breaker has seen calls to
+func (b *CircuitBreaker) rails() []string {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rails := make([]string, 0, len(b.circuits))
+	for rail := range b.circuits {
+		rails = append(rails, rail)
+	}
+	return rails
+}
+
+// allow reports whether a call to rail may go ahead. Each allowed call must
+// be followed by record.
+func (b *CircuitBreaker) allow(rail string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuit(rail)
+	switch c.state {
+	case CircuitOpen:
+		if b.clock().Sub(c.openedAt) < b.openDuration() {
+			return false
+		}
+		b.transition(rail, c, CircuitHalfOpen)
+		c.probes, c.successes = 0, 0
+		fallthrough
+	case CircuitHalfOpen:
+		if c.probes >= b.halfOpenProbes() {
+			return false
+		}
+		c.probes++
+	}
+	return true
+}
+
+// record reports the outcome of an allowed call to rail
+func (b *CircuitBreaker) record(rail string, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuit(rail)
+	switch c.state {
+	case CircuitClosed:
+		if err == nil {
+			c.failures = 0
+			return
+		}
+		if c.failures++; c.failures >= b.threshold() {
+			c.openedAt = b.clock()
+			b.transition(rail, c, CircuitOpen)
+		}
+	case CircuitHalfOpen:
+		if err != nil {
+			c.openedAt = b.clock()
+			b.transition(rail, c, CircuitOpen)
+			return
+		}
+		if c.successes++; c.successes >= b.halfOpenProbes() {
+			c.failures = 0
+			b.transition(rail, c, CircuitClosed)
+		}
+	}
+}
+
+// transition moves c to state, reporting the change. Callers hold mu.
+func (b *CircuitBreaker) transition(rail string, c *circuit, state CircuitState) {
+	from := c.state
+	c.state = state
+	log.Printf("x402: %s rail circuit is %s (was %s)", rail, state, from)
+	b.Metrics.circuitChanged(rail, state)
+	if b.OnStateChange != nil {
+		b.OnStateChange(rail, from, state)
+	}
+}
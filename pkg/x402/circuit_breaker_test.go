@@ -0,0 +1,137 @@
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyRail is a countingRail that errors while failing is set
+type flakyRail struct {
+	countingRail
+	failing atomic.Bool
+}
+
+func (f *flakyRail) VerifyPayment(ctx context.Context, req *VerifyPaymentRequest) (*PaymentVerification, error) {
+	if f.failing.Load() {
+		f.verified.Add(1)
+		return nil, errors.New("facilitator unreachable")
+	}
+	return f.countingRail.VerifyPayment(ctx, req)
+}
+
+func TestCircuitBreaker_OpensAndRecovers(t *testing.T) {
+	rail := &flakyRail{countingRail: countingRail{EVMCryptoRail: NewEVMCryptoRail("", nil)}}
+	rail.failing.Store(true)
+	registry := NewRailRegistry()
+	registry.Register(rail)
+
+	now := time.Now()
+	metrics := NewRailMetrics()
+	breaker := NewCircuitBreaker(2, time.Minute)
+	breaker.Metrics = metrics
+	breaker.now = func() time.Time { return now }
+
+	var reasons []string
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		Price:          "0.01",
+		CryptoEnabled:  true,
+		CryptoNetworks: []NetworkType{NetworkBaseMainnet},
+		RailRegistry:   registry,
+		CircuitBreaker: breaker,
+		OnPaymentFailure: func(ctx context.Context, failure *PaymentFailure) {
+			reasons = append(reasons, failure.Reason)
+		},
+	})
+
+	pay := func() int {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-PAYMENT", "payload")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	options := func() int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+		var response PaymentOptionsResponse
+		json.NewDecoder(w.Body).Decode(&response)
+		return len(response.Options)
+	}
+
+	if options() != 1 {
+		t.Fatal("Expected the crypto rail offered while healthy")
+	}
+
+	// Two errors open the circuit
+	pay()
+	pay()
+	if breaker.State(rail.ID()) != CircuitOpen {
+		t.Fatalf("Expected the circuit open, got %s", breaker.State(rail.ID()))
+	}
+
+	// Open, payments fail fast without calling the rail, and it isn't offered
+	if code := pay(); code != http.StatusPaymentRequired || rail.verified.Load() != 2 {
+		t.Errorf("Expected a fast 402 without a rail call, got %d after %d calls", code, rail.verified.Load())
+	}
+	if reasons[len(reasons)-1] != FailureCircuitOpen {
+		t.Errorf("Expected reason %s, got %v", FailureCircuitOpen, reasons)
+	}
+	if n := options(); n != 0 {
+		t.Errorf("Expected no options while the circuit is open, got %d", n)
+	}
+
+	// A failed probe opens it again
+	now = now.Add(time.Minute)
+	if options() != 1 {
+		t.Error("Expected the rail offered once it is due a probe")
+	}
+	pay()
+	if breaker.State(rail.ID()) != CircuitOpen || rail.verified.Load() != 3 {
+		t.Fatalf("Expected the failed probe to reopen the circuit, got %s after %d calls", breaker.State(rail.ID()), rail.verified.Load())
+	}
+
+	// A successful probe closes it
+	now = now.Add(time.Minute)
+	rail.failing.Store(false)
+	if code := pay(); code != http.StatusOK {
+		t.Fatalf("Expected the probe payment accepted, got %d", code)
+	}
+	if breaker.State(rail.ID()) != CircuitClosed || options() != 1 {
+		t.Errorf("Expected the circuit closed and the rail offered, got %s", breaker.State(rail.ID()))
+	}
+
+	health, _ := metrics.Health(rail.ID())
+	if health.Circuit != CircuitClosed {
+		t.Errorf("Expected the closed circuit in the rail's health, got %q", health.Circuit)
+	}
+	// open, half-open, open, half-open, closed
+	if metrics.transitions[railTransition{rail.ID(), CircuitOpen}] != 2 || metrics.transitions[railTransition{rail.ID(), CircuitHalfOpen}] != 2 || metrics.transitions[railTransition{rail.ID(), CircuitClosed}] != 1 {
+		t.Errorf("Expected every transition counted, got %v", metrics.transitions)
+	}
+}
+
+func TestCircuitBreaker_HalfOpenProbes(t *testing.T) {
+	now := time.Now()
+	breaker := &CircuitBreaker{FailureThreshold: 1, OpenDuration: time.Second, HalfOpenProbes: 2, now: func() time.Time { return now }}
+	breaker.allow("stripe")
+	breaker.record("stripe", errors.New("down"))
+
+	now = now.Add(time.Second)
+	if !breaker.allow("stripe") || !breaker.allow("stripe") || breaker.allow("stripe") {
+		t.Fatal("Expected exactly two probes let through")
+	}
+	breaker.record("stripe", nil)
+	if breaker.State("stripe") != CircuitHalfOpen {
+		t.Errorf("Expected the circuit half-open until both probes succeed, got %s", breaker.State("stripe"))
+	}
+	breaker.record("stripe", nil)
+	if breaker.State("stripe") != CircuitClosed {
+		t.Errorf("Expected the circuit closed, got %s", breaker.State("stripe"))
+	}
+}
@@ -0,0 +1,392 @@
+// Package client is the buyer side of x402: an http.RoundTripper that
+// answers 402 Payment Required responses by paying and retrying.
+//
+// On a 402 the transport reads the payment requirements (from the
+// PAYMENT-REQUIRED header or the JSON body), picks one allowed by its Policy
+// and budget, asks its Payer for a proof and retries the request once with
+// the proof attached. Settlement data comes back in the X-PAYMENT-RESPONSE
+// header (see ParseSettlement) and, for callers that ask for it, in a
+// Receipt on the request context (see WithReceipt).
+//
+//	httpClient := client.NewClient(client.Config{
+//	    Payer:  client.PayerFunc(sign),
+//	    Policy: client.Policy{MaxAmount: 10000, PreferredNetworks: []string{"base"}},
+//	    Budget: 1000000,
+//	})
+//	resp, err := httpClient.Get("https://api.example.com/data")
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402"
+)
+
+// DefaultProofHeader carries the payment proof on the retried request
+const DefaultProofHeader = "X-PAYMENT"
+
+var (
+	// ErrNoAcceptableOption is returned when no payment option satisfies
+	// the Policy
+	ErrNoAcceptableOption = errors.New("x402 client: no acceptable payment option")
+
+	// ErrBudgetExceeded is returned when paying would exceed the Budget
+	ErrBudgetExceeded = errors.New("x402 client: budget exceeded")
+)
+
+// Payer obtains a payment proof (the proof header's value) for the chosen
+// requirement, by signing locally or asking a facilitator
+type Payer interface {
+	Pay(ctx context.Context, requirement x402.PaymentRequirements) (string, error)
+}
+
+// PayerFunc adapts a function to Payer
+type PayerFunc func(ctx context.Context, requirement x402.PaymentRequirements) (string, error)
+
+// Pay calls f
+func (f PayerFunc) Pay(ctx context.Context, requirement x402.PaymentRequirements) (string, error) {
+	return f(ctx, requirement)
+}
+
+// Policy decides which payment options may be paid
+type Policy struct {
+	// MaxAmount caps a single payment in the asset's smallest unit (0 = no cap)
+	MaxAmount int64
+
+	// Schemes limits the accepted schemes (empty = any)
+	Schemes []string
+
+	// PreferredNetworks are tried in order; other networks are used only if
+	// AllowOtherNetworks is set or PreferredNetworks is empty
+	PreferredNetworks  []string
+	AllowOtherNetworks bool
+}
+
+// Config configures a Transport
+type Config struct {
+	// Base performs the requests (default http.DefaultTransport)
+	Base http.RoundTripper
+
+	// Payer pays for the chosen option; required unless DryRun is set
+	Payer Payer
+
+	// Policy selects among the offered options
+	Policy Policy
+
+	// Budget caps the total paid by this transport (0 = unlimited)
+	Budget int64
+
+	// DryRun selects an option but never pays: the 402 is returned as is and
+	// the Receipt records what would have been paid
+	DryRun bool
+
+	// ProofHeader carries the proof (default X-PAYMENT)
+	ProofHeader string
+}
+
+// Transport is an http.RoundTripper that pays for 402 responses
+type Transport struct {
+	config Config
+
+	mu    sync.Mutex
+	spent int64
+}
+
+// NewTransport creates a paying transport
+func NewTransport(config Config) *Transport {
+	if config.Base == nil {
+		config.Base = http.DefaultTransport
+	}
+	if config.ProofHeader == "" {
+		config.ProofHeader = DefaultProofHeader
+	}
+	return &Transport{config: config}
+}
+
+// NewClient creates an http.Client using a paying transport
+func NewClient(config Config) *http.Client {
+	return &http.Client{Transport: NewTransport(config)}
+}
+
+// Spent returns the total paid so far
+func (t *Transport) Spent() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.spent
+}
+
+// Settlement is the decoded X-PAYMENT-RESPONSE header
+type Settlement struct {
+	Success     bool   `json:"success"`
+	Transaction string `json:"transaction,omitempty"`
+	Network     string `json:"network,omitempty"`
+	Payer       string `json:"payer,omitempty"`
+	ErrorReason string `json:"errorReason,omitempty"`
+}
+
+// ParseSettlement decodes resp's X-PAYMENT-RESPONSE header (nil if absent
+// or invalid)
+func ParseSettlement(resp *http.Response) *Settlement {
+	header := resp.Header.Get("X-PAYMENT-RESPONSE")
+	if header == "" {
+		return nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		decoded = []byte(header)
+	}
+	var settlement Settlement
+	if err := json.Unmarshal(decoded, &settlement); err != nil {
+		return nil
+	}
+	return &settlement
+}
+
+// Receipt describes what the transport paid for a request
+type Receipt struct {
+	// Paid is set once a proof was sent
+	Paid bool
+
+	// DryRun is set when the payment was only selected
+	DryRun bool
+
+	// Requirement is the option chosen and Amount its price
+	Requirement x402.PaymentRequirements
+	Amount      int64
+
+	// Settlement is the seller's X-PAYMENT-RESPONSE, if any
+	Settlement *Settlement
+}
+
+type receiptKey struct{}
+
+// WithReceipt returns a context whose requests report their payment in the
+// returned Receipt
+func WithReceipt(ctx context.Context) (context.Context, *Receipt) {
+	receipt := &Receipt{}
+	return context.WithValue(ctx, receiptKey{}, receipt), receipt
+}
+
+// RoundTrip sends req and, if it is answered with a 402, pays and retries once
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The body may have to be sent twice
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.config.Base.RoundTrip(withBody(req, body, nil))
+	if err != nil || resp.StatusCode != http.StatusPaymentRequired {
+		return resp, err
+	}
+
+	required, err := ParsePaymentRequired(resp)
+	if err != nil {
+		return resp, nil // Not an x402 402; leave it to the caller
+	}
+
+	requirement, amount, err := t.selectOption(required.Accepts)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	receipt, _ := req.Context().Value(receiptKey{}).(*Receipt)
+	if receipt != nil {
+		receipt.Requirement, receipt.Amount = requirement, amount
+	}
+	if t.config.DryRun {
+		if receipt != nil {
+			receipt.DryRun = true
+		}
+		return resp, nil
+	}
+
+	if t.config.Payer == nil {
+		resp.Body.Close()
+		return nil, errors.New("x402 client: no Payer configured")
+	}
+	if err := t.reserve(amount); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	proof, err := t.config.Payer.Pay(req.Context(), requirement)
+	if err != nil {
+		t.release(amount)
+		resp.Body.Close()
+		return nil, fmt.Errorf("x402 client: pay: %w", err)
+	}
+	resp.Body.Close()
+
+	retry := withBody(req, body, http.Header{t.config.ProofHeader: {proof}})
+	paid, err := t.config.Base.RoundTrip(retry)
+	if err != nil || paid.StatusCode == http.StatusPaymentRequired {
+		// The seller refused the proof, so nothing was spent
+		t.release(amount)
+		return paid, err
+	}
+	if receipt != nil {
+		receipt.Paid = true
+		receipt.Settlement = ParseSettlement(paid)
+	}
+	return paid, nil
+}
+
+// selectOption picks the cheapest option on the most preferred network
+// that the policy and remaining budget allow
+func (t *Transport) selectOption(accepts []x402.PaymentRequirements) (x402.PaymentRequirements, int64, error) {
+	policy := t.config.Policy
+	rank := func(network string) int {
+		for i, preferred := range policy.PreferredNetworks {
+			if preferred == network {
+				return i
+			}
+		}
+		if len(policy.PreferredNetworks) == 0 || policy.AllowOtherNetworks {
+			return len(policy.PreferredNetworks)
+		}
+		return -1
+	}
+
+	type candidate struct {
+		requirement x402.PaymentRequirements
+		amount      int64
+		rank        int
+	}
+	var candidates []candidate
+	overBudget := false
+	for _, requirement := range accepts {
+		amount, err := strconv.ParseInt(requirement.MaxAmountRequired, 10, 64)
+		if err != nil || amount < 0 {
+			continue
+		}
+		if !allowed(policy.Schemes, requirement.Scheme) || (policy.MaxAmount > 0 && amount > policy.MaxAmount) {
+			continue
+		}
+		r := rank(requirement.Network)
+		if r < 0 {
+			continue
+		}
+		if !t.affordable(amount) {
+			overBudget = true
+			continue
+		}
+		candidates = append(candidates, candidate{requirement, amount, r})
+	}
+
+	if len(candidates) == 0 {
+		if overBudget {
+			return x402.PaymentRequirements{}, 0, ErrBudgetExceeded
+		}
+		return x402.PaymentRequirements{}, 0, ErrNoAcceptableOption
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].rank != candidates[j].rank {
+			return candidates[i].rank < candidates[j].rank
+		}
+		return candidates[i].amount < candidates[j].amount
+	})
+	return candidates[0].requirement, candidates[0].amount, nil
+}
+
+func allowed(schemes []string, scheme string) bool {
+	if len(schemes) == 0 {
+		return true
+	}
+	for _, s := range schemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// affordable reports whether amount fits in the remaining budget
+func (t *Transport) affordable(amount int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.config.Budget <= 0 || t.spent+amount <= t.config.Budget
+}
+
+// reserve counts amount against the budget before paying
+func (t *Transport) reserve(amount int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.config.Budget > 0 && t.spent+amount > t.config.Budget {
+		return ErrBudgetExceeded
+	}
+	t.spent += amount
+	return nil
+}
+
+// release returns a reservation for a payment that was not made
+func (t *Transport) release(amount int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spent -= amount
+}
+
+// ParsePaymentRequired reads a 402's requirements from the PAYMENT-REQUIRED
+// header or the JSON body (either format), leaving the body readable
+func ParsePaymentRequired(resp *http.Response) (*x402.PaymentRequiredResponse, error) {
+	var required x402.PaymentRequiredResponse
+	if header := resp.Header.Get("PAYMENT-REQUIRED"); header != "" {
+		if decoded, err := base64.StdEncoding.DecodeString(header); err == nil {
+			if json.Unmarshal(decoded, &required) == nil && len(required.Accepts) > 0 {
+				return &required, nil
+			}
+		}
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &required); err != nil || len(required.Accepts) == 0 {
+		// Agent-format 402s carry the requirements as data
+		var agent struct {
+			Data x402.PaymentRequiredResponse `json:"data"`
+		}
+		if json.Unmarshal(data, &agent) == nil && len(agent.Data.Accepts) > 0 {
+			return &agent.Data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrNoAcceptableOption
+	}
+	return &required, nil
+}
+
+// readBody reads and closes req's body (nil for requests without one)
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	defer req.Body.Close()
+	return io.ReadAll(req.Body)
+}
+
+// withBody copies req with a fresh reader over body and extra headers set,
+// since a RoundTripper must not modify the caller's request
+func withBody(req *http.Request, body []byte, extra http.Header) *http.Request {
+	out := req.Clone(req.Context())
+	if body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	for name, values := range extra {
+		out.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	return out
+}
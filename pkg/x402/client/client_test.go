@@ -0,0 +1,227 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402"
+)
+
+// newSeller starts an API behind x402.Middleware charging price that
+// accepts proofs made by signer, echoes the request body and reports a
+// settlement
+func newSeller(t *testing.T, price int64) *httptest.Server {
+	t.Helper()
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-PAYMENT-RESPONSE", base64.StdEncoding.EncodeToString([]byte(`{"success":true,"transaction":"0xabc","network":"base-sepolia"}`)))
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte("paid:" + string(body)))
+	})
+	server := httptest.NewServer(x402.Middleware(api, x402.Config{
+		PricePerRequest: price,
+		Currency:        "USD",
+		PaymentVerifier: func(token string) (bool, error) {
+			return token == "signed:base-sepolia", nil
+		},
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// signer pays any requirement, counting its calls
+type signer struct{ calls int }
+
+func (s *signer) Pay(ctx context.Context, requirement x402.PaymentRequirements) (string, error) {
+	s.calls++
+	return "signed:" + requirement.Network, nil
+}
+
+func TestTransport_PaysAndRetries(t *testing.T) {
+	seller := newSeller(t, 100)
+	payer := &signer{}
+	transport := NewTransport(Config{Payer: payer})
+	httpClient := &http.Client{Transport: transport}
+
+	ctx, receipt := WithReceipt(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "POST", seller.URL+"/api/data", strings.NewReader("hello"))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK || string(body) != "paid:hello" {
+		t.Errorf("Expected the paid retry to resend the body, got %d %q", resp.StatusCode, body)
+	}
+	if payer.calls != 1 || transport.Spent() != 100 {
+		t.Errorf("Expected one payment of 100, got %d calls and %d spent", payer.calls, transport.Spent())
+	}
+	if !receipt.Paid || receipt.Amount != 100 || receipt.Requirement.Network != "base-sepolia" {
+		t.Errorf("Unexpected receipt %+v", receipt)
+	}
+	if receipt.Settlement == nil || receipt.Settlement.Transaction != "0xabc" {
+		t.Errorf("Expected the settlement in the receipt, got %+v", receipt.Settlement)
+	}
+}
+
+func TestTransport_PaysAgentFormat402(t *testing.T) {
+	seller := newSeller(t, 100)
+	payer := &signer{}
+	httpClient := &http.Client{Transport: NewTransport(Config{Payer: payer})}
+
+	req, _ := http.NewRequest("GET", seller.URL+"/api/data", nil)
+	req.Header.Set("X-AI-Agent", "true")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || payer.calls != 1 {
+		t.Errorf("Expected the agent to pay from the AIResponse body, got %d after %d payments", resp.StatusCode, payer.calls)
+	}
+}
+
+func TestTransport_Policy(t *testing.T) {
+	seller := newSeller(t, 100)
+
+	httpClient := NewClient(Config{Payer: &signer{}, Policy: Policy{MaxAmount: 50}})
+	if _, err := httpClient.Get(seller.URL + "/api/data"); !errors.Is(err, ErrNoAcceptableOption) {
+		t.Errorf("Expected ErrNoAcceptableOption above MaxAmount, got %v", err)
+	}
+
+	httpClient = NewClient(Config{Payer: &signer{}, Policy: Policy{PreferredNetworks: []string{"base"}}})
+	if _, err := httpClient.Get(seller.URL + "/api/data"); !errors.Is(err, ErrNoAcceptableOption) {
+		t.Errorf("Expected ErrNoAcceptableOption on another network, got %v", err)
+	}
+}
+
+func TestTransport_Budget(t *testing.T) {
+	seller := newSeller(t, 100)
+	transport := NewTransport(Config{Payer: &signer{}, Budget: 150})
+	httpClient := &http.Client{Transport: transport}
+
+	resp, err := httpClient.Get(seller.URL + "/api/data")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the first request to be paid, got %v", err)
+	}
+	resp.Body.Close()
+
+	if _, err := httpClient.Get(seller.URL + "/api/data"); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("Expected ErrBudgetExceeded, got %v", err)
+	}
+	if transport.Spent() != 100 {
+		t.Errorf("Expected 100 spent, got %d", transport.Spent())
+	}
+}
+
+func TestTransport_DryRun(t *testing.T) {
+	seller := newSeller(t, 100)
+	payer := &signer{}
+	transport := NewTransport(Config{Payer: payer, DryRun: true})
+
+	ctx, receipt := WithReceipt(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", seller.URL+"/api/data", nil)
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPaymentRequired {
+		t.Errorf("Expected the 402 to be returned, got %d", resp.StatusCode)
+	}
+	if payer.calls != 0 || transport.Spent() != 0 {
+		t.Errorf("Expected no payment, got %d calls", payer.calls)
+	}
+	if !receipt.DryRun || receipt.Paid || receipt.Amount != 100 {
+		t.Errorf("Expected the receipt to show the would-be payment, got %+v", receipt)
+	}
+}
+
+func TestTransport_RefusedProofIsNotSpent(t *testing.T) {
+	seller := newSeller(t, 100)
+	refused := PayerFunc(func(ctx context.Context, requirement x402.PaymentRequirements) (string, error) {
+		return "bogus", nil
+	})
+	transport := NewTransport(Config{Payer: refused})
+
+	resp, err := (&http.Client{Transport: transport}).Get(seller.URL + "/api/data")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPaymentRequired || transport.Spent() != 0 {
+		t.Errorf("Expected the refusal to be returned unspent, got %d with %d spent", resp.StatusCode, transport.Spent())
+	}
+}
+
+func TestSelectOption(t *testing.T) {
+	accepts := []x402.PaymentRequirements{
+		{Scheme: "exact", Network: "base", MaxAmountRequired: "120"},
+		{Scheme: "exact", Network: "polygon", MaxAmountRequired: "90"},
+		{Scheme: "upto", Network: "base", MaxAmountRequired: "100"},
+	}
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		network string
+		scheme  string
+	}{
+		{"cheapest without preferences", Policy{}, "polygon", "exact"},
+		{"preferred network first", Policy{PreferredNetworks: []string{"base"}}, "base", "upto"},
+		{"scheme filter", Policy{PreferredNetworks: []string{"base"}, Schemes: []string{"exact"}}, "base", "exact"},
+		{"price cap", Policy{MaxAmount: 95}, "polygon", "exact"},
+	}
+	for _, tt := range tests {
+		transport := NewTransport(Config{Policy: tt.policy})
+		got, _, err := transport.selectOption(accepts)
+		if err != nil || got.Network != tt.network || got.Scheme != tt.scheme {
+			t.Errorf("%s: expected %s/%s, got %s/%s (%v)", tt.name, tt.scheme, tt.network, got.Scheme, got.Network, err)
+		}
+	}
+}
+
+func TestVerifyDiscoverySignature(t *testing.T) {
+	signer := x402.NewDiscoverySigner("k1", ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	mux := http.NewServeMux()
+	mux.Handle(x402.WellKnownPath, x402.WellKnownHandler(signer))
+	mux.Handle("/api/", x402.Middleware(http.NotFoundHandler(), x402.Config{
+		PricePerRequest: 100,
+		PayTo:           "0xseller",
+		TestMode:        true,
+		DiscoverySigner: signer,
+		Protocol:        x402.ProtocolLegacy,
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	keys, err := FetchDiscoveryKeys(context.Background(), server.Client(), server.URL)
+	if err != nil || len(keys.Keys) != 1 {
+		t.Fatalf("Expected one key, got %+v %v", keys, err)
+	}
+
+	resp, err := http.Get(server.URL + "/api/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := VerifyDiscoverySignature(resp, keys); err != nil {
+		t.Fatalf("Expected the requirements to verify, got %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+
+	// An intermediary changing one byte of payTo is caught
+	tampered := http.Response{Header: resp.Header, Body: io.NopCloser(strings.NewReader(strings.Replace(string(body), "0xseller", "0xsellet", 1)))}
+	if err := VerifyDiscoverySignature(&tampered, keys); !errors.Is(err, x402.ErrInvalidDiscoverySignature) {
+		t.Errorf("Expected the modified payTo rejected, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402"
+)
+
+// FetchDiscoveryKeys reads a seller's discovery signing keys from
+// /.well-known/x402 at baseURL. Callers should pin or cache the result:
+// keys fetched over the same channel as a document only protect it as far
+// as that channel is trusted.
+func FetchDiscoveryKeys(ctx context.Context, httpClient *http.Client, baseURL string) (x402.DiscoveryKeySet, error) {
+	var keys x402.DiscoveryKeySet
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+x402.WellKnownPath, nil)
+	if err != nil {
+		return keys, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return keys, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return keys, fmt.Errorf("x402 client: %s returned %d", x402.WellKnownPath, resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&keys)
+	return keys, err
+}
+
+// VerifyDiscoverySignature checks resp's X-Discovery-Signature against
+// keys, leaving the body readable. It verifies discovery documents and 402
+// requirements, whether sent in the PAYMENT-REQUIRED header, the body or an
+// agent-format body's data.
+func VerifyDiscoverySignature(resp *http.Response, keys x402.DiscoveryKeySet) error {
+	signature := resp.Header.Get(x402.DiscoverySignatureHeader)
+	if signature == "" {
+		return fmt.Errorf("%w: response is not signed", x402.ErrInvalidDiscoverySignature)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	var documents [][]byte
+	if header := resp.Header.Get("PAYMENT-REQUIRED"); header != "" {
+		if decoded, err := base64.StdEncoding.DecodeString(header); err == nil {
+			documents = append(documents, decoded)
+		}
+	}
+	documents = append(documents, data)
+	var agent struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if json.Unmarshal(data, &agent) == nil && len(agent.Data) > 0 {
+		documents = append(documents, agent.Data)
+	}
+
+	for _, document := range documents {
+		if err = x402.VerifyDiscoverySignature(document, signature, keys); err == nil {
+			return nil
+		}
+	}
+	return err
+}
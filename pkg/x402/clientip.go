@@ -0,0 +1,124 @@
+// Package x402 - Client IP Extraction
+// Derives the real client address behind reverse proxies. Forwarding headers
+// are only believed when the TCP peer is a trusted proxy; anything else falls
+// back to the peer address so clients cannot spoof their IP.
+package x402
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseTrustedProxies parses CIDRs (or bare IPs) of proxies whose forwarding
+// headers may be trusted
+func ParseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	return parseNetworks(entries, "trusted proxy")
+}
+
+// parseNetworks parses CIDRs or bare IPs, naming kind in errors
+func parseNetworks(entries []string, kind string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s %q", kind, entry)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", kind, entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// ClientIPFromRequest returns the client IP for r. X-Forwarded-For is walked
+// right to left, skipping trusted proxies, and the first untrusted hop is the
+// client. If the peer itself is not trusted its address is returned as-is.
+func ClientIPFromRequest(r *http.Request, trusted []*net.IPNet) string {
+	peer := peerIP(r)
+	if !isTrustedProxy(peer, trusted) {
+		return peer
+	}
+
+	hops := forwardedForHops(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// A malformed hop means the chain can't be trusted past this point
+			return peer
+		}
+		if !isTrustedProxy(hops[i], trusted) {
+			return ip.String()
+		}
+	}
+	if len(hops) > 0 {
+		// Every hop is a trusted proxy; the first is the closest we have to the client
+		return net.ParseIP(hops[0]).String()
+	}
+
+	if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP.String()
+	}
+	return peer
+}
+
+// IsTrustedPeer reports whether the request's TCP peer is a trusted proxy
+func IsTrustedPeer(r *http.Request, trusted []*net.IPNet) bool {
+	return isTrustedProxy(peerIP(r), trusted)
+}
+
+// peerIP returns the TCP peer address without the port
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedForHops flattens all X-Forwarded-For headers into a hop list
+func forwardedForHops(header http.Header) []string {
+	var hops []string
+	for _, line := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(line, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// isTrustedProxy reports whether ip falls within a trusted network
+func isTrustedProxy(ip string, trusted []*net.IPNet) bool {
+	return ipInNetworks(ip, trusted)
+}
+
+// ipInNetworks reports whether ip falls within any of nets
+func ipInNetworks(ip string, nets []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
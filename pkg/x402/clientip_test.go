@@ -0,0 +1,87 @@
+package x402
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "::1", ""})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(nets) != 3 {
+		t.Errorf("Expected 3 networks, got %d", len(nets))
+	}
+
+	if _, err := ParseTrustedProxies([]string{"not-an-ip"}); err == nil {
+		t.Error("Expected error for invalid entry")
+	}
+	if _, err := ParseTrustedProxies([]string{"10.0.0.0/99"}); err == nil {
+		t.Error("Expected error for invalid CIDR")
+	}
+}
+
+func TestClientIPFromRequest(t *testing.T) {
+	trusted, _ := ParseTrustedProxies([]string{"10.0.0.0/8"})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		realIP     string
+		trusted    bool
+		want       string
+	}{
+		{"no proxy", "203.0.113.5:1234", "", "", true, "203.0.113.5"},
+		{"spoofed XFF from untrusted peer", "203.0.113.5:1234", "1.2.3.4", "", true, "203.0.113.5"},
+		{"spoofed X-Real-IP from untrusted peer", "203.0.113.5:1234", "", "1.2.3.4", true, "203.0.113.5"},
+		{"trusted proxy", "10.0.0.1:1234", "198.51.100.7", "", true, "198.51.100.7"},
+		{"trusted chain", "10.0.0.1:1234", "198.51.100.7, 10.0.0.2", "", true, "198.51.100.7"},
+		{"spoofed prefix in trusted chain", "10.0.0.1:1234", "1.2.3.4, 198.51.100.7, 10.0.0.2", "", true, "198.51.100.7"},
+		{"malformed hop", "10.0.0.1:1234", "garbage", "", true, "10.0.0.1"},
+		{"X-Real-IP from trusted proxy", "10.0.0.1:1234", "", "198.51.100.7", true, "198.51.100.7"},
+		{"no trust configured", "10.0.0.1:1234", "198.51.100.7", "", false, "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			nets := trusted
+			if !tt.trusted {
+				nets = nil
+			}
+			if got := ClientIPFromRequest(req, nets); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMeteringMiddleware_RecordsClientIP(t *testing.T) {
+	store := NewInMemoryMeteringStore(10, "USDC")
+	trusted, _ := ParseTrustedProxies([]string{"10.0.0.0/8"})
+
+	handler := MeteringMiddleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		MeteringConfig{Store: store, TrustedProxies: trusted},
+	)
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got := store.metrics[0].ClientIP; got != "198.51.100.7" {
+		t.Errorf("Expected client IP 198.51.100.7, got %s", got)
+	}
+}
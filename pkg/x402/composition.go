@@ -0,0 +1,61 @@
+// Package x402 - Middleware Composition
+// Payment middlewares are easy to stack by accident: AIAgentPaymentMiddleware
+// runs UnifiedPaymentMiddleware itself, so wrapping a handler in both would
+// verify and capture each payment twice. The middleware that decides a
+// request's payment marks the request context, and x402 middlewares inside it
+// pass marked requests straight through, logging once that they are
+// redundant.
+package x402
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+)
+
+type paymentDecidedKey struct{}
+
+// decidedBy names the middleware that decided r's payment, or ""
+func decidedBy(r *http.Request) string {
+	by, _ := r.Context().Value(paymentDecidedKey{}).(string)
+	return by
+}
+
+// decide marks r's payment decided by middleware name, unless one outside it
+// already did
+func decide(r *http.Request, name string) *http.Request {
+	if decidedBy(r) != "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), paymentDecidedKey{}, name))
+}
+
+// decided wraps next so every request middleware name passes to it is
+// marked decided
+func decided(next http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, decide(r, name))
+	})
+}
+
+// composition lets a middleware step aside for requests whose payment a
+// middleware outside it decided
+type composition struct {
+	name   string
+	warned sync.Once
+}
+
+// passThrough serves r with next and reports true if its payment was
+// already decided
+func (c *composition) passThrough(w http.ResponseWriter, r *http.Request, next http.Handler) bool {
+	by := decidedBy(r)
+	if by == "" {
+		return false
+	}
+	c.warned.Do(func() {
+		log.Printf("x402: %s middleware is wrapped by %s, which already handles payment; passing requests through (see \"Composing Middleware\" in docs/UNIFIED_PAYMENTS.md)", c.name, by)
+	})
+	next.ServeHTTP(w, r)
+	return true
+}
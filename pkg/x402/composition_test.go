@@ -0,0 +1,133 @@
+package x402
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingRail accepts every payment and counts verifications and captures
+type countingRail struct {
+	*EVMCryptoRail
+	verified atomic.Int64
+	captured atomic.Int64
+}
+
+func (c *countingRail) VerifyPayment(ctx context.Context, req *VerifyPaymentRequest) (*PaymentVerification, error) {
+	c.verified.Add(1)
+	return &PaymentVerification{Valid: true, PaymentID: "pay_1", Amount: req.ExpectedAmount, RequiresCapture: true}, nil
+}
+
+func (c *countingRail) CapturePayment(ctx context.Context, req *CapturePaymentRequest) (*PaymentCapture, error) {
+	c.captured.Add(1)
+	return &PaymentCapture{Success: true, TransactionID: "tx_1", GrossAmount: req.Amount, NetAmount: req.Amount}, nil
+}
+
+func TestComposition_RedundantUnifiedMiddleware(t *testing.T) {
+	rail := &countingRail{EVMCryptoRail: NewEVMCryptoRail("", nil)}
+	registry := NewRailRegistry()
+	registry.Register(rail)
+	config := UnifiedPaymentConfig{Price: "0.01", CryptoEnabled: true, RailRegistry: registry}
+
+	var served atomic.Int64
+	inner := UnifiedPaymentMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}), config)
+	handler := AIAgentPaymentMiddleware(inner, config, AIAgentPaymentConfig{})
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	for _, userAgent := range []string{"Mozilla/5.0", "GPT-Agent/1.0"} {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("User-Agent", userAgent)
+		req.Header.Set("X-PAYMENT", "payload")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the %s request paid, got %d: %s", userAgent, w.Code, w.Body)
+		}
+	}
+
+	if rail.verified.Load() != 2 || rail.captured.Load() != 2 || served.Load() != 2 {
+		t.Errorf("Expected one verification and capture per request, got %d and %d for %d requests",
+			rail.verified.Load(), rail.captured.Load(), served.Load())
+	}
+	if n := strings.Count(logs.String(), "UnifiedPaymentMiddleware middleware is wrapped by"); n != 1 {
+		t.Errorf("Expected the double wrapping logged once, got %d times: %s", n, logs.String())
+	}
+}
+
+func TestComposition_RedundantMultiSchemeMiddleware(t *testing.T) {
+	scheme := &recordingScheme{}
+	registry := NewSchemeRegistry()
+	registry.Register(scheme)
+	config := MultiSchemeConfig{
+		Config: Config{
+			PayTo:                 "0xseller",
+			PricePerRequest:       100,
+			Currency:              "USDC",
+			PaymentRequiredFormat: FormatX402,
+		},
+		AcceptedSchemes:  []SchemeType{SchemeExact},
+		AcceptedNetworks: []NetworkType{NetworkBaseMainnet},
+		SchemeRegistry:   registry,
+	}
+	handler := MultiSchemeMiddleware(MultiSchemeMiddleware(createTestHandler(), config), config)
+
+	payload, _ := json.Marshal(PaymentPayload{Scheme: SchemeExact, Network: NetworkBaseMainnet, Payer: "0xagent"})
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-PAYMENT", base64.StdEncoding.EncodeToString(payload))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the payment accepted, got %d", w.Code)
+	}
+	if len(scheme.verified) != 1 {
+		t.Errorf("Expected one verification, got %d", len(scheme.verified))
+	}
+}
+
+func TestComposition_BudgetPaidRequestsSkipInnerPayment(t *testing.T) {
+	rail := &countingRail{EVMCryptoRail: NewEVMCryptoRail("", nil)}
+	registry := NewRailRegistry()
+	registry.Register(rail)
+	budgets := NewInMemoryPreAuthStore()
+	budgets.Create(&PreAuthBudget{AgentID: "agent-1", TotalBudget: 1000, Remaining: 1000})
+
+	handler := AIFirstMiddleware(UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		Price:         "0.01",
+		CryptoEnabled: true,
+		RailRegistry:  registry,
+	}), AIFirstConfig{EnablePreAuth: true, PreAuthStore: budgets, DefaultCost: 100})
+
+	// Paid from the budget, so the inner middleware doesn't charge again
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-Agent-ID", "agent-1")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("X-Budget-Remaining") != "900" {
+		t.Errorf("Expected the budget-paid request served, got %d with remaining %q", w.Code, w.Header().Get("X-Budget-Remaining"))
+	}
+
+	// Without a budget the inner middleware still asks for payment
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 without a budget, got %d", w.Code)
+	}
+	if rail.verified.Load() != 0 {
+		t.Errorf("Expected no rail verification, got %d", rail.verified.Load())
+	}
+}
@@ -0,0 +1,93 @@
+// Package x402 - Conditional Requests
+// A client re-fetching a resource it already paid for with If-None-Match or
+// If-Modified-Since shouldn't pay again only to learn it hasn't changed.
+// With UnifiedPaymentConfig.FreeRevalidation, a conditional GET or HEAD
+// carrying a valid session, or a payment the rail captures separately, is
+// answered by next into a buffer first. A 304 is sent without counting the
+// session request or capturing the payment; anything else is charged as
+// usual and the buffered response sent once it is.
+package x402
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// PaymentMethodRevalidation is the X-Payment-Method of conditional requests
+// answered 304 without charge
+const PaymentMethodRevalidation = "revalidation"
+
+// conditionalRequest reports whether r is a GET or HEAD that a handler may
+// answer 304 Not Modified
+func conditionalRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+// sessionCovers reports whether session id would cover a request to path by
+// delegate presenting key, without counting the request
+func sessionCovers(store SessionStore, id, path, delegate, key string) bool {
+	session, err := store.GetSession(id)
+	if err != nil {
+		return false
+	}
+	return validateSession(session, path) == nil && checkDelegate(session, delegate, key) == nil
+}
+
+// bufferedResponse holds a handler's response until payment is settled
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// serve sends the buffered response on w, or serves r with next if b is nil
+func (b *bufferedResponse) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if b == nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+	for name, values := range b.header {
+		w.Header()[name] = values
+	}
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	w.WriteHeader(b.status)
+	_, _ = w.Write(b.body.Bytes())
+}
+
+// revalidate serves a conditional r with next into a buffer. A 304 is sent
+// at no charge, attributed to payer, and revalidate returns nil; any other
+// response is returned for sending once the request is paid.
+func revalidate(w http.ResponseWriter, r *http.Request, next http.Handler, audit *AuditLog, rail, payer string) *bufferedResponse {
+	response := &bufferedResponse{header: http.Header{}}
+	next.ServeHTTP(response, r)
+	if response.status != http.StatusNotModified {
+		return response
+	}
+
+	audit.Record(r, AuditEvent{Decision: AuditFree, Reason: PaymentMethodRevalidation, Rail: rail, Payer: payer})
+	w.Header().Set("X-Payment-Method", PaymentMethodRevalidation)
+	info, _ := paymentInfoFor(r)
+	info.Payer = payer
+	response.serve(w, r, next)
+	return nil
+}
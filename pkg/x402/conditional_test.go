@@ -0,0 +1,103 @@
+package x402
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// etagHandler serves a resource with ETag "v1", answering 304 to clients
+// that have it
+func etagHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("resource"))
+	})
+}
+
+func TestFreeRevalidation_NotModifiedIsNotCaptured(t *testing.T) {
+	rail := &countingRail{EVMCryptoRail: NewEVMCryptoRail("", nil)}
+	registry := NewRailRegistry()
+	registry.Register(rail)
+	store := NewInMemoryMeteringStore(0, "USD")
+	handler := MeteringMiddleware(UnifiedPaymentMiddleware(etagHandler(), UnifiedPaymentConfig{
+		Price:            "0.01",
+		CryptoEnabled:    true,
+		RailRegistry:     registry,
+		FreeRevalidation: true,
+	}), MeteringConfig{Store: store, Currency: "USD"})
+
+	fetch := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-PAYMENT", "payload")
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := fetch("")
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"v1"` || w.Body.String() != "resource" {
+		t.Fatalf("Expected the paid resource with its ETag, got %d %q %q", w.Code, w.Header().Get("ETag"), w.Body)
+	}
+
+	w = fetch(w.Header().Get("ETag"))
+	if w.Code != http.StatusNotModified || w.Header().Get("X-Payment-Method") != PaymentMethodRevalidation {
+		t.Fatalf("Expected a free 304, got %d %q", w.Code, w.Header().Get("X-Payment-Method"))
+	}
+	if rail.captured.Load() != 1 {
+		t.Errorf("Expected only the first fetch captured, got %d captures", rail.captured.Load())
+	}
+
+	// A stale ETag gets the resource, and is charged for it
+	w = fetch(`"v0"`)
+	if w.Code != http.StatusOK || w.Body.String() != "resource" || w.Header().Get("X-Payment-Verified") != "true" {
+		t.Errorf("Expected the changed resource served paid, got %d %q", w.Code, w.Body)
+	}
+	if rail.captured.Load() != 2 {
+		t.Errorf("Expected the changed resource captured, got %d captures", rail.captured.Load())
+	}
+
+	report, _ := store.GetMetrics(MetricsFilter{})
+	if report.TotalRequests != 3 || report.ByRail[rail.ID()] == nil || report.ByRail[rail.ID()].Requests != 2 {
+		t.Errorf("Expected 3 requests with 2 paid, got %d with %+v", report.TotalRequests, report.ByRail[rail.ID()])
+	}
+}
+
+func TestFreeRevalidation_SessionRequestNotCounted(t *testing.T) {
+	sessions := NewInMemorySessionStore()
+	sessions.CreateSession(&Session{
+		ID:          "sess_1",
+		Active:      true,
+		SessionType: SessionTypeRequests,
+		MaxRequests: 5,
+		ExpiresAt:   time.Now().Add(time.Hour),
+	})
+	handler := UnifiedPaymentMiddleware(etagHandler(), UnifiedPaymentConfig{
+		Price:            "0.01",
+		CryptoEnabled:    true,
+		RailRegistry:     NewRailRegistry(),
+		EnableSessions:   true,
+		SessionStore:     sessions,
+		FreeRevalidation: true,
+	})
+
+	for _, etag := range []string{`"v1"`, `"v0"`} {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-Session-ID", "sess_1")
+		req.Header.Set("If-None-Match", etag)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	session, _ := sessions.GetSession("sess_1")
+	if session.UsedRequests != 1 {
+		t.Errorf("Expected only the 200 counted against the session, got %d requests", session.UsedRequests)
+	}
+}
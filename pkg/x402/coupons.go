@@ -0,0 +1,252 @@
+// Package x402 - Coupons
+// Promo codes presented with X-Coupon-Code (or ?coupon=) discount the price
+// quoted in the 402 and accepted at verification. A coupon that brings the
+// price to zero skips payment entirely. Redemptions are counted only once a
+// request is actually granted.
+package x402
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Coupon errors, also used as the reason in 402 responses
+var (
+	ErrCouponNotFound   = kindOf(ErrNotFound, "coupon not found")
+	ErrCouponExists     = errors.New("coupon already exists")
+	ErrCouponExpired    = kindOf(ErrExpired, "coupon has expired")
+	ErrCouponExhausted  = errors.New("coupon has no redemptions left")
+	ErrCouponNotAllowed = errors.New("coupon is not valid for this path")
+)
+
+// CouponHeader carries the coupon code; the "coupon" query parameter is
+// accepted too for links
+const CouponHeader = "X-Coupon-Code"
+
+// PaymentMethodCoupon is the X-Payment-Method (and CompletedPayment rail) of
+// requests a coupon made free
+const PaymentMethodCoupon = "coupon"
+
+// Coupon is a promo code discounting the price by a percentage or a fixed
+// amount
+type Coupon struct {
+	Code string `json:"code"` // Case-insensitive, stored upper-case
+
+	// PercentOff discounts by a percentage (1-100); 100 makes requests free
+	PercentOff int `json:"percentOff,omitempty"`
+
+	// AmountOff discounts by a fixed decimal amount of the price's currency
+	// (e.g. "0.50"), converted to each rail's smallest unit like Price
+	AmountOff string `json:"amountOff,omitempty"`
+
+	MaxRedemptions int64      `json:"maxRedemptions,omitempty"` // 0 = unlimited
+	Redemptions    int64      `json:"redemptions"`
+	ExpiresAt      *time.Time `json:"expiresAt,omitempty"`
+
+	// AllowedPaths restricts the coupon to path prefixes (empty = all paths)
+	AllowedPaths []string `json:"allowedPaths,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Discount returns amount (in a unit with the given decimals) after the
+// coupon. Percentages round in the seller's favor; the result is never
+// negative. A nil coupon leaves amount unchanged.
+func (c *Coupon) Discount(amount int64, decimals int) int64 {
+	if c == nil || amount <= 0 {
+		return amount
+	}
+	if c.PercentOff > 0 {
+		return (amount*int64(100-c.PercentOff) + 99) / 100
+	}
+
+	// Extra decimal places can't be charged in this unit; drop them
+	whole, frac, _ := strings.Cut(c.AmountOff, ".")
+	if len(frac) > decimals {
+		frac = frac[:decimals]
+	}
+	off, err := parseDecimalAmount(whole+"."+frac, decimals)
+	if err != nil {
+		return amount
+	}
+	if off >= amount {
+		return 0
+	}
+	return amount - off
+}
+
+// check reports why the coupon cannot be used on path at now, if it can't
+func (c *Coupon) check(path string, now time.Time) error {
+	if c.ExpiresAt != nil && now.After(*c.ExpiresAt) {
+		return ErrCouponExpired
+	}
+	if c.MaxRedemptions > 0 && c.Redemptions >= c.MaxRedemptions {
+		return ErrCouponExhausted
+	}
+	if len(c.AllowedPaths) > 0 && !isExemptPath(path, c.AllowedPaths) {
+		return ErrCouponNotAllowed
+	}
+	return nil
+}
+
+// validate checks a coupon before it is stored
+func (c *Coupon) validate() error {
+	if c.Code == "" {
+		return fmt.Errorf("coupon code is required")
+	}
+	if (c.PercentOff != 0) == (c.AmountOff != "") {
+		return fmt.Errorf("coupon needs exactly one of percentOff or amountOff")
+	}
+	if c.PercentOff < 0 || c.PercentOff > 100 {
+		return fmt.Errorf("percentOff must be between 1 and 100")
+	}
+	if c.AmountOff != "" {
+		if _, err := parseDecimalAmount(c.AmountOff, 18); err != nil {
+			return fmt.Errorf("amountOff: %w", err)
+		}
+	}
+	if c.MaxRedemptions < 0 {
+		return fmt.Errorf("maxRedemptions must not be negative")
+	}
+	return nil
+}
+
+// CouponStore stores coupons. Redeem must validate and count a redemption
+// atomically so MaxRedemptions holds under concurrent requests.
+type CouponStore interface {
+	Create(coupon Coupon) (*Coupon, error)
+	Get(code string) (*Coupon, error)
+	Redeem(code, path string) (*Coupon, error)
+	List() ([]Coupon, error)
+}
+
+// InMemoryCouponStore is an in-memory CouponStore
+type InMemoryCouponStore struct {
+	mu      sync.Mutex
+	coupons map[string]*Coupon
+}
+
+// NewInMemoryCouponStore creates an empty coupon store
+func NewInMemoryCouponStore() *InMemoryCouponStore {
+	return &InMemoryCouponStore{coupons: make(map[string]*Coupon)}
+}
+
+// Create validates and stores a new coupon
+func (s *InMemoryCouponStore) Create(coupon Coupon) (*Coupon, error) {
+	coupon.Code = normalizeCouponCode(coupon.Code)
+	if err := coupon.validate(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.coupons[coupon.Code]; exists {
+		return nil, ErrCouponExists
+	}
+	coupon.Redemptions = 0
+	coupon.CreatedAt = time.Now()
+	coupon.AllowedPaths = append([]string(nil), coupon.AllowedPaths...)
+	s.coupons[coupon.Code] = &coupon
+
+	created := coupon
+	return &created, nil
+}
+
+// Get returns a copy of a coupon
+func (s *InMemoryCouponStore) Get(code string) (*Coupon, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	coupon, ok := s.coupons[normalizeCouponCode(code)]
+	if !ok {
+		return nil, ErrCouponNotFound
+	}
+	found := *coupon
+	return &found, nil
+}
+
+// Redeem checks the coupon for path and counts one redemption
+func (s *InMemoryCouponStore) Redeem(code, path string) (*Coupon, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	coupon, ok := s.coupons[normalizeCouponCode(code)]
+	if !ok {
+		return nil, ErrCouponNotFound
+	}
+	if err := coupon.check(path, time.Now()); err != nil {
+		return nil, err
+	}
+	coupon.Redemptions++
+
+	redeemed := *coupon
+	return &redeemed, nil
+}
+
+// List returns all coupons sorted by code
+func (s *InMemoryCouponStore) List() ([]Coupon, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Coupon, 0, len(s.coupons))
+	for _, coupon := range s.coupons {
+		list = append(list, *coupon)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+	return list, nil
+}
+
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// couponCode returns the coupon code presented with r, if any
+func couponCode(r *http.Request) string {
+	if code := r.Header.Get(CouponHeader); code != "" {
+		return code
+	}
+	return r.URL.Query().Get("coupon")
+}
+
+// requestCoupon returns the usable coupon presented with r. It returns nil,
+// nil when there is no store or no code, and the reason when the code can't
+// be used on this path.
+func requestCoupon(store CouponStore, r *http.Request) (*Coupon, error) {
+	code := couponCode(r)
+	if store == nil || code == "" {
+		return nil, nil
+	}
+	coupon, err := store.Get(code)
+	if err != nil {
+		return nil, err
+	}
+	if err := coupon.check(r.URL.Path, time.Now()); err != nil {
+		return nil, err
+	}
+	return coupon, nil
+}
+
+// couponMetadata tags a payment made with coupon (nil when there is none)
+func couponMetadata(coupon *Coupon) map[string]string {
+	if coupon == nil {
+		return nil
+	}
+	return map[string]string{"coupon": coupon.Code}
+}
+
+// couponMessage explains a coupon that could not be applied in a 402.
+// Store errors other than the coupon errors above are not exposed.
+func couponMessage(err error) string {
+	for _, known := range []error{ErrCouponNotFound, ErrCouponExpired, ErrCouponExhausted, ErrCouponNotAllowed} {
+		if errors.Is(err, known) {
+			return "Coupon cannot be used: " + known.Error()
+		}
+	}
+	return "Coupon cannot be used: coupon could not be checked"
+}
@@ -0,0 +1,326 @@
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCouponDiscount(t *testing.T) {
+	tests := []struct {
+		coupon   Coupon
+		amount   int64
+		decimals int
+		want     int64
+	}{
+		{Coupon{PercentOff: 25}, 100, 2, 75},
+		{Coupon{PercentOff: 33}, 10, 2, 7}, // Rounds up for the seller
+		{Coupon{PercentOff: 100}, 100, 2, 0},
+		{Coupon{AmountOff: "0.25"}, 100, 2, 75},
+		{Coupon{AmountOff: "0.25"}, 1000000, 6, 750000},
+		{Coupon{AmountOff: "0.005"}, 100, 2, 100}, // Sub-cent discount drops
+		{Coupon{AmountOff: "5"}, 100, 2, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.coupon.Discount(tt.amount, tt.decimals); got != tt.want {
+			t.Errorf("Discount(%+v, %d) = %d, expected %d", tt.coupon, tt.amount, got, tt.want)
+		}
+	}
+
+	var none *Coupon
+	if none.Discount(100, 2) != 100 {
+		t.Error("Expected nil coupon to leave the price unchanged")
+	}
+}
+
+func TestCouponStoreCreateValidates(t *testing.T) {
+	store := NewInMemoryCouponStore()
+
+	invalid := []Coupon{
+		{PercentOff: 10},
+		{Code: "BOTH", PercentOff: 10, AmountOff: "1"},
+		{Code: "NONE"},
+		{Code: "TOOMUCH", PercentOff: 101},
+		{Code: "BADAMOUNT", AmountOff: "-1"},
+	}
+	for _, coupon := range invalid {
+		if _, err := store.Create(coupon); err == nil {
+			t.Errorf("Expected %+v to be rejected", coupon)
+		}
+	}
+
+	if _, err := store.Create(Coupon{Code: "launch", PercentOff: 10}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := store.Create(Coupon{Code: "LAUNCH", PercentOff: 20}); err != ErrCouponExists {
+		t.Errorf("Expected ErrCouponExists for a duplicate code, got %v", err)
+	}
+	if coupon, err := store.Get(" Launch "); err != nil || coupon.PercentOff != 10 {
+		t.Errorf("Expected case-insensitive lookup, got %+v, %v", coupon, err)
+	}
+}
+
+func TestCouponExpiry(t *testing.T) {
+	store := NewInMemoryCouponStore()
+	expired := time.Now().Add(-time.Minute)
+	store.Create(Coupon{Code: "OLD", PercentOff: 50, ExpiresAt: &expired})
+
+	if _, err := store.Redeem("OLD", "/api/data"); err != ErrCouponExpired {
+		t.Errorf("Expected ErrCouponExpired, got %v", err)
+	}
+
+	config := testConfig()
+	config.Coupons = store
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set(CouponHeader, "OLD")
+	w := httptest.NewRecorder()
+	Middleware(createTestHandler(), config).ServeHTTP(w, req)
+
+	var response PaymentRequiredResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusPaymentRequired || response.Accepts[0].MaxAmountRequired != "100" {
+		t.Errorf("Expected full-price 402 for an expired coupon, got %d %+v", w.Code, response.Accepts)
+	}
+	if !strings.Contains(response.Error, "coupon has expired") {
+		t.Errorf("Expected 402 error to explain the expired coupon, got %q", response.Error)
+	}
+}
+
+func TestCouponExhaustionIsAtomic(t *testing.T) {
+	store := NewInMemoryCouponStore()
+	store.Create(Coupon{Code: "FIRST10", PercentOff: 100, MaxRedemptions: 10})
+
+	config := testConfig()
+	config.Coupons = store
+	handler := Middleware(createTestHandler(), config)
+
+	var granted int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "/api/data?coupon=first10", nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code == http.StatusOK {
+				atomic.AddInt64(&granted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if granted != 10 {
+		t.Errorf("Expected exactly 10 free requests, got %d", granted)
+	}
+	coupon, _ := store.Get("FIRST10")
+	if coupon.Redemptions != 10 {
+		t.Errorf("Expected 10 redemptions, got %d", coupon.Redemptions)
+	}
+	if _, err := store.Redeem("FIRST10", "/api/data"); err != ErrCouponExhausted {
+		t.Errorf("Expected ErrCouponExhausted, got %v", err)
+	}
+}
+
+func TestCouponPathRestriction(t *testing.T) {
+	store := NewInMemoryCouponStore()
+	store.Create(Coupon{Code: "REPORTS", PercentOff: 50, AllowedPaths: []string{"/api/reports/"}})
+
+	config := testConfig()
+	config.Coupons = store
+	handler := Middleware(createTestHandler(), config)
+
+	for path, want := range map[string]string{"/api/reports/q3": "50", "/api/data": "100"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set(CouponHeader, "REPORTS")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		var response PaymentRequiredResponse
+		json.NewDecoder(w.Body).Decode(&response)
+		if response.Accepts[0].MaxAmountRequired != want {
+			t.Errorf("Expected %s on %s, got %s", want, path, response.Accepts[0].MaxAmountRequired)
+		}
+	}
+
+	if _, err := store.Redeem("REPORTS", "/api/data"); err != ErrCouponNotAllowed {
+		t.Errorf("Expected ErrCouponNotAllowed, got %v", err)
+	}
+}
+
+func TestCouponRedeemedOnlyAfterPayment(t *testing.T) {
+	store := NewInMemoryCouponStore()
+	store.Create(Coupon{Code: "HALF", PercentOff: 50, MaxRedemptions: 1})
+
+	ledger := NewInMemoryPaymentLedger(10)
+	config := testConfig()
+	config.Coupons = store
+	config.Ledger = ledger
+	handler := Middleware(createTestHandler(), config)
+
+	// Asking for the price doesn't use the coupon up
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set(CouponHeader, "HALF")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set(CouponHeader, "HALF")
+	req.Header.Set("Authorization", "Bearer valid_token")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 with payment and coupon, got %d", w.Code)
+	}
+
+	records, _ := ledger.List(LedgerFilter{})
+	if len(records) != 1 || records[0].Amount != 50 || records[0].Metadata["coupon"] != "HALF" {
+		t.Errorf("Expected discounted ledger entry tagged with the coupon, got %+v", records)
+	}
+	if coupon, _ := store.Get("HALF"); coupon.Redemptions != 1 {
+		t.Errorf("Expected 1 redemption, got %d", coupon.Redemptions)
+	}
+}
+
+func TestFreeCouponRecordsZeroAmountPayment(t *testing.T) {
+	store := NewInMemoryCouponStore()
+	store.Create(Coupon{Code: "FREE", PercentOff: 100})
+
+	var completed *CompletedPayment
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		Price:            "0.01",
+		Currency:         "USD",
+		CryptoEnabled:    true,
+		CryptoPayTo:      "0xseller",
+		CryptoNetworks:   []NetworkType{NetworkBaseSepolia},
+		RailRegistry:     NewRailRegistry(),
+		Coupons:          store,
+		OnPaymentSuccess: func(ctx context.Context, payment *CompletedPayment) { completed = payment },
+	})
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set(CouponHeader, "FREE")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || w.Header().Get("X-Payment-Method") != "coupon" {
+		t.Fatalf("Expected free access via coupon, got %d", w.Code)
+	}
+	if completed == nil || completed.Amount != 0 || completed.Rail != "coupon" || completed.Metadata["coupon"] != "FREE" {
+		t.Errorf("Expected zero-amount coupon payment, got %+v", completed)
+	}
+}
+
+func TestUnifiedCouponDiscountsEveryRail(t *testing.T) {
+	// Stripe serves a succeeded payment of half the price
+	stripeAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`{"id":"pi_half","amount":50,"currency":"usd","status":"succeeded"}`))
+			return
+		}
+		_ = r.ParseForm()
+		fmt.Fprintf(w, `{"id":"pi_new","amount":%s,"currency":"usd","status":"requires_payment_method","client_secret":"secret"}`, r.Form.Get("amount"))
+	}))
+	defer stripeAPI.Close()
+
+	stripe := NewStripeRail("sk_test", "")
+	stripe.BaseURL = stripeAPI.URL
+	registry := NewRailRegistry()
+	registry.Register(stripe)
+
+	store := NewInMemoryCouponStore()
+	store.Create(Coupon{Code: "HALF", PercentOff: 50})
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		Price:          "1.00",
+		Currency:       "USD",
+		CryptoEnabled:  true,
+		CryptoPayTo:    "0xseller",
+		CryptoNetworks: []NetworkType{NetworkBaseSepolia},
+		FiatEnabled:    true,
+		RailRegistry:   registry,
+		Coupons:        store,
+	})
+
+	req := httptest.NewRequest("GET", "/api/data?coupon=HALF", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var response PaymentOptionsResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response.Accepts[0].MaxAmountRequired != "500000" {
+		t.Errorf("Expected discounted crypto amount 500000, got %s", response.Accepts[0].MaxAmountRequired)
+	}
+	for _, option := range response.Options {
+		if option.Rail == RailStripe && option.Amount != 50 {
+			t.Errorf("Expected discounted Stripe amount 50, got %d", option.Amount)
+		}
+	}
+
+	// Half the price is accepted with the coupon and refused without it
+	req = httptest.NewRequest("GET", "/api/data?coupon=HALF", nil)
+	req.Header.Set("X-STRIPE-PAYMENT-INTENT", "pi_half")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("X-Coupon-Applied") != "HALF" {
+		t.Errorf("Expected discounted payment to be accepted, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-STRIPE-PAYMENT-INTENT", "pi_half")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected half payment without coupon to be refused, got %d", w.Code)
+	}
+}
+
+func TestFreeCouponRecordedInLedger(t *testing.T) {
+	store := NewInMemoryCouponStore()
+	store.Create(Coupon{Code: "FREE", PercentOff: 100})
+	ledger := NewInMemoryPaymentLedger(0)
+
+	var reported RequestPaymentInfo
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reported, _ = PaymentInfoFromRequest(r)
+	})
+	handlers := map[string]http.Handler{
+		"multi-scheme": MultiSchemeMiddleware(next, MultiSchemeConfig{
+			Config:         Config{PricePerRequest: 100, PayTo: "0xseller", Network: "base-sepolia", Coupons: store, Ledger: ledger},
+			SchemeRegistry: NewSchemeRegistry(),
+		}),
+		"unified": UnifiedPaymentMiddleware(next, UnifiedPaymentConfig{
+			Price:          "0.01",
+			Currency:       "USD",
+			CryptoEnabled:  true,
+			CryptoPayTo:    "0xseller",
+			CryptoNetworks: []NetworkType{NetworkBaseSepolia},
+			RailRegistry:   NewRailRegistry(),
+			Coupons:        store,
+			Ledger:         ledger,
+		}),
+	}
+	for name, handler := range handlers {
+		reported = RequestPaymentInfo{}
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set(CouponHeader, "FREE")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		record, err := ledger.Get(reported.PaymentID)
+		if !reported.Paid || reported.Type != PaymentMethodCoupon || err != nil {
+			t.Errorf("%s: expected a coupon payment linked to the ledger, got %+v (%v)", name, reported, err)
+			continue
+		}
+		if record.Amount != 0 || record.Scheme != PaymentMethodCoupon || record.Metadata["coupon"] != "FREE" {
+			t.Errorf("%s: expected a zero-amount coupon record, got %+v", name, record)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Package x402 - Currency Conversion
+// Lets a seller price in one currency and accept payments in others. Amounts
+// are always in each currency's smallest unit (cents, 6-decimal USDC units).
+package x402
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// CurrencyConverter converts amounts between currencies. Implement it to plug
+// in live exchange rates.
+type CurrencyConverter interface {
+	Convert(ctx context.Context, amount int64, from, to string) (int64, error)
+}
+
+// CurrencyConverterFunc adapts a function to CurrencyConverter
+type CurrencyConverterFunc func(ctx context.Context, amount int64, from, to string) (int64, error)
+
+// Convert calls f
+func (f CurrencyConverterFunc) Convert(ctx context.Context, amount int64, from, to string) (int64, error) {
+	return f(ctx, amount, from, to)
+}
+
+// StaticRates converts with fixed rates. Rates[c] is how many whole units of
+// c one whole unit of Base buys, e.g. Base "USD" with Rates{"EUR": 0.92}.
+type StaticRates struct {
+	Base  string
+	Rates map[string]float64
+}
+
+// NewStaticRates creates a converter with fixed rates against base. Base
+// itself always has rate 1.
+func NewStaticRates(base string, rates map[string]float64) *StaticRates {
+	normalized := map[string]float64{strings.ToUpper(base): 1}
+	for currency, rate := range rates {
+		normalized[strings.ToUpper(currency)] = rate
+	}
+	return &StaticRates{Base: strings.ToUpper(base), Rates: normalized}
+}
+
+// Convert converts amount (smallest unit of from) to the smallest unit of to,
+// rounding down so a payment is never credited more than it is worth
+func (s *StaticRates) Convert(ctx context.Context, amount int64, from, to string) (int64, error) {
+	from, to = strings.ToUpper(from), strings.ToUpper(to)
+	if from == to {
+		return amount, nil
+	}
+
+	fromRate, ok := s.Rates[from]
+	if !ok || fromRate <= 0 {
+		return 0, fmt.Errorf("no rate for %s", from)
+	}
+	toRate, ok := s.Rates[to]
+	if !ok || toRate <= 0 {
+		return 0, fmt.Errorf("no rate for %s", to)
+	}
+
+	// amount / 10^dec(from) / fromRate * toRate * 10^dec(to)
+	value := new(big.Rat).SetInt64(amount)
+	value.Mul(value, decimalRat(toRate))
+	value.Quo(value, decimalRat(fromRate))
+	value.Mul(value, new(big.Rat).SetFrac(pow10(currencyDecimals(to)), pow10(currencyDecimals(from))))
+
+	converted := new(big.Int).Quo(value.Num(), value.Denom())
+	if !converted.IsInt64() {
+		return 0, fmt.Errorf("converted amount out of range")
+	}
+	return converted.Int64(), nil
+}
+
+// decimalRat returns rate as the decimal it was written as (0.92 = 23/25),
+// not its binary approximation, so round trips don't lose a unit
+func decimalRat(rate float64) *big.Rat {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(rate, 'f', -1, 64))
+	return r
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// meetsPrice reports whether converted covers expected within tolerance
+// (a fraction, e.g. 0.01 accepts payments up to 1% short)
+func meetsPrice(converted, expected int64, tolerance float64) bool {
+	shortfall := int64(float64(expected) * tolerance)
+	return converted >= expected-shortfall
+}
+
+// convertVerification re-judges a payment refused for currency mismatch by
+// its value in config.Currency. It reports whether the payment was accepted;
+// otherwise verification explains the shortfall.
+func convertVerification(ctx context.Context, config UnifiedPaymentConfig, verification *PaymentVerification, expected int64) bool {
+	converted, err := config.CurrencyConverter.Convert(ctx, verification.Amount, verification.Currency, config.Currency)
+	if err != nil {
+		verification.Message = fmt.Sprintf("cannot convert %s to %s: %v", verification.Currency, config.Currency, err)
+		return false
+	}
+
+	if !meetsPrice(converted, expected, config.CurrencyTolerance) {
+		verification.Reason = FailureAmountMismatch
+		verification.Message = fmt.Sprintf("%d %s converts to %d %s", verification.Amount, verification.Currency, converted, config.Currency)
+		verification.Amount = converted
+		return false
+	}
+
+	verification.Valid = true
+	verification.Reason = ""
+	return true
+}
+
+// localQuote converts amount (in c.Currency) to the rail's local currency
+// from RailCurrencies, rounded up so the quote converts back to at least the
+// price. Without a local currency or converter it returns amount unchanged.
+func (c UnifiedPaymentConfig) localQuote(ctx context.Context, railID string, amount int64) (int64, string) {
+	local := c.RailCurrencies[railID]
+	if local == "" || c.CurrencyConverter == nil || strings.EqualFold(local, c.Currency) {
+		return amount, c.Currency
+	}
+
+	quote, err := c.CurrencyConverter.Convert(ctx, amount, c.Currency, local)
+	if err != nil {
+		return amount, c.Currency
+	}
+	// Conversion rounds down; step up until the quote covers the price
+	for i := 0; i < 3; i++ {
+		back, err := c.CurrencyConverter.Convert(ctx, quote, local, c.Currency)
+		if err != nil || back >= amount {
+			break
+		}
+		quote++
+	}
+	return quote, strings.ToUpper(local)
+}
@@ -0,0 +1,272 @@
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestStaticRatesConvert(t *testing.T) {
+	rates := NewStaticRates("USD", map[string]float64{"EUR": 0.92, "USDC": 1, "JPY": 150})
+	ctx := context.Background()
+
+	tests := []struct {
+		amount   int64
+		from, to string
+		want     int64
+	}{
+		{100, "USD", "EUR", 92},
+		{92, "EUR", "USD", 100},
+		{100, "usd", "USDC", 1000000},
+		{100, "USD", "JPY", 150},
+		{50, "EUR", "EUR", 50},
+	}
+	for _, tt := range tests {
+		got, err := rates.Convert(ctx, tt.amount, tt.from, tt.to)
+		if err != nil || got != tt.want {
+			t.Errorf("Convert(%d, %s, %s) = %d, %v; expected %d", tt.amount, tt.from, tt.to, got, err, tt.want)
+		}
+	}
+
+	if _, err := rates.Convert(ctx, 100, "USD", "GBP"); err == nil {
+		t.Error("Expected error for currency without a rate")
+	}
+}
+
+// newEURStripe serves a succeeded EUR payment intent of paid cents and
+// records the currency of created intents
+func newEURStripe(t *testing.T, paid int64, created *string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodGet {
+			fmt.Fprintf(w, `{"id":"pi_eur","amount":%d,"currency":"eur","status":"succeeded"}`, paid)
+			return
+		}
+		_ = r.ParseForm()
+		if created != nil {
+			*created = r.Form.Get("currency")
+		}
+		fmt.Fprintf(w, `{"id":"pi_new","amount":%s,"currency":"%s","status":"requires_payment_method","client_secret":"secret"}`, r.Form.Get("amount"), r.Form.Get("currency"))
+	}))
+}
+
+func newEURHandler(stripeURL string, failures chan *PaymentFailure) http.Handler {
+	stripe := NewStripeRail("sk_test", "")
+	stripe.BaseURL = stripeURL
+	registry := NewRailRegistry()
+	registry.Register(stripe)
+
+	return UnifiedPaymentMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), UnifiedPaymentConfig{
+		Price:             "1.00",
+		Currency:          "USD",
+		FiatEnabled:       true,
+		RailRegistry:      registry,
+		CurrencyConverter: NewStaticRates("USD", map[string]float64{"EUR": 0.92}),
+		CurrencyTolerance: 0.01,
+		RailCurrencies:    map[string]string{RailStripe: "EUR"},
+		OnPaymentFailure: func(ctx context.Context, failure *PaymentFailure) {
+			if failures != nil {
+				failures <- failure
+			}
+		},
+	})
+}
+
+func TestEURPaymentAgainstUSDPrice(t *testing.T) {
+	stripeAPI := newEURStripe(t, 92, nil)
+	defer stripeAPI.Close()
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-STRIPE-PAYMENT-INTENT", "pi_eur")
+	rr := httptest.NewRecorder()
+	newEURHandler(stripeAPI.URL, nil).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected 0.92 EUR to cover a 1.00 USD price, got %d", rr.Code)
+	}
+}
+
+func TestEURPaymentInsufficientAfterConversion(t *testing.T) {
+	stripeAPI := newEURStripe(t, 85, nil)
+	defer stripeAPI.Close()
+
+	failures := make(chan *PaymentFailure, 1)
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-STRIPE-PAYMENT-INTENT", "pi_eur")
+	failure, _ := serveFailure(t, newEURHandler(stripeAPI.URL, failures), req, failures)
+
+	if failure.Reason != FailureAmountMismatch {
+		t.Errorf("Expected amount_mismatch, got %s", failure.Reason)
+	}
+	// 0.85 EUR is 0.92 USD, below the 0.99 USD accepted with 1% tolerance
+	if failure.PresentedAmount != 92 || failure.ExpectedAmount != 100 {
+		t.Errorf("Expected converted 92 vs 100, got %d vs %d", failure.PresentedAmount, failure.ExpectedAmount)
+	}
+}
+
+func TestStripeOptionQuotedInLocalCurrency(t *testing.T) {
+	var created string
+	stripeAPI := newEURStripe(t, 0, &created)
+	defer stripeAPI.Close()
+
+	rr := httptest.NewRecorder()
+	newEURHandler(stripeAPI.URL, nil).ServeHTTP(rr, httptest.NewRequest("GET", "/api/data", nil))
+
+	var response PaymentOptionsResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(response.Options) != 1 || response.Options[0].Currency != "EUR" || response.Options[0].Amount != 92 {
+		t.Errorf("Expected Stripe option of 92 EUR, got %+v", response.Options)
+	}
+	if created != "eur" {
+		t.Errorf("Expected payment intent in eur, got %q", created)
+	}
+}
+
+func TestCurrencyDecimalsFollowISO4217(t *testing.T) {
+	for currency, want := range map[string]int{"USD": 2, "eur": 2, "JPY": 0, "KRW": 0, "KWD": 3, "bhd": 3, "USDC": 6} {
+		if got := currencyDecimals(currency); got != want {
+			t.Errorf("Expected %s to have %d decimals, got %d", currency, want, got)
+		}
+	}
+}
+
+// newIntentStripe serves one payment intent of amount in currency and
+// records the forms posted to it
+func newIntentStripe(t *testing.T, currency string, amount int64, status string, forms *[]url.Values) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost {
+			_ = r.ParseForm()
+			*forms = append(*forms, r.PostForm)
+			if strings.HasSuffix(r.URL.Path, "/capture") {
+				status = "succeeded"
+			} else {
+				fmt.Fprintf(w, `{"id":"pi_new","amount":%s,"currency":"%s","status":"requires_payment_method","client_secret":"secret"}`, r.PostForm.Get("amount"), r.PostForm.Get("currency"))
+				return
+			}
+		}
+		fmt.Fprintf(w, `{"id":"pi_1","amount":%d,"currency":"%s","status":"%s"}`, amount, currency, status)
+	}))
+}
+
+func TestStripeVerifyComparesMinorUnitsOfOneCurrency(t *testing.T) {
+	tests := []struct {
+		currency   string
+		paid       int64
+		expected   string
+		amount     int64
+		wantReason string
+	}{
+		{"jpy", 100, "USD", 100, FailureCurrencyMismatch}, // 100 yen is not a dollar
+		{"jpy", 100, "JPY", 100, ""},
+		{"jpy", 99, "JPY", 100, FailureAmountMismatch},
+		{"kwd", 1005, "KWD", 1005, ""},
+		{"kwd", 1000, "KWD", 1005, FailureAmountMismatch},
+		{"kwd", 1000, "BHD", 1000, FailureCurrencyMismatch},
+		{"usd", 100, "USD", 100, ""},
+		{"usd", 100, "", 100, FailureCurrencyMismatch},
+	}
+	for _, tt := range tests {
+		var forms []url.Values
+		stripeAPI := newIntentStripe(t, tt.currency, tt.paid, "succeeded", &forms)
+		rail := NewStripeRail("sk_test", "")
+		rail.BaseURL = stripeAPI.URL
+
+		verification, err := rail.VerifyPayment(context.Background(), &VerifyPaymentRequest{
+			PaymentIntentID:  "pi_1",
+			ExpectedAmount:   tt.amount,
+			ExpectedCurrency: tt.expected,
+		})
+		stripeAPI.Close()
+		if err != nil {
+			t.Fatalf("VerifyPayment failed: %v", err)
+		}
+		if verification.Reason != tt.wantReason || verification.Valid != (tt.wantReason == "") {
+			t.Errorf("%d %s against %d %q: expected reason %q, got %q", tt.paid, tt.currency, tt.amount, tt.expected, tt.wantReason, verification.Reason)
+		}
+	}
+}
+
+func TestUnifiedConvertsAcrossMinorUnits(t *testing.T) {
+	tests := []struct {
+		currency  string
+		paid      int64
+		converter CurrencyConverter
+		wantCode  int
+	}{
+		{"jpy", 150, NewStaticRates("USD", map[string]float64{"JPY": 150}), http.StatusOK},
+		{"jpy", 100, NewStaticRates("USD", map[string]float64{"JPY": 150}), http.StatusPaymentRequired},
+		{"jpy", 150, nil, http.StatusPaymentRequired},
+		{"kwd", 307, NewStaticRates("USD", map[string]float64{"KWD": 0.307}), http.StatusOK},
+		{"kwd", 300, NewStaticRates("USD", map[string]float64{"KWD": 0.307}), http.StatusPaymentRequired},
+	}
+	for _, tt := range tests {
+		var forms []url.Values
+		stripeAPI := newIntentStripe(t, tt.currency, tt.paid, "succeeded", &forms)
+		stripe := NewStripeRail("sk_test", "")
+		stripe.BaseURL = stripeAPI.URL
+		registry := NewRailRegistry()
+		registry.Register(stripe)
+		handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+			Price:             "1.00",
+			Currency:          "USD",
+			FiatEnabled:       true,
+			RailRegistry:      registry,
+			CurrencyConverter: tt.converter,
+		})
+
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-STRIPE-PAYMENT-INTENT", "pi_1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		stripeAPI.Close()
+		if w.Code != tt.wantCode {
+			t.Errorf("%d %s against 1.00 USD (converter %v): expected %d, got %d", tt.paid, tt.currency, tt.converter != nil, tt.wantCode, w.Code)
+		}
+	}
+}
+
+func TestStripeChargesThreeDecimalCurrenciesInHundredths(t *testing.T) {
+	var forms []url.Values
+	stripeAPI := newIntentStripe(t, "kwd", 1010, "requires_capture", &forms)
+	defer stripeAPI.Close()
+	stripe := NewStripeRail("sk_test", "")
+	stripe.BaseURL = stripeAPI.URL
+	registry := NewRailRegistry()
+	registry.Register(stripe)
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		Price:        "1.005",
+		Currency:     "KWD",
+		FiatEnabled:  true,
+		RailRegistry: registry,
+	})
+
+	// The quote and intent round 1.005 KWD up to 1.010
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+	var response PaymentOptionsResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if len(response.Options) != 1 || response.Options[0].Amount != 1010 || forms[0].Get("amount") != "1010" {
+		t.Fatalf("Expected a 1010 fils Stripe option and intent, got %+v and %v", response.Options, forms)
+	}
+
+	// So does a capture
+	capture, err := stripe.CapturePayment(context.Background(), &CapturePaymentRequest{PaymentID: "pi_1", Amount: 1005, Currency: "KWD"})
+	if err != nil || !capture.Success {
+		t.Fatalf("Expected the payment captured, got %+v, %v", capture, err)
+	}
+	if got := forms[len(forms)-1].Get("amount_to_capture"); got != "1010" {
+		t.Errorf("Expected 1010 fils captured, got %q", got)
+	}
+}
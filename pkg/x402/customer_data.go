@@ -0,0 +1,193 @@
+// Package x402 - Customer Data Requests
+// Customers can have their saved payment preferences erased and get a copy
+// of what the seller holds about them: their preferences and their ledger
+// entries. Erasing also detaches their saved Stripe payment method, so it
+// can't be charged off-session afterwards. Requests must be authenticated as
+// the customer (OnboardingHandler.Authenticate) or carry the admin key.
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// PaymentPrefsLister is implemented by preference stores that can page
+// through every customer, for the admin API. Listings are ordered by
+// CreatedAt, then customer ID.
+type PaymentPrefsLister interface {
+	ListPrefs(ctx context.Context, pageToken string, limit int) ([]*CustomerPaymentPrefs, string, error)
+}
+
+// PaymentMethodDetacher is implemented by rails that can detach a saved
+// payment method from its customer, e.g. StripeRail
+type PaymentMethodDetacher interface {
+	DetachPaymentMethod(ctx context.Context, paymentMethodID string) error
+}
+
+// DetachPaymentMethod detaches a saved payment method from its Stripe
+// customer. A payment method Stripe no longer knows is already detached.
+func (s *StripeRail) DetachPaymentMethod(ctx context.Context, paymentMethodID string) error {
+	var detached struct {
+		ID string `json:"id"`
+	}
+	err := s.postForm(ctx, "/payment_methods/"+url.PathEscape(paymentMethodID)+"/detach", url.Values{}, &detached)
+	var stripeErr *StripeError
+	if errors.As(err, &stripeErr) && stripeErr.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// CustomerDataExport is everything held about a customer
+type CustomerDataExport struct {
+	CustomerID  string                `json:"customerId"`
+	ExportedAt  time.Time             `json:"exportedAt"`
+	Preferences *CustomerPaymentPrefs `json:"preferences"`          // nil if none are saved
+	Payments    []PaymentRecord       `json:"payments"`             // Ledger entries, newest first
+	PayerIDs    []string              `json:"payerIds,omitempty"`   // Identities the payments were looked up by
+	LedgerNote  string                `json:"ledgerNote,omitempty"` // Why payments may be missing
+}
+
+// authorizeCustomer reports whether r may read or erase customerID's data:
+// as that customer, or as an admin
+func (h *OnboardingHandler) authorizeCustomer(r *http.Request, customerID string) bool {
+	if adminAuthorized(r, h.AdminKey) {
+		return true
+	}
+	return h.Authenticate != nil && customerID != "" && h.Authenticate(r) == customerID
+}
+
+// customerRequest reads ?customerId= and checks the caller may act on it,
+// answering the request if not
+func (h *OnboardingHandler) customerRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	w.Header().Set("Cache-Control", "no-store")
+	customerID := r.URL.Query().Get("customerId")
+	if customerID == "" {
+		http.Error(w, "customerId required", http.StatusBadRequest)
+		return "", false
+	}
+	if !h.authorizeCustomer(r, customerID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", false
+	}
+	return customerID, true
+}
+
+// DeletePreferences erases a customer's payment preferences
+// (DELETE ?customerId=...), first detaching their saved payment method from
+// the rail it was saved on. If detaching fails nothing is erased, so the
+// request can be retried.
+func (h *OnboardingHandler) DeletePreferences(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := h.customerRequest(w, r)
+	if !ok {
+		return
+	}
+	store := h.config.Tenants.prefsFor(r, h.prefs)
+
+	prefs, err := store.Get(r.Context(), customerID)
+	if err != nil {
+		http.Error(w, "Failed to get preferences", http.StatusInternalServerError)
+		return
+	}
+	detached := false
+	if prefs != nil && prefs.PaymentMethodID != "" {
+		rail, _ := h.registry.Get(RailStripe)
+		detacher, ok := rail.(PaymentMethodDetacher)
+		if !ok {
+			http.Error(w, "Saved payment method cannot be detached: Stripe rail not configured", http.StatusServiceUnavailable)
+			return
+		}
+		if err := detacher.DetachPaymentMethod(r.Context(), prefs.PaymentMethodID); err != nil {
+			http.Error(w, "Failed to detach saved payment method", http.StatusBadGateway)
+			return
+		}
+		detached = true
+	}
+	if err := store.Delete(r.Context(), customerID); err != nil {
+		http.Error(w, "Failed to delete preferences", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"deleted":               prefs != nil,
+		"paymentMethodDetached": detached,
+	})
+}
+
+// ExportPreferences returns a customer's CustomerDataExport
+// (GET ?customerId=...), for data-subject access requests
+func (h *OnboardingHandler) ExportPreferences(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := h.customerRequest(w, r)
+	if !ok {
+		return
+	}
+
+	prefs, err := h.config.Tenants.prefsFor(r, h.prefs).Get(r.Context(), customerID)
+	if err != nil {
+		http.Error(w, "Failed to get preferences", http.StatusInternalServerError)
+		return
+	}
+	export := CustomerDataExport{
+		CustomerID:  customerID,
+		ExportedAt:  time.Now().UTC(),
+		Preferences: prefs,
+		Payments:    []PaymentRecord{},
+	}
+
+	if h.Ledger == nil {
+		export.LedgerNote = "no payment ledger is configured"
+	} else {
+		export.PayerIDs = customerPayerIDs(customerID, prefs)
+		export.Payments, err = customerPayments(h.Ledger, export.PayerIDs)
+		if err != nil {
+			http.Error(w, "Failed to load payments", errorStatus(err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="customer-data.json"`)
+	_ = json.NewEncoder(w).Encode(export)
+}
+
+// customerPayerIDs are the ledger payer IDs a customer may have paid as:
+// their customer ID, Stripe customer and crypto address
+func customerPayerIDs(customerID string, prefs *CustomerPaymentPrefs) []string {
+	ids := []string{customerID}
+	if prefs != nil {
+		for _, id := range []string{prefs.StripeCustomerID, prefs.CryptoAddress} {
+			if id != "" && id != customerID {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// customerPayments returns the ledger records of any of payerIDs, newest
+// first, each once
+func customerPayments(ledger PaymentLedger, payerIDs []string) ([]PaymentRecord, error) {
+	history := PaymentHistoryConfig{Ledger: ledger}
+	payments := []PaymentRecord{}
+	seen := map[string]bool{}
+	for _, payer := range payerIDs {
+		records, err := history.payerRecords(payer)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			if !seen[record.ID] {
+				seen[record.ID] = true
+				payments = append(payments, record)
+			}
+		}
+	}
+	sort.Slice(payments, func(i, j int) bool { return recordKey(payments[j]).before(recordKey(payments[i])) })
+	return payments, nil
+}
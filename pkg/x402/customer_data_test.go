@@ -0,0 +1,145 @@
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// customerDataHandler mounts onboarding for alice, who saved a card, with
+// requests authenticated by X-Test-Customer. Stripe detach calls are
+// recorded in detached.
+func customerDataHandler(t *testing.T, ledger PaymentLedger) (http.Handler, *InMemoryPaymentPrefsStore, *[]string) {
+	t.Helper()
+	var detached []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		detached = append(detached, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"pm_alice","customer":null}`))
+	}))
+	t.Cleanup(api.Close)
+
+	stripe := NewStripeRail("sk_test", "")
+	stripe.BaseURL = api.URL
+	registry := NewRailRegistry()
+	registry.Register(stripe)
+
+	prefs := NewInMemoryPaymentPrefsStore()
+	prefs.Set(context.Background(), &CustomerPaymentPrefs{
+		CustomerID:       "alice",
+		PreferredRail:    RailStripe,
+		StripeCustomerID: "cus_alice",
+		PaymentMethodID:  "pm_alice",
+		CryptoAddress:    "0xa11ce",
+	})
+
+	onboarding := NewOnboardingHandler(UnifiedPaymentConfig{RailRegistry: registry, PaymentPrefs: prefs}, nil)
+	onboarding.AdminKey = "admin-secret"
+	onboarding.Authenticate = CustomerFromHeader("X-Test-Customer")
+	onboarding.Ledger = ledger
+
+	mux := http.NewServeMux()
+	if _, err := MountStandardEndpoints(mux, StandardEndpointDeps{Onboarding: onboarding}, MountOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return mux, prefs, &detached
+}
+
+func customerRequest(handler http.Handler, method, path, customer string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if customer != "" {
+		req.Header.Set("X-Test-Customer", customer)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestOnboarding_DeletePreferences(t *testing.T) {
+	handler, _, detached := customerDataHandler(t, nil)
+
+	if w := customerRequest(handler, "DELETE", "/x402/onboarding/preferences?customerId=alice", "mallory"); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected another customer to be refused, got %d", w.Code)
+	}
+
+	w := customerRequest(handler, "DELETE", "/x402/onboarding/preferences?customerId=alice", "alice")
+	var deleted map[string]bool
+	json.NewDecoder(w.Body).Decode(&deleted)
+	if w.Code != http.StatusOK || !deleted["deleted"] || !deleted["paymentMethodDetached"] {
+		t.Fatalf("Expected the preferences deleted, got %d %v", w.Code, deleted)
+	}
+	if len(*detached) != 1 || (*detached)[0] != "POST /payment_methods/pm_alice/detach" {
+		t.Errorf("Expected the saved card detached, got %v", *detached)
+	}
+
+	w = customerRequest(handler, "GET", "/x402/onboarding/preferences?customerId=alice", "alice")
+	var got map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&got)
+	if got["hasPreferences"] != false {
+		t.Errorf("Expected hasPreferences=false after deleting, got %v", got)
+	}
+}
+
+func TestOnboarding_ExportPreferences(t *testing.T) {
+	ledger := NewInMemoryPaymentLedger(10)
+	now := time.Now()
+	ledger.Record(PaymentRecord{Timestamp: now.Add(-2 * time.Minute), Endpoint: "/api/a", PayerID: "cus_alice", Amount: 100, Currency: "USD", Status: PaymentStatusSettled})
+	ledger.Record(PaymentRecord{Timestamp: now.Add(-time.Minute), Endpoint: "/api/b", PayerID: "0xa11ce", Amount: 10000, Currency: "USDC", Status: PaymentStatusSettled})
+	ledger.Record(PaymentRecord{Timestamp: now, Endpoint: "/api/c", PayerID: "cus_bob", Amount: 100, Currency: "USD", Status: PaymentStatusSettled})
+	handler, _, _ := customerDataHandler(t, ledger)
+
+	if w := customerRequest(handler, "GET", "/x402/onboarding/preferences/export?customerId=alice", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected an unauthenticated export to be refused, got %d", w.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/x402/onboarding/preferences/export?customerId=alice", nil)
+	req.Header.Set("X-Admin-Key", "admin-secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var export CustomerDataExport
+	if err := json.NewDecoder(w.Body).Decode(&export); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected an export for the admin, got %d: %v", w.Code, err)
+	}
+	if export.Preferences == nil || export.Preferences.PaymentMethodID != "pm_alice" {
+		t.Errorf("Expected alice's preferences, got %+v", export.Preferences)
+	}
+	if len(export.Payments) != 2 || export.Payments[0].Endpoint != "/api/b" || export.Payments[1].Endpoint != "/api/a" {
+		t.Errorf("Expected alice's card and crypto payments, newest first, got %+v", export.Payments)
+	}
+}
+
+func TestAdminHandler_ListPreferences(t *testing.T) {
+	prefs := NewInMemoryPaymentPrefsStore()
+	for i, customer := range []string{"a", "b", "c"} {
+		prefs.Set(context.Background(), &CustomerPaymentPrefs{CustomerID: customer, CreatedAt: time.Unix(int64(i), 0)})
+	}
+	admin := AdminHandler(AdminDeps{APIKey: "k", Prefs: prefs})
+
+	list := func(query string) (ids []string, next string) {
+		req := httptest.NewRequest("GET", "/admin/preferences"+query, nil)
+		req.Header.Set("X-Admin-Key", "k")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		var page struct {
+			Preferences   []CustomerPaymentPrefs `json:"preferences"`
+			NextPageToken string                 `json:"nextPageToken"`
+		}
+		json.NewDecoder(w.Body).Decode(&page)
+		for _, p := range page.Preferences {
+			ids = append(ids, p.CustomerID)
+		}
+		return ids, page.NextPageToken
+	}
+
+	first, next := list("?limit=2")
+	if len(first) != 2 || first[0] != "a" || first[1] != "b" || next == "" {
+		t.Fatalf("Expected the first page a, b, got %v (%q)", first, next)
+	}
+	second, next := list("?limit=2&pageToken=" + next)
+	if len(second) != 1 || second[0] != "c" || next != "" {
+		t.Errorf("Expected the last page c, got %v (%q)", second, next)
+	}
+}
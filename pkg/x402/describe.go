@@ -0,0 +1,232 @@
+// Package x402 - Described Routes
+// Endpoint prices and schemas used to be listed in AIFirstConfig.Endpoints,
+// apart from the mux routes serving them, and drifted as routes were renamed.
+// Describe attaches them to the ServeMux pattern instead. DescribedEndpoints
+// hands the one list to AIFirstConfig, discovery and DescribeEndpoints, and
+// VerifyDescriptions lets a test catch descriptions whose route is gone.
+package x402
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Endpoint is what Describe says about a route
+type Endpoint struct {
+	Name        string
+	Description string
+
+	// Cost is the price of one call, in Currency's smallest unit
+	Cost     int64
+	Currency string
+	CostUnit string // default "per_call"
+
+	// Params describes the route's parameters. Path wildcards not listed are
+	// added as required string path parameters.
+	Params []EndpointParam
+
+	Tags      []string
+	RateLimit *EndpointRateLimit
+
+	// MimeType and OutputSchema describe the response
+	MimeType     string
+	OutputSchema map[string]interface{}
+}
+
+// apiEndpoint is endpoint as served on method and path
+func (endpoint Endpoint) apiEndpoint(method, path string) APIEndpoint {
+	ep := APIEndpoint{
+		Path:         path,
+		Method:       method,
+		Name:         endpoint.Name,
+		Description:  endpoint.Description,
+		Parameters:   append([]EndpointParam(nil), endpoint.Params...),
+		Cost:         endpoint.Cost,
+		Currency:     endpoint.Currency,
+		CostUnit:     endpoint.CostUnit,
+		Tags:         endpoint.Tags,
+		RateLimit:    endpoint.RateLimit,
+		MimeType:     endpoint.MimeType,
+		OutputSchema: endpoint.OutputSchema,
+	}
+	if ep.CostUnit == "" {
+		ep.CostUnit = "per_call"
+	}
+	for _, name := range routeWildcards(path) {
+		if !hasParam(ep.Parameters, name) {
+			ep.Parameters = append(ep.Parameters, EndpointParam{Name: name, In: "path", Type: "string", Required: true})
+		}
+	}
+	return ep
+}
+
+type describedRoute struct {
+	pattern  string
+	endpoint APIEndpoint
+}
+
+// descriptions holds the routes described on each mux
+var descriptions = struct {
+	sync.Mutex
+	byMux map[*http.ServeMux][]describedRoute
+}{byMux: make(map[*http.ServeMux][]describedRoute)}
+
+// Describe records endpoint as the description of pattern, a Go 1.22
+// ServeMux pattern such as "GET /api/articles/{id}" registered on mux. The
+// host, if any, is not part of the description. Like mux.Handle, it panics on
+// a malformed pattern or one described twice.
+func Describe(mux *http.ServeMux, pattern string, endpoint Endpoint) {
+	method, _, path, err := splitPattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+
+	ep := endpoint.apiEndpoint(method, path)
+
+	descriptions.Lock()
+	defer descriptions.Unlock()
+	for _, route := range descriptions.byMux[mux] {
+		if route.pattern == pattern {
+			panic(fmt.Sprintf("x402: pattern %q described twice", pattern))
+		}
+	}
+	descriptions.byMux[mux] = append(descriptions.byMux[mux], describedRoute{pattern: pattern, endpoint: ep})
+}
+
+// DescribedEndpoints returns the endpoints described on mux, in the order
+// they were described, for AIFirstConfig.Endpoints and DescribeEndpoints
+func DescribedEndpoints(mux *http.ServeMux) []APIEndpoint {
+	descriptions.Lock()
+	defer descriptions.Unlock()
+	routes := descriptions.byMux[mux]
+	endpoints := make([]APIEndpoint, len(routes))
+	for i, route := range routes {
+		endpoints[i] = route.endpoint
+	}
+	return endpoints
+}
+
+// VerifyDescriptions checks that mux serves every pattern described on it
+// with that pattern's own handler, so tests catch routes that were renamed
+// or removed without their description
+func VerifyDescriptions(mux *http.ServeMux) error {
+	descriptions.Lock()
+	routes := append([]describedRoute(nil), descriptions.byMux[mux]...)
+	descriptions.Unlock()
+
+	var errs []error
+	for _, route := range routes {
+		_, served := mux.Handler(sampleRequest(route.pattern))
+		switch served {
+		case route.pattern:
+		case "":
+			errs = append(errs, fmt.Errorf("x402: described route %q is not served", route.pattern))
+		default:
+			errs = append(errs, fmt.Errorf("x402: described route %q is served by %q", route.pattern, served))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// splitPattern splits a ServeMux pattern into its method, host and path
+func splitPattern(pattern string) (method, host, path string, err error) {
+	rest := pattern
+	if i := strings.IndexAny(pattern, " \t"); i >= 0 {
+		method, rest = pattern[:i], strings.TrimLeft(pattern[i:], " \t")
+	}
+	slash := strings.Index(rest, "/")
+	if slash < 0 {
+		return "", "", "", fmt.Errorf("x402: invalid pattern %q: no path", pattern)
+	}
+	host, path = rest[:slash], rest[slash:]
+	for _, segment := range strings.Split(path, "/") {
+		if strings.ContainsAny(segment, "{}") && !wildcard(segment) {
+			return "", "", "", fmt.Errorf("x402: invalid pattern %q: bad wildcard %q", pattern, segment)
+		}
+	}
+	return method, host, path, nil
+}
+
+// wildcard reports whether segment is a whole-segment wildcard
+func wildcard(segment string) bool {
+	return len(segment) > 2 && segment[0] == '{' && segment[len(segment)-1] == '}' &&
+		!strings.ContainsAny(segment[1:len(segment)-1], "{}")
+}
+
+// routeWildcards returns the names of path's wildcards
+func routeWildcards(path string) []string {
+	var names []string
+	for _, segment := range strings.Split(path, "/") {
+		if wildcard(segment) && segment != "{$}" {
+			names = append(names, strings.TrimSuffix(segment[1:len(segment)-1], "..."))
+		}
+	}
+	return names
+}
+
+func hasParam(params []EndpointParam, name string) bool {
+	for _, p := range params {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sampleRequest returns a request pattern should match, its wildcards
+// filled in with their names
+func sampleRequest(pattern string) *http.Request {
+	method, host, path, _ := splitPattern(pattern)
+	if method == "" {
+		method = http.MethodGet
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		switch {
+		case segment == "{$}":
+			segments[i] = ""
+		case wildcard(segment):
+			segments[i] = strings.TrimSuffix(segment[1:len(segment)-1], "...")
+		}
+	}
+	return &http.Request{Method: method, Host: host, URL: &url.URL{Path: strings.Join(segments, "/")}, Header: http.Header{}}
+}
+
+// routeMatches reports whether path matches route, a ServeMux pattern path:
+// {name} matches one segment, {name...} the rest of the path and {$} the end
+// of a path ending in a slash. Routes without wildcards match exactly.
+func routeMatches(route, path string) bool {
+	if !strings.Contains(route, "{") {
+		return route == path
+	}
+	routeSegments, pathSegments := strings.Split(route, "/"), strings.Split(path, "/")
+	for i, segment := range routeSegments {
+		if i >= len(pathSegments) {
+			return false
+		}
+		if segment == "{$}" {
+			return i == len(pathSegments)-1 && pathSegments[i] == ""
+		}
+		switch {
+		case wildcard(segment) && strings.HasSuffix(segment, "...}"):
+			return true
+		case wildcard(segment):
+			if pathSegments[i] == "" {
+				return false
+			}
+		case segment != pathSegments[i]:
+			return false
+		}
+	}
+	return len(routeSegments) == len(pathSegments)
+}
+
+// matches reports whether ep describes method on path. An endpoint without a
+// Method matches any method.
+func (ep APIEndpoint) matches(method, path string) bool {
+	return (ep.Method == "" || strings.EqualFold(ep.Method, method)) && routeMatches(ep.Path, path)
+}
@@ -0,0 +1,162 @@
+package x402
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var articleSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"title": map[string]interface{}{"type": "string"},
+	},
+}
+
+func newArticlesMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/articles/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("article " + r.PathValue("id")))
+	})
+	Describe(mux, "GET /api/articles/{id}", Endpoint{
+		Name:         "get_article",
+		Description:  "Fetch an article",
+		Cost:         25,
+		MimeType:     "application/json",
+		OutputSchema: articleSchema,
+	})
+	return mux
+}
+
+func TestDescribe_CostInDiscoveryAnd402(t *testing.T) {
+	mux := newArticlesMux()
+	config := AIFirstConfig{
+		Endpoints:       DescribedEndpoints(mux),
+		Currency:        "USDC",
+		DefaultCost:     100,
+		RequirePayment:  true,
+		PaymentVerifier: func(token string) (bool, error) { return token == "signed_proof", nil },
+	}
+
+	// Discovery lists the route with its cost and path parameter
+	w := httptest.NewRecorder()
+	AIDiscoveryHandler(config).ServeHTTP(w, httptest.NewRequest("GET", "/ai/discover", nil))
+	var discovery struct {
+		Endpoints []APIEndpoint `json:"endpoints"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&discovery); err != nil || len(discovery.Endpoints) != 1 {
+		t.Fatalf("Expected one described endpoint, got %+v (%v)", discovery.Endpoints, err)
+	}
+	ep := discovery.Endpoints[0]
+	if ep.Path != "/api/articles/{id}" || ep.Method != "GET" || ep.Cost != 25 || ep.CostUnit != "per_call" {
+		t.Errorf("Expected GET /api/articles/{id} at 25 per call, got %+v", ep)
+	}
+	if len(ep.Parameters) != 1 || ep.Parameters[0].Name != "id" || ep.Parameters[0].In != "path" || !ep.Parameters[0].Required {
+		t.Errorf("Expected a required id path parameter, got %+v", ep.Parameters)
+	}
+
+	// The 402 asks for the described cost, not the default
+	handler := AIFirstMiddleware(mux, config)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/articles/42", nil))
+	var response AIResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusPaymentRequired || response.Error == nil || response.Error.PaymentInfo == nil || response.Error.PaymentInfo.Amount != 25 {
+		t.Fatalf("Expected a 402 for 25, got %d: %+v", w.Code, response.Error)
+	}
+
+	req := httptest.NewRequest("GET", "/api/articles/42", nil)
+	req.Header.Set("X-PAYMENT", "signed_proof")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "article 42" {
+		t.Errorf("Expected the article served once paid, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestDescribe_SchemaInPaymentRequirements(t *testing.T) {
+	config := testConfig()
+	config.ResourceDescriptor = DescribeEndpoints(DescribedEndpoints(newArticlesMux()))
+	handler := Middleware(createTestHandler(), config)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/articles/7", nil))
+	req := decodePaymentRequired(t, w).Accepts[0]
+	if req.MimeType != "application/json" || !reflect.DeepEqual(req.OutputSchema, articleSchema) {
+		t.Errorf("Expected the article schema, got %q %v", req.MimeType, req.OutputSchema)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/articles/7/comments", nil))
+	if req := decodePaymentRequired(t, w).Accepts[0]; req.OutputSchema != nil {
+		t.Errorf("Expected no schema for an undescribed path, got %v", req.OutputSchema)
+	}
+}
+
+func TestVerifyDescriptions(t *testing.T) {
+	if err := VerifyDescriptions(newArticlesMux()); err != nil {
+		t.Errorf("Expected described routes to verify, got %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("POST /api/orders", func(w http.ResponseWriter, r *http.Request) {})
+	Describe(mux, "GET /api/articles/{id}", Endpoint{Cost: 25})
+	Describe(mux, "GET /api/orders", Endpoint{Cost: 10})
+	Describe(mux, "POST /api/orders", Endpoint{Cost: 10})
+	Describe(mux, "GET /reports/{name...}", Endpoint{Cost: 50})
+
+	err := VerifyDescriptions(mux)
+	if err == nil {
+		t.Fatal("Expected mismatched descriptions reported")
+	}
+	for _, want := range []string{
+		`"GET /api/articles/{id}" is served by "/api/"`,
+		`"GET /api/orders" is served by "/api/"`,
+		`"GET /reports/{name...}" is not served`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), `"POST /api/orders"`) {
+		t.Errorf("Expected the served route not reported, got %v", err)
+	}
+}
+
+func TestDescribe_PanicsOnDuplicate(t *testing.T) {
+	mux := newArticlesMux()
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a pattern described twice to panic")
+		}
+	}()
+	Describe(mux, "GET /api/articles/{id}", Endpoint{Cost: 1})
+}
+
+func TestRouteMatches(t *testing.T) {
+	tests := []struct {
+		route, path string
+		want        bool
+	}{
+		{"/api/articles/{id}", "/api/articles/42", true},
+		{"/api/articles/{id}", "/api/articles/", false},
+		{"/api/articles/{id}", "/api/articles/42/comments", false},
+		{"/files/{path...}", "/files/a/b.txt", true},
+		{"/files/{path...}", "/files/", true},
+		{"/files/{path...}", "/files", false},
+		{"/docs/{$}", "/docs/", true},
+		{"/docs/{$}", "/docs/intro", false},
+		{"/docs/{$}", "/docs", false},
+		{"/api/items", "/api/items", true},
+		{"/api/", "/api/items", false},
+	}
+	for _, tt := range tests {
+		if got := routeMatches(tt.route, tt.path); got != tt.want {
+			t.Errorf("routeMatches(%q, %q): expected %v, got %v", tt.route, tt.path, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// Package x402 - Signed Discovery
+// Discovery documents and 402 requirements tell agents where to send money,
+// so a proxy or CDN that rewrites payTo redirects every payment. A
+// DiscoverySigner adds a detached JWS (RFC 7515 appendix F, EdDSA over
+// Ed25519) of the document's canonical JSON in X-Discovery-Signature, and
+// WellKnownHandler publishes the public keys at /.well-known/x402 by kid, so
+// keys can be rotated while agents holding old documents still verify them.
+package x402
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// DiscoverySignatureHeader carries the detached JWS of a signed response
+const DiscoverySignatureHeader = "X-Discovery-Signature"
+
+// WellKnownPath is where WellKnownHandler is conventionally mounted
+const WellKnownPath = "/.well-known/x402"
+
+// ErrInvalidDiscoverySignature is returned for signatures that are
+// malformed, by an unknown key or over a different document
+var ErrInvalidDiscoverySignature = errors.New("invalid discovery signature")
+
+// DiscoveryKey is a public signing key as a JWK (RFC 8037)
+type DiscoveryKey struct {
+	KeyType   string `json:"kty"` // "OKP"
+	Curve     string `json:"crv"` // "Ed25519"
+	KeyID     string `json:"kid"`
+	X         string `json:"x"` // base64url public key
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+// DiscoveryKeySet is the document served at /.well-known/x402
+type DiscoveryKeySet struct {
+	X402Version int            `json:"x402Version"`
+	Keys        []DiscoveryKey `json:"keys"`
+}
+
+// key finds the public key with id kid
+func (s DiscoveryKeySet) key(kid string) (ed25519.PublicKey, bool) {
+	for _, k := range s.Keys {
+		if k.KeyID != kid || k.KeyType != "OKP" || k.Curve != "Ed25519" {
+			continue
+		}
+		public, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(public) != ed25519.PublicKeySize {
+			return nil, false
+		}
+		return ed25519.PublicKey(public), true
+	}
+	return nil, false
+}
+
+// jwsHeader is the protected header of a discovery signature
+type jwsHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// signingKey is a private key and its kid
+type signingKey struct {
+	id  string
+	key ed25519.PrivateKey
+}
+
+// DiscoverySigner signs discovery documents and 402 requirements. The most
+// recently added key signs; every key not retired is published.
+type DiscoverySigner struct {
+	mu   sync.RWMutex
+	keys []signingKey // Current key first
+}
+
+// NewDiscoverySigner creates a signer signing with key as kid
+func NewDiscoverySigner(kid string, key ed25519.PrivateKey) *DiscoverySigner {
+	s := &DiscoverySigner{}
+	s.Rotate(kid, key)
+	return s
+}
+
+// Rotate makes key, as kid, the signing key. Earlier keys stay published
+// until retired, so documents they signed still verify.
+func (s *DiscoverySigner) Rotate(kid string, key ed25519.PrivateKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []signingKey{{id: kid, key: key}}
+	for _, k := range s.keys {
+		if k.id != kid {
+			keys = append(keys, k)
+		}
+	}
+	s.keys = keys
+}
+
+// Retire stops publishing kid. The signing key can't be retired.
+func (s *DiscoverySigner) Retire(kid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, k := range s.keys {
+		if i > 0 && k.id == kid {
+			s.keys = append(s.keys[:i:i], s.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+// Keys returns the published public keys
+func (s *DiscoverySigner) Keys() DiscoveryKeySet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	set := DiscoveryKeySet{X402Version: X402Version, Keys: make([]DiscoveryKey, 0, len(s.keys))}
+	for _, k := range s.keys {
+		set.Keys = append(set.Keys, DiscoveryKey{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			KeyID:     k.id,
+			X:         base64.RawURLEncoding.EncodeToString(k.key.Public().(ed25519.PublicKey)),
+			Algorithm: "EdDSA",
+			Use:       "sig",
+		})
+	}
+	return set
+}
+
+// Sign returns the detached JWS ("header..signature") of document's
+// canonical JSON
+func (s *DiscoverySigner) Sign(document []byte) (string, error) {
+	canonical, err := CanonicalJSON(document)
+	if err != nil {
+		return "", err
+	}
+	s.mu.RLock()
+	current := s.keys[0]
+	s.mu.RUnlock()
+
+	header, _ := json.Marshal(jwsHeader{Algorithm: "EdDSA", KeyID: current.id})
+	protected := base64.RawURLEncoding.EncodeToString(header)
+	signature := ed25519.Sign(current.key, signingInput(protected, canonical))
+	return protected + ".." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// sign sets w's signature header for document, if s isn't nil
+func (s *DiscoverySigner) sign(w http.ResponseWriter, document interface{}) {
+	if s == nil {
+		return
+	}
+	data, err := json.Marshal(document)
+	if err != nil {
+		return
+	}
+	if signature, err := s.Sign(data); err == nil {
+		w.Header().Set(DiscoverySignatureHeader, signature)
+	}
+}
+
+// VerifyDiscoverySignature checks that signature, from a response's
+// X-Discovery-Signature header, is a valid signature of document by one of
+// keys. Whitespace and key order in document don't matter; any change to a
+// value does.
+func VerifyDiscoverySignature(document []byte, signature string, keys DiscoveryKeySet) error {
+	protected, encoded, ok := strings.Cut(signature, "..")
+	if !ok {
+		return fmt.Errorf("%w: not a detached JWS", ErrInvalidDiscoverySignature)
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(protected)
+	if err != nil {
+		return fmt.Errorf("%w: malformed header", ErrInvalidDiscoverySignature)
+	}
+	var header jwsHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Algorithm != "EdDSA" {
+		return fmt.Errorf("%w: unsupported header %s", ErrInvalidDiscoverySignature, headerJSON)
+	}
+	public, ok := keys.key(header.KeyID)
+	if !ok {
+		return fmt.Errorf("%w: unknown key %q", ErrInvalidDiscoverySignature, header.KeyID)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("%w: malformed signature", ErrInvalidDiscoverySignature)
+	}
+	canonical, err := CanonicalJSON(document)
+	if err != nil {
+		return fmt.Errorf("%w: document is not JSON", ErrInvalidDiscoverySignature)
+	}
+	if !ed25519.Verify(public, signingInput(protected, canonical), sig) {
+		return fmt.Errorf("%w: signature does not match document", ErrInvalidDiscoverySignature)
+	}
+	return nil
+}
+
+// signingInput is the JWS signing input for a protected header and payload
+func signingInput(protected string, payload []byte) []byte {
+	return []byte(protected + "." + base64.RawURLEncoding.EncodeToString(payload))
+}
+
+// CanonicalJSON re-encodes document with object keys sorted and no
+// insignificant whitespace, so documents that differ only in formatting
+// sign the same. Numbers keep their original spelling.
+func CanonicalJSON(document []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// WellKnownHandler serves signer's public keys, for mounting at
+// WellKnownPath
+func WellKnownHandler(signer *DiscoverySigner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		_ = json.NewEncoder(w).Encode(signer.Keys())
+	}
+}
@@ -0,0 +1,132 @@
+package x402
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testSigningKey(seed byte) ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+}
+
+// tamper changes one byte of payTo in document
+func tamper(t *testing.T, document []byte, payTo string) []byte {
+	t.Helper()
+	i := bytes.Index(document, []byte(payTo))
+	if i < 0 {
+		t.Fatalf("Expected %s in %s", payTo, document)
+	}
+	tampered := append([]byte(nil), document...)
+	tampered[i+len(payTo)-1] ^= 1
+	return tampered
+}
+
+func TestDiscoverySigner_SignsDiscoveryDocuments(t *testing.T) {
+	signer := NewDiscoverySigner("2026-10", testSigningKey(1))
+	handler := AIDiscoveryHandler(AIFirstConfig{PayTo: "0xseller", Network: "base", DiscoverySigner: signer})
+
+	for _, format := range []string{"", "openai", "mcp"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/ai/discover?format="+format, nil))
+		signature := w.Header().Get(DiscoverySignatureHeader)
+		if !strings.HasPrefix(signature, base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","kid":"2026-10"}`))+"..") {
+			t.Fatalf("Expected a detached EdDSA JWS for format %q, got %q", format, signature)
+		}
+
+		document := w.Body.Bytes()
+		if err := VerifyDiscoverySignature(document, signature, signer.Keys()); err != nil {
+			t.Errorf("Expected the %q document to verify, got %v", format, err)
+		}
+
+		// Formatting doesn't matter, content does
+		var indented bytes.Buffer
+		json.Indent(&indented, document, "", "  ")
+		if err := VerifyDiscoverySignature(indented.Bytes(), signature, signer.Keys()); err != nil {
+			t.Errorf("Expected the reformatted %q document to verify, got %v", format, err)
+		}
+		if err := VerifyDiscoverySignature(tamper(t, document, "0xseller"), signature, signer.Keys()); !errors.Is(err, ErrInvalidDiscoverySignature) {
+			t.Errorf("Expected a modified payTo rejected for format %q, got %v", format, err)
+		}
+	}
+}
+
+func TestDiscoverySigner_SignsPaymentRequirements(t *testing.T) {
+	signer := NewDiscoverySigner("k1", testSigningKey(1))
+	config := testConfig()
+	config.PayTo = "0xseller"
+	config.DiscoverySigner = signer
+	handler := Middleware(createTestHandler(), config)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402, got %d", w.Code)
+	}
+	signature := w.Header().Get(DiscoverySignatureHeader)
+
+	// The PAYMENT-REQUIRED header and the body carry the same requirements
+	header, _ := base64.StdEncoding.DecodeString(w.Header().Get("PAYMENT-REQUIRED"))
+	for name, document := range map[string][]byte{"header": header, "body": w.Body.Bytes()} {
+		if err := VerifyDiscoverySignature(document, signature, signer.Keys()); err != nil {
+			t.Errorf("Expected the requirements in the %s to verify, got %v", name, err)
+		}
+		if err := VerifyDiscoverySignature(tamper(t, document, "0xseller"), signature, signer.Keys()); !errors.Is(err, ErrInvalidDiscoverySignature) {
+			t.Errorf("Expected a modified payTo in the %s rejected, got %v", name, err)
+		}
+	}
+}
+
+func TestDiscoverySigner_Rotation(t *testing.T) {
+	signer := NewDiscoverySigner("old", testSigningKey(1))
+	document := []byte(`{"payTo":"0xseller"}`)
+	oldSignature, _ := signer.Sign(document)
+
+	signer.Rotate("new", testSigningKey(2))
+	newSignature, _ := signer.Sign(document)
+	if newSignature == oldSignature {
+		t.Fatal("Expected the new key to sign")
+	}
+
+	// Both keys are published until the old one is retired
+	w := httptest.NewRecorder()
+	WellKnownHandler(signer).ServeHTTP(w, httptest.NewRequest("GET", WellKnownPath, nil))
+	var published DiscoveryKeySet
+	json.NewDecoder(w.Body).Decode(&published)
+	if len(published.Keys) != 2 || published.Keys[0].KeyID != "new" || published.Keys[1].KeyType != "OKP" || published.Keys[1].Curve != "Ed25519" {
+		t.Fatalf("Expected both keys published, got %+v", published)
+	}
+	for _, signature := range []string{oldSignature, newSignature} {
+		if err := VerifyDiscoverySignature(document, signature, published); err != nil {
+			t.Errorf("Expected the document to verify, got %v", err)
+		}
+	}
+
+	signer.Retire("old")
+	signer.Retire("new") // The signing key stays
+	if err := VerifyDiscoverySignature(document, oldSignature, signer.Keys()); !errors.Is(err, ErrInvalidDiscoverySignature) {
+		t.Errorf("Expected the retired key rejected, got %v", err)
+	}
+	if err := VerifyDiscoverySignature(document, newSignature, signer.Keys()); err != nil {
+		t.Errorf("Expected the signing key kept, got %v", err)
+	}
+}
+
+func TestMountStandardEndpoints_WellKnown(t *testing.T) {
+	mux := http.NewServeMux()
+	routes, err := MountStandardEndpoints(mux, StandardEndpointDeps{DiscoverySigner: NewDiscoverySigner("k1", testSigningKey(1))}, MountOptions{Prefix: "/payments/"})
+	if err != nil || len(routes) != 1 || routes[0] != WellKnownPath {
+		t.Fatalf("Expected the keys mounted at %s, got %v %v", WellKnownPath, routes, err)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", WellKnownPath, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"kid":"k1"`) {
+		t.Errorf("Expected the keys served, got %d: %s", w.Code, w.Body)
+	}
+}
@@ -14,6 +14,9 @@
 //	    PricePerRequest:  100,
 //	    Currency:         "USD",
 //	    ExemptPaths:      []string{"/public"},
+//	    PaymentVerifier:  x402.NewHTTPVerifier(x402.VerifierConfig{
+//	        Endpoint: "https://pay.example.com/verify",
+//	    }),
 //	})
 //
 //	http.ListenAndServe(":8080", handler)
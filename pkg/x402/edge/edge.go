@@ -1,12 +1,27 @@
 // Package edge provides x402 middleware compatible with edge computing platforms
 // like Cloudflare Workers, Vercel Edge, Deno Deploy, etc.
+//
+// The package avoids fmt and other reflection-heavy helpers so it also builds
+// for js/wasm with Go or TinyGo (see RegisterWorkerHandler).
 package edge
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -27,14 +42,136 @@ type EdgeConfig struct {
 	// UpstreamURL - the backend to proxy to (for gateway mode)
 	UpstreamURL string `json:"upstream_url"`
 
+	// UpstreamTimeoutMs - timeout for a proxied upstream request (default 30000)
+	UpstreamTimeoutMs int `json:"upstream_timeout_ms,omitempty"`
+
 	// ValidTokens - static list of valid tokens (for simple deployments)
 	ValidTokens []string `json:"valid_tokens,omitempty"`
 
 	// VerifyEndpoint - external endpoint to verify tokens
 	VerifyEndpoint string `json:"verify_endpoint,omitempty"`
+
+	// VerifyTimeoutMs - timeout for a remote verification call (default 2000)
+	VerifyTimeoutMs int `json:"verify_timeout_ms,omitempty"`
+
+	// VerifyCacheTTLSeconds - how long positive verifications are cached (default 60, -1 disables)
+	VerifyCacheTTLSeconds int `json:"verify_cache_ttl_seconds,omitempty"`
+
+	// VerifySecret - shared secret used to HMAC-sign verification requests
+	// so the verify service can authenticate the edge worker
+	VerifySecret string `json:"verify_secret,omitempty"`
+
+	// FailMode - "closed" (default) rejects payment when the verify service
+	// is unreachable; "open" lets the request through
+	FailMode string `json:"fail_mode,omitempty"`
+
+	// HTTPClient - optional client for verification and upstream calls.
+	// It is copied, and redirects are never followed.
+	HTTPClient *http.Client `json:"-"`
+
+	// SigningSecret - shared secret for self-contained HMAC tokens minted
+	// with MintEdgeToken; these verify locally with no network call
+	SigningSecret string `json:"signing_secret,omitempty"`
+
+	// ClockSkewSeconds - tolerated clock drift for signed token expiry (default 30)
+	ClockSkewSeconds int `json:"clock_skew_seconds,omitempty"`
+
+	// AllowQueryToken - accept the payment_token query parameter. Off by
+	// default, since URLs end up in logs and Referer headers; the parameter
+	// is never forwarded upstream either way.
+	AllowQueryToken bool `json:"allow_query_token,omitempty"`
+
+	// TestMode - accept any token starting with "valid_" when no other
+	// verification is configured. Never enable it in production.
+	TestMode bool `json:"test_mode,omitempty"`
+
+	// x402 payment requirements advertised in 402 responses
+	PayTo             string `json:"pay_to,omitempty"`
+	Network           string `json:"network,omitempty"` // default "base-sepolia"
+	Asset             string `json:"asset,omitempty"`
+	Scheme            string `json:"scheme,omitempty"` // default "exact"
+	Description       string `json:"description,omitempty"`
+	MaxTimeoutSeconds int    `json:"max_timeout_seconds,omitempty"` // default 60
+
+	// LegacyFormat - emit the pre-x402 body (status/error/amount/payment_url)
+	// instead of the x402 PaymentRequiredResponse
+	LegacyFormat bool `json:"legacy_format,omitempty"`
 }
 
-// PaymentRequiredResponse is the 402 response body
+// X402Version is the x402 protocol version emitted in 402 responses
+const X402Version = 1
+
+// PaymentRequirements mirrors x402.PaymentRequirements so edge builds don't
+// depend on the full middleware package
+type PaymentRequirements struct {
+	Scheme            string                 `json:"scheme"`
+	Network           string                 `json:"network"`
+	MaxAmountRequired string                 `json:"maxAmountRequired"`
+	Resource          string                 `json:"resource"`
+	Description       string                 `json:"description"`
+	MimeType          string                 `json:"mimeType,omitempty"`
+	PayTo             string                 `json:"payTo"`
+	MaxTimeoutSeconds int                    `json:"maxTimeoutSeconds"`
+	Asset             string                 `json:"asset,omitempty"`
+	OutputSchema      interface{}            `json:"outputSchema"`
+	Extra             map[string]interface{} `json:"extra,omitempty"`
+	ExpiresAt         int64                  `json:"expiresAt,omitempty"` // Unix time the quote expires
+}
+
+// X402PaymentRequired mirrors x402.PaymentRequiredResponse
+type X402PaymentRequired struct {
+	X402Version int                   `json:"x402Version"`
+	Accepts     []PaymentRequirements `json:"accepts"`
+	Error       string                `json:"error,omitempty"`
+	ValidUntil  int64                 `json:"validUntil,omitempty"` // Unix time the quote expires
+
+	// RequirementsHash identifies the offer in Accepts, ignoring expiry
+	RequirementsHash string `json:"requirementsHash,omitempty"`
+}
+
+// requirementsHash matches x402's: a hex SHA-256 of accepts with their
+// expiry cleared
+func requirementsHash(accepts []PaymentRequirements) string {
+	stable := make([]PaymentRequirements, len(accepts))
+	for i, req := range accepts {
+		req.ExpiresAt = 0
+		stable[i] = req
+	}
+	data, err := json.Marshal(stable)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Fail modes for remote verification
+const (
+	FailClosed = "closed"
+	FailOpen   = "open"
+)
+
+// SignatureHeader carries the HMAC signature of remote verification requests:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">"
+const SignatureHeader = "X-Edge-Signature"
+
+// VerifyRequest is the body POSTed to VerifyEndpoint
+type VerifyRequest struct {
+	Token    string `json:"token"`
+	Method   string `json:"method,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Price    int64  `json:"price"`
+	Currency string `json:"currency"`
+}
+
+// VerifyResponse is the expected reply from VerifyEndpoint
+type VerifyResponse struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// PaymentRequiredResponse is the legacy 402 response body (see LegacyFormat)
 type PaymentRequiredResponse struct {
 	Status      int    `json:"status"`
 	Error       string `json:"error"`
@@ -48,9 +185,23 @@ type PaymentRequiredResponse struct {
 type EdgeHandler struct {
 	config   EdgeConfig
 	tokenSet map[string]struct{}
+	client   *http.Client
+
+	cacheMu sync.Mutex
+	cache   map[string]time.Time // token+path -> expiry of a positive verification
+}
+
+// Validate reports configuration errors. Tokens must be verifiable by
+// ValidTokens, VerifyEndpoint or SigningSecret unless TestMode is set.
+func (c EdgeConfig) Validate() error {
+	if len(c.ValidTokens) == 0 && c.VerifyEndpoint == "" && c.SigningSecret == "" && !c.TestMode {
+		return errors.New("no token verification configured: set ValidTokens, VerifyEndpoint, SigningSecret or TestMode")
+	}
+	return nil
 }
 
-// NewEdgeHandler creates a new edge-compatible handler
+// NewEdgeHandler creates a new edge-compatible handler. Call config.Validate
+// first; without verification configured it accepts no tokens.
 func NewEdgeHandler(config EdgeConfig) *EdgeHandler {
 	tokenSet := make(map[string]struct{})
 	for _, t := range config.ValidTokens {
@@ -60,19 +211,79 @@ func NewEdgeHandler(config EdgeConfig) *EdgeHandler {
 	if config.Currency == "" {
 		config.Currency = "USD"
 	}
+	if config.VerifyTimeoutMs <= 0 {
+		config.VerifyTimeoutMs = 2000
+	}
+	if config.VerifyCacheTTLSeconds == 0 {
+		config.VerifyCacheTTLSeconds = 60
+	}
+	if config.FailMode == "" {
+		config.FailMode = FailClosed
+	}
+	if config.ClockSkewSeconds == 0 {
+		config.ClockSkewSeconds = 30
+	}
+	if config.UpstreamTimeoutMs <= 0 {
+		config.UpstreamTimeoutMs = 30000
+	}
+	if config.Scheme == "" {
+		config.Scheme = "exact"
+	}
+	if config.Network == "" {
+		config.Network = "base-sepolia"
+	}
+	if config.MaxTimeoutSeconds == 0 {
+		config.MaxTimeoutSeconds = 60
+	}
+
+	// Upstream redirects go back to the client, never followed past the
+	// checks made on the request's own path
+	client := &http.Client{}
+	if config.HTTPClient != nil {
+		copied := *config.HTTPClient
+		client = &copied
+	}
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
 
 	return &EdgeHandler{
 		config:   config,
 		tokenSet: tokenSet,
+		client:   client,
+		cache:    make(map[string]time.Time),
 	}
 }
 
+// cleanPath resolves dot segments and repeated slashes in a request path,
+// so exemptions, token scopes and the upstream all see the same resource.
+// URL.Path is already decoded, so percent-encoded traversal is resolved too.
+func cleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// withCleanPath returns r with its path cleaned
+func withCleanPath(r *http.Request) *http.Request {
+	cleaned := cleanPath(r.URL.Path)
+	if cleaned == r.URL.Path && r.URL.RawPath == "" {
+		return r
+	}
+	clean := *r
+	u := *r.URL
+	u.Path, u.RawPath = cleaned, ""
+	clean.URL = &u
+	return &clean
+}
+
 // ShouldRequirePayment checks if a request should require payment
 // Returns: (requiresPayment bool, token string)
 func (h *EdgeHandler) ShouldRequirePayment(r *http.Request) (bool, string) {
 	// Check exempt paths
-	for _, path := range h.config.ExemptPaths {
-		if strings.HasPrefix(r.URL.Path, path) {
+	requestPath := cleanPath(r.URL.Path)
+	for _, exempt := range h.config.ExemptPaths {
+		if strings.HasPrefix(requestPath, exempt) {
 			return false, ""
 		}
 	}
@@ -83,6 +294,11 @@ func (h *EdgeHandler) ShouldRequirePayment(r *http.Request) (bool, string) {
 		return true, ""
 	}
 
+	// Signed tokens are scoped to a resource prefix; out-of-scope tokens don't count
+	if claims, ok := h.parseSignedToken(token); ok && !claims.AllowsPath(requestPath) {
+		return true, ""
+	}
+
 	return false, token
 }
 
@@ -97,6 +313,14 @@ func (h *EdgeHandler) ExtractToken(r *http.Request) string {
 		}
 	}
 
+	// Check the x402 payment headers (PAYMENT-SIGNATURE, then X-PAYMENT),
+	// verified as tokens by the verify service
+	for _, header := range []string{"PAYMENT-SIGNATURE", "X-PAYMENT"} {
+		if token := r.Header.Get(header); token != "" {
+			return token
+		}
+	}
+
 	// Check X-Payment-Token header
 	if token := r.Header.Get("X-Payment-Token"); token != "" {
 		return token
@@ -107,9 +331,11 @@ func (h *EdgeHandler) ExtractToken(r *http.Request) string {
 		return token
 	}
 
-	// Check query parameter
-	if token := r.URL.Query().Get("payment_token"); token != "" {
-		return token
+	// Check query parameter, if allowed
+	if h.config.AllowQueryToken {
+		if token := r.URL.Query().Get("payment_token"); token != "" {
+			return token
+		}
 	}
 
 	// Check cookie
@@ -120,31 +346,228 @@ func (h *EdgeHandler) ExtractToken(r *http.Request) string {
 	return ""
 }
 
-// VerifyToken verifies if a token is valid
+// VerifyToken verifies if a token is valid. Without a request there is no
+// path to check, so signed tokens scoped to a resource are refused; use
+// VerifyTokenForRequest for those.
 func (h *EdgeHandler) VerifyToken(token string) bool {
+	return h.VerifyTokenForRequest(nil, token)
+}
+
+// VerifyTokenForRequest verifies a token, passing request metadata to the
+// remote verify service when one is configured
+func (h *EdgeHandler) VerifyTokenForRequest(r *http.Request, token string) bool {
+	// Self-contained signed tokens verify locally
+	if h.config.SigningSecret != "" && strings.HasPrefix(token, EdgeTokenPrefix) {
+		claims, ok := h.parseSignedToken(token)
+		if !ok || claims.Amount < h.config.Price {
+			return false
+		}
+		if r == nil {
+			return claims.Resource == ""
+		}
+		return claims.AllowsPath(cleanPath(r.URL.Path))
+	}
+
 	// Check static token list first (fastest)
 	if len(h.tokenSet) > 0 {
 		_, valid := h.tokenSet[token]
 		return valid
 	}
 
-	// For testing: accept tokens starting with "valid_"
-	if strings.HasPrefix(token, "valid_") {
+	if h.config.VerifyEndpoint != "" {
+		return h.verifyRemote(r, token)
+	}
+
+	// Test mode only: accept tokens starting with "valid_"
+	if h.config.TestMode && strings.HasPrefix(token, "valid_") {
 		return true
 	}
 
 	return false
 }
 
+// parseSignedToken validates a signed edge token's signature and expiry
+func (h *EdgeHandler) parseSignedToken(token string) (*EdgeTokenClaims, bool) {
+	if h.config.SigningSecret == "" || !strings.HasPrefix(token, EdgeTokenPrefix) {
+		return nil, false
+	}
+	skew := time.Duration(h.config.ClockSkewSeconds) * time.Second
+	claims, err := ParseEdgeToken(h.config.SigningSecret, token, time.Now(), skew)
+	if err != nil {
+		return nil, false
+	}
+	return claims, true
+}
+
+// verifyRemote asks VerifyEndpoint whether the token is valid, caching
+// positive answers
+func (h *EdgeHandler) verifyRemote(r *http.Request, token string) bool {
+	req := VerifyRequest{
+		Token:    token,
+		Price:    h.config.Price,
+		Currency: h.config.Currency,
+	}
+	ctx := context.Background()
+	if r != nil {
+		req.Method = r.Method
+		req.Path = cleanPath(r.URL.Path)
+		req.Host = r.Host
+		ctx = r.Context()
+	}
+
+	cacheKey := token + "\x00" + req.Path
+	if h.cachedValid(cacheKey) {
+		return true
+	}
+
+	valid, err := h.callVerifyEndpoint(ctx, req)
+	if err != nil {
+		// Verify service unreachable or broken
+		return h.config.FailMode == FailOpen
+	}
+	if valid {
+		h.storeValid(cacheKey)
+	}
+	return valid
+}
+
+// callVerifyEndpoint performs the HTTP verification. A non-nil error means
+// the service could not give an answer (as opposed to rejecting the token).
+func (h *EdgeHandler) callVerifyEndpoint(ctx context.Context, req VerifyRequest) (bool, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(h.config.VerifyTimeoutMs)*time.Millisecond)
+	defer cancel()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, h.config.VerifyEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if h.config.VerifySecret != "" {
+		httpReq.Header.Set(SignatureHeader, SignVerifyRequest(h.config.VerifySecret, time.Now(), body))
+	}
+
+	resp, err := h.client.Do(httpReq)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return false, errors.New("verify endpoint returned status " + strconv.Itoa(resp.StatusCode))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, nil
+	}
+
+	var result VerifyResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result); err != nil {
+		return false, errors.New("invalid verify response: " + err.Error())
+	}
+	return result.Valid, nil
+}
+
+// cachedValid reports whether a positive verification is still cached
+func (h *EdgeHandler) cachedValid(key string) bool {
+	if h.config.VerifyCacheTTLSeconds < 0 {
+		return false
+	}
+	h.cacheMu.Lock()
+	defer h.cacheMu.Unlock()
+
+	expiry, ok := h.cache[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(h.cache, key)
+		return false
+	}
+	return true
+}
+
+// storeValid caches a positive verification
+func (h *EdgeHandler) storeValid(key string) {
+	if h.config.VerifyCacheTTLSeconds < 0 {
+		return
+	}
+	h.cacheMu.Lock()
+	defer h.cacheMu.Unlock()
+
+	now := time.Now()
+	// Opportunistically drop expired entries so the map stays bounded
+	if len(h.cache) >= 10000 {
+		for k, exp := range h.cache {
+			if now.After(exp) {
+				delete(h.cache, k)
+			}
+		}
+	}
+	h.cache[key] = now.Add(time.Duration(h.config.VerifyCacheTTLSeconds) * time.Second)
+}
+
+// SignVerifyRequest builds the SignatureHeader value for a verification body
+func SignVerifyRequest(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + verifySignature(secret, ts, body)
+}
+
+// CheckVerifySignature validates a SignatureHeader value on the verify service
+// side, rejecting signatures older than maxAge
+func CheckVerifySignature(secret, header string, body []byte, maxAge time.Duration) bool {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == "" {
+		return false
+	}
+	age := time.Since(time.Unix(unix, 0))
+	if age > maxAge || age < -maxAge {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(verifySignature(secret, ts, body)))
+}
+
+func verifySignature(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 // PaymentRequiredJSON returns the 402 response as JSON bytes
 func (h *EdgeHandler) PaymentRequiredJSON() []byte {
-	resp := PaymentRequiredResponse{
-		Status:      402,
-		Error:       "Payment Required",
-		Amount:      h.config.Price,
-		Currency:    h.config.Currency,
-		PaymentURL:  h.config.PaymentEndpoint,
-		Description: fmt.Sprintf("Payment of %d %s required", h.config.Price, h.config.Currency),
+	return h.PaymentRequiredJSONFor(nil)
+}
+
+// PaymentRequiredJSONFor returns the 402 body for a request. The x402
+// body names the requested resource; r may be nil.
+func (h *EdgeHandler) PaymentRequiredJSONFor(r *http.Request) []byte {
+	var resp interface{}
+	if h.config.LegacyFormat {
+		resp = PaymentRequiredResponse{
+			Status:      402,
+			Error:       "Payment Required",
+			Amount:      h.config.Price,
+			Currency:    h.config.Currency,
+			PaymentURL:  h.config.PaymentEndpoint,
+			Description: h.description(),
+		}
+	} else {
+		resp = h.x402PaymentRequired(r)
 	}
 	data, _ := json.Marshal(resp)
 	return data
@@ -152,15 +575,70 @@ func (h *EdgeHandler) PaymentRequiredJSON() []byte {
 
 // PaymentRequiredHeaders returns headers for a 402 response
 func (h *EdgeHandler) PaymentRequiredHeaders() map[string]string {
-	return map[string]string{
+	return h.PaymentRequiredHeadersFor(nil)
+}
+
+// PaymentRequiredHeadersFor returns headers for a 402 response to r,
+// including the base64 PAYMENT-REQUIRED header x402 clients negotiate with
+func (h *EdgeHandler) PaymentRequiredHeadersFor(r *http.Request) map[string]string {
+	headers := map[string]string{
 		"Content-Type":       "application/json",
 		"X-Payment-Required": "true",
-		"X-Payment-Amount":   fmt.Sprintf("%d", h.config.Price),
+		"X-Payment-Amount":   strconv.FormatInt(h.config.Price, 10),
 		"X-Payment-Currency": h.config.Currency,
 		"X-Payment-URL":      h.config.PaymentEndpoint,
 		"WWW-Authenticate":   `Bearer realm="Payment Required", X402 realm="Payment Required"`,
 		"Cache-Control":      "no-store",
 	}
+	if !h.config.LegacyFormat {
+		data, _ := json.Marshal(h.x402PaymentRequired(r))
+		headers["PAYMENT-REQUIRED"] = base64.StdEncoding.EncodeToString(data)
+	}
+	return headers
+}
+
+// x402PaymentRequired builds the protocol 402 body, matching pkg/x402 output
+func (h *EdgeHandler) x402PaymentRequired(r *http.Request) X402PaymentRequired {
+	resource := ""
+	if r != nil {
+		resource = r.URL.Path
+		if query := r.URL.Query(); query.Has("payment_token") {
+			query.Del("payment_token")
+			if encoded := query.Encode(); encoded != "" {
+				resource += "?" + encoded
+			}
+		} else if r.URL.RawQuery != "" {
+			resource += "?" + r.URL.RawQuery
+		}
+	}
+
+	validUntil := time.Now().Add(time.Duration(h.config.MaxTimeoutSeconds) * time.Second).Unix()
+	accepts := []PaymentRequirements{{
+		Scheme:            h.config.Scheme,
+		Network:           h.config.Network,
+		MaxAmountRequired: strconv.FormatInt(h.config.Price, 10),
+		Resource:          resource,
+		Description:       h.description(),
+		PayTo:             h.config.PayTo,
+		MaxTimeoutSeconds: h.config.MaxTimeoutSeconds,
+		Asset:             h.config.Asset,
+		ExpiresAt:         validUntil,
+	}}
+	return X402PaymentRequired{
+		X402Version:      X402Version,
+		ValidUntil:       validUntil,
+		Accepts:          accepts,
+		Error:            "X-PAYMENT header is required",
+		RequirementsHash: requirementsHash(accepts),
+	}
+}
+
+// description returns the configured or default payment description
+func (h *EdgeHandler) description() string {
+	if h.config.Description != "" {
+		return h.config.Description
+	}
+	return "Payment of " + strconv.FormatInt(h.config.Price, 10) + " " + h.config.Currency + " required"
 }
 
 // SuccessHeaders returns headers to add on successful payment verification
@@ -173,21 +651,26 @@ func (h *EdgeHandler) SuccessHeaders() map[string]string {
 
 // ServeHTTP implements http.Handler for standard Go servers
 func (h *EdgeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = withCleanPath(r)
 	requiresPayment, token := h.ShouldRequirePayment(r)
 
-	if !requiresPayment {
+	if !requiresPayment && token == "" {
 		// Path is exempt, let it through
+		if h.config.UpstreamURL != "" {
+			h.proxy(w, r)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	if token == "" || !h.VerifyToken(token) {
+	if token == "" || !h.VerifyTokenForRequest(r, token) {
 		// No valid token, return 402
-		for k, v := range h.PaymentRequiredHeaders() {
+		for k, v := range h.PaymentRequiredHeadersFor(r) {
 			w.Header().Set(k, v)
 		}
 		w.WriteHeader(http.StatusPaymentRequired)
-		_, _ = w.Write(h.PaymentRequiredJSON())
+		_, _ = w.Write(h.PaymentRequiredJSONFor(r))
 		return
 	}
 
@@ -195,25 +678,165 @@ func (h *EdgeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	for k, v := range h.SuccessHeaders() {
 		w.Header().Set(k, v)
 	}
+	if h.config.UpstreamURL != "" {
+		h.proxy(w, r)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
+// hopHeaders are connection-specific and never forwarded
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// paymentHeaders carry payment credentials that must not reach the upstream
+var paymentHeaders = []string{"X-Payment-Token", "X-402-Token", "X-Payment", "Payment-Signature"}
+
+// proxy forwards r to UpstreamURL and streams the response back
+func (h *EdgeHandler) proxy(w http.ResponseWriter, r *http.Request) {
+	target, err := h.upstreamURL(r)
+	if err != nil {
+		http.Error(w, "Invalid upstream", http.StatusBadGateway)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(h.config.UpstreamTimeoutMs)*time.Millisecond)
+	defer cancel()
+
+	var body io.Reader
+	if r.Body != nil && r.Body != http.NoBody {
+		body = r.Body
+	}
+	out, err := http.NewRequestWithContext(ctx, r.Method, target, body)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadGateway)
+		return
+	}
+	out.ContentLength = r.ContentLength
+	out.Header = h.upstreamHeaders(r)
+
+	resp, err := h.client.Do(out)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			http.Error(w, "Upstream timeout", http.StatusGatewayTimeout)
+			return
+		}
+		http.Error(w, "Upstream unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for k, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+	for _, k := range hopHeaders {
+		w.Header().Del(k)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	// Stream the body, flushing as chunks arrive
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if readErr != nil {
+			return
+		}
+	}
+}
+
+// upstreamURL joins UpstreamURL with the request path, dropping the
+// payment_token query parameter
+func (h *EdgeHandler) upstreamURL(r *http.Request) (string, error) {
+	base, err := url.Parse(h.config.UpstreamURL)
+	if err != nil {
+		return "", err
+	}
+
+	target := *base
+	target.Path = strings.TrimSuffix(base.Path, "/") + cleanPath(r.URL.Path)
+	target.RawPath = ""
+
+	query := r.URL.Query()
+	if query.Has("payment_token") {
+		query.Del("payment_token")
+		target.RawQuery = query.Encode()
+	} else {
+		target.RawQuery = r.URL.RawQuery
+	}
+	return target.String(), nil
+}
+
+// upstreamHeaders copies request headers minus hop-by-hop and payment headers
+func (h *EdgeHandler) upstreamHeaders(r *http.Request) http.Header {
+	headers := r.Header.Clone()
+	for _, k := range hopHeaders {
+		headers.Del(k)
+	}
+	for _, k := range paymentHeaders {
+		headers.Del(k)
+	}
+
+	// Authorization only goes upstream when it isn't the payment token
+	if auth := headers.Get("Authorization"); auth != "" {
+		for _, prefix := range []string{"Bearer ", "Token ", "X402 "} {
+			if strings.HasPrefix(auth, prefix) {
+				headers.Del("Authorization")
+				break
+			}
+		}
+	}
+
+	// Drop the payment cookie, keep the rest
+	if cookies := r.Cookies(); len(cookies) > 0 {
+		headers.Del("Cookie")
+		for _, c := range cookies {
+			if c.Name != "x402_token" {
+				headers.Add("Cookie", c.Name+"="+c.Value)
+			}
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := headers.Get("X-Forwarded-For"); prior != "" {
+			host = prior + ", " + host
+		}
+		headers.Set("X-Forwarded-For", host)
+	}
+	headers.Set("X-Forwarded-Host", r.Host)
+	return headers
+}
+
 // WrapHandler wraps an existing http.Handler with x402 payment protection
 func (h *EdgeHandler) WrapHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = withCleanPath(r)
 		requiresPayment, token := h.ShouldRequirePayment(r)
 
-		if !requiresPayment {
+		// A token means payment still has to be verified
+		if !requiresPayment && token == "" {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		if token == "" || !h.VerifyToken(token) {
-			for k, v := range h.PaymentRequiredHeaders() {
+		if token == "" || !h.VerifyTokenForRequest(r, token) {
+			for k, v := range h.PaymentRequiredHeadersFor(r) {
 				w.Header().Set(k, v)
 			}
 			w.WriteHeader(http.StatusPaymentRequired)
-			_, _ = w.Write(h.PaymentRequiredJSON())
+			_, _ = w.Write(h.PaymentRequiredJSONFor(r))
 			return
 		}
 
@@ -0,0 +1,215 @@
+package edge
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newVerifyService returns a verify service accepting tokens in valid and
+// counting calls
+func newVerifyService(t *testing.T, secret string, valid map[string]bool, calls *int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		body, _ := io.ReadAll(r.Body)
+
+		if secret != "" && !CheckVerifySignature(secret, r.Header.Get(SignatureHeader), body, time.Minute) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var req VerifyRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(VerifyResponse{Valid: valid[req.Token]})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestVerifyRemote_CacheHit(t *testing.T) {
+	var calls int32
+	service := newVerifyService(t, "", map[string]bool{"tok_paid": true}, &calls)
+	h := NewEdgeHandler(EdgeConfig{Price: 100, VerifyEndpoint: service.URL})
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	for i := 0; i < 3; i++ {
+		if !h.VerifyTokenForRequest(req, "tok_paid") {
+			t.Fatal("Expected token to verify")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected one remote call with caching, got %d", calls)
+	}
+}
+
+func TestVerifyRemote_Rejection(t *testing.T) {
+	var calls int32
+	service := newVerifyService(t, "", map[string]bool{}, &calls)
+	h := NewEdgeHandler(EdgeConfig{Price: 100, VerifyEndpoint: service.URL})
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("Authorization", "Bearer tok_unpaid")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 for rejected token, got %d", w.Code)
+	}
+
+	// Rejections are not cached
+	h.VerifyTokenForRequest(req, "tok_unpaid")
+	if calls != 2 {
+		t.Errorf("Expected rejections to be re-checked, got %d calls", calls)
+	}
+}
+
+func TestVerifyRemote_HMACSignature(t *testing.T) {
+	var calls int32
+	service := newVerifyService(t, "edge_secret", map[string]bool{"tok_paid": true}, &calls)
+
+	signed := NewEdgeHandler(EdgeConfig{VerifyEndpoint: service.URL, VerifySecret: "edge_secret"})
+	if !signed.VerifyToken("tok_paid") {
+		t.Error("Expected signed request to be accepted")
+	}
+
+	wrongSecret := NewEdgeHandler(EdgeConfig{VerifyEndpoint: service.URL, VerifySecret: "other"})
+	if wrongSecret.VerifyToken("tok_paid") {
+		t.Error("Expected request with wrong signature to be rejected")
+	}
+}
+
+func TestVerifyRemote_Timeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		_ = json.NewEncoder(w).Encode(VerifyResponse{Valid: true})
+	}))
+	defer slow.Close()
+
+	closed := NewEdgeHandler(EdgeConfig{VerifyEndpoint: slow.URL, VerifyTimeoutMs: 50})
+	if closed.VerifyToken("tok_paid") {
+		t.Error("Expected fail-closed handler to reject on timeout")
+	}
+
+	open := NewEdgeHandler(EdgeConfig{VerifyEndpoint: slow.URL, VerifyTimeoutMs: 50, FailMode: FailOpen})
+	if !open.VerifyToken("tok_paid") {
+		t.Error("Expected fail-open handler to accept on timeout")
+	}
+}
+
+func TestVerifyRemote_ServerErrorFailsClosed(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	h := NewEdgeHandler(EdgeConfig{VerifyEndpoint: broken.URL})
+	if h.VerifyToken("tok_paid") {
+		t.Error("Expected 5xx from verify service to fail closed")
+	}
+}
+
+func TestCheckVerifySignature_RejectsStale(t *testing.T) {
+	body := []byte(`{"token":"x"}`)
+	header := SignVerifyRequest("secret", time.Now().Add(-10*time.Minute), body)
+
+	if CheckVerifySignature("secret", header, body, time.Minute) {
+		t.Error("Expected stale signature to be rejected")
+	}
+	if !CheckVerifySignature("secret", header, body, time.Hour) {
+		t.Error("Expected signature within max age to be accepted")
+	}
+	if CheckVerifySignature("secret", header, []byte(`{"token":"y"}`), time.Hour) {
+		t.Error("Expected tampered body to be rejected")
+	}
+}
+
+func TestWrapHandler_VerifiesPresentedToken(t *testing.T) {
+	h := NewEdgeHandler(EdgeConfig{Price: 100, ValidTokens: []string{"tok_paid"}, ExemptPaths: []string{"/public"}})
+	handler := h.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		path  string
+		token string
+		want  int
+	}{
+		{"/api/data", "", http.StatusPaymentRequired},
+		{"/api/data", "tok_forged", http.StatusPaymentRequired},
+		{"/api/data", "tok_paid", http.StatusOK},
+		{"/public/info", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tt.want {
+			t.Errorf("%s with token %q: expected %d, got %d", tt.path, tt.token, tt.want, w.Code)
+		}
+	}
+}
+
+func TestWrapHandler_AcceptsX402PaymentHeaders(t *testing.T) {
+	var calls int32
+	service := newVerifyService(t, "", map[string]bool{"eyJwYXlsb2FkIjoicGFpZCJ9": true}, &calls)
+	h := NewEdgeHandler(EdgeConfig{Price: 100, VerifyEndpoint: service.URL})
+	handler := h.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, header := range []string{"X-PAYMENT", "PAYMENT-SIGNATURE"} {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set(header, "eyJwYXlsb2FkIjoicGFpZCJ9")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected a payment in %s to be accepted, got %d", header, w.Code)
+		}
+	}
+}
+
+func TestVerifyToken_TestTokensRequireTestMode(t *testing.T) {
+	if err := (EdgeConfig{Price: 100}).Validate(); err == nil {
+		t.Error("Expected Validate to require token verification")
+	}
+	if err := (EdgeConfig{Price: 100, TestMode: true}).Validate(); err != nil {
+		t.Errorf("Expected test mode to be valid, got %v", err)
+	}
+
+	if NewEdgeHandler(EdgeConfig{Price: 100, ValidTokens: []string{"tok"}}).VerifyToken("valid_foo") {
+		t.Error("Expected valid_foo to be refused outside test mode")
+	}
+	if NewEdgeHandler(EdgeConfig{Price: 100}).VerifyToken("valid_foo") {
+		t.Error("Expected valid_foo to be refused without any verification")
+	}
+	if !NewEdgeHandler(EdgeConfig{Price: 100, TestMode: true}).VerifyToken("valid_foo") {
+		t.Error("Expected valid_foo to be accepted in test mode")
+	}
+}
+
+func TestExtractToken_QueryTokenOptIn(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/data?payment_token=valid_q", nil)
+
+	if token := NewEdgeHandler(EdgeConfig{Price: 100, TestMode: true}).ExtractToken(req); token != "" {
+		t.Errorf("Expected the query token to be ignored by default, got %q", token)
+	}
+	if token := NewEdgeHandler(EdgeConfig{Price: 100, TestMode: true, AllowQueryToken: true}).ExtractToken(req); token != "valid_q" {
+		t.Errorf("Expected valid_q with AllowQueryToken, got %q", token)
+	}
+}
@@ -0,0 +1,146 @@
+package edge
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxy_RoundTripsBodyAndHeaders(t *testing.T) {
+	var got *http.Request
+	var gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		w.Header().Set("X-Upstream", "yes")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created:" + gotBody))
+	}))
+	defer upstream.Close()
+
+	h := NewEdgeHandler(EdgeConfig{Price: 100, UpstreamURL: upstream.URL + "/base", TestMode: true})
+
+	req := httptest.NewRequest("POST", "/api/items?x=1&payment_token=valid_q", strings.NewReader(`{"name":"a"}`))
+	req.Header.Set("Authorization", "Bearer valid_token")
+	req.Header.Set("X-Payment-Token", "valid_other")
+	req.Header.Set("X-Custom", "kept")
+	req.AddCookie(&http.Cookie{Name: "x402_token", Value: "valid_cookie"})
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected upstream status 201, got %d", w.Code)
+	}
+	if w.Body.String() != `created:{"name":"a"}` {
+		t.Errorf("Unexpected body: %s", w.Body.String())
+	}
+	if w.Header().Get("X-Upstream") != "yes" || w.Header().Get("X-Payment-Verified") != "true" {
+		t.Errorf("Expected upstream and success headers, got %v", w.Header())
+	}
+
+	if got.Method != "POST" || got.URL.Path != "/base/api/items" || got.URL.RawQuery != "x=1" {
+		t.Errorf("Unexpected upstream request: %s %s?%s", got.Method, got.URL.Path, got.URL.RawQuery)
+	}
+	if gotBody != `{"name":"a"}` {
+		t.Errorf("Unexpected upstream body: %s", gotBody)
+	}
+	if got.Header.Get("X-Custom") != "kept" {
+		t.Error("Expected custom header to be forwarded")
+	}
+	for _, h := range []string{"Authorization", "X-Payment-Token"} {
+		if got.Header.Get(h) != "" {
+			t.Errorf("Expected payment header %s to be stripped", h)
+		}
+	}
+	if _, err := got.Cookie("x402_token"); err == nil {
+		t.Error("Expected payment cookie to be stripped")
+	}
+	if c, err := got.Cookie("session"); err != nil || c.Value != "abc" {
+		t.Error("Expected other cookies to be forwarded")
+	}
+}
+
+func TestProxy_UnpaidNeverReachesUpstream(t *testing.T) {
+	called := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer upstream.Close()
+
+	h := NewEdgeHandler(EdgeConfig{Price: 100, UpstreamURL: upstream.URL})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402, got %d", w.Code)
+	}
+	if called {
+		t.Error("Expected unpaid request not to be proxied")
+	}
+}
+
+func TestProxy_ExemptPathProxied(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("public"))
+	}))
+	defer upstream.Close()
+
+	h := NewEdgeHandler(EdgeConfig{Price: 100, UpstreamURL: upstream.URL, ExemptPaths: []string{"/public"}})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/public/info", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != "public" {
+		t.Errorf("Expected exempt path to be proxied, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestProxy_Timeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+
+	h := NewEdgeHandler(EdgeConfig{Price: 100, UpstreamURL: upstream.URL, UpstreamTimeoutMs: 50, TestMode: true})
+
+	req := httptest.NewRequest("GET", "/api/slow", nil)
+	req.Header.Set("Authorization", "Bearer valid_token")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 on upstream timeout, got %d", w.Code)
+	}
+}
+
+func TestProxy_PathTraversalNotExempt(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	mux.HandleFunc("/api/premium", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("premium")) })
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/api/premium", http.StatusFound) })
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+
+	h := NewEdgeHandler(EdgeConfig{Price: 100, UpstreamURL: upstream.URL, ExemptPaths: []string{"/health", "/moved"}, TestMode: true})
+	for _, target := range []string{"/health/../api/premium", "/health/%2e%2e/api/premium", "//health/..//api/premium"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusPaymentRequired {
+			t.Errorf("%s: expected 402, got %d: %s", target, w.Code, w.Body.String())
+		}
+	}
+
+	// Upstream redirects are passed back, not followed
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/moved", nil))
+	if w.Code != http.StatusFound || w.Body.String() == "premium" {
+		t.Errorf("Expected the redirect returned unfollowed, got %d: %s", w.Code, w.Body.String())
+	}
+}
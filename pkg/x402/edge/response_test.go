@@ -0,0 +1,83 @@
+package edge
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/siddimore/x402-seller-middleware/pkg/x402"
+)
+
+func decodePaymentRequiredHeader(t *testing.T, header string) map[string]interface{} {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		t.Fatalf("PAYMENT-REQUIRED is not base64: %v", err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatalf("PAYMENT-REQUIRED is not JSON: %v", err)
+	}
+	return decoded
+}
+
+func TestPaymentRequired_MatchesMainPackage(t *testing.T) {
+	edgeHandler := NewEdgeHandler(EdgeConfig{
+		Price:    100,
+		Currency: "USDC",
+		PayTo:    "0x1234567890123456789012345678901234567890",
+		Network:  "base",
+		Asset:    "0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913",
+	})
+	mainHandler := x402.Middleware(http.NotFoundHandler(), x402.Config{
+		PricePerRequest: 100,
+		Currency:        "USDC",
+		PayTo:           "0x1234567890123456789012345678901234567890",
+		Network:         "base",
+		Asset:           "0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913",
+		TestMode:        true,
+	})
+
+	edgeRec := httptest.NewRecorder()
+	edgeHandler.ServeHTTP(edgeRec, httptest.NewRequest("GET", "/api/data?q=1", nil))
+	mainRec := httptest.NewRecorder()
+	mainHandler.ServeHTTP(mainRec, httptest.NewRequest("GET", "/api/data?q=1", nil))
+
+	if edgeRec.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402, got %d", edgeRec.Code)
+	}
+
+	edgeHeader := decodePaymentRequiredHeader(t, edgeRec.Header().Get("PAYMENT-REQUIRED"))
+	mainHeader := decodePaymentRequiredHeader(t, mainRec.Header().Get("PAYMENT-REQUIRED"))
+	if !reflect.DeepEqual(edgeHeader, mainHeader) {
+		t.Errorf("Edge PAYMENT-REQUIRED differs from main package:\nedge: %v\nmain: %v", edgeHeader, mainHeader)
+	}
+
+	var edgeBody, mainBody map[string]interface{}
+	_ = json.Unmarshal(edgeRec.Body.Bytes(), &edgeBody)
+	_ = json.Unmarshal(mainRec.Body.Bytes(), &mainBody)
+	if !reflect.DeepEqual(edgeBody, mainBody) {
+		t.Errorf("Edge body differs from main package:\nedge: %v\nmain: %v", edgeBody, mainBody)
+	}
+}
+
+func TestPaymentRequired_LegacyFormat(t *testing.T) {
+	h := NewEdgeHandler(EdgeConfig{Price: 100, PaymentEndpoint: "https://pay.example.com", LegacyFormat: true})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+
+	var body PaymentRequiredResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode legacy body: %v", err)
+	}
+	if body.Status != 402 || body.PaymentURL != "https://pay.example.com" || body.Amount != 100 {
+		t.Errorf("Unexpected legacy body: %+v", body)
+	}
+	if w.Header().Get("PAYMENT-REQUIRED") != "" {
+		t.Error("Expected no PAYMENT-REQUIRED header in legacy format")
+	}
+}
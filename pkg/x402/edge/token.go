@@ -0,0 +1,106 @@
+package edge
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// EdgeTokenPrefix marks self-contained HMAC-signed tokens
+const EdgeTokenPrefix = "x402e."
+
+// Edge token errors
+var (
+	ErrTokenMalformed = errors.New("edge token malformed")
+	ErrTokenSignature = errors.New("edge token signature invalid")
+	ErrTokenExpired   = errors.New("edge token expired")
+	ErrTokenResource  = errors.New("edge token not valid for resource")
+	ErrTokenAmount    = errors.New("edge token amount too low")
+)
+
+// EdgeTokenClaims is the payload of a self-contained edge token
+type EdgeTokenClaims struct {
+	Payer     string `json:"payer"`
+	Resource  string `json:"res"`           // Path prefix the token unlocks
+	ExpiresAt int64  `json:"exp"`           // Unix seconds
+	Amount    int64  `json:"amt"`           // Amount paid in smallest currency unit
+	IssuedAt  int64  `json:"iat,omitempty"` // Unix seconds
+}
+
+// MintEdgeToken creates an HMAC-signed token the edge handler can verify
+// locally. The payment service calls this after settling a payment.
+func MintEdgeToken(secret string, claims EdgeTokenClaims) (string, error) {
+	if secret == "" {
+		return "", errors.New("signing secret is required")
+	}
+	if claims.ExpiresAt == 0 {
+		return "", errors.New("expiry is required")
+	}
+	if claims.IssuedAt == 0 {
+		claims.IssuedAt = time.Now().Unix()
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return EdgeTokenPrefix + encoded + "." + signEdgeToken(secret, encoded), nil
+}
+
+// ParseEdgeToken checks the signature and expiry of an edge token.
+// skew is tolerated on expiry to absorb clock drift between issuer and edge.
+func ParseEdgeToken(secret, token string, now time.Time, skew time.Duration) (*EdgeTokenClaims, error) {
+	if !strings.HasPrefix(token, EdgeTokenPrefix) {
+		return nil, ErrTokenMalformed
+	}
+	payload, sig, ok := strings.Cut(strings.TrimPrefix(token, EdgeTokenPrefix), ".")
+	if !ok || payload == "" || sig == "" {
+		return nil, ErrTokenMalformed
+	}
+
+	// Constant-time comparison of the signature
+	if !hmac.Equal([]byte(sig), []byte(signEdgeToken(secret, payload))) {
+		return nil, ErrTokenSignature
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrTokenMalformed
+	}
+	var claims EdgeTokenClaims
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, ErrTokenMalformed
+	}
+
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(skew)) {
+		return nil, ErrTokenExpired
+	}
+	if claims.IssuedAt != 0 && time.Unix(claims.IssuedAt, 0).After(now.Add(skew)) {
+		// Issued in the future beyond tolerated drift
+		return nil, ErrTokenMalformed
+	}
+	return &claims, nil
+}
+
+// AllowsPath reports whether the token's resource prefix covers path,
+// matching whole segments of the cleaned path: "/api/free" covers
+// "/api/free/today" but not "/api/freebies" or "/api/free/../premium".
+// An empty resource unlocks every path.
+func (c *EdgeTokenClaims) AllowsPath(path string) bool {
+	if c.Resource == "" || c.Resource == "/" {
+		return true
+	}
+	path = cleanPath(path)
+	return path == c.Resource || strings.HasPrefix(path, strings.TrimSuffix(c.Resource, "/")+"/")
+}
+
+func signEdgeToken(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,160 @@
+package edge
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mintTestToken(t *testing.T, secret string, claims EdgeTokenClaims) string {
+	t.Helper()
+	token, err := MintEdgeToken(secret, claims)
+	if err != nil {
+		t.Fatalf("MintEdgeToken failed: %v", err)
+	}
+	return token
+}
+
+func TestEdgeToken_Valid(t *testing.T) {
+	token := mintTestToken(t, "secret", EdgeTokenClaims{
+		Payer:     "0xpayer",
+		Resource:  "/api/",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Amount:    100,
+	})
+
+	claims, err := ParseEdgeToken("secret", token, time.Now(), 0)
+	if err != nil {
+		t.Fatalf("Expected valid token, got %v", err)
+	}
+	if claims.Payer != "0xpayer" || claims.Amount != 100 {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+
+	h := NewEdgeHandler(EdgeConfig{Price: 100, SigningSecret: "secret"})
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 for valid signed token, got %d", w.Code)
+	}
+}
+
+func TestEdgeToken_Expired(t *testing.T) {
+	token := mintTestToken(t, "secret", EdgeTokenClaims{ExpiresAt: time.Now().Add(-time.Minute).Unix(), Amount: 100})
+
+	if _, err := ParseEdgeToken("secret", token, time.Now(), 0); err != ErrTokenExpired {
+		t.Errorf("Expected ErrTokenExpired, got %v", err)
+	}
+
+	// Within tolerated clock skew
+	if _, err := ParseEdgeToken("secret", token, time.Now(), 2*time.Minute); err != nil {
+		t.Errorf("Expected skew tolerance to accept token, got %v", err)
+	}
+
+	h := NewEdgeHandler(EdgeConfig{Price: 100, SigningSecret: "secret", ClockSkewSeconds: 1})
+	if h.VerifyToken(token) {
+		t.Error("Expected expired token to be rejected")
+	}
+}
+
+func TestEdgeToken_Tampered(t *testing.T) {
+	token := mintTestToken(t, "secret", EdgeTokenClaims{ExpiresAt: time.Now().Add(time.Hour).Unix(), Amount: 1})
+
+	// Swap in a payload claiming a larger amount, keeping the old signature
+	forged := mintTestToken(t, "secret", EdgeTokenClaims{ExpiresAt: time.Now().Add(time.Hour).Unix(), Amount: 1000000})
+	forgedPayload := strings.Split(strings.TrimPrefix(forged, EdgeTokenPrefix), ".")[0]
+	origSig := strings.Split(strings.TrimPrefix(token, EdgeTokenPrefix), ".")[1]
+	tampered := EdgeTokenPrefix + forgedPayload + "." + origSig
+
+	if _, err := ParseEdgeToken("secret", tampered, time.Now(), 0); err != ErrTokenSignature {
+		t.Errorf("Expected ErrTokenSignature, got %v", err)
+	}
+	if _, err := ParseEdgeToken("other-secret", token, time.Now(), 0); err != ErrTokenSignature {
+		t.Errorf("Expected wrong secret to fail signature check, got %v", err)
+	}
+	if _, err := ParseEdgeToken("secret", "x402e.garbage", time.Now(), 0); err != ErrTokenMalformed {
+		t.Errorf("Expected ErrTokenMalformed, got %v", err)
+	}
+
+	h := NewEdgeHandler(EdgeConfig{Price: 100, SigningSecret: "secret"})
+	if h.VerifyToken(token) {
+		t.Error("Expected token below the price to be rejected")
+	}
+}
+
+func TestEdgeToken_WrongResource(t *testing.T) {
+	token := mintTestToken(t, "secret", EdgeTokenClaims{
+		Resource:  "/api/weather",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Amount:    100,
+	})
+	h := NewEdgeHandler(EdgeConfig{Price: 100, SigningSecret: "secret"})
+
+	req := httptest.NewRequest("GET", "/api/stocks", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	requires, tok := h.ShouldRequirePayment(req)
+	if !requires || tok != "" {
+		t.Errorf("Expected out-of-scope token to require payment, got (%v, %q)", requires, tok)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 for wrong resource, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/weather/today", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 within resource prefix, got %d", w.Code)
+	}
+}
+
+func TestEdgeTokenClaims_AllowsPath(t *testing.T) {
+	claims := EdgeTokenClaims{Resource: "/api/free"}
+	for path, want := range map[string]bool{
+		"/api/free":            true,
+		"/api/free/today":      true,
+		"/api/freeX":           false,
+		"/api/free/../premium": false,
+		"/api/premium":         false,
+	} {
+		if got := claims.AllowsPath(path); got != want {
+			t.Errorf("AllowsPath(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestEdgeToken_ScopedNeedsRequest(t *testing.T) {
+	h := NewEdgeHandler(EdgeConfig{Price: 100, SigningSecret: "secret"})
+	scoped := mintTestToken(t, "secret", EdgeTokenClaims{Resource: "/api/weather", ExpiresAt: time.Now().Add(time.Hour).Unix(), Amount: 100})
+	unscoped := mintTestToken(t, "secret", EdgeTokenClaims{ExpiresAt: time.Now().Add(time.Hour).Unix(), Amount: 100})
+
+	// Without a request the scope can't be checked
+	if h.VerifyToken(scoped) {
+		t.Error("Expected a resource-scoped token refused without a request")
+	}
+	if !h.VerifyToken(unscoped) {
+		t.Error("Expected an unscoped token accepted without a request")
+	}
+	if !h.VerifyTokenForRequest(httptest.NewRequest("GET", "/api/weather/today", nil), scoped) {
+		t.Error("Expected the scoped token accepted for its resource")
+	}
+}
+
+func TestMintEdgeToken_RequiresSecretAndExpiry(t *testing.T) {
+	if _, err := MintEdgeToken("", EdgeTokenClaims{ExpiresAt: 1}); err == nil {
+		t.Error("Expected error without secret")
+	}
+	if _, err := MintEdgeToken("secret", EdgeTokenClaims{}); err == nil {
+		t.Error("Expected error without expiry")
+	}
+}
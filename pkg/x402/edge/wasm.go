@@ -0,0 +1,81 @@
+//go:build js && wasm
+
+package edge
+
+import (
+	"fmt"
+	"syscall/js"
+)
+
+// RegisterWorkerHandler exposes h to JavaScript as globalThis[name].
+// The function takes a plain object {method, url, headers, body} and returns
+// a Promise resolving to {status, headers, body, forward}. Work runs on a
+// goroutine because upstream and verify calls block on fetch.
+func RegisterWorkerHandler(name string, h *EdgeHandler) {
+	js.Global().Set(name, js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		var req WorkerRequest
+		if len(args) > 0 {
+			req = workerRequestFromJS(args[0])
+		}
+
+		// The executor is released once the promise settles, or every
+		// request would leak a function
+		var executor js.Func
+		executor = js.FuncOf(func(this js.Value, p []js.Value) interface{} {
+			resolve, reject := p[0], p[1]
+			go func() {
+				defer executor.Release()
+				defer func() {
+					if err := recover(); err != nil {
+						reject.Invoke(js.Global().Get("Error").New(fmt.Sprint(err)))
+					}
+				}()
+				resolve.Invoke(workerResponseToJS(h.HandleWorkerRequest(req)))
+			}()
+			return nil
+		})
+		return js.Global().Get("Promise").New(executor)
+	}))
+}
+
+// workerRequestFromJS reads a plain JS request object
+func workerRequestFromJS(v js.Value) WorkerRequest {
+	req := WorkerRequest{
+		Method:  jsString(v.Get("method")),
+		URL:     jsString(v.Get("url")),
+		Body:    jsString(v.Get("body")),
+		Headers: make(map[string]string),
+	}
+
+	headers := v.Get("headers")
+	if headers.Type() == js.TypeObject {
+		keys := js.Global().Get("Object").Call("keys", headers)
+		for i := 0; i < keys.Length(); i++ {
+			k := keys.Index(i).String()
+			req.Headers[k] = jsString(headers.Get(k))
+		}
+	}
+	return req
+}
+
+// workerResponseToJS builds a plain JS response object
+func workerResponseToJS(resp WorkerResponse) js.Value {
+	headers := js.Global().Get("Object").New()
+	for k, v := range resp.Headers {
+		headers.Set(k, v)
+	}
+
+	out := js.Global().Get("Object").New()
+	out.Set("status", resp.Status)
+	out.Set("headers", headers)
+	out.Set("body", resp.Body)
+	out.Set("forward", resp.Forward)
+	return out
+}
+
+func jsString(v js.Value) string {
+	if v.Type() != js.TypeString {
+		return ""
+	}
+	return v.String()
+}
@@ -0,0 +1,109 @@
+package edge
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+// WorkerRequest is a platform-neutral request passed in from a JS worker
+type WorkerRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// WorkerResponse tells the worker what to do with a request
+type WorkerResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body,omitempty"`
+
+	// Forward is true when the request is paid (or exempt) and no
+	// UpstreamURL is configured: the worker should fetch the origin itself
+	// and add Headers to the origin response.
+	Forward bool `json:"forward"`
+}
+
+// HandleWorkerRequest runs a worker request through ShouldRequirePayment and
+// VerifyToken. When UpstreamURL is set the request is proxied and the
+// upstream response returned; otherwise paid requests come back with Forward.
+func (h *EdgeHandler) HandleWorkerRequest(req WorkerRequest) WorkerResponse {
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	r, err := http.NewRequest(method, req.URL, strings.NewReader(req.Body))
+	if err != nil {
+		return WorkerResponse{
+			Status:  http.StatusBadRequest,
+			Headers: map[string]string{"Content-Type": "text/plain"},
+			Body:    "invalid request URL",
+		}
+	}
+	for k, v := range req.Headers {
+		r.Header.Set(k, v)
+	}
+	r.Host = r.URL.Host
+	r = withCleanPath(r)
+
+	if h.config.UpstreamURL != "" {
+		rec := newBufferedResponse()
+		h.ServeHTTP(rec, r)
+		return rec.workerResponse()
+	}
+
+	requiresPayment, token := h.ShouldRequirePayment(r)
+	if !requiresPayment && token == "" {
+		return WorkerResponse{Status: http.StatusOK, Headers: map[string]string{}, Forward: true}
+	}
+
+	if token == "" || !h.VerifyTokenForRequest(r, token) {
+		return WorkerResponse{
+			Status:  http.StatusPaymentRequired,
+			Headers: h.PaymentRequiredHeadersFor(r),
+			Body:    string(h.PaymentRequiredJSONFor(r)),
+		}
+	}
+
+	return WorkerResponse{Status: http.StatusOK, Headers: h.SuccessHeaders(), Forward: true}
+}
+
+// bufferedResponse is a minimal in-memory http.ResponseWriter
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) workerResponse() WorkerResponse {
+	headers := make(map[string]string, len(b.header))
+	for k := range b.header {
+		headers[k] = b.header.Get(k)
+	}
+	status := b.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return WorkerResponse{Status: status, Headers: headers, Body: b.body.String()}
+}
@@ -0,0 +1,59 @@
+package edge
+
+import (
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestHandleWorkerRequest(t *testing.T) {
+	h := NewEdgeHandler(EdgeConfig{Price: 100, ExemptPaths: []string{"/public"}, TestMode: true})
+
+	tests := []struct {
+		name        string
+		req         WorkerRequest
+		wantStatus  int
+		wantForward bool
+	}{
+		{"unpaid", WorkerRequest{URL: "https://api.example.com/api/data"}, http.StatusPaymentRequired, false},
+		{"invalid token", WorkerRequest{URL: "https://api.example.com/api/data", Headers: map[string]string{"Authorization": "Bearer bogus"}}, http.StatusPaymentRequired, false},
+		{"paid", WorkerRequest{URL: "https://api.example.com/api/data", Headers: map[string]string{"Authorization": "Bearer valid_token"}}, http.StatusOK, true},
+		{"exempt", WorkerRequest{URL: "https://api.example.com/public/info"}, http.StatusOK, true},
+		{"bad url", WorkerRequest{URL: "://bad"}, http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := h.HandleWorkerRequest(tt.req)
+			if resp.Status != tt.wantStatus || resp.Forward != tt.wantForward {
+				t.Errorf("Expected (%d, forward=%v), got (%d, forward=%v)", tt.wantStatus, tt.wantForward, resp.Status, resp.Forward)
+			}
+		})
+	}
+
+	resp := h.HandleWorkerRequest(WorkerRequest{URL: "https://api.example.com/api/data"})
+	if resp.Headers["PAYMENT-REQUIRED"] == "" || resp.Body == "" {
+		t.Error("Expected 402 headers and body for the worker to return")
+	}
+}
+
+// TestWASMBuild checks the edge package and worker example compile for js/wasm
+func TestWASMBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping wasm compile check in short mode")
+	}
+
+	goBin := filepath.Join(runtime.GOROOT(), "bin", "go")
+	if _, err := os.Stat(goBin); err != nil {
+		t.Skip("go toolchain not available")
+	}
+
+	cmd := exec.Command(goBin, "vet", ".", "../../../examples/cloudflare-worker")
+	cmd.Env = append(os.Environ(), "GOOS=js", "GOARCH=wasm")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("js/wasm build failed: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,158 @@
+// Package x402 - Errors
+// Stores, rails and schemes report failures with these sentinels and types so
+// callers, and the package's own handlers, can tell a missing record from a
+// refused payment or an outage with errors.Is and errors.As instead of
+// matching messages. Narrower sentinels such as ErrCouponNotFound also match
+// the general one (ErrNotFound).
+package x402
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// ErrNotFound is returned by stores for unknown IDs
+	ErrNotFound = errors.New("not found")
+
+	// ErrInsufficientBudget is returned when a budget can't cover a deduction
+	ErrInsufficientBudget = errors.New("insufficient budget")
+
+	// ErrExpired is returned for sessions, coupons and payments past their
+	// deadline
+	ErrExpired = errors.New("expired")
+
+	// ErrInvalidPayment is returned for payment proofs that can't be used
+	ErrInvalidPayment = errors.New("invalid payment")
+
+	// ErrRailUnavailable is returned when a payment provider can't be
+	// reached or fails on its side
+	ErrRailUnavailable = errors.New("payment rail unavailable")
+
+	// ErrConflict is returned for changes that clash with one already made
+	// or under way
+	ErrConflict = errors.New("conflict")
+)
+
+var (
+	// ErrBudgetNotFound is returned for unknown pre-authorized budgets
+	ErrBudgetNotFound = kindOf(ErrNotFound, "budget not found")
+
+	// ErrSessionNotFound is returned for unknown session IDs
+	ErrSessionNotFound = kindOf(ErrNotFound, "session not found")
+
+	// ErrSessionExpired is returned for sessions past their expiry
+	ErrSessionExpired = kindOf(ErrExpired, "session has expired")
+
+	// ErrSessionLimitReached is returned for request-based sessions that
+	// have used all their requests
+	ErrSessionLimitReached = errors.New("session request limit exceeded")
+
+	// ErrPaymentRecordNotFound is returned by ledgers for unknown payments
+	ErrPaymentRecordNotFound = kindOf(ErrNotFound, "payment record not found")
+)
+
+// kindError is a specific error that also matches a general sentinel
+type kindError struct {
+	kind error
+	msg  string
+}
+
+// kindOf returns an error with message msg that errors.Is matches to kind
+func kindOf(kind error, msg string) error {
+	return &kindError{kind: kind, msg: msg}
+}
+
+func (e *kindError) Error() string        { return e.msg }
+func (e *kindError) Is(target error) bool { return target == e.kind }
+
+// StripeError is a failed Stripe API call: an error response, or no response
+// at all. It matches ErrRailUnavailable for outages and rate limits,
+// ErrInvalidPayment for card errors and ErrNotFound for unknown objects.
+type StripeError struct {
+	StatusCode int    // 0 if Stripe could not be reached
+	Type       string // e.g. "card_error", "invalid_request_error"
+	Code       string // e.g. "card_declined"
+	Message    string
+	Err        error // Transport error, if Stripe could not be reached
+}
+
+// newStripeError reads Stripe's error envelope from an error response body
+func newStripeError(statusCode int, body []byte) *StripeError {
+	var envelope struct {
+		Error struct {
+			Type    string `json:"type"`
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	e := &StripeError{StatusCode: statusCode, Message: string(body)}
+	if json.Unmarshal(body, &envelope) == nil && envelope.Error.Message != "" {
+		e.Type, e.Code, e.Message = envelope.Error.Type, envelope.Error.Code, envelope.Error.Message
+	}
+	return e
+}
+
+func (e *StripeError) Error() string {
+	if e.Err != nil {
+		return "stripe API error: " + e.Err.Error()
+	}
+	return "stripe error: " + e.Message
+}
+
+func (e *StripeError) Unwrap() error { return e.Err }
+
+func (e *StripeError) Is(target error) bool {
+	switch target {
+	case ErrRailUnavailable:
+		return e.Err != nil || e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	case ErrInvalidPayment:
+		return e.Type == "card_error"
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// FacilitatorError is a failed call to an x402 facilitator. It always
+// matches ErrRailUnavailable.
+type FacilitatorError struct {
+	Op         string // "verify", "settle" or "supported"
+	StatusCode int    // 0 if the facilitator could not be reached
+	Message    string
+	Err        error
+}
+
+func (e *FacilitatorError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("facilitator API error: %s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("facilitator %s returned status %d: %s", e.Op, e.StatusCode, e.Message)
+}
+
+func (e *FacilitatorError) Unwrap() error { return e.Err }
+
+func (e *FacilitatorError) Is(target error) bool { return target == ErrRailUnavailable }
+
+// errorStatus is the HTTP status a handler answers err with
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidPageToken):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrInsufficientBudget), errors.Is(err, ErrInvalidPayment):
+		return http.StatusPaymentRequired
+	case errors.Is(err, ErrBudgetSuspended):
+		return http.StatusForbidden
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrExpired):
+		return http.StatusGone
+	case errors.Is(err, ErrRailUnavailable):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,154 @@
+package x402
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// wrapTwice wraps err the way callers typically do, two layers deep
+func wrapTwice(err error) error {
+	return fmt.Errorf("handler: %w", fmt.Errorf("store: %w", err))
+}
+
+func TestErrors_IsThroughWrapping(t *testing.T) {
+	budgets := NewInMemoryPreAuthStore()
+	_, budgetErr := budgets.Get("missing")
+	_, agentErr := budgets.GetByAgentID("nobody")
+	_, sessionErr := NewInMemorySessionStore().GetSession("missing")
+	_, couponErr := NewInMemoryCouponStore().Get("MISSING")
+	_, ledgerErr := NewInMemoryPaymentLedger(0).Get("missing")
+	_, taskErr := NewInMemoryTaskSpendStore(TaskSpendLimits{}).Get("missing")
+
+	tests := []struct {
+		name   string
+		err    error
+		target error
+	}{
+		{"budget", budgetErr, ErrNotFound},
+		{"budget by agent", agentErr, ErrBudgetNotFound},
+		{"session", sessionErr, ErrNotFound},
+		{"coupon", couponErr, ErrNotFound},
+		{"ledger", ledgerErr, ErrPaymentRecordNotFound},
+		{"task", taskErr, ErrNotFound},
+		{"expired coupon", ErrCouponExpired, ErrExpired},
+		{"expired session", ErrSessionExpired, ErrExpired},
+		{"subscription", ErrSubscriptionNotFound, ErrNotFound},
+	}
+	for _, tt := range tests {
+		if tt.err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+			continue
+		}
+		if !errors.Is(wrapTwice(tt.err), tt.target) {
+			t.Errorf("%s: expected %v to match %v", tt.name, tt.err, tt.target)
+		}
+	}
+	if errors.Is(ErrCouponNotFound, ErrExpired) || errors.Is(ErrSessionExpired, ErrNotFound) {
+		t.Error("Expected sentinels to match only their own kind")
+	}
+}
+
+func TestStripeRail_TypedErrors(t *testing.T) {
+	stripeAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/payment_intents":
+			w.WriteHeader(http.StatusPaymentRequired)
+			fmt.Fprint(w, `{"error":{"type":"card_error","code":"card_declined","message":"Your card was declined."}}`)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error":{"type":"api_error","message":"Try again later."}}`)
+		}
+	}))
+	defer stripeAPI.Close()
+
+	stripe := NewStripeRail("sk_test", "")
+	stripe.BaseURL = stripeAPI.URL
+
+	_, err := stripe.CreatePaymentIntent(context.Background(), &PaymentIntentRequest{Amount: 100, Currency: "USD"})
+	var stripeErr *StripeError
+	if !errors.As(wrapTwice(err), &stripeErr) || stripeErr.Code != "card_declined" || stripeErr.StatusCode != http.StatusPaymentRequired {
+		t.Fatalf("Expected a card_declined StripeError, got %v", err)
+	}
+	if !errors.Is(wrapTwice(err), ErrInvalidPayment) || errors.Is(err, ErrRailUnavailable) {
+		t.Errorf("Expected a declined card to be an invalid payment, got %v", err)
+	}
+
+	_, err = stripe.VerifyPayment(context.Background(), &VerifyPaymentRequest{PaymentIntentID: "pi_1"})
+	if !errors.Is(wrapTwice(err), ErrRailUnavailable) {
+		t.Errorf("Expected a 503 to make the rail unavailable, got %v", err)
+	}
+
+	stripeAPI.Close()
+	_, err = stripe.VerifyPayment(context.Background(), &VerifyPaymentRequest{PaymentIntentID: "pi_1"})
+	if !errors.As(wrapTwice(err), &stripeErr) || stripeErr.Err == nil || !errors.Is(err, ErrRailUnavailable) {
+		t.Errorf("Expected an unreachable Stripe to be unavailable, got %v", err)
+	}
+}
+
+func TestEVMCryptoRail_TypedErrors(t *testing.T) {
+	facilitator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, "upstream RPC down")
+	}))
+	defer facilitator.Close()
+	rail := NewEVMCryptoRail(facilitator.URL, nil)
+
+	payload := base64.StdEncoding.EncodeToString([]byte(`{"x402Version":1,"scheme":"exact","payload":{}}`))
+	_, err := rail.VerifyPayment(context.Background(), &VerifyPaymentRequest{PaymentPayload: payload})
+	var facilitatorErr *FacilitatorError
+	if !errors.As(wrapTwice(err), &facilitatorErr) || facilitatorErr.Op != "verify" || facilitatorErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected a verify FacilitatorError, got %v", err)
+	}
+	if !errors.Is(wrapTwice(err), ErrRailUnavailable) {
+		t.Errorf("Expected the facilitator outage to make the rail unavailable, got %v", err)
+	}
+
+	_, err = rail.VerifyPayment(context.Background(), &VerifyPaymentRequest{PaymentPayload: "not base64!"})
+	if !errors.Is(wrapTwice(err), ErrInvalidPayment) {
+		t.Errorf("Expected a malformed payload to be an invalid payment, got %v", err)
+	}
+}
+
+// flakyBudgetStore fails every lookup with err
+type flakyBudgetStore struct {
+	*InMemoryPreAuthStore
+	err error
+}
+
+func (s *flakyBudgetStore) Get(id string) (*PreAuthBudget, error) { return nil, s.err }
+
+func TestAIBudgetHandler_ErrorStatuses(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{wrapTwice(ErrBudgetNotFound), http.StatusNotFound},
+		{wrapTwice(&StripeError{Err: context.DeadlineExceeded}), http.StatusServiceUnavailable},
+		{errors.New("disk on fire"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		handler := AIBudgetHandler(&flakyBudgetStore{NewInMemoryPreAuthStore(), tt.err}, AIFirstConfig{})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/ai/budget?id=b1", nil))
+		if w.Code != tt.want {
+			t.Errorf("%v: expected status %d, got %d", tt.err, tt.want, w.Code)
+		}
+	}
+
+	statuses := map[error]int{
+		ErrInsufficientBudget: http.StatusPaymentRequired,
+		ErrBudgetSuspended:    http.StatusForbidden,
+		ErrSessionExpired:     http.StatusGone,
+		ErrCouponNotFound:     http.StatusNotFound,
+	}
+	for err, want := range statuses {
+		if got := errorStatus(wrapTwice(err)); got != want {
+			t.Errorf("%v: expected status %d, got %d", err, want, got)
+		}
+	}
+}
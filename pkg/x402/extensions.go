@@ -0,0 +1,126 @@
+// Package x402 - 402 Extensions
+// A 402 quotes one request, but the server may offer cheaper ways to keep
+// paying: session tiers, a pre-authorized budget, batch pricing. Agents only
+// find them if the 402 says so. PaymentExtensions describes them; it is set
+// on Config (or UnifiedPaymentConfig) directly, and SessionMiddleware,
+// AIFirstMiddleware and AIAgentMiddleware add their own to the request, so a
+// payment middleware they wrap advertises whatever the server composes.
+package x402
+
+import (
+	"context"
+	"net/http"
+)
+
+// maxAdvertisedTiers bounds the session tiers copied into each 402
+const maxAdvertisedTiers = 5
+
+// PaymentExtensions are the optional features a 402 advertises, in each
+// accepts entry's extra and in the unified response's extensions
+type PaymentExtensions struct {
+	Sessions *SubscriptionInfo `json:"sessions,omitempty"`
+	PreAuth  *PreAuthInfo      `json:"preAuth,omitempty"`
+	Batch    *BatchInfo        `json:"batch,omitempty"`
+	Retry    *RetryStrategy    `json:"retry,omitempty"`
+}
+
+// PreAuthInfo says where agents can open a pre-authorized budget
+type PreAuthInfo struct {
+	Endpoint  string `json:"endpoint"`
+	MinBudget int64  `json:"minBudget,omitempty"`
+}
+
+// BatchInfo describes batch pricing
+type BatchInfo struct {
+	Endpoint     string `json:"endpoint,omitempty"`
+	Discount     int    `json:"discount,omitempty"` // Percentage
+	MinBatchSize int    `json:"minBatchSize,omitempty"`
+}
+
+// extensionsKey is the context key of the extensions middlewares add
+type extensionsKey struct{}
+
+// advertise adds ext to those r's 402s will carry. Fields already set by an
+// outer middleware are kept.
+func advertise(r *http.Request, ext PaymentExtensions) *http.Request {
+	merged := extensionsFrom(r).merge(&ext)
+	if merged == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), extensionsKey{}, merged))
+}
+
+// extensionsFrom returns the extensions middlewares added to r, or nil
+func extensionsFrom(r *http.Request) *PaymentExtensions {
+	ext, _ := r.Context().Value(extensionsKey{}).(*PaymentExtensions)
+	return ext
+}
+
+// extensionsFor returns the extensions a 402 to r advertises: configured
+// ones, then those added by the middlewares around this one
+func extensionsFor(r *http.Request, configured *PaymentExtensions) *PaymentExtensions {
+	return configured.merge(extensionsFrom(r)).bounded()
+}
+
+// merge returns e with the fields it leaves unset taken from other. Either
+// may be nil; the result is nil if both advertise nothing.
+func (e *PaymentExtensions) merge(other *PaymentExtensions) *PaymentExtensions {
+	var merged PaymentExtensions
+	if e != nil {
+		merged = *e
+	}
+	if other != nil {
+		if merged.Sessions == nil {
+			merged.Sessions = other.Sessions
+		}
+		if merged.PreAuth == nil {
+			merged.PreAuth = other.PreAuth
+		}
+		if merged.Batch == nil {
+			merged.Batch = other.Batch
+		}
+		if merged.Retry == nil {
+			merged.Retry = other.Retry
+		}
+	}
+	if merged == (PaymentExtensions{}) {
+		return nil
+	}
+	return &merged
+}
+
+// bounded returns e with at most maxAdvertisedTiers session tiers
+func (e *PaymentExtensions) bounded() *PaymentExtensions {
+	if e == nil || e.Sessions == nil || len(e.Sessions.Tiers) <= maxAdvertisedTiers {
+		return e
+	}
+	bounded := *e
+	sessions := *e.Sessions
+	sessions.Tiers = sessions.Tiers[:maxAdvertisedTiers]
+	bounded.Sessions = &sessions
+	return &bounded
+}
+
+// apply adds the extensions to each requirement's Extra
+func (e *PaymentExtensions) apply(requirements []PaymentRequirements) {
+	if e == nil {
+		return
+	}
+	for i := range requirements {
+		if e.Sessions != nil {
+			AddSubscriptionInfo(&requirements[i], *e.Sessions)
+		}
+		if requirements[i].Extra == nil && (e.PreAuth != nil || e.Batch != nil || e.Retry != nil) {
+			requirements[i].Extra = make(map[string]interface{})
+		}
+		if e.PreAuth != nil {
+			requirements[i].Extra["preAuth"] = e.PreAuth
+		}
+		if e.Batch != nil {
+			requirements[i].Extra["batch"] = e.Batch
+		}
+		if e.Retry != nil {
+			requirements[i].Extra["retry"] = e.Retry
+		}
+	}
+}
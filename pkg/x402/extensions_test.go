@@ -0,0 +1,78 @@
+package x402
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddleware_AdvertisesComposedExtensions(t *testing.T) {
+	tiers := []SessionPricingTier{{Name: "hour", Duration: time.Hour, Price: 500, Currency: "USD", SessionType: SessionTypeTime}}
+	var handler http.Handler = Middleware(createTestHandler(), testConfig())
+	handler = SessionMiddleware(handler, SessionConfig{Store: NewInMemorySessionStore(), Tiers: tiers, Endpoint: "/sessions"})
+	handler = AIFirstMiddleware(handler, AIFirstConfig{EnablePreAuth: true, PreAuthStore: NewInMemoryPreAuthStore()})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/protected", nil))
+
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected status 402, got %d", w.Code)
+	}
+	var response struct {
+		Accepts []struct {
+			Extra struct {
+				Subscription *SubscriptionInfo `json:"subscription"`
+				PreAuth      *PreAuthInfo      `json:"preAuth"`
+			} `json:"extra"`
+		} `json:"accepts"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil || len(response.Accepts) != 1 {
+		t.Fatalf("Invalid 402 body: %v", err)
+	}
+	extra := response.Accepts[0].Extra
+	if extra.Subscription == nil || !extra.Subscription.Available || extra.Subscription.SessionEndpoint != "/sessions" || len(extra.Subscription.Tiers) != 1 {
+		t.Errorf("Expected the session tiers and endpoint, got %+v", extra.Subscription)
+	}
+	if extra.PreAuth == nil || extra.PreAuth.Endpoint != "/ai/budget" {
+		t.Errorf("Expected the pre-auth endpoint, got %+v", extra.PreAuth)
+	}
+}
+
+func TestUnifiedPaymentOptions_Extensions(t *testing.T) {
+	tiers := make([]SessionPricingTier, 8)
+	for i := range tiers {
+		tiers[i] = SessionPricingTier{Name: "tier", MaxRequests: int64(i + 1), Price: 100, SessionType: SessionTypeRequests}
+	}
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		PricePerRequest: 100,
+		CryptoEnabled:   true,
+		CryptoNetworks:  []NetworkType{NetworkBaseSepolia},
+		RailRegistry:    NewRailRegistry(),
+		EnableSessions:  true,
+		SessionTiers:    tiers,
+		Extensions:      &PaymentExtensions{Retry: &RetryStrategy{ShouldRetry: true, RetryAfterSec: 2}},
+	})
+	handler = AIAgentMiddleware(handler, Config{PricePerRequest: 100}, AIAgentConfig{EnableBatchPricing: true, BatchDiscount: 10, MinBatchSize: 5})
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-AI-Agent", "true")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var response PaymentOptionsResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Invalid 402 body: %v", err)
+	}
+	if response.Session == nil || len(response.Session.Tiers) != maxAdvertisedTiers {
+		t.Errorf("Expected sessions with %d tiers, got %+v", maxAdvertisedTiers, response.Session)
+	}
+	ext := response.Extensions
+	if ext == nil || ext.Sessions != nil || ext.Retry == nil || ext.Retry.RetryAfterSec != 2 || ext.Batch == nil || ext.Batch.Discount != 10 {
+		t.Fatalf("Expected configured retry and agent batch extensions, got %+v", ext)
+	}
+	if len(response.Accepts) == 0 || response.Accepts[0].Extra["batch"] == nil || response.Accepts[0].Extra["retry"] == nil {
+		t.Errorf("Expected the extensions in the accepts extra, got %v", response.Accepts)
+	}
+}
@@ -0,0 +1,227 @@
+// Package x402 - Facilitator Sync
+// A facilitator's /supported endpoint lists the scheme/network pairs it can
+// verify. FacilitatorSync polls it so MultiSchemeMiddleware advertises and
+// accepts exactly those pairs, narrowed by the operator's allow/deny lists,
+// instead of hardcoded AcceptedSchemes/AcceptedNetworks drifting out of date.
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// SupportedKind is a scheme/network pair a facilitator can verify
+type SupportedKind struct {
+	X402Version int         `json:"x402Version"`
+	Scheme      SchemeType  `json:"scheme"`
+	Network     NetworkType `json:"network"`
+}
+
+// FacilitatorClient talks to an x402 facilitator
+type FacilitatorClient struct {
+	URL string
+
+	// Metrics, if set, records the latency of calls, as rail "facilitator"
+	Metrics *RailMetrics
+
+	client *http.Client
+}
+
+// NewFacilitatorClient creates a client for the facilitator at url
+func NewFacilitatorClient(url string) *FacilitatorClient {
+	return &FacilitatorClient{
+		URL:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Supported returns the scheme/network pairs the facilitator can verify
+func (f *FacilitatorClient) Supported(ctx context.Context) ([]SupportedKind, error) {
+	start := time.Now()
+	kinds, err := f.supported(ctx)
+	f.Metrics.observe("facilitator", RailOpSupported, start, err)
+	return kinds, err
+}
+
+func (f *FacilitatorClient) supported(ctx context.Context) ([]SupportedKind, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", f.URL+"/supported", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, &FacilitatorError{Op: "supported", Err: err}
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, &FacilitatorError{Op: "supported", StatusCode: resp.StatusCode, Message: string(body)}
+	}
+
+	var supported struct {
+		Kinds []SupportedKind `json:"kinds"`
+	}
+	if err := json.Unmarshal(body, &supported); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return supported.Kinds, nil
+}
+
+// SupportedLister is anything that can list supported kinds, usually a
+// *FacilitatorClient
+type SupportedLister interface {
+	Supported(ctx context.Context) ([]SupportedKind, error)
+}
+
+// FacilitatorSync keeps the accepted scheme/network pairs in sync with a
+// facilitator. Call Refresh once at startup, then Run in the background:
+//
+//	syncer := x402.NewFacilitatorSync(x402.NewFacilitatorClient(url))
+//	syncer.DenyNetworks = []x402.NetworkType{x402.NetworkEthereumMainnet}
+//	if err := syncer.Refresh(ctx); err != nil { ... }
+//	go syncer.Run(ctx)
+//	config.SyncFromFacilitator = syncer
+//
+// Until a refresh succeeds, the config's static AcceptedSchemes and
+// AcceptedNetworks apply. A failed refresh keeps the last good set.
+type FacilitatorSync struct {
+	Client SupportedLister
+
+	// RefreshInterval between polls in Run (default 5m)
+	RefreshInterval time.Duration
+
+	// Allow lists, if set, admit only these schemes/networks; deny lists
+	// always exclude. Networks match in either CAIP-2 or facilitator form,
+	// and wildcards such as eip155:* match a whole family.
+	AllowSchemes  []SchemeType
+	DenySchemes   []SchemeType
+	AllowNetworks []NetworkType
+	DenyNetworks  []NetworkType
+
+	kinds atomic.Pointer[[]SupportedKind]
+}
+
+// NewFacilitatorSync creates a FacilitatorSync polling client
+func NewFacilitatorSync(client SupportedLister) *FacilitatorSync {
+	return &FacilitatorSync{Client: client}
+}
+
+// Refresh fetches the facilitator's supported kinds and, if that succeeds,
+// swaps in the allowed ones
+func (s *FacilitatorSync) Refresh(ctx context.Context) error {
+	supported, err := s.Client.Supported(ctx)
+	if err != nil {
+		return err
+	}
+
+	kinds := make([]SupportedKind, 0, len(supported))
+	for _, kind := range supported {
+		if s.allows(kind) {
+			kinds = append(kinds, kind)
+		}
+	}
+	s.kinds.Store(&kinds)
+	return nil
+}
+
+// Run refreshes every RefreshInterval until ctx is done, logging failures
+func (s *FacilitatorSync) Run(ctx context.Context) {
+	interval := s.RefreshInterval
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Refresh(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("x402: facilitator sync failed, keeping last supported set: %v", err)
+			}
+		}
+	}
+}
+
+// Kinds returns the synced kinds, or nil if no refresh has succeeded yet
+func (s *FacilitatorSync) Kinds() []SupportedKind {
+	if s == nil {
+		return nil
+	}
+	kinds := s.kinds.Load()
+	if kinds == nil {
+		return nil
+	}
+	return append([]SupportedKind(nil), (*kinds)...)
+}
+
+// accepts reports whether the synced set includes scheme on network. ok is
+// false when nothing has been synced and the static config applies.
+func (s *FacilitatorSync) accepts(scheme SchemeType, network NetworkType) (accepted, ok bool) {
+	if s == nil {
+		return false, false
+	}
+	kinds := s.kinds.Load()
+	if kinds == nil {
+		return false, false
+	}
+	for _, kind := range *kinds {
+		if kind.Scheme == scheme && sameNetwork(kind.Network, network) {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+func (s *FacilitatorSync) allows(kind SupportedKind) bool {
+	for _, scheme := range s.DenySchemes {
+		if scheme == kind.Scheme {
+			return false
+		}
+	}
+	for _, network := range s.DenyNetworks {
+		if networkMatches(network, kind.Network) {
+			return false
+		}
+	}
+
+	if len(s.AllowSchemes) > 0 {
+		allowed := false
+		for _, scheme := range s.AllowSchemes {
+			allowed = allowed || scheme == kind.Scheme
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if len(s.AllowNetworks) > 0 {
+		allowed := false
+		for _, network := range s.AllowNetworks {
+			allowed = allowed || networkMatches(network, kind.Network)
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// sameNetwork compares networks named in CAIP-2 or facilitator form
+func sameNetwork(a, b NetworkType) bool {
+	return canonicalEVMNetwork(string(a)) == canonicalEVMNetwork(string(b))
+}
+
+// networkMatches reports whether pattern, possibly a wildcard, covers network
+func networkMatches(pattern, network NetworkType) bool {
+	return sameNetwork(pattern, network) || isWildcardMatch(pattern, canonicalEVMNetwork(string(network)))
+}
@@ -0,0 +1,156 @@
+package x402
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeFacilitator serves /supported from a list that tests can change
+type fakeFacilitator struct {
+	mu     sync.Mutex
+	kinds  string // JSON array of kinds
+	broken bool   // answer 500
+}
+
+func (f *fakeFacilitator) set(kinds string, broken bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.kinds, f.broken = kinds, broken
+}
+
+func (f *fakeFacilitator) server(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if r.URL.Path != "/supported" || f.broken {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"kinds": %s}`, f.kinds)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func acceptedPairs(config *MultiSchemeConfig) []string {
+	var pairs []string
+	for _, req := range config.BuildMultiSchemeRequirements("/api/data") {
+		pairs = append(pairs, req.Scheme+"@"+req.Network)
+	}
+	return pairs
+}
+
+func TestFacilitatorSync_FollowsSupportedList(t *testing.T) {
+	facilitator := &fakeFacilitator{}
+	facilitator.set(`[
+		{"x402Version": 1, "scheme": "exact", "network": "base-sepolia"},
+		{"x402Version": 1, "scheme": "exact", "network": "ethereum"},
+		{"x402Version": 1, "scheme": "upto", "network": "base-sepolia"}
+	]`, false)
+
+	syncer := NewFacilitatorSync(NewFacilitatorClient(facilitator.server(t).URL))
+	syncer.DenyNetworks = []NetworkType{NetworkEthereumMainnet}
+	config := &MultiSchemeConfig{
+		Config:              Config{PricePerRequest: 100, PayTo: "0xseller", Network: "base-sepolia"},
+		AcceptedSchemes:     []SchemeType{SchemeExact},
+		PaymentAddresses:    map[NetworkType]string{NetworkBaseSepolia: "0xsepolia"},
+		SyncFromFacilitator: syncer,
+	}
+
+	// Before the first refresh the static config applies
+	if pairs := acceptedPairs(config); len(pairs) != 1 || pairs[0] != "exact@base-sepolia" {
+		t.Errorf("Expected static accepts before sync, got %v", pairs)
+	}
+
+	if err := syncer.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	pairs := acceptedPairs(config)
+	if len(pairs) != 2 || pairs[0] != "exact@base-sepolia" || pairs[1] != "upto@base-sepolia" {
+		t.Errorf("Expected denied ethereum to be dropped, got %v", pairs)
+	}
+	if payTo := config.BuildMultiSchemeRequirements("/api/data")[0].PayTo; payTo != "0xsepolia" {
+		t.Errorf("Expected CAIP-2 keyed address for base-sepolia, got %s", payTo)
+	}
+
+	// The facilitator drops upto; the next poll follows
+	facilitator.set(`[{"x402Version": 1, "scheme": "exact", "network": "base-sepolia"}]`, false)
+	if err := syncer.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if pairs := acceptedPairs(config); len(pairs) != 1 || pairs[0] != "exact@base-sepolia" {
+		t.Errorf("Expected upto to be removed, got %v", pairs)
+	}
+
+	// A failed poll keeps the last good set
+	facilitator.set("", true)
+	if err := syncer.Refresh(context.Background()); err == nil {
+		t.Error("Expected refresh to fail")
+	}
+	if pairs := acceptedPairs(config); len(pairs) != 1 || pairs[0] != "exact@base-sepolia" {
+		t.Errorf("Expected last good set after a failed sync, got %v", pairs)
+	}
+}
+
+func TestFacilitatorSync_AllowList(t *testing.T) {
+	facilitator := &fakeFacilitator{}
+	facilitator.set(`[
+		{"x402Version": 1, "scheme": "exact", "network": "base"},
+		{"x402Version": 1, "scheme": "exact", "network": "solana-devnet"},
+		{"x402Version": 1, "scheme": "upto", "network": "base"}
+	]`, false)
+
+	syncer := NewFacilitatorSync(NewFacilitatorClient(facilitator.server(t).URL))
+	syncer.AllowSchemes = []SchemeType{SchemeExact}
+	syncer.AllowNetworks = []NetworkType{NetworkEVMWildcard}
+	if err := syncer.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+
+	kinds := syncer.Kinds()
+	if len(kinds) != 1 || kinds[0].Scheme != SchemeExact || kinds[0].Network != "base" {
+		t.Errorf("Expected only exact on base, got %+v", kinds)
+	}
+}
+
+func TestMultiSchemeMiddleware_RefusesUnsyncedPairs(t *testing.T) {
+	facilitator := &fakeFacilitator{}
+	facilitator.set(`[{"x402Version": 1, "scheme": "exact", "network": "base-sepolia"}]`, false)
+	syncer := NewFacilitatorSync(NewFacilitatorClient(facilitator.server(t).URL))
+	if err := syncer.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+
+	failures := make(chan *PaymentFailure, 1)
+	handler := MultiSchemeMiddleware(createTestHandler(), MultiSchemeConfig{
+		Config:              Config{PricePerRequest: 100, PayTo: "0xseller"},
+		SyncFromFacilitator: syncer,
+		OnPaymentFailure:    func(ctx context.Context, failure *PaymentFailure) { failures <- failure },
+	})
+
+	pay := func(network string) int {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		payload := fmt.Sprintf(`{"scheme":"exact","network":%q,"payer":"0xpayer"}`, network)
+		req.Header.Set("X-PAYMENT", base64.StdEncoding.EncodeToString([]byte(payload)))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Either naming of the synced network is accepted
+	if code := pay("eip155:84532"); code != http.StatusOK {
+		t.Errorf("Expected synced network to be accepted, got %d", code)
+	}
+	if code := pay("eip155:1"); code != http.StatusPaymentRequired {
+		t.Fatalf("Expected unsynced network to be refused, got %d", code)
+	}
+	if failure := <-failures; failure.Reason != FailureUnsupportedRail {
+		t.Errorf("Expected unsupported_rail, got %s", failure.Reason)
+	}
+}
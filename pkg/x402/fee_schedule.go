@@ -0,0 +1,146 @@
+// Package x402 - Fee Schedules
+// Rails keep part of each payment: Stripe's list price is 2.9% + 30¢, but
+// negotiated rates differ and international cards cost more, and a crypto
+// facilitator may charge too. A FeeSchedule on the rail estimates the fee
+// shown in 402 options (EstimatedFee) and recorded at capture (FeeAmount and
+// NetAmount), with overrides per currency or card country.
+package x402
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Fee is a percentage of an amount plus a fixed part
+type Fee struct {
+	Percent float64 `json:"percent"`       // e.g. 2.9 for 2.9%
+	Fixed   int64   `json:"fixed"`         // In the currency's smallest unit
+	Max     int64   `json:"max,omitempty"` // Cap on the fee, 0 for none (e.g. 500 for ACH's $5)
+}
+
+// FeeSchedule estimates a rail's fee on a payment
+type FeeSchedule struct {
+	// Default applies when no override matches
+	Default Fee
+
+	// ByCurrency overrides Default for payments in a currency, e.g. "EUR"
+	ByCurrency map[string]Fee
+
+	// ByRegion overrides both for cards issued in a country, e.g. "GB"
+	ByRegion map[string]Fee
+}
+
+// DefaultStripeFees is Stripe's list price for domestic cards
+func DefaultStripeFees() *FeeSchedule {
+	return &FeeSchedule{Default: Fee{Percent: 2.9, Fixed: 30}}
+}
+
+// FeeEstimator is implemented by rails that can estimate their fee on an
+// amount before it is paid
+type FeeEstimator interface {
+	EstimateFee(amount int64, currency string) int64
+}
+
+// Validate rejects negative fees and percentages over 100
+func (s *FeeSchedule) Validate() error {
+	if s == nil {
+		return nil
+	}
+	check := func(name string, fee Fee) error {
+		if fee.Percent < 0 || fee.Percent > 100 {
+			return fmt.Errorf("x402: fee %s percent %v must be between 0 and 100", name, fee.Percent)
+		}
+		if fee.Fixed < 0 {
+			return fmt.Errorf("x402: fee %s fixed amount %d must not be negative", name, fee.Fixed)
+		}
+		if fee.Max < 0 {
+			return fmt.Errorf("x402: fee %s cap %d must not be negative", name, fee.Max)
+		}
+		return nil
+	}
+	if err := check("default", s.Default); err != nil {
+		return err
+	}
+	for currency, fee := range s.ByCurrency {
+		if err := check("for "+currency, fee); err != nil {
+			return err
+		}
+	}
+	for region, fee := range s.ByRegion {
+		if err := check("for region "+region, fee); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Estimate returns the fee on amount in currency, for a card issued in
+// region if known. The percentage is rounded down, and the fee never exceeds
+// the amount. A nil schedule charges nothing.
+func (s *FeeSchedule) Estimate(amount int64, currency, region string) int64 {
+	if s == nil || amount <= 0 {
+		return 0
+	}
+	fee := s.Default
+	if f, ok := lookupFold(s.ByCurrency, currency); ok {
+		fee = f
+	}
+	if f, ok := lookupFold(s.ByRegion, region); ok {
+		fee = f
+	}
+
+	percent := new(big.Rat).Mul(new(big.Rat).SetInt64(amount), decimalRat(fee.Percent))
+	percent.Quo(percent, big.NewRat(100, 1))
+	total := new(big.Int).Quo(percent.Num(), percent.Denom()).Int64() + fee.Fixed
+	if fee.Max > 0 && total > fee.Max {
+		total = fee.Max
+	}
+	if total > amount {
+		return amount
+	}
+	return total
+}
+
+// lookupFold finds key in m ignoring case
+func lookupFold(m map[string]Fee, key string) (Fee, bool) {
+	if key == "" {
+		return Fee{}, false
+	}
+	if fee, ok := m[key]; ok {
+		return fee, true
+	}
+	for k, fee := range m {
+		if strings.EqualFold(k, key) {
+			return fee, true
+		}
+	}
+	return Fee{}, false
+}
+
+// estimateFee returns rail's estimated fee on amount, or 0 if it cannot say
+func estimateFee(rail PaymentRail, amount int64, currency string) int64 {
+	if estimator, ok := rail.(FeeEstimator); ok {
+		return estimator.EstimateFee(amount, currency)
+	}
+	return 0
+}
+
+// validateRailFees checks the fee schedules of the built-in rails in registry
+func validateRailFees(registry *RailRegistry) error {
+	for _, rail := range registry.List() {
+		var fees *FeeSchedule
+		switch rail := rail.(type) {
+		case *StripeRail:
+			fees = rail.Fees
+		case *EVMCryptoRail:
+			fees = rail.Fees
+		case *ACHRail:
+			fees = rail.Fees
+		}
+		if err := fees.Validate(); err != nil {
+			return fmt.Errorf("%w (rail %s)", err, rail.ID())
+		}
+	}
+	return nil
+}
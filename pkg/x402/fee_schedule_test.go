@@ -0,0 +1,127 @@
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFeeSchedule_Estimate(t *testing.T) {
+	negotiated := &FeeSchedule{
+		Default:    Fee{Percent: 2.2, Fixed: 20},
+		ByCurrency: map[string]Fee{"EUR": {Percent: 1.5, Fixed: 25}},
+		ByRegion:   map[string]Fee{"JP": {Percent: 3.9, Fixed: 30}},
+	}
+	tests := []struct {
+		name     string
+		schedule *FeeSchedule
+		amount   int64
+		currency string
+		region   string
+		want     int64
+	}{
+		{"stripe list price", DefaultStripeFees(), 1000, "USD", "", 59},
+		{"negotiated default", negotiated, 1000, "USD", "", 42},
+		{"currency override", negotiated, 1000, "eur", "", 40},
+		{"region beats currency", negotiated, 1000, "EUR", "JP", 69},
+		{"never more than the amount", negotiated, 10, "USD", "", 10},
+		{"nil schedule", nil, 1000, "USD", "", 0},
+	}
+	for _, tt := range tests {
+		if got := tt.schedule.Estimate(tt.amount, tt.currency, tt.region); got != tt.want {
+			t.Errorf("%s: expected fee %d, got %d", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestFeeSchedule_Validate(t *testing.T) {
+	invalid := []*FeeSchedule{
+		{Default: Fee{Percent: -1}},
+		{Default: Fee{Percent: 101}},
+		{Default: Fee{Fixed: -30}},
+		{ByCurrency: map[string]Fee{"EUR": {Percent: 150}}},
+		{ByRegion: map[string]Fee{"GB": {Fixed: -1}}},
+	}
+	for _, schedule := range invalid {
+		if err := schedule.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", schedule)
+		}
+	}
+	if err := DefaultStripeFees().Validate(); err != nil {
+		t.Errorf("Expected the default schedule to be valid, got %v", err)
+	}
+
+	stripe := NewStripeRail("sk_test", "")
+	stripe.Fees = &FeeSchedule{Default: Fee{Percent: 200}}
+	registry := NewRailRegistry()
+	registry.Register(stripe)
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected UnifiedPaymentMiddleware to reject an invalid rail schedule")
+		}
+	}()
+	UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{PricePerRequest: 100, FiatEnabled: true, RailRegistry: registry})
+}
+
+func TestStripeRail_CustomFeeSchedule(t *testing.T) {
+	var expanded string
+	stripeAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/payment_intents":
+			fmt.Fprintf(w, `{"id":"pi_new","amount":%s,"currency":"%s","status":"requires_payment_method","client_secret":"secret"}`, r.Form.Get("amount"), r.Form.Get("currency"))
+		case "/payment_intents/pi_eur/capture":
+			expanded = r.Form.Get("expand[]")
+			fmt.Fprint(w, `{"id":"pi_eur","amount":1000,"currency":"eur","status":"succeeded","latest_charge":{"payment_method_details":{"card":{"country":"DE"}}}}`)
+		case "/payment_intents/pi_jp/capture":
+			fmt.Fprint(w, `{"id":"pi_jp","amount":1000,"currency":"eur","status":"succeeded","latest_charge":{"payment_method_details":{"card":{"country":"JP"}}}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer stripeAPI.Close()
+
+	stripe := NewStripeRail("sk_test", "")
+	stripe.BaseURL = stripeAPI.URL
+	stripe.Fees = &FeeSchedule{
+		Default:    Fee{Percent: 2.2, Fixed: 20},
+		ByCurrency: map[string]Fee{"EUR": {Percent: 1.5, Fixed: 25}},
+		ByRegion:   map[string]Fee{"JP": {Percent: 3.9, Fixed: 30}},
+	}
+
+	// Captures are charged by currency, or by the card's country
+	capture, err := stripe.CapturePayment(context.Background(), &CapturePaymentRequest{PaymentID: "pi_eur"})
+	if err != nil || capture.FeeAmount != 40 || capture.NetAmount != 960 {
+		t.Errorf("Expected the EUR fee of 40, got %+v %v", capture, err)
+	}
+	if expanded != "latest_charge" {
+		t.Errorf("Expected the charge to be expanded, got %q", expanded)
+	}
+	capture, err = stripe.CapturePayment(context.Background(), &CapturePaymentRequest{PaymentID: "pi_jp"})
+	if err != nil || capture.FeeAmount != 69 || capture.NetAmount != 931 {
+		t.Errorf("Expected the JP card fee of 69, got %+v %v", capture, err)
+	}
+
+	// The 402 option shows the same schedule
+	registry := NewRailRegistry()
+	registry.Register(stripe)
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		PricePerRequest: 1000,
+		Currency:        "USD",
+		FiatEnabled:     true,
+		RailRegistry:    registry,
+	})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+	var response PaymentOptionsResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil || len(response.Options) != 1 {
+		t.Fatalf("Expected one card option, got %v %+v", err, response.Options)
+	}
+	if response.Options[0].EstimatedFee != 42 {
+		t.Errorf("Expected an estimated fee of 42, got %d", response.Options[0].EstimatedFee)
+	}
+}
@@ -0,0 +1,78 @@
+// Package x402 - Free Endpoint Discovery
+// Agents that can't tell which paths are free either waste budget probing
+// them or avoid them entirely. Discovery documents list the free paths,
+// derived from the same exemptions and prices the middleware enforces, so
+// the list can't drift from what is actually charged.
+package x402
+
+import (
+	"sort"
+	"strings"
+)
+
+// Why an endpoint is free
+const (
+	FreeReasonExempt    = "exempt"     // Listed in ExemptPaths or DynamicExemptions
+	FreeReasonMethod    = "method"     // A free method in MethodPricing
+	FreeReasonZeroPrice = "zero_price" // An APIEndpoint costing nothing
+)
+
+// FreeEndpoint is a path agents can call without paying
+type FreeEndpoint struct {
+	Path   string `json:"path"`
+	Method string `json:"method,omitempty"` // "" for every method
+	Prefix bool   `json:"prefix,omitempty"` // Paths below Path are free too
+	Reason string `json:"reason"`
+}
+
+// String renders e compactly, e.g. "GET /api/items*"
+func (e FreeEndpoint) String() string {
+	s := e.Path
+	if e.Prefix {
+		s += "*"
+	}
+	if e.Method != "" {
+		s = e.Method + " " + s
+	}
+	return s
+}
+
+// FreeEndpoints lists the paths served without payment: exempt path
+// prefixes, active dynamic exemptions, free methods in pricing, and
+// endpoints whose cost (after pricing) is zero
+func FreeEndpoints(exemptPaths []string, dynamic *ExemptionList, pricing MethodPricing, endpoints []APIEndpoint, defaultCost int64) []FreeEndpoint {
+	free := make([]FreeEndpoint, 0)
+	for _, path := range exemptPaths {
+		free = append(free, FreeEndpoint{Path: path, Prefix: true, Reason: FreeReasonExempt})
+	}
+	if dynamic != nil {
+		for _, exemption := range dynamic.List() {
+			free = append(free, FreeEndpoint{Path: exemption.Path, Prefix: !exemption.Exact, Reason: FreeReasonExempt})
+		}
+	}
+	for _, rule := range pricing {
+		methods := append([]string(nil), rule.FreeMethods...)
+		for method, price := range rule.Prices {
+			if price == 0 {
+				methods = append(methods, method)
+			}
+		}
+		sort.Strings(methods)
+		for _, method := range methods {
+			free = append(free, FreeEndpoint{Path: rule.Path, Method: strings.ToUpper(method), Prefix: true, Reason: FreeReasonMethod})
+		}
+	}
+
+	// Endpoints free by method are already listed under their rule
+	for _, ep := range endpoints {
+		if getCostForPath(ep.Path, ep.Method, endpoints, pricing, defaultCost) == 0 && pricing.Price(ep.Method, ep.Path, -1) != 0 {
+			free = append(free, FreeEndpoint{Path: ep.Path, Method: ep.Method, Reason: FreeReasonZeroPrice})
+		}
+	}
+	return free
+}
+
+// freeEndpoints lists the paths c serves without payment
+func (c AIFirstConfig) freeEndpoints() []FreeEndpoint {
+	return FreeEndpoints(c.ExemptPaths, c.DynamicExemptions, c.MethodPricing, c.Endpoints, c.DefaultCost)
+}
@@ -0,0 +1,136 @@
+package x402
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fuzz targets for the parsers that see attacker-controlled input. Seeds
+// and past findings live in testdata/fuzz, so plain go test replays them;
+// go test -fuzz FuzzName explores further.
+
+func FuzzExtractPaymentToken(f *testing.F) {
+	f.Add("Bearer signed_proof", "", "")
+	f.Add("", "signed_proof", "")
+	f.Add("", "", "signed_proof")
+	f.Add("Bearer", "", "%zz")
+	f.Add("Basic c2lnbmVkX3Byb29m", "", "")
+	f.Fuzz(func(t *testing.T, authorization, payment, query string) {
+		config := testConfig()
+		config.TestMode = false
+		config.AllowQueryToken = true
+		var verified []string
+		config.PaymentVerifier = func(token string) (bool, error) {
+			verified = append(verified, token)
+			return token == "signed_proof", nil
+		}
+
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.URL.RawQuery = queryTokenParam + "=" + url.QueryEscape(query)
+		req.Header["Authorization"] = []string{authorization}
+		req.Header["X-Payment"] = []string{payment}
+
+		token := extractPaymentToken(req, config)
+		if token != "" && !strings.Contains(authorization, token) && token != payment && token != query {
+			t.Fatalf("Expected the token to be one presented, got %q", token)
+		}
+
+		w := httptest.NewRecorder()
+		Middleware(createTestHandler(), config).ServeHTTP(w, req)
+		if w.Code == http.StatusOK && (len(verified) != 1 || verified[0] != "signed_proof") {
+			t.Fatalf("Expected only signed_proof served, got %d after verifying %q", w.Code, verified)
+		}
+	})
+}
+
+func FuzzDecodeSessionToken(f *testing.F) {
+	f.Add(EncodeSessionToken(&Session{ID: "sess_1", Active: true}))
+	f.Add(base64.RawURLEncoding.EncodeToString([]byte(`{"id":"sess_1"}`)))
+	f.Add(base64.StdEncoding.EncodeToString([]byte("null")))
+	f.Add("not base64!")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, token string) {
+		session, err := DecodeSessionToken(token)
+		if err != nil {
+			return
+		}
+		if session.ID == "" {
+			t.Fatal("Expected tokens without a session ID refused")
+		}
+		if len(token) > DefaultMaxProofBytes {
+			t.Fatalf("Expected a %d-byte token refused", len(token))
+		}
+	})
+}
+
+// stripeSignature is what Stripe signs payload with at timestamp
+func stripeSignature(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + string(payload)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func FuzzVerifyWebhookSignature(f *testing.F) {
+	const secret = "whsec_test"
+	payload := []byte(`{"type":"payment_intent.succeeded"}`)
+	f.Add(payload, "t=1700000000,v1="+stripeSignature(secret, "1700000000", payload))
+	f.Add(payload, "t=1700000000,v1=deadbeef,v1="+stripeSignature(secret, "1700000000", payload))
+	f.Add(payload, "v1="+stripeSignature(secret, "", payload))
+	f.Add(payload, "t=,v1=")
+	f.Add([]byte{}, "")
+	f.Add(payload, "t=1700000000,v0=abc,v1")
+	rail := NewStripeRail("sk_test", secret)
+	rail.now = func() time.Time { return time.Unix(1700000000, 0) }
+	f.Fuzz(func(t *testing.T, payload []byte, header string) {
+		if !rail.verifyWebhookSignature(payload, header) {
+			return
+		}
+		for _, part := range strings.Split(header, ",") {
+			if timestamp, ok := strings.CutPrefix(part, "t="); ok && timestamp != "" &&
+				strings.Contains(header, "v1="+stripeSignature(secret, timestamp, payload)) {
+				return
+			}
+		}
+		t.Fatalf("Expected only Stripe's signature accepted, got %q", header)
+	})
+}
+
+func TestEVMCryptoRail_ShortPayload(t *testing.T) {
+	facilitator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"isValid":true,"payer":"0xpayer"}`)
+	}))
+	defer facilitator.Close()
+	rail := NewEVMCryptoRail(facilitator.URL, nil)
+
+	// "{}" encoded every way clients do, all shorter than a payment ID
+	for _, payload := range []string{"e30=", "e30"} {
+		verification, err := rail.VerifyPayment(context.Background(), &VerifyPaymentRequest{PaymentPayload: payload})
+		if err != nil || !verification.Valid || verification.PaymentID != payload {
+			t.Errorf("Expected %q verified with itself as ID, got %+v (%v)", payload, verification, err)
+		}
+	}
+}
+
+func TestDecodePaymentToken_Encodings(t *testing.T) {
+	payload := []byte(`{"scheme":"exact","payer":"0x>?"}`)
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		token := enc.EncodeToString(payload)
+		parsed, err := parsePaymentPayload(token, 0)
+		if err != nil || parsed.Payer != "0x>?" {
+			t.Errorf("Expected %q decoded, got %+v (%v)", token, parsed, err)
+		}
+	}
+	if _, err := parsePaymentPayload(base64.StdEncoding.EncodeToString([]byte("null")), 0); err == nil {
+		t.Error("Expected a null payload refused")
+	}
+}
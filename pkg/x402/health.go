@@ -0,0 +1,276 @@
+// Package x402 - Dependency Health
+// Kubernetes probes checked the app, not whether it could take payments: a
+// down facilitator, a revoked Stripe key, an unreachable store or a backed up
+// webhook queue showed up as customer complaints. HealthHandler checks each
+// of the middleware's own dependencies and answers 503 naming the ones that
+// fail. Results are cached, so probes can call it as often as they like
+// without hammering the facilitator or Stripe.
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHealthCacheTTL is how long a check's result is reused
+	DefaultHealthCacheTTL = 15 * time.Second
+
+	// DefaultStripeHealthTTL is how long a valid Stripe key is trusted
+	// before it's checked again
+	DefaultStripeHealthTTL = 5 * time.Minute
+
+	// DefaultHealthTimeout bounds each check
+	DefaultHealthTimeout = 5 * time.Second
+)
+
+// Health statuses
+const (
+	HealthOK          = "ok"
+	HealthUnavailable = "unavailable"
+)
+
+// HealthCheck reports whether a dependency works
+type HealthCheck func(ctx context.Context) error
+
+// HealthDeps are the dependencies HealthHandler checks. Nil fields aren't
+// checked.
+type HealthDeps struct {
+	// Facilitator must answer its /supported endpoint
+	Facilitator SupportedLister
+
+	// Stripe's key must be accepted by a balance call
+	Stripe *StripeRail
+
+	// Stores must round-trip a key, e.g. the Redis-backed idempotency store
+	Stores map[string]IdempotencyStore
+
+	// Callbacks' queue must hold fewer than MaxQueueDepth callbacks
+	// waiting to run (default three quarters of its QueueSize)
+	Callbacks     *CallbackRunner
+	MaxQueueDepth int
+
+	// Checks are any other dependencies, by name
+	Checks map[string]HealthCheck
+
+	// CacheTTL is how long results are reused (default
+	// DefaultHealthCacheTTL). A valid Stripe key is trusted for
+	// DefaultStripeHealthTTL; a failed check is retried after CacheTTL.
+	CacheTTL time.Duration
+
+	// Timeout bounds each check (default DefaultHealthTimeout)
+	Timeout time.Duration
+}
+
+// ComponentHealth is one dependency's health
+type ComponentHealth struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMS int64     `json:"latencyMs"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// HealthReport is HealthHandler's answer
+type HealthReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentHealth `json:"components"`
+	Failing    []string                   `json:"failing,omitempty"`
+}
+
+// healthCheck is a check and its cached result
+type healthCheck struct {
+	name  string
+	check HealthCheck
+	ttl   time.Duration // how long a passing result is reused
+
+	// mu is held while checking, so concurrent probes wait for one check
+	// instead of each making their own
+	mu     sync.Mutex
+	result ComponentHealth
+}
+
+// run returns the cached result, or checks again if it's stale
+func (h *healthCheck) run(ctx context.Context, retry, timeout time.Duration) ComponentHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ttl := h.ttl
+	if h.result.Status != HealthOK {
+		ttl = retry
+	}
+	if !h.result.CheckedAt.IsZero() && time.Since(h.result.CheckedAt) < ttl {
+		return h.result
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+	start := time.Now()
+	err := h.check(ctx)
+	h.result = ComponentHealth{Status: HealthOK, LatencyMS: time.Since(start).Milliseconds(), CheckedAt: time.Now()}
+	if err != nil {
+		h.result.Status, h.result.Error = HealthUnavailable, err.Error()
+	}
+	return h.result
+}
+
+// StoreRoundTrip checks store by writing a short-lived key, reading it back
+// and deleting it
+func StoreRoundTrip(store IdempotencyStore) HealthCheck {
+	return func(ctx context.Context) error {
+		now := time.Now()
+		key := "x402:health:" + strconv.FormatInt(now.UnixNano(), 36)
+		if err := store.Set(key, &IdempotencyRecord{Key: key, CreatedAt: now, ExpiresAt: now.Add(time.Minute)}); err != nil {
+			return fmt.Errorf("write failed: %w", err)
+		}
+		defer store.Delete(key)
+		record, err := store.Get(key)
+		if err != nil {
+			return fmt.Errorf("read failed: %w", err)
+		}
+		if record == nil || record.Key != key {
+			return errors.New("read did not return the written key")
+		}
+		return nil
+	}
+}
+
+// CheckKey reports whether Stripe accepts the rail's secret key, with a
+// balance call (which has no side effects)
+func (s *StripeRail) CheckKey(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.BaseURL+"/balance", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.SecretKey)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return &StripeError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return newStripeError(resp.StatusCode, body)
+	}
+	return nil
+}
+
+// QueueDepth is how many async callbacks are waiting for a worker
+func (c *CallbackRunner) QueueDepth() int {
+	if !c.async() {
+		return 0
+	}
+	c.start.Do(c.startWorkers)
+	return len(c.queue)
+}
+
+// queueCheck checks callbacks' queue is shallower than limit
+func queueCheck(callbacks *CallbackRunner, limit int) HealthCheck {
+	if limit <= 0 {
+		size := callbacks.QueueSize
+		if size <= 0 {
+			size = DefaultCallbackQueueSize
+		}
+		limit = size * 3 / 4
+	}
+	return func(ctx context.Context) error {
+		if depth := callbacks.QueueDepth(); depth >= limit {
+			return fmt.Errorf("%d callbacks queued, limit %d", depth, limit)
+		}
+		return nil
+	}
+}
+
+// healthChecks builds the checks deps asks for
+func healthChecks(deps HealthDeps) []*healthCheck {
+	ttl := deps.CacheTTL
+	if ttl <= 0 {
+		ttl = DefaultHealthCacheTTL
+	}
+	var checks []*healthCheck
+	add := func(name string, check HealthCheck, ttl time.Duration) {
+		checks = append(checks, &healthCheck{name: name, check: check, ttl: ttl})
+	}
+
+	if deps.Facilitator != nil {
+		add("facilitator", func(ctx context.Context) error {
+			_, err := deps.Facilitator.Supported(ctx)
+			return err
+		}, ttl)
+	}
+	if deps.Stripe != nil {
+		add("stripe", deps.Stripe.CheckKey, max(ttl, DefaultStripeHealthTTL))
+	}
+	for name, store := range deps.Stores {
+		add("store:"+name, StoreRoundTrip(store), ttl)
+	}
+	if deps.Callbacks.async() {
+		add("callback_queue", queueCheck(deps.Callbacks, deps.MaxQueueDepth), ttl)
+	}
+	for name, check := range deps.Checks {
+		add(name, check, ttl)
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].name < checks[j].name })
+	return checks
+}
+
+// HealthHandler serves the health of the middleware's dependencies: 200 if
+// all of them work, 503 naming the ones that don't. Serve it at a path the
+// payment middleware exempts (see AIFirstConfig.ExemptPaths), or outside it:
+//
+//	mux.Handle("/healthz/payments", x402.HealthHandler(x402.HealthDeps{
+//		Facilitator: x402.NewFacilitatorClient(facilitatorURL),
+//		Stripe:      stripeRail,
+//		Stores:      map[string]x402.IdempotencyStore{"idempotency": store},
+//	}))
+func HealthHandler(deps HealthDeps) http.HandlerFunc {
+	checks := healthChecks(deps)
+	retry := deps.CacheTTL
+	if retry <= 0 {
+		retry = DefaultHealthCacheTTL
+	}
+	timeout := deps.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHealthTimeout
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		results := make([]ComponentHealth, len(checks))
+		var wg sync.WaitGroup
+		for i, check := range checks {
+			wg.Add(1)
+			go func(i int, check *healthCheck) {
+				defer wg.Done()
+				results[i] = check.run(r.Context(), retry, timeout)
+			}(i, check)
+		}
+		wg.Wait()
+
+		report := HealthReport{Status: HealthOK, Components: make(map[string]ComponentHealth, len(checks))}
+		for i, check := range checks {
+			report.Components[check.name] = results[i]
+			if results[i].Status != HealthOK {
+				report.Status = HealthUnavailable
+				report.Failing = append(report.Failing, check.name)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if report.Status != HealthOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if r.Method != http.MethodHead {
+			_ = json.NewEncoder(w).Encode(report)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func getHealth(t *testing.T, handler http.Handler) (int, HealthReport) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/healthz/payments", nil))
+	var report HealthReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	return w.Code, report
+}
+
+// newFacilitator serves /supported with status, counting calls
+func newFacilitator(status *atomic.Int32, calls *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(int(status.Load()))
+		w.Write([]byte(`{"kinds":[]}`))
+	}))
+}
+
+func TestHealthHandler_Healthy(t *testing.T) {
+	var status, calls atomic.Int32
+	status.Store(http.StatusOK)
+	facilitator := newFacilitator(&status, &calls)
+	defer facilitator.Close()
+	stripeAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/balance" || r.Header.Get("Authorization") != "Bearer sk_test" {
+			t.Errorf("Expected a balance call with the key, got %s %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		w.Write([]byte(`{"object":"balance"}`))
+	}))
+	defer stripeAPI.Close()
+	rail := NewStripeRail("sk_test", "whsec_test")
+	rail.BaseURL = stripeAPI.URL
+
+	handler := HealthHandler(HealthDeps{
+		Facilitator: NewFacilitatorClient(facilitator.URL),
+		Stripe:      rail,
+		Stores:      map[string]IdempotencyStore{"idempotency": NewInMemoryIdempotencyStore()},
+	})
+	code, report := getHealth(t, handler)
+	if code != http.StatusOK || report.Status != HealthOK || len(report.Failing) != 0 {
+		t.Fatalf("Expected healthy, got %d %+v", code, report)
+	}
+	for _, name := range []string{"facilitator", "stripe", "store:idempotency"} {
+		if report.Components[name].Status != HealthOK {
+			t.Errorf("Expected %s ok, got %+v", name, report.Components[name])
+		}
+	}
+}
+
+func TestHealthHandler_FacilitatorDown(t *testing.T) {
+	var status, calls atomic.Int32
+	status.Store(http.StatusBadGateway)
+	facilitator := newFacilitator(&status, &calls)
+	defer facilitator.Close()
+
+	handler := HealthHandler(HealthDeps{
+		Facilitator: NewFacilitatorClient(facilitator.URL),
+		Stores:      map[string]IdempotencyStore{"idempotency": NewInMemoryIdempotencyStore()},
+	})
+	code, report := getHealth(t, handler)
+	if code != http.StatusServiceUnavailable || report.Status != HealthUnavailable {
+		t.Fatalf("Expected 503, got %d %+v", code, report)
+	}
+	if len(report.Failing) != 1 || report.Failing[0] != "facilitator" || report.Components["facilitator"].Error == "" {
+		t.Errorf("Expected the facilitator named as failing, got %+v", report)
+	}
+	if report.Components["store:idempotency"].Status != HealthOK {
+		t.Errorf("Expected the store still ok, got %+v", report.Components["store:idempotency"])
+	}
+}
+
+func TestHealthHandler_CachesResults(t *testing.T) {
+	var status, calls atomic.Int32
+	status.Store(http.StatusOK)
+	facilitator := newFacilitator(&status, &calls)
+	defer facilitator.Close()
+
+	handler := HealthHandler(HealthDeps{Facilitator: NewFacilitatorClient(facilitator.URL), CacheTTL: time.Hour})
+	for i := 0; i < 5; i++ {
+		getHealth(t, handler)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected one facilitator call within the TTL, got %d", calls.Load())
+	}
+}
+
+func TestHealthHandler_RetriesFailures(t *testing.T) {
+	failing := true
+	check := func(ctx context.Context) error {
+		if failing {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	handler := HealthHandler(HealthDeps{Checks: map[string]HealthCheck{"redis": check}, CacheTTL: 10 * time.Millisecond})
+	if code, _ := getHealth(t, handler); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503, got %d", code)
+	}
+	failing = false
+	time.Sleep(20 * time.Millisecond)
+	if code, report := getHealth(t, handler); code != http.StatusOK {
+		t.Errorf("Expected recovery seen after CacheTTL, got %d %+v", code, report)
+	}
+}
+
+func TestHealthHandler_StripeKeyRejected(t *testing.T) {
+	stripeAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":{"type":"invalid_request_error","message":"Invalid API Key provided"}}`))
+	}))
+	defer stripeAPI.Close()
+	rail := NewStripeRail("sk_revoked", "whsec_test")
+	rail.BaseURL = stripeAPI.URL
+
+	code, report := getHealth(t, HealthHandler(HealthDeps{Stripe: rail}))
+	if code != http.StatusServiceUnavailable || len(report.Failing) != 1 || report.Failing[0] != "stripe" {
+		t.Errorf("Expected stripe failing, got %d %+v", code, report)
+	}
+}
+
+func TestHealthHandler_CallbackQueue(t *testing.T) {
+	callbacks := &CallbackRunner{Mode: CallbackAsync, Workers: 1, QueueSize: 4}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	callbacks.run("block", func() { close(started); <-release })
+	<-started
+	for i := 0; i < 3; i++ {
+		callbacks.run("wait", func() {})
+	}
+	defer func() {
+		close(release)
+		callbacks.Shutdown(context.Background())
+	}()
+
+	code, report := getHealth(t, HealthHandler(HealthDeps{Callbacks: callbacks}))
+	if code != http.StatusServiceUnavailable || report.Components["callback_queue"].Status != HealthUnavailable {
+		t.Errorf("Expected a backed up queue to fail, got %d %+v", code, report)
+	}
+}
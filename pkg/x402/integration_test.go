@@ -0,0 +1,482 @@
+package x402
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The integration tests stand up the whole stack a seller would run —
+// metering around AIFirstMiddleware around UnifiedPaymentMiddleware, with
+// the standard endpoints mounted — against a mock x402 facilitator and a
+// fake Stripe API, and drive it the way clients do. Nothing leaves the
+// process.
+
+// mockFacilitator verifies and settles EIP-3009 authorizations like an x402
+// facilitator: the authorization must pay the requirements' payTo at least
+// maxAmountRequired, and each nonce settles once
+type mockFacilitator struct {
+	mu       sync.Mutex
+	settled  map[string]bool
+	verifies int
+	settles  int
+}
+
+// facilitatorRequest is the part of a /verify or /settle body the mock reads
+type facilitatorRequest struct {
+	PaymentPayload struct {
+		Payload struct {
+			Authorization struct {
+				From  string `json:"from"`
+				To    string `json:"to"`
+				Value string `json:"value"`
+				Nonce string `json:"nonce"`
+			} `json:"authorization"`
+		} `json:"payload"`
+	} `json:"paymentPayload"`
+	PaymentRequirements struct {
+		PayTo             string `json:"payTo"`
+		MaxAmountRequired string `json:"maxAmountRequired"`
+	} `json:"paymentRequirements"`
+}
+
+// invalidReason is why the facilitator refuses req ("" if it doesn't)
+func (f *mockFacilitator) invalidReason(req facilitatorRequest) string {
+	auth := req.PaymentPayload.Payload.Authorization
+	value, _ := strconv.ParseInt(auth.Value, 10, 64)
+	required, _ := strconv.ParseInt(req.PaymentRequirements.MaxAmountRequired, 10, 64)
+	switch {
+	case !strings.EqualFold(auth.To, req.PaymentRequirements.PayTo):
+		return "invalid_exact_evm_payload_recipient_mismatch"
+	case value < required:
+		return "invalid_exact_evm_payload_authorization_value"
+	case f.settled[auth.Nonce]:
+		return "invalid_exact_evm_payload_authorization_nonce"
+	}
+	return ""
+}
+
+func (f *mockFacilitator) server(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		var req facilitatorRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+			return
+		}
+		auth := req.PaymentPayload.Payload.Authorization
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/verify":
+			f.verifies++
+			if reason := f.invalidReason(req); reason != "" {
+				fmt.Fprintf(w, `{"isValid":false,"invalidReason":%q,"payer":%q}`, reason, auth.From)
+				return
+			}
+			fmt.Fprintf(w, `{"isValid":true,"payer":%q}`, auth.From)
+		case "/settle":
+			f.settles++
+			if reason := f.invalidReason(req); reason != "" {
+				fmt.Fprintf(w, `{"success":false,"errorReason":%q}`, reason)
+				return
+			}
+			f.settled[auth.Nonce] = true
+			fmt.Fprintf(w, `{"success":true,"transaction":"0xtx%d","network":"base-sepolia","payer":%q}`, f.settles, auth.From)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// counts returns how many verifications and settlements were asked for
+func (f *mockFacilitator) counts() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.verifies, f.settles
+}
+
+// fakeStripeAPI keeps the payment intents created for 402s, which a test
+// then pays as the buyer's browser would
+type fakeStripeAPI struct {
+	mu      sync.Mutex
+	intents map[string]map[string]interface{}
+}
+
+func (s *fakeStripeAPI) server(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+
+		id, action, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/payment_intents"), "/"), "/")
+		switch {
+		case r.Method == http.MethodPost && id == "":
+			_ = r.ParseForm()
+			amount, _ := strconv.ParseInt(r.PostForm.Get("amount"), 10, 64)
+			id = fmt.Sprintf("pi_%d", len(s.intents)+1)
+			s.intents[id] = map[string]interface{}{
+				"id":            id,
+				"amount":        amount,
+				"currency":      r.PostForm.Get("currency"),
+				"status":        "requires_payment_method",
+				"client_secret": id + "_secret_test",
+				"metadata":      map[string]string{"expires_at": r.PostForm.Get("metadata[expires_at]")},
+			}
+		case s.intents[id] == nil:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"type":"invalid_request_error","code":"resource_missing"}}`)
+			return
+		case action == "cancel":
+			s.intents[id]["status"] = "canceled"
+		}
+		_ = json.NewEncoder(w).Encode(s.intents[id])
+	}))
+}
+
+// pay completes intent id by customer, as Stripe.js would
+func (s *fakeStripeAPI) pay(id, customer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.intents[id]["status"] = "succeeded"
+	s.intents[id]["customer"] = customer
+}
+
+// integrationStack is a seller's full middleware stack and its fakes
+type integrationStack struct {
+	handler     http.Handler
+	facilitator *mockFacilitator
+	stripe      *fakeStripeAPI
+	budgets     *InMemoryPreAuthStore
+}
+
+const integrationAdminKey = "admin-key"
+
+func newIntegrationStack(t *testing.T) *integrationStack {
+	t.Helper()
+	stack := &integrationStack{
+		facilitator: &mockFacilitator{settled: map[string]bool{}},
+		stripe:      &fakeStripeAPI{intents: map[string]map[string]interface{}{}},
+		budgets:     NewInMemoryPreAuthStore(),
+	}
+	facilitatorAPI := stack.facilitator.server(t)
+	t.Cleanup(facilitatorAPI.Close)
+	stripeAPI := stack.stripe.server(t)
+	t.Cleanup(stripeAPI.Close)
+
+	stripe := NewStripeRail("sk_test", "")
+	stripe.BaseURL = stripeAPI.URL
+	registry := NewRailRegistry()
+	registry.Register(NewEVMCryptoRail(facilitatorAPI.URL, []NetworkType{NetworkBaseSepolia}))
+	registry.Register(stripe)
+
+	metering := NewInMemoryMeteringStore(0, "USD")
+	sessions := NewInMemorySessionStore()
+	ai := &AIFirstConfig{
+		Currency:          "USDC",
+		PreAuthStore:      stack.budgets,
+		EnablePreAuth:     true,
+		IdempotencyStore:  NewInMemoryIdempotencyStore(),
+		EnableIdempotency: true,
+		DefaultCost:       10000,
+		AdminKey:          integrationAdminKey,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"data":"premium","path":%q}`, r.URL.Path)
+	})
+	exemptions := NewExemptionList()
+	if _, err := MountStandardEndpoints(mux, StandardEndpointDeps{
+		SessionStore: sessions,
+		AI:           ai,
+		Metering:     metering,
+	}, MountOptions{Exemptions: exemptions}); err != nil {
+		t.Fatalf("MountStandardEndpoints failed: %v", err)
+	}
+
+	unified := UnifiedPaymentMiddleware(mux, UnifiedPaymentConfig{
+		Price:               "0.01",
+		Currency:            "USD",
+		CryptoEnabled:       true,
+		CryptoPayTo:         "0xseller",
+		CryptoNetworks:      []NetworkType{NetworkBaseSepolia},
+		FiatEnabled:         true,
+		RailRegistry:        registry,
+		DynamicExemptions:   exemptions,
+		EnableSessions:      true,
+		SessionStore:        sessions,
+		SessionAfterPayment: time.Hour,
+		SessionMaxRequests:  2,
+	})
+	stack.handler = MeteringMiddleware(AIFirstMiddleware(unified, *ai), MeteringConfig{Store: metering, Currency: "USD"})
+	return stack
+}
+
+// do serves one request through the stack
+func (s *integrationStack) do(method, path string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	return w
+}
+
+// paymentOptions decodes a 402 from the unified middleware
+func paymentOptions(t *testing.T, w *httptest.ResponseRecorder) PaymentOptionsResponse {
+	t.Helper()
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402, got %d: %s", w.Code, w.Body)
+	}
+	var options PaymentOptionsResponse
+	if err := json.NewDecoder(w.Body).Decode(&options); err != nil {
+		t.Fatalf("Failed to decode 402: %v", err)
+	}
+	return options
+}
+
+// signPayment builds the X-PAYMENT header a wallet would send for
+// requirement: an exact-scheme authorization of value from payer
+func signPayment(requirement PaymentRequirements, payer, nonce string) string {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"x402Version": 1,
+		"scheme":      requirement.Scheme,
+		"network":     requirement.Network,
+		"payload": map[string]interface{}{
+			"signature": "0xsigned",
+			"authorization": map[string]string{
+				"from":        payer,
+				"to":          requirement.PayTo,
+				"value":       requirement.MaxAmountRequired,
+				"validAfter":  "0",
+				"validBefore": strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10),
+				"nonce":       nonce,
+			},
+		},
+	})
+	return base64.StdEncoding.EncodeToString(payload)
+}
+
+// payWithCrypto asks for path, signs the 402's first requirement and pays
+func (s *integrationStack) payWithCrypto(t *testing.T, path, payer, nonce string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	options := paymentOptions(t, s.do("GET", path, nil))
+	if len(options.Accepts) == 0 {
+		t.Fatal("Expected crypto requirements in the 402")
+	}
+	paid := map[string]string{"X-PAYMENT": signPayment(options.Accepts[0], payer, nonce)}
+	for name, value := range headers {
+		paid[name] = value
+	}
+	return s.do("GET", path, paid)
+}
+
+func TestIntegration_CryptoPayment(t *testing.T) {
+	stack := newIntegrationStack(t)
+
+	options := paymentOptions(t, stack.do("GET", "/api/data", nil))
+	if len(options.Accepts) != 1 || options.Accepts[0].PayTo != "0xseller" || options.Accepts[0].MaxAmountRequired != "10000" {
+		t.Fatalf("Expected one requirement of 10000 to 0xseller, got %+v", options.Accepts)
+	}
+
+	// Paying short is refused by the facilitator and answered with a new 402
+	short := options.Accepts[0]
+	short.MaxAmountRequired = "9999"
+	w := stack.do("GET", "/api/data", map[string]string{"X-PAYMENT": signPayment(short, "0xbuyer", "0x01")})
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected an underpayment refused, got %d", w.Code)
+	}
+
+	w = stack.do("GET", "/api/data", map[string]string{"X-PAYMENT": signPayment(options.Accepts[0], "0xbuyer", "0x02")})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"premium"`) {
+		t.Fatalf("Expected the paid request served, got %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("X-Payment-Rail") != RailEVMCrypto || w.Header().Get("X-Payment-ID") == "" {
+		t.Errorf("Expected the crypto payment identified in headers, got rail %q", w.Header().Get("X-Payment-Rail"))
+	}
+	if verifies, settles := stack.facilitator.counts(); verifies != 2 || settles != 1 {
+		t.Errorf("Expected 2 verifications and 1 settlement, got %d and %d", verifies, settles)
+	}
+}
+
+func TestIntegration_StripeIntent(t *testing.T) {
+	stack := newIntegrationStack(t)
+
+	var intentID string
+	for _, option := range paymentOptions(t, stack.do("GET", "/api/data", nil)).Options {
+		if option.Rail == RailStripe {
+			intentID, _, _ = strings.Cut(option.ClientSecret, "_secret")
+			if option.Amount != 1 {
+				t.Errorf("Expected a 1 cent Stripe option, got %d", option.Amount)
+			}
+		}
+	}
+	if intentID == "" {
+		t.Fatal("Expected a Stripe option with a client secret")
+	}
+	proof, _ := json.Marshal(PaymentProof{Rail: RailStripe, PaymentIntentID: intentID})
+	headers := map[string]string{"X-PAYMENT-PROOF": base64.StdEncoding.EncodeToString(proof)}
+
+	// Presented before the buyer completes it, the intent is incomplete
+	if w := stack.do("GET", "/api/data", headers); w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected an unpaid intent refused, got %d", w.Code)
+	}
+
+	stack.stripe.pay(intentID, "cus_buyer")
+	w := stack.do("GET", "/api/data", headers)
+	if w.Code != http.StatusOK || w.Header().Get("X-Payment-Rail") != RailStripe || w.Header().Get("X-Payment-ID") != intentID {
+		t.Fatalf("Expected the Stripe-paid request served, got %d with rail %q", w.Code, w.Header().Get("X-Payment-Rail"))
+	}
+}
+
+func TestIntegration_SessionExhaustion(t *testing.T) {
+	stack := newIntegrationStack(t)
+
+	w := stack.payWithCrypto(t, "/api/data", "0xbuyer", "0x01", nil)
+	sessionID := w.Header().Get("X-Session-ID")
+	if w.Code != http.StatusOK || sessionID == "" {
+		t.Fatalf("Expected a session minted by the payment, got %d with session %q", w.Code, sessionID)
+	}
+
+	for i := 1; i <= 2; i++ {
+		w = stack.do("GET", "/api/data", map[string]string{"X-Session-ID": sessionID})
+		if w.Code != http.StatusOK || w.Header().Get("X-Payment-Method") != "session" {
+			t.Fatalf("Expected session request %d served, got %d", i, w.Code)
+		}
+	}
+	if _, settles := stack.facilitator.counts(); settles != 1 {
+		t.Errorf("Expected session requests not to settle, got %d settlements", settles)
+	}
+
+	options := paymentOptions(t, stack.do("GET", "/api/data", map[string]string{"X-Session-ID": sessionID}))
+	if !strings.Contains(options.Error, "Session cannot be used") {
+		t.Errorf("Expected the exhausted session explained in the 402, got %q", options.Error)
+	}
+
+	// Session details stay available from the session endpoint
+	w = stack.do("GET", "/x402/session?id="+url.QueryEscape(sessionID), nil)
+	var session Session
+	if err := json.NewDecoder(w.Body).Decode(&session); err != nil || session.UsedRequests != 2 {
+		t.Errorf("Expected the session to report 2 requests, got %+v (%v)", session, err)
+	}
+}
+
+func TestIntegration_BudgetLifecycle(t *testing.T) {
+	stack := newIntegrationStack(t)
+	agent := map[string]string{"X-Agent-ID": "agent-1"}
+
+	// Without a budget the agent is asked to pay
+	paymentOptions(t, stack.do("GET", "/api/data", agent))
+
+	req := httptest.NewRequest("POST", "/x402/budget", strings.NewReader(`{"agentId":"agent-1","walletAddress":"0xagent","budget":20000}`))
+	w := httptest.NewRecorder()
+	stack.handler.ServeHTTP(w, req)
+	var budget PreAuthBudget
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&budget) != nil {
+		t.Fatalf("Expected the budget created, got %d: %s", w.Code, w.Body)
+	}
+
+	for _, remaining := range []string{"10000", "0"} {
+		w = stack.do("GET", "/api/data", agent)
+		if w.Code != http.StatusOK || w.Header().Get("X-Budget-Remaining") != remaining {
+			t.Fatalf("Expected a budget-paid request leaving %s, got %d with %q", remaining, w.Code, w.Header().Get("X-Budget-Remaining"))
+		}
+	}
+
+	w = stack.do("GET", "/api/data", agent)
+	if w.Code != http.StatusPaymentRequired || !strings.Contains(w.Body.String(), ErrCodeInsufficientBudget) {
+		t.Fatalf("Expected the exhausted budget refused, got %d: %s", w.Code, w.Body)
+	}
+
+	if w = stack.do("DELETE", "/x402/budget?id="+budget.ID, nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected closing without authorization forbidden, got %d", w.Code)
+	}
+	w = stack.do("DELETE", "/x402/budget?id="+budget.ID, map[string]string{"X-Admin-Key": integrationAdminKey})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"totalSpent":20000`) {
+		t.Fatalf("Expected the spent budget closed, got %d: %s", w.Code, w.Body)
+	}
+	if _, err := stack.budgets.Get(budget.ID); err == nil {
+		t.Error("Expected the closed budget deleted")
+	}
+
+	// Once closed, the agent pays per request again
+	paymentOptions(t, stack.do("GET", "/api/data", agent))
+	if verifies, _ := stack.facilitator.counts(); verifies != 0 {
+		t.Errorf("Expected budget requests not to reach the facilitator, got %d verifications", verifies)
+	}
+}
+
+func TestIntegration_IdempotentReplay(t *testing.T) {
+	stack := newIntegrationStack(t)
+	key := map[string]string{"Idempotency-Key": "order-42"}
+
+	w := stack.payWithCrypto(t, "/api/data", "0xbuyer", "0x01", key)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the paid request served, got %d: %s", w.Code, w.Body)
+	}
+	first := w.Body.String()
+
+	// A retry with the same key gets the same response without paying again
+	w = stack.do("GET", "/api/data", key)
+	if w.Code != http.StatusOK || w.Header().Get("X-Idempotent-Replay") != "true" || w.Body.String() != first {
+		t.Fatalf("Expected the response replayed, got %d (replay %q): %s", w.Code, w.Header().Get("X-Idempotent-Replay"), w.Body)
+	}
+	if verifies, settles := stack.facilitator.counts(); verifies != 1 || settles != 1 {
+		t.Errorf("Expected the replay not to reach the facilitator, got %d verifications and %d settlements", verifies, settles)
+	}
+
+	// Resending the settled authorization without the key is refused
+	options := paymentOptions(t, stack.do("GET", "/api/data", nil))
+	w = stack.do("GET", "/api/data", map[string]string{"X-PAYMENT": signPayment(options.Accepts[0], "0xbuyer", "0x01")})
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected a reused authorization refused, got %d", w.Code)
+	}
+}
+
+func TestIntegration_MeteringTotals(t *testing.T) {
+	stack := newIntegrationStack(t)
+
+	stack.payWithCrypto(t, "/api/data", "0xbuyer", "0x01", map[string]string{"Idempotency-Key": "k1"})
+	stack.do("GET", "/api/data", map[string]string{"Idempotency-Key": "k1"}) // Replay, not charged again
+	stack.payWithCrypto(t, "/api/other", "0xbuyer", "0x02", nil)
+
+	budget := &PreAuthBudget{AgentID: "agent-1", TotalBudget: 10000}
+	if err := stack.budgets.Create(budget); err != nil {
+		t.Fatalf("Create budget failed: %v", err)
+	}
+	stack.do("GET", "/api/data", map[string]string{"X-Agent-ID": "agent-1"})
+
+	w := stack.do("GET", "/x402/metrics", nil)
+	var report MetricsReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode metrics: %v", err)
+	}
+
+	// Two 402s before the crypto payments, their two paid retries, the
+	// replay, the budget request; the metrics request itself is recorded
+	// after it answers
+	if report.TotalRequests != 6 || report.PaymentRequired != 2 {
+		t.Errorf("Expected 6 requests with 2 answered 402, got %d and %d", report.TotalRequests, report.PaymentRequired)
+	}
+	if crypto := report.ByRail[RailEVMCrypto]; crypto == nil || crypto.Requests != 2 || crypto.Revenue != 20000 {
+		t.Errorf("Expected 2 crypto payments of 20000 in total, got %+v", crypto)
+	}
+	if report.TotalRevenue != 30000 {
+		t.Errorf("Expected 30000 revenue from crypto and the budget, got %d", report.TotalRevenue)
+	}
+}
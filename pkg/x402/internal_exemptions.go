@@ -0,0 +1,32 @@
+// Package x402 - Internal Exemptions
+// Health probes and service mesh sidecars call protected endpoints from
+// known subnets. ExemptCIDRs lets them through without a shared fake token;
+// the client IP is derived the same trusted-proxy-aware way as everywhere
+// else, so an X-Forwarded-For header from an outside peer can't claim one.
+package x402
+
+import (
+	"net"
+	"net/http"
+)
+
+// PaymentMethodExemptInternal is the X-Payment-Method (and metered payment
+// type) of requests from ExemptCIDRs
+const PaymentMethodExemptInternal = "exempt-internal"
+
+// parseExemptCIDRs parses ExemptCIDRs entries
+func parseExemptCIDRs(entries []string) ([]*net.IPNet, error) {
+	return parseNetworks(entries, "exempt CIDR")
+}
+
+// serveInternal serves r without payment if its client IP is in exempt,
+// reporting whether it did
+func serveInternal(w http.ResponseWriter, r *http.Request, exempt, trusted []*net.IPNet, audit *AuditLog, next http.Handler) bool {
+	if len(exempt) == 0 || !ipInNetworks(ClientIPFromRequest(r, trusted), exempt) {
+		return false
+	}
+	audit.Record(r, AuditEvent{Decision: AuditExempt, Reason: "internal"})
+	w.Header().Set("X-Payment-Method", PaymentMethodExemptInternal)
+	next.ServeHTTP(w, r)
+	return true
+}
@@ -0,0 +1,78 @@
+package x402
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware_ExemptCIDRs(t *testing.T) {
+	trusted, _ := ParseTrustedProxies([]string{"10.0.0.1"})
+	store := NewInMemoryMeteringStore(0, "USD")
+
+	config := testConfig()
+	config.ExemptCIDRs = []string{"192.168.10.0/24", "fd00:1::/64"}
+	config.TrustedProxies = trusted
+	handler := MeteringMiddleware(Middleware(createTestHandler(), config), MeteringConfig{Store: store, PricePerRequest: 100})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       int
+	}{
+		{"IPv4 in range", "192.168.10.7:4000", "", http.StatusOK},
+		{"IPv6 in range", "[fd00:1::42]:4000", "", http.StatusOK},
+		{"outside range", "192.168.11.7:4000", "", http.StatusPaymentRequired},
+		{"via trusted proxy", "10.0.0.1:4000", "192.168.10.7", http.StatusOK},
+		{"spoofed from untrusted peer", "203.0.113.9:4000", "192.168.10.7", http.StatusPaymentRequired},
+		{"spoofed through trusted proxy", "10.0.0.1:4000", "192.168.10.7, 203.0.113.9", http.StatusPaymentRequired},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, w.Code)
+		}
+	}
+
+	// Internal calls are metered as exempt and free
+	metrics, _ := store.GetMetrics(MetricsFilter{PaymentType: PaymentMethodExemptInternal})
+	if metrics.TotalRequests != 3 || metrics.TotalRevenue != 0 {
+		t.Errorf("Expected 3 free exempt-internal requests, got %d requests and %d revenue", metrics.TotalRequests, metrics.TotalRevenue)
+	}
+}
+
+func TestUnifiedMiddleware_ExemptCIDRs(t *testing.T) {
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		PricePerRequest: 100,
+		CryptoEnabled:   true,
+		ExemptCIDRs:     []string{"10.20.0.0/16"},
+	})
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.RemoteAddr = "10.20.3.4:5000"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("X-Payment-Method") != PaymentMethodExemptInternal {
+		t.Errorf("Expected internal caller to be exempt, got %d %q", w.Code, w.Header().Get("X-Payment-Method"))
+	}
+}
+
+func TestValidate_RejectsInvalidExemptCIDR(t *testing.T) {
+	config := testConfig()
+	config.ExemptCIDRs = []string{"10.0.0.0/33"}
+	if err := config.Validate(); err == nil {
+		t.Error("Expected invalid CIDR to fail Config.Validate")
+	}
+
+	unified := UnifiedPaymentConfig{PricePerRequest: 100, CryptoEnabled: true, ExemptCIDRs: []string{"not-a-cidr"}}
+	if err := unified.Validate(); err == nil {
+		t.Error("Expected invalid CIDR to fail UnifiedPaymentConfig.Validate")
+	}
+}
@@ -0,0 +1,196 @@
+// Package x402 - Payment Ledger
+// Records every verified payment so operators can audit what was charged,
+// to whom, and for which resource.
+package x402
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Payment record statuses
+const (
+	PaymentStatusVerified  = "verified"
+	PaymentStatusSettled   = "settled"
+	PaymentStatusFailed    = "failed"
+	PaymentStatusConfirmed = "confirmed" // Settlement mined with enough confirmations
+	PaymentStatusReverted  = "reverted"  // Settlement transaction reverted
+)
+
+// PaymentRecord is a single ledger entry
+type PaymentRecord struct {
+	ID            string            `json:"id"`
+	Timestamp     time.Time         `json:"timestamp"`
+	Endpoint      string            `json:"endpoint"`
+	Method        string            `json:"method"`
+	PayerID       string            `json:"payerId,omitempty"`
+	Amount        int64             `json:"amount"` // In smallest currency unit
+	Currency      string            `json:"currency"`
+	Rail          string            `json:"rail,omitempty"` // Payment rail ID, when known
+	Scheme        string            `json:"scheme,omitempty"`
+	Network       string            `json:"network,omitempty"`
+	TransactionID string            `json:"transactionId,omitempty"`
+	Status        string            `json:"status"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+
+	// Refunded is how much of Amount has been refunded so far
+	Refunded int64 `json:"refunded,omitempty"`
+}
+
+// LedgerFilter narrows ledger queries
+type LedgerFilter struct {
+	StartTime *time.Time `json:"startTime,omitempty"`
+	EndTime   *time.Time `json:"endTime,omitempty"`
+	PayerID   string     `json:"payerId,omitempty"`
+	Endpoint  string     `json:"endpoint,omitempty"`
+	Status    string     `json:"status,omitempty"`
+	Limit     int        `json:"limit,omitempty"` // Most recent N records (0 = all)
+}
+
+// PaymentLedger defines the interface for payment record storage
+type PaymentLedger interface {
+	Record(record PaymentRecord) (PaymentRecord, error)
+	Get(id string) (PaymentRecord, error)
+	List(filter LedgerFilter) ([]PaymentRecord, error)
+}
+
+// PaymentStatusUpdater is implemented by ledgers that can change a record's
+// status, e.g. once a settlement is confirmed or reverts
+type PaymentStatusUpdater interface {
+	UpdateStatus(id, status string) error
+}
+
+// InMemoryPaymentLedger is a simple in-memory implementation
+type InMemoryPaymentLedger struct {
+	mu      sync.RWMutex
+	records []*PaymentRecord
+	byID    map[string]*PaymentRecord
+	maxSize int
+}
+
+// NewInMemoryPaymentLedger creates a new in-memory ledger holding at most maxSize records
+func NewInMemoryPaymentLedger(maxSize int) *InMemoryPaymentLedger {
+	if maxSize <= 0 {
+		maxSize = 100000 // Default 100k entries
+	}
+	return &InMemoryPaymentLedger{
+		byID:    make(map[string]*PaymentRecord),
+		maxSize: maxSize,
+	}
+}
+
+// Record appends a payment, assigning an ID and timestamp when missing
+func (l *InMemoryPaymentLedger) Record(record PaymentRecord) (PaymentRecord, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if record.ID == "" {
+		record.ID = generatePaymentRecordID()
+	}
+	if record.Timestamp.IsZero() {
+		record.Timestamp = time.Now()
+	}
+	if record.Status == "" {
+		record.Status = PaymentStatusVerified
+	}
+	if _, exists := l.byID[record.ID]; exists {
+		return PaymentRecord{}, fmt.Errorf("payment record %s already exists", record.ID)
+	}
+
+	// Evict oldest entries if at capacity
+	if len(l.records) >= l.maxSize {
+		delete(l.byID, l.records[0].ID)
+		l.records = l.records[1:]
+	}
+
+	stored := record
+	l.byID[record.ID] = &stored
+	l.records = append(l.records, &stored)
+	return record, nil
+}
+
+// Get returns a payment record by ID
+func (l *InMemoryPaymentLedger) Get(id string) (PaymentRecord, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	rec, ok := l.byID[id]
+	if !ok {
+		return PaymentRecord{}, ErrPaymentRecordNotFound
+	}
+	return *rec, nil
+}
+
+// UpdateStatus sets the status of a payment record
+func (l *InMemoryPaymentLedger) UpdateStatus(id, status string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec, ok := l.byID[id]
+	if !ok {
+		return ErrPaymentRecordNotFound
+	}
+	rec.Status = status
+	return nil
+}
+
+// RecordRefund adds amount to the record's Refunded, marking it refunded
+// once all of it is
+func (l *InMemoryPaymentLedger) RecordRefund(id string, amount int64) (PaymentRecord, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec, ok := l.byID[id]
+	if !ok {
+		return PaymentRecord{}, ErrPaymentRecordNotFound
+	}
+	rec.Refunded += amount
+	if rec.Refunded >= rec.Amount {
+		rec.Status = PaymentStatusRefunded
+	}
+	return *rec, nil
+}
+
+// List returns matching records, newest first
+func (l *InMemoryPaymentLedger) List(filter LedgerFilter) ([]PaymentRecord, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	result := make([]PaymentRecord, 0)
+	for _, rec := range l.records {
+		if filter.StartTime != nil && rec.Timestamp.Before(*filter.StartTime) {
+			continue
+		}
+		if filter.EndTime != nil && rec.Timestamp.After(*filter.EndTime) {
+			continue
+		}
+		if filter.PayerID != "" && rec.PayerID != filter.PayerID {
+			continue
+		}
+		if filter.Endpoint != "" && rec.Endpoint != filter.Endpoint {
+			continue
+		}
+		if filter.Status != "" && rec.Status != filter.Status {
+			continue
+		}
+		result = append(result, *rec)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Timestamp.After(result[j].Timestamp)
+	})
+	if filter.Limit > 0 && len(result) > filter.Limit {
+		result = result[:filter.Limit]
+	}
+	return result, nil
+}
+
+func generatePaymentRecordID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "pay_" + hex.EncodeToString(b)
+}
@@ -0,0 +1,78 @@
+package x402
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInMemoryPaymentLedger_RecordAndList(t *testing.T) {
+	ledger := NewInMemoryPaymentLedger(10)
+
+	first, err := ledger.Record(PaymentRecord{Endpoint: "/api/a", Amount: 100, Timestamp: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+	if first.ID == "" || first.Status != PaymentStatusVerified {
+		t.Errorf("Expected ID and default status, got %+v", first)
+	}
+	ledger.Record(PaymentRecord{Endpoint: "/api/b", Amount: 200})
+
+	records, _ := ledger.List(LedgerFilter{})
+	if len(records) != 2 || records[0].Endpoint != "/api/b" {
+		t.Errorf("Expected newest first, got %+v", records)
+	}
+
+	records, _ = ledger.List(LedgerFilter{Limit: 1})
+	if len(records) != 1 {
+		t.Errorf("Expected limit to apply, got %d records", len(records))
+	}
+
+	got, err := ledger.Get(first.ID)
+	if err != nil || got.Amount != 100 {
+		t.Errorf("Expected to get first record, got %+v (%v)", got, err)
+	}
+
+	if _, err := ledger.Record(PaymentRecord{ID: first.ID}); err == nil {
+		t.Error("Expected duplicate ID to be rejected")
+	}
+}
+
+func TestInMemoryPaymentLedger_Eviction(t *testing.T) {
+	ledger := NewInMemoryPaymentLedger(2)
+
+	first, _ := ledger.Record(PaymentRecord{Endpoint: "/1"})
+	ledger.Record(PaymentRecord{Endpoint: "/2"})
+	ledger.Record(PaymentRecord{Endpoint: "/3"})
+
+	if _, err := ledger.Get(first.ID); err == nil {
+		t.Error("Expected oldest record to be evicted")
+	}
+	records, _ := ledger.List(LedgerFilter{})
+	if len(records) != 2 {
+		t.Errorf("Expected 2 records, got %d", len(records))
+	}
+}
+
+func TestMiddleware_RecordsPaymentsInLedger(t *testing.T) {
+	ledger := NewInMemoryPaymentLedger(10)
+	config := testConfig()
+	config.Ledger = ledger
+	handler := Middleware(createTestHandler(), config)
+
+	// Unpaid request is not recorded
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/data", nil))
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("Authorization", "Bearer valid_token")
+	req.Header.Set("X-Payer-Address", "0xpayer")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	records, _ := ledger.List(LedgerFilter{})
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 ledger record, got %d", len(records))
+	}
+	if records[0].PayerID != "0xpayer" || records[0].Amount != 100 || records[0].Endpoint != "/api/data" {
+		t.Errorf("Unexpected ledger record: %+v", records[0])
+	}
+}
@@ -0,0 +1,194 @@
+// Package x402 - Request & Response Size Limits
+// Bounds how much data a paid request can push at the backend and how much
+// the backend can stream back, so neither side can exhaust the server.
+package x402
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrResponseTooLarge is returned from Write once a response exceeds MaxResponseBodyBytes
+var ErrResponseTooLarge = errors.New("x402: response body exceeds limit")
+
+// BodyLimitEvent describes a request or response that exceeded a size limit
+type BodyLimitEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Endpoint  string    `json:"endpoint"`
+	Method    string    `json:"method"`
+	Direction string    `json:"direction"` // "request" or "response"
+	Limit     int64     `json:"limit"`
+	Size      int64     `json:"size"` // Bytes seen when the limit was hit (or declared Content-Length)
+}
+
+// BodyLimits configures size enforcement
+type BodyLimits struct {
+	// MaxRequestBodyBytes caps the request body (0 = unlimited).
+	// Oversized requests are rejected with 413.
+	MaxRequestBodyBytes int64
+
+	// MaxResponseBodyBytes caps the response body (0 = unlimited).
+	// A declared oversized response becomes 502; a streamed one is cut off.
+	MaxResponseBodyBytes int64
+
+	// OnLimitExceeded is called whenever a limit is hit
+	OnLimitExceeded func(event BodyLimitEvent)
+}
+
+// enabled reports whether any limit is configured
+func (l BodyLimits) enabled() bool {
+	return l.MaxRequestBodyBytes > 0 || l.MaxResponseBodyBytes > 0
+}
+
+// BodyLimitMiddleware enforces request and response size limits.
+// Oversized requests are rejected before reaching next, so they are never
+// verified, charged, or proxied: those with a declared Content-Length over
+// the limit straight away, and those of unknown length, such as chunked
+// uploads, once buffering them runs over it.
+func BodyLimitMiddleware(next http.Handler, limits BodyLimits) http.Handler {
+	if !limits.enabled() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if max := limits.MaxRequestBodyBytes; max > 0 && r.Body != nil && r.Body != http.NoBody {
+			if r.ContentLength > max {
+				limits.report(r, "request", max, r.ContentLength)
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if r.ContentLength < 0 {
+				// Read up to the limit now, rather than failing next's read
+				// after payment has been taken
+				body, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+				if err != nil {
+					http.Error(w, "Failed to read request body", http.StatusBadRequest)
+					return
+				}
+				if int64(len(body)) > max {
+					limits.report(r, "request", max, int64(len(body)))
+					http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+					return
+				}
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				r.ContentLength = int64(len(body))
+			} else {
+				// Declared lengths are enforced while reading
+				r.Body = &limitedRequestBody{
+					ReadCloser: http.MaxBytesReader(w, r.Body, max),
+					onExceeded: func(n int64) { limits.report(r, "request", max, n) },
+				}
+			}
+		}
+
+		if max := limits.MaxResponseBodyBytes; max > 0 {
+			w = &limitedResponseWriter{
+				ResponseWriter: w,
+				limit:          max,
+				onExceeded:     func(n int64) { limits.report(r, "response", max, n) },
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l BodyLimits) report(r *http.Request, direction string, limit, size int64) {
+	if l.OnLimitExceeded == nil {
+		return
+	}
+	l.OnLimitExceeded(BodyLimitEvent{
+		Timestamp: time.Now(),
+		Endpoint:  r.URL.Path,
+		Method:    r.Method,
+		Direction: direction,
+		Limit:     limit,
+		Size:      size,
+	})
+}
+
+// limitedRequestBody reports the first read that trips http.MaxBytesReader
+type limitedRequestBody struct {
+	io.ReadCloser
+	read       int64
+	reported   bool
+	onExceeded func(n int64)
+}
+
+func (b *limitedRequestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	var tooLarge *http.MaxBytesError
+	if err != nil && !b.reported && errors.As(err, &tooLarge) {
+		b.reported = true
+		b.onExceeded(b.read)
+	}
+	return n, err
+}
+
+// limitedResponseWriter counts response bytes and stops writing past the limit
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	limit       int64
+	written     int64
+	wroteHeader bool
+	exceeded    bool
+	onExceeded  func(n int64)
+}
+
+func (w *limitedResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	// A declared oversized body is replaced by a 502 before anything is sent
+	if cl, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil && cl > w.limit {
+		w.exceeded = true
+		w.onExceeded(cl)
+		w.Header().Del("Content-Length")
+		http.Error(w.ResponseWriter, "Upstream response too large", http.StatusBadGateway)
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *limitedResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		// First write larger than the limit can still become a 502
+		if int64(len(b)) > w.limit {
+			w.wroteHeader = true
+			w.exceeded = true
+			w.onExceeded(int64(len(b)))
+			http.Error(w.ResponseWriter, "Upstream response too large", http.StatusBadGateway)
+			return 0, ErrResponseTooLarge
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.exceeded {
+		return 0, ErrResponseTooLarge
+	}
+
+	if remaining := w.limit - w.written; int64(len(b)) > remaining {
+		n, _ := w.ResponseWriter.Write(b[:remaining])
+		w.written += int64(n)
+		w.exceeded = true
+		w.onExceeded(w.written + int64(len(b)) - int64(n))
+		return n, ErrResponseTooLarge
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush supports streaming responses
+func (w *limitedResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,173 @@
+package x402
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyLimitMiddleware_RejectsOversizedRequest(t *testing.T) {
+	backendCalled := false
+	var events []BodyLimitEvent
+
+	handler := BodyLimitMiddleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backendCalled = true
+		}),
+		BodyLimits{
+			MaxRequestBodyBytes: 10,
+			OnLimitExceeded:     func(e BodyLimitEvent) { events = append(events, e) },
+		},
+	)
+
+	req := httptest.NewRequest("POST", "/api/upload", strings.NewReader(strings.Repeat("x", 100)))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d", w.Code)
+	}
+	if backendCalled {
+		t.Error("Expected backend not to see oversized body")
+	}
+	if len(events) != 1 || events[0].Direction != "request" || events[0].Size != 100 {
+		t.Errorf("Expected one request limit event, got %+v", events)
+	}
+}
+
+func TestBodyLimitMiddleware_ChunkedRequestBuffered(t *testing.T) {
+	var got []byte
+	var events []BodyLimitEvent
+
+	handler := BodyLimitMiddleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = io.ReadAll(r.Body)
+		}),
+		BodyLimits{
+			MaxRequestBodyBytes: 10,
+			OnLimitExceeded:     func(e BodyLimitEvent) { events = append(events, e) },
+		},
+	)
+
+	// Unknown length, as with chunked encoding
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/upload", strings.NewReader(body))
+		req.ContentLength = -1
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send(strings.Repeat("x", 100)); w.Code != http.StatusRequestEntityTooLarge || got != nil {
+		t.Errorf("Expected 413 before next reads the body, got %d with %d bytes read", w.Code, len(got))
+	}
+	if len(events) != 1 || events[0].Size != 11 {
+		t.Errorf("Expected one limit event, got %+v", events)
+	}
+
+	if w := send("small"); w.Code != http.StatusOK || string(got) != "small" {
+		t.Errorf("Expected a body within the limit passed on, got %d with %q", w.Code, got)
+	}
+}
+
+func TestBodyLimitMiddleware_DeclaredOversizedResponse(t *testing.T) {
+	handler := BodyLimitMiddleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "1000")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(strings.Repeat("x", 1000)))
+		}),
+		BodyLimits{MaxResponseBodyBytes: 100},
+	)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/big", nil))
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502, got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "xxxx") {
+		t.Error("Expected oversized body not to be relayed")
+	}
+}
+
+func TestBodyLimitMiddleware_StreamedResponseTruncated(t *testing.T) {
+	var writeErr error
+	var events []BodyLimitEvent
+
+	handler := BodyLimitMiddleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for i := 0; i < 10 && writeErr == nil; i++ {
+				_, writeErr = w.Write([]byte(strings.Repeat("x", 30)))
+			}
+		}),
+		BodyLimits{
+			MaxResponseBodyBytes: 100,
+			OnLimitExceeded:      func(e BodyLimitEvent) { events = append(events, e) },
+		},
+	)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/stream", nil))
+
+	if writeErr != ErrResponseTooLarge {
+		t.Errorf("Expected ErrResponseTooLarge, got %v", writeErr)
+	}
+	if w.Body.Len() != 100 {
+		t.Errorf("Expected body truncated to 100 bytes, got %d", w.Body.Len())
+	}
+	if len(events) != 1 || events[0].Direction != "response" {
+		t.Errorf("Expected one response limit event, got %+v", events)
+	}
+}
+
+func TestMiddleware_BodyLimitBeforePayment(t *testing.T) {
+	verified := false
+	config := testConfig()
+	config.MaxRequestBodyBytes = 10
+	config.PaymentVerifier = func(token string) (bool, error) {
+		verified = true
+		return true, nil
+	}
+
+	handler := Middleware(createTestHandler(), config)
+
+	req := httptest.NewRequest("POST", "/api/data", strings.NewReader(strings.Repeat("x", 100)))
+	req.Header.Set("Authorization", "Bearer valid_token")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d", w.Code)
+	}
+	if verified {
+		t.Error("Expected oversized request to be rejected before payment verification")
+	}
+}
+
+func TestMiddleware_ChunkedBodyLimitBeforePayment(t *testing.T) {
+	ledger := NewInMemoryPaymentLedger(0)
+	config := testConfig()
+	config.MaxRequestBodyBytes = 10
+	config.Ledger = ledger
+	backendCalled := false
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalled = true
+		io.ReadAll(r.Body)
+	}), config)
+
+	req := httptest.NewRequest("POST", "/api/data", strings.NewReader(strings.Repeat("x", 100)))
+	req.ContentLength = -1 // Chunked
+	req.Header.Set("Authorization", "Bearer valid_token")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge || backendCalled {
+		t.Errorf("Expected 413 without reaching the backend, got %d", w.Code)
+	}
+	if records, _ := ledger.List(LedgerFilter{}); len(records) != 0 {
+		t.Errorf("Expected no payment recorded, got %+v", records)
+	}
+}
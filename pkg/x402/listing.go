@@ -0,0 +1,168 @@
+// Package x402 - Listing
+// Admin tooling pages through sessions and budgets rather than loading tens
+// of thousands at once. Listings are ordered by creation time, then ID, and
+// a page token names the last record returned, so pages stay stable while
+// records are added or removed.
+package x402
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultListLimit is the page size when none is given
+	DefaultListLimit = 100
+
+	// MaxListLimit caps the page size
+	MaxListLimit = 1000
+)
+
+// ErrInvalidPageToken is returned for page tokens a store did not issue
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// ListFilter narrows a session or budget listing. Zero fields match all.
+type ListFilter struct {
+	// Payer matches a session's PayerAddress, or a budget's AgentID or
+	// WalletAddress
+	Payer string
+
+	// Active, if set, matches records that are (or are not) usable now:
+	// active unexpired sessions, or unsuspended unexpired budgets
+	Active *bool
+
+	// CreatedAfter (inclusive) and CreatedBefore (exclusive) bound CreatedAt
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+// matches reports whether a record passes the filter
+func (f ListFilter) matches(payers []string, active bool, created time.Time) bool {
+	if f.Payer != "" {
+		found := false
+		for _, payer := range payers {
+			if payer != "" && strings.EqualFold(payer, f.Payer) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Active != nil && *f.Active != active {
+		return false
+	}
+	if !f.CreatedAfter.IsZero() && created.Before(f.CreatedAfter) {
+		return false
+	}
+	if !f.CreatedBefore.IsZero() && !created.Before(f.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// ParseListFilter reads a filter, page token and limit from query parameters:
+// payer, active (true/false), createdAfter and createdBefore (RFC3339),
+// pageToken and limit
+func ParseListFilter(q url.Values) (ListFilter, string, int, error) {
+	var filter ListFilter
+	filter.Payer = q.Get("payer")
+	if active := q.Get("active"); active != "" {
+		parsed, err := strconv.ParseBool(active)
+		if err != nil {
+			return filter, "", 0, fmt.Errorf("active must be true or false")
+		}
+		filter.Active = &parsed
+	}
+	for name, field := range map[string]*time.Time{"createdAfter": &filter.CreatedAfter, "createdBefore": &filter.CreatedBefore} {
+		if value := q.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, "", 0, fmt.Errorf("%s must be RFC3339", name)
+			}
+			*field = parsed
+		}
+	}
+	limit := 0
+	if value := q.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return filter, "", 0, fmt.Errorf("limit must be a positive number")
+		}
+		limit = parsed
+	}
+	return filter, q.Get("pageToken"), limit, nil
+}
+
+// listLimit applies the default and maximum page sizes
+func listLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		return MaxListLimit
+	}
+	return limit
+}
+
+// pageKey orders listed records
+type pageKey struct {
+	created time.Time
+	id      string
+}
+
+func (k pageKey) before(other pageKey) bool {
+	if !k.created.Equal(other.created) {
+		return k.created.Before(other.created)
+	}
+	return k.id < other.id
+}
+
+func encodePageToken(k pageKey) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(k.created.UnixNano(), 10) + ":" + k.id))
+}
+
+func decodePageToken(token string) (pageKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return pageKey{}, ErrInvalidPageToken
+	}
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return pageKey{}, ErrInvalidPageToken
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return pageKey{}, ErrInvalidPageToken
+	}
+	return pageKey{created: time.Unix(0, n), id: id}, nil
+}
+
+// paginate sorts items and returns the page after pageToken, with the token
+// of the next page ("" on the last one)
+func paginate[T any](items []T, key func(T) pageKey, pageToken string, limit int) ([]T, string, error) {
+	sort.Slice(items, func(i, j int) bool { return key(items[i]).before(key(items[j])) })
+
+	start := 0
+	if pageToken != "" {
+		after, err := decodePageToken(pageToken)
+		if err != nil {
+			return nil, "", err
+		}
+		start = sort.Search(len(items), func(i int) bool { return after.before(key(items[i])) })
+	}
+
+	limit = listLimit(limit)
+	end := start + limit
+	if end >= len(items) {
+		return items[start:], "", nil
+	}
+	return items[start:end], encodePageToken(key(items[end-1])), nil
+}
@@ -0,0 +1,213 @@
+package x402
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// seedBudgets creates n budgets created a minute apart, with every third
+// one suspended and agents alternating between two payers
+func seedBudgets(store *InMemoryPreAuthStore, n int, start time.Time) {
+	for i := 0; i < n; i++ {
+		budget := &PreAuthBudget{
+			ID:          fmt.Sprintf("budget-%02d", i),
+			AgentID:     fmt.Sprintf("agent-%02d", i),
+			TotalBudget: 1000,
+		}
+		if i%2 == 0 {
+			budget.WalletAddress = "0xEven"
+		}
+		store.Create(budget)
+		store.budgets[budget.ID].CreatedAt = start.Add(time.Duration(i) * time.Minute)
+		store.budgets[budget.ID].Suspended = i%3 == 0
+	}
+}
+
+func TestListBudgets_Pages(t *testing.T) {
+	store := NewInMemoryPreAuthStore()
+	start := time.Now().Add(-time.Hour)
+	seedBudgets(store, 10, start)
+
+	var seen []string
+	token := ""
+	pages := 0
+	for {
+		page, next, err := store.ListBudgets(ListFilter{}, token, 3)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		pages++
+		for _, budget := range page {
+			seen = append(seen, budget.ID)
+		}
+		// New budgets sort after the cursor and must not shift pages already read
+		store.Create(&PreAuthBudget{AgentID: fmt.Sprintf("late-%d", pages), TotalBudget: 1})
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	if pages < 4 {
+		t.Errorf("Expected at least 4 pages of 3, got %d", pages)
+	}
+	for i := 0; i < 10; i++ {
+		if want := fmt.Sprintf("budget-%02d", i); seen[i] != want {
+			t.Fatalf("Expected %s at position %d, got %v", want, i, seen)
+		}
+	}
+	unique := make(map[string]bool)
+	for _, id := range seen {
+		if unique[id] {
+			t.Errorf("Expected no duplicates, got %s twice", id)
+		}
+		unique[id] = true
+	}
+
+	if _, _, err := store.ListBudgets(ListFilter{}, "not a token!", 3); !errors.Is(err, ErrInvalidPageToken) {
+		t.Errorf("Expected ErrInvalidPageToken, got %v", err)
+	}
+}
+
+func TestListBudgets_Filters(t *testing.T) {
+	store := NewInMemoryPreAuthStore()
+	start := time.Now().Add(-time.Hour)
+	seedBudgets(store, 10, start)
+
+	active, inactive := true, false
+	tests := []struct {
+		name   string
+		filter ListFilter
+		want   []string
+	}{
+		{"agent", ListFilter{Payer: "AGENT-03"}, []string{"budget-03"}},
+		{"wallet", ListFilter{Payer: "0xeven"}, []string{"budget-00", "budget-02", "budget-04", "budget-06", "budget-08"}},
+		{"suspended", ListFilter{Active: &inactive}, []string{"budget-00", "budget-03", "budget-06", "budget-09"}},
+		{"created range", ListFilter{CreatedAfter: start.Add(2 * time.Minute), CreatedBefore: start.Add(5 * time.Minute)}, []string{"budget-02", "budget-03", "budget-04"}},
+		{"wallet and active and created", ListFilter{Payer: "0xEven", Active: &active, CreatedAfter: start.Add(time.Minute)}, []string{"budget-02", "budget-04", "budget-08"}},
+	}
+	for _, tt := range tests {
+		page, next, err := store.ListBudgets(tt.filter, "", 2)
+		var got []string
+		for err == nil {
+			for _, budget := range page {
+				got = append(got, budget.ID)
+			}
+			if next == "" {
+				break
+			}
+			page, next, err = store.ListBudgets(tt.filter, next, 2)
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestListSessions_FiltersAndPages(t *testing.T) {
+	store := NewInMemorySessionStore()
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 6; i++ {
+		session := &Session{
+			ID:           fmt.Sprintf("sess-%d", i),
+			PayerAddress: "0xPayer",
+			ExpiresAt:    time.Now().Add(time.Hour),
+		}
+		if i == 5 {
+			session.PayerAddress = "0xOther"
+		}
+		store.CreateSession(session)
+		store.sessions[session.ID].CreatedAt = start.Add(time.Duration(i) * time.Minute)
+	}
+	// One expired, one revoked
+	store.sessions["sess-1"].ExpiresAt = time.Now().Add(-time.Minute)
+	store.sessions["sess-2"].Active = false
+
+	active := true
+	filter := ListFilter{Payer: "0xpayer", Active: &active}
+	first, next, err := store.ListSessions(filter, "", 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(first) != 2 || first[0].ID != "sess-0" || first[1].ID != "sess-3" || next == "" {
+		t.Fatalf("Expected sess-0 and sess-3 with a next page, got %v next=%q", first, next)
+	}
+	second, next, err := store.ListSessions(filter, next, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(second) != 1 || second[0].ID != "sess-4" || next != "" {
+		t.Errorf("Expected only sess-4 on the last page, got %v next=%q", second, next)
+	}
+
+	// Returned sessions are copies
+	first[0].UsedRequests = 99
+	if stored, _ := store.GetSession("sess-0"); stored.UsedRequests != 0 {
+		t.Error("Expected listed sessions to be copies")
+	}
+}
+
+func TestAdminHandler_ListPaging(t *testing.T) {
+	handler, deps := newTestAdminHandler()
+	seedBudgets(deps.Budgets.(*InMemoryPreAuthStore), 5, time.Now().Add(-time.Hour))
+	deps.Sessions.CreateSession(&Session{PayerAddress: "0xabc", ExpiresAt: time.Now().Add(time.Hour)})
+
+	type budgetPage struct {
+		Budgets       []PreAuthBudget `json:"budgets"`
+		Count         int             `json:"count"`
+		NextPageToken string          `json:"nextPageToken"`
+	}
+	get := func(path string) (int, budgetPage) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, adminRequest("GET", path, ""))
+		var page budgetPage
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+		}
+		return w.Code, page
+	}
+
+	code, page := get("/admin/budgets?active=true&limit=2")
+	if code != http.StatusOK || page.Count != 2 || page.Budgets[0].ID != "budget-01" || page.NextPageToken == "" {
+		t.Fatalf("Expected the first two active budgets, got %d %+v", code, page)
+	}
+	code, page = get("/admin/budgets?active=true&limit=2&pageToken=" + url.QueryEscape(page.NextPageToken))
+	if code != http.StatusOK || page.Count != 1 || page.Budgets[0].ID != "budget-04" || page.NextPageToken != "" {
+		t.Errorf("Expected budget-04 on the last page, got %d %+v", code, page)
+	}
+
+	for _, path := range []string{
+		"/admin/budgets?active=maybe",
+		"/admin/budgets?createdAfter=yesterday",
+		"/admin/budgets?limit=-1",
+		"/admin/budgets?pageToken=garbage!",
+	} {
+		if code, _ := get(path); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", path, code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("GET", "/admin/sessions?payer=0xABC", ""))
+	var sessions struct {
+		Sessions []Session `json:"sessions"`
+		Count    int       `json:"count"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&sessions); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if sessions.Count != 1 || sessions.Sessions[0].PayerAddress != "0xabc" {
+		t.Errorf("Expected the 0xabc session, got %+v", sessions)
+	}
+}
@@ -0,0 +1,108 @@
+// Package x402 - Low Balance Warnings
+// An agent whose pre-authorized budget or request session runs dry finds out
+// from a 402 in the middle of a task. Instead, the request that takes a
+// budget to its LowBalanceThreshold, or a session to 90% of its requests,
+// says so in a response header (and a budgetWarning in AIResponse metadata)
+// and fires a spending alert, once per crossing.
+package x402
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Low balance alert kinds
+const (
+	AlertLowBalance = "low_balance" // A budget's remaining fell to its LowBalanceThreshold
+	AlertSessionLow = "session_low" // A request session used sessionLowPercent of its requests
+)
+
+// sessionLowPercent is how much of a request session is used before it is
+// reported low
+const sessionLowPercent = 90
+
+// BudgetWarning tells an agent in AIResponse metadata that its budget is low
+type BudgetWarning struct {
+	Remaining int64  `json:"remaining"`
+	Threshold int64  `json:"threshold"`
+	Message   string `json:"message"`
+}
+
+// crossedLowBalance reports whether deducting amount took budget (as returned
+// by the store) from above its LowBalanceThreshold to at or below it
+func (b *PreAuthBudget) crossedLowBalance(amount int64) bool {
+	threshold := b.LowBalanceThreshold
+	return threshold > 0 && b.Remaining <= threshold && b.Remaining+amount > threshold
+}
+
+// crossedLowBalance reports whether the request just counted took a request
+// session to sessionLowPercent of MaxRequests
+func (s *Session) crossedLowBalance() bool {
+	if s.SessionType != SessionTypeRequests || s.MaxRequests <= 0 {
+		return false
+	}
+	low := func(used int64) bool { return used*100 >= s.MaxRequests*sessionLowPercent }
+	return low(s.UsedRequests) && !low(s.UsedRequests-1)
+}
+
+// warnLowBalance flags the response to a deduction of amount that crossed
+// budget's threshold and alerts on it
+func warnLowBalance(w http.ResponseWriter, alerts *SpendingAlerts, budget *PreAuthBudget, amount int64) {
+	if !budget.crossedLowBalance(amount) {
+		return
+	}
+	w.Header().Set("X-Budget-Low", "true")
+	w.Header().Set("X-Budget-Low-Threshold", strconv.FormatInt(budget.LowBalanceThreshold, 10))
+	if alerts == nil {
+		return
+	}
+	alerts.notify(SpendAlert{
+		Kind:      AlertLowBalance,
+		BudgetID:  budget.ID,
+		AgentID:   budget.AgentID,
+		Spent:     budget.TotalSpent,
+		Threshold: budget.LowBalanceThreshold,
+		Remaining: budget.Remaining,
+		Currency:  budget.Currency,
+		Time:      alerts.clock(),
+	})
+}
+
+// warnSessionLow flags the response to the request that took session to
+// sessionLowPercent of its requests and alerts on it
+func warnSessionLow(w http.ResponseWriter, alerts *SpendingAlerts, session *Session) {
+	if !session.crossedLowBalance() {
+		return
+	}
+	w.Header().Set("X-Session-Low", "true")
+	if alerts == nil {
+		return
+	}
+	alerts.notify(SpendAlert{
+		Kind:      AlertSessionLow,
+		SessionID: session.ID,
+		Spent:     session.UsedRequests,
+		Threshold: session.MaxRequests * sessionLowPercent / 100,
+		Remaining: session.MaxRequests - session.UsedRequests,
+		Currency:  session.Currency,
+		Time:      alerts.clock(),
+	})
+}
+
+// budgetWarningFrom reads the warning a payment middleware flagged on the
+// response headers, or nil
+func budgetWarningFrom(h http.Header) *BudgetWarning {
+	if h.Get("X-Budget-Low") != "true" {
+		return nil
+	}
+	remaining, err := strconv.ParseInt(h.Get("X-Budget-Remaining"), 10, 64)
+	if err != nil {
+		remaining, _ = strconv.ParseInt(h.Get("X-Remaining-Budget"), 10, 64)
+	}
+	threshold, _ := strconv.ParseInt(h.Get("X-Budget-Low-Threshold"), 10, 64)
+	return &BudgetWarning{
+		Remaining: remaining,
+		Threshold: threshold,
+		Message:   "Pre-authorized budget is running low; top it up or open a new one",
+	}
+}
@@ -0,0 +1,99 @@
+package x402
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLowBalance_BudgetWarnsOncePerCrossing(t *testing.T) {
+	store := NewInMemoryPreAuthStore()
+	store.Create(&PreAuthBudget{AgentID: "agent-1", TotalBudget: 1000, LowBalanceThreshold: 250, Currency: "USD"})
+
+	var alerts []SpendAlert
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SendAISuccess(w, "req_1", time.Now(), map[string]string{"ok": "yes"}, nil)
+	})
+	handler := AIFirstMiddleware(api, AIFirstConfig{
+		PreAuthStore:  store,
+		EnablePreAuth: true,
+		DefaultCost:   200,
+		Currency:      "USD",
+		Alerts:        &SpendingAlerts{OnAlert: func(alert SpendAlert) { alerts = append(alerts, alert) }},
+	})
+
+	// Remaining: 800, 600, 400, 200 (crosses 250), 0
+	var low []int
+	var warning *BudgetWarning
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-Agent-ID", "agent-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected 200, got %d", i, w.Code)
+		}
+		var resp AIResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		if w.Header().Get("X-Budget-Low") == "true" {
+			low = append(low, i)
+			warning = resp.Meta.BudgetWarning
+		} else if resp.Meta.BudgetWarning != nil {
+			t.Errorf("Request %d: expected no budget warning, got %+v", i, resp.Meta.BudgetWarning)
+		}
+	}
+
+	if len(low) != 1 || low[0] != 3 {
+		t.Fatalf("Expected X-Budget-Low only on the request crossing the threshold, got %v", low)
+	}
+	if warning == nil || warning.Remaining != 200 || warning.Threshold != 250 {
+		t.Errorf("Expected a budget warning at 200 of 250, got %+v", warning)
+	}
+	if len(alerts) != 1 || alerts[0].Kind != AlertLowBalance || alerts[0].Remaining != 200 || alerts[0].BudgetID == "" {
+		t.Errorf("Expected one low balance alert, got %+v", alerts)
+	}
+}
+
+func TestAIBudgetHandler_LowBalanceThreshold(t *testing.T) {
+	store := NewInMemoryPreAuthStore()
+	handler := AIBudgetHandler(store, AIFirstConfig{Currency: "USD"})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/ai/budget", strings.NewReader(`{"agentId":"agent-1","budget":1000,"lowBalanceThreshold":100}`)))
+	budget, err := store.GetByAgentID("agent-1")
+	if err != nil || budget.LowBalanceThreshold != 100 {
+		t.Errorf("Expected the threshold to be stored, got %+v (%v)", budget, err)
+	}
+}
+
+func TestLowBalance_SessionWarnsAtNinetyPercent(t *testing.T) {
+	store := NewInMemorySessionStore()
+	store.CreateSession(&Session{ID: "sess-1", SessionType: SessionTypeRequests, MaxRequests: 10, ExpiresAt: time.Now().Add(time.Hour)})
+
+	var alerts []SpendAlert
+	handler := SessionMiddleware(createTestHandler(), SessionConfig{
+		Store:  store,
+		Alerts: &SpendingAlerts{OnAlert: func(alert SpendAlert) { alerts = append(alerts, alert) }},
+	})
+
+	var low []int
+	for i := 1; i <= 10; i++ {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-Session-ID", "sess-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Header().Get("X-Session-Low") == "true" {
+			low = append(low, i)
+		}
+	}
+
+	if len(low) != 1 || low[0] != 9 {
+		t.Errorf("Expected X-Session-Low only on the 9th of 10 requests, got %v", low)
+	}
+	if len(alerts) != 1 || alerts[0].Kind != AlertSessionLow || alerts[0].SessionID != "sess-1" || alerts[0].Remaining != 1 {
+		t.Errorf("Expected one session_low alert, got %+v", alerts)
+	}
+}
@@ -4,6 +4,9 @@ package x402
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
+	"net"
 	"net/http"
 	"sort"
 	"sync"
@@ -27,10 +30,34 @@ type UsageMetric struct {
 	Currency     string    `json:"currency"`
 	ResponseCode int       `json:"responseCode"`
 	Latency      int64     `json:"latencyMs"`   // Response time in milliseconds
-	PaymentType  string    `json:"paymentType"` // "per-request", "session", "subscription"
+	PaymentType  string    `json:"paymentType"` // "per-request", "budget", "session", "subscription", "unpaid", "exempt", "free", "coupon", "exempt-internal"
 	SessionID    string    `json:"sessionId,omitempty"`
 	UserAgent    string    `json:"userAgent,omitempty"`
+	ClientIP     string    `json:"clientIp,omitempty"`
 	IsAIAgent    bool      `json:"isAiAgent"` // Detected AI agent request
+	BytesIn      int64     `json:"bytesIn"`   // Request body bytes read by the handler
+	BytesOut     int64     `json:"bytesOut"`  // Response body bytes written
+
+	// Settlement, when the payment middleware reports it: the rail's fee,
+	// what the seller keeps, and the rail's transaction reference
+	FeeAmount     int64  `json:"feeAmount,omitempty"`
+	NetAmount     int64  `json:"netAmount,omitempty"`
+	Rail          string `json:"rail,omitempty"`
+	Network       string `json:"network,omitempty"` // For crypto rails
+	TransactionID string `json:"transactionId,omitempty"`
+
+	// PaymentID links a paid request to its payment's ledger record (or,
+	// for budget deductions, the budget)
+	PaymentID string `json:"paymentId,omitempty"`
+}
+
+// net is what the seller kept: NetAmount once a settlement reported it,
+// otherwise the gross amount
+func (m UsageMetric) net() int64 {
+	if m.NetAmount != 0 || m.FeeAmount != 0 {
+		return m.NetAmount
+	}
+	return m.AmountPaid
 }
 
 // MetricsFilter for querying metrics
@@ -41,8 +68,27 @@ type MetricsFilter struct {
 	PayerID      string     `json:"payerId,omitempty"`
 	PaymentType  string     `json:"paymentType,omitempty"`
 	AIAgentsOnly bool       `json:"aiAgentsOnly,omitempty"`
+
+	// Rail and Network match the paying rail and, for crypto, its network
+	// (in either CAIP-2 or facilitator form)
+	Rail    string `json:"rail,omitempty"`
+	Network string `json:"network,omitempty"`
+
+	// Granularity of the report's TimeSeries: GranularityMinute,
+	// GranularityHour (the default) or GranularityDay
+	Granularity string `json:"granularity,omitempty"`
+}
+
+// byRequest reports whether f narrows requests by more than time
+func (f MetricsFilter) byRequest() bool {
+	return f.Endpoint != "" || f.PayerID != "" || f.PaymentType != "" || f.AIAgentsOnly || f.Rail != "" || f.Network != ""
 }
 
+// RevenueUnattributed is the RevenueByRail and RevenueByNetwork key of
+// revenue with no rail or network: fiat payments have no network, and
+// requests metered without a payment middleware have neither
+const RevenueUnattributed = "none"
+
 // MetricsReport contains aggregated metrics
 type MetricsReport struct {
 	Period          string          `json:"period"`
@@ -58,6 +104,31 @@ type MetricsReport struct {
 	AIAgentRequests int64           `json:"aiAgentRequests"`
 	AIAgentRevenue  int64           `json:"aiAgentRevenue"`
 	ErrorRate       float64         `json:"errorRate"`
+	TotalBytesIn    int64           `json:"totalBytesIn"`
+	TotalBytesOut   int64           `json:"totalBytesOut"`
+	PaymentRequired int64           `json:"paymentRequired"` // Requests answered with 402
+
+	// TotalFees are rail fees on TotalRevenue; NetRevenue is what remains
+	TotalFees  int64                   `json:"totalFees"`
+	NetRevenue int64                   `json:"netRevenue"`
+	ByRail     map[string]*RailRevenue `json:"byRail"` // Paid requests by rail
+
+	// RevenueByRail and RevenueByNetwork split TotalRevenue; each sums to it
+	RevenueByRail    map[string]int64 `json:"revenueByRail"`
+	RevenueByNetwork map[string]int64 `json:"revenueByNetwork"`
+
+	// TimeSeries is requests, revenue and errors per Granularity bucket,
+	// oldest first. RequestsByHour and RevenueByHour fold all days together.
+	Granularity string   `json:"granularity"`
+	TimeSeries  []Bucket `json:"timeSeries"`
+}
+
+// RailRevenue is one rail's share of a MetricsReport
+type RailRevenue struct {
+	Requests   int64 `json:"requests"`
+	Revenue    int64 `json:"revenue"`
+	Fees       int64 `json:"fees"`
+	NetRevenue int64 `json:"netRevenue"`
 }
 
 // EndpointStats contains per-endpoint metrics
@@ -68,6 +139,8 @@ type EndpointStats struct {
 	AvgLatencyMs  float64 `json:"avgLatencyMs"`
 	ErrorRate     float64 `json:"errorRate"`
 	UniqueUsers   int64   `json:"uniqueUsers"`
+	BytesIn       int64   `json:"bytesIn"`
+	BytesOut      int64   `json:"bytesOut"`
 }
 
 // PayerStats contains per-payer metrics
@@ -79,12 +152,21 @@ type PayerStats struct {
 	IsAIAgent     bool   `json:"isAiAgent"`
 }
 
-// InMemoryMeteringStore is a simple in-memory implementation
+// InMemoryMeteringStore is a simple in-memory implementation. Besides its
+// last maxSize metrics, it keeps time series rollups for as long as
+// Retention says.
 type InMemoryMeteringStore struct {
+	// Retention of the time series rollups (default DefaultRollupRetention)
+	Retention RollupRetention
+
 	mu       sync.RWMutex
 	metrics  []UsageMetric
 	maxSize  int
 	currency string
+	rollups  rollups
+
+	// now is stubbed in tests
+	now func() time.Time
 }
 
 // NewInMemoryMeteringStore creates a new in-memory metering store
@@ -113,20 +195,47 @@ func (s *InMemoryMeteringStore) RecordRequest(metric UsageMetric) error {
 	}
 
 	s.metrics = append(s.metrics, metric)
+
+	// Compact old buckets at most once a minute
+	now, retention := s.clock(), s.Retention.withDefaults()
+	s.rollups.add(metric, now, retention)
+	if now.Sub(s.rollups.compacted) >= time.Minute {
+		s.rollups.compact(now, retention)
+	}
 	return nil
 }
 
+func (s *InMemoryMeteringStore) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
 // GetMetrics retrieves aggregated metrics based on filter
 func (s *InMemoryMeteringStore) GetMetrics(filter MetricsFilter) (*MetricsReport, error) {
+	granularity := filter.Granularity
+	if granularity == "" {
+		granularity = GranularityHour
+	}
+	if granularityRank(granularity) < 0 {
+		return nil, ErrInvalidGranularity
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	report := &MetricsReport{
-		Period:         "custom",
-		Currency:       s.currency,
-		RequestsByHour: make(map[int]int64),
-		RevenueByHour:  make(map[int]int64),
+		Period:           "custom",
+		Currency:         s.currency,
+		RequestsByHour:   make(map[int]int64),
+		RevenueByHour:    make(map[int]int64),
+		ByRail:           make(map[string]*RailRevenue),
+		RevenueByRail:    make(map[string]int64),
+		RevenueByNetwork: make(map[string]int64),
+		Granularity:      granularity,
 	}
+	series := make(map[int64]*Bucket)
 
 	uniqueUsers := make(map[string]bool)
 	endpointStats := make(map[string]*EndpointStats)
@@ -154,20 +263,57 @@ func (s *InMemoryMeteringStore) GetMetrics(filter MetricsFilter) (*MetricsReport
 		if filter.AIAgentsOnly && !m.IsAIAgent {
 			continue
 		}
+		if filter.Rail != "" && m.Rail != filter.Rail {
+			continue
+		}
+		if filter.Network != "" && canonicalEVMNetwork(m.Network) != canonicalEVMNetwork(filter.Network) {
+			continue
+		}
 
 		// Aggregate
 		report.TotalRequests++
 		report.TotalRevenue += m.AmountPaid
+		report.TotalFees += m.FeeAmount
+		report.NetRevenue += m.net()
 		totalLatency += m.Latency
+		report.TotalBytesIn += m.BytesIn
+		report.TotalBytesOut += m.BytesOut
 
 		hour := m.Timestamp.Hour()
 		report.RequestsByHour[hour]++
 		report.RevenueByHour[hour] += m.AmountPaid
 
+		if filter.byRequest() {
+			start := bucketStart(m.Timestamp, granularity)
+			b, ok := series[start.Unix()]
+			if !ok {
+				b = &Bucket{Start: start}
+				series[start.Unix()] = b
+			}
+			b.add(m)
+		}
+
 		if m.PayerID != "" {
 			uniqueUsers[m.PayerID] = true
 		}
 
+		if m.AmountPaid != 0 {
+			report.RevenueByRail[orUnattributed(m.Rail)] += m.AmountPaid
+			report.RevenueByNetwork[orUnattributed(m.Network)] += m.AmountPaid
+		}
+
+		if m.Rail != "" && m.AmountPaid > 0 {
+			rr, ok := report.ByRail[m.Rail]
+			if !ok {
+				rr = &RailRevenue{}
+				report.ByRail[m.Rail] = rr
+			}
+			rr.Requests++
+			rr.Revenue += m.AmountPaid
+			rr.Fees += m.FeeAmount
+			rr.NetRevenue += m.net()
+		}
+
 		if m.IsAIAgent {
 			report.AIAgentRequests++
 			report.AIAgentRevenue += m.AmountPaid
@@ -176,6 +322,9 @@ func (s *InMemoryMeteringStore) GetMetrics(filter MetricsFilter) (*MetricsReport
 		if m.ResponseCode >= 400 {
 			errorCount++
 		}
+		if m.ResponseCode == http.StatusPaymentRequired {
+			report.PaymentRequired++
+		}
 
 		// Endpoint stats
 		if _, ok := endpointStats[m.Endpoint]; !ok {
@@ -184,6 +333,8 @@ func (s *InMemoryMeteringStore) GetMetrics(filter MetricsFilter) (*MetricsReport
 		es := endpointStats[m.Endpoint]
 		es.TotalRequests++
 		es.TotalRevenue += m.AmountPaid
+		es.BytesIn += m.BytesIn
+		es.BytesOut += m.BytesOut
 		es.AvgLatencyMs = (es.AvgLatencyMs*float64(es.TotalRequests-1) + float64(m.Latency)) / float64(es.TotalRequests)
 		if m.ResponseCode >= 400 {
 			es.ErrorRate = float64(errorCount) / float64(es.TotalRequests)
@@ -202,6 +353,13 @@ func (s *InMemoryMeteringStore) GetMetrics(filter MetricsFilter) (*MetricsReport
 		}
 	}
 
+	// The rollups outlive evicted metrics, but only count requests by time
+	if filter.byRequest() {
+		report.TimeSeries = sortedBuckets(series)
+	} else {
+		report.TimeSeries = s.rollups.series(granularity, filter.StartTime, filter.EndTime)
+	}
+
 	report.UniqueUsers = int64(len(uniqueUsers))
 	if report.TotalRequests > 0 {
 		report.AvgLatencyMs = float64(totalLatency) / float64(report.TotalRequests)
@@ -232,6 +390,14 @@ func (s *InMemoryMeteringStore) GetMetrics(filter MetricsFilter) (*MetricsReport
 	return report, nil
 }
 
+// orUnattributed is key, or RevenueUnattributed if it's empty
+func orUnattributed(key string) string {
+	if key == "" {
+		return RevenueUnattributed
+	}
+	return key
+}
+
 // GetEndpointStats returns stats for all endpoints
 func (s *InMemoryMeteringStore) GetEndpointStats() ([]EndpointStats, error) {
 	report, err := s.GetMetrics(MetricsFilter{})
@@ -243,9 +409,20 @@ func (s *InMemoryMeteringStore) GetEndpointStats() ([]EndpointStats, error) {
 
 // MeteringConfig configures the metering middleware
 type MeteringConfig struct {
-	Store           MeteringStore
-	Currency        string
+	Store    MeteringStore
+	Currency string
+
+	// Deprecated: metering records the amount the payment middleware
+	// reports each request paid (see RequestPaymentInfo); PricePerRequest is
+	// ignored
 	PricePerRequest int64
+
+	// TrustedProxies are networks whose X-Forwarded-For headers are believed
+	// when recording ClientIP (see ParseTrustedProxies)
+	TrustedProxies []*net.IPNet
+
+	// Tenants, if set, meters each tenant separately, in place of Store
+	Tenants *TenantStores
 }
 
 // MeteringMiddleware wraps a handler with usage metering
@@ -253,37 +430,84 @@ func MeteringMiddleware(next http.Handler, config MeteringConfig) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
-		// Wrap response writer to capture status code
+		// Count request body bytes as the handler reads them
+		var body *countingReader
+		if r.Body != nil {
+			body = &countingReader{ReadCloser: r.Body}
+			r.Body = body
+		}
+
+		// Wrap response writer to capture status code and size
 		wrapped := &responseRecorder{ResponseWriter: w, statusCode: 200}
 
+		// A payment middleware on either side reports its decision here
+		info, r := paymentInfoFor(r)
+
 		next.ServeHTTP(wrapped, r)
 
+		// Only requests the payment middleware reports paid carry an amount.
+		// The rest were demanded payment, waived, covered by a session,
+		// subscription or receipt, exempt, or a cache revalidation.
+		var amount int64
+		paymentType := PaymentTypeUnpaid
+		method, prepaid := wrapped.Header().Get("X-Payment-Method"), prepaidAccess(r)
+		switch {
+		case info.Paid:
+			amount, paymentType = info.Gross, info.Type
+		case method == PaymentMethodFree || method == PaymentMethodAttribution || method == PaymentMethodCoupon || method == PaymentMethodSubscription || method == PaymentMethodExemptInternal || method == PaymentMethodRevalidation || method == PaymentMethodReceipt:
+			paymentType = method
+		case info.Type == PaymentTypeExempt:
+			paymentType = PaymentTypeExempt
+		case prepaid != "" && wrapped.statusCode != http.StatusPaymentRequired:
+			paymentType = prepaid
+		}
+
 		// Record metric
 		metric := UsageMetric{
 			Timestamp:    start,
 			Endpoint:     r.URL.Path,
 			Method:       r.Method,
 			PayerID:      extractPayerID(r),
-			AmountPaid:   config.PricePerRequest,
+			AmountPaid:   amount,
 			Currency:     config.Currency,
 			ResponseCode: wrapped.statusCode,
 			Latency:      time.Since(start).Milliseconds(),
-			PaymentType:  detectPaymentType(r),
+			PaymentType:  paymentType,
 			SessionID:    r.Header.Get("X-Session-ID"),
 			UserAgent:    r.UserAgent(),
+			ClientIP:     ClientIPFromRequest(r, config.TrustedProxies),
 			IsAIAgent:    isAIAgent(r),
+			BytesOut:     wrapped.bytes,
+		}
+		if body != nil {
+			metric.BytesIn = body.n
+		}
+		if info.Payer != "" {
+			metric.PayerID = info.Payer
+		}
+		if info.Paid {
+			metric.PaymentID = info.PaymentID
+			metric.FeeAmount = info.Fee
+			metric.NetAmount = info.Net
+			metric.Rail = info.Rail
+			metric.Network = info.Network
+			metric.TransactionID = info.TransactionID
+			if info.Currency != "" {
+				metric.Currency = info.Currency
+			}
 		}
 
-		if config.Store != nil {
-			_ = config.Store.RecordRequest(metric)
+		if store := config.Tenants.meteringFor(r, config.Store); store != nil {
+			_ = store.RecordRequest(metric)
 		}
 	})
 }
 
-// responseRecorder captures the response status code
+// responseRecorder captures the response status code and body size
 type responseRecorder struct {
 	http.ResponseWriter
 	statusCode int
+	bytes      int64
 }
 
 func (rr *responseRecorder) WriteHeader(code int) {
@@ -291,6 +515,24 @@ func (rr *responseRecorder) WriteHeader(code int) {
 	rr.ResponseWriter.WriteHeader(code)
 }
 
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+// countingReader counts bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
 // extractPayerID extracts the payer identifier from the request
 func extractPayerID(r *http.Request) string {
 	// Check for wallet address in payment headers
@@ -312,15 +554,16 @@ func extractPayerID(r *http.Request) string {
 	return ""
 }
 
-// detectPaymentType determines the payment type from headers
-func detectPaymentType(r *http.Request) string {
+// prepaidAccess is the session or subscription r claims to be covered by,
+// if any
+func prepaidAccess(r *http.Request) string {
 	if r.Header.Get("X-Session-ID") != "" {
 		return "session"
 	}
 	if r.Header.Get("X-Subscription-ID") != "" {
 		return "subscription"
 	}
-	return "per-request"
+	return ""
 }
 
 // MetricsHandler returns an HTTP handler for the metrics endpoint
@@ -348,10 +591,32 @@ func MetricsHandler(store MeteringStore) http.HandlerFunc {
 		filter.PayerID = r.URL.Query().Get("payer")
 		filter.PaymentType = r.URL.Query().Get("paymentType")
 		filter.AIAgentsOnly = r.URL.Query().Get("aiOnly") == "true"
+		filter.Rail = r.URL.Query().Get("rail")
+		filter.Network = r.URL.Query().Get("network")
+		filter.Granularity = r.URL.Query().Get("granularity")
+
+		// range=30d reports the 30 days before end (default now)
+		if rng := r.URL.Query().Get("range"); rng != "" {
+			d, err := parseMetricsRange(rng)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			end := time.Now()
+			if filter.EndTime != nil {
+				end = *filter.EndTime
+			}
+			start := end.Add(-d)
+			filter.StartTime = &start
+		}
 
 		report, err := store.GetMetrics(filter)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrInvalidGranularity) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
 			return
 		}
 
@@ -0,0 +1,246 @@
+// Package x402 - Revenue Rollups
+// RequestsByHour folds every day into hours of the day, so yesterday's 3 PM
+// and today's are one number, and raw metrics are evicted once the store is
+// full. InMemoryMeteringStore also rolls requests up into buckets keyed by
+// when they start, at minute, hour and day granularity, compacting old minute
+// buckets into hours and old hours into days, so a report can chart revenue
+// per day for the last month at a bounded cost in memory.
+package x402
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time series granularities
+const (
+	GranularityMinute = "minute"
+	GranularityHour   = "hour"
+	GranularityDay    = "day"
+)
+
+// ErrInvalidGranularity is returned for an unknown MetricsFilter.Granularity
+var ErrInvalidGranularity = errors.New("granularity must be minute, hour or day")
+
+// Bucket is one interval of a MetricsReport's TimeSeries. Buckets start on
+// UTC minute, hour or day boundaries.
+type Bucket struct {
+	Start    time.Time `json:"start"`
+	Requests int64     `json:"requests"`
+	Revenue  int64     `json:"revenue"`
+	Errors   int64     `json:"errors"`
+}
+
+// RollupRetention is how long InMemoryMeteringStore keeps buckets of each
+// granularity
+type RollupRetention struct {
+	// Minute buckets older than this are compacted into hours (default 6h)
+	Minute time.Duration
+
+	// Hour buckets older than this are compacted into days (default 7 days)
+	Hour time.Duration
+
+	// Day buckets older than this are dropped (default 400 days)
+	Day time.Duration
+}
+
+// DefaultRollupRetention is the retention of a zero RollupRetention
+var DefaultRollupRetention = RollupRetention{
+	Minute: 6 * time.Hour,
+	Hour:   7 * 24 * time.Hour,
+	Day:    400 * 24 * time.Hour,
+}
+
+// withDefaults fills in the zero fields of r
+func (r RollupRetention) withDefaults() RollupRetention {
+	if r.Minute <= 0 {
+		r.Minute = DefaultRollupRetention.Minute
+	}
+	if r.Hour <= 0 {
+		r.Hour = DefaultRollupRetention.Hour
+	}
+	if r.Day <= 0 {
+		r.Day = DefaultRollupRetention.Day
+	}
+	return r
+}
+
+// granularities, finest first
+var granularities = []string{GranularityMinute, GranularityHour, GranularityDay}
+
+// granularityRank orders granularities, finest first, and is -1 for unknown
+// ones
+func granularityRank(granularity string) int {
+	for i, g := range granularities {
+		if g == granularity {
+			return i
+		}
+	}
+	return -1
+}
+
+// bucketStart is the start of the granularity bucket t falls in
+func bucketStart(t time.Time, granularity string) time.Time {
+	t = t.UTC()
+	switch granularity {
+	case GranularityMinute:
+		return t.Truncate(time.Minute)
+	case GranularityHour:
+		return t.Truncate(time.Hour)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// bucketEnd is when the granularity bucket starting at start ends
+func bucketEnd(start time.Time, granularity string) time.Time {
+	switch granularity {
+	case GranularityMinute:
+		return start.Add(time.Minute)
+	case GranularityHour:
+		return start.Add(time.Hour)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// add counts metric in b
+func (b *Bucket) add(metric UsageMetric) {
+	b.Requests++
+	b.Revenue += metric.AmountPaid
+	if metric.ResponseCode >= 400 {
+		b.Errors++
+	}
+}
+
+// merge adds other's counts to b
+func (b *Bucket) merge(other Bucket) {
+	b.Requests += other.Requests
+	b.Revenue += other.Revenue
+	b.Errors += other.Errors
+}
+
+// rollups holds a store's buckets, one tier per granularity
+type rollups struct {
+	tiers     map[string]map[int64]*Bucket // by granularity, then Start
+	compacted time.Time                    // when compact last ran
+}
+
+// tier returns granularity's buckets
+func (r *rollups) tier(granularity string) map[int64]*Bucket {
+	if r.tiers == nil {
+		r.tiers = make(map[string]map[int64]*Bucket)
+	}
+	if r.tiers[granularity] == nil {
+		r.tiers[granularity] = make(map[int64]*Bucket)
+	}
+	return r.tiers[granularity]
+}
+
+// bucket returns the granularity bucket starting at start, adding it if
+// needed
+func (r *rollups) bucket(granularity string, start time.Time) *Bucket {
+	tier := r.tier(granularity)
+	b, ok := tier[start.Unix()]
+	if !ok {
+		b = &Bucket{Start: start}
+		tier[start.Unix()] = b
+	}
+	return b
+}
+
+// granularityAt is the granularity kept for an interval starting at t, or ""
+// if it's past retention
+func granularityAt(t, now time.Time, retention RollupRetention) string {
+	switch age := now.Sub(t); {
+	case age < retention.Minute:
+		return GranularityMinute
+	case age < retention.Hour:
+		return GranularityHour
+	case age < retention.Day:
+		return GranularityDay
+	}
+	return ""
+}
+
+// add counts metric in the bucket its age calls for
+func (r *rollups) add(metric UsageMetric, now time.Time, retention RollupRetention) {
+	if granularity := granularityAt(metric.Timestamp, now, retention); granularity != "" {
+		r.bucket(granularity, bucketStart(metric.Timestamp, granularity)).add(metric)
+	}
+}
+
+// compact moves buckets past their tier's retention into the coarser tier
+// their age calls for, and drops those past the day tier's
+func (r *rollups) compact(now time.Time, retention RollupRetention) {
+	r.compacted = now
+	for i, granularity := range granularities {
+		for key, b := range r.tier(granularity) {
+			target := granularityAt(b.Start, now, retention)
+			if target != "" && granularityRank(target) <= i {
+				continue
+			}
+			delete(r.tiers[granularity], key)
+			if target != "" {
+				r.bucket(target, bucketStart(b.Start, target)).merge(*b)
+			}
+		}
+	}
+}
+
+// series returns the buckets overlapping [start, end] at granularity, oldest
+// first. Intervals compacted past granularity come back at the size they
+// were compacted to.
+func (r *rollups) series(granularity string, start, end *time.Time) []Bucket {
+	rank := granularityRank(granularity)
+	merged := make(map[int64]*Bucket)
+	for i, tierGranularity := range granularities {
+		size := tierGranularity
+		if i < rank {
+			size = granularity
+		}
+		for _, b := range r.tiers[tierGranularity] {
+			at := bucketStart(b.Start, size)
+			if (start != nil && !bucketEnd(at, size).After(*start)) || (end != nil && at.After(*end)) {
+				continue
+			}
+			m, ok := merged[at.Unix()]
+			if !ok {
+				m = &Bucket{Start: at}
+				merged[at.Unix()] = m
+			}
+			m.merge(*b)
+		}
+	}
+	return sortedBuckets(merged)
+}
+
+// sortedBuckets returns buckets oldest first
+func sortedBuckets(buckets map[int64]*Bucket) []Bucket {
+	series := make([]Bucket, 0, len(buckets))
+	for _, b := range buckets {
+		series = append(series, *b)
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Start.Before(series[j].Start) })
+	return series
+}
+
+// parseMetricsRange parses a MetricsHandler range: a Go duration such as
+// "90m" or "24h", or a number of days such as "30d"
+func parseMetricsRange(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, errors.New("range must be a positive duration, such as 24h or 30d")
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errors.New("range must be a positive duration, such as 24h or 30d")
+	}
+	return d, nil
+}
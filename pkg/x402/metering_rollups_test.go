@@ -0,0 +1,156 @@
+package x402
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newRollupStore is a metering store whose clock reads *now
+func newRollupStore(now *time.Time) *InMemoryMeteringStore {
+	store := NewInMemoryMeteringStore(1000, "USDC")
+	store.now = func() time.Time { return *now }
+	return store
+}
+
+func TestMeteringRollups_MidnightBoundary(t *testing.T) {
+	now := time.Date(2026, 3, 2, 0, 10, 0, 0, time.UTC)
+	store := newRollupStore(&now)
+	eastern := time.FixedZone("EST", -5*60*60)
+	store.RecordRequest(UsageMetric{Timestamp: time.Date(2026, 3, 1, 23, 59, 30, 0, time.UTC), AmountPaid: 100, ResponseCode: 200})
+	store.RecordRequest(UsageMetric{Timestamp: time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), AmountPaid: 200, ResponseCode: 200})
+	store.RecordRequest(UsageMetric{Timestamp: time.Date(2026, 3, 1, 19, 0, 30, 0, eastern), AmountPaid: 300, ResponseCode: 500})
+
+	tests := []struct {
+		granularity string
+		want        []Bucket
+	}{
+		{GranularityDay, []Bucket{
+			{Start: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), Requests: 1, Revenue: 100},
+			{Start: time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), Requests: 2, Revenue: 500, Errors: 1},
+		}},
+		{GranularityHour, []Bucket{
+			{Start: time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC), Requests: 1, Revenue: 100},
+			{Start: time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), Requests: 2, Revenue: 500, Errors: 1},
+		}},
+		{GranularityMinute, []Bucket{
+			{Start: time.Date(2026, 3, 1, 23, 59, 0, 0, time.UTC), Requests: 1, Revenue: 100},
+			{Start: time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), Requests: 2, Revenue: 500, Errors: 1},
+		}},
+	}
+	for _, tt := range tests {
+		report, err := store.GetMetrics(MetricsFilter{Granularity: tt.granularity})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.granularity, err)
+		}
+		if len(report.TimeSeries) != len(tt.want) {
+			t.Fatalf("%s: expected %d buckets, got %+v", tt.granularity, len(tt.want), report.TimeSeries)
+		}
+		for i, b := range report.TimeSeries {
+			if !b.Start.Equal(tt.want[i].Start) || b.Requests != tt.want[i].Requests || b.Revenue != tt.want[i].Revenue || b.Errors != tt.want[i].Errors {
+				t.Errorf("%s bucket %d: expected %+v, got %+v", tt.granularity, i, tt.want[i], b)
+			}
+		}
+	}
+
+	// Filtered reports bucket the matching metrics themselves
+	report, _ := store.GetMetrics(MetricsFilter{Granularity: GranularityDay, AIAgentsOnly: true})
+	if len(report.TimeSeries) != 0 {
+		t.Errorf("Expected no buckets for a filter matching nothing, got %+v", report.TimeSeries)
+	}
+	if _, err := store.GetMetrics(MetricsFilter{Granularity: "week"}); err != ErrInvalidGranularity {
+		t.Errorf("Expected %v, got %v", ErrInvalidGranularity, err)
+	}
+}
+
+func TestMeteringRollups_Compaction(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	store := newRollupStore(&now)
+	store.Retention = RollupRetention{Minute: time.Hour, Hour: 24 * time.Hour, Day: 3 * 24 * time.Hour}
+	paidAt := time.Date(2026, 3, 10, 11, 50, 0, 0, time.UTC)
+	store.RecordRequest(UsageMetric{Timestamp: paidAt, AmountPaid: 100})
+	store.RecordRequest(UsageMetric{Timestamp: paidAt.Add(time.Minute), AmountPaid: 100})
+
+	tierSizes := func() [3]int {
+		return [3]int{len(store.rollups.tiers[GranularityMinute]), len(store.rollups.tiers[GranularityHour]), len(store.rollups.tiers[GranularityDay])}
+	}
+	if got := tierSizes(); got != [3]int{2, 0, 0} {
+		t.Fatalf("Expected 2 minute buckets, got %v", got)
+	}
+
+	// Two hours on, the minute buckets are folded into their hour
+	now = now.Add(2 * time.Hour)
+	store.RecordRequest(UsageMetric{Timestamp: now, AmountPaid: 1})
+	if got := tierSizes(); got != [3]int{1, 1, 0} {
+		t.Fatalf("Expected the old minutes compacted into an hour, got %v", got)
+	}
+	report, _ := store.GetMetrics(MetricsFilter{Granularity: GranularityMinute})
+	if len(report.TimeSeries) != 2 || !report.TimeSeries[0].Start.Equal(time.Date(2026, 3, 10, 11, 0, 0, 0, time.UTC)) || report.TimeSeries[0].Revenue != 200 {
+		t.Errorf("Expected the compacted minutes back as their hour, got %+v", report.TimeSeries)
+	}
+
+	// Two days on, the hour and the minute are both folded into March 10
+	now = now.Add(48 * time.Hour)
+	store.RecordRequest(UsageMetric{Timestamp: now, AmountPaid: 1})
+	if got := tierSizes(); got != [3]int{1, 0, 1} {
+		t.Fatalf("Expected the old buckets compacted into a day, got %v", got)
+	}
+	report, _ = store.GetMetrics(MetricsFilter{Granularity: GranularityDay})
+	if len(report.TimeSeries) != 2 || report.TimeSeries[0].Requests != 3 || report.TimeSeries[0].Revenue != 201 {
+		t.Errorf("Expected 3 requests for 201 on March 10, got %+v", report.TimeSeries)
+	}
+
+	// And past the day retention, dropped
+	now = now.Add(5 * 24 * time.Hour)
+	store.RecordRequest(UsageMetric{Timestamp: now, AmountPaid: 1})
+	if got := tierSizes(); got != [3]int{1, 0, 0} {
+		t.Errorf("Expected the expired days dropped, got %v", got)
+	}
+}
+
+func TestMeteringRollups_OutliveEvictedMetrics(t *testing.T) {
+	now := time.Now()
+	store := NewInMemoryMeteringStore(2, "USDC")
+	store.now = func() time.Time { return now }
+	for i := 0; i < 5; i++ {
+		store.RecordRequest(UsageMetric{Timestamp: now, AmountPaid: 10})
+	}
+
+	report, _ := store.GetMetrics(MetricsFilter{Granularity: GranularityDay})
+	if report.TotalRequests != 2 {
+		t.Errorf("Expected the 2 kept metrics totalled, got %d", report.TotalRequests)
+	}
+	if len(report.TimeSeries) != 1 || report.TimeSeries[0].Requests != 5 || report.TimeSeries[0].Revenue != 50 {
+		t.Errorf("Expected all 5 requests in the time series, got %+v", report.TimeSeries)
+	}
+}
+
+func TestMetricsHandler_TimeSeries(t *testing.T) {
+	store := NewInMemoryMeteringStore(100, "USDC")
+	store.RecordRequest(UsageMetric{Timestamp: time.Now().Add(-40 * 24 * time.Hour), AmountPaid: 100})
+	store.RecordRequest(UsageMetric{Timestamp: time.Now().Add(-24 * time.Hour), AmountPaid: 200})
+	store.RecordRequest(UsageMetric{Timestamp: time.Now(), AmountPaid: 300})
+	handler := MetricsHandler(store)
+
+	req := httptest.NewRequest("GET", "/metrics?granularity=day&range=30d", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var report MetricsReport
+	json.NewDecoder(w.Body).Decode(&report)
+	if w.Code != http.StatusOK || report.Granularity != GranularityDay {
+		t.Fatalf("Expected a daily report, got %d %+v", w.Code, report)
+	}
+	if len(report.TimeSeries) != 2 || report.TimeSeries[0].Revenue != 200 || report.TimeSeries[1].Revenue != 300 {
+		t.Errorf("Expected the last 30 days by day, got %+v", report.TimeSeries)
+	}
+
+	for _, query := range []string{"granularity=week", "range=abc", "range=0d", "range=-1h"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, w.Code)
+		}
+	}
+}
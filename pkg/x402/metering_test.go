@@ -1,9 +1,12 @@
 package x402
 
 import (
+	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -164,3 +167,207 @@ func TestMeteringStore_Eviction(t *testing.T) {
 		t.Errorf("Expected revenue %d, got %d", expectedRevenue, report.TotalRevenue)
 	}
 }
+
+func TestMeteringMiddleware_RecordsBytes(t *testing.T) {
+	store := NewInMemoryMeteringStore(1000, "USDC")
+
+	handler := MeteringMiddleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.ReadAll(r.Body)
+			w.Write([]byte("hello world"))
+		}),
+		MeteringConfig{Store: store, Currency: "USDC", PricePerRequest: 100},
+	)
+
+	req := httptest.NewRequest("POST", "/api/upload", strings.NewReader("12345"))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	report, _ := store.GetMetrics(MetricsFilter{})
+	if report.TotalBytesIn != 5 {
+		t.Errorf("Expected 5 bytes in, got %d", report.TotalBytesIn)
+	}
+	if report.TotalBytesOut != 11 {
+		t.Errorf("Expected 11 bytes out, got %d", report.TotalBytesOut)
+	}
+	if len(report.TopEndpoints) != 1 || report.TopEndpoints[0].BytesOut != 11 {
+		t.Errorf("Expected endpoint bytes to be aggregated, got %+v", report.TopEndpoints)
+	}
+}
+
+func TestMeteringMiddleware_PaymentRequiredNotCharged(t *testing.T) {
+	store := NewInMemoryMeteringStore(10, "USDC")
+	handler := MeteringMiddleware(
+		Middleware(createTestHandler(), testConfig()),
+		MeteringConfig{Store: store, Currency: "USDC", PricePerRequest: 100},
+	)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/data", nil))
+
+	report, _ := store.GetMetrics(MetricsFilter{})
+	if report.PaymentRequired != 1 {
+		t.Errorf("Expected 1 payment-required response, got %d", report.PaymentRequired)
+	}
+	if report.TotalRevenue != 0 {
+		t.Errorf("Expected no revenue for a 402, got %d", report.TotalRevenue)
+	}
+}
+
+// feeRail settles every verified payment, charging Stripe's 2.9% + 30 on the
+// stripe rail and nothing on crypto
+type feeRail struct {
+	PaymentRail
+}
+
+func (f *feeRail) VerifyPayment(ctx context.Context, req *VerifyPaymentRequest) (*PaymentVerification, error) {
+	return &PaymentVerification{Valid: true, PaymentID: "pay_" + f.ID(), Amount: req.ExpectedAmount, Currency: "USD", Payer: "0xPayer", RequiresCapture: true}, nil
+}
+
+func (f *feeRail) CapturePayment(ctx context.Context, req *CapturePaymentRequest) (*PaymentCapture, error) {
+	var fee int64
+	if f.ID() == RailStripe {
+		fee = int64(float64(req.Amount)*0.029) + 30
+	}
+	return &PaymentCapture{Success: true, TransactionID: "tx_" + f.ID(), GrossAmount: req.Amount, FeeAmount: fee, NetAmount: req.Amount - fee}, nil
+}
+
+func TestMeteringMiddleware_RecordsSettlementFees(t *testing.T) {
+	registry := NewRailRegistry()
+	registry.Register(&feeRail{NewStripeRail("sk_test", "")})
+	registry.Register(&feeRail{NewEVMCryptoRail("", nil)})
+	config := UnifiedPaymentConfig{
+		Currency:      "USD",
+		PriceByRail:   map[string]int64{RailStripe: 1000, RailEVMCrypto: 1000},
+		CryptoEnabled: true,
+		FiatEnabled:   true,
+		RailRegistry:  registry,
+	}
+
+	compositions := map[string]func(store MeteringStore) http.Handler{
+		"metering outside": func(store MeteringStore) http.Handler {
+			return MeteringMiddleware(UnifiedPaymentMiddleware(createTestHandler(), config), MeteringConfig{Store: store, Currency: "USD"})
+		},
+		"metering inside": func(store MeteringStore) http.Handler {
+			return UnifiedPaymentMiddleware(MeteringMiddleware(createTestHandler(), MeteringConfig{Store: store, Currency: "USD"}), config)
+		},
+	}
+	for name, compose := range compositions {
+		t.Run(name, func(t *testing.T) {
+			store := NewInMemoryMeteringStore(10, "USD")
+			handler := compose(store)
+			for _, header := range []string{"X-STRIPE-PAYMENT-INTENT", "X-STRIPE-PAYMENT-INTENT", "X-PAYMENT"} {
+				req := httptest.NewRequest("GET", "/api/data", nil)
+				req.Header.Set(header, "proof")
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					t.Fatalf("Expected the payment to succeed, got %d: %s", w.Code, w.Body.String())
+				}
+			}
+
+			report, _ := store.GetMetrics(MetricsFilter{})
+			if report.TotalRevenue != 3000 || report.TotalFees != 118 || report.NetRevenue != 2882 {
+				t.Errorf("Expected 3000 gross, 118 fees, 2882 net, got %d, %d, %d", report.TotalRevenue, report.TotalFees, report.NetRevenue)
+			}
+			stripe, crypto := report.ByRail[RailStripe], report.ByRail[RailEVMCrypto]
+			if stripe == nil || stripe.Requests != 2 || stripe.Fees != 118 || stripe.NetRevenue != 1882 {
+				t.Errorf("Unexpected stripe breakdown %+v", stripe)
+			}
+			if crypto == nil || crypto.Requests != 1 || crypto.Fees != 0 || crypto.NetRevenue != 1000 {
+				t.Errorf("Unexpected crypto breakdown %+v", crypto)
+			}
+			if m := store.metrics[0]; m.TransactionID != "tx_stripe" || m.Rail != RailStripe || m.FeeAmount != 59 {
+				t.Errorf("Expected the stripe settlement on the metric, got %+v", m)
+			}
+		})
+	}
+}
+
+// networkRail is a feeRail whose crypto payments are on the network their
+// proof names
+type networkRail struct {
+	feeRail
+}
+
+func (n *networkRail) VerifyPayment(ctx context.Context, req *VerifyPaymentRequest) (*PaymentVerification, error) {
+	verification, _ := n.feeRail.VerifyPayment(ctx, req)
+	if n.Type() == RailTypeCrypto {
+		verification.Network = req.PaymentPayload
+	}
+	return verification, nil
+}
+
+func TestMetricsReport_RevenueByRailAndNetwork(t *testing.T) {
+	registry := NewRailRegistry()
+	registry.Register(&networkRail{feeRail{NewStripeRail("sk_test", "")}})
+	registry.Register(&networkRail{feeRail{NewEVMCryptoRail("", nil)}})
+	config := UnifiedPaymentConfig{
+		Currency:      "USD",
+		PriceByRail:   map[string]int64{RailStripe: 1000, RailEVMCrypto: 1000},
+		CryptoEnabled: true,
+		FiatEnabled:   true,
+		RailRegistry:  registry,
+	}
+	store := NewInMemoryMeteringStore(100, "USD")
+	handler := MeteringMiddleware(UnifiedPaymentMiddleware(createTestHandler(), config), MeteringConfig{Store: store, Currency: "USD"})
+
+	payments := []struct{ header, proof string }{
+		{"X-STRIPE-PAYMENT-INTENT", "pi_1"},
+		{"X-STRIPE-PAYMENT-INTENT", "pi_2"},
+		{"X-PAYMENT", "base"},
+		{"X-PAYMENT", "base"},
+		{"X-PAYMENT", "base-sepolia"},
+	}
+	for _, p := range payments {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set(p.header, p.proof)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the payment to succeed, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	// Metered without a payment middleware
+	store.RecordRequest(UsageMetric{Timestamp: time.Now(), Endpoint: "/api/legacy", AmountPaid: 500, ResponseCode: 200})
+
+	report, _ := store.GetMetrics(MetricsFilter{})
+	if report.TotalRevenue != 5500 {
+		t.Fatalf("Expected 5500 revenue, got %d", report.TotalRevenue)
+	}
+	wantRails := map[string]int64{RailStripe: 2000, RailEVMCrypto: 3000, RevenueUnattributed: 500}
+	wantNetworks := map[string]int64{"base": 2000, "base-sepolia": 1000, RevenueUnattributed: 2500}
+	for name, split := range map[string][2]map[string]int64{"rail": {report.RevenueByRail, wantRails}, "network": {report.RevenueByNetwork, wantNetworks}} {
+		got, want := split[0], split[1]
+		var sum int64
+		for key, revenue := range got {
+			sum += revenue
+			if want[key] != revenue {
+				t.Errorf("By %s: expected %s to have %d, got %d", name, key, want[key], revenue)
+			}
+		}
+		if sum != report.TotalRevenue || len(got) != len(want) {
+			t.Errorf("By %s: expected %v summing to %d, got %v", name, want, report.TotalRevenue, got)
+		}
+	}
+
+	filters := []struct {
+		filter MetricsFilter
+		want   int64
+	}{
+		{MetricsFilter{Rail: RailEVMCrypto}, 3000},
+		{MetricsFilter{Rail: RailStripe}, 2000},
+		{MetricsFilter{Network: "eip155:84532"}, 1000},
+		{MetricsFilter{Rail: RailEVMCrypto, Network: "base"}, 2000},
+	}
+	for _, tt := range filters {
+		if report, _ := store.GetMetrics(tt.filter); report.TotalRevenue != tt.want {
+			t.Errorf("%+v: expected %d revenue, got %d", tt.filter, tt.want, report.TotalRevenue)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	MetricsHandler(store).ServeHTTP(w, httptest.NewRequest("GET", "/metrics?rail=evm-crypto&network=base-sepolia", nil))
+	json.NewDecoder(w.Body).Decode(&report)
+	if report.TotalRevenue != 1000 || report.RevenueByNetwork["base-sepolia"] != 1000 {
+		t.Errorf("Expected the handler to filter by rail and network, got %d %v", report.TotalRevenue, report.RevenueByNetwork)
+	}
+}
@@ -0,0 +1,104 @@
+// Package x402 - Method Pricing
+// A REST resource is often free to read and paid to change: GET /api/items
+// costs nothing while POST /api/items costs 500. MethodPricing prices each
+// HTTP method per path prefix, with HEAD priced like GET unless set itself.
+package x402
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// MethodPricingRule prices HTTP methods on paths starting with Path
+type MethodPricingRule struct {
+	// Path matches by prefix like ExemptPaths; "" matches every path
+	Path string
+
+	// Prices by method, in PricePerRequest units. Methods not listed keep
+	// the config's price.
+	Prices map[string]int64
+
+	// FreeMethods are served without payment
+	FreeMethods []string
+}
+
+// MethodPricing prices requests by method. The rule with the longest
+// matching Path applies.
+type MethodPricing []MethodPricingRule
+
+// Validate reports negative prices
+func (m MethodPricing) Validate() error {
+	for _, rule := range m {
+		for method, price := range rule.Prices {
+			if price < 0 {
+				return fmt.Errorf("x402: method price for %s %s must not be negative", method, rule.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// Price returns the price of method on path given the config's base price
+func (m MethodPricing) Price(method, path string, base int64) int64 {
+	rule := m.rule(path)
+	if rule == nil {
+		return base
+	}
+	method = strings.ToUpper(method)
+	if price, ok := rule.price(method); ok {
+		return price
+	}
+	// HEAD is a GET without the body, so it costs the same
+	if method == http.MethodHead {
+		if price, ok := rule.price(http.MethodGet); ok {
+			return price
+		}
+	}
+	return base
+}
+
+// free reports whether r's method is served without payment
+func (m MethodPricing) free(r *http.Request) bool {
+	return len(m) > 0 && m.Price(r.Method, r.URL.Path, -1) == 0
+}
+
+// hasPrices reports whether any rule sets a non-free price
+func (m MethodPricing) hasPrices() bool {
+	for _, rule := range m {
+		if len(rule.Prices) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// rule returns the rule with the longest Path prefixing path
+func (m MethodPricing) rule(path string) *MethodPricingRule {
+	var best *MethodPricingRule
+	for i := range m {
+		rule := &m[i]
+		if !strings.HasPrefix(path, rule.Path) {
+			continue
+		}
+		if best == nil || len(rule.Path) > len(best.Path) {
+			best = rule
+		}
+	}
+	return best
+}
+
+// price returns the rule's own price for method
+func (r *MethodPricingRule) price(method string) (int64, bool) {
+	for _, free := range r.FreeMethods {
+		if strings.EqualFold(free, method) {
+			return 0, true
+		}
+	}
+	for m, price := range r.Prices {
+		if strings.EqualFold(m, method) {
+			return price, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,125 @@
+package x402
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// itemsPricing makes reads of /api/items free and creating items cost 500
+var itemsPricing = MethodPricing{{
+	Path:        "/api/items",
+	Prices:      map[string]int64{"POST": 500},
+	FreeMethods: []string{"GET"},
+}}
+
+func TestMethodPricing_Price(t *testing.T) {
+	pricing := append(MethodPricing{{Path: "/api/items/archive", Prices: map[string]int64{"GET": 50}}}, itemsPricing...)
+
+	tests := []struct {
+		method, path string
+		want         int64
+	}{
+		{"GET", "/api/items", 0},
+		{"HEAD", "/api/items", 0},
+		{"post", "/api/items", 500},
+		{"DELETE", "/api/items/1", 100},
+		{"GET", "/api/items/archive", 50},
+		{"HEAD", "/api/items/archive", 50},
+		{"GET", "/api/other", 100},
+	}
+	for _, tt := range tests {
+		if got := pricing.Price(tt.method, tt.path, 100); got != tt.want {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestMiddleware_MethodPricing(t *testing.T) {
+	config := testConfig()
+	config.MethodPricing = itemsPricing
+	handler := Middleware(createTestHandler(), config)
+
+	for _, method := range []string{"GET", "HEAD"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/api/items", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected free %s, got %d", method, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/items", nil))
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402 for POST, got %d", w.Code)
+	}
+	if amount := decodePaymentRequired(t, w).Accepts[0].MaxAmountRequired; amount != "500" {
+		t.Errorf("Expected POST price 500, got %s", amount)
+	}
+}
+
+func TestMultiSchemeMiddleware_MethodPricing(t *testing.T) {
+	handler := MultiSchemeMiddleware(createTestHandler(), MultiSchemeConfig{
+		Config:         Config{PricePerRequest: 100, PayTo: "0xseller", Network: "base-sepolia", MethodPricing: itemsPricing},
+		SchemeRegistry: NewSchemeRegistry(),
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("HEAD", "/api/items", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected free HEAD, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/items", nil))
+	if amount := decodePaymentRequired(t, w).Accepts[0].MaxAmountRequired; amount != "500" {
+		t.Errorf("Expected POST price 500, got %s", amount)
+	}
+}
+
+func TestUnifiedMiddleware_MethodPricing(t *testing.T) {
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		PricePerRequest: 100,
+		CryptoEnabled:   true,
+		CryptoNetworks:  []NetworkType{NetworkBaseSepolia},
+		MethodPricing:   itemsPricing,
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/items", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected free GET, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/items", nil))
+	if amount := decodePaymentRequired(t, w).Accepts[0].MaxAmountRequired; amount != "500" {
+		t.Errorf("Expected POST price 500, got %s", amount)
+	}
+}
+
+func TestUnifiedConfig_MethodPricesNeedPricePerRequest(t *testing.T) {
+	config := UnifiedPaymentConfig{Price: "0.01", CryptoEnabled: true, MethodPricing: itemsPricing}
+	if err := config.Validate(); err == nil {
+		t.Error("Expected MethodPricing prices with Price to be rejected")
+	}
+
+	config.MethodPricing = MethodPricing{{Path: "/api/items", FreeMethods: []string{"GET"}}}
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected free methods to combine with Price, got %v", err)
+	}
+}
+
+func TestGetCostForPath_Methods(t *testing.T) {
+	endpoints := []APIEndpoint{{Path: "/api/items", Method: "GET", Cost: 10}}
+
+	if cost := getCostForPath("/api/items", "HEAD", endpoints, nil, 99); cost != 10 {
+		t.Errorf("Expected HEAD to cost like GET, got %d", cost)
+	}
+	if cost := getCostForPath("/api/items", "GET", endpoints, itemsPricing, 99); cost != 0 {
+		t.Errorf("Expected free GET, got %d", cost)
+	}
+	if cost := getCostForPath("/api/items", "POST", endpoints, itemsPricing, 99); cost != 500 {
+		t.Errorf("Expected POST to cost 500, got %d", cost)
+	}
+}
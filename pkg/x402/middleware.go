@@ -4,10 +4,14 @@
 package x402
 
 import (
-	"encoding/base64"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -28,12 +32,25 @@ type Config struct {
 	// AcceptedMethods lists the accepted authentication methods (e.g., "Bearer", "Token", "X402")
 	AcceptedMethods []string
 
-	// PricePerRequest is the price per request in the smallest currency unit (e.g., 1000 = $0.001 USDC)
+	// PricePerRequest is the price per request in the smallest currency unit (e.g., 1000 = $0.001 USDC).
+	// Zero makes resources free with attribution (see AllowAnonymousFree).
 	PricePerRequest int64
 
+	// AllowAnonymousFree serves zero-priced requests that don't say who is
+	// calling, instead of answering them with a 402
+	AllowAnonymousFree bool
+
 	// ExemptPaths lists paths that don't require payment
 	ExemptPaths []string
 
+	// ExemptCIDRs lets internal callers whose client IP is in one of these
+	// networks through without payment (metered as "exempt-internal")
+	ExemptCIDRs []string
+
+	// TrustedProxies are networks whose X-Forwarded-For headers are believed
+	// when finding the client IP for ExemptCIDRs (see ParseTrustedProxies)
+	TrustedProxies []*net.IPNet
+
 	// Currency is the currency code (e.g., "USD", "USDC")
 	Currency string
 
@@ -49,11 +66,130 @@ type Config struct {
 	// Description describes what the payment is for
 	Description string
 
-	// MaxTimeoutSeconds is the maximum time for payment verification
+	// ResourceDescriptor sets the mimeType and outputSchema advertised in
+	// 402s for each request (see DescribeEndpoints)
+	ResourceDescriptor ResourceDescriptor
+
+	// MaxTimeoutSeconds is how long a quoted price is valid (default 60).
+	// Payments presented after the quote's deadline are refused.
 	MaxTimeoutSeconds int
 
-	// PaymentVerifier is an optional custom payment verification function
+	// Realm is the WWW-Authenticate realm on 402 responses (default "x402")
+	Realm string
+
+	// Protocol names the headers payments are read from and requirements
+	// written to (ProtocolV1, ProtocolV2, ProtocolLegacy or custom). Nil
+	// accepts all of them and emits PAYMENT-REQUIRED and the JSON body.
+	Protocol *ProtocolProfile
+
+	// DiscoverySigner, if set, signs 402 requirements in
+	// X-Discovery-Signature (see WellKnownHandler for the public keys)
+	DiscoverySigner *DiscoverySigner
+
+	// BodyProof, if set, also reads payment proofs from a field of JSON
+	// request bodies, for clients that can't set headers
+	BodyProof *BodyProof
+
+	// MaxProofBytes is the largest payment proof decoded (default
+	// DefaultMaxProofBytes). Larger proofs, and proofs that can't be
+	// decoded, are answered with a 400 MALFORMED_PROOF.
+	MaxProofBytes int
+
+	// ReceiptCookies, if set, gives browsers that pay a signed receipt
+	// cookie and serves later requests carrying one without a new payment
+	ReceiptCookies *ReceiptCookies
+
+	// AllowQueryToken accepts the payment_token query parameter where the
+	// protocol profile allows it. Off by default: URLs end up in access logs,
+	// browser history and Referer headers. When a query token is accepted the
+	// parameter is removed before the request reaches next.
+	AllowQueryToken bool
+
+	// PaymentVerifier verifies payment tokens. It is required unless
+	// TestMode is set.
 	PaymentVerifier func(token string) (bool, error)
+
+	// TestMode accepts any token starting with "valid_" when no
+	// PaymentVerifier is set. Never enable it in production.
+	TestMode bool
+
+	// VerificationTimeout bounds each payment verification (default 5s,
+	// capped by MaxTimeoutSeconds)
+	VerificationTimeout time.Duration
+
+	// FailMode decides what happens when verification times out: FailClosed
+	// (default) answers 402, FailOpen serves the request unpaid
+	FailMode string
+
+	// MaxRequestBodyBytes rejects larger request bodies with 413 before
+	// payment is verified (0 = unlimited)
+	MaxRequestBodyBytes int64
+
+	// MaxResponseBodyBytes caps the response body written by next (0 = unlimited)
+	MaxResponseBodyBytes int64
+
+	// OnBodyLimitExceeded is called when either body limit is hit
+	OnBodyLimitExceeded func(event BodyLimitEvent)
+
+	// Ledger, if set, records every verified payment
+	Ledger PaymentLedger
+
+	// DynamicExemptions are path exemptions that can change at runtime
+	// (e.g. via AdminHandler's POST /admin/exempt)
+	DynamicExemptions *ExemptionList
+
+	// Coupons, if set, discounts requests carrying a valid X-Coupon-Code
+	// header or coupon query parameter
+	Coupons CouponStore
+
+	// TieredPricing, if set, replaces PricePerRequest with the payer's volume
+	// tier and reports it in X-Current-Tier
+	TieredPricing *TieredPricing
+
+	// MethodPricing, if set, prices requests by HTTP method, replacing
+	// PricePerRequest; free methods skip payment entirely
+	MethodPricing MethodPricing
+
+	// PayerHeaders names the request headers that tell next who paid, and
+	// optionally signs them (see VerifyGatewayClaims)
+	PayerHeaders PayerHeaders
+
+	// Audit, if set, records every payment decision
+	Audit *AuditLog
+
+	// TaskSpend, if set, totals paid requests per X-Agent-Task-ID and
+	// returns the running total in X-Task-Spent
+	TaskSpend TaskSpendStore
+
+	// Quotes, if set, honors the price of a signed quote sent in
+	// X-Price-Quote (see QuoteHandler) when it is below the current price
+	Quotes *QuoteSigner
+
+	// Extensions are advertised in every 402, along with those of the
+	// session and agent middlewares around this one (see PaymentExtensions)
+	Extensions *PaymentExtensions
+
+	// AgentDetector decides which requests come from AI agents (default:
+	// User-Agent patterns and X-AI-Agent / X-Agent-* headers)
+	AgentDetector AgentDetector
+
+	// PaymentRequiredFormat picks the 402 body: FormatAuto (default) sends
+	// agents an AIResponse and everyone else a PaymentRequiredResponse
+	PaymentRequiredFormat string
+
+	// now is stubbed in tests
+	now func() time.Time
+}
+
+func (c Config) verificationTimeout() time.Duration {
+	return railTimeout(c.VerificationTimeout, DefaultVerificationTimeout, c.MaxTimeoutSeconds)
+}
+
+func (c Config) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
 }
 
 // PaymentRequirements defines the x402 payment requirements structure
@@ -69,6 +205,7 @@ type PaymentRequirements struct {
 	Asset             string                 `json:"asset,omitempty"`
 	OutputSchema      interface{}            `json:"outputSchema"`
 	Extra             map[string]interface{} `json:"extra,omitempty"`
+	ExpiresAt         int64                  `json:"expiresAt,omitempty"` // Unix time the quote expires
 }
 
 // PaymentRequiredResponse is the x402 402 response body
@@ -76,6 +213,28 @@ type PaymentRequiredResponse struct {
 	X402Version int                   `json:"x402Version"`
 	Accepts     []PaymentRequirements `json:"accepts"`
 	Error       string                `json:"error,omitempty"`
+	Code        string                `json:"code,omitempty"`       // e.g. EXPIRED_PAYMENT for a refused proof
+	ValidUntil  int64                 `json:"validUntil,omitempty"` // Unix time the quote expires
+
+	// RequirementsHash identifies the offer in Accepts, ignoring expiry, so
+	// clients can use it as a cache key
+	RequirementsHash string `json:"requirementsHash,omitempty"`
+}
+
+// requirementsHash returns a hex SHA-256 of accepts with their expiry cleared.
+// It changes only when the price, payee or accepted schemes/networks do.
+func requirementsHash(accepts []PaymentRequirements) string {
+	stable := make([]PaymentRequirements, len(accepts))
+	for i, req := range accepts {
+		req.ExpiresAt = 0
+		stable[i] = req
+	}
+	data, err := json.Marshal(stable)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
 
 // PaymentInfo contains legacy payment info (for backward compatibility)
@@ -86,44 +245,260 @@ type PaymentInfo struct {
 	Description string `json:"description"`
 }
 
-// Middleware creates a middleware that implements HTTP 402 Payment Required
+// Validate reports configuration errors. A PaymentVerifier is required unless
+// TestMode is set, so test tokens are never accepted by accident.
+func (c Config) Validate() error {
+	if c.PaymentVerifier == nil && !c.TestMode {
+		return fmt.Errorf("x402: PaymentVerifier is required unless TestMode is set")
+	}
+	if err := c.MethodPricing.Validate(); err != nil {
+		return err
+	}
+	if err := validateFailMode(c.FailMode); err != nil {
+		return err
+	}
+	if _, err := parseExemptCIDRs(c.ExemptCIDRs); err != nil {
+		return fmt.Errorf("x402: %w", err)
+	}
+	if err := c.Protocol.Validate(); err != nil {
+		return err
+	}
+	if err := c.ReceiptCookies.Validate(); err != nil {
+		return err
+	}
+	return c.TieredPricing.Validate()
+}
+
+// Middleware creates a middleware that implements HTTP 402 Payment Required.
+// It panics if config.Validate fails.
 func Middleware(next http.Handler, config Config) http.Handler {
 	// Set default currency if not provided
 	if config.Currency == "" {
 		config.Currency = "USD"
 	}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if err := config.Validate(); err != nil {
+		panic(err)
+	}
+	internal, _ := parseExemptCIDRs(config.ExemptCIDRs)
+	if config.AllowQueryToken {
+		next = withoutQueryToken(next)
+	}
+	guard := &composition{name: "Middleware"}
+	next = decided(next, guard.name)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An x402 middleware outside this one already handled payment
+		if guard.passThrough(w, r, next) {
+			return
+		}
+
+		// Only the middleware says who paid
+		config.PayerHeaders.strip(r)
+
 		// Check if path is exempt from payment
-		if isExemptPath(r.URL.Path, config.ExemptPaths) {
+		if reason := exemption(r, config.ExemptPaths, config.DynamicExemptions, config.MethodPricing); reason != "" {
+			config.Audit.Record(r, AuditEvent{Decision: AuditExempt, Reason: reason})
+			next.ServeHTTP(w, reportExempt(r))
+			return
+		}
+
+		// So are internal callers
+		if serveInternal(w, r, internal, config.TrustedProxies, config.Audit, next) {
+			return
+		}
+		r = config.BodyProof.read(r)
+
+		// A browser that already paid shows its receipt
+		if config.ReceiptCookies.serve(w, r, config.PayerHeaders, config.Audit, next) {
+			return
+		}
+
+		// The method, payer's tier, any quote and any coupon price this request on a per-request copy
+		config := config
+		config.PricePerRequest = scalePrice(r, config.MethodPricing.Price(r.Method, r.URL.Path, config.PricePerRequest))
+		currentPrice, payer := applyTier(w, r, config.TieredPricing, config.PricePerRequest)
+		config.PricePerRequest = currentPrice
+
+		// Zero-priced resources only ask who is calling; a quote never
+		// makes a resource zero-priced
+		if config.PricePerRequest == 0 {
+			if !serveAttributed(w, r, config, next) {
+				sendPaymentRequired(w, config, r, nil, attributionRequired)
+			}
+			return
+		}
+		listPrice, quote, quoteErr := config.Quotes.price(r, config.Currency, currentPrice)
+		config.PricePerRequest = listPrice
+
+		coupon, couponErr := requestCoupon(config.Coupons, r)
+		message := ""
+		if quoteErr != nil {
+			message = quoteMessage(quoteErr)
+		}
+		if couponErr != nil {
+			message = couponMessage(couponErr)
+		}
+		if coupon != nil {
+			config.PricePerRequest = coupon.Discount(config.PricePerRequest, currencyDecimals(config.Currency))
+		}
+
+		// A coupon covering the whole price skips payment
+		if coupon != nil && config.PricePerRequest == 0 {
+			if err := config.Quotes.claim(quote); err != nil {
+				config.PricePerRequest = currentPrice
+				sendPaymentRequired(w, config, r, nil, quoteMessage(err))
+				return
+			}
+			if _, err := config.Coupons.Redeem(coupon.Code, r.URL.Path); err != nil {
+				config.Quotes.release(quote)
+				config.PricePerRequest = listPrice
+				sendPaymentRequired(w, config, r, nil, couponMessage(err))
+				return
+			}
+			config.Audit.Record(r, AuditEvent{Decision: AuditFree, Reason: PaymentMethodCoupon, Metadata: couponMetadata(coupon)})
+			w.Header().Set("X-Payment-Verified", "true")
+			w.Header().Set("X-Payment-Method", PaymentMethodCoupon)
+			r = recordPayment(config, r, PaymentMethodCoupon, "", coupon)
+			config.TieredPricing.record(payer, 0)
 			next.ServeHTTP(w, r)
 			return
 		}
 
 		// Extract payment token from request
-		token := extractPaymentToken(r, config.AcceptedMethods)
+		token := extractPaymentToken(r, config)
 
 		if token == "" {
 			// No payment token provided, return 402
-			sendPaymentRequired(w, config, r)
+			sendPaymentRequired(w, config, r, nil, message)
+			return
+		}
+		if err := checkProofSize(token, config.MaxProofBytes); err != nil {
+			config.Audit.recordFailure(r, &PaymentFailure{Rail: config.Scheme, Stage: StageExtract, Reason: FailureMalformedProof, Err: err}, "")
+			sendMalformedProof(w, err, config.MaxProofBytes)
+			return
+		}
+
+		// Payments presented after the quote's deadline must be re-quoted
+		if paymentExpired(proofDeadline(token, config.MaxTimeoutSeconds), config.clock()) {
+			sendPaymentRequired(w, config, r, &PaymentFailure{Rail: config.Scheme, Stage: StageVerify, Reason: FailureExpired}, "")
 			return
 		}
 
 		// Verify payment token
-		valid, err := verifyPaymentToken(token, config)
+		valid, err := callWithTimeout(r.Context(), config.verificationTimeout(), func(ctx context.Context) (bool, error) {
+			return verifyPaymentToken(token, config)
+		})
+		if isTimeout(err) {
+			if config.FailMode == FailOpen {
+				config.Audit.Record(r, AuditEvent{Decision: AuditFailOpen, Reason: FailureTimeout, Rail: config.Scheme, PayloadHash: hashPayload(token)})
+				_ = config.Quotes.claim(quote)
+				next.ServeHTTP(w, r)
+				return
+			}
+			sendPaymentRequired(w, config, r, &PaymentFailure{Rail: config.Scheme, Stage: StageVerify, Reason: FailureTimeout, Err: err}, "")
+			return
+		}
 		if err != nil || !valid {
 			// Invalid or expired payment token
-			sendPaymentRequired(w, config, r)
+			reason := FailureInvalidPayment
+			if err != nil {
+				reason = FailureRailError
+			}
+			config.Audit.recordFailure(r, &PaymentFailure{Rail: config.Scheme, Stage: StageVerify, Reason: reason, ExpectedAmount: config.PricePerRequest}, token)
+			sendPaymentRequired(w, config, r, nil, message)
+			return
+		}
+
+		// Count the quote and coupon only once the request is paid for
+		if err := config.Quotes.claim(quote); err != nil {
+			config.PricePerRequest = currentPrice
+			sendPaymentRequired(w, config, r, nil, quoteMessage(err))
 			return
 		}
+		if coupon != nil {
+			if _, err := config.Coupons.Redeem(coupon.Code, r.URL.Path); err != nil {
+				config.Quotes.release(quote)
+				config.PricePerRequest = listPrice
+				sendPaymentRequired(w, config, r, nil, couponMessage(err))
+				return
+			}
+		}
 
 		// Payment verified, allow access
 		// Add payment metadata to response headers
 		w.Header().Set("X-Payment-Verified", "true")
 		w.Header().Set("X-Payment-Timestamp", time.Now().Format(time.RFC3339))
 
+		r = recordPayment(config, r, config.Scheme, "", coupon)
+		config.TieredPricing.record(payer, config.PricePerRequest)
+
+		// Tell next who paid; tokens that are x402 payloads name the payer
+		claims := GatewayClaims{Rail: config.Scheme, Amount: config.PricePerRequest, Resource: redactedRequestURI(r.URL), Timestamp: config.clock().Unix()}
+		if payload, err := parsePaymentPayload(token, config.MaxProofBytes); err == nil {
+			claims.Payer = payload.Payer
+		}
+		config.PayerHeaders.set(r, claims)
+		info, _ := PaymentInfoFromRequest(r)
+		config.ReceiptCookies.issue(w, r, config.Scheme, claims.Payer, info.PaymentID)
+		config.Audit.Record(r, AuditEvent{
+			Decision:       AuditVerified,
+			Rail:           config.Scheme,
+			Payer:          claims.Payer,
+			RequiredAmount: config.PricePerRequest,
+			Currency:       config.Currency,
+			PayloadHash:    hashPayload(token),
+			Metadata:       couponMetadata(coupon),
+		})
+		recordTaskSpend(config.TaskSpend, w, r, config.PricePerRequest, config.Currency)
+
 		next.ServeHTTP(w, r)
 	})
+
+	// Size limits wrap payment so oversized requests are never charged
+	return BodyLimitMiddleware(handler, BodyLimits{
+		MaxRequestBodyBytes:  config.MaxRequestBodyBytes,
+		MaxResponseBodyBytes: config.MaxResponseBodyBytes,
+		OnLimitExceeded:      config.OnBodyLimitExceeded,
+	})
+}
+
+// recordPayment adds a granted request to config.Ledger, if set, and
+// reports it paid for metering, linked to its ledger record. payer is who
+// the payment names, if known.
+func recordPayment(config Config, r *http.Request, scheme, payer string, coupon *Coupon) *http.Request {
+	info := RequestPaymentInfo{
+		Paid:     true,
+		Payer:    payer,
+		Rail:     scheme,
+		Network:  config.Network,
+		Gross:    config.PricePerRequest,
+		Net:      config.PricePerRequest,
+		Currency: config.Currency,
+	}
+	if scheme == PaymentMethodCoupon {
+		info.Type = PaymentMethodCoupon
+	}
+	if payer == "" {
+		payer = extractPayerID(r)
+	}
+	if config.Ledger != nil {
+		record, err := config.Ledger.Record(PaymentRecord{
+			Endpoint: r.URL.Path,
+			Method:   r.Method,
+			PayerID:  payer,
+			Amount:   config.PricePerRequest,
+			Currency: config.Currency,
+			Scheme:   scheme,
+			Network:  config.Network,
+			Status:   PaymentStatusVerified,
+			Metadata: couponMetadata(coupon),
+		})
+		if err == nil {
+			info.PaymentID = record.ID
+		}
+	}
+	return reportPayment(r, info)
 }
 
 // isExemptPath checks if the requested path is exempt from payment.
@@ -140,38 +515,11 @@ func isExemptPath(path string, exemptPaths []string) bool {
 	return false
 }
 
-// extractPaymentToken extracts the payment token from the request
-// Supports x402 protocol headers (X-PAYMENT, PAYMENT-SIGNATURE) and legacy methods
-func extractPaymentToken(r *http.Request, acceptedMethods []string) string {
-	// x402 v2: Check PAYMENT-SIGNATURE header first
-	if paymentSig := r.Header.Get("PAYMENT-SIGNATURE"); paymentSig != "" {
-		return paymentSig
-	}
-
-	// x402 v1: Check X-PAYMENT header (base64-encoded payment payload)
-	if xPayment := r.Header.Get("X-PAYMENT"); xPayment != "" {
-		return xPayment
-	}
-
-	// Legacy: Check Authorization header
-	authHeader := r.Header.Get("Authorization")
-	if authHeader != "" {
-		for _, method := range acceptedMethods {
-			prefix := method + " "
-			if strings.HasPrefix(authHeader, prefix) {
-				return strings.TrimPrefix(authHeader, prefix)
-			}
-		}
-	}
-
-	// Legacy: Check X-Payment-Token header
-	paymentToken := r.Header.Get("X-Payment-Token")
-	if paymentToken != "" {
-		return paymentToken
-	}
-
-	// Legacy: Check query parameter
-	return r.URL.Query().Get("payment_token")
+// extractPaymentToken extracts the payment token from the request: x402
+// protocol headers (PAYMENT-SIGNATURE, X-PAYMENT) and legacy methods, or
+// those config.Protocol names if it is set
+func extractPaymentToken(r *http.Request, config Config) string {
+	return config.Protocol.token(r, config.AcceptedMethods, config.AllowQueryToken)
 }
 
 // verifyPaymentToken verifies the payment token
@@ -181,21 +529,21 @@ func verifyPaymentToken(token string, config Config) (bool, error) {
 		return config.PaymentVerifier(token)
 	}
 
-	// Default: accept tokens that start with "valid_" (for testing)
-	if strings.HasPrefix(token, "valid_") {
+	// Test mode only: accept tokens that start with "valid_"
+	if config.TestMode && strings.HasPrefix(token, "valid_") {
 		return true, nil
 	}
 
 	return false, nil
 }
 
-// sendPaymentRequired sends a 402 Payment Required response compliant with x402 protocol
-func sendPaymentRequired(w http.ResponseWriter, config Config, r *http.Request) {
+// sendPaymentRequired sends a 402 Payment Required response compliant with x402 protocol.
+// If a presented payment was refused, failure explains why in the error and
+// code; otherwise message, if set, replaces the default error (e.g. to
+// explain a refused coupon).
+func sendPaymentRequired(w http.ResponseWriter, config Config, r *http.Request, failure *PaymentFailure, message string) {
 	// Build resource URL
-	resource := r.URL.Path
-	if r.URL.RawQuery != "" {
-		resource += "?" + r.URL.RawQuery
-	}
+	resource := requestResource(r.URL)
 
 	// Set defaults
 	scheme := config.Scheme
@@ -206,13 +554,11 @@ func sendPaymentRequired(w http.ResponseWriter, config Config, r *http.Request)
 	if network == "" {
 		network = "base-sepolia"
 	}
-	maxTimeout := config.MaxTimeoutSeconds
-	if maxTimeout == 0 {
-		maxTimeout = 60
-	}
+	maxTimeout := maxTimeoutOrDefault(config.MaxTimeoutSeconds)
+	validUntil := paymentDeadline(config.clock(), maxTimeout).Unix()
 	description := config.Description
 	if description == "" {
-		description = fmt.Sprintf("Payment of %d %s required", config.PricePerRequest, config.Currency)
+		description = priceDescription(config.PricePerRequest, config.Currency)
 	}
 
 	// Build x402 PaymentRequirements
@@ -226,26 +572,35 @@ func sendPaymentRequired(w http.ResponseWriter, config Config, r *http.Request)
 		MaxTimeoutSeconds: maxTimeout,
 		Asset:             config.Asset,
 		OutputSchema:      nil,
+		ExpiresAt:         validUntil,
 	}
+	accepts := []PaymentRequirements{requirements}
+	config.ResourceDescriptor.describe(r, accepts)
+	extensionsFor(r, config.Extensions).apply(accepts)
 
 	// Build x402 response
 	response := PaymentRequiredResponse{
-		X402Version: X402Version,
-		Accepts:     []PaymentRequirements{requirements},
-		Error:       "X-PAYMENT header is required",
+		X402Version:      X402Version,
+		Accepts:          accepts,
+		Error:            config.Protocol.missingProof(),
+		ValidUntil:       validUntil,
+		RequirementsHash: requirementsHash(accepts),
+	}
+	if failure != nil {
+		message = failure.PublicMessage()
+		response.Code = failure.ErrorCode()
+	}
+	if message != "" {
+		response.Error = message
 	}
 
-	// Encode response as base64 for PAYMENT-REQUIRED header (v2 protocol)
-	responseJSON, _ := json.Marshal(response)
-	paymentRequiredHeader := base64.StdEncoding.EncodeToString(responseJSON)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("PAYMENT-REQUIRED", paymentRequiredHeader) // x402 v2 header
-
-	w.WriteHeader(http.StatusPaymentRequired) // 402
-
-	// Write JSON body (x402 v1 style, also useful for debugging)
-	_ = json.NewEncoder(w).Encode(response)
+	config.Audit.recordPaymentRequired(r, failure, extractPaymentToken(r, config), AuditEvent{RequiredAmount: config.PricePerRequest, Currency: config.Currency})
+	config.DiscoverySigner.sign(w, response)
+	if config.agentFormat(r) {
+		config.Protocol.writePaymentRequiredBody(w, config.Realm, requirementSchemes(response.Accepts), response, config.agentPaymentRequired(r, response))
+		return
+	}
+	config.Protocol.writePaymentRequired(w, config.Realm, requirementSchemes(response.Accepts), response)
 }
 
 // MultiSchemeMiddleware creates a middleware that accepts multiple payment schemes
@@ -258,30 +613,161 @@ func MultiSchemeMiddleware(next http.Handler, config MultiSchemeConfig) http.Han
 
 	registry := config.SchemeRegistry
 	if registry == nil {
-		registry = DefaultRegistry
+		registry = NewDefaultSchemeRegistry()
+	}
+
+	if err := config.TieredPricing.Validate(); err != nil {
+		panic(err)
+	}
+	if err := config.MethodPricing.Validate(); err != nil {
+		panic(err)
+	}
+	if err := validateFailMode(config.FailMode); err != nil {
+		panic(err)
+	}
+	if err := config.Callbacks.Validate(); err != nil {
+		panic(err)
+	}
+	if err := config.Protocol.Validate(); err != nil {
+		panic(err)
+	}
+	if err := validateAcceptedAssets(config.AcceptedAssets); err != nil {
+		panic(err)
+	}
+	internal, err := parseExemptCIDRs(config.ExemptCIDRs)
+	if err != nil {
+		panic(fmt.Errorf("x402: %w", err))
+	}
+	if config.AllowQueryToken {
+		next = withoutQueryToken(next)
+	}
+	guard := &composition{name: "MultiSchemeMiddleware"}
+	next = decided(next, guard.name)
+
+	// fail reports a refused payment and answers with a 402 explaining it
+	fail := func(w http.ResponseWriter, r *http.Request, config MultiSchemeConfig, failure *PaymentFailure) {
+		failure.ExpectedAmount = config.PricePerRequest
+		reportFailure(config.Callbacks, config.OnPaymentFailure, r, failure)
+		if failure.Reason == FailureMalformedProof {
+			config.Audit.recordFailure(r, failure, "")
+			sendMalformedProof(w, failure.Err, config.MaxProofBytes)
+			return
+		}
+		sendMultiSchemePaymentRequired(w, config, r, failure, "")
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check if path is exempt from payment
-		if isExemptPath(r.URL.Path, config.ExemptPaths) {
+		// An x402 middleware outside this one already handled payment
+		if guard.passThrough(w, r, next) {
+			return
+		}
+
+		// Only the middleware says who paid
+		config.PayerHeaders.strip(r)
+
+		// Check if path or method is exempt from payment
+		if reason := exemption(r, config.ExemptPaths, config.DynamicExemptions, config.MethodPricing); reason != "" {
+			config.Audit.Record(r, AuditEvent{Decision: AuditExempt, Reason: reason})
+			next.ServeHTTP(w, reportExempt(r))
+			return
+		}
+
+		// So are internal callers
+		if serveInternal(w, r, internal, config.TrustedProxies, config.Audit, next) {
+			return
+		}
+		r = config.BodyProof.read(r)
+
+		// Build resource URL
+		resource := requestResource(r.URL)
+
+		// Client IP policy applies before any payment is asked for
+		if servePayerPolicy(w, r, config.AccessPolicy, "", config.Audit, next) {
+			return
+		}
+
+		// A browser that already paid shows its receipt
+		if config.ReceiptCookies.serve(w, r, config.PayerHeaders, config.Audit, next) {
+			return
+		}
+
+		// The method, payer's tier, any quote and any coupon price this request on a per-request copy
+		config := config
+		config.PricePerRequest = scalePrice(r, config.MethodPricing.Price(r.Method, r.URL.Path, config.PricePerRequest))
+		currentPrice, payer := applyTier(w, r, config.TieredPricing, config.PricePerRequest)
+		config.PricePerRequest = currentPrice
+
+		// Zero-priced resources only ask who is calling; a quote never
+		// makes a resource zero-priced
+		if config.PricePerRequest == 0 {
+			if !serveAttributed(w, r, config.Config, next) {
+				sendMultiSchemePaymentRequired(w, config, r, nil, attributionRequired)
+			}
+			return
+		}
+		listPrice, quote, quoteErr := config.Quotes.price(r, config.Currency, currentPrice)
+		config.PricePerRequest = listPrice
+
+		coupon, couponErr := requestCoupon(config.Coupons, r)
+		if coupon != nil {
+			config.PricePerRequest = coupon.Discount(config.PricePerRequest, currencyDecimals(config.Currency))
+		}
+
+		// A coupon covering the whole price skips payment
+		if coupon != nil && config.PricePerRequest == 0 {
+			if err := config.Quotes.claim(quote); err != nil {
+				config.PricePerRequest = currentPrice
+				sendMultiSchemePaymentRequired(w, config, r, nil, quoteMessage(err))
+				return
+			}
+			if _, err := config.Coupons.Redeem(coupon.Code, r.URL.Path); err != nil {
+				config.Quotes.release(quote)
+				config.PricePerRequest = listPrice
+				sendMultiSchemePaymentRequired(w, config, r, nil, couponMessage(err))
+				return
+			}
+			config.Audit.Record(r, AuditEvent{Decision: AuditFree, Reason: PaymentMethodCoupon, Metadata: couponMetadata(coupon)})
+			w.Header().Set("X-Payment-Verified", "true")
+			w.Header().Set("X-Payment-Method", PaymentMethodCoupon)
+			r = recordPayment(config.Config, r, PaymentMethodCoupon, "", coupon)
+			config.TieredPricing.record(payer, 0)
 			next.ServeHTTP(w, r)
 			return
 		}
 
 		// Extract payment token from request
-		token := extractPaymentToken(r, config.AcceptedMethods)
+		token := extractPaymentToken(r, config.Config)
 
 		if token == "" {
 			// No payment token provided, return 402 with multi-scheme requirements
-			sendMultiSchemePaymentRequired(w, config, r)
+			message := ""
+			if quoteErr != nil {
+				message = quoteMessage(quoteErr)
+			}
+			if couponErr != nil {
+				message = couponMessage(couponErr)
+			}
+			sendMultiSchemePaymentRequired(w, config, r, nil, message)
 			return
 		}
 
 		// Parse payment payload to determine scheme
-		payload, err := parsePaymentPayload(token)
+		payload, err := parsePaymentPayload(token, config.MaxProofBytes)
 		if err != nil {
 			// Invalid payload format
-			sendMultiSchemePaymentRequired(w, config, r)
+			fail(w, r, config, &PaymentFailure{Stage: StageExtract, Reason: FailureMalformedProof, Resource: resource, Err: err})
+			return
+		}
+
+		// Payments presented after the quote's deadline must be re-quoted
+		if paymentExpired(proofDeadline(token, config.MaxTimeoutSeconds), config.clock()) {
+			fail(w, r, config, &PaymentFailure{
+				Rail:     string(payload.Scheme),
+				Stage:    StageVerify,
+				Reason:   FailureExpired,
+				Resource: resource,
+				Payer:    payload.Payer,
+			})
 			return
 		}
 
@@ -289,16 +775,29 @@ func MultiSchemeMiddleware(next http.Handler, config MultiSchemeConfig) http.Han
 		scheme, ok := registry.Get(payload.Scheme)
 		if !ok {
 			// Unsupported scheme, return 402 with supported schemes
-			sendMultiSchemePaymentRequired(w, config, r)
+			fail(w, r, config, &PaymentFailure{
+				Rail:     string(payload.Scheme),
+				Stage:    StageExtract,
+				Reason:   FailureUnsupportedRail,
+				Resource: resource,
+				Payer:    payload.Payer,
+			})
 			return
 		}
 
-		// Build requirements for verification
-		resource := r.URL.Path
-		if r.URL.RawQuery != "" {
-			resource += "?" + r.URL.RawQuery
+		// With a synced facilitator, only its supported pairs are accepted
+		if accepted, synced := config.SyncFromFacilitator.accepts(payload.Scheme, payload.Network); synced && !accepted {
+			fail(w, r, config, &PaymentFailure{
+				Rail:     string(payload.Scheme),
+				Stage:    StageExtract,
+				Reason:   FailureUnsupportedRail,
+				Resource: resource,
+				Payer:    payload.Payer,
+			})
+			return
 		}
 
+		// Build requirements for verification
 		requirements := &PaymentRequirements{
 			Scheme:            string(payload.Scheme),
 			Network:           string(payload.Network),
@@ -309,12 +808,119 @@ func MultiSchemeMiddleware(next http.Handler, config MultiSchemeConfig) http.Han
 			Asset:             config.Asset,
 		}
 
+		// Where several assets are accepted, verify against the claimed one
+		if assets := acceptedAssets(config.AcceptedAssets, payload.Network); len(assets) > 0 {
+			asset, ok := claimedAsset(assets, payload.Asset)
+			if !ok {
+				fail(w, r, config, &PaymentFailure{
+					Rail:     string(payload.Scheme),
+					Stage:    StageExtract,
+					Reason:   FailureCurrencyMismatch,
+					Message:  fmt.Sprintf("asset %q is not accepted on %s", payload.Asset, payload.Network),
+					Resource: resource,
+					Payer:    payload.Payer,
+				})
+				return
+			}
+			requirements.Asset = asset.Contract
+			requirements.MaxAmountRequired = config.assetAmount(asset)
+		}
+
 		// Verify payment using the scheme handler
-		result, err := scheme.Verify(r.Context(), payload, requirements)
+		result, err := callWithTimeout(r.Context(), config.verificationTimeout(), func(ctx context.Context) (*VerificationResult, error) {
+			return scheme.Verify(ctx, payload, requirements)
+		})
+		if isTimeout(err) {
+			failure := &PaymentFailure{
+				Rail:     string(payload.Scheme),
+				Stage:    StageVerify,
+				Reason:   FailureTimeout,
+				Resource: resource,
+				Payer:    payload.Payer,
+				Err:      err,
+			}
+			if config.FailMode == FailOpen {
+				failure.ExpectedAmount = config.PricePerRequest
+				reportFailure(config.Callbacks, config.OnPaymentFailure, r, failure)
+				_ = config.Quotes.claim(quote)
+				next.ServeHTTP(w, r)
+				return
+			}
+			fail(w, r, config, failure)
+			return
+		}
 		if err != nil || !result.Valid {
-			sendMultiSchemePaymentRequired(w, config, r)
+			failure := &PaymentFailure{
+				Rail:     string(payload.Scheme),
+				Stage:    StageVerify,
+				Reason:   FailureRailError,
+				Resource: resource,
+				Payer:    payload.Payer,
+				Err:      err,
+			}
+			if result != nil {
+				failure.Reason = result.Reason
+				if failure.Reason == "" {
+					failure.Reason = FailureInvalidPayment
+				}
+				failure.Message = result.Message
+				failure.PresentedAmount, _ = strconv.ParseInt(result.Amount, 10, 64)
+				if result.Payer != "" {
+					failure.Payer = result.Payer
+				}
+			}
+			fail(w, r, config, failure)
+			return
+		}
+
+		// Denied payers are refused and free payers served without the coupon
+		verifiedPayer := result.Payer
+		if verifiedPayer == "" {
+			verifiedPayer = payload.Payer
+		}
+		if servePayerPolicy(w, r, config.AccessPolicy, verifiedPayer, config.Audit, next) {
+			return
+		}
+
+		// Count the quote and coupon only once the request is paid for
+		if err := config.Quotes.claim(quote); err != nil {
+			config.PricePerRequest = currentPrice
+			sendMultiSchemePaymentRequired(w, config, r, nil, quoteMessage(err))
 			return
 		}
+		if coupon != nil {
+			if _, err := config.Coupons.Redeem(coupon.Code, r.URL.Path); err != nil {
+				config.Quotes.release(quote)
+				config.PricePerRequest = listPrice
+				sendMultiSchemePaymentRequired(w, config, r, nil, couponMessage(err))
+				return
+			}
+		}
+
+		config.TieredPricing.record(payer, config.PricePerRequest)
+		config.PayerHeaders.set(r, GatewayClaims{
+			Payer:     verifiedPayer,
+			Rail:      string(payload.Scheme),
+			Amount:    config.PricePerRequest,
+			Resource:  resource,
+			Timestamp: config.clock().Unix(),
+		})
+		config.Audit.Record(r, AuditEvent{
+			Decision:       AuditVerified,
+			Rail:           string(payload.Scheme),
+			Payer:          verifiedPayer,
+			RequiredAmount: config.PricePerRequest,
+			Currency:       config.Currency,
+			PayloadHash:    hashPayload(token),
+			Metadata:       couponMetadata(coupon),
+		})
+		recordTaskSpend(config.TaskSpend, w, r, config.PricePerRequest, config.Currency)
+
+		// Receipts carry the ledger ID so refunds can revoke them
+		config.Network = string(payload.Network)
+		r = recordPayment(config.Config, r, string(payload.Scheme), verifiedPayer, coupon)
+		info, _ := PaymentInfoFromRequest(r)
+		config.ReceiptCookies.issue(w, r, string(payload.Scheme), verifiedPayer, info.PaymentID)
 
 		// Payment verified, allow access
 		w.Header().Set("X-Payment-Verified", "true")
@@ -326,16 +932,16 @@ func MultiSchemeMiddleware(next http.Handler, config MultiSchemeConfig) http.Han
 	})
 }
 
-// sendMultiSchemePaymentRequired sends a 402 response with all accepted schemes
-func sendMultiSchemePaymentRequired(w http.ResponseWriter, config MultiSchemeConfig, r *http.Request) {
+// sendMultiSchemePaymentRequired sends a 402 response with all accepted schemes.
+// If a presented payment was refused, failure explains why in the error;
+// otherwise message, if set, does (e.g. for a refused coupon).
+func sendMultiSchemePaymentRequired(w http.ResponseWriter, config MultiSchemeConfig, r *http.Request, failure *PaymentFailure, message string) {
 	// Build resource URL
-	resource := r.URL.Path
-	if r.URL.RawQuery != "" {
-		resource += "?" + r.URL.RawQuery
-	}
+	resource := requestResource(r.URL)
 
 	// Generate requirements for all accepted schemes/networks
 	requirements := config.BuildMultiSchemeRequirements(resource)
+	validUntil := paymentDeadline(config.clock(), config.MaxTimeoutSeconds).Unix()
 
 	// If no multi-scheme config, fall back to single scheme
 	if len(requirements) == 0 {
@@ -346,46 +952,45 @@ func sendMultiSchemePaymentRequired(w http.ResponseWriter, config MultiSchemeCon
 			Resource:          resource,
 			Description:       config.Description,
 			PayTo:             config.PayTo,
-			MaxTimeoutSeconds: 60,
+			MaxTimeoutSeconds: maxTimeoutOrDefault(config.MaxTimeoutSeconds),
 			Asset:             config.Asset,
+			ExpiresAt:         validUntil,
 		}}
 	}
 
+	config.ResourceDescriptor.describe(r, requirements)
+	extensionsFor(r, config.Extensions).apply(requirements)
+
 	// Build x402 response
 	response := PaymentRequiredResponse{
-		X402Version: X402Version,
-		Accepts:     requirements,
-		Error:       "Payment required - select a supported scheme and network",
+		X402Version:      X402Version,
+		Accepts:          requirements,
+		Error:            "Payment required - select a supported scheme and network",
+		ValidUntil:       validUntil,
+		RequirementsHash: requirementsHash(requirements),
+	}
+	if failure != nil {
+		message = failure.PublicMessage()
+		response.Code = failure.ErrorCode()
+	}
+	if message != "" {
+		response.Error = message + " - select a supported scheme and network"
 	}
 
-	// Encode response as base64 for PAYMENT-REQUIRED header (v2 protocol)
-	responseJSON, _ := json.Marshal(response)
-	paymentRequiredHeader := base64.StdEncoding.EncodeToString(responseJSON)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("PAYMENT-REQUIRED", paymentRequiredHeader)
-
-	w.WriteHeader(http.StatusPaymentRequired) // 402
-
-	_ = json.NewEncoder(w).Encode(response)
+	config.Audit.recordPaymentRequired(r, failure, extractPaymentToken(r, config.Config), AuditEvent{RequiredAmount: config.PricePerRequest, Currency: config.Currency})
+	config.DiscoverySigner.sign(w, response)
+	config.Protocol.writePaymentRequired(w, config.Realm, requirementSchemes(response.Accepts), response)
 }
 
-// parsePaymentPayload parses a base64-encoded payment payload
-func parsePaymentPayload(token string) (*PaymentPayload, error) {
-	// Try base64 decode first
-	decoded, err := base64.StdEncoding.DecodeString(token)
-	if err != nil {
-		// Try URL-safe base64
-		decoded, err = base64.URLEncoding.DecodeString(token)
-		if err != nil {
-			// Assume it's raw JSON
-			decoded = []byte(token)
-		}
+// parsePaymentPayload parses a base64-encoded payment payload of at most
+// maxBytes (0 = DefaultMaxProofBytes)
+func parsePaymentPayload(token string, maxBytes int) (*PaymentPayload, error) {
+	if err := checkProofSize(token, maxBytes); err != nil {
+		return nil, err
 	}
-
 	var payload PaymentPayload
-	if err := json.Unmarshal(decoded, &payload); err != nil {
-		return nil, fmt.Errorf("invalid payment payload: %w", err)
+	if err := decodeProofJSON(decodePaymentToken(token), &payload); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPayment, err)
 	}
 
 	return &payload, nil
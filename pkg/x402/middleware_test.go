@@ -49,6 +49,80 @@ func TestMiddleware_NoToken(t *testing.T) {
 	}
 }
 
+func TestMiddleware_PaymentRequiredFormat(t *testing.T) {
+	config := testConfig()
+	config.PayTo = "0xseller"
+	config.Extensions = &PaymentExtensions{PreAuth: &PreAuthInfo{Endpoint: "/ai/budget", MinBudget: 1000}}
+	handler := Middleware(createTestHandler(), config)
+
+	// A browser gets the plain x402 body
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	handler.ServeHTTP(w, req)
+	var plain map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&plain)
+	if _, ok := plain["accepts"]; !ok || plain["success"] != nil {
+		t.Errorf("Expected a PaymentRequiredResponse for a browser, got %v", plain)
+	}
+
+	// An agent on the same endpoint gets the AIResponse envelope
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("User-Agent", "langchain/0.1")
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusPaymentRequired || w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("Expected a 402 with payment headers, got %d", w.Code)
+	}
+	var agent struct {
+		AIResponse
+		Data PaymentRequiredResponse `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&agent); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	e := agent.Error
+	if agent.Success || e == nil || e.Code != ErrCodePaymentRequired || e.Retryable || e.Action != "pay" {
+		t.Fatalf("Expected a non-retryable PAYMENT_REQUIRED error, got %+v", e)
+	}
+	pay := e.PaymentInfo
+	if pay == nil || !pay.Required || pay.Amount != 100 || pay.Currency != "USD" || pay.PayTo != "0xseller" ||
+		pay.Network != "base-sepolia" || pay.Endpoint != "/api/data" || pay.ExpiresAt == 0 {
+		t.Errorf("Expected full payment instructions, got %+v", pay)
+	}
+	if !pay.PreAuthAvailable || pay.PreAuthEndpoint != "/ai/budget" || pay.PreAuthMinBudget != 1000 {
+		t.Errorf("Expected the pre-auth hint, got %+v", pay)
+	}
+	if len(agent.Data.Accepts) != 1 || agent.Data.Accepts[0].PayTo != "0xseller" || agent.Meta.RequestID == "" {
+		t.Errorf("Expected the x402 requirements as data and a request ID, got %+v", agent)
+	}
+
+	// The format can be forced either way, and detection replaced
+	tests := []struct {
+		format    string
+		detector  AgentDetector
+		userAgent string
+		wantAgent bool
+	}{
+		{FormatX402, nil, "langchain/0.1", false},
+		{FormatAgent, nil, "Mozilla/5.0", true},
+		{FormatAuto, func(r *http.Request) bool { return r.Header.Get("X-Internal-Bot") != "" }, "langchain/0.1", false},
+	}
+	for _, tt := range tests {
+		config.PaymentRequiredFormat = tt.format
+		config.AgentDetector = tt.detector
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("User-Agent", tt.userAgent)
+		Middleware(createTestHandler(), config).ServeHTTP(w, req)
+		var body map[string]interface{}
+		json.NewDecoder(w.Body).Decode(&body)
+		if _, isAgent := body["success"]; isAgent != tt.wantAgent {
+			t.Errorf("format %q, UA %q: expected agent body %v, got %v", tt.format, tt.userAgent, tt.wantAgent, body)
+		}
+	}
+}
+
 func TestMiddleware_ValidToken(t *testing.T) {
 	handler := createTestHandler()
 	wrapped := Middleware(handler, testConfig())
@@ -127,7 +201,9 @@ func TestMiddleware_XPaymentTokenHeader(t *testing.T) {
 
 func TestMiddleware_QueryParam(t *testing.T) {
 	handler := createTestHandler()
-	wrapped := Middleware(handler, testConfig())
+	config := testConfig()
+	config.AllowQueryToken = true
+	wrapped := Middleware(handler, config)
 
 	req := httptest.NewRequest("GET", "/api/protected?payment_token=valid_token789", nil)
 	w := httptest.NewRecorder()
@@ -204,6 +280,40 @@ func TestMiddleware_CustomVerifier(t *testing.T) {
 	}
 }
 
+func TestMiddleware_TestTokenRequiresTestMode(t *testing.T) {
+	config := testConfig()
+	config.TestMode = false
+	config.PaymentVerifier = func(token string) (bool, error) { return false, nil }
+	wrapped := Middleware(createTestHandler(), config)
+
+	req := httptest.NewRequest("GET", "/api/protected", nil)
+	req.Header.Set("Authorization", "Bearer valid_foo")
+	w := httptest.NewRecorder()
+	wrapped.ServeHTTP(w, req)
+
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected valid_foo to be refused outside test mode, got %d", w.Code)
+	}
+	if valid, _ := verifyPaymentToken("valid_foo", Config{}); valid {
+		t.Error("Expected valid_foo to be refused without a verifier")
+	}
+}
+
+func TestMiddleware_PanicsWithoutVerifier(t *testing.T) {
+	config := testConfig()
+	config.TestMode = false
+	if err := config.Validate(); err == nil {
+		t.Fatal("Expected Validate to require a PaymentVerifier")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected Middleware to panic")
+		}
+	}()
+	Middleware(createTestHandler(), config)
+}
+
 // Helper functions
 
 func createTestHandler() http.Handler {
@@ -223,5 +333,6 @@ func testConfig() Config {
 		Network:         "base-sepolia",
 		Scheme:          "exact",
 		ExemptPaths:     []string{"/public"},
+		TestMode:        true,
 	}
 }
@@ -0,0 +1,128 @@
+// Package x402 - Payer Identity
+// Verifying a payment tells the middleware who paid, but the handler behind
+// it (often a separate backend behind the gateway) only sees the request.
+// After a successful payment the payer and rail are set as request headers,
+// and optionally a compact HMAC-signed claims header the backend can check
+// with VerifyGatewayClaims, so a client can't simply send its own.
+package x402
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Default names of the payer identity request headers
+const (
+	DefaultPayerHeader  = "X-Payment-Payer"
+	DefaultRailHeader   = "X-Payment-Rail"
+	DefaultClaimsHeader = "X-Payment-Claims"
+)
+
+// PayerHeaders names the request headers that carry the verified payer to
+// the next handler. Clients' own values for them are always removed.
+type PayerHeaders struct {
+	Payer  string // default X-Payment-Payer
+	Rail   string // default X-Payment-Rail
+	Claims string // default X-Payment-Claims
+
+	// ClaimsSecret signs the claims header; without it none is set
+	ClaimsSecret []byte
+}
+
+// GatewayClaims describe a verified payment to the backend
+type GatewayClaims struct {
+	Payer     string `json:"payer,omitempty"`
+	Rail      string `json:"rail"`
+	Amount    int64  `json:"amount"`
+	Resource  string `json:"resource"`
+	Timestamp int64  `json:"iat"`
+}
+
+// ErrInvalidClaims is returned by VerifyGatewayClaims for a claims header
+// that is malformed, forged or stale
+var ErrInvalidClaims = errors.New("x402: invalid gateway claims")
+
+func (h PayerHeaders) names() (payer, rail, claims string) {
+	payer, rail, claims = h.Payer, h.Rail, h.Claims
+	if payer == "" {
+		payer = DefaultPayerHeader
+	}
+	if rail == "" {
+		rail = DefaultRailHeader
+	}
+	if claims == "" {
+		claims = DefaultClaimsHeader
+	}
+	return payer, rail, claims
+}
+
+// strip removes client-supplied identity headers from r
+func (h PayerHeaders) strip(r *http.Request) {
+	payer, rail, claims := h.names()
+	r.Header.Del(payer)
+	r.Header.Del(rail)
+	r.Header.Del(claims)
+}
+
+// set adds the verified payment's identity headers to r
+func (h PayerHeaders) set(r *http.Request, claims GatewayClaims) {
+	payerName, railName, claimsName := h.names()
+	if claims.Payer != "" {
+		r.Header.Set(payerName, claims.Payer)
+	}
+	r.Header.Set(railName, claims.Rail)
+	if len(h.ClaimsSecret) > 0 {
+		r.Header.Set(claimsName, SignGatewayClaims(claims, h.ClaimsSecret))
+	}
+}
+
+// SignGatewayClaims encodes claims as base64url(JSON).base64url(HMAC-SHA256)
+func SignGatewayClaims(claims GatewayClaims, secret []byte) string {
+	payload, _ := json.Marshal(claims)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(claimsMAC(encoded, secret))
+}
+
+// VerifyGatewayClaims checks a claims header set by a middleware sharing
+// secret and returns its claims. Claims issued more than maxAge from now are
+// refused; maxAge 0 disables the check.
+func VerifyGatewayClaims(header string, secret []byte, maxAge time.Duration) (*GatewayClaims, error) {
+	encoded, signature, ok := strings.Cut(header, ".")
+	if !ok {
+		return nil, ErrInvalidClaims
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, claimsMAC(encoded, secret)) {
+		return nil, ErrInvalidClaims
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidClaims
+	}
+	var claims GatewayClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidClaims
+	}
+
+	if maxAge > 0 {
+		age := time.Since(time.Unix(claims.Timestamp, 0))
+		if age > maxAge || age < -maxAge {
+			return nil, fmt.Errorf("%w: issued %v ago", ErrInvalidClaims, age.Round(time.Second))
+		}
+	}
+	return &claims, nil
+}
+
+func claimsMAC(encoded string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
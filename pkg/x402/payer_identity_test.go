@@ -0,0 +1,117 @@
+package x402
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backendHeaders records the request headers next receives
+func backendHeaders(got *http.Header) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*got = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestUnifiedMiddleware_PayerIdentity(t *testing.T) {
+	secret := []byte("gateway-secret")
+	registry := NewRailRegistry()
+	registry.Register(&payerRail{EVMCryptoRail: NewEVMCryptoRail("", nil), payer: "0xPayer"})
+
+	var got http.Header
+	handler := UnifiedPaymentMiddleware(backendHeaders(&got), UnifiedPaymentConfig{
+		PricePerRequest: 100,
+		CryptoEnabled:   true,
+		RailRegistry:    registry,
+		PayerHeaders:    PayerHeaders{ClaimsSecret: secret},
+	})
+
+	req := httptest.NewRequest("GET", "/api/data?q=1", nil)
+	req.Header.Set("X-PAYMENT", "payload")
+	req.Header.Set("X-Payment-Payer", "0xSpoofed")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	if got.Get("X-Payment-Payer") != "0xPayer" || got.Get("X-Payment-Rail") != "evm-crypto" {
+		t.Errorf("Expected payer and rail on the backend request, got %q %q", got.Get("X-Payment-Payer"), got.Get("X-Payment-Rail"))
+	}
+
+	claims, err := VerifyGatewayClaims(got.Get("X-Payment-Claims"), secret, time.Minute)
+	if err != nil {
+		t.Fatalf("Expected valid claims, got %v", err)
+	}
+	if claims.Payer != "0xPayer" || claims.Amount != 100 || claims.Resource != "/api/data?q=1" {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+}
+
+func TestMiddleware_PayerHeadersConfigurable(t *testing.T) {
+	config := testConfig()
+	config.PayerHeaders = PayerHeaders{Payer: "X-Buyer", Rail: "X-Buyer-Rail"}
+	config.Scheme = "exact"
+	config.PaymentVerifier = func(token string) (bool, error) { return true, nil }
+
+	var got http.Header
+	handler := Middleware(backendHeaders(&got), config)
+
+	token := base64.StdEncoding.EncodeToString([]byte(`{"scheme":"exact","payer":"0xBuyer"}`))
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-PAYMENT", token)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got.Get("X-Buyer") != "0xBuyer" || got.Get("X-Buyer-Rail") != "exact" {
+		t.Errorf("Expected configured payer headers, got %q %q", got.Get("X-Buyer"), got.Get("X-Buyer-Rail"))
+	}
+	if got.Get("X-Payment-Claims") != "" {
+		t.Error("Expected no claims header without a secret")
+	}
+}
+
+func TestPayerHeaders_StrippedFromUnpaidRequests(t *testing.T) {
+	config := testConfig()
+	var got http.Header
+	handler := Middleware(backendHeaders(&got), config)
+
+	req := httptest.NewRequest("GET", "/public/page", nil)
+	req.Header.Set("X-Payment-Payer", "0xSpoofed")
+	req.Header.Set("X-Payment-Claims", "forged.claims")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got.Get("X-Payment-Payer") != "" || got.Get("X-Payment-Claims") != "" {
+		t.Errorf("Expected client identity headers to be removed, got %v", got)
+	}
+}
+
+func TestVerifyGatewayClaims_RejectsForgery(t *testing.T) {
+	secret := []byte("gateway-secret")
+	claims := GatewayClaims{Payer: "0xPayer", Rail: "evm-crypto", Amount: 100, Resource: "/api", Timestamp: time.Now().Unix()}
+	header := SignGatewayClaims(claims, secret)
+
+	forgedPayload := SignGatewayClaims(GatewayClaims{Payer: "0xAttacker", Rail: "evm-crypto", Amount: 100, Resource: "/api", Timestamp: claims.Timestamp}, secret)
+	encoded, _, _ := strings.Cut(forgedPayload, ".")
+	_, signature, _ := strings.Cut(header, ".")
+
+	tests := []struct {
+		name   string
+		header string
+		secret []byte
+	}{
+		{"wrong secret", SignGatewayClaims(claims, []byte("attacker")), secret},
+		{"swapped payload", encoded + "." + signature, secret},
+		{"unsigned", encoded, secret},
+		{"stale", SignGatewayClaims(GatewayClaims{Rail: "evm-crypto", Timestamp: time.Now().Add(-time.Hour).Unix()}, secret), secret},
+	}
+	for _, tt := range tests {
+		if _, err := VerifyGatewayClaims(tt.header, tt.secret, time.Minute); !errors.Is(err, ErrInvalidClaims) {
+			t.Errorf("%s: expected ErrInvalidClaims, got %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+// Package x402 - Payer Access Policy
+// Blocks payers flagged for fraud and lets partners through without being
+// charged. Policies match wallet addresses (case-insensitively) or client IPs
+// and networks. A client IP is checked before payment is asked for; the
+// payer address once verification has identified it.
+package x402
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// PayerDecision is the outcome of a payer policy check
+type PayerDecision string
+
+const (
+	PayerAllow PayerDecision = "allow" // Charge as usual
+	PayerDeny  PayerDecision = "deny"  // Refuse with 403, even with a valid payment
+	PayerFree  PayerDecision = "free"  // Serve without charging
+)
+
+// PaymentMethodFree is the X-Payment-Method of requests served free by policy
+const PaymentMethodFree = "free"
+
+// Payer identifies who is making a request for policy checks
+type Payer struct {
+	Address string // Wallet address or customer ID from verification (may be empty)
+	IP      string // Client IP
+}
+
+// PayerPolicyStore decides how a payer is treated
+type PayerPolicyStore interface {
+	Check(payer Payer) (PayerDecision, error)
+}
+
+// PayerPolicyEditor is a PayerPolicyStore whose entries can be changed at
+// runtime, e.g. via AdminHandler
+type PayerPolicyEditor interface {
+	PayerPolicyStore
+	SetEntry(entry string, decision PayerDecision) error
+	RemoveEntry(entry string) error
+	Entries() ([]PayerPolicyEntry, error)
+}
+
+// PayerPolicyEntry is a wallet address, IP, or CIDR and its decision
+type PayerPolicyEntry struct {
+	Entry    string        `json:"entry"`
+	Decision PayerDecision `json:"decision"`
+}
+
+// AccessPolicy configures payer policy enforcement in the middlewares
+type AccessPolicy struct {
+	Payers PayerPolicyStore
+
+	// TrustedProxies are networks whose X-Forwarded-For headers are believed
+	// when determining the client IP (see ParseTrustedProxies)
+	TrustedProxies []*net.IPNet
+}
+
+// check returns the decision for payer, with the client IP taken from r
+func (p *AccessPolicy) check(r *http.Request, address string) (PayerDecision, error) {
+	if p == nil || p.Payers == nil {
+		return PayerAllow, nil
+	}
+	return p.Payers.Check(Payer{Address: address, IP: ClientIPFromRequest(r, p.TrustedProxies)})
+}
+
+// servePayerPolicy applies policy to the payer at address (empty before
+// verification) and reports whether it answered the request: 403 for denied
+// payers, next without charging for free ones.
+func servePayerPolicy(w http.ResponseWriter, r *http.Request, policy *AccessPolicy, address string, audit *AuditLog, next http.Handler) bool {
+	decision, err := policy.check(r, address)
+	if err != nil {
+		sendPolicyUnavailable(w)
+		return true
+	}
+
+	switch decision {
+	case PayerDeny:
+		audit.Record(r, AuditEvent{Decision: AuditRejected, Reason: "payer_denied", Payer: address})
+		sendPayerDenied(w, address)
+		return true
+	case PayerFree:
+		audit.Record(r, AuditEvent{Decision: AuditFree, Reason: "payer_policy", Payer: address})
+		w.Header().Set("X-Payment-Method", PaymentMethodFree)
+		next.ServeHTTP(w, r)
+		return true
+	}
+	return false
+}
+
+// PayerDeniedResponse is the 403 body sent to denied payers
+type PayerDeniedResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	Payer   string `json:"payer,omitempty"`
+}
+
+// sendPayerDenied answers a denied payer with 403
+func sendPayerDenied(w http.ResponseWriter, payer string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	_ = json.NewEncoder(w).Encode(PayerDeniedResponse{
+		Error:   "payer_denied",
+		Message: "This payer is not allowed to access this resource",
+		Payer:   payer,
+	})
+}
+
+// sendPolicyUnavailable answers when the policy store cannot be consulted.
+// Failing closed keeps blocked payers out during store outages.
+func sendPolicyUnavailable(w http.ResponseWriter) {
+	http.Error(w, "Payer policy unavailable", http.StatusServiceUnavailable)
+}
+
+// InMemoryPayerPolicyStore matches wallet addresses case-insensitively and
+// IPs against single addresses or CIDRs. Deny wins over free, and free over
+// allow; payers matching no entry are allowed.
+type InMemoryPayerPolicyStore struct {
+	mu        sync.RWMutex
+	addresses map[string]PayerDecision
+	networks  map[string]policyNetwork // Keyed by canonical CIDR
+}
+
+type policyNetwork struct {
+	ipNet    *net.IPNet
+	decision PayerDecision
+}
+
+// NewInMemoryPayerPolicyStore creates an empty policy store
+func NewInMemoryPayerPolicyStore() *InMemoryPayerPolicyStore {
+	return &InMemoryPayerPolicyStore{
+		addresses: make(map[string]PayerDecision),
+		networks:  make(map[string]policyNetwork),
+	}
+}
+
+// SetEntry sets the decision for a wallet address, IP, or CIDR
+func (s *InMemoryPayerPolicyStore) SetEntry(entry string, decision PayerDecision) error {
+	switch decision {
+	case PayerAllow, PayerDeny, PayerFree:
+	default:
+		return fmt.Errorf("invalid decision %q", decision)
+	}
+
+	ipNet, address, err := parsePolicyEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ipNet != nil {
+		s.networks[ipNet.String()] = policyNetwork{ipNet: ipNet, decision: decision}
+	} else {
+		s.addresses[address] = decision
+	}
+	return nil
+}
+
+// RemoveEntry drops a wallet address, IP, or CIDR
+func (s *InMemoryPayerPolicyStore) RemoveEntry(entry string) error {
+	ipNet, address, err := parsePolicyEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ipNet != nil {
+		delete(s.networks, ipNet.String())
+	} else {
+		delete(s.addresses, address)
+	}
+	return nil
+}
+
+// Entries returns all entries sorted by entry
+func (s *InMemoryPayerPolicyStore) Entries() ([]PayerPolicyEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := make([]PayerPolicyEntry, 0, len(s.addresses)+len(s.networks))
+	for address, decision := range s.addresses {
+		entries = append(entries, PayerPolicyEntry{Entry: address, Decision: decision})
+	}
+	for cidr, network := range s.networks {
+		entries = append(entries, PayerPolicyEntry{Entry: cidr, Decision: network.decision})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Entry < entries[j].Entry })
+	return entries, nil
+}
+
+// Check returns the strictest decision matching the payer's address or IP
+func (s *InMemoryPayerPolicyStore) Check(payer Payer) (PayerDecision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matched []PayerDecision
+	if payer.Address != "" {
+		if decision, ok := s.addresses[strings.ToLower(strings.TrimSpace(payer.Address))]; ok {
+			matched = append(matched, decision)
+		}
+	}
+	if ip := net.ParseIP(payer.IP); ip != nil {
+		for _, network := range s.networks {
+			if network.ipNet.Contains(ip) {
+				matched = append(matched, network.decision)
+			}
+		}
+	}
+
+	result := PayerAllow
+	for _, decision := range matched {
+		if decision == PayerDeny {
+			return PayerDeny, nil
+		}
+		if decision == PayerFree {
+			result = PayerFree
+		}
+	}
+	return result, nil
+}
+
+// parsePolicyEntry returns the network of an IP or CIDR entry, or the
+// normalized wallet address otherwise
+func parsePolicyEntry(entry string) (*net.IPNet, string, error) {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return nil, "", fmt.Errorf("entry is required")
+	}
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid CIDR %q: %w", entry, err)
+		}
+		return ipNet, "", nil
+	}
+	if ip := net.ParseIP(entry); ip != nil {
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		}
+		return &net.IPNet{IP: ip.Mask(net.CIDRMask(bits, bits)), Mask: net.CIDRMask(bits, bits)}, "", nil
+	}
+	return nil, strings.ToLower(entry), nil
+}
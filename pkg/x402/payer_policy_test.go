@@ -0,0 +1,164 @@
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPayerPolicyStoreCheck(t *testing.T) {
+	store := NewInMemoryPayerPolicyStore()
+	store.SetEntry("0xAbCdEf0000000000000000000000000000000001", PayerDeny)
+	store.SetEntry("0xPARTNER", PayerFree)
+	store.SetEntry("10.0.0.0/8", PayerFree)
+	store.SetEntry("10.6.6.6", PayerDeny)
+
+	tests := []struct {
+		payer Payer
+		want  PayerDecision
+	}{
+		{Payer{Address: "0xabcdef0000000000000000000000000000000001"}, PayerDeny},
+		{Payer{Address: "0xABCDEF0000000000000000000000000000000001"}, PayerDeny},
+		{Payer{Address: "0xpartner"}, PayerFree},
+		{Payer{Address: "0xsomeone"}, PayerAllow},
+		{Payer{IP: "10.1.2.3"}, PayerFree},
+		{Payer{IP: "10.6.6.6"}, PayerDeny}, // Deny wins over the free network
+		{Payer{Address: "0xpartner", IP: "10.6.6.6"}, PayerDeny},
+		{Payer{IP: "192.168.1.1"}, PayerAllow},
+	}
+	for _, tt := range tests {
+		got, err := store.Check(tt.payer)
+		if err != nil || got != tt.want {
+			t.Errorf("Check(%+v) = %s, %v; expected %s", tt.payer, got, err, tt.want)
+		}
+	}
+
+	store.RemoveEntry("0xPartner")
+	if got, _ := store.Check(Payer{Address: "0xpartner"}); got != PayerAllow {
+		t.Errorf("Expected removed partner to be allowed, got %s", got)
+	}
+	if err := store.SetEntry("10.0.0.0/99", PayerDeny); err == nil {
+		t.Error("Expected invalid CIDR to be rejected")
+	}
+	if err := store.SetEntry("0xabc", "maybe"); err == nil {
+		t.Error("Expected invalid decision to be rejected")
+	}
+}
+
+// payerRail verifies every payment as made by payer and counts captures
+type payerRail struct {
+	*EVMCryptoRail
+	payer    string
+	captures int
+}
+
+func (p *payerRail) VerifyPayment(ctx context.Context, req *VerifyPaymentRequest) (*PaymentVerification, error) {
+	return &PaymentVerification{Valid: true, PaymentID: "pay_1", Amount: req.ExpectedAmount, Payer: p.payer, RequiresCapture: true}, nil
+}
+
+func (p *payerRail) CapturePayment(ctx context.Context, req *CapturePaymentRequest) (*PaymentCapture, error) {
+	p.captures++
+	return &PaymentCapture{Success: true, GrossAmount: req.Amount}, nil
+}
+
+func newPolicyHandler(payer string, policy PayerPolicyStore) (http.Handler, *payerRail) {
+	rail := &payerRail{EVMCryptoRail: NewEVMCryptoRail("", nil), payer: payer}
+	registry := NewRailRegistry()
+	registry.Register(rail)
+
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		PricePerRequest: 1000,
+		CryptoEnabled:   true,
+		RailRegistry:    registry,
+		AccessPolicy:    &AccessPolicy{Payers: policy},
+	})
+	return handler, rail
+}
+
+func paidRequest() *http.Request {
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-PAYMENT", "payload")
+	return req
+}
+
+func TestDeniedPayerGets403WithValidPayment(t *testing.T) {
+	policy := NewInMemoryPayerPolicyStore()
+	policy.SetEntry("0xFRAUD", PayerDeny)
+	handler, rail := newPolicyHandler("0xfraud", policy)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, paidRequest())
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403, got %d", w.Code)
+	}
+	var body PayerDeniedResponse
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Error != "payer_denied" || body.Payer != "0xfraud" {
+		t.Errorf("Expected structured payer_denied body, got %+v, %v", body, err)
+	}
+	if rail.captures != 0 {
+		t.Error("Expected denied payment not to be captured")
+	}
+}
+
+func TestFreePayerSkipsCaptureButIsMetered(t *testing.T) {
+	policy := NewInMemoryPayerPolicyStore()
+	policy.SetEntry("0xpartner", PayerFree)
+	handler, rail := newPolicyHandler("0xPartner", policy)
+
+	metering := NewInMemoryMeteringStore(10, "USDC")
+	metered := MeteringMiddleware(handler, MeteringConfig{Store: metering, Currency: "USDC", PricePerRequest: 1000})
+
+	w := httptest.NewRecorder()
+	metered.ServeHTTP(w, paidRequest())
+
+	if w.Code != http.StatusOK || w.Header().Get("X-Payment-Method") != PaymentMethodFree {
+		t.Fatalf("Expected free access, got %d", w.Code)
+	}
+	if rail.captures != 0 {
+		t.Error("Expected free payer not to be charged")
+	}
+	report, _ := metering.GetMetrics(MetricsFilter{})
+	if report.TotalRequests != 1 || report.TotalRevenue != 0 {
+		t.Errorf("Expected 1 metered request with no revenue, got %d requests, %d revenue", report.TotalRequests, report.TotalRevenue)
+	}
+}
+
+func TestAllowedPayerIsCharged(t *testing.T) {
+	handler, rail := newPolicyHandler("0xsomeone", NewInMemoryPayerPolicyStore())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, paidRequest())
+
+	if w.Code != http.StatusOK || rail.captures != 1 {
+		t.Errorf("Expected charged access, got %d with %d captures", w.Code, rail.captures)
+	}
+}
+
+func TestDeniedIPNeedsNoPayment(t *testing.T) {
+	policy := NewInMemoryPayerPolicyStore()
+	policy.SetEntry("203.0.113.0/24", PayerDeny)
+
+	handler := MultiSchemeMiddleware(createTestHandler(), MultiSchemeConfig{
+		Config:       Config{PricePerRequest: 1000, PayTo: "0xseller"},
+		AccessPolicy: &AccessPolicy{Payers: policy},
+	})
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.RemoteAddr = "203.0.113.7:4000"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for denied network before payment, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/data", nil)
+	req.RemoteAddr = "198.51.100.7:4000"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 for other clients, got %d", w.Code)
+	}
+}
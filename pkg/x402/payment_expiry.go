@@ -0,0 +1,96 @@
+// Package x402 - Payment Expiry
+// A quoted price is valid for MaxTimeoutSeconds. 402 responses carry the
+// deadline as validUntil (and expiresAt on each requirement), and proofs
+// presented after their deadline are refused with EXPIRED_PAYMENT so clients
+// re-quote instead of paying a stale price.
+package x402
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+)
+
+// defaultMaxTimeoutSeconds is how long a quote is valid when not configured
+const defaultMaxTimeoutSeconds = 60
+
+// maxTimeoutOrDefault returns maxTimeout, or the default when unset
+func maxTimeoutOrDefault(maxTimeout int) int {
+	if maxTimeout <= 0 {
+		return defaultMaxTimeoutSeconds
+	}
+	return maxTimeout
+}
+
+// paymentDeadline returns when a quote made at now expires
+func paymentDeadline(now time.Time, maxTimeout int) time.Time {
+	return now.Add(time.Duration(maxTimeoutOrDefault(maxTimeout)) * time.Second)
+}
+
+// paymentExpired reports whether deadline has passed at now. A zero deadline
+// never expires; a proof presented exactly at its deadline is still accepted.
+func paymentExpired(deadline, now time.Time) bool {
+	return !deadline.IsZero() && now.After(deadline)
+}
+
+// proofDeadline returns when a payment payload (base64 or raw JSON) stops
+// being accepted: the earlier of the quote's validUntil echoed by the client
+// and the signed authorization's validBefore, or maxTimeout after the
+// payload's timestamp. It is zero when the payload carries none of them.
+func proofDeadline(token string, maxTimeout int) time.Time {
+	var payload struct {
+		ValidUntil int64           `json:"validUntil"`
+		Timestamp  int64           `json:"timestamp"`
+		Payload    json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(decodePaymentToken(token), &payload); err != nil {
+		return time.Time{}
+	}
+
+	// The x402 exact scheme signs an EIP-3009 authorization with validBefore
+	var signed struct {
+		Authorization struct {
+			ValidBefore json.Number `json:"validBefore"`
+		} `json:"authorization"`
+	}
+	var validBefore int64
+	if len(payload.Payload) > 0 && json.Unmarshal(payload.Payload, &signed) == nil {
+		validBefore, _ = signed.Authorization.ValidBefore.Int64()
+	}
+
+	var deadline int64
+	for _, candidate := range []int64{payload.ValidUntil, validBefore} {
+		if candidate > 0 && (deadline == 0 || candidate < deadline) {
+			deadline = candidate
+		}
+	}
+	if deadline > 0 {
+		return time.Unix(deadline, 0)
+	}
+	if payload.Timestamp > 0 {
+		return paymentDeadline(time.Unix(payload.Timestamp, 0), maxTimeout)
+	}
+	return time.Time{}
+}
+
+// decodePaymentToken returns the JSON of a base64 (standard or URL-safe,
+// padded or not) or raw JSON payment token
+func decodePaymentToken(token string) []byte {
+	if decoded, err := decodeBase64(token); err == nil {
+		return decoded
+	}
+	return []byte(token)
+}
+
+// decodeBase64 decodes s in any of the standard and URL-safe alphabets, with
+// or without padding, as clients differ
+func decodeBase64(s string) ([]byte, error) {
+	var err error
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		var decoded []byte
+		if decoded, err = enc.DecodeString(s); err == nil {
+			return decoded, nil
+		}
+	}
+	return nil, err
+}
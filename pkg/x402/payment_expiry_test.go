@@ -0,0 +1,176 @@
+package x402
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var quoteTime = time.Date(2026, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+func decodePaymentRequired(t *testing.T, w *httptest.ResponseRecorder) PaymentRequiredResponse {
+	t.Helper()
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402, got %d", w.Code)
+	}
+	var response PaymentRequiredResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return response
+}
+
+func TestPaymentRequiredCarriesDeadline(t *testing.T) {
+	config := testConfig()
+	config.MaxTimeoutSeconds = 30
+	config.now = func() time.Time { return quoteTime }
+	handler := Middleware(createTestHandler(), config)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+
+	header, _ := base64.StdEncoding.DecodeString(w.Header().Get("PAYMENT-REQUIRED"))
+	var fromHeader PaymentRequiredResponse
+	if err := json.Unmarshal(header, &fromHeader); err != nil {
+		t.Fatalf("Failed to decode PAYMENT-REQUIRED: %v", err)
+	}
+
+	want := quoteTime.Add(30 * time.Second).Unix()
+	response := decodePaymentRequired(t, w)
+	if response.ValidUntil != want || response.Accepts[0].ExpiresAt != want || fromHeader.ValidUntil != want {
+		t.Errorf("Expected deadline %d, got body %d, requirement %d, header %d",
+			want, response.ValidUntil, response.Accepts[0].ExpiresAt, fromHeader.ValidUntil)
+	}
+}
+
+func TestExpiredPaymentBoundary(t *testing.T) {
+	token := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(`{"scheme":"exact","timestamp":%d}`, quoteTime.Unix())))
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		want    int
+	}{
+		{"at the deadline", 30 * time.Second, http.StatusOK},
+		{"after the deadline", 31 * time.Second, http.StatusPaymentRequired},
+	}
+	for _, tt := range tests {
+		config := testConfig()
+		config.MaxTimeoutSeconds = 30
+		config.PaymentVerifier = func(string) (bool, error) { return true, nil }
+		now := quoteTime.Add(tt.elapsed)
+		config.now = func() time.Time { return now }
+
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-PAYMENT", token)
+		w := httptest.NewRecorder()
+		Middleware(createTestHandler(), config).ServeHTTP(w, req)
+
+		if w.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, w.Code)
+			continue
+		}
+		if tt.want == http.StatusPaymentRequired {
+			if response := decodePaymentRequired(t, w); response.Code != ErrCodeExpiredPayment {
+				t.Errorf("%s: expected code %s, got %q", tt.name, ErrCodeExpiredPayment, response.Code)
+			}
+		}
+	}
+}
+
+func TestUnifiedRejectsExpiredAuthorization(t *testing.T) {
+	validBefore := quoteTime.Add(time.Minute)
+	payload := fmt.Sprintf(`{"x402Version":1,"scheme":"exact","payload":{"signature":"0xsig","authorization":{"validBefore":"%d"}}}`, validBefore.Unix())
+
+	for _, tt := range []struct {
+		now  time.Time
+		want int
+	}{
+		{validBefore, http.StatusOK},
+		{validBefore.Add(time.Second), http.StatusPaymentRequired},
+	} {
+		rail := &recordingRail{EVMCryptoRail: NewEVMCryptoRail("", nil)}
+		registry := NewRailRegistry()
+		registry.Register(rail)
+		now := tt.now
+		handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+			PricePerRequest: 100,
+			CryptoEnabled:   true,
+			CryptoNetworks:  []NetworkType{NetworkBaseSepolia},
+			RailRegistry:    registry,
+			now:             func() time.Time { return now },
+		})
+
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-PAYMENT", base64.StdEncoding.EncodeToString([]byte(payload)))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tt.want {
+			t.Fatalf("At %s: expected %d, got %d", now.Sub(validBefore), tt.want, w.Code)
+		}
+		if tt.want == http.StatusPaymentRequired {
+			var response PaymentOptionsResponse
+			json.NewDecoder(w.Body).Decode(&response)
+			if response.Code != ErrCodeExpiredPayment || rail.expected != 0 {
+				t.Errorf("Expected EXPIRED_PAYMENT before verification, got %q (verified %d)", response.Code, rail.expected)
+			}
+		}
+	}
+}
+
+func TestStripeCancelsExpiredIntent(t *testing.T) {
+	deadline := quoteTime.Add(time.Minute)
+	status := "requires_payment_method"
+	canceled := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/cancel") {
+			canceled = true
+		}
+		fmt.Fprintf(w, `{"id":"pi_1","amount":100,"currency":"usd","status":%q,"metadata":{"expires_at":"%d"}}`, status, deadline.Unix())
+	}))
+	defer server.Close()
+
+	rail := NewStripeRail("sk_test", "")
+	rail.BaseURL = server.URL
+	verify := func(now time.Time) *PaymentVerification {
+		rail.now = func() time.Time { return now }
+		verification, err := rail.VerifyPayment(context.Background(), &VerifyPaymentRequest{PaymentIntentID: "pi_1", ExpectedAmount: 100, ExpectedCurrency: "USD"})
+		if err != nil {
+			t.Fatalf("VerifyPayment failed: %v", err)
+		}
+		return verification
+	}
+
+	if v := verify(deadline); v.Reason != FailurePaymentIncomplete || canceled {
+		t.Errorf("Expected unpaid intent at the deadline to stay open, got %q (canceled %v)", v.Reason, canceled)
+	}
+	if v := verify(deadline.Add(time.Second)); v.Reason != FailureExpired || !canceled {
+		t.Errorf("Expected expired intent to be canceled, got %q (canceled %v)", v.Reason, canceled)
+	}
+
+	// Paid before anyone canceled it: the payment stands
+	status = "succeeded"
+	if v := verify(deadline.Add(time.Hour)); !v.Valid {
+		t.Errorf("Expected succeeded intent to be accepted, got %q", v.Reason)
+	}
+}
+
+func TestSendAIErrorSetsPaymentDeadline(t *testing.T) {
+	w := httptest.NewRecorder()
+	sendAIError(w, "", "req_1", time.Now(), AIError{Code: ErrCodePaymentRequired, PaymentInfo: &PaymentAction{Required: true, Amount: 100}})
+
+	var response AIResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if expires := response.Error.PaymentInfo.ExpiresAt; expires <= time.Now().Unix() {
+		t.Errorf("Expected a future payment deadline, got %d", expires)
+	}
+}
@@ -0,0 +1,128 @@
+// Package x402 - Payment Failures
+// Structured details of why a presented payment was refused, passed to
+// OnPaymentFailure hooks so sellers can tell a short payment from an expired
+// authorization or a declined card.
+package x402
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FailureStage is the point in the payment flow where a payment failed
+type FailureStage string
+
+const (
+	StageExtract FailureStage = "extract" // Payment proof missing pieces or undecodable
+	StageVerify  FailureStage = "verify"  // Rail or scheme refused the payment
+	StageCapture FailureStage = "capture" // Verified payment could not be settled
+	StageConfirm FailureStage = "confirm" // Settled transaction failed on-chain
+)
+
+// Failure reason codes
+const (
+	FailureMalformedProof      = "malformed_proof"      // Proof header could not be decoded
+	FailureUnsupportedRail     = "unsupported_rail"     // Rail or scheme not accepted here
+	FailureAmountMismatch      = "amount_mismatch"      // Paid less than the price
+	FailureCurrencyMismatch    = "currency_mismatch"    // Paid in another currency
+	FailurePaymentIncomplete   = "payment_incomplete"   // Payment exists but has not completed
+	FailureDeclined            = "declined"             // Payment was canceled or declined
+	FailureFacilitatorRejected = "facilitator_rejected" // Facilitator reported the payload invalid
+	FailureInvalidPayment      = "invalid_payment"      // Refused without a more specific reason
+	FailureCaptureFailed       = "capture_failed"       // Capture or settlement unsuccessful
+	FailureRailError           = "rail_error"           // Rail could not be reached or errored
+	FailureExpired             = "expired_payment"      // Presented after the quote's deadline
+	FailureReverted            = "transaction_reverted" // Settlement transaction reverted on-chain
+	FailureTimeout             = "rail_timeout"         // Rail did not answer within its timeout
+	FailureCircuitOpen         = "rail_unavailable"     // Rail's circuit breaker is open
+)
+
+// PaymentFailure describes a refused payment
+type PaymentFailure struct {
+	Rail     string       `json:"rail"` // Rail ID, or scheme for MultiSchemeMiddleware
+	Stage    FailureStage `json:"stage"`
+	Reason   string       `json:"reason"`
+	Message  string       `json:"message,omitempty"` // Detail from the rail or facilitator
+	Resource string       `json:"resource"`
+
+	PresentedAmount int64  `json:"presentedAmount,omitempty"`
+	ExpectedAmount  int64  `json:"expectedAmount"`
+	Payer           string `json:"payer,omitempty"`
+
+	// Err is the underlying error, if any (not serialized)
+	Err error `json:"-"`
+}
+
+// Error implements error
+func (f *PaymentFailure) Error() string {
+	msg := fmt.Sprintf("payment %s failed on %s: %s", f.Stage, f.Rail, f.Reason)
+	if f.Message != "" {
+		msg += " (" + f.Message + ")"
+	}
+	if f.Err != nil {
+		msg += ": " + f.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error
+func (f *PaymentFailure) Unwrap() error {
+	return f.Err
+}
+
+// PublicMessage is a description safe to return to the client. Rail errors
+// and unexpected reasons are reported generically so internal details such as
+// API responses never leak into 402 bodies.
+func (f *PaymentFailure) PublicMessage() string {
+	switch f.Reason {
+	case FailureMalformedProof:
+		return "Payment proof could not be decoded"
+	case FailureUnsupportedRail:
+		return fmt.Sprintf("Payment method %q is not accepted", f.Rail)
+	case FailureAmountMismatch:
+		return fmt.Sprintf("Payment of %d is less than the required %d", f.PresentedAmount, f.ExpectedAmount)
+	case FailureCurrencyMismatch:
+		return "Payment currency does not match the price"
+	case FailurePaymentIncomplete:
+		return "Payment has not completed"
+	case FailureDeclined:
+		return "Payment was declined"
+	case FailureFacilitatorRejected:
+		if f.Message != "" && isReasonToken(f.Message) {
+			return "Payment was rejected by the facilitator: " + f.Message
+		}
+		return "Payment was rejected by the facilitator"
+	case FailureCaptureFailed:
+		return "Payment could not be settled"
+	case FailureExpired:
+		return "Payment deadline has passed; request a new quote"
+	case FailureReverted:
+		return "Payment transaction reverted"
+	case FailureTimeout:
+		return "Payment provider did not respond in time; retry the payment"
+	case FailureCircuitOpen:
+		return fmt.Sprintf("Payment method %q is temporarily unavailable; choose another", f.Rail)
+	default:
+		return "Payment could not be verified"
+	}
+}
+
+// ErrorCode is the machine-readable code sent with the failure in 402
+// responses, if the reason has one
+func (f *PaymentFailure) ErrorCode() string {
+	if f.Reason == FailureExpired {
+		return ErrCodeExpiredPayment
+	}
+	return ""
+}
+
+// isReasonToken reports whether s looks like a facilitator reason code (e.g.
+// "insufficient_funds") rather than free text that may carry internals
+func isReasonToken(s string) bool {
+	if len(s) > 64 {
+		return false
+	}
+	return strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_')
+	}) < 0
+}
@@ -0,0 +1,176 @@
+package x402
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveFailure runs req through handler and returns the reported failure and
+// the 402 body's error
+func serveFailure(t *testing.T, handler http.Handler, req *http.Request, failures chan *PaymentFailure) (*PaymentFailure, string) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402, got %d", rec.Code)
+	}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode body: %v", err)
+	}
+
+	select {
+	case failure := <-failures:
+		return failure, body.Error
+	default:
+		t.Fatal("Expected OnPaymentFailure to be called")
+		return nil, ""
+	}
+}
+
+func TestStripeWrongAmountFailure(t *testing.T) {
+	stripeAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`{"id":"pi_short","amount":50,"currency":"usd","status":"succeeded","customer":"cus_1"}`))
+			return
+		}
+		w.Write([]byte(`{"id":"pi_new","amount":100,"currency":"usd","status":"requires_payment_method","client_secret":"secret"}`))
+	}))
+	defer stripeAPI.Close()
+
+	stripe := NewStripeRail("sk_test", "")
+	stripe.BaseURL = stripeAPI.URL
+	registry := NewRailRegistry()
+	registry.Register(stripe)
+
+	failures := make(chan *PaymentFailure, 1)
+	legacyCalled := false
+	handler := UnifiedPaymentMiddleware(http.NotFoundHandler(), UnifiedPaymentConfig{
+		PricePerRequest:  100,
+		Currency:         "USD",
+		FiatEnabled:      true,
+		RailRegistry:     registry,
+		OnPaymentFailure: func(ctx context.Context, failure *PaymentFailure) { failures <- failure },
+		OnPaymentFailed:  func(ctx context.Context, err error, r *http.Request) { legacyCalled = true },
+	})
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-STRIPE-PAYMENT-INTENT", "pi_short")
+	failure, message := serveFailure(t, handler, req, failures)
+
+	if failure.Rail != RailStripe || failure.Stage != StageVerify || failure.Reason != FailureAmountMismatch {
+		t.Errorf("Expected stripe verify amount_mismatch, got %s %s %s", failure.Rail, failure.Stage, failure.Reason)
+	}
+	if failure.PresentedAmount != 50 || failure.ExpectedAmount != 100 || failure.Payer != "cus_1" {
+		t.Errorf("Expected presented 50, expected 100, payer cus_1, got %+v", failure)
+	}
+	if !strings.Contains(message, "less than the required 100") {
+		t.Errorf("Expected 402 error to explain the short payment, got %q", message)
+	}
+	if !legacyCalled {
+		t.Error("Expected OnPaymentFailed to still be called")
+	}
+}
+
+func TestFacilitatorRejectionFailure(t *testing.T) {
+	facilitator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"isValid":false,"invalidReason":"insufficient_funds","payer":"0xpayer"}`))
+	}))
+	defer facilitator.Close()
+
+	failures := make(chan *PaymentFailure, 1)
+	handler := UnifiedPaymentMiddleware(http.NotFoundHandler(), UnifiedPaymentConfig{
+		PricePerRequest:  10000,
+		CryptoEnabled:    true,
+		CryptoPayTo:      "0xseller",
+		CryptoNetworks:   []NetworkType{NetworkBaseSepolia},
+		FacilitatorURL:   facilitator.URL,
+		OnPaymentFailure: func(ctx context.Context, failure *PaymentFailure) { failures <- failure },
+	})
+
+	payload := base64.StdEncoding.EncodeToString([]byte(`{"x402Version":1,"scheme":"exact","payload":{}}`))
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-PAYMENT", payload)
+	failure, message := serveFailure(t, handler, req, failures)
+
+	if failure.Rail != RailEVMCrypto || failure.Stage != StageVerify || failure.Reason != FailureFacilitatorRejected {
+		t.Errorf("Expected evm-crypto verify facilitator_rejected, got %s %s %s", failure.Rail, failure.Stage, failure.Reason)
+	}
+	if failure.Message != "insufficient_funds" || failure.Payer != "0xpayer" || failure.ExpectedAmount != 10000 {
+		t.Errorf("Expected facilitator reason and payer, got %+v", failure)
+	}
+	if !strings.Contains(message, "insufficient_funds") {
+		t.Errorf("Expected 402 error to include the facilitator reason, got %q", message)
+	}
+}
+
+func TestMalformedProofFailure(t *testing.T) {
+	failures := make(chan *PaymentFailure, 1)
+	handler := UnifiedPaymentMiddleware(http.NotFoundHandler(), UnifiedPaymentConfig{
+		PricePerRequest:  100,
+		FiatEnabled:      true,
+		RailRegistry:     NewRailRegistry(),
+		OnPaymentFailure: func(ctx context.Context, failure *PaymentFailure) { failures <- failure },
+	})
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-PAYMENT-PROOF", "not base64!")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var response MalformedProofResponse
+	json.NewDecoder(rec.Body).Decode(&response)
+	if rec.Code != http.StatusBadRequest || response.Code != ErrCodeMalformedProof {
+		t.Fatalf("Expected a 400 %s, got %d %q", ErrCodeMalformedProof, rec.Code, response.Code)
+	}
+
+	failure := <-failures
+	if failure.Stage != StageExtract || failure.Reason != FailureMalformedProof || failure.Err == nil {
+		t.Errorf("Expected extract malformed_proof with error, got %+v", failure)
+	}
+}
+
+func TestMultiSchemeFailureReasons(t *testing.T) {
+	failures := make(chan *PaymentFailure, 1)
+	handler := MultiSchemeMiddleware(http.NotFoundHandler(), MultiSchemeConfig{
+		Config:           Config{PricePerRequest: 1000, PayTo: "0xseller", Network: "base-sepolia"},
+		SchemeRegistry:   NewSchemeRegistry(),
+		OnPaymentFailure: func(ctx context.Context, failure *PaymentFailure) { failures <- failure },
+	})
+
+	payload := base64.StdEncoding.EncodeToString([]byte(`{"scheme":"exact","network":"eip155:84532","payer":"0xpayer"}`))
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-PAYMENT", payload)
+	failure, message := serveFailure(t, handler, req, failures)
+
+	if failure.Rail != "exact" || failure.Stage != StageExtract || failure.Reason != FailureUnsupportedRail {
+		t.Errorf("Expected unsupported exact scheme, got %s %s %s", failure.Rail, failure.Stage, failure.Reason)
+	}
+	if failure.ExpectedAmount != 1000 || failure.Payer != "0xpayer" {
+		t.Errorf("Expected amount and payer, got %+v", failure)
+	}
+	if !strings.Contains(message, "not accepted") {
+		t.Errorf("Expected 402 error to name the unsupported scheme, got %q", message)
+	}
+}
+
+func TestPublicMessageHidesRailErrors(t *testing.T) {
+	failure := &PaymentFailure{Rail: RailStripe, Stage: StageVerify, Reason: FailureRailError, Message: "sk_live_secret"}
+	if strings.Contains(failure.PublicMessage(), "sk_live") {
+		t.Error("Expected rail error details to stay private")
+	}
+
+	rejected := &PaymentFailure{Reason: FailureFacilitatorRejected, Message: "signature invalid: key 0xabc"}
+	if strings.Contains(rejected.PublicMessage(), "0xabc") {
+		t.Error("Expected free-text facilitator messages to stay private")
+	}
+}
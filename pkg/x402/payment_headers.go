@@ -0,0 +1,48 @@
+// Package x402 - Payment Required Headers
+// Every 402 carries the same standard headers, whichever middleware sends it:
+// a WWW-Authenticate challenge so generic HTTP clients recognize it,
+// Cache-Control: no-store and Vary so intermediaries never serve one payer's
+// challenge (or a paid response) to another, and the CORS exposure browser
+// clients need to read PAYMENT-REQUIRED.
+package x402
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultRealm is the WWW-Authenticate realm used when none is configured
+const DefaultRealm = "x402"
+
+// setPaymentRequiredHeaders sets the standard 402 headers on w. It must be
+// called before WriteHeader. schemes are the accepted x402 schemes listed in
+// the challenge; protocol, which may be nil, names the payment headers.
+func setPaymentRequiredHeaders(w http.ResponseWriter, realm string, schemes []string, protocol *ProtocolProfile) {
+	if realm == "" {
+		realm = DefaultRealm
+	}
+	challenge := fmt.Sprintf("X402 realm=%q", realm)
+	if len(schemes) > 0 {
+		challenge += fmt.Sprintf(", schemes=%q", strings.Join(schemes, " "))
+	}
+
+	h := w.Header()
+	h.Set("WWW-Authenticate", challenge)
+	h.Set("Cache-Control", "no-store")
+	h.Add("Vary", protocol.vary())
+	h.Set("Access-Control-Expose-Headers", protocol.exposed())
+}
+
+// requirementSchemes returns the distinct schemes of requirements, in order
+func requirementSchemes(requirements []PaymentRequirements) []string {
+	var schemes []string
+	seen := make(map[string]bool)
+	for _, req := range requirements {
+		if req.Scheme != "" && !seen[req.Scheme] {
+			seen[req.Scheme] = true
+			schemes = append(schemes, req.Scheme)
+		}
+	}
+	return schemes
+}
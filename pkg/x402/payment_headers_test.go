@@ -0,0 +1,80 @@
+package x402
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPaymentRequiredHeadersOnEveryMiddleware(t *testing.T) {
+	preAuthStore := NewInMemoryPreAuthStore()
+	preAuthStore.Create(&PreAuthBudget{AgentID: "poor_agent", TotalBudget: 50, ExpiresAt: time.Now().Add(time.Hour)})
+
+	core := testConfig()
+	core.Realm = "premium-api"
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		realm   string
+		scheme  string
+	}{
+		{"Middleware", Middleware(createTestHandler(), core), "premium-api", "exact"},
+		{"MultiSchemeMiddleware", MultiSchemeMiddleware(createTestHandler(), MultiSchemeConfig{
+			Config:          Config{PricePerRequest: 1000, PayTo: "0xseller", Network: "base-sepolia"},
+			AcceptedSchemes: []SchemeType{SchemeExact, SchemeUpto},
+			SchemeRegistry:  NewSchemeRegistry(),
+		}), DefaultRealm, "exact upto"},
+		{"UnifiedPaymentMiddleware", UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+			PricePerRequest: 100,
+			CryptoEnabled:   true,
+			CryptoNetworks:  []NetworkType{NetworkBaseSepolia},
+			Realm:           "unified",
+		}), "unified", "exact"},
+		{"AIFirstMiddleware", AIFirstMiddleware(createTestHandler(), AIFirstConfig{
+			EnablePreAuth: true,
+			PreAuthStore:  preAuthStore,
+			DefaultCost:   100,
+		}), DefaultRealm, "exact"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-Agent-ID", "poor_agent")
+		w := httptest.NewRecorder()
+		tt.handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusPaymentRequired {
+			t.Errorf("%s: expected 402, got %d", tt.name, w.Code)
+			continue
+		}
+		want := `X402 realm="` + tt.realm + `", schemes="` + tt.scheme + `"`
+		if got := w.Header().Get("WWW-Authenticate"); got != want {
+			t.Errorf("%s: expected WWW-Authenticate %s, got %s", tt.name, want, got)
+		}
+		if got := w.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("%s: expected Cache-Control no-store, got %q", tt.name, got)
+		}
+		if got := w.Header().Get("Vary"); got != "Authorization, X-PAYMENT" {
+			t.Errorf("%s: expected Vary on the payment headers, got %q", tt.name, got)
+		}
+		if got := w.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(got, "PAYMENT-REQUIRED") {
+			t.Errorf("%s: expected PAYMENT-REQUIRED to be exposed, got %q", tt.name, got)
+		}
+	}
+}
+
+func TestPaymentRequiredHeadersKeepExistingVary(t *testing.T) {
+	w := httptest.NewRecorder()
+	w.Header().Set("Vary", "Accept")
+	setPaymentRequiredHeaders(w, "", nil, nil)
+
+	if got := w.Header().Values("Vary"); len(got) != 2 || got[0] != "Accept" {
+		t.Errorf("Expected Vary to be extended, got %v", got)
+	}
+	if got := w.Header().Get("WWW-Authenticate"); got != `X402 realm="x402"` {
+		t.Errorf("Expected default realm without schemes, got %s", got)
+	}
+}
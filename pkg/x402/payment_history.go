@@ -0,0 +1,246 @@
+// Package x402 - Payment History
+// Buyers, people and agents alike, had to ask the seller for a record of
+// what they paid. PaymentHistoryHandler serves each payer their own ledger
+// entries: the resource, amount, rail, a link to the transaction and what was
+// refunded, and nothing else. The payer proves who they are by signing a
+// message with their wallet, or with a live session or receipt cookie.
+package x402
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultHistorySignatureAge is how old a signed history request may be
+const DefaultHistorySignatureAge = 5 * time.Minute
+
+// ErrPayerNotAuthenticated is returned for history requests that don't
+// prove a payer
+var ErrPayerNotAuthenticated = errors.New("payer not authenticated")
+
+// PaymentHistoryMessage is what a wallet signs to read its payment history:
+// the lowercase address and the X-Payer-Timestamp (Unix seconds)
+func PaymentHistoryMessage(address string, timestamp int64) string {
+	return fmt.Sprintf("x402 payment history for %s at %d", strings.ToLower(address), timestamp)
+}
+
+// PaymentHistoryConfig configures PaymentHistoryHandler
+type PaymentHistoryConfig struct {
+	Ledger PaymentLedger
+
+	// WalletVerifier checks X-Payer-Signature (default VerifyPersonalSign)
+	WalletVerifier WalletVerifier
+
+	// MaxSignatureAge bounds how far X-Payer-Timestamp may be from now
+	// (default DefaultHistorySignatureAge)
+	MaxSignatureAge time.Duration
+
+	// Sessions, if set, accepts a live session (X-Session-ID or
+	// X-Session-Token) as proof of its payer
+	Sessions SessionStore
+
+	// Receipts, if set, accepts a valid receipt cookie as proof of its payer
+	Receipts *ReceiptCookies
+
+	now func() time.Time
+}
+
+// PayerPayment is one payment as its payer sees it
+type PayerPayment struct {
+	ID             string    `json:"id"`
+	Resource       string    `json:"resource"`
+	Amount         int64     `json:"amount"`
+	Currency       string    `json:"currency"`
+	Rail           string    `json:"rail"`
+	Network        string    `json:"network,omitempty"`
+	TransactionID  string    `json:"transactionId,omitempty"`
+	TransactionURL string    `json:"transactionUrl,omitempty"`
+	Status         string    `json:"status"`
+	Refunded       int64     `json:"refunded,omitempty"`
+	PaidAt         time.Time `json:"paidAt"`
+}
+
+// payerPayment is what record's payer may see of it
+func payerPayment(record PaymentRecord) PayerPayment {
+	return PayerPayment{
+		ID:             record.ID,
+		Resource:       record.Endpoint,
+		Amount:         record.Amount,
+		Currency:       record.Currency,
+		Rail:           recordRail(record),
+		Network:        record.Network,
+		TransactionID:  record.TransactionID,
+		TransactionURL: transactionURL(record.Network, record.TransactionID),
+		Status:         record.Status,
+		Refunded:       record.Refunded,
+		PaidAt:         record.Timestamp,
+	}
+}
+
+// explorerTxURLs are block explorers' transaction pages by network
+var explorerTxURLs = map[NetworkType]string{
+	NetworkEthereumMainnet: "https://etherscan.io/tx/",
+	NetworkBaseMainnet:     "https://basescan.org/tx/",
+	NetworkBaseSepolia:     "https://sepolia.basescan.org/tx/",
+	NetworkOptimism:        "https://optimistic.etherscan.io/tx/",
+	NetworkArbitrum:        "https://arbiscan.io/tx/",
+	NetworkPolygon:         "https://polygonscan.com/tx/",
+}
+
+// transactionURL links to transaction on network's block explorer, if it has
+// a known one
+func transactionURL(network, transaction string) string {
+	base, ok := explorerTxURLs[canonicalEVMNetwork(network)]
+	if !ok || transaction == "" {
+		return ""
+	}
+	return base + transaction
+}
+
+// payer returns the payer r proves it is
+func (c PaymentHistoryConfig) payer(r *http.Request) (string, error) {
+	if address := r.Header.Get("X-Payer-Address"); address != "" {
+		return c.signedPayer(r, address)
+	}
+	if c.Sessions != nil {
+		if id := requestSessionID(r); id != "" {
+			session, err := c.Sessions.GetSession(id)
+			if err == nil && session.Active && time.Now().Before(session.ExpiresAt) && session.PayerAddress != "" {
+				return session.PayerAddress, nil
+			}
+		}
+	}
+	if c.Receipts != nil {
+		if cookie, err := r.Cookie(c.Receipts.name()); err == nil {
+			receipt, err := c.Receipts.Verify(cookie.Value)
+			if err == nil && receipt.Payer != "" && !c.Receipts.isRevoked(receipt.PaymentID) {
+				return receipt.Payer, nil
+			}
+		}
+	}
+	return "", ErrPayerNotAuthenticated
+}
+
+// signedPayer checks address's signature of a recent history message
+func (c PaymentHistoryConfig) signedPayer(r *http.Request, address string) (string, error) {
+	timestamp, err := strconv.ParseInt(r.Header.Get("X-Payer-Timestamp"), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%w: X-Payer-Timestamp must be Unix seconds", ErrPayerNotAuthenticated)
+	}
+	now := time.Now()
+	if c.now != nil {
+		now = c.now()
+	}
+	maxAge := c.MaxSignatureAge
+	if maxAge <= 0 {
+		maxAge = DefaultHistorySignatureAge
+	}
+	if age := now.Sub(time.Unix(timestamp, 0)); age > maxAge || age < -maxAge {
+		return "", fmt.Errorf("%w: signature timestamp is not recent", ErrPayerNotAuthenticated)
+	}
+
+	verify := c.WalletVerifier
+	if verify == nil {
+		verify = VerifyPersonalSign
+	}
+	valid, err := verify(address, PaymentHistoryMessage(address, timestamp), r.Header.Get("X-Payer-Signature"))
+	if err != nil || !valid {
+		return "", fmt.Errorf("%w: signature does not match X-Payer-Address", ErrPayerNotAuthenticated)
+	}
+	return address, nil
+}
+
+// payerRecords returns payer's ledger records, newest first. Ledgers match
+// PayerID exactly, so each spelling of an EVM address is looked up.
+func (c PaymentHistoryConfig) payerRecords(payer string) ([]PaymentRecord, error) {
+	var records []PaymentRecord
+	seen := map[string]bool{}
+	for _, spelling := range []string{payer, strings.ToLower(payer), ChecksumAddress(payer)} {
+		if seen[spelling] {
+			continue
+		}
+		seen[spelling] = true
+		found, err := c.Ledger.List(LedgerFilter{PayerID: spelling})
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, found...)
+	}
+	sort.Slice(records, func(i, j int) bool { return recordKey(records[j]).before(recordKey(records[i])) })
+	return records, nil
+}
+
+// recordKey orders ledger records for paging
+func recordKey(record PaymentRecord) pageKey {
+	return pageKey{created: record.Timestamp, id: record.ID}
+}
+
+// PaymentHistoryHandler serves the authenticated payer's payments, newest
+// first: GET ?limit=...&pageToken=... The payer signs
+// PaymentHistoryMessage(address, timestamp) and sends X-Payer-Address,
+// X-Payer-Timestamp and X-Payer-Signature, or presents a session or receipt
+// cookie the config accepts.
+func PaymentHistoryHandler(config PaymentHistoryConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method != http.MethodGet {
+			http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+			return
+		}
+		_, pageToken, limit, err := ParseListFilter(r.URL.Query())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		payer, err := config.payer(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		records, err := config.payerRecords(payer)
+		if err != nil {
+			http.Error(w, `{"error":"failed to load payments"}`, errorStatus(err))
+			return
+		}
+
+		start := 0
+		if pageToken != "" {
+			after, err := decodePageToken(pageToken)
+			if err != nil {
+				http.Error(w, `{"error":"invalid page token"}`, http.StatusBadRequest)
+				return
+			}
+			for start < len(records) && !recordKey(records[start]).before(after) {
+				start++
+			}
+		}
+		limit = listLimit(limit)
+		end, next := start+limit, ""
+		if end < len(records) {
+			next = encodePageToken(recordKey(records[end-1]))
+		} else {
+			end = len(records)
+		}
+
+		payments := make([]PayerPayment, 0, end-start)
+		for _, record := range records[start:end] {
+			payments = append(payments, payerPayment(record))
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"payer":         payer,
+			"payments":      payments,
+			"count":         len(payments),
+			"nextPageToken": next,
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package x402
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const historyPayer = "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf"
+
+type paymentHistoryPage struct {
+	Payer         string         `json:"payer"`
+	Payments      []PayerPayment `json:"payments"`
+	Count         int            `json:"count"`
+	NextPageToken string         `json:"nextPageToken"`
+}
+
+func newHistoryConfig() PaymentHistoryConfig {
+	ledger := NewInMemoryPaymentLedger(100)
+	base := time.Now().Add(-time.Hour)
+	ledger.Record(PaymentRecord{ID: "pay_1", Timestamp: base, Endpoint: "/api/a", PayerID: strings.ToLower(historyPayer), Amount: 100, Currency: "USDC",
+		Scheme: "exact", Network: "base-sepolia", TransactionID: "0xabc", Metadata: map[string]string{"internal": "secret"}})
+	ledger.Record(PaymentRecord{ID: "pay_2", Timestamp: base.Add(time.Minute), Endpoint: "/api/b", PayerID: historyPayer, Amount: 200, Currency: "USDC"})
+	ledger.Record(PaymentRecord{ID: "pay_3", Timestamp: base.Add(2 * time.Minute), Endpoint: "/api/c", PayerID: historyPayer, Amount: 300, Currency: "USDC"})
+	ledger.Record(PaymentRecord{ID: "pay_other", Timestamp: base.Add(3 * time.Minute), Endpoint: "/api/a", PayerID: "0xsomeoneelse", Amount: 100, Currency: "USDC"})
+	ledger.RecordRefund("pay_1", 40)
+	return PaymentHistoryConfig{Ledger: ledger}
+}
+
+// signedHistoryRequest is a history request signed by key
+func signedHistoryRequest(t *testing.T, key *big.Int, query string, timestamp time.Time) *http.Request {
+	t.Helper()
+	ts := timestamp.Unix()
+	req := httptest.NewRequest("GET", "/payments/mine?"+query, nil)
+	req.Header.Set("X-Payer-Address", historyPayer)
+	req.Header.Set("X-Payer-Timestamp", strconv.FormatInt(ts, 10))
+	req.Header.Set("X-Payer-Signature", personalSign(t, key, PaymentHistoryMessage(historyPayer, ts)))
+	return req
+}
+
+func getPaymentHistory(config PaymentHistoryConfig, req *http.Request) (int, paymentHistoryPage) {
+	w := httptest.NewRecorder()
+	PaymentHistoryHandler(config).ServeHTTP(w, req)
+	var page paymentHistoryPage
+	json.NewDecoder(w.Body).Decode(&page)
+	return w.Code, page
+}
+
+func TestPaymentHistory_ValidSignature(t *testing.T) {
+	config := newHistoryConfig()
+	code, page := getPaymentHistory(config, signedHistoryRequest(t, big.NewInt(1), "", time.Now()))
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if page.Payer != historyPayer || page.Count != 3 {
+		t.Fatalf("Expected the payer's 3 payments, got %+v", page)
+	}
+	for i, id := range []string{"pay_3", "pay_2", "pay_1"} {
+		if page.Payments[i].ID != id {
+			t.Errorf("Payment %d: expected %s, got %s", i, id, page.Payments[i].ID)
+		}
+	}
+	want := PayerPayment{ID: "pay_1", Resource: "/api/a", Amount: 100, Currency: "USDC", Rail: "exact", Network: "base-sepolia",
+		TransactionID: "0xabc", TransactionURL: "https://sepolia.basescan.org/tx/0xabc", Status: PaymentStatusVerified, Refunded: 40}
+	got := page.Payments[2]
+	got.PaidAt = time.Time{}
+	if got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+func TestPaymentHistory_LeavesOutMetadata(t *testing.T) {
+	w := httptest.NewRecorder()
+	PaymentHistoryHandler(newHistoryConfig()).ServeHTTP(w, signedHistoryRequest(t, big.NewInt(1), "", time.Now()))
+	if strings.Contains(w.Body.String(), "secret") || strings.Contains(w.Body.String(), "pay_other") {
+		t.Errorf("Expected only the payer's payments without metadata, got %s", w.Body.String())
+	}
+}
+
+func TestPaymentHistory_Unauthenticated(t *testing.T) {
+	config := newHistoryConfig()
+	stale := signedHistoryRequest(t, big.NewInt(1), "", time.Now().Add(-10*time.Minute))
+	tests := []struct {
+		name string
+		req  *http.Request
+	}{
+		{"wrong signer", signedHistoryRequest(t, big.NewInt(2), "", time.Now())},
+		{"stale signature", stale},
+		{"no credentials", httptest.NewRequest("GET", "/payments/mine", nil)},
+	}
+	for _, tt := range tests {
+		if code, page := getPaymentHistory(config, tt.req); code != http.StatusUnauthorized || len(page.Payments) != 0 {
+			t.Errorf("%s: expected 401 and no payments, got %d %+v", tt.name, code, page)
+		}
+	}
+}
+
+func TestPaymentHistory_Pages(t *testing.T) {
+	config := newHistoryConfig()
+	code, first := getPaymentHistory(config, signedHistoryRequest(t, big.NewInt(1), "limit=2", time.Now()))
+	if code != http.StatusOK || first.Count != 2 || first.NextPageToken == "" {
+		t.Fatalf("Expected a first page of 2 with a token, got %d %+v", code, first)
+	}
+	code, rest := getPaymentHistory(config, signedHistoryRequest(t, big.NewInt(1), "limit=2&pageToken="+first.NextPageToken, time.Now()))
+	if code != http.StatusOK || rest.Count != 1 || rest.NextPageToken != "" || rest.Payments[0].ID != "pay_1" {
+		t.Errorf("Expected the last payment on the second page, got %d %+v", code, rest)
+	}
+	if code, _ := getPaymentHistory(config, signedHistoryRequest(t, big.NewInt(1), "pageToken=abc", time.Now())); code != http.StatusBadRequest {
+		t.Errorf("Expected a bad page token refused with 400, got %d", code)
+	}
+}
+
+func TestPaymentHistory_Session(t *testing.T) {
+	config := newHistoryConfig()
+	sessions := NewInMemorySessionStore()
+	sessions.CreateSession(&Session{ID: "sess_1", PayerAddress: strings.ToLower(historyPayer), Active: true, ExpiresAt: time.Now().Add(time.Hour)})
+	config.Sessions = sessions
+
+	req := httptest.NewRequest("GET", "/payments/mine", nil)
+	req.Header.Set("X-Session-ID", "sess_1")
+	if code, page := getPaymentHistory(config, req); code != http.StatusOK || page.Count != 3 {
+		t.Errorf("Expected the session's payer's 3 payments, got %d %+v", code, page)
+	}
+
+	req = httptest.NewRequest("GET", "/payments/mine", nil)
+	req.Header.Set("X-Session-ID", "sess_missing")
+	if code, _ := getPaymentHistory(config, req); code != http.StatusUnauthorized {
+		t.Errorf("Expected an unknown session refused with 401, got %d", code)
+	}
+}
@@ -0,0 +1,87 @@
+// Package x402 - Payment Info
+// MeteringMiddleware used to record the configured price for every request
+// that wasn't a 402, so metered revenue counted exempt paths, session and
+// receipt requests, and disagreed with the ledger. Payment middlewares now
+// report the payment decision for each request in its context, and metering
+// records an amount only for requests they report paid, linked to the
+// payment's ledger record.
+package x402
+
+import (
+	"context"
+	"net/http"
+)
+
+// Payment types metering records besides the X-Payment-Method values
+const (
+	PaymentTypePerRequest = "per-request"
+	PaymentTypeBudget     = "budget"
+	PaymentTypeUnpaid     = "unpaid"
+	PaymentTypeExempt     = "exempt"
+)
+
+// RequestPaymentInfo is what a payment middleware decided about a request:
+// whether it was paid for, how, and how much. (PaymentInfo is the legacy 402
+// body.)
+type RequestPaymentInfo struct {
+	// Paid is set when a payment was taken or a budget deducted for the
+	// request
+	Paid bool
+
+	// Type is how the request was paid for (PaymentTypePerRequest,
+	// PaymentTypeBudget, PaymentMethodCoupon), or PaymentTypeExempt
+	Type string
+
+	// PaymentID is the payment's ledger record, or the budget deducted
+	PaymentID string
+
+	Payer         string // Set alone for attributed free requests
+	Rail          string
+	Network       string
+	TransactionID string
+	Gross         int64
+	Fee           int64
+	Net           int64
+	Currency      string
+}
+
+// paymentInfoKey is the context key of a request's *RequestPaymentInfo
+type paymentInfoKey struct{}
+
+// paymentInfoFor returns the request's payment info, adding an empty one to
+// the request's context if it has none. Whichever of the payment and
+// metering middlewares runs first adds it, so the payment middleware can fill
+// it in and metering can read it whichever way they are composed.
+func paymentInfoFor(r *http.Request) (*RequestPaymentInfo, *http.Request) {
+	if info, ok := r.Context().Value(paymentInfoKey{}).(*RequestPaymentInfo); ok {
+		return info, r
+	}
+	info := &RequestPaymentInfo{}
+	return info, r.WithContext(context.WithValue(r.Context(), paymentInfoKey{}, info))
+}
+
+// PaymentInfoFromRequest returns what the payment middleware reported about r so
+// far, if any middleware is tracking it
+func PaymentInfoFromRequest(r *http.Request) (RequestPaymentInfo, bool) {
+	info, ok := r.Context().Value(paymentInfoKey{}).(*RequestPaymentInfo)
+	if !ok {
+		return RequestPaymentInfo{}, false
+	}
+	return *info, true
+}
+
+// reportPayment records info as r's payment decision, for metering
+func reportPayment(r *http.Request, info RequestPaymentInfo) *http.Request {
+	if info.Paid && info.Type == "" {
+		info.Type = PaymentTypePerRequest
+	}
+	reported, r := paymentInfoFor(r)
+	*reported = info
+	return r
+}
+
+// reportExempt records that r was served without payment because its path
+// or method is exempt
+func reportExempt(r *http.Request) *http.Request {
+	return reportPayment(r, RequestPaymentInfo{Type: PaymentTypeExempt})
+}
@@ -0,0 +1,126 @@
+// Package x402 - Customer Payment Preferences in 402s
+// Customers who saved a preferred rail during onboarding see it first. When
+// UnifiedPaymentConfig.PaymentPrefs is set and a request names a customer
+// with preferences, the 402's options are ordered with the preferred rail
+// (and network) first and flagged preferred, rails the customer disabled are
+// left out, and, with QuickPay, customers with a saved card are offered a
+// Stripe intent already attached to it.
+package x402
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Where DefaultCustomerResolver finds the customer a request is for
+const (
+	CustomerIDHeader = "X-Customer-ID"
+	CustomerCookie   = "x402_customer"
+)
+
+// CustomerResolver names the PaymentPrefsStore customer a request is for
+// ("" if none)
+type CustomerResolver func(r *http.Request) string
+
+// CustomerFromHeader resolves customers from a request header
+func CustomerFromHeader(name string) CustomerResolver {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// CustomerFromCookie resolves customers from a cookie
+func CustomerFromCookie(name string) CustomerResolver {
+	return func(r *http.Request) string {
+		if cookie, err := r.Cookie(name); err == nil {
+			return cookie.Value
+		}
+		return ""
+	}
+}
+
+// DefaultCustomerResolver reads X-Customer-ID, then the x402_customer cookie
+func DefaultCustomerResolver(r *http.Request) string {
+	if customer := CustomerFromHeader(CustomerIDHeader)(r); customer != "" {
+		return customer
+	}
+	return CustomerFromCookie(CustomerCookie)(r)
+}
+
+// customerPrefs returns the preferences of r's customer, or nil if prefs
+// aren't configured, r names no customer, or they can't be read (the 402 is
+// then sent in the seller's order)
+func (c UnifiedPaymentConfig) customerPrefs(r *http.Request) *CustomerPaymentPrefs {
+	store := c.Tenants.prefsFor(r, c.PaymentPrefs)
+	if store == nil {
+		return nil
+	}
+	resolve := c.Customer
+	if resolve == nil {
+		resolve = DefaultCustomerResolver
+	}
+	customer := resolve(r)
+	if customer == "" {
+		return nil
+	}
+	prefs, err := store.Get(r.Context(), customer)
+	if err != nil {
+		return nil
+	}
+	return prefs
+}
+
+// allows reports whether the customer accepts paying with rail
+func (p *CustomerPaymentPrefs) allows(rail string) bool {
+	if p == nil {
+		return true
+	}
+	for _, disabled := range p.DisabledRails {
+		if disabled == rail {
+			return false
+		}
+	}
+	return true
+}
+
+// quickPay reports whether the customer has a saved card to pay with
+func (p *CustomerPaymentPrefs) quickPay() bool {
+	return p != nil && p.PaymentMethodID != "" && p.StripeCustomerID != ""
+}
+
+// rank orders an option for the customer: their preferred rail on their
+// preferred network (in CAIP-2 or short form) first, then the rest of the
+// preferred rail, then others
+func (p *CustomerPaymentPrefs) rank(rail, network string) int {
+	switch {
+	case rail != p.PreferredRail:
+		return 2
+	case p.PreferredNetwork == "" || network == "" || sameNetwork(NetworkType(network), NetworkType(p.PreferredNetwork)):
+		return 0
+	default:
+		return 1
+	}
+}
+
+// order moves the customer's preferred options to the front and flags the
+// best match preferred; the seller's order is kept otherwise. Crypto
+// requirements on the preferred network move first too, since x402 clients
+// usually pay the first one.
+func (p *CustomerPaymentPrefs) order(options []PaymentOption, accepts []PaymentRequirements) {
+	if p == nil || p.PreferredRail == "" {
+		return
+	}
+	sort.SliceStable(options, func(i, j int) bool {
+		return p.rank(options[i].Rail, options[i].Network) < p.rank(options[j].Rail, options[j].Network)
+	})
+	for i := range options {
+		options[i].Preferred = p.rank(options[i].Rail, options[i].Network) == 0
+	}
+
+	if p.PreferredRail == RailEVMCrypto && p.PreferredNetwork != "" {
+		preferred := func(i int) bool {
+			return sameNetwork(NetworkType(accepts[i].Network), NetworkType(p.PreferredNetwork))
+		}
+		sort.SliceStable(accepts, func(i, j int) bool { return preferred(i) && !preferred(j) })
+	}
+}
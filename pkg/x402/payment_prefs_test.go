@@ -0,0 +1,142 @@
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// prefsTestHandler offers crypto on Base and Base Sepolia and Stripe cards,
+// with alice preferring crypto on Base Sepolia and bob a saved card
+func prefsTestHandler(t *testing.T) (http.Handler, *[]url.Values) {
+	t.Helper()
+	var mu sync.Mutex
+	var forms []url.Values
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		_ = r.ParseForm()
+		forms = append(forms, r.PostForm)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":"pi_%d","amount":%s,"currency":"usd","status":"requires_confirmation","client_secret":"pi_%d_secret"}`, len(forms), r.PostForm.Get("amount"), len(forms))
+	}))
+	t.Cleanup(api.Close)
+
+	stripe := NewStripeRail("sk_test", "")
+	stripe.BaseURL = api.URL
+	registry := NewRailRegistry()
+	registry.Register(stripe)
+
+	prefs := NewInMemoryPaymentPrefsStore()
+	prefs.Set(context.Background(), &CustomerPaymentPrefs{CustomerID: "alice", PreferredRail: RailEVMCrypto, PreferredNetwork: "base-sepolia", DisabledRails: []string{RailStripe}})
+	prefs.Set(context.Background(), &CustomerPaymentPrefs{CustomerID: "bob", PreferredRail: RailStripe, StripeCustomerID: "cus_bob", PaymentMethodID: "pm_bob"})
+
+	return UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		Price:          "0.01",
+		Currency:       "USD",
+		CryptoEnabled:  true,
+		CryptoPayTo:    "0xseller",
+		CryptoAsset:    baseUSDC,
+		CryptoScheme:   "exact",
+		CryptoNetworks: []NetworkType{NetworkBaseMainnet, NetworkBaseSepolia},
+		FiatEnabled:    true,
+		RailRegistry:   registry,
+		PaymentPrefs:   prefs,
+		QuickPay:       true,
+	}), &forms
+}
+
+func paymentOptionsFor(t *testing.T, handler http.Handler, customer *http.Cookie, header string) PaymentOptionsResponse {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/test", nil)
+	if customer != nil {
+		req.AddCookie(customer)
+	}
+	if header != "" {
+		req.Header.Set(CustomerIDHeader, header)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var response PaymentOptionsResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Invalid 402 body: %v", err)
+	}
+	return response
+}
+
+func optionNames(options []PaymentOption) []string {
+	var names []string
+	for _, option := range options {
+		name := option.Rail + ":" + option.Network
+		if option.SavedCard {
+			name += ":saved"
+		}
+		if option.Preferred {
+			name += "*"
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestPaymentOptions_CustomerPreferences(t *testing.T) {
+	handler, forms := prefsTestHandler(t)
+
+	anonymous := optionNames(paymentOptionsFor(t, handler, nil, "").Options)
+	if fmt.Sprint(anonymous) != "[evm-crypto:eip155:8453 evm-crypto:eip155:84532 stripe:]" {
+		t.Errorf("Expected the seller's order without a customer, got %v", anonymous)
+	}
+
+	// alice prefers Base Sepolia and disabled cards
+	response := paymentOptionsFor(t, handler, &http.Cookie{Name: CustomerCookie, Value: "alice"}, "")
+	if got := optionNames(response.Options); fmt.Sprint(got) != "[evm-crypto:eip155:84532* evm-crypto:eip155:8453]" {
+		t.Errorf("Expected Base Sepolia first and no card, got %v", got)
+	}
+	if response.Accepts[0].Network != string(NetworkBaseSepolia) {
+		t.Errorf("Expected the preferred network's requirements first, got %s", response.Accepts[0].Network)
+	}
+
+	// bob prefers his saved card
+	*forms = nil
+	response = paymentOptionsFor(t, handler, nil, "bob")
+	if got := optionNames(response.Options); fmt.Sprint(got) != "[stripe::saved* stripe:* evm-crypto:eip155:8453 evm-crypto:eip155:84532]" {
+		t.Errorf("Expected the saved card then cards first, got %v", got)
+	}
+	if len(*forms) != 2 || (*forms)[0].Get("customer") != "cus_bob" || (*forms)[0].Get("payment_method") != "pm_bob" || (*forms)[0].Get("confirm") != "" {
+		t.Errorf("Expected an unconfirmed intent on bob's saved card, got %v", *forms)
+	}
+	if response.Options[0].ClientSecret != "pi_1_secret" {
+		t.Errorf("Expected the saved card intent's client secret, got %q", response.Options[0].ClientSecret)
+	}
+
+	// Unknown customers see the seller's order
+	if got := optionNames(paymentOptionsFor(t, handler, nil, "carol").Options); fmt.Sprint(got) != fmt.Sprint(anonymous) {
+		t.Errorf("Expected the default order for an unknown customer, got %v", got)
+	}
+}
+
+func TestOnboarding_PreferredRailCannotBeDisabled(t *testing.T) {
+	registry := NewRailRegistry()
+	registry.Register(NewStripeRail("sk_test", ""))
+	prefs := NewInMemoryPaymentPrefsStore()
+	handler := NewOnboardingHandler(UnifiedPaymentConfig{RailRegistry: registry, PaymentPrefs: prefs}, nil)
+
+	w := httptest.NewRecorder()
+	handler.SetPreferredMethod(w, httptest.NewRequest("POST", "/prefs", strings.NewReader(`{"customerId":"dave","rail":"stripe","disabledRails":["stripe"]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.SetPreferredMethod(w, httptest.NewRequest("POST", "/prefs", strings.NewReader(`{"customerId":"dave","rail":"stripe","disabledRails":["evm-crypto"]}`)))
+	saved, _ := prefs.Get(context.Background(), "dave")
+	if w.Code != http.StatusOK || saved == nil || len(saved.DisabledRails) != 1 {
+		t.Errorf("Expected the preferences saved to config.PaymentPrefs, got %d %+v", w.Code, saved)
+	}
+}
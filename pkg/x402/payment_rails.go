@@ -14,13 +14,15 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
-	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -95,8 +97,25 @@ type PaymentIntentRequest struct {
 	// For recurring/subscription payments
 	SetupFutureUsage string `json:"setupFutureUsage,omitempty"` // "on_session", "off_session"
 
+	// PaymentMethodID, with OffSession, charges the customer's saved payment
+	// method right away without them present, e.g. to renew a session
+	PaymentMethodID string `json:"paymentMethodId,omitempty"`
+	OffSession      bool   `json:"offSession,omitempty"`
+
+	// PaymentMethodTypes limits how the intent can be paid, e.g.
+	// ["us_bank_account"] (default: the account's settings)
+	PaymentMethodTypes []string `json:"paymentMethodTypes,omitempty"`
+
 	// Idempotency key
 	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// ExpiresAt is the quote's deadline; rails refuse (and, where possible,
+	// cancel) intents still unpaid when presented after it
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+
+	// StripeAccount creates the intent on this Stripe Connect account, so
+	// the charge is paid out to it ("" = the platform's account)
+	StripeAccount string `json:"stripeAccount,omitempty"`
 }
 
 // PaymentIntent represents a payment intent (Stripe-style)
@@ -148,11 +167,19 @@ type VerifyPaymentRequest struct {
 	PaymentIntentID string `json:"paymentIntentId,omitempty"`
 	PaymentToken    string `json:"paymentToken,omitempty"`
 
+	// For Stripe Checkout: the session and the state it was created with
+	CheckoutSessionID string `json:"checkoutSessionId,omitempty"`
+	CheckoutState     string `json:"checkoutState,omitempty"`
+
 	// Expected payment details
 	ExpectedAmount   int64  `json:"expectedAmount"`
 	ExpectedCurrency string `json:"expectedCurrency"`
 	ExpectedPayTo    string `json:"expectedPayTo"`
 
+	// StripeAccount is the Stripe Connect account the payment must have been
+	// made on ("" = the platform's account)
+	StripeAccount string `json:"stripeAccount,omitempty"`
+
 	// Resource being accessed
 	Resource string `json:"resource"`
 }
@@ -161,6 +188,7 @@ type VerifyPaymentRequest struct {
 type PaymentVerification struct {
 	Valid   bool   `json:"valid"`
 	Message string `json:"message,omitempty"`
+	Reason  string `json:"reason,omitempty"` // Failure reason code when not valid
 
 	// Payment details
 	PaymentID string `json:"paymentId"`
@@ -168,6 +196,13 @@ type PaymentVerification struct {
 	Currency  string `json:"currency"`
 	Payer     string `json:"payer,omitempty"` // Address or customer ID
 
+	// Network the payment was made on, for crypto rails
+	Network string `json:"network,omitempty"`
+
+	// Status is the rail's own payment status where it has one, e.g.
+	// "processing" for bank debits still settling
+	Status string `json:"status,omitempty"`
+
 	// For capture
 	RequiresCapture bool   `json:"requiresCapture"`
 	SettlementData  string `json:"settlementData,omitempty"` // JSON data needed for settlement
@@ -180,9 +215,13 @@ type PaymentVerification struct {
 type CapturePaymentRequest struct {
 	PaymentID string `json:"paymentId"`
 	Amount    int64  `json:"amount,omitempty"` // For partial capture
+	Currency  string `json:"currency,omitempty"`
 
 	// For crypto: additional settlement data
 	SettlementData map[string]interface{} `json:"settlementData,omitempty"`
+
+	// StripeAccount is the Stripe Connect account the payment was made on
+	StripeAccount string `json:"stripeAccount,omitempty"`
 }
 
 // PaymentCapture is the result of payment capture
@@ -201,6 +240,15 @@ type PaymentCapture struct {
 
 	// Timestamps
 	CapturedAt time.Time `json:"capturedAt"`
+
+	// Reason is a Failure* code when Success is false (optional)
+	Reason string `json:"reason,omitempty"`
+
+	// Settlement is the on-chain confirmation, when the rail waited for one
+	Settlement *SettlementResult `json:"settlement,omitempty"`
+
+	// LedgerID is the ledger record the rail added for the payment, if any
+	LedgerID string `json:"ledgerId,omitempty"`
 }
 
 // RefundPaymentRequest is a request to refund a payment
@@ -227,16 +275,46 @@ type StripeRail struct {
 	// Stripe API key
 	SecretKey string
 
-	// Webhook secret for verifying webhooks
+	// Webhook secret for verifying webhooks. WebhookHandler refuses every
+	// delivery without one.
 	WebhookSecret string
 
+	// WebhookTolerance is how far a webhook's signed timestamp may be from
+	// the clock (default DefaultWebhookTolerance)
+	WebhookTolerance time.Duration
+
 	// API base URL (for testing)
 	BaseURL string
 
+	// Subscriptions, if set, enables CreateSubscription and activates
+	// subscriptions from invoice webhooks
+	Subscriptions *SubscriptionConfig
+
+	// Fees estimates Stripe's fee in 402 options and at capture (default
+	// DefaultStripeFees)
+	Fees *FeeSchedule
+
+	// Metrics, if set, records verification and capture latencies
+	Metrics *RailMetrics
+
+	// Ledger, if set, records payments made on Checkout pages when their
+	// checkout.session.completed webhook arrives
+	Ledger PaymentLedger
+
 	// HTTP client
 	client *http.Client
+
+	mu     sync.Mutex
+	events map[string]time.Time // webhook event ID -> when it is forgotten
+
+	// now is stubbed in tests
+	now func() time.Time
 }
 
+// DefaultWebhookTolerance is how old, or how far ahead, a Stripe webhook's
+// signed timestamp may be, as Stripe's own libraries allow
+const DefaultWebhookTolerance = 5 * time.Minute
+
 // NewStripeRail creates a new Stripe payment rail
 func NewStripeRail(secretKey, webhookSecret string) *StripeRail {
 	return &StripeRail{
@@ -267,7 +345,7 @@ func (s *StripeRail) CreatePaymentIntent(ctx context.Context, req *PaymentIntent
 	// Build Stripe API request
 	data := fmt.Sprintf(
 		"amount=%d&currency=%s&description=%s&metadata[resource]=%s",
-		req.Amount,
+		stripeAmount(req.Amount, req.Currency),
 		strings.ToLower(req.Currency),
 		req.Description,
 		req.Resource,
@@ -281,6 +359,22 @@ func (s *StripeRail) CreatePaymentIntent(ctx context.Context, req *PaymentIntent
 		data += "&setup_future_usage=" + req.SetupFutureUsage
 	}
 
+	if req.PaymentMethodID != "" {
+		data += "&payment_method=" + req.PaymentMethodID
+		if req.OffSession {
+			data += "&off_session=true&confirm=true"
+		}
+	}
+
+	for _, methodType := range req.PaymentMethodTypes {
+		data += "&payment_method_types[]=" + methodType
+	}
+
+	// Stripe has no deadline on intents; VerifyPayment enforces this one
+	if req.ExpiresAt != nil {
+		data += fmt.Sprintf("&metadata[expires_at]=%d", req.ExpiresAt.Unix())
+	}
+
 	// Make API request
 	httpReq, err := http.NewRequestWithContext(ctx, "POST", s.BaseURL+"/payment_intents", strings.NewReader(data))
 	if err != nil {
@@ -293,17 +387,18 @@ func (s *StripeRail) CreatePaymentIntent(ctx context.Context, req *PaymentIntent
 	if req.IdempotencyKey != "" {
 		httpReq.Header.Set("Idempotency-Key", req.IdempotencyKey)
 	}
+	setStripeAccount(httpReq, req.StripeAccount)
 
 	resp, err := s.client.Do(httpReq)
 	if err != nil {
-		return nil, fmt.Errorf("stripe API error: %w", err)
+		return nil, &StripeError{Err: err}
 	}
 	defer resp.Body.Close()
 
 	body, _ := io.ReadAll(resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("stripe error: %s", string(body))
+		return nil, newStripeError(resp.StatusCode, body)
 	}
 
 	// Parse response
@@ -333,62 +428,169 @@ func (s *StripeRail) CreatePaymentIntent(ctx context.Context, req *PaymentIntent
 }
 
 func (s *StripeRail) VerifyPayment(ctx context.Context, req *VerifyPaymentRequest) (*PaymentVerification, error) {
-	// Retrieve payment intent from Stripe
+	start := time.Now()
+	verification, err := s.verifyPayment(ctx, req)
+	s.Metrics.observe(s.ID(), RailOpVerify, start, err)
+	return verification, err
+}
+
+func (s *StripeRail) verifyPayment(ctx context.Context, req *VerifyPaymentRequest) (*PaymentVerification, error) {
+	if req.CheckoutSessionID != "" {
+		// Checkout sessions are only created on the platform's account
+		if req.StripeAccount != "" {
+			return &PaymentVerification{
+				Valid:   false,
+				Message: "Checkout sessions can't pay connected accounts",
+				Reason:  FailureInvalidPayment,
+			}, nil
+		}
+		return s.verifyCheckoutSession(ctx, req)
+	}
+
+	// Retrieve payment intent from Stripe. Intents made on another account
+	// aren't found on this one.
 	httpReq, err := http.NewRequestWithContext(ctx, "GET", s.BaseURL+"/payment_intents/"+req.PaymentIntentID, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	httpReq.Header.Set("Authorization", "Bearer "+s.SecretKey)
+	setStripeAccount(httpReq, req.StripeAccount)
 
 	resp, err := s.client.Do(httpReq)
 	if err != nil {
-		return nil, fmt.Errorf("stripe API error: %w", err)
+		return nil, &StripeError{Err: err}
 	}
 	defer resp.Body.Close()
 
 	body, _ := io.ReadAll(resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("stripe error: %s", string(body))
+		return nil, newStripeError(resp.StatusCode, body)
 	}
 
 	var stripeIntent struct {
-		ID       string `json:"id"`
-		Amount   int64  `json:"amount"`
-		Currency string `json:"currency"`
-		Status   string `json:"status"`
-		Customer string `json:"customer"`
+		ID       string            `json:"id"`
+		Amount   int64             `json:"amount"`
+		Currency string            `json:"currency"`
+		Status   string            `json:"status"`
+		Customer string            `json:"customer"`
+		Metadata map[string]string `json:"metadata"`
 	}
 
 	if err := json.Unmarshal(body, &stripeIntent); err != nil {
 		return nil, fmt.Errorf("failed to parse response: %w", err)
 	}
 
+	// An unpaid intent past its quote's deadline is canceled so it can't be
+	// paid at the stale price later
+	expired := false
+	if expiresAt, err := strconv.ParseInt(stripeIntent.Metadata["expires_at"], 10, 64); err == nil && stripeIntent.Status != "succeeded" {
+		expired = paymentExpired(time.Unix(expiresAt, 0), s.clock())
+		if expired && stripeIntent.Status != "canceled" {
+			s.cancelPaymentIntent(ctx, stripeIntent.ID, req.StripeAccount)
+		}
+	}
+
 	// Verify amount matches
-	valid := stripeIntent.Status == "succeeded" &&
-		stripeIntent.Amount >= req.ExpectedAmount &&
-		strings.EqualFold(stripeIntent.Currency, req.ExpectedCurrency)
+	reason := ""
+	switch {
+	case expired:
+		reason = FailureExpired
+	case stripeIntent.Status == "canceled":
+		reason = FailureDeclined
+	case stripeIntent.Status != "succeeded":
+		reason = FailurePaymentIncomplete
+	case !strings.EqualFold(stripeIntent.Currency, req.ExpectedCurrency):
+		// Amounts in different currencies aren't comparable; callers with a
+		// CurrencyConverter can still accept it
+		reason = FailureCurrencyMismatch
+	case stripeIntent.Amount < req.ExpectedAmount:
+		reason = FailureAmountMismatch
+	}
 
 	return &PaymentVerification{
-		Valid:           valid,
+		Valid:           reason == "",
 		Message:         fmt.Sprintf("Payment status: %s", stripeIntent.Status),
+		Reason:          reason,
 		PaymentID:       stripeIntent.ID,
 		Amount:          stripeIntent.Amount,
 		Currency:        strings.ToUpper(stripeIntent.Currency),
 		Payer:           stripeIntent.Customer,
+		Status:          stripeIntent.Status,
 		RequiresCapture: stripeIntent.Status == "requires_capture",
 		VerifiedAt:      time.Now(),
 	}, nil
 }
 
+// stripeAmount is amount (in currency's smallest unit) as Stripe charges it.
+// Stripe takes three-decimal currencies in thousandths but only charges whole
+// hundredths, so those round up to a multiple of ten.
+func stripeAmount(amount int64, currency string) int64 {
+	if currencyDecimals(currency) == 3 && amount%10 != 0 {
+		return amount + 10 - amount%10
+	}
+	return amount
+}
+
+// cancelPaymentIntent cancels an intent, ignoring failures: an intent that
+// can no longer be canceled has already completed or been canceled
+func (s *StripeRail) cancelPaymentIntent(ctx context.Context, id, account string) {
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", s.BaseURL+"/payment_intents/"+id+"/cancel", nil)
+	if err != nil {
+		return
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+s.SecretKey)
+	setStripeAccount(httpReq, account)
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
+
+// setStripeAccount makes httpReq on a Stripe Connect account, if one is named
+func setStripeAccount(httpReq *http.Request, account string) {
+	if account != "" {
+		httpReq.Header.Set("Stripe-Account", account)
+	}
+}
+
+// EstimateFee returns the fee on amount in currency for a domestic card
+func (s *StripeRail) EstimateFee(amount int64, currency string) int64 {
+	return s.fees().Estimate(amount, currency, "")
+}
+
+func (s *StripeRail) fees() *FeeSchedule {
+	if s.Fees == nil {
+		return DefaultStripeFees()
+	}
+	return s.Fees
+}
+
+func (s *StripeRail) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
 func (s *StripeRail) CapturePayment(ctx context.Context, req *CapturePaymentRequest) (*PaymentCapture, error) {
+	start := time.Now()
+	capture, err := s.capturePayment(ctx, req)
+	s.Metrics.observe(s.ID(), RailOpCapture, start, err)
+	return capture, err
+}
+
+func (s *StripeRail) capturePayment(ctx context.Context, req *CapturePaymentRequest) (*PaymentCapture, error) {
 	// Capture the payment intent
 	url := fmt.Sprintf("%s/payment_intents/%s/capture", s.BaseURL, req.PaymentID)
 
-	data := ""
+	// The charge says where the card was issued, for region fees
+	data := "expand[]=latest_charge"
 	if req.Amount > 0 {
-		data = fmt.Sprintf("amount_to_capture=%d", req.Amount)
+		data += fmt.Sprintf("&amount_to_capture=%d", stripeAmount(req.Amount, req.Currency))
 	}
 
 	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(data))
@@ -398,31 +600,42 @@ func (s *StripeRail) CapturePayment(ctx context.Context, req *CapturePaymentRequ
 
 	httpReq.Header.Set("Authorization", "Bearer "+s.SecretKey)
 	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	setStripeAccount(httpReq, req.StripeAccount)
 
 	resp, err := s.client.Do(httpReq)
 	if err != nil {
-		return nil, fmt.Errorf("stripe API error: %w", err)
+		return nil, &StripeError{Err: err}
 	}
 	defer resp.Body.Close()
 
 	body, _ := io.ReadAll(resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("stripe error: %s", string(body))
+		return nil, newStripeError(resp.StatusCode, body)
 	}
 
 	var stripeIntent struct {
-		ID     string `json:"id"`
-		Amount int64  `json:"amount"`
-		Status string `json:"status"`
+		ID           string          `json:"id"`
+		Amount       int64           `json:"amount"`
+		Currency     string          `json:"currency"`
+		Status       string          `json:"status"`
+		LatestCharge json.RawMessage `json:"latest_charge"`
 	}
 
 	if err := json.Unmarshal(body, &stripeIntent); err != nil {
 		return nil, fmt.Errorf("failed to parse response: %w", err)
 	}
 
-	// Stripe typically charges 2.9% + $0.30
-	feeAmount := int64(float64(stripeIntent.Amount)*0.029) + 30
+	// latest_charge is an ID unless expanded, so its country is optional
+	var charge struct {
+		PaymentMethodDetails struct {
+			Card struct {
+				Country string `json:"country"`
+			} `json:"card"`
+		} `json:"payment_method_details"`
+	}
+	_ = json.Unmarshal(stripeIntent.LatestCharge, &charge)
+	feeAmount := s.fees().Estimate(stripeIntent.Amount, strings.ToUpper(stripeIntent.Currency), charge.PaymentMethodDetails.Card.Country)
 
 	return &PaymentCapture{
 		Success:       stripeIntent.Status == "succeeded",
@@ -453,14 +666,14 @@ func (s *StripeRail) RefundPayment(ctx context.Context, req *RefundPaymentReques
 
 	resp, err := s.client.Do(httpReq)
 	if err != nil {
-		return nil, fmt.Errorf("stripe API error: %w", err)
+		return nil, &StripeError{Err: err}
 	}
 	defer resp.Body.Close()
 
 	body, _ := io.ReadAll(resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("stripe error: %s", string(body))
+		return nil, newStripeError(resp.StatusCode, body)
 	}
 
 	var stripeRefund struct {
@@ -489,10 +702,8 @@ func (s *StripeRail) WebhookHandler() http.Handler {
 			return
 		}
 
-		// Verify webhook signature
-		sigHeader := r.Header.Get("Stripe-Signature")
-		if !s.verifyWebhookSignature(body, sigHeader) {
-			http.Error(w, "Invalid signature", http.StatusBadRequest)
+		eventID, ok := s.acceptWebhook(w, body, r.Header.Get("Stripe-Signature"))
+		if !ok {
 			return
 		}
 
@@ -508,6 +719,7 @@ func (s *StripeRail) WebhookHandler() http.Handler {
 		}
 
 		// Handle event types
+		var handleErr error
 		switch event.Type {
 		case "payment_intent.succeeded":
 			// Payment successful - grant access
@@ -515,20 +727,109 @@ func (s *StripeRail) WebhookHandler() http.Handler {
 			// Payment failed - deny access
 		case "charge.refunded":
 			// Handle refund
+		case "checkout.session.completed":
+			if s.Ledger != nil {
+				handleErr = s.recordCheckout(event.Data)
+			}
+		case "invoice.paid":
+			if s.Subscriptions != nil && s.Subscriptions.Store != nil {
+				handleErr = s.activateSubscription(event.Data)
+			}
+		case "customer.subscription.deleted":
+			if s.Subscriptions != nil && s.Subscriptions.Store != nil {
+				handleErr = s.cancelSubscription(event.Data)
+			}
+		}
+
+		// A failed update is retried by Stripe
+		if handleErr != nil {
+			s.releaseEvent(eventID)
+			http.Error(w, "Failed to handle event", http.StatusInternalServerError)
+			return
 		}
 
 		w.WriteHeader(http.StatusOK)
 	})
 }
 
+// acceptWebhook checks a delivery's signature and timestamp and claims its
+// event ID, so a replayed or duplicate event is handled once. It answers
+// the delivery and reports false unless the event should be handled; a
+// handler that then fails calls releaseEvent so Stripe's retry is handled.
+func (s *StripeRail) acceptWebhook(w http.ResponseWriter, body []byte, sigHeader string) (string, bool) {
+	if s.WebhookSecret == "" {
+		log.Printf("x402: refusing Stripe webhook: no WebhookSecret configured")
+		http.Error(w, "Webhook secret not configured", http.StatusInternalServerError)
+		return "", false
+	}
+	if !s.verifyWebhookSignature(body, sigHeader) {
+		http.Error(w, "Invalid signature", http.StatusBadRequest)
+		return "", false
+	}
+	var event struct {
+		ID string `json:"id"`
+	}
+	if json.Unmarshal(body, &event) != nil || event.ID == "" {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return "", false
+	}
+	if !s.claimEvent(event.ID) {
+		// Already handled: acknowledge it so Stripe stops sending it
+		w.WriteHeader(http.StatusOK)
+		return "", false
+	}
+	return event.ID, true
+}
+
+func (s *StripeRail) webhookTolerance() time.Duration {
+	if s.WebhookTolerance > 0 {
+		return s.WebhookTolerance
+	}
+	return DefaultWebhookTolerance
+}
+
+// claimEvent marks webhook event id handled, reporting false if it already
+// was. IDs are kept for twice the tolerance, past which a replay of the
+// delivery is refused for its timestamp.
+func (s *StripeRail) claimEvent(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock()
+	if s.events == nil {
+		s.events = make(map[string]time.Time)
+	}
+	for event, forget := range s.events {
+		if !now.Before(forget) {
+			delete(s.events, event)
+		}
+	}
+	if _, ok := s.events[id]; ok {
+		return false
+	}
+	s.events[id] = now.Add(2 * s.webhookTolerance())
+	return true
+}
+
+// releaseEvent makes event id handleable again, for events that failed
+func (s *StripeRail) releaseEvent(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.events, id)
+}
+
+// verifyWebhookSignature reports whether sigHeader holds a v1 signature of
+// payload by WebhookSecret, with a timestamp within the tolerance
 func (s *StripeRail) verifyWebhookSignature(payload []byte, sigHeader string) bool {
 	if s.WebhookSecret == "" {
-		return true // Skip verification if no secret configured
+		return false
 	}
 
-	// Parse signature header: t=timestamp,v1=signature
+	// Parse signature header: t=timestamp,v1=signature. Stripe sends a v1
+	// signature for each active secret while one is being rolled.
 	parts := strings.Split(sigHeader, ",")
-	var timestamp, signature string
+	var timestamp string
+	var signatures []string
 	for _, part := range parts {
 		kv := strings.SplitN(part, "=", 2)
 		if len(kv) == 2 {
@@ -536,10 +837,17 @@ func (s *StripeRail) verifyWebhookSignature(payload []byte, sigHeader string) bo
 			case "t":
 				timestamp = kv[1]
 			case "v1":
-				signature = kv[1]
+				signatures = append(signatures, kv[1])
 			}
 		}
 	}
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := s.clock().Sub(time.Unix(signedAt, 0)); age > s.webhookTolerance() || age < -s.webhookTolerance() {
+		return false
+	}
 
 	// Compute expected signature
 	signedPayload := timestamp + "." + string(payload)
@@ -547,7 +855,12 @@ func (s *StripeRail) verifyWebhookSignature(payload []byte, sigHeader string) bo
 	mac.Write([]byte(signedPayload))
 	expectedSig := hex.EncodeToString(mac.Sum(nil))
 
-	return hmac.Equal([]byte(signature), []byte(expectedSig))
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(expectedSig)) {
+			return true
+		}
+	}
+	return false
 }
 
 // ===============================================
@@ -565,6 +878,17 @@ type EVMCryptoRail struct {
 	// Supported networks
 	Networks []NetworkType
 
+	// Confirmation, if set, waits for settlements to be mined (see
+	// ConfirmationPolicy); RPCEndpoints must cover the settled networks
+	Confirmation *ConfirmationPolicy
+
+	// Fees models facilitator fees on settlements (default none; gas is
+	// paid by the sender)
+	Fees *FeeSchedule
+
+	// Metrics, if set, records verification and capture latencies
+	Metrics *RailMetrics
+
 	client *http.Client
 }
 
@@ -582,6 +906,11 @@ func (e *EVMCryptoRail) ID() string {
 	return "evm-crypto"
 }
 
+// EstimateFee returns the facilitator's fee on amount (none by default)
+func (e *EVMCryptoRail) EstimateFee(amount int64, currency string) int64 {
+	return e.Fees.Estimate(amount, currency, "")
+}
+
 func (e *EVMCryptoRail) DisplayName() string {
 	return "Cryptocurrency (Base, Ethereum)"
 }
@@ -612,16 +941,23 @@ func (e *EVMCryptoRail) CreatePaymentIntent(ctx context.Context, req *PaymentInt
 }
 
 func (e *EVMCryptoRail) VerifyPayment(ctx context.Context, req *VerifyPaymentRequest) (*PaymentVerification, error) {
+	start := time.Now()
+	verification, err := e.verifyPayment(ctx, req)
+	e.Metrics.observe(e.ID(), RailOpVerify, start, err)
+	return verification, err
+}
+
+func (e *EVMCryptoRail) verifyPayment(ctx context.Context, req *VerifyPaymentRequest) (*PaymentVerification, error) {
 	// Decode the base64 X-PAYMENT header
-	paymentBytes, err := base64.StdEncoding.DecodeString(req.PaymentPayload)
+	paymentBytes, err := decodeBase64(req.PaymentPayload)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode payment payload: %w", err)
+		return nil, fmt.Errorf("%w: failed to decode payment payload: %w", ErrInvalidPayment, err)
 	}
 
 	// Parse the payment payload to get x402Version and structured data
 	var paymentPayload map[string]interface{}
 	if err := json.Unmarshal(paymentBytes, &paymentPayload); err != nil {
-		return nil, fmt.Errorf("failed to parse payment payload: %w", err)
+		return nil, fmt.Errorf("%w: failed to parse payment payload: %w", ErrInvalidPayment, err)
 	}
 
 	// Get x402Version (default to 1 if not present)
@@ -667,7 +1003,7 @@ func (e *EVMCryptoRail) VerifyPayment(ctx context.Context, req *VerifyPaymentReq
 
 	resp, err := e.client.Do(httpReq)
 	if err != nil {
-		return nil, fmt.Errorf("facilitator API error: %w", err)
+		return nil, &FacilitatorError{Op: "verify", Err: err}
 	}
 	defer resp.Body.Close()
 
@@ -675,6 +1011,9 @@ func (e *EVMCryptoRail) VerifyPayment(ctx context.Context, req *VerifyPaymentReq
 
 	// Debug: Log the facilitator response
 	fmt.Printf("[DEBUG] Facilitator response (status %d): %s\n", resp.StatusCode, string(body))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, &FacilitatorError{Op: "verify", StatusCode: resp.StatusCode, Message: string(body)}
+	}
 
 	// The facilitator returns isValid (camelCase), not valid
 	var verifyResp struct {
@@ -704,13 +1043,32 @@ func (e *EVMCryptoRail) VerifyPayment(ctx context.Context, req *VerifyPaymentReq
 	}
 	settlementJSON, _ := json.Marshal(settlementData)
 
+	reason := ""
+	if !verifyResp.IsValid {
+		reason = FailureFacilitatorRejected
+	}
+
+	// The payload names its network; the requirements' is the fallback
+	network, _ := paymentPayload["network"].(string)
+	if network == "" {
+		network, _ = paymentRequirements["network"].(string)
+	}
+
+	// Use the first 16 chars as ID
+	paymentID := req.PaymentPayload
+	if len(paymentID) > 16 {
+		paymentID = paymentID[:16]
+	}
+
 	return &PaymentVerification{
 		Valid:           verifyResp.IsValid,
 		Message:         message,
-		PaymentID:       req.PaymentPayload[:16], // Use first 16 chars as ID
+		Reason:          reason,
+		PaymentID:       paymentID,
 		Amount:          req.ExpectedAmount,
 		Currency:        req.ExpectedCurrency,
 		Payer:           verifyResp.Payer,
+		Network:         network,
 		RequiresCapture: true, // Enable on-chain settlement
 		SettlementData:  string(settlementJSON),
 		VerifiedAt:      time.Now(),
@@ -718,6 +1076,13 @@ func (e *EVMCryptoRail) VerifyPayment(ctx context.Context, req *VerifyPaymentReq
 }
 
 func (e *EVMCryptoRail) CapturePayment(ctx context.Context, req *CapturePaymentRequest) (*PaymentCapture, error) {
+	start := time.Now()
+	capture, err := e.capturePayment(ctx, req)
+	e.Metrics.observe(e.ID(), RailOpCapture, start, err)
+	return capture, err
+}
+
+func (e *EVMCryptoRail) capturePayment(ctx context.Context, req *CapturePaymentRequest) (*PaymentCapture, error) {
 	// The facilitator expects the same format as verify, but at /settle endpoint
 	// Parse the settlement data we stored during verification
 	var settlementData map[string]interface{}
@@ -755,7 +1120,7 @@ func (e *EVMCryptoRail) CapturePayment(ctx context.Context, req *CapturePaymentR
 
 	resp, err := e.client.Do(httpReq)
 	if err != nil {
-		return nil, fmt.Errorf("facilitator API error: %w", err)
+		return nil, &FacilitatorError{Op: "settle", Err: err}
 	}
 	defer resp.Body.Close()
 
@@ -763,6 +1128,9 @@ func (e *EVMCryptoRail) CapturePayment(ctx context.Context, req *CapturePaymentR
 
 	// Debug: Log the response
 	fmt.Printf("[DEBUG] Facilitator settle response (status %d): %s\n", resp.StatusCode, string(body))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, &FacilitatorError{Op: "settle", StatusCode: resp.StatusCode, Message: string(body)}
+	}
 
 	var settleResp struct {
 		Success       bool   `json:"success"`
@@ -782,15 +1150,27 @@ func (e *EVMCryptoRail) CapturePayment(ctx context.Context, req *CapturePaymentR
 		txURL = fmt.Sprintf("https://sepolia.basescan.org/tx/%s", settleResp.TransactionID)
 	}
 
-	return &PaymentCapture{
+	fee := e.Fees.Estimate(req.Amount, "", "")
+	capture := &PaymentCapture{
 		Success:        settleResp.Success,
 		TransactionID:  settleResp.TransactionID,
 		TransactionURL: txURL,
 		GrossAmount:    req.Amount,
-		NetAmount:      req.Amount, // No fees for on-chain settlement (gas paid separately)
-		FeeAmount:      0,
+		NetAmount:      req.Amount - fee,
+		FeeAmount:      fee,
 		CapturedAt:     time.Now(),
-	}, nil
+	}
+
+	// A broadcast transaction can still revert; wait for it if configured
+	if e.Confirmation != nil && capture.Success && capture.TransactionID != "" {
+		e.confirmSettlement(ctx, settlement{
+			TransactionID: settleResp.TransactionID,
+			Network:       settleResp.Network,
+			Payer:         settleResp.Payer,
+			Amount:        req.Amount,
+		}, capture)
+	}
+	return capture, nil
 }
 
 func (e *EVMCryptoRail) RefundPayment(ctx context.Context, req *RefundPaymentRequest) (*PaymentRefund, error) {
@@ -813,29 +1193,59 @@ func (e *EVMCryptoRail) WebhookHandler() http.Handler {
 
 // RailRegistry manages registered payment rails
 type RailRegistry struct {
-	rails map[string]PaymentRail
+	mu     sync.RWMutex
+	rails  map[string]PaymentRail
+	frozen bool
 }
 
-// NewRailRegistry creates a new payment rail registry
+// NewRailRegistry creates a new, empty payment rail registry
 func NewRailRegistry() *RailRegistry {
 	return &RailRegistry{
 		rails: make(map[string]PaymentRail),
 	}
 }
 
+// NewDefaultRailRegistry creates a new registry holding the standard rails
+// config enables: Stripe when FiatEnabled with a StripeSecretKey, and EVM
+// crypto when CryptoEnabled with a FacilitatorURL. UnifiedPaymentMiddleware
+// uses one when config.RailRegistry is nil.
+func NewDefaultRailRegistry(config UnifiedPaymentConfig) *RailRegistry {
+	registry := NewRailRegistry()
+	if config.FiatEnabled && config.StripeSecretKey != "" {
+		stripeRail := NewStripeRail(config.StripeSecretKey, config.StripeWebhookSecret)
+		stripeRail.Subscriptions = config.Subscriptions
+		stripeRail.Fees = config.StripeFees
+		registry.Register(stripeRail)
+	}
+	if config.CryptoEnabled && config.FacilitatorURL != "" {
+		registry.Register(NewEVMCryptoRail(config.FacilitatorURL, config.CryptoNetworks))
+	}
+	return registry
+}
+
 // Register registers a payment rail
 func (r *RailRegistry) Register(rail PaymentRail) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.frozen {
+		log.Printf("x402: ignoring %s rail registered on the deprecated DefaultRailRegistry; set UnifiedPaymentConfig.RailRegistry instead", rail.ID())
+		return
+	}
 	r.rails[rail.ID()] = rail
 }
 
 // Get retrieves a payment rail by ID
 func (r *RailRegistry) Get(id string) (PaymentRail, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	rail, ok := r.rails[id]
 	return rail, ok
 }
 
 // List returns all registered rails
 func (r *RailRegistry) List() []PaymentRail {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	rails := make([]PaymentRail, 0, len(r.rails))
 	for _, rail := range r.rails {
 		rails = append(rails, rail)
@@ -845,6 +1255,8 @@ func (r *RailRegistry) List() []PaymentRail {
 
 // ListByType returns rails of a specific type
 func (r *RailRegistry) ListByType(railType RailType) []PaymentRail {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	rails := make([]PaymentRail, 0)
 	for _, rail := range r.rails {
 		if rail.Type() == railType {
@@ -854,8 +1266,11 @@ func (r *RailRegistry) ListByType(railType RailType) []PaymentRail {
 	return rails
 }
 
-// DefaultRailRegistry is the global rail registry
-var DefaultRailRegistry = NewRailRegistry()
+// DefaultRailRegistry is an empty registry that can't be changed.
+//
+// Deprecated: middlewares never read it. Set UnifiedPaymentConfig.RailRegistry,
+// or leave it nil for NewDefaultRailRegistry(config).
+var DefaultRailRegistry = &RailRegistry{rails: make(map[string]PaymentRail), frozen: true}
 
 // ===============================================
 // X402 PAYMENT OPTIONS RESPONSE
@@ -889,6 +1304,19 @@ type PaymentOption struct {
 
 	// Estimated fees (for display)
 	EstimatedFee int64 `json:"estimatedFee,omitempty"`
+
+	// SettlementNote says how long the payment takes to settle, for rails
+	// slower than cards
+	SettlementNote string `json:"settlementNote,omitempty"`
+
+	// For hosted payment pages: where to send the buyer
+	NextAction *PaymentNextAction `json:"nextAction,omitempty"`
+
+	// Preferred marks the option matching the customer's saved preference
+	Preferred bool `json:"preferred,omitempty"`
+
+	// SavedCard marks a Stripe intent attached to the customer's saved card
+	SavedCard bool `json:"savedCard,omitempty"`
 }
 
 // PaymentOptionsResponse is the enhanced 402 response with multiple payment options
@@ -902,9 +1330,27 @@ type PaymentOptionsResponse struct {
 	Accepts []PaymentRequirements `json:"accepts"`
 
 	// Resource info
-	Resource    string `json:"resource"`
-	Description string `json:"description"`
+	Resource     string                 `json:"resource"`
+	Description  string                 `json:"description"`
+	MimeType     string                 `json:"mimeType,omitempty"`
+	OutputSchema map[string]interface{} `json:"outputSchema,omitempty"`
 
-	// Error message
+	// Error message, and its code for refused payments (e.g. EXPIRED_PAYMENT)
 	Error string `json:"error,omitempty"`
+	Code  string `json:"code,omitempty"`
+
+	// ValidUntil is the Unix time the quoted options expire
+	ValidUntil int64 `json:"validUntil,omitempty"`
+
+	// RequirementsHash identifies the offer in Accepts, ignoring expiry
+	RequirementsHash string `json:"requirementsHash,omitempty"`
+
+	// Session purchase info when sessions are enabled
+	Session *SubscriptionInfo `json:"session,omitempty"`
+
+	// Pre-auth, batch and retry guidance; sessions are in Session
+	Extensions *PaymentExtensions `json:"extensions,omitempty"`
+
+	// Stripe subscription plans when subscriptions are configured
+	Subscriptions *SubscriptionOffer `json:"subscriptions,omitempty"`
 }
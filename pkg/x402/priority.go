@@ -0,0 +1,119 @@
+// Package x402 - Agent Priority
+// Agents say how urgent a request is in X-Agent-Priority. A PriorityPolicy
+// prices that urgency (high priority costing more, low priority less) and,
+// when the server is saturated, sheds low-priority requests with a 429 so
+// high-priority ones keep being served. The payment middleware inside
+// AIAgentMiddleware charges, quotes and verifies the adjusted price.
+package x402
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Agent priorities, as sent in X-Agent-Priority
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+// PriorityPolicy prices and admits requests by agent priority
+type PriorityPolicy struct {
+	// Multipliers scale the price per priority, e.g. {"high": 1.5,
+	// "low": 0.8}. Priorities without one pay the normal price.
+	Multipliers map[string]float64
+
+	// MaxConcurrent, if set, is how many requests may be in flight before
+	// the server counts as saturated and sheds low-priority ones
+	MaxConcurrent int64
+
+	// RetryAfter is what shed requests are told to wait (default 1s)
+	RetryAfter time.Duration
+
+	inFlight atomic.Int64
+}
+
+// priority normalizes an X-Agent-Priority value ("" and unknown values are
+// normal)
+func priority(value string) string {
+	switch p := strings.ToLower(strings.TrimSpace(value)); p {
+	case PriorityLow, PriorityHigh:
+		return p
+	}
+	return PriorityNormal
+}
+
+// multiplier is the price multiplier for priority p
+func (p *PriorityPolicy) multiplier(priority string) float64 {
+	if p == nil {
+		return 1
+	}
+	if m, ok := p.Multipliers[priority]; ok && m >= 0 {
+		return m
+	}
+	return 1
+}
+
+// admit counts a request of priority in flight, or reports false to shed
+// it. Admitted requests call the returned done when finished.
+func (p *PriorityPolicy) admit(priority string) (done func(), ok bool) {
+	if p == nil || p.MaxConcurrent <= 0 {
+		return func() {}, true
+	}
+	if n := p.inFlight.Add(1); n > p.MaxConcurrent && priority == PriorityLow {
+		p.inFlight.Add(-1)
+		return nil, false
+	}
+	return func() { p.inFlight.Add(-1) }, true
+}
+
+// retryAfter is how long shed requests should wait, in whole seconds
+func (p *PriorityPolicy) retryAfter() int {
+	if p.RetryAfter <= 0 {
+		return 1
+	}
+	return int(math.Ceil(p.RetryAfter.Seconds()))
+}
+
+type priceMultiplierKey struct{}
+
+// withPriceMultiplier has payment middleware inside scale r's price by m
+func withPriceMultiplier(r *http.Request, m float64) *http.Request {
+	if m == 1 {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), priceMultiplierKey{}, m))
+}
+
+// scalePrice applies r's priority multiplier to price
+func scalePrice(r *http.Request, price int64) int64 {
+	m, ok := r.Context().Value(priceMultiplierKey{}).(float64)
+	if !ok {
+		return price
+	}
+	return int64(math.Round(float64(price) * m))
+}
+
+// shedRequest answers a low-priority request shed under load, asking it to
+// wait the policy's RetryAfter or, with a RetryPolicy, at least that
+func shedRequest(w http.ResponseWriter, r *http.Request, policy *PriorityPolicy, retries *RetryPolicy) {
+	retry := policy.retryAfter()
+	if retries != nil {
+		retry = max(retry, retries.Strategy(r, http.StatusTooManyRequests).RetryAfterSec)
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	sendAIError(w, "", generateRequestID(r), time.Now(), AIError{
+		Code:       ErrCodeRateLimited,
+		Message:    "Server is saturated; low-priority requests are shed",
+		Retryable:  true,
+		RetryAfter: retry,
+		Action:     "retry",
+		Details:    map[string]string{"priority": PriorityLow},
+	})
+}
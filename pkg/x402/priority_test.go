@@ -0,0 +1,174 @@
+package x402
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingScheme accepts every payment and records what it was verified
+// against
+type recordingScheme struct {
+	mu       sync.Mutex
+	verified []PaymentRequirements
+}
+
+func (s *recordingScheme) Type() SchemeType                 { return SchemeExact }
+func (s *recordingScheme) SupportedNetworks() []NetworkType { return []NetworkType{NetworkBaseMainnet} }
+
+func (s *recordingScheme) Verify(ctx context.Context, payload *PaymentPayload, requirements *PaymentRequirements) (*VerificationResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.verified = append(s.verified, *requirements)
+	return &VerificationResult{Valid: true, Network: payload.Network}, nil
+}
+
+func (s *recordingScheme) Settle(ctx context.Context, payload *PaymentPayload, requirements *PaymentRequirements) (*SettlementResult, error) {
+	return &SettlementResult{Success: true}, nil
+}
+
+func TestAIAgentMiddleware_PricesByPriority(t *testing.T) {
+	scheme := &recordingScheme{}
+	registry := NewSchemeRegistry()
+	registry.Register(scheme)
+	config := MultiSchemeConfig{
+		Config: Config{
+			PayTo:                 "0xseller",
+			PricePerRequest:       100,
+			Currency:              "USDC",
+			PaymentRequiredFormat: FormatX402,
+		},
+		AcceptedSchemes:  []SchemeType{SchemeExact},
+		AcceptedNetworks: []NetworkType{NetworkBaseMainnet},
+		SchemeRegistry:   registry,
+	}
+	handler := AIAgentMiddleware(MultiSchemeMiddleware(createTestHandler(), config), config.Config, AIAgentConfig{
+		EnableCostEstimation: true,
+		Priority:             &PriorityPolicy{Multipliers: map[string]float64{PriorityHigh: 1.5, PriorityLow: 0.8}},
+	})
+
+	request := func(priority string, paid bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-Agent-Task-ID", "task-1")
+		req.Header.Set("X-Agent-Priority", priority)
+		if paid {
+			payload, _ := json.Marshal(PaymentPayload{Scheme: SchemeExact, Network: NetworkBaseMainnet, Payer: "0xagent"})
+			req.Header.Set("X-PAYMENT", base64.StdEncoding.EncodeToString(payload))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for priority, want := range map[string]string{"high": "150", "low": "80", "": "100", "urgent": "100"} {
+		w := request(priority, false)
+		var response PaymentRequiredResponse
+		json.NewDecoder(w.Body).Decode(&response)
+		if w.Code != http.StatusPaymentRequired || len(response.Accepts) == 0 || response.Accepts[0].MaxAmountRequired != want {
+			t.Errorf("Priority %q: expected a 402 quoting %s, got %d %+v", priority, want, w.Code, response.Accepts)
+		}
+	}
+
+	w := request("HIGH", true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the high-priority payment accepted, got %d", w.Code)
+	}
+	if len(scheme.verified) != 1 || scheme.verified[0].MaxAmountRequired != "150" {
+		t.Errorf("Expected the payment verified for 150, got %+v", scheme.verified)
+	}
+	if w.Header().Get("X-Actual-Cost") != "150" || w.Header().Get("X-Price-Multiplier") != "1.5" {
+		t.Errorf("Expected X-Actual-Cost 150 at 1.5x, got %q at %q", w.Header().Get("X-Actual-Cost"), w.Header().Get("X-Price-Multiplier"))
+	}
+}
+
+func TestAIAgentMiddleware_ShedsLowPriorityWhenSaturated(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Block") != "" {
+			close(started)
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := AIAgentMiddleware(next, testConfig(), AIAgentConfig{
+		Priority: &PriorityPolicy{MaxConcurrent: 1, RetryAfter: 2 * time.Second},
+	})
+
+	request := func(priority string, block bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-Agent-Task-ID", "task-1")
+		req.Header.Set("X-Agent-Priority", priority)
+		if block {
+			req.Header.Set("X-Block", "true")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// One request in flight saturates the server
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		request("normal", true)
+	}()
+	<-started
+
+	w := request("low", false)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("Expected the low-priority request shed with Retry-After 2, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := request("high", false); w.Code != http.StatusOK {
+		t.Errorf("Expected the high-priority request served while saturated, got %d", w.Code)
+	}
+
+	close(release)
+	<-done
+	if w := request("low", false); w.Code != http.StatusOK {
+		t.Errorf("Expected low priority served once load drops, got %d", w.Code)
+	}
+}
+
+func TestAIAgentMiddleware_UnifiedChargesByPriority(t *testing.T) {
+	rail := &recordingRail{EVMCryptoRail: NewEVMCryptoRail("", nil)}
+	registry := NewRailRegistry()
+	registry.Register(rail)
+	unified := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		PricePerRequest: 100,
+		Currency:        "USDC",
+		CryptoEnabled:   true,
+		CryptoPayTo:     "0xseller",
+		CryptoNetworks:  []NetworkType{NetworkBaseMainnet},
+		RailRegistry:    registry,
+	})
+	handler := AIAgentMiddleware(unified, Config{PricePerRequest: 100, Currency: "USDC"}, AIAgentConfig{
+		Priority: &PriorityPolicy{Multipliers: map[string]float64{PriorityHigh: 1.5}},
+	})
+
+	request := func(paid bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-Agent-Task-ID", "task-1")
+		req.Header.Set("X-Agent-Priority", PriorityHigh)
+		if paid {
+			req.Header.Set("X-PAYMENT", "payload")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	var response PaymentOptionsResponse
+	json.NewDecoder(request(false).Body).Decode(&response)
+	if len(response.Accepts) != 1 || response.Accepts[0].MaxAmountRequired != "150" {
+		t.Errorf("Expected a 402 quoting 150, got %+v", response.Accepts)
+	}
+	if w := request(true); w.Code != http.StatusOK || rail.expected != 150 {
+		t.Errorf("Expected the payment verified for 150, got %d verifying %d", w.Code, rail.expected)
+	}
+}
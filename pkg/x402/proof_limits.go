@@ -0,0 +1,117 @@
+// Package x402 - Proof Limits
+// Payment proofs used to be base64-decoded and unmarshaled whatever their
+// size, so a client could make every request decode megabytes of header.
+// Proofs larger than MaxProofBytes are now refused before decoding, payloads
+// are decoded strictly (no unknown fields, no deep nesting), and a proof that
+// can't be decoded gets a 400 rather than a 402, so clients can tell "your
+// payload is broken" from "you didn't pay".
+package x402
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// DefaultMaxProofBytes is the largest payment proof decoded by default
+const DefaultMaxProofBytes = 16 << 10
+
+// maxProofDepth bounds the nesting of proof JSON; real payloads nest three
+// levels (payload, authorization, fields)
+const maxProofDepth = 8
+
+var (
+	// ErrProofTooLarge is returned for proofs over MaxProofBytes
+	ErrProofTooLarge = kindOf(ErrInvalidPayment, "payment proof too large")
+
+	// ErrProofTooDeep is returned for proof JSON nested too deeply
+	ErrProofTooDeep = kindOf(ErrInvalidPayment, "payment proof nested too deeply")
+)
+
+// MalformedProofResponse is the 400 body for a payment proof that can't be
+// decoded or is too large
+type MalformedProofResponse struct {
+	X402Version   int    `json:"x402Version"`
+	Code          string `json:"code"`
+	Error         string `json:"error"`
+	MaxProofBytes int    `json:"maxProofBytes"`
+}
+
+// maxProofBytes returns limit, or the default if it is unset
+func maxProofBytes(limit int) int {
+	if limit > 0 {
+		return limit
+	}
+	return DefaultMaxProofBytes
+}
+
+// checkProofSize refuses a proof over limit before it is decoded
+func checkProofSize(proof string, limit int) error {
+	if len(proof) > maxProofBytes(limit) {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrProofTooLarge, len(proof), maxProofBytes(limit))
+	}
+	return nil
+}
+
+// decodeProofJSON strictly decodes one JSON object from data into v
+func decodeProofJSON(data []byte, v interface{}) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '{' {
+		return fmt.Errorf("payment proof is not a JSON object")
+	}
+	if jsonDepth(data) > maxProofDepth {
+		return ErrProofTooDeep
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return fmt.Errorf("unexpected data after the payment proof")
+	}
+	return nil
+}
+
+// jsonDepth returns the deepest nesting of objects and arrays in data
+func jsonDepth(data []byte) int {
+	depth, deepest := 0, 0
+	inString, escaped := false, false
+	for _, c := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{' || c == '[':
+			depth++
+			if depth > deepest {
+				deepest = depth
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return deepest
+}
+
+// sendMalformedProof answers a proof that can't be decoded with a 400
+func sendMalformedProof(w http.ResponseWriter, err error, limit int) {
+	message := "Payment proof could not be decoded"
+	if errors.Is(err, ErrProofTooLarge) {
+		message = fmt.Sprintf("Payment proof exceeds %d bytes", maxProofBytes(limit))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(MalformedProofResponse{
+		X402Version:   X402Version,
+		Code:          ErrCodeMalformedProof,
+		Error:         message,
+		MaxProofBytes: maxProofBytes(limit),
+	})
+}
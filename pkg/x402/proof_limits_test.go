@@ -0,0 +1,159 @@
+package x402
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func encodeProof(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestProofLimits_SizeCap(t *testing.T) {
+	verified := 0
+	basic := testConfig()
+	basic.TestMode = false
+	basic.PaymentVerifier = func(token string) (bool, error) {
+		verified++
+		return true, nil
+	}
+	small := basic
+	small.MaxProofBytes = 64
+
+	big := "valid" + strings.Repeat("x", DefaultMaxProofBytes)
+	tests := []struct {
+		name   string
+		config Config
+		token  string
+		want   int
+	}{
+		{"under the default", basic, "valid_token", http.StatusOK},
+		{"over the default", basic, big, http.StatusBadRequest},
+		{"over a configured cap", small, "valid" + strings.Repeat("x", 64), http.StatusBadRequest},
+		{"at a configured cap", small, "valid" + strings.Repeat("x", 59), http.StatusOK},
+	}
+	for _, tt := range tests {
+		verified = 0
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		Middleware(createTestHandler(), tt.config).ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, w.Code)
+			continue
+		}
+		if tt.want == http.StatusBadRequest {
+			var response MalformedProofResponse
+			json.NewDecoder(w.Body).Decode(&response)
+			if response.Code != ErrCodeMalformedProof || response.MaxProofBytes != maxProofBytes(tt.config.MaxProofBytes) {
+				t.Errorf("%s: expected a %s body stating the limit, got %+v", tt.name, ErrCodeMalformedProof, response)
+			}
+			if verified != 0 {
+				t.Errorf("%s: expected the oversized proof never verified", tt.name)
+			}
+		}
+	}
+}
+
+func TestProofLimits_MultiSchemeAndUnified(t *testing.T) {
+	multi := MultiSchemeMiddleware(createTestHandler(), MultiSchemeConfig{
+		Config:         Config{PricePerRequest: 1000, PayTo: "0xseller", Network: "base-sepolia", MaxProofBytes: 256},
+		SchemeRegistry: NewSchemeRegistry(),
+	})
+	unified := newCallbackHandler(UnifiedPaymentConfig{MaxProofBytes: 256})
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		header  string
+		value   string
+		want    int
+	}{
+		{"multi-scheme oversized", multi, "X-PAYMENT", encodeProof(`{"scheme":"exact","payer":"` + strings.Repeat("a", 256) + `"}`), http.StatusBadRequest},
+		{"multi-scheme unknown field", multi, "X-PAYMENT", encodeProof(`{"scheme":"exact","network":"base-sepolia","amount":"999"}`), http.StatusBadRequest},
+		{"multi-scheme nested", multi, "X-PAYMENT", encodeProof(`{"scheme":"exact","resource":` + strings.Repeat("[", 20) + strings.Repeat("]", 20) + `}`), http.StatusBadRequest},
+		{"multi-scheme trailing data", multi, "X-PAYMENT", encodeProof(`{"scheme":"exact"}{"scheme":"upto"}`), http.StatusBadRequest},
+		{"multi-scheme well-formed", multi, "X-PAYMENT", encodeProof(`{"x402Version":1,"scheme":"exact","network":"base-sepolia","validUntil":1}`), http.StatusPaymentRequired},
+		{"unified oversized header", unified, "X-PAYMENT", strings.Repeat("a", 257), http.StatusBadRequest},
+		{"unified unknown proof field", unified, "X-PAYMENT-PROOF", encodeProof(`{"rail":"stripe","amount":1}`), http.StatusBadRequest},
+		{"unified well-formed", unified, "X-PAYMENT", "payload", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set(tt.header, tt.value)
+		w := httptest.NewRecorder()
+		tt.handler.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d: %s", tt.name, tt.want, w.Code, w.Body)
+		}
+	}
+}
+
+func TestParsePaymentPayload_Errors(t *testing.T) {
+	if _, err := parsePaymentPayload(strings.Repeat("a", DefaultMaxProofBytes+1), 0); !errors.Is(err, ErrProofTooLarge) || !errors.Is(err, ErrInvalidPayment) {
+		t.Errorf("Expected %v as an invalid payment, got %v", ErrProofTooLarge, err)
+	}
+	deep := `{"scheme":"exact","payload":` + strings.Repeat(`{"a":`, maxProofDepth) + `1` + strings.Repeat("}", maxProofDepth) + `}`
+	if _, err := parsePaymentPayload(encodeProof(deep), 0); !errors.Is(err, ErrProofTooDeep) {
+		t.Errorf("Expected %v, got %v", ErrProofTooDeep, err)
+	}
+}
+
+func TestJSONDepth(t *testing.T) {
+	tests := []struct {
+		data string
+		want int
+	}{
+		{`"flat"`, 0},
+		{`{"a":[1,{"b":2}]}`, 3},
+		{`{"a":"[[[{{{"}`, 1},
+		{`{"a":"\"[[["}`, 1},
+	}
+	for _, tt := range tests {
+		if got := jsonDepth([]byte(tt.data)); got != tt.want {
+			t.Errorf("jsonDepth(%s): expected %d, got %d", tt.data, tt.want, got)
+		}
+	}
+}
+
+func FuzzParsePaymentPayload(f *testing.F) {
+	f.Add(encodeProof(`{"scheme":"exact","network":"base-sepolia","payer":"0xpayer","timestamp":1}`))
+	f.Add(`{"scheme":"exact"}`)
+	f.Add(encodeProof(`{"scheme":"exact","extra":1}`))
+	f.Add(encodeProof(strings.Repeat("[", 64)))
+	f.Add("not base64!")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, token string) {
+		payload, err := parsePaymentPayload(token, 1024)
+		if err == nil && payload == nil {
+			t.Fatal("Expected a payload or an error")
+		}
+		if len(token) > 1024 && !errors.Is(err, ErrProofTooLarge) {
+			t.Fatalf("Expected a %d-byte token refused, got %v", len(token), err)
+		}
+	})
+}
+
+func FuzzExtractPaymentProof(f *testing.F) {
+	f.Add("X-PAYMENT-PROOF", encodeProof(`{"rail":"stripe","paymentIntentId":"pi_1"}`))
+	f.Add("X-PAYMENT-PROOF", encodeProof(`{"rail":"stripe","unknown":true}`))
+	f.Add("X-PAYMENT-PROOF", "not base64!")
+	f.Add("X-PAYMENT", "payload")
+	f.Add("X-STRIPE-PAYMENT-INTENT", "pi_1")
+	f.Fuzz(func(t *testing.T, header, value string) {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header[http.CanonicalHeaderKey(header)] = []string{value}
+		proof, err := extractPaymentProof(req, nil, 1024)
+		if err != nil && proof != nil {
+			t.Fatal("Expected no proof alongside an error")
+		}
+		if len(value) > 1024 && proof != nil && (proof.Payload == value || req.Header.Get("X-PAYMENT-PROOF") == value) {
+			t.Fatalf("Expected a %d-byte proof refused", len(value))
+		}
+	})
+}
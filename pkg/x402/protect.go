@@ -0,0 +1,201 @@
+// Package x402 - Declarative Route Protection
+// Wrapping a sub-mux in the payment middleware and mounting it under a
+// prefix is easy to get wrong: the inner mux sees the full path, prefixes
+// drift from the routes, and every free route needs an exemption. Protect
+// takes each route's PaymentPolicy keyed by the same Go 1.22 pattern the mux
+// routes it by. One handler picks the policy with ServeMux precedence,
+// enforces it, and routes the request; Endpoints hands the same rules to
+// discovery and agent pricing.
+package x402
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// PaymentPolicy is how a route is paid for
+type PaymentPolicy struct {
+	// Free serves the route without payment
+	Free bool
+
+	// Price is the route's price in Currency, like UnifiedPaymentConfig.Price
+	// (default: the config's price)
+	Price string
+
+	// Rails are the IDs of the rails accepted (default: every rail of the
+	// config)
+	Rails []string
+
+	// Sessions accepts the config's sessions, and mints them after payment
+	// if it sets SessionAfterPayment. Without it every request pays.
+	Sessions bool
+
+	// Endpoint describes the route in discovery. Its Cost is the policy's.
+	Endpoint Endpoint
+}
+
+// ProtectionRules configures Protect
+type ProtectionRules struct {
+	// Routes maps ServeMux patterns, such as "GET /api/items/{id}", to their
+	// policies. As in ServeMux, the most specific matching pattern applies.
+	Routes map[string]PaymentPolicy
+
+	// UnmatchedFree serves requests no route matches without payment. By
+	// default they pay the config's price and may use its sessions.
+	UnmatchedFree bool
+
+	// Payment is the config each policy adjusts
+	Payment UnifiedPaymentConfig
+}
+
+// Protected routes requests to a mux, enforcing each route's PaymentPolicy
+type Protected struct {
+	mux       *http.ServeMux
+	rules     *http.ServeMux          // The rules' patterns, for their precedence
+	handlers  map[string]http.Handler // By pattern; "" for unmatched requests
+	patterns  []string
+	endpoints []APIEndpoint
+	audit     *AuditLog
+}
+
+// Protect returns a handler serving mux with rules enforced. Like
+// UnifiedPaymentMiddleware and mux.Handle, it panics on an invalid config
+// or pattern, including patterns that conflict.
+func Protect(mux *http.ServeMux, rules ProtectionRules) *Protected {
+	// Routes share one session store and rail registry, as one middleware would
+	base := rules.Payment
+	if base.EnableSessions && base.SessionStore == nil {
+		base.SessionStore = NewInMemorySessionStore()
+	}
+	if base.RailRegistry == nil {
+		base.RailRegistry = NewDefaultRailRegistry(base)
+	}
+
+	p := &Protected{
+		mux:      mux,
+		rules:    http.NewServeMux(),
+		handlers: make(map[string]http.Handler),
+		audit:    base.Audit,
+	}
+	if !rules.UnmatchedFree {
+		p.handlers[""] = UnifiedPaymentMiddleware(mux, base)
+	}
+	for pattern, policy := range rules.Routes {
+		method, _, path, err := splitPattern(pattern)
+		if err != nil {
+			panic(err)
+		}
+		p.rules.Handle(pattern, http.NotFoundHandler())
+		p.patterns = append(p.patterns, pattern)
+
+		ep := policy.Endpoint.apiEndpoint(method, path)
+		if ep.Currency == "" {
+			ep.Currency = base.Currency
+		}
+		ep.Cost = 0
+		if !policy.Free {
+			config := policy.config(base)
+			p.handlers[pattern] = UnifiedPaymentMiddleware(mux, config)
+			ep.Cost = config.agentAmount()
+		}
+		p.endpoints = append(p.endpoints, ep)
+	}
+	sort.Strings(p.patterns)
+	sortBySpecificity(p.endpoints)
+	return p
+}
+
+// config is base adjusted by the policy
+func (policy PaymentPolicy) config(base UnifiedPaymentConfig) UnifiedPaymentConfig {
+	config := base
+	if policy.Price != "" {
+		config.Price, config.PricePerRequest, config.PriceByRail = policy.Price, 0, nil
+	}
+	if !policy.Sessions {
+		config.EnableSessions, config.SessionAfterPayment = false, 0
+	}
+	if policy.Rails != nil {
+		accepts := func(id string) bool { return slices.Contains(policy.Rails, id) }
+		config.RailRegistry = NewRailRegistry()
+		for _, rail := range base.RailRegistry.List() {
+			if accepts(rail.ID()) {
+				config.RailRegistry.Register(rail)
+			}
+		}
+		config.CryptoEnabled = config.CryptoEnabled && accepts(RailEVMCrypto)
+		config.FiatEnabled = config.FiatEnabled && (accepts(RailStripe) || accepts(RailStripeACH))
+	}
+	return config
+}
+
+// ServeHTTP enforces the policy of r's route, then serves it with the mux
+func (p *Protected) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, pattern := p.rules.Handler(r)
+	if handler, ok := p.handlers[pattern]; ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	p.audit.Record(r, AuditEvent{Decision: AuditExempt, Reason: "route"})
+	p.mux.ServeHTTP(w, reportExempt(r))
+}
+
+// Endpoints returns the protected routes, most specific first, with what
+// agent budgets are charged for them, for AIFirstConfig.Endpoints and
+// discovery. Free routes cost nothing.
+func (p *Protected) Endpoints() []APIEndpoint {
+	return append([]APIEndpoint(nil), p.endpoints...)
+}
+
+// Verify checks that the mux serves every rule's pattern with that
+// pattern's own handler, so tests catch rules whose route was renamed or
+// removed
+func (p *Protected) Verify() error {
+	var errs []error
+	for _, pattern := range p.patterns {
+		_, served := p.mux.Handler(sampleRequest(pattern))
+		switch served {
+		case pattern:
+		case "":
+			errs = append(errs, fmt.Errorf("x402: protected route %q is not served", pattern))
+		default:
+			errs = append(errs, fmt.Errorf("x402: protected route %q is served by %q", pattern, served))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sortBySpecificity orders endpoints so that the first one matching a
+// request is the one ServeMux would pick: more literal segments first, then
+// exact paths before subtrees, then those with a method
+func sortBySpecificity(endpoints []APIEndpoint) {
+	literals := func(path string) int {
+		n := 0
+		for _, segment := range strings.Split(path, "/") {
+			if segment != "" && !wildcard(segment) {
+				n++
+			}
+		}
+		return n
+	}
+	subtree := func(path string) bool {
+		return strings.HasSuffix(path, "/") || strings.HasSuffix(path, "...}")
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		a, b := endpoints[i], endpoints[j]
+		switch {
+		case literals(a.Path) != literals(b.Path):
+			return literals(a.Path) > literals(b.Path)
+		case subtree(a.Path) != subtree(b.Path):
+			return !subtree(a.Path)
+		case (a.Method == "") != (b.Method == ""):
+			return a.Method != ""
+		case a.Path != b.Path:
+			return a.Path < b.Path
+		}
+		return a.Method < b.Method
+	})
+}
@@ -0,0 +1,196 @@
+package x402
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// protectedRoutes are rules whose patterns overlap, so precedence decides
+var protectedRoutes = map[string]PaymentPolicy{
+	"/api/":                  {Price: "0.01", Endpoint: Endpoint{Name: "api"}},
+	"GET /api/items/{id}":    {Price: "0.05", Endpoint: Endpoint{Name: "get_item"}},
+	"POST /api/items/{id}":   {Price: "0.10", Endpoint: Endpoint{Name: "update_item"}},
+	"GET /api/items/free":    {Free: true, Endpoint: Endpoint{Name: "free_item"}},
+	"/api/reports/{name...}": {Price: "0.20", Rails: []string{RailStripe}, Endpoint: Endpoint{Name: "report"}},
+}
+
+func protectedMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	ok := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }
+	for pattern := range protectedRoutes {
+		mux.HandleFunc(pattern, ok)
+	}
+	mux.HandleFunc("/", ok)
+	return mux
+}
+
+func protectRules(unmatchedFree bool) ProtectionRules {
+	registry := NewRailRegistry()
+	registry.Register(NewEVMCryptoRail("", nil))
+	return ProtectionRules{
+		Routes:        protectedRoutes,
+		UnmatchedFree: unmatchedFree,
+		Payment: UnifiedPaymentConfig{
+			Price:          "0.02",
+			Currency:       "USD",
+			CryptoEnabled:  true,
+			CryptoPayTo:    "0xseller",
+			CryptoNetworks: []NetworkType{NetworkBaseSepolia},
+			RailRegistry:   registry,
+		},
+	}
+}
+
+func TestProtect_PatternPrecedence(t *testing.T) {
+	handler := Protect(protectedMux(), protectRules(false))
+	for _, tt := range []struct {
+		method, path string
+		want         string // Crypto amount required; "" for served free
+	}{
+		{"GET", "/api/items/7", "50000"},    // Method and wildcard beat the /api/ subtree
+		{"HEAD", "/api/items/7", "50000"},   // GET patterns match HEAD
+		{"POST", "/api/items/7", "100000"},  // The method picks its own rule
+		{"DELETE", "/api/items/7", "10000"}, // No DELETE rule: the subtree applies
+		{"GET", "/api/items/free", ""},      // A literal segment beats a wildcard
+		{"GET", "/api/other", "10000"},
+		{"GET", "/elsewhere", "20000"}, // Unmatched paths pay the config's price
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if tt.want == "" {
+			if w.Code != http.StatusOK {
+				t.Errorf("%s %s: expected to be served free, got %d", tt.method, tt.path, w.Code)
+			}
+			continue
+		}
+		if w.Code != http.StatusPaymentRequired {
+			t.Errorf("%s %s: expected 402, got %d", tt.method, tt.path, w.Code)
+			continue
+		}
+		var response PaymentRequiredResponse
+		json.NewDecoder(w.Body).Decode(&response)
+		if len(response.Accepts) != 1 || response.Accepts[0].MaxAmountRequired != tt.want {
+			t.Errorf("%s %s: expected %s required, got %+v", tt.method, tt.path, tt.want, response.Accepts)
+		}
+	}
+
+	// Unless unmatched paths are free
+	w := httptest.NewRecorder()
+	Protect(protectedMux(), protectRules(true)).ServeHTTP(w, httptest.NewRequest("GET", "/elsewhere", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected unmatched paths served free, got %d", w.Code)
+	}
+}
+
+func TestProtect_RailsAndSessions(t *testing.T) {
+	stripeAPI := newFakeStripe(t)
+	defer stripeAPI.Close()
+	stripe := NewStripeRail("sk_test", "")
+	stripe.BaseURL = stripeAPI.URL
+	sessions := NewInMemorySessionStore()
+	sessions.CreateSession(&Session{
+		ID:          "sess_1",
+		Active:      true,
+		SessionType: SessionTypeRequests,
+		MaxRequests: 5,
+		ExpiresAt:   time.Now().Add(time.Hour),
+	})
+
+	rules := protectRules(false)
+	rules.Payment.RailRegistry.Register(stripe)
+	rules.Payment.FiatEnabled = true
+	rules.Payment.EnableSessions = true
+	rules.Payment.SessionStore = sessions
+	rules.Routes = map[string]PaymentPolicy{
+		"/api/reports/": {Rails: []string{RailStripe}},
+		"/api/live/":    {Sessions: true},
+	}
+	handler := Protect(protectedMux(), rules)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/reports/q3", nil))
+	var response PaymentOptionsResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if len(response.Accepts) != 0 || len(response.Options) != 1 || response.Options[0].Rail != RailStripe {
+		t.Errorf("Expected only a Stripe option for reports, got %+v", response.Options)
+	}
+
+	// Sessions only cover the routes allowing them
+	for path, want := range map[string]int{"/api/live/feed": http.StatusOK, "/api/reports/q3": http.StatusPaymentRequired} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Session-ID", "sess_1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("%s with a session: expected %d, got %d", path, want, w.Code)
+		}
+	}
+}
+
+func TestProtect_DiscoveryReflectsRules(t *testing.T) {
+	protected := Protect(protectedMux(), protectRules(false))
+	discovery := AIDiscoveryHandler(AIFirstConfig{Endpoints: protected.Endpoints()})
+
+	w := httptest.NewRecorder()
+	discovery.ServeHTTP(w, httptest.NewRequest("GET", "/x402/discovery", nil))
+	var document struct {
+		Endpoints     []APIEndpoint  `json:"endpoints"`
+		FreeEndpoints []FreeEndpoint `json:"freeEndpoints"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&document); err != nil {
+		t.Fatalf("Invalid discovery document: %v", err)
+	}
+
+	want := map[string]int64{
+		"/api/":                  10000,
+		"GET /api/items/{id}":    50000,
+		"POST /api/items/{id}":   100000,
+		"GET /api/items/free":    0,
+		"/api/reports/{name...}": 20, // Stripe only, so in cents
+	}
+	if len(document.Endpoints) != len(want) {
+		t.Fatalf("Expected exactly the %d rules in discovery, got %+v", len(want), document.Endpoints)
+	}
+	for _, ep := range document.Endpoints {
+		pattern := strings.TrimSpace(ep.Method + " " + ep.Path)
+		cost, ok := want[pattern]
+		if !ok || ep.Cost != cost || ep.Name != protectedRoutes[pattern].Endpoint.Name {
+			t.Errorf("Discovery lists %q costing %d, want %d", pattern, ep.Cost, cost)
+		}
+		delete(want, pattern)
+	}
+	if len(document.FreeEndpoints) != 1 || document.FreeEndpoints[0].String() != "GET /api/items/free" {
+		t.Errorf("Expected only the free rule listed as free, got %+v", document.FreeEndpoints)
+	}
+
+	// Agent pricing finds the same rule ServeMux does
+	for _, tt := range []struct {
+		method, path string
+		want         int64
+	}{
+		{"GET", "/api/items/free", 0},
+		{"GET", "/api/items/7", 50000},
+		{"GET", "/api/reports/2024/q3", 20},
+	} {
+		if cost := getCostForPath(tt.path, tt.method, protected.Endpoints(), nil, -1); cost != tt.want {
+			t.Errorf("%s %s: expected agents charged %d, got %d", tt.method, tt.path, tt.want, cost)
+		}
+	}
+}
+
+func TestProtect_Verify(t *testing.T) {
+	if err := Protect(protectedMux(), protectRules(false)).Verify(); err != nil {
+		t.Errorf("Expected every rule served, got %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {})
+	err := Protect(mux, protectRules(false)).Verify()
+	if err == nil || !strings.Contains(err.Error(), `"GET /api/items/{id}" is served by "/api/"`) {
+		t.Errorf("Expected rules without their own route reported, got %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+// Package x402 - Protocol Profiles
+// x402 v1 clients send X-PAYMENT and read requirements from the 402 body, v2
+// clients send PAYMENT-SIGNATURE and read the base64 PAYMENT-REQUIRED header,
+// and older integrations use their own header names. A ProtocolProfile says
+// which proof headers are read, which legacy fallbacks are honored and how
+// requirements are emitted, so one deployment can serve exactly the clients
+// it has. Without one, the middlewares accept all of the above and emit both.
+package x402
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Encodings of the requirements header
+const (
+	EncodingBase64 = "base64" // base64 of the JSON response (default)
+	EncodingJSON   = "json"   // the JSON response as is
+)
+
+// ProtocolProfile names the headers payments are read from and requirements
+// are written to
+type ProtocolProfile struct {
+	// Name identifies the profile in errors
+	Name string
+
+	// ProofHeaders carry the payment proof, checked in order
+	ProofHeaders []string
+
+	// Legacy fallbacks, checked after ProofHeaders by Middleware and
+	// MultiSchemeMiddleware: Authorization with an AcceptedMethods prefix,
+	// the X-Payment-Token header and the payment_token query parameter (which
+	// also needs Config.AllowQueryToken)
+	AllowAuthorization bool
+	AllowTokenHeader   bool
+	AllowQueryToken    bool
+
+	// RequirementsHeader carries the requirements on 402s ("" to omit)
+	RequirementsHeader string
+
+	// RequirementsEncoding is EncodingBase64 (default) or EncodingJSON
+	RequirementsEncoding string
+
+	// RequirementsBody writes the requirements as the 402's JSON body
+	RequirementsBody bool
+}
+
+// Built-in profiles
+var (
+	// ProtocolV1 reads X-PAYMENT and answers with requirements in the body
+	ProtocolV1 = &ProtocolProfile{
+		Name:             "v1",
+		ProofHeaders:     []string{"X-PAYMENT"},
+		RequirementsBody: true,
+	}
+
+	// ProtocolV2 reads PAYMENT-SIGNATURE and answers with the base64
+	// PAYMENT-REQUIRED header, keeping the body for debugging
+	ProtocolV2 = &ProtocolProfile{
+		Name:                 "v2",
+		ProofHeaders:         []string{"PAYMENT-SIGNATURE"},
+		RequirementsHeader:   "PAYMENT-REQUIRED",
+		RequirementsEncoding: EncodingBase64,
+		RequirementsBody:     true,
+	}
+
+	// ProtocolLegacy serves pre-standard clients: X-Payment plus every
+	// legacy fallback in, X-Accept-Payment out
+	ProtocolLegacy = &ProtocolProfile{
+		Name:                 "legacy",
+		ProofHeaders:         []string{"X-Payment"},
+		AllowAuthorization:   true,
+		AllowTokenHeader:     true,
+		AllowQueryToken:      true,
+		RequirementsHeader:   "X-Accept-Payment",
+		RequirementsEncoding: EncodingBase64,
+		RequirementsBody:     true,
+	}
+)
+
+// defaultProtocol is the behavior without a profile: v2 and v1 headers and
+// every fallback in, PAYMENT-REQUIRED and the body out
+var defaultProtocol = &ProtocolProfile{
+	Name:                 "default",
+	ProofHeaders:         []string{"PAYMENT-SIGNATURE", "X-PAYMENT"},
+	AllowAuthorization:   true,
+	AllowTokenHeader:     true,
+	AllowQueryToken:      true,
+	RequirementsHeader:   "PAYMENT-REQUIRED",
+	RequirementsEncoding: EncodingBase64,
+	RequirementsBody:     true,
+}
+
+// Validate reports a profile that could never accept a payment or never
+// tell the client what to pay. A nil profile is valid.
+func (p *ProtocolProfile) Validate() error {
+	if p == nil {
+		return nil
+	}
+	if len(p.ProofHeaders) == 0 && !p.AllowAuthorization && !p.AllowTokenHeader && !p.AllowQueryToken {
+		return fmt.Errorf("x402: protocol profile %q accepts no payment headers", p.Name)
+	}
+	if p.RequirementsHeader == "" && !p.RequirementsBody {
+		return fmt.Errorf("x402: protocol profile %q emits no payment requirements", p.Name)
+	}
+	switch p.RequirementsEncoding {
+	case "", EncodingBase64, EncodingJSON:
+		return nil
+	}
+	return fmt.Errorf("x402: protocol profile %q has unknown RequirementsEncoding %q", p.Name, p.RequirementsEncoding)
+}
+
+// resolve returns p, or the default profile if p is nil
+func (p *ProtocolProfile) resolve() *ProtocolProfile {
+	if p == nil {
+		return defaultProtocol
+	}
+	return p
+}
+
+// proof returns the first proof header present on r, or else the proof a
+// BodyProof found in its body
+func (p *ProtocolProfile) proof(r *http.Request) string {
+	for _, name := range p.resolve().ProofHeaders {
+		if value := r.Header.Get(name); value != "" {
+			return value
+		}
+	}
+	return bodyProof(r)
+}
+
+// token returns the payment token from the proof headers or, if the
+// profile allows them, the legacy fallbacks
+func (p *ProtocolProfile) token(r *http.Request, acceptedMethods []string, allowQuery bool) string {
+	p = p.resolve()
+	if proof := p.proof(r); proof != "" {
+		return proof
+	}
+
+	if p.AllowAuthorization {
+		if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+			for _, method := range acceptedMethods {
+				prefix := method + " "
+				if strings.HasPrefix(authHeader, prefix) {
+					return strings.TrimPrefix(authHeader, prefix)
+				}
+			}
+		}
+	}
+	if p.AllowTokenHeader {
+		if paymentToken := r.Header.Get("X-Payment-Token"); paymentToken != "" {
+			return paymentToken
+		}
+	}
+	if p.AllowQueryToken && allowQuery {
+		return r.URL.Query().Get(queryTokenParam)
+	}
+	return ""
+}
+
+// missingProof is the 402 error when no payment was presented
+func (p *ProtocolProfile) missingProof() string {
+	if p == nil {
+		return "X-PAYMENT header is required"
+	}
+	if len(p.ProofHeaders) == 0 {
+		return "Payment is required"
+	}
+	return fmt.Sprintf("%s header is required", p.ProofHeaders[0])
+}
+
+// vary lists the request headers a 402 depends on
+func (p *ProtocolProfile) vary() string {
+	if p == nil {
+		return "Authorization, X-PAYMENT"
+	}
+	return strings.Join(append([]string{"Authorization"}, p.ProofHeaders...), ", ")
+}
+
+// exposed lists the response headers browser clients need to read
+func (p *ProtocolProfile) exposed() string {
+	if header := p.resolve().RequirementsHeader; header != "" {
+		return header + ", WWW-Authenticate"
+	}
+	return "WWW-Authenticate"
+}
+
+// writePaymentRequired answers with a 402 carrying response as the profile
+// says, along with the standard 402 headers
+func (p *ProtocolProfile) writePaymentRequired(w http.ResponseWriter, realm string, schemes []string, response interface{}) {
+	p.writePaymentRequiredBody(w, realm, schemes, response, nil)
+}
+
+// writePaymentRequiredBody is writePaymentRequired with body, if not nil,
+// sent in place of response whatever the profile's RequirementsBody
+func (p *ProtocolProfile) writePaymentRequiredBody(w http.ResponseWriter, realm string, schemes []string, response, body interface{}) {
+	profile := p.resolve()
+	responseJSON, _ := json.Marshal(response)
+
+	w.Header().Set("Content-Type", "application/json")
+	if profile.RequirementsHeader != "" {
+		value := base64.StdEncoding.EncodeToString(responseJSON)
+		if profile.RequirementsEncoding == EncodingJSON {
+			value = string(responseJSON)
+		}
+		w.Header().Set(profile.RequirementsHeader, value)
+	}
+	setPaymentRequiredHeaders(w, realm, schemes, p)
+
+	w.WriteHeader(http.StatusPaymentRequired)
+	switch {
+	case body != nil:
+		_ = json.NewEncoder(w).Encode(body)
+	case profile.RequirementsBody:
+		_ = json.NewEncoder(w).Encode(response)
+	}
+}
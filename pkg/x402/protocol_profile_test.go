@@ -0,0 +1,179 @@
+package x402
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProtocolProfiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol *ProtocolProfile
+		accepted []string // headers whose token is accepted
+		ignored  []string // headers whose token is not
+		emitted  string   // requirements header on 402s
+		absent   string   // requirements header not on 402s
+	}{
+		{"default", nil, []string{"PAYMENT-SIGNATURE", "X-PAYMENT", "X-Payment-Token"}, nil, "PAYMENT-REQUIRED", "X-Accept-Payment"},
+		{"v1", ProtocolV1, []string{"X-PAYMENT"}, []string{"PAYMENT-SIGNATURE", "X-Payment-Token"}, "", "PAYMENT-REQUIRED"},
+		{"v2", ProtocolV2, []string{"PAYMENT-SIGNATURE"}, []string{"X-PAYMENT", "X-Payment-Token"}, "PAYMENT-REQUIRED", "X-Accept-Payment"},
+		{"legacy", ProtocolLegacy, []string{"X-Payment", "X-Payment-Token"}, []string{"PAYMENT-SIGNATURE"}, "X-Accept-Payment", "PAYMENT-REQUIRED"},
+	}
+
+	for _, tt := range tests {
+		config := testConfig()
+		config.Protocol = tt.protocol
+		handler := Middleware(createTestHandler(), config)
+
+		for _, header := range tt.accepted {
+			req := httptest.NewRequest("GET", "/api/data", nil)
+			req.Header.Set(header, "valid_token")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Errorf("%s: expected %s to be accepted, got %d", tt.name, header, w.Code)
+			}
+		}
+		for _, header := range tt.ignored {
+			req := httptest.NewRequest("GET", "/api/data", nil)
+			req.Header.Set(header, "valid_token")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusPaymentRequired {
+				t.Errorf("%s: expected %s to be ignored, got %d", tt.name, header, w.Code)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+		if w.Code != http.StatusPaymentRequired {
+			t.Fatalf("%s: expected 402, got %d", tt.name, w.Code)
+		}
+		if tt.emitted != "" {
+			decoded, _ := base64.StdEncoding.DecodeString(w.Header().Get(tt.emitted))
+			var fromHeader PaymentRequiredResponse
+			if err := json.Unmarshal(decoded, &fromHeader); err != nil || len(fromHeader.Accepts) == 0 {
+				t.Errorf("%s: expected requirements in %s, got %q", tt.name, tt.emitted, w.Header().Get(tt.emitted))
+			}
+		}
+		if got := w.Header().Get(tt.absent); got != "" {
+			t.Errorf("%s: expected no %s header, got %q", tt.name, tt.absent, got)
+		}
+		var body PaymentRequiredResponse
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil || len(body.Accepts) == 0 {
+			t.Errorf("%s: expected requirements in the body, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestProtocolProfile_LegacyClientHeaders(t *testing.T) {
+	config := testConfig()
+	config.Protocol = ProtocolLegacy
+	handler := Middleware(createTestHandler(), config)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+
+	if got := w.Header().Get("Access-Control-Expose-Headers"); got != "X-Accept-Payment, WWW-Authenticate" {
+		t.Errorf("Expected X-Accept-Payment to be exposed, got %q", got)
+	}
+	if got := w.Header().Get("Vary"); got != "Authorization, X-Payment" {
+		t.Errorf("Expected Vary on the legacy proof header, got %q", got)
+	}
+	var body PaymentRequiredResponse
+	_ = json.NewDecoder(w.Body).Decode(&body)
+	if body.Error != "X-Payment header is required" {
+		t.Errorf("Expected the error to name X-Payment, got %q", body.Error)
+	}
+}
+
+func TestProtocolProfile_JSONEncodingWithoutBody(t *testing.T) {
+	config := testConfig()
+	config.Protocol = &ProtocolProfile{
+		Name:                 "header-only",
+		ProofHeaders:         []string{"X-Pay"},
+		RequirementsHeader:   "X-Pay-Required",
+		RequirementsEncoding: EncodingJSON,
+	}
+	handler := Middleware(createTestHandler(), config)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+
+	var response PaymentRequiredResponse
+	if err := json.Unmarshal([]byte(w.Header().Get("X-Pay-Required")), &response); err != nil || len(response.Accepts) == 0 {
+		t.Errorf("Expected JSON requirements in X-Pay-Required, got %q", w.Header().Get("X-Pay-Required"))
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected no body, got %q", w.Body.String())
+	}
+}
+
+func TestUnifiedMiddleware_ProtocolProfile(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol *ProtocolProfile
+		proof    string
+		ignored  string
+		emitted  string
+	}{
+		{"v1", ProtocolV1, "X-PAYMENT", "PAYMENT-SIGNATURE", ""},
+		{"v2", ProtocolV2, "PAYMENT-SIGNATURE", "X-PAYMENT", "PAYMENT-REQUIRED"},
+		{"legacy", ProtocolLegacy, "X-Payment", "PAYMENT-SIGNATURE", "X-Accept-Payment"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set(tt.proof, "payload")
+		proof, err := extractPaymentProof(req, tt.protocol, 0)
+		if err != nil || proof == nil || proof.Payload != "payload" {
+			t.Errorf("%s: expected a proof from %s, got %+v %v", tt.name, tt.proof, proof, err)
+		}
+
+		req = httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set(tt.ignored, "payload")
+		if proof, _ := extractPaymentProof(req, tt.protocol, 0); proof != nil {
+			t.Errorf("%s: expected %s to be ignored, got %+v", tt.name, tt.ignored, proof)
+		}
+
+		handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+			PricePerRequest: 100,
+			CryptoEnabled:   true,
+			Protocol:        tt.protocol,
+		})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/data", nil))
+		if w.Code != http.StatusPaymentRequired {
+			t.Fatalf("%s: expected 402, got %d", tt.name, w.Code)
+		}
+		for _, header := range []string{"PAYMENT-REQUIRED", "X-Accept-Payment"} {
+			if got := w.Header().Get(header); (got != "") != (header == tt.emitted) {
+				t.Errorf("%s: unexpected %s header %q", tt.name, header, got)
+			}
+		}
+	}
+}
+
+func TestProtocolProfile_Validate(t *testing.T) {
+	for _, p := range []*ProtocolProfile{nil, ProtocolV1, ProtocolV2, ProtocolLegacy} {
+		if err := p.Validate(); err != nil {
+			t.Errorf("Expected built-in profile to be valid, got %v", err)
+		}
+	}
+
+	invalid := []*ProtocolProfile{
+		{Name: "deaf", RequirementsBody: true},
+		{Name: "mute", ProofHeaders: []string{"X-PAYMENT"}},
+		{Name: "odd", ProofHeaders: []string{"X-PAYMENT"}, RequirementsHeader: "X-Req", RequirementsEncoding: "hex"},
+	}
+	for _, p := range invalid {
+		config := testConfig()
+		config.Protocol = p
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected profile %q to be rejected", p.Name)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Package x402 - Query Tokens
+// A payment token in the URL (?payment_token=...) is copied into access logs,
+// browser history and Referer headers, so it is accepted only when
+// Config.AllowQueryToken is set. Even then the parameter is removed before
+// the request reaches the protected handler, and it is never written to the
+// audit log or echoed in 402 resources.
+package x402
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// queryTokenParam is the query parameter legacy clients put tokens in
+const queryTokenParam = "payment_token"
+
+// withoutQueryToken wraps next so it never sees the payment_token parameter
+func withoutQueryToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawQuery := stripQueryParam(r.URL.RawQuery, queryTokenParam)
+		if rawQuery == r.URL.RawQuery {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.URL.RawQuery = rawQuery
+		r.RequestURI = r.URL.RequestURI()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// stripQueryParam removes every occurrence of name from rawQuery, keeping
+// the other parameters as they were sent
+func stripQueryParam(rawQuery, name string) string {
+	if !strings.Contains(rawQuery, name) {
+		return rawQuery
+	}
+	parts := strings.Split(rawQuery, "&")
+	kept := parts[:0]
+	for _, part := range parts {
+		key, _, _ := strings.Cut(part, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == name {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, "&")
+}
+
+// requestResource is the path and query of u without any payment token
+func requestResource(u *url.URL) string {
+	resource := u.Path
+	if rawQuery := stripQueryParam(u.RawQuery, queryTokenParam); rawQuery != "" {
+		resource += "?" + rawQuery
+	}
+	return resource
+}
+
+// redactedRequestURI is u.RequestURI() without any payment token
+func redactedRequestURI(u *url.URL) string {
+	redacted := *u
+	redacted.RawQuery = stripQueryParam(u.RawQuery, queryTokenParam)
+	return redacted.RequestURI()
+}
@@ -0,0 +1,91 @@
+package x402
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware_QueryTokenIgnoredByDefault(t *testing.T) {
+	handler := Middleware(createTestHandler(), testConfig())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/protected?payment_token=valid_token", nil))
+
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected status 402 for a query token without AllowQueryToken, got %d", w.Code)
+	}
+	var response PaymentRequiredResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil || len(response.Accepts) == 0 {
+		t.Fatalf("Invalid 402 body: %v", err)
+	}
+	if strings.Contains(response.Accepts[0].Resource, "valid_token") {
+		t.Errorf("Expected the token left out of the 402 resource, got %s", response.Accepts[0].Resource)
+	}
+}
+
+func TestMiddleware_QueryTokenStrippedDownstream(t *testing.T) {
+	var forwarded *http.Request
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+		w.WriteHeader(http.StatusOK)
+	})
+	sink := NewInMemoryAuditSink()
+	config := testConfig()
+	config.AllowQueryToken = true
+	config.Audit = &AuditLog{Sink: sink}
+	handler := Middleware(next, config)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/protected?a=1&payment_token=valid_token&b=2", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if forwarded.URL.RawQuery != "a=1&b=2" || forwarded.RequestURI != "/api/protected?a=1&b=2" {
+		t.Errorf("Expected payment_token removed from the forwarded request, got %q and %q", forwarded.URL.RawQuery, forwarded.RequestURI)
+	}
+	if forwarded.URL.Query().Has("payment_token") {
+		t.Error("Expected next not to see payment_token")
+	}
+
+	// A refused query token is not logged either
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/protected?payment_token=bad_token", nil))
+
+	events := sink.Events()
+	if got := auditDecisions(events); got != "verified,rejected,payment_required" {
+		t.Fatalf("Expected verified,rejected,payment_required, got %s", got)
+	}
+	if events[0].Resource != "/api/protected?a=1&b=2" {
+		t.Errorf("Expected the paid resource without the token, got %q", events[0].Resource)
+	}
+	for _, event := range events[1:] {
+		if event.Resource != "/api/protected" {
+			t.Errorf("Expected the refused resource without the token, got %q", event.Resource)
+		}
+	}
+	if events[1].PayloadHash == "" {
+		t.Error("Expected the refused token to be recorded by its hash")
+	}
+}
+
+func TestStripQueryParam(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", ""},
+		{"a=1", "a=1"},
+		{"payment_token=x", ""},
+		{"b=2&payment_token=x&a=1", "b=2&a=1"},
+		{"payment%5Ftoken=x&payment_token=y&c", "c"},
+		{"my_payment_token=x", "my_payment_token=x"},
+	}
+	for _, tt := range tests {
+		if got := stripQueryParam(tt.query, queryTokenParam); got != tt.want {
+			t.Errorf("stripQueryParam(%q): expected %q, got %q", tt.query, tt.want, got)
+		}
+	}
+}
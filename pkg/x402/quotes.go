@@ -0,0 +1,253 @@
+// Package x402 - Price Quotes
+// A cost estimate is only useful for budgeting if the server stands by it.
+// QuoteSigner issues short-lived quotes signed with a server secret, and
+// payment middlewares given the same signer charge the quoted price for a
+// request carrying one in X-Price-Quote, even if the price has gone up since.
+// A quote names one method and path and is honored once.
+package x402
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultQuoteTTL is how long quotes are honored when QuoteSigner.TTL is 0
+const DefaultQuoteTTL = 5 * time.Minute
+
+// QuoteHeader carries a signed quote on a paid request
+const QuoteHeader = "X-Price-Quote"
+
+var (
+	// ErrInvalidQuote is returned for quotes that are malformed, tampered
+	// with or for another request
+	ErrInvalidQuote = kindOf(ErrInvalidPayment, "invalid price quote")
+
+	// ErrQuoteExpired is returned for quotes past their expiry
+	ErrQuoteExpired = kindOf(ErrExpired, "price quote has expired")
+
+	// ErrQuoteUsed is returned for quotes already honored once
+	ErrQuoteUsed = kindOf(ErrInvalidPayment, "price quote has already been used")
+)
+
+// PriceQuote is a server's promise to charge Price for one request
+type PriceQuote struct {
+	ID        string `json:"id"`
+	Endpoint  string `json:"endpoint"`
+	Method    string `json:"method"`
+	Price     int64  `json:"price"`
+	Currency  string `json:"currency"`
+	ExpiresAt int64  `json:"expiresAt"` // Unix seconds
+}
+
+// QuoteSigner issues and checks price quotes
+type QuoteSigner struct {
+	// Secret signs quotes (HMAC-SHA256); servers honoring each other's
+	// quotes share it
+	Secret []byte
+
+	// TTL is how long a quote is honored (default DefaultQuoteTTL)
+	TTL time.Duration
+
+	mu   sync.Mutex
+	used map[string]int64 // quote ID -> expiry of quotes already honored
+
+	// now is stubbed in tests
+	now func() time.Time
+}
+
+// NewQuoteSigner creates a signer for secret
+func NewQuoteSigner(secret []byte, ttl time.Duration) *QuoteSigner {
+	return &QuoteSigner{Secret: secret, TTL: ttl}
+}
+
+func (s *QuoteSigner) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// Issue quotes price for method on endpoint and returns the quote and its
+// signed token
+func (s *QuoteSigner) Issue(endpoint, method string, price int64, currency string) (PriceQuote, string) {
+	ttl := s.TTL
+	if ttl <= 0 {
+		ttl = DefaultQuoteTTL
+	}
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	quote := PriceQuote{
+		ID:        "quote_" + hex.EncodeToString(b),
+		Endpoint:  endpoint,
+		Method:    strings.ToUpper(method),
+		Price:     price,
+		Currency:  currency,
+		ExpiresAt: s.clock().Add(ttl).Unix(),
+	}
+	payload, _ := json.Marshal(quote)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return quote, encoded + "." + base64.RawURLEncoding.EncodeToString(claimsMAC(encoded, s.Secret))
+}
+
+// Verify checks a quote token's signature and expiry and returns its quote
+func (s *QuoteSigner) Verify(token string) (*PriceQuote, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidQuote
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, claimsMAC(encoded, s.Secret)) {
+		return nil, ErrInvalidQuote
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidQuote
+	}
+	var quote PriceQuote
+	if err := json.Unmarshal(payload, &quote); err != nil || quote.ID == "" {
+		return nil, ErrInvalidQuote
+	}
+	if s.clock().Unix() >= quote.ExpiresAt {
+		return nil, ErrQuoteExpired
+	}
+	return &quote, nil
+}
+
+// price returns what r pays given its current price: the quoted price, if
+// r carries a valid quote for it that is lower, along with the quote to
+// claim once the request is charged. Otherwise it returns current, and why
+// a quote r carries is not honored.
+func (s *QuoteSigner) price(r *http.Request, currency string, current int64) (int64, *PriceQuote, error) {
+	token := r.Header.Get(QuoteHeader)
+	if s == nil || token == "" {
+		return current, nil, nil
+	}
+	quote, err := s.Verify(token)
+	if err != nil {
+		return current, nil, err
+	}
+	if quote.Endpoint != r.URL.Path || quote.Method != r.Method || !strings.EqualFold(quote.Currency, currency) {
+		return current, nil, ErrInvalidQuote
+	}
+	// A quote only discounts a priced request, and never to free
+	if quote.Price <= 0 {
+		return current, nil, ErrInvalidQuote
+	}
+	if quote.Price >= current {
+		return current, nil, nil
+	}
+	return quote.Price, quote, nil
+}
+
+// claim marks quote honored, failing if it already was
+func (s *QuoteSigner) claim(quote *PriceQuote) error {
+	if s == nil || quote == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock().Unix()
+	if s.used == nil {
+		s.used = make(map[string]int64)
+	}
+	for id, expiresAt := range s.used {
+		if now >= expiresAt {
+			delete(s.used, id)
+		}
+	}
+	if _, ok := s.used[quote.ID]; ok {
+		return ErrQuoteUsed
+	}
+	s.used[quote.ID] = quote.ExpiresAt
+	return nil
+}
+
+// release makes a claimed quote usable again, for charges that failed
+func (s *QuoteSigner) release(quote *PriceQuote) {
+	if s == nil || quote == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.used, quote.ID)
+}
+
+// quoteMessage explains in a 402 why a quote was not honored
+func quoteMessage(err error) string {
+	return "Price quote not honored: " + err.Error()
+}
+
+// QuotePricer prices method on endpoint the way a payment middleware
+// charges it, reporting false for endpoints that have no price
+type QuotePricer func(method, endpoint string) (int64, bool)
+
+// QuotePrice prices quotes as Middleware and MultiSchemeMiddleware charge
+// with c, before tiers and coupons
+func (c Config) QuotePrice(method, endpoint string) (int64, bool) {
+	if isExemptPath(endpoint, c.ExemptPaths) {
+		return 0, false
+	}
+	price := c.MethodPricing.Price(method, endpoint, c.PricePerRequest)
+	return price, price > 0
+}
+
+// QuotePrice prices quotes as UnifiedPaymentMiddleware charges with c,
+// before tiers and coupons
+func (c UnifiedPaymentConfig) QuotePrice(method, endpoint string) (int64, bool) {
+	if isExemptPath(endpoint, c.ExemptPaths) {
+		return 0, false
+	}
+	price := c.MethodPricing.Price(method, endpoint, c.PricePerRequest)
+	return price, price > 0
+}
+
+// QuotePrice prices quotes as AIFirstMiddleware charges with c
+func (c AIFirstConfig) QuotePrice(method, endpoint string) (int64, bool) {
+	if isExemptPath(endpoint, c.ExemptPaths) {
+		return 0, false
+	}
+	price := getCostForPath(endpoint, method, c.Endpoints, c.MethodPricing, c.DefaultCost)
+	return price, price > 0
+}
+
+// QuoteHandler serves signed quotes at e.g. GET /ai/quote?endpoint=&method=,
+// priced by price, which should be the QuotePrice of the config of the
+// middleware honoring them. Endpoints without a price are refused.
+func QuoteHandler(quotes *QuoteSigner, price QuotePricer, currency string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		endpoint := r.URL.Query().Get("endpoint")
+		if endpoint == "" {
+			http.Error(w, `{"error":"endpoint required"}`, http.StatusBadRequest)
+			return
+		}
+		method := strings.ToUpper(r.URL.Query().Get("method"))
+		if method == "" {
+			method = "GET"
+		}
+		amount, ok := price(method, endpoint)
+		if !ok || amount <= 0 {
+			http.Error(w, `{"error":"endpoint has no price to quote"}`, http.StatusNotFound)
+			return
+		}
+
+		quote, token := quotes.Issue(endpoint, method, amount, currency)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(CostEstimate{
+			Endpoint:      quote.Endpoint,
+			Method:        quote.Method,
+			EstimatedCost: quote.Price,
+			Currency:      quote.Currency,
+			ValidUntil:    time.Unix(quote.ExpiresAt, 0).UTC(),
+			Quote:         token,
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package x402
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// issueQuote asks QuoteHandler for a quote on endpoint while it costs price
+func issueQuote(t *testing.T, quotes *QuoteSigner, endpoint string, price int64) string {
+	t.Helper()
+	handler := QuoteHandler(quotes, Config{PricePerRequest: price}.QuotePrice, "USD")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/ai/quote?endpoint="+endpoint, nil))
+	var estimate CostEstimate
+	if err := json.NewDecoder(w.Body).Decode(&estimate); err != nil || estimate.Quote == "" {
+		t.Fatalf("Expected a signed quote, got %d %v", w.Code, err)
+	}
+	if estimate.EstimatedCost != price || estimate.ValidUntil.IsZero() {
+		t.Fatalf("Expected a quote of %d, got %+v", price, estimate)
+	}
+	return estimate.Quote
+}
+
+// quotedRequest sends GET /api/data with quote and, if set, a payment token
+func quotedRequest(handler http.Handler, quote, token string) (*httptest.ResponseRecorder, PaymentRequiredResponse) {
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set(QuoteHeader, quote)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var resp PaymentRequiredResponse
+	if w.Code == http.StatusPaymentRequired {
+		json.NewDecoder(w.Body).Decode(&resp)
+	}
+	return w, resp
+}
+
+func TestQuotes_HonoredOnceAtQuotedPrice(t *testing.T) {
+	quotes := NewQuoteSigner([]byte("quote_secret"), time.Minute)
+	quote := issueQuote(t, quotes, "/api/data", 100)
+
+	// The price has since gone up
+	sink := NewInMemoryAuditSink()
+	config := testConfig()
+	config.PricePerRequest = 500
+	config.Quotes = quotes
+	config.Audit = &AuditLog{Sink: sink}
+	handler := Middleware(createTestHandler(), config)
+
+	if _, resp := quotedRequest(handler, quote, ""); resp.Accepts[0].MaxAmountRequired != "100" {
+		t.Errorf("Expected the 402 to ask for the quoted 100, got %s", resp.Accepts[0].MaxAmountRequired)
+	}
+	if w, _ := quotedRequest(handler, quote, "valid_token"); w.Code != http.StatusOK {
+		t.Fatalf("Expected the quoted payment to be accepted, got %d", w.Code)
+	}
+	events := sink.Events()
+	if last := events[len(events)-1]; last.Decision != AuditVerified || last.RequiredAmount != 100 {
+		t.Errorf("Expected a verified payment of 100, got %+v", last)
+	}
+
+	// A second use is charged the current price
+	w, resp := quotedRequest(handler, quote, "valid_token")
+	if w.Code != http.StatusPaymentRequired || resp.Accepts[0].MaxAmountRequired != "500" || !strings.Contains(resp.Error, "already been used") {
+		t.Errorf("Expected a reused quote to be refused at 500, got %d %+v", w.Code, resp)
+	}
+}
+
+func TestQuotes_ExpiredAndTamperedRejected(t *testing.T) {
+	quotes := NewQuoteSigner([]byte("quote_secret"), time.Minute)
+	config := testConfig()
+	config.PricePerRequest = 500
+	config.Quotes = quotes
+	handler := Middleware(createTestHandler(), config)
+
+	// Tampered: the price lowered without re-signing
+	quote := issueQuote(t, quotes, "/api/data", 100)
+	encoded, signature, _ := strings.Cut(quote, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(encoded)
+	tampered := base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(payload), `"price":100`, `"price":1`, 1))) + "." + signature
+
+	// Scoped: a quote for another endpoint
+	other := issueQuote(t, quotes, "/api/other", 100)
+
+	for name, token := range map[string]string{"tampered": tampered, "other endpoint": other, "garbage": "not-a-quote"} {
+		_, resp := quotedRequest(handler, token, "")
+		if resp.Accepts[0].MaxAmountRequired != "500" || !strings.Contains(resp.Error, "invalid price quote") {
+			t.Errorf("%s: expected the quote ignored, got %+v", name, resp)
+		}
+	}
+
+	// Expired
+	quotes.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	_, resp := quotedRequest(handler, quote, "")
+	if resp.Accepts[0].MaxAmountRequired != "500" || !strings.Contains(resp.Error, "expired") {
+		t.Errorf("Expected an expired quote ignored, got %+v", resp)
+	}
+}
+
+func TestQuotes_NeverMakeRequestsFree(t *testing.T) {
+	quotes := NewQuoteSigner([]byte("quote_secret"), time.Minute)
+
+	// Endpoints the middleware doesn't charge for have nothing to quote
+	config := testConfig()
+	config.PricePerRequest = 1000
+	config.MethodPricing = MethodPricing{{Path: "/api/free", FreeMethods: []string{"GET"}}}
+	w := httptest.NewRecorder()
+	QuoteHandler(quotes, config.QuotePrice, "USD").ServeHTTP(w, httptest.NewRequest("GET", "/ai/quote?endpoint=/api/free", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unpriced endpoint refused a quote, got %d", w.Code)
+	}
+
+	// A zero quote, however it was signed, doesn't skip payment
+	config.Quotes = quotes
+	handler := Middleware(createTestHandler(), config)
+	_, zero := quotes.Issue("/api/data", "GET", 0, "USD")
+	for i := 0; i < 2; i++ {
+		w, resp := quotedRequest(handler, zero, "")
+		if w.Code != http.StatusPaymentRequired || resp.Accepts[0].MaxAmountRequired != "1000" || !strings.Contains(resp.Error, "invalid price quote") {
+			t.Fatalf("Expected a zero quote refused at 1000, got %d %+v", w.Code, resp)
+		}
+	}
+}
+
+func TestQuotes_AIFirstBudgetDeductsQuotedPrice(t *testing.T) {
+	quotes := NewQuoteSigner([]byte("quote_secret"), time.Minute)
+	store := NewInMemoryPreAuthStore()
+	store.Create(&PreAuthBudget{AgentID: "agent-1", TotalBudget: 1000})
+	handler := AIFirstMiddleware(createTestHandler(), AIFirstConfig{
+		PreAuthStore:  store,
+		EnablePreAuth: true,
+		DefaultCost:   300,
+		Currency:      "USD",
+		Quotes:        quotes,
+	})
+
+	quote := issueQuote(t, quotes, "/api/data", 100)
+	for _, want := range []string{"100", "300"} {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-Agent-ID", "agent-1")
+		req.Header.Set(QuoteHeader, quote)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if got := w.Header().Get("X-Budget-Deducted"); got != want {
+			t.Errorf("Expected %s deducted, got %s", want, got)
+		}
+	}
+}
+
+func TestQuotes_UnifiedChargesQuotedPriceOnce(t *testing.T) {
+	quotes := NewQuoteSigner([]byte("quote_secret"), time.Minute)
+	quote := issueQuote(t, quotes, "/api/data", 100)
+	rail := &recordingRail{EVMCryptoRail: NewEVMCryptoRail("", nil)}
+	registry := NewRailRegistry()
+	registry.Register(rail)
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		PricePerRequest: 500,
+		Currency:        "USD",
+		CryptoEnabled:   true,
+		CryptoPayTo:     "0xseller",
+		CryptoNetworks:  []NetworkType{NetworkBaseSepolia},
+		RailRegistry:    registry,
+		Quotes:          quotes,
+	})
+
+	send := func(paid bool) (*httptest.ResponseRecorder, PaymentOptionsResponse) {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set(QuoteHeader, quote)
+		if paid {
+			req.Header.Set("X-PAYMENT", "payload")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var response PaymentOptionsResponse
+		if w.Code == http.StatusPaymentRequired {
+			json.NewDecoder(w.Body).Decode(&response)
+		}
+		return w, response
+	}
+
+	if _, response := send(false); len(response.Accepts) != 1 || response.Accepts[0].MaxAmountRequired != "100" {
+		t.Errorf("Expected the 402 to ask for the quoted 100, got %+v", response.Accepts)
+	}
+	if w, _ := send(true); w.Code != http.StatusOK || rail.expected != 100 {
+		t.Fatalf("Expected a payment of 100 accepted, got %d verifying %d", w.Code, rail.expected)
+	}
+
+	// A second use is charged the current price
+	w, response := send(true)
+	if w.Code != http.StatusPaymentRequired || rail.expected != 100 || len(response.Accepts) != 1 ||
+		response.Accepts[0].MaxAmountRequired != "500" || !strings.Contains(response.Error, "already been used") {
+		t.Errorf("Expected a reused quote refused at 500, got %d %+v", w.Code, response)
+	}
+
+	// Quotes are in PricePerRequest units
+	err := UnifiedPaymentConfig{Price: "0.01", Quotes: quotes}.Validate()
+	if err == nil {
+		t.Error("Expected Quotes with Price rejected")
+	}
+}
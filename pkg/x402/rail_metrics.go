@@ -0,0 +1,336 @@
+// Package x402 - Rail Metrics
+// When Stripe or a facilitator slows down, request latency climbs with no
+// sign of which rail is responsible. RailMetrics records the latency and
+// outcome of every rail call by rail and operation: as Prometheus histograms
+// and error counters (RailMetricsHandler), and as a rolling RailHealth
+// snapshot per rail for the admin API and anything deciding whether to keep
+// offering a rail. StripeRail, EVMCryptoRail and FacilitatorClient report to
+// their Metrics field; custom rails can call Observe.
+package x402
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rail operations recorded by RailMetrics
+const (
+	RailOpVerify    = "verify"
+	RailOpCapture   = "capture"
+	RailOpSupported = "supported" // A facilitator's /supported listing
+)
+
+// DefaultRailLatencyBuckets are the histogram bounds, in seconds, used when
+// RailMetrics.Buckets is empty
+var DefaultRailLatencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// DefaultRailHealthWindow is how many recent calls RailHealth covers when
+// RailMetrics.Window is 0
+const DefaultRailHealthWindow = 100
+
+// RailHealth is a snapshot of one rail's recent calls
+type RailHealth struct {
+	Rail         string     `json:"rail"`
+	Calls        int64      `json:"calls"`        // Since start
+	Errors       int64      `json:"errors"`       // Since start
+	SuccessRate  float64    `json:"successRate"`  // Over the last Window calls
+	AvgLatencyMs float64    `json:"avgLatencyMs"` // Over the last Window calls
+	P50LatencyMs float64    `json:"p50LatencyMs"` // Over the last Window calls
+	P95LatencyMs float64    `json:"p95LatencyMs"` // Over the last Window calls
+	LastError    string     `json:"lastError,omitempty"`
+	LastErrorAt  *time.Time `json:"lastErrorAt,omitempty"`
+
+	// Circuit is the rail's CircuitBreaker state, if a breaker reports here
+	Circuit CircuitState `json:"circuit,omitempty"`
+}
+
+// RailMetrics records rail call latencies and errors
+type RailMetrics struct {
+	// Buckets are the latency histogram bounds in seconds (default
+	// DefaultRailLatencyBuckets)
+	Buckets []float64
+
+	// Window is how many recent calls RailHealth covers (default
+	// DefaultRailHealthWindow)
+	Window int
+
+	mu          sync.Mutex
+	series      map[railOperation]*latencySeries
+	health      map[string]*railWindow
+	transitions map[railTransition]int64
+}
+
+// railTransition labels a circuit state change count
+type railTransition struct {
+	rail  string
+	state CircuitState
+}
+
+// railOperation labels a series
+type railOperation struct {
+	rail      string
+	operation string
+}
+
+// latencySeries is one rail operation's histogram and error count
+type latencySeries struct {
+	buckets []int64 // Cumulative counts per bound
+	sum     float64
+	count   int64
+	errors  int64
+}
+
+// railCall is a recent call's outcome
+type railCall struct {
+	latency time.Duration
+	failed  bool
+}
+
+// railWindow is a rail's totals and its most recent calls
+type railWindow struct {
+	calls       int64
+	errors      int64
+	recent      []railCall // Ring buffer
+	next        int
+	lastError   string
+	lastErrorAt time.Time
+	circuit     CircuitState
+}
+
+// NewRailMetrics creates metrics with the default buckets and window
+func NewRailMetrics() *RailMetrics {
+	return &RailMetrics{}
+}
+
+// Observe records a call to operation on rail that took latency and failed
+// with err (nil for success). Declined payments are successful calls: only
+// errors reaching the rail count against its health.
+func (m *RailMetrics) Observe(rail, operation string, latency time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.init()
+
+	bounds := m.bounds()
+	key := railOperation{rail, operation}
+	series, ok := m.series[key]
+	if !ok {
+		series = &latencySeries{buckets: make([]int64, len(bounds))}
+		m.series[key] = series
+	}
+	seconds := latency.Seconds()
+	for i, bound := range bounds {
+		if seconds <= bound {
+			series.buckets[i]++
+		}
+	}
+	series.sum += seconds
+	series.count++
+
+	window := m.window(rail)
+	window.calls++
+	call := railCall{latency: latency, failed: err != nil}
+	if err != nil {
+		series.errors++
+		window.errors++
+		window.lastError = err.Error()
+		window.lastErrorAt = time.Now()
+	}
+	if size := m.windowSize(); len(window.recent) < size {
+		window.recent = append(window.recent, call)
+	} else {
+		window.recent[window.next%size] = call
+	}
+	window.next++
+}
+
+// observe records a call to operation on rail started at start
+func (m *RailMetrics) observe(rail, operation string, start time.Time, err error) {
+	m.Observe(rail, operation, time.Since(start), err)
+}
+
+func (m *RailMetrics) bounds() []float64 {
+	if len(m.Buckets) > 0 {
+		return m.Buckets
+	}
+	return DefaultRailLatencyBuckets
+}
+
+// init creates m's maps. Callers hold mu.
+func (m *RailMetrics) init() {
+	if m.series == nil {
+		m.series = make(map[railOperation]*latencySeries)
+		m.health = make(map[string]*railWindow)
+		m.transitions = make(map[railTransition]int64)
+	}
+}
+
+// window returns rail's window, creating it. Callers hold mu.
+func (m *RailMetrics) window(rail string) *railWindow {
+	window, ok := m.health[rail]
+	if !ok {
+		window = &railWindow{}
+		m.health[rail] = window
+	}
+	return window
+}
+
+// circuitChanged records rail's circuit moving to state
+func (m *RailMetrics) circuitChanged(rail string, state CircuitState) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.init()
+	m.window(rail).circuit = state
+	m.transitions[railTransition{rail, state}]++
+}
+
+func (m *RailMetrics) windowSize() int {
+	if m.Window > 0 {
+		return m.Window
+	}
+	return DefaultRailHealthWindow
+}
+
+// Health returns rail's health, and false if no call to it was recorded
+func (m *RailMetrics) Health(rail string) (RailHealth, bool) {
+	if m == nil {
+		return RailHealth{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	window, ok := m.health[rail]
+	if !ok {
+		return RailHealth{}, false
+	}
+	return window.snapshot(rail), true
+}
+
+// Snapshot returns every recorded rail's health, ordered by rail
+func (m *RailMetrics) Snapshot() []RailHealth {
+	snapshot := make([]RailHealth, 0)
+	if m == nil {
+		return snapshot
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for rail, window := range m.health {
+		snapshot = append(snapshot, window.snapshot(rail))
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Rail < snapshot[j].Rail })
+	return snapshot
+}
+
+func (w *railWindow) snapshot(rail string) RailHealth {
+	health := RailHealth{Rail: rail, Calls: w.calls, Errors: w.errors, LastError: w.lastError, Circuit: w.circuit}
+	if !w.lastErrorAt.IsZero() {
+		at := w.lastErrorAt
+		health.LastErrorAt = &at
+	}
+	var failed int
+	var total time.Duration
+	latencies := make([]time.Duration, 0, len(w.recent))
+	for _, call := range w.recent {
+		total += call.latency
+		latencies = append(latencies, call.latency)
+		if call.failed {
+			failed++
+		}
+	}
+	if n := len(w.recent); n > 0 {
+		health.SuccessRate = float64(n-failed) / float64(n)
+		health.AvgLatencyMs = float64(total.Microseconds()) / 1000 / float64(n)
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		health.P50LatencyMs = latencyPercentile(latencies, 0.50)
+		health.P95LatencyMs = latencyPercentile(latencies, 0.95)
+	}
+	return health
+}
+
+// latencyPercentile is the nearest-rank percentile p of sorted latencies, in
+// milliseconds
+func latencyPercentile(sorted []time.Duration, p float64) float64 {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return float64(sorted[rank].Microseconds()) / 1000
+}
+
+// RailMetricsHandler serves m in the Prometheus text format:
+// x402_rail_call_duration_seconds (histogram) and x402_rail_errors_total
+// (counter), labeled by rail and operation, and
+// x402_rail_circuit_transitions_total (counter), labeled by rail and state
+func RailMetricsHandler(m *RailMetrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = w.Write([]byte(m.prometheus()))
+	}
+}
+
+// prometheus renders m in the Prometheus text format
+func (m *RailMetrics) prometheus() string {
+	var out strings.Builder
+	out.WriteString("# HELP x402_rail_call_duration_seconds Latency of payment rail calls.\n")
+	out.WriteString("# TYPE x402_rail_call_duration_seconds histogram\n")
+	if m == nil {
+		return out.String()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]railOperation, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].rail != keys[j].rail {
+			return keys[i].rail < keys[j].rail
+		}
+		return keys[i].operation < keys[j].operation
+	})
+
+	bounds := m.bounds()
+	for _, key := range keys {
+		series := m.series[key]
+		labels := fmt.Sprintf("rail=%q,operation=%q", key.rail, key.operation)
+		for i, bound := range bounds {
+			fmt.Fprintf(&out, "x402_rail_call_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, bound, series.buckets[i])
+		}
+		fmt.Fprintf(&out, "x402_rail_call_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, series.count)
+		fmt.Fprintf(&out, "x402_rail_call_duration_seconds_sum{%s} %g\n", labels, series.sum)
+		fmt.Fprintf(&out, "x402_rail_call_duration_seconds_count{%s} %d\n", labels, series.count)
+	}
+
+	out.WriteString("# HELP x402_rail_errors_total Payment rail calls that failed.\n")
+	out.WriteString("# TYPE x402_rail_errors_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(&out, "x402_rail_errors_total{rail=%q,operation=%q} %d\n", key.rail, key.operation, m.series[key].errors)
+	}
+
+	transitions := make([]railTransition, 0, len(m.transitions))
+	for key := range m.transitions {
+		transitions = append(transitions, key)
+	}
+	sort.Slice(transitions, func(i, j int) bool {
+		if transitions[i].rail != transitions[j].rail {
+			return transitions[i].rail < transitions[j].rail
+		}
+		return transitions[i].state < transitions[j].state
+	})
+	out.WriteString("# HELP x402_rail_circuit_transitions_total Circuit breaker state changes.\n")
+	out.WriteString("# TYPE x402_rail_circuit_transitions_total counter\n")
+	for _, key := range transitions {
+		fmt.Fprintf(&out, "x402_rail_circuit_transitions_total{rail=%q,state=%q} %d\n", key.rail, key.state, m.transitions[key])
+	}
+	return out.String()
+}
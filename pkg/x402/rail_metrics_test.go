@@ -0,0 +1,114 @@
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRailMetrics_RecordsSuccessAndFailure(t *testing.T) {
+	var forms []url.Values
+	stripeAPI := newIntentStripe(t, "usd", 100, "succeeded", &forms)
+	metrics := NewRailMetrics()
+	rail := NewStripeRail("sk_test", "")
+	rail.BaseURL = stripeAPI.URL
+	rail.Metrics = metrics
+
+	verify := func() error {
+		_, err := rail.VerifyPayment(context.Background(), &VerifyPaymentRequest{PaymentIntentID: "pi_1", ExpectedAmount: 100, ExpectedCurrency: "USD"})
+		return err
+	}
+	if err := verify(); err != nil {
+		t.Fatalf("VerifyPayment failed: %v", err)
+	}
+	if _, err := rail.CapturePayment(context.Background(), &CapturePaymentRequest{PaymentID: "pi_1", Amount: 100, Currency: "USD"}); err != nil {
+		t.Fatalf("CapturePayment failed: %v", err)
+	}
+
+	// Stripe goes away
+	stripeAPI.Close()
+	if err := verify(); err == nil {
+		t.Fatal("Expected verification to fail without Stripe")
+	}
+
+	health, ok := metrics.Health(RailStripe)
+	if !ok || health.Calls != 3 || health.Errors != 1 || health.LastErrorAt == nil || health.LastError == "" {
+		t.Fatalf("Expected 3 calls with 1 error, got %+v", health)
+	}
+	if health.SuccessRate < 0.66 || health.SuccessRate > 0.67 || health.AvgLatencyMs <= 0 {
+		t.Errorf("Expected a 2/3 success rate and some latency, got %+v", health)
+	}
+
+	w := httptest.NewRecorder()
+	RailMetricsHandler(metrics).ServeHTTP(w, httptest.NewRequest("GET", "/x402/metrics/rails", nil))
+	for _, line := range []string{
+		`x402_rail_call_duration_seconds_count{rail="stripe",operation="verify"} 2`,
+		`x402_rail_call_duration_seconds_count{rail="stripe",operation="capture"} 1`,
+		`x402_rail_call_duration_seconds_bucket{rail="stripe",operation="verify",le="+Inf"} 2`,
+		`x402_rail_errors_total{rail="stripe",operation="verify"} 1`,
+		`x402_rail_errors_total{rail="stripe",operation="capture"} 0`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("Expected %q in:\n%s", line, w.Body)
+		}
+	}
+}
+
+func TestRailMetrics_FacilitatorClient(t *testing.T) {
+	facilitator := &fakeFacilitator{}
+	facilitator.set(`[{"x402Version":1,"scheme":"exact","network":"base"}]`, false)
+	client := NewFacilitatorClient(facilitator.server(t).URL)
+	client.Metrics = NewRailMetrics()
+
+	client.Supported(context.Background())
+	facilitator.set("", true)
+	client.Supported(context.Background())
+
+	health, _ := client.Metrics.Health("facilitator")
+	if health.Calls != 2 || health.Errors != 1 || health.SuccessRate != 0.5 {
+		t.Errorf("Expected 2 calls with 1 error, got %+v", health)
+	}
+}
+
+func TestRailMetrics_HealthCoversRecentCalls(t *testing.T) {
+	metrics := &RailMetrics{Window: 2}
+	metrics.Observe("evm", RailOpVerify, 10*time.Millisecond, errors.New("facilitator unreachable"))
+	metrics.Observe("evm", RailOpVerify, 20*time.Millisecond, nil)
+	metrics.Observe("evm", RailOpCapture, 40*time.Millisecond, nil)
+
+	health, _ := metrics.Health("evm")
+	if health.Calls != 3 || health.Errors != 1 || health.SuccessRate != 1 || health.AvgLatencyMs != 30 {
+		t.Errorf("Expected the failure aged out of the window, got %+v", health)
+	}
+	if health.P50LatencyMs != 20 || health.P95LatencyMs != 40 {
+		t.Errorf("Expected p50 20ms and p95 40ms, got %v and %v", health.P50LatencyMs, health.P95LatencyMs)
+	}
+	if health.LastError != "facilitator unreachable" {
+		t.Errorf("Expected the last error kept, got %q", health.LastError)
+	}
+	if _, ok := metrics.Health("stripe"); ok {
+		t.Error("Expected no health for a rail never called")
+	}
+}
+
+func TestAdminHandler_Rails(t *testing.T) {
+	metrics := NewRailMetrics()
+	metrics.Observe(RailStripe, RailOpVerify, time.Millisecond, nil)
+	handler := AdminHandler(AdminDeps{APIKey: "admin_secret", RailMetrics: metrics})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("GET", "/admin/rails", ""))
+	var response struct {
+		Rails []RailHealth `json:"rails"`
+	}
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusOK || len(response.Rails) != 1 || response.Rails[0].Rail != RailStripe || response.Rails[0].SuccessRate != 1 {
+		t.Errorf("Expected the Stripe rail's health, got %d %+v", w.Code, response.Rails)
+	}
+}
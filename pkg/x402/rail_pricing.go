@@ -0,0 +1,216 @@
+// Package x402 - Per-Rail Pricing
+// Rails count money in different units: Stripe charges in cents while USDC
+// on-chain uses 6-decimal token units, so a single integer price means 100x
+// different amounts depending on how the client pays. A human decimal Price
+// (or explicit PriceByRail amounts) is converted to each rail's own unit.
+package x402
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Rail IDs of the built-in rails
+const (
+	RailStripe    = "stripe"
+	RailEVMCrypto = "evm-crypto"
+)
+
+// defaultCryptoDecimals is the decimals of USDC, the default CryptoAsset
+const defaultCryptoDecimals = 6
+
+// currencyExponents are the ISO 4217 minor-unit exponents of fiat currencies
+// without the usual two decimals
+var currencyExponents = map[string]int{
+	// Charged in whole units
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0,
+	"KRW": 0, "PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0,
+	"XOF": 0, "XPF": 0,
+
+	// Charged in thousandths
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// tokenDecimals are the decimals of common crypto assets
+var tokenDecimals = map[string]int{
+	"USDC": 6,
+	"USDT": 6,
+	"DAI":  18,
+	"ETH":  18,
+	"WETH": 18,
+}
+
+// currencyDecimals returns the smallest-unit decimals of a currency
+func currencyDecimals(currency string) int {
+	currency = strings.ToUpper(currency)
+	if decimals, ok := tokenDecimals[currency]; ok {
+		return decimals
+	}
+	if exponent, ok := currencyExponents[currency]; ok {
+		return exponent
+	}
+	return 2
+}
+
+// Validate reports pricing that would charge different real amounts on
+// different rails. PricePerRequest is only unambiguous when a single kind of
+// rail is enabled; with both crypto and fiat use Price or PriceByRail.
+func (c UnifiedPaymentConfig) Validate() error {
+	if c.Price != "" && c.PricePerRequest != 0 {
+		return fmt.Errorf("x402: set Price or PricePerRequest, not both")
+	}
+	if c.CryptoDecimals < 0 {
+		return fmt.Errorf("x402: CryptoDecimals must not be negative")
+	}
+	if err := c.ReceiptCookies.Validate(); err != nil {
+		return err
+	}
+	if c.FiatEnabled && c.Subscriptions != nil && c.StripeWebhookSecret == "" {
+		return fmt.Errorf("x402: StripeWebhookSecret is required with Subscriptions, whose webhooks activate them")
+	}
+	for rail, amount := range c.PriceByRail {
+		if amount < 0 {
+			return fmt.Errorf("x402: PriceByRail[%s] must not be negative", rail)
+		}
+	}
+
+	if err := c.TieredPricing.Validate(); err != nil {
+		return err
+	}
+	if c.TieredPricing != nil && (c.Price != "" || len(c.PriceByRail) > 0) {
+		return fmt.Errorf("x402: TieredPricing tiers are in PricePerRequest units; it cannot be combined with Price or PriceByRail")
+	}
+	if err := c.MethodPricing.Validate(); err != nil {
+		return err
+	}
+	if err := validateFailMode(c.FailMode); err != nil {
+		return err
+	}
+	if err := c.Callbacks.Validate(); err != nil {
+		return err
+	}
+	if _, err := parseExemptCIDRs(c.ExemptCIDRs); err != nil {
+		return fmt.Errorf("x402: %w", err)
+	}
+	if err := c.Protocol.Validate(); err != nil {
+		return err
+	}
+	if c.MethodPricing.hasPrices() && (c.Price != "" || len(c.PriceByRail) > 0) {
+		return fmt.Errorf("x402: MethodPricing prices are in PricePerRequest units; it cannot be combined with Price or PriceByRail")
+	}
+	if c.Quotes != nil && (c.Price != "" || len(c.PriceByRail) > 0) {
+		return fmt.Errorf("x402: quoted prices are in PricePerRequest units; Quotes cannot be combined with Price or PriceByRail")
+	}
+	if c.QuickPay && c.PaymentPrefs == nil && c.Tenants == nil {
+		return fmt.Errorf("x402: QuickPay requires PaymentPrefs")
+	}
+	if c.Subscriptions != nil && c.Subscriptions.Store == nil {
+		return fmt.Errorf("x402: Subscriptions requires a Store")
+	}
+	if err := validateAcceptedAssets(c.CryptoAssets); err != nil {
+		return err
+	}
+	if err := c.StripeFees.Validate(); err != nil {
+		return err
+	}
+
+	if c.Price != "" {
+		if c.CryptoEnabled {
+			if _, err := parseDecimalAmount(c.Price, c.cryptoDecimals()); err != nil {
+				return fmt.Errorf("x402: Price for %s: %w", RailEVMCrypto, err)
+			}
+		}
+		if c.FiatEnabled {
+			if _, err := parseDecimalAmount(c.Price, currencyDecimals(c.Currency)); err != nil {
+				return fmt.Errorf("x402: Price for %s in %s: %w", RailStripe, c.Currency, err)
+			}
+		}
+		return nil
+	}
+
+	_, cryptoPriced := c.PriceByRail[RailEVMCrypto]
+	_, fiatPriced := c.PriceByRail[RailStripe]
+	if c.CryptoEnabled && c.FiatEnabled && c.PricePerRequest != 0 && !(cryptoPriced && fiatPriced) {
+		return fmt.Errorf("x402: PricePerRequest %d is ambiguous with crypto and fiat enabled (cents on %s, token units on %s); set Price or PriceByRail",
+			c.PricePerRequest, RailStripe, RailEVMCrypto)
+	}
+	return nil
+}
+
+// RailAmount returns the price in the smallest unit of the given rail:
+// PriceByRail if set, else Price converted with the rail's decimals, else
+// PricePerRequest, less any coupon applied to the request
+func (c UnifiedPaymentConfig) RailAmount(railID string, railType RailType) int64 {
+	decimals := currencyDecimals(c.Currency)
+	if railType == RailTypeCrypto {
+		decimals = c.cryptoDecimals()
+	}
+	return c.coupon.Discount(c.baseRailAmount(railID, decimals), decimals)
+}
+
+// baseRailAmount is RailAmount before coupons
+func (c UnifiedPaymentConfig) baseRailAmount(railID string, decimals int) int64 {
+	if amount, ok := c.PriceByRail[railID]; ok {
+		return amount
+	}
+	if c.Price == "" {
+		return c.PricePerRequest
+	}
+
+	amount, err := parseDecimalAmount(c.Price, decimals)
+	if err != nil {
+		// Rejected by Validate; never undercharge
+		return 0
+	}
+	return amount
+}
+
+// agentAmount is the price charged to AI agent pre-auth budgets, which are
+// held in the crypto asset when crypto is enabled
+func (c UnifiedPaymentConfig) agentAmount() int64 {
+	if c.CryptoEnabled {
+		return c.RailAmount(RailEVMCrypto, RailTypeCrypto)
+	}
+	return c.RailAmount(RailStripe, RailTypeFiat)
+}
+
+func (c UnifiedPaymentConfig) cryptoDecimals() int {
+	if c.CryptoDecimals == 0 {
+		return defaultCryptoDecimals
+	}
+	return c.CryptoDecimals
+}
+
+// parseDecimalAmount converts a decimal string such as "0.01" to an integer
+// amount with the given decimals, without floating point rounding
+func parseDecimalAmount(price string, decimals int) (int64, error) {
+	whole, frac, _ := strings.Cut(strings.TrimSpace(price), ".")
+	if whole == "" {
+		whole = "0"
+	}
+	if !isDigits(whole) || (frac != "" && !isDigits(frac)) {
+		return 0, fmt.Errorf("invalid price %q", price)
+	}
+
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > decimals {
+		return 0, fmt.Errorf("price %q has more than %d decimal places", price, decimals)
+	}
+	frac += strings.Repeat("0", decimals-len(frac))
+
+	amount, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("price %q out of range", price)
+	}
+	return amount, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,212 @@
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseDecimalAmount(t *testing.T) {
+	tests := []struct {
+		price    string
+		decimals int
+		want     int64
+		wantErr  bool
+	}{
+		{"0.01", 2, 1, false},
+		{"0.01", 6, 10000, false},
+		{"1", 6, 1000000, false},
+		{"1.50", 2, 150, false},
+		{".5", 2, 50, false},
+		{"0.001", 2, 0, true},
+		{"abc", 2, 0, true},
+		{"-1", 2, 0, true},
+		{"1.2.3", 2, 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseDecimalAmount(tt.price, tt.decimals)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDecimalAmount(%q, %d) error = %v, wantErr %v", tt.price, tt.decimals, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseDecimalAmount(%q, %d) = %d, expected %d", tt.price, tt.decimals, got, tt.want)
+		}
+	}
+}
+
+func TestUnifiedConfigValidate(t *testing.T) {
+	both := UnifiedPaymentConfig{CryptoEnabled: true, FiatEnabled: true, Currency: "USD"}
+
+	ambiguous := both
+	ambiguous.PricePerRequest = 100
+	if err := ambiguous.Validate(); err == nil {
+		t.Error("Expected PricePerRequest with crypto and fiat to be rejected")
+	}
+
+	conflicting := both
+	conflicting.Price = "0.01"
+	conflicting.PricePerRequest = 100
+	if err := conflicting.Validate(); err == nil {
+		t.Error("Expected Price together with PricePerRequest to be rejected")
+	}
+
+	tooPrecise := both
+	tooPrecise.Price = "0.001"
+	if err := tooPrecise.Validate(); err == nil {
+		t.Error("Expected a price below one cent to be rejected for Stripe")
+	}
+
+	explicit := both
+	explicit.PricePerRequest = 100
+	explicit.PriceByRail = map[string]int64{RailStripe: 1, RailEVMCrypto: 10000}
+	if err := explicit.Validate(); err != nil {
+		t.Errorf("Expected explicit per-rail amounts to be valid, got %v", err)
+	}
+
+	single := UnifiedPaymentConfig{CryptoEnabled: true, PricePerRequest: 10000}
+	if err := single.Validate(); err != nil {
+		t.Errorf("Expected PricePerRequest with a single rail to be valid, got %v", err)
+	}
+}
+
+func TestUnifiedMiddlewarePanicsOnAmbiguousPrice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected UnifiedPaymentMiddleware to panic")
+		}
+	}()
+	UnifiedPaymentMiddleware(http.NotFoundHandler(), UnifiedPaymentConfig{
+		PricePerRequest: 100,
+		CryptoEnabled:   true,
+		FiatEnabled:     true,
+	})
+}
+
+// newFakeStripe serves payment intents echoing the requested amount
+func newFakeStripe(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"pi_test","amount":` + r.Form.Get("amount") + `,"currency":"usd","status":"requires_payment_method","client_secret":"pi_test_secret"}`))
+	}))
+}
+
+func TestUnifiedPaymentOptionsDeriveFromSamePrice(t *testing.T) {
+	stripeAPI := newFakeStripe(t)
+	defer stripeAPI.Close()
+
+	stripe := NewStripeRail("sk_test", "")
+	stripe.BaseURL = stripeAPI.URL
+	registry := NewRailRegistry()
+	registry.Register(stripe)
+
+	handler := UnifiedPaymentMiddleware(http.NotFoundHandler(), UnifiedPaymentConfig{
+		Price:          "0.01",
+		Currency:       "USD",
+		CryptoEnabled:  true,
+		CryptoPayTo:    "0xseller",
+		CryptoNetworks: []NetworkType{NetworkBaseSepolia},
+		FiatEnabled:    true,
+		RailRegistry:   registry,
+	})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/data", nil))
+	if rec.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402, got %d", rec.Code)
+	}
+
+	var response PaymentOptionsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if len(response.Accepts) != 1 || response.Accepts[0].MaxAmountRequired != "10000" {
+		t.Errorf("Expected crypto accepts of 10000 USDC units, got %+v", response.Accepts)
+	}
+
+	amounts := map[string]int64{}
+	for _, option := range response.Options {
+		amounts[option.Rail] = option.Amount
+	}
+	if amounts[RailEVMCrypto] != 10000 {
+		t.Errorf("Expected crypto option of 10000, got %d", amounts[RailEVMCrypto])
+	}
+	if amounts[RailStripe] != 1 {
+		t.Errorf("Expected Stripe option of 1 cent, got %d", amounts[RailStripe])
+	}
+}
+
+// recordingRail captures the amount it was asked to verify
+type recordingRail struct {
+	*EVMCryptoRail
+	expected int64
+}
+
+func (r *recordingRail) VerifyPayment(ctx context.Context, req *VerifyPaymentRequest) (*PaymentVerification, error) {
+	r.expected = req.ExpectedAmount
+	return &PaymentVerification{Valid: true, PaymentID: "pay_1", Amount: req.ExpectedAmount}, nil
+}
+
+func TestUnifiedVerifyUsesRailAmount(t *testing.T) {
+	rail := &recordingRail{EVMCryptoRail: NewEVMCryptoRail("", nil)}
+	registry := NewRailRegistry()
+	registry.Register(rail)
+
+	handler := UnifiedPaymentMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}), UnifiedPaymentConfig{
+		Price:         "0.25",
+		CryptoEnabled: true,
+		FiatEnabled:   true,
+		RailRegistry:  registry,
+	})
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-PAYMENT", "payload")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "ok" {
+		t.Fatalf("Expected verified request to pass, got %d", rec.Code)
+	}
+	if rail.expected != 250000 {
+		t.Errorf("Expected crypto verification of 250000 units, got %d", rail.expected)
+	}
+}
+
+func TestNewDefaultRailRegistry(t *testing.T) {
+	config := UnifiedPaymentConfig{
+		FiatEnabled:     true,
+		StripeSecretKey: "sk_test",
+		CryptoEnabled:   true,
+		FacilitatorURL:  "https://facilitator.example",
+	}
+	a, b := NewDefaultRailRegistry(config), NewDefaultRailRegistry(config)
+	for _, id := range []string{RailStripe, RailEVMCrypto} {
+		if _, ok := a.Get(id); !ok {
+			t.Errorf("Expected the %s rail registered", id)
+		}
+	}
+
+	first, _ := a.Get(RailStripe)
+	second, _ := b.Get(RailStripe)
+	if first == second {
+		t.Error("Expected each registry to have its own rails")
+	}
+
+	if rails := NewDefaultRailRegistry(UnifiedPaymentConfig{FiatEnabled: true, CryptoEnabled: true}).List(); len(rails) != 0 {
+		t.Errorf("Expected no rails without credentials, got %d", len(rails))
+	}
+
+	DefaultRailRegistry.Register(first)
+	if len(DefaultRailRegistry.List()) != 0 {
+		t.Error("Expected rails registered on DefaultRailRegistry ignored")
+	}
+}
@@ -0,0 +1,78 @@
+// Package x402 - Rail Timeouts
+// A hung facilitator or payment API would otherwise hold the client's
+// connection, and a server goroutine, until some outer client gave up.
+// Verification and capture each get a deadline, and FailMode decides whether
+// a payment that timed out is refused or the request is served anyway.
+package x402
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Default deadlines for rail calls
+const (
+	DefaultVerificationTimeout = 5 * time.Second
+	DefaultCaptureTimeout      = 10 * time.Second
+)
+
+// Fail modes for verifications and captures that time out
+const (
+	FailClosed = "closed" // Refuse the request (default)
+	FailOpen   = "open"   // Serve the request without the payment
+)
+
+// validateFailMode reports an unknown FailMode
+func validateFailMode(mode string) error {
+	switch mode {
+	case "", FailClosed, FailOpen:
+		return nil
+	}
+	return fmt.Errorf("x402: FailMode must be %q or %q, got %q", FailClosed, FailOpen, mode)
+}
+
+// railTimeout returns the configured timeout, or def, capped by the quote's
+// MaxTimeoutSeconds
+func railTimeout(configured, def time.Duration, maxTimeoutSeconds int) time.Duration {
+	timeout := configured
+	if timeout <= 0 {
+		timeout = def
+	}
+	if quote := time.Duration(maxTimeoutOrDefault(maxTimeoutSeconds)) * time.Second; quote < timeout {
+		timeout = quote
+	}
+	return timeout
+}
+
+// callWithTimeout runs call with a context that ends after timeout, and
+// returns when it does even if call ignores the context. An abandoned call
+// finishes in the background.
+func callWithTimeout[T any](ctx context.Context, timeout time.Duration, call func(ctx context.Context) (T, error)) (T, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := call(ctx)
+		done <- result{value, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.value, res.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// isTimeout reports whether err is a rail call running out of time
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,132 @@
+package x402
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// slowRail hangs in verification or capture until the context ends
+type slowRail struct {
+	*EVMCryptoRail
+	slowVerify  bool
+	slowCapture bool
+}
+
+func (s *slowRail) VerifyPayment(ctx context.Context, req *VerifyPaymentRequest) (*PaymentVerification, error) {
+	if s.slowVerify {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return &PaymentVerification{Valid: true, PaymentID: "pay_1", Amount: req.ExpectedAmount, RequiresCapture: true}, nil
+}
+
+func (s *slowRail) CapturePayment(ctx context.Context, req *CapturePaymentRequest) (*PaymentCapture, error) {
+	if s.slowCapture {
+		// Ignores the context, like a misbehaving client library
+		time.Sleep(time.Second)
+	}
+	return &PaymentCapture{Success: true, GrossAmount: req.Amount}, nil
+}
+
+func serveWithSlowRail(t *testing.T, rail *slowRail, failMode string) (*httptest.ResponseRecorder, *PaymentFailure, time.Duration) {
+	t.Helper()
+	registry := NewRailRegistry()
+	registry.Register(rail)
+
+	var failure *PaymentFailure
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		PricePerRequest:     100,
+		CryptoEnabled:       true,
+		RailRegistry:        registry,
+		VerificationTimeout: 50 * time.Millisecond,
+		CaptureTimeout:      50 * time.Millisecond,
+		FailMode:            failMode,
+		OnPaymentFailure:    func(ctx context.Context, f *PaymentFailure) { failure = f },
+	})
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-PAYMENT", "payload")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	handler.ServeHTTP(w, req)
+	return w, failure, time.Since(start)
+}
+
+func TestUnifiedVerificationTimeout(t *testing.T) {
+	rail := &slowRail{EVMCryptoRail: NewEVMCryptoRail("", nil), slowVerify: true}
+
+	w, failure, elapsed := serveWithSlowRail(t, rail, "")
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the request to end near the 50ms timeout, took %v", elapsed)
+	}
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 when failing closed, got %d", w.Code)
+	}
+	if failure == nil || failure.Stage != StageVerify || failure.Reason != FailureTimeout {
+		t.Errorf("Expected verify rail_timeout, got %+v", failure)
+	}
+}
+
+func TestUnifiedCaptureTimeout(t *testing.T) {
+	rail := &slowRail{EVMCryptoRail: NewEVMCryptoRail("", nil), slowCapture: true}
+
+	w, failure, elapsed := serveWithSlowRail(t, rail, FailClosed)
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the request to end near the 50ms timeout, took %v", elapsed)
+	}
+	if w.Code != http.StatusPaymentRequired || failure == nil || failure.Stage != StageCapture || failure.Reason != FailureTimeout {
+		t.Errorf("Expected 402 with capture rail_timeout, got %d %+v", w.Code, failure)
+	}
+
+	// Failing open serves the request but still reports the timeout
+	w, failure, _ = serveWithSlowRail(t, rail, FailOpen)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 when failing open, got %d", w.Code)
+	}
+	if failure == nil || failure.Reason != FailureTimeout {
+		t.Errorf("Expected the timeout to be reported, got %+v", failure)
+	}
+}
+
+func TestMiddlewareVerificationTimeout(t *testing.T) {
+	config := testConfig()
+	config.VerificationTimeout = 50 * time.Millisecond
+	config.PaymentVerifier = func(token string) (bool, error) {
+		time.Sleep(time.Second)
+		return true, nil
+	}
+	handler := Middleware(createTestHandler(), config)
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	handler.ServeHTTP(w, req)
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the request to end near the 50ms timeout, took %v", elapsed)
+	}
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402, got %d", w.Code)
+	}
+}
+
+func TestRailTimeoutCappedByQuote(t *testing.T) {
+	if got := railTimeout(0, DefaultCaptureTimeout, 0); got != DefaultCaptureTimeout {
+		t.Errorf("Expected default capture timeout, got %v", got)
+	}
+	if got := railTimeout(30*time.Second, DefaultCaptureTimeout, 2); got != 2*time.Second {
+		t.Errorf("Expected MaxTimeoutSeconds to cap the timeout, got %v", got)
+	}
+}
+
+func TestConfigRejectsUnknownFailMode(t *testing.T) {
+	config := testConfig()
+	config.FailMode = "sometimes"
+	if err := config.Validate(); err == nil {
+		t.Error("Expected unknown FailMode to be rejected")
+	}
+}
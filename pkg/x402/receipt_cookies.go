@@ -0,0 +1,279 @@
+// Package x402 - Receipt Cookies
+// A person who pays on the landing page and then follows a link is asked to
+// pay again: nothing remembers the payment but whatever the page's script
+// does by hand. With ReceiptCookies set, a verified payment also sets an
+// HttpOnly cookie holding a signed receipt, scoped to a path prefix and a
+// TTL, and the payment middlewares serve later requests carrying a valid
+// one without a new payment. Clients that don't keep cookies, like most API
+// clients, are unaffected.
+package x402
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Receipt cookie defaults
+const (
+	DefaultReceiptCookieName = "x402_receipt"
+	DefaultReceiptTTL        = time.Hour
+)
+
+// MinReceiptSecretBytes is the shortest Secret receipts are signed with
+const MinReceiptSecretBytes = 16
+
+// PaymentMethodReceipt is the X-Payment-Method of requests covered by a
+// receipt cookie
+const PaymentMethodReceipt = "receipt"
+
+var (
+	// ErrInvalidReceipt is returned for receipts that are malformed or
+	// tampered with
+	ErrInvalidReceipt = kindOf(ErrInvalidPayment, "invalid payment receipt")
+
+	// ErrReceiptExpired is returned for receipts past their expiry
+	ErrReceiptExpired = kindOf(ErrExpired, "payment receipt has expired")
+)
+
+// PaymentReceipt is what a receipt cookie says was paid for
+type PaymentReceipt struct {
+	Payer     string `json:"payer,omitempty"`
+	Rail      string `json:"rail"`
+	PaymentID string `json:"paymentId,omitempty"`
+	Path      string `json:"path"`      // Prefix of the paths covered
+	ExpiresAt int64  `json:"expiresAt"` // Unix seconds
+}
+
+// ReceiptCookies issues and accepts signed payment receipts in cookies
+type ReceiptCookies struct {
+	// Secret signs receipts (HMAC-SHA256); servers accepting each other's
+	// receipts share it. It must be at least MinReceiptSecretBytes long;
+	// without one no receipt is issued or accepted.
+	Secret []byte
+
+	// Name is the cookie name (default DefaultReceiptCookieName)
+	Name string
+
+	// Path is the prefix of the paths a receipt covers, and the cookie's
+	// Path (default "/")
+	Path string
+
+	// TTL is how long a receipt is accepted (default DefaultReceiptTTL)
+	TTL time.Duration
+
+	// SameSite is the cookie's SameSite mode (default Lax, so links from
+	// other sites still carry it)
+	SameSite http.SameSite
+
+	// Domain is the cookie's Domain (default: the host that set it)
+	Domain string
+
+	// Insecure leaves the Secure attribute off, for plain HTTP development
+	// servers. Browsers only send Secure cookies over HTTPS.
+	Insecure bool
+
+	mu      sync.Mutex
+	revoked map[string]int64 // payment ID -> when its last receipt expires
+
+	// now is stubbed in tests
+	now func() time.Time
+}
+
+// NewReceiptCookies creates receipt cookies signed with secret, accepted for
+// ttl on paths under path. It panics if secret is shorter than
+// MinReceiptSecretBytes.
+func NewReceiptCookies(secret []byte, path string, ttl time.Duration) *ReceiptCookies {
+	c := &ReceiptCookies{Secret: secret, Path: path, TTL: ttl}
+	if err := c.Validate(); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// Validate reports a missing or short Secret
+func (c *ReceiptCookies) Validate() error {
+	if c != nil && len(c.Secret) < MinReceiptSecretBytes {
+		return fmt.Errorf("x402: ReceiptCookies.Secret must be at least %d bytes", MinReceiptSecretBytes)
+	}
+	return nil
+}
+
+func (c *ReceiptCookies) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+func (c *ReceiptCookies) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return DefaultReceiptCookieName
+}
+
+func (c *ReceiptCookies) path() string {
+	if c.Path != "" {
+		return c.Path
+	}
+	return "/"
+}
+
+func (c *ReceiptCookies) ttl() time.Duration {
+	if c.TTL > 0 {
+		return c.TTL
+	}
+	return DefaultReceiptTTL
+}
+
+func (c *ReceiptCookies) sameSite() http.SameSite {
+	if c.SameSite != 0 {
+		return c.SameSite
+	}
+	return http.SameSiteLaxMode
+}
+
+// Sign encodes receipt as base64url(JSON).base64url(HMAC-SHA256), or
+// returns "" if c has no valid Secret
+func (c *ReceiptCookies) Sign(receipt PaymentReceipt) string {
+	if c.Validate() != nil {
+		return ""
+	}
+	payload, _ := json.Marshal(receipt)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(claimsMAC(encoded, c.Secret))
+}
+
+// Verify checks a receipt's signature and expiry and returns it
+func (c *ReceiptCookies) Verify(value string) (*PaymentReceipt, error) {
+	encoded, signature, ok := strings.Cut(value, ".")
+	if !ok || len(c.Secret) < MinReceiptSecretBytes {
+		return nil, ErrInvalidReceipt
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, claimsMAC(encoded, c.Secret)) {
+		return nil, ErrInvalidReceipt
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidReceipt
+	}
+	var receipt PaymentReceipt
+	if err := json.Unmarshal(payload, &receipt); err != nil || receipt.Path == "" {
+		return nil, ErrInvalidReceipt
+	}
+	if c.clock().Unix() >= receipt.ExpiresAt {
+		return nil, ErrReceiptExpired
+	}
+	return &receipt, nil
+}
+
+// issue sets a receipt cookie for a payment verified on r, if c is set and
+// r's path is one its receipts cover, reporting whether it did
+func (c *ReceiptCookies) issue(w http.ResponseWriter, r *http.Request, rail, payer, paymentID string) bool {
+	if c == nil || c.Validate() != nil || !pathCovered(c.path(), r.URL.Path) {
+		return false
+	}
+	expires := c.clock().Add(c.ttl())
+	value := c.Sign(PaymentReceipt{
+		Payer:     payer,
+		Rail:      rail,
+		PaymentID: paymentID,
+		Path:      c.path(),
+		ExpiresAt: expires.Unix(),
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.name(),
+		Value:    value,
+		Path:     c.path(),
+		Domain:   c.Domain,
+		Expires:  expires,
+		MaxAge:   int(c.ttl().Seconds()),
+		HttpOnly: true,
+		Secure:   !c.Insecure,
+		SameSite: c.sameSite(),
+	})
+	return true
+}
+
+// receipt returns the valid receipt r carries for its path, if any
+func (c *ReceiptCookies) receipt(r *http.Request) *PaymentReceipt {
+	if c == nil {
+		return nil
+	}
+	cookie, err := r.Cookie(c.name())
+	if err != nil {
+		return nil
+	}
+	receipt, err := c.Verify(cookie.Value)
+	if err != nil || !pathCovered(receipt.Path, r.URL.Path) || c.isRevoked(receipt.PaymentID) {
+		return nil
+	}
+	return receipt
+}
+
+// Revoke stops accepting the receipts of paymentID, e.g. a bank debit that
+// failed after access was granted
+func (c *ReceiptCookies) Revoke(paymentID string) {
+	if c == nil || paymentID == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock().Unix()
+	if c.revoked == nil {
+		c.revoked = make(map[string]int64)
+	}
+	for id, expiry := range c.revoked {
+		if now >= expiry {
+			delete(c.revoked, id)
+		}
+	}
+	// No receipt issued before now outlives one TTL
+	c.revoked[paymentID] = c.clock().Add(c.ttl()).Unix()
+}
+
+func (c *ReceiptCookies) isRevoked(paymentID string) bool {
+	if paymentID == "" {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.revoked[paymentID]
+	return ok
+}
+
+// serve serves r without payment if it carries a valid receipt, reporting
+// whether it did
+func (c *ReceiptCookies) serve(w http.ResponseWriter, r *http.Request, headers PayerHeaders, audit *AuditLog, next http.Handler) bool {
+	receipt := c.receipt(r)
+	if receipt == nil {
+		return false
+	}
+	headers.set(r, GatewayClaims{
+		Payer:     receipt.Payer,
+		Rail:      receipt.Rail,
+		Resource:  redactedRequestURI(r.URL),
+		Timestamp: c.clock().Unix(),
+	})
+	audit.Record(r, AuditEvent{Decision: AuditVerified, Rail: PaymentMethodReceipt, Payer: receipt.Payer, PaymentID: receipt.PaymentID})
+	w.Header().Set("X-Payment-Verified", "true")
+	w.Header().Set("X-Payment-Method", PaymentMethodReceipt)
+	next.ServeHTTP(w, r)
+	return true
+}
+
+// pathCovered reports whether path is prefix or below it
+func pathCovered(prefix, path string) bool {
+	if prefix == "/" || path == prefix {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
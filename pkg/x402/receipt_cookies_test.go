@@ -0,0 +1,224 @@
+package x402
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReceiptCookies_IssuedAndAccepted(t *testing.T) {
+	now := time.Now()
+	receipts := NewReceiptCookies([]byte("receipt-secret-key"), "/articles", 10*time.Minute)
+	receipts.now = func() time.Time { return now }
+
+	verified := 0
+	config := testConfig()
+	config.TestMode = false
+	config.PaymentVerifier = func(token string) (bool, error) {
+		verified++
+		return token == "valid_token", nil
+	}
+	config.ReceiptCookies = receipts
+	handler := Middleware(createTestHandler(), config)
+
+	req := httptest.NewRequest("GET", "/articles/1", nil)
+	req.Header.Set("Authorization", "Bearer valid_token")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the payment accepted, got %d", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected one receipt cookie, got %d", len(cookies))
+	}
+	cookie := cookies[0]
+	if cookie.Name != DefaultReceiptCookieName || cookie.Path != "/articles" || !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode || cookie.MaxAge != 600 {
+		t.Errorf("Expected a Secure, HttpOnly, Lax cookie scoped to /articles for 10 minutes, got %+v", cookie)
+	}
+
+	get := func(path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// The next page load is served on the receipt alone
+	w = get("/articles/2", cookie)
+	if w.Code != http.StatusOK || w.Header().Get("X-Payment-Method") != PaymentMethodReceipt {
+		t.Errorf("Expected the receipt accepted, got %d (%s)", w.Code, w.Header().Get("X-Payment-Method"))
+	}
+	if verified != 1 {
+		t.Errorf("Expected no verification for the receipt, got %d", verified)
+	}
+
+	// Only under its path prefix
+	if w := get("/articlesarchive", cookie); w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected a receipt for /articles refused on /articlesarchive, got %d", w.Code)
+	}
+
+	// Not once tampered with
+	forged := *cookie
+	forged.Value = receipts.Sign(PaymentReceipt{Rail: "exact", Path: "/", ExpiresAt: now.Add(time.Hour).Unix()}) + "x"
+	if w := get("/articles/2", &forged); w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected a tampered receipt refused, got %d", w.Code)
+	}
+
+	// Nor after its TTL
+	now = now.Add(10 * time.Minute)
+	if w := get("/articles/2", cookie); w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected an expired receipt refused, got %d", w.Code)
+	}
+}
+
+func TestReceiptCookies_RevokedByRefund(t *testing.T) {
+	receipts := NewReceiptCookies([]byte("receipt-secret-key"), "/articles", 10*time.Minute)
+	ledger := NewInMemoryPaymentLedger(100)
+	refunds := &PaymentRefunds{Ledger: ledger, Queue: NewRefundQueue(), Receipts: receipts}
+
+	config := testConfig()
+	config.Ledger = ledger
+	config.ReceiptCookies = receipts
+	multi := assetTestConfig(&assetScheme{})
+	multi.Ledger = ledger
+	multi.ReceiptCookies = receipts
+	payload, _ := json.Marshal(PaymentPayload{Scheme: SchemeExact, Network: NetworkBaseMainnet, Payer: "0xpayer", Asset: "DAI"})
+
+	for name, tc := range map[string]struct {
+		handler http.Handler
+		headers map[string]string
+	}{
+		"Middleware": {Middleware(createTestHandler(), config), map[string]string{
+			"Authorization": "Bearer valid_token", "X-Payer-Address": "0xpayer"}},
+		"MultiSchemeMiddleware": {MultiSchemeMiddleware(createTestHandler(), multi), map[string]string{
+			"X-PAYMENT": base64.StdEncoding.EncodeToString(payload)}},
+	} {
+		req := httptest.NewRequest("GET", "/articles/1", nil)
+		for key, value := range tc.headers {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		tc.handler.ServeHTTP(w, req)
+		cookies := w.Result().Cookies()
+		if w.Code != http.StatusOK || len(cookies) != 1 {
+			t.Fatalf("%s: expected the payment accepted with a receipt, got %d", name, w.Code)
+		}
+		info, err := receipts.Verify(cookies[0].Value)
+		if err != nil || info.PaymentID == "" {
+			t.Fatalf("%s: expected the receipt to name its ledger record, got %+v (%v)", name, info, err)
+		}
+
+		if _, _, err := refunds.Refund(context.Background(), RefundPaymentRequest{PaymentID: info.PaymentID}); err != nil {
+			t.Fatalf("%s: expected the payment refunded, got %v", name, err)
+		}
+		req = httptest.NewRequest("GET", "/articles/2", nil)
+		req.AddCookie(cookies[0])
+		w = httptest.NewRecorder()
+		tc.handler.ServeHTTP(w, req)
+		if w.Code != http.StatusPaymentRequired {
+			t.Errorf("%s: expected the refunded payment's receipt refused, got %d", name, w.Code)
+		}
+	}
+}
+
+func TestReceiptCookies_APIClientsUnaffected(t *testing.T) {
+	receipts := &ReceiptCookies{Secret: []byte("receipt-secret-key")}
+	cookie := &http.Cookie{Name: DefaultReceiptCookieName, Value: receipts.Sign(PaymentReceipt{Rail: "exact", Path: "/", ExpiresAt: time.Now().Add(time.Hour).Unix()})}
+
+	enabled := testConfig()
+	enabled.ReceiptCookies = receipts
+	tests := []struct {
+		name   string
+		config Config
+		token  string
+		cookie *http.Cookie
+		want   int
+	}{
+		{"no payment", enabled, "", nil, http.StatusPaymentRequired},
+		{"paid with a header", enabled, "valid_1", nil, http.StatusOK},
+		{"receipts disabled", testConfig(), "", cookie, http.StatusPaymentRequired},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		if tt.cookie != nil {
+			req.AddCookie(tt.cookie)
+		}
+		w := httptest.NewRecorder()
+		Middleware(createTestHandler(), tt.config).ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, w.Code)
+		}
+	}
+}
+
+func TestReceiptCookies_RequireSecret(t *testing.T) {
+	for _, secret := range []string{"", "short"} {
+		receipts := &ReceiptCookies{Secret: []byte(secret)}
+		config := testConfig()
+		config.ReceiptCookies = receipts
+		if config.Validate() == nil || (UnifiedPaymentConfig{ReceiptCookies: receipts}).Validate() == nil {
+			t.Errorf("%q: expected the secret rejected", secret)
+		}
+
+		// A receipt MACed with the same weak key is still refused
+		encoded := base64.RawURLEncoding.EncodeToString([]byte(`{"rail":"exact","path":"/","expiresAt":9999999999}`))
+		forged := encoded + "." + base64.RawURLEncoding.EncodeToString(claimsMAC(encoded, []byte(secret)))
+		if _, err := receipts.Verify(forged); err == nil {
+			t.Errorf("%q: expected a receipt refused without a secret", secret)
+		}
+		if receipts.Sign(PaymentReceipt{Rail: "exact", Path: "/"}) != "" {
+			t.Errorf("%q: expected nothing signed without a secret", secret)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected NewReceiptCookies to refuse an empty secret")
+		}
+	}()
+	NewReceiptCookies(nil, "/", time.Hour)
+}
+
+func TestReceiptCookies_UnifiedMiddleware(t *testing.T) {
+	rail := &countingRail{EVMCryptoRail: NewEVMCryptoRail("", nil)}
+	registry := NewRailRegistry()
+	registry.Register(rail)
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		Price:          "0.01",
+		CryptoEnabled:  true,
+		RailRegistry:   registry,
+		ReceiptCookies: &ReceiptCookies{Secret: []byte("receipt-secret-key"), Name: "paid", Insecure: true},
+	})
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-PAYMENT", "payload")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusOK || len(cookies) != 1 || cookies[0].Name != "paid" || cookies[0].Secure {
+		t.Fatalf("Expected an insecure receipt cookie named paid, got %d with %+v", w.Code, cookies)
+	}
+	receipt, err := (&ReceiptCookies{Secret: []byte("receipt-secret-key")}).Verify(cookies[0].Value)
+	if err != nil || receipt.Rail != rail.ID() || receipt.PaymentID != "pay_1" {
+		t.Errorf("Expected a receipt for pay_1 on %s, got %+v (%v)", rail.ID(), receipt, err)
+	}
+
+	req = httptest.NewRequest("GET", "/api/data", nil)
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || rail.verified.Load() != 1 || rail.captured.Load() != 1 {
+		t.Errorf("Expected the receipt accepted without charging again, got %d after %d captures", w.Code, rail.captured.Load())
+	}
+}
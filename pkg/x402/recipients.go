@@ -0,0 +1,94 @@
+// Package x402 - Per-Resource Recipients
+// A marketplace gateway sells many sellers' APIs, each paid out to its own
+// wallet and Stripe account. UnifiedPaymentConfig.Recipients names the
+// recipient of each request: its 402 quotes that wallet (and asset) and
+// creates Stripe intents on that seller's connected account, and payments
+// are verified against the same recipient, so a payment to one seller can't
+// be presented for another's resource. A recipient that can't be resolved,
+// or doesn't look right, fails closed: the request is refused rather than
+// quoted to the gateway's own CryptoPayTo.
+package x402
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Recipient is who a request's payment goes to
+type Recipient struct {
+	PayTo         string `json:"payTo"`                   // Wallet crypto payments go to
+	StripeAccount string `json:"stripeAccount,omitempty"` // Stripe Connect account card payments are made on ("" = the platform's)
+	Asset         string `json:"asset,omitempty"`         // Token contract ("" = CryptoAsset)
+}
+
+// RecipientResolver names the recipient of a request's payment. A zero
+// Recipient means none could be resolved.
+type RecipientResolver func(r *http.Request) Recipient
+
+// RecipientsByPath resolves recipients by the longest path prefix they are
+// listed under; unlisted paths have none
+func RecipientsByPath(recipients map[string]Recipient) RecipientResolver {
+	return func(r *http.Request) Recipient {
+		var match string
+		for prefix := range recipients {
+			if strings.HasPrefix(r.URL.Path, prefix) && len(prefix) > len(match) {
+				match = prefix
+			}
+		}
+		if match == "" {
+			return Recipient{}
+		}
+		return recipients[match]
+	}
+}
+
+// ErrRecipientUnresolved is the error of requests whose recipient could not
+// be resolved
+var ErrRecipientUnresolved = errors.New("payment recipient could not be resolved")
+
+// evmAddress matches a 0x-prefixed 20-byte hex address
+var evmAddress = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+
+// validate checks recipient can be paid by config's rails
+func (recipient Recipient) validate(config UnifiedPaymentConfig) error {
+	switch {
+	case recipient == Recipient{}:
+		return ErrRecipientUnresolved
+	case config.CryptoEnabled && !evmAddress.MatchString(recipient.PayTo):
+		return fmt.Errorf("%w: payTo %q is not an address", ErrRecipientUnresolved, recipient.PayTo)
+	case recipient.Asset != "" && !evmAddress.MatchString(recipient.Asset):
+		return fmt.Errorf("%w: asset %q is not a token contract", ErrRecipientUnresolved, recipient.Asset)
+	case recipient.StripeAccount != "" && !strings.HasPrefix(recipient.StripeAccount, "acct_"):
+		return fmt.Errorf("%w: %q is not a Stripe account", ErrRecipientUnresolved, recipient.StripeAccount)
+	}
+	return nil
+}
+
+// resolveRecipient points config, a per-request copy, at r's recipient.
+// Without Recipients it is left as configured.
+func (c *UnifiedPaymentConfig) resolveRecipient(r *http.Request) error {
+	if c.Recipients == nil {
+		return nil
+	}
+	recipient := c.Recipients(r)
+	if err := recipient.validate(*c); err != nil {
+		return err
+	}
+	c.CryptoPayTo = recipient.PayTo
+	if recipient.Asset != "" {
+		c.CryptoAsset = recipient.Asset
+	}
+	c.stripeAccount = recipient.StripeAccount
+	return nil
+}
+
+// refuseUnresolvedRecipient answers a request whose recipient is unknown
+func refuseUnresolvedRecipient(w http.ResponseWriter, r *http.Request, audit *AuditLog, err error) {
+	log.Printf("x402: %s %s: %v", r.Method, r.URL.Path, err)
+	audit.Record(r, AuditEvent{Decision: AuditRejected, Reason: "recipient_unresolved"})
+	http.Error(w, "Payment recipient unavailable", http.StatusServiceUnavailable)
+}
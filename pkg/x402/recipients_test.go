@@ -0,0 +1,181 @@
+package x402
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	sellerAWallet = "0x00000000000000000000000000000000000000aa"
+	sellerBWallet = "0x00000000000000000000000000000000000000bb"
+)
+
+// payToRail records the recipient it was asked to verify payment to
+type payToRail struct {
+	*EVMCryptoRail
+	payTo string
+}
+
+func (r *payToRail) VerifyPayment(ctx context.Context, req *VerifyPaymentRequest) (*PaymentVerification, error) {
+	r.payTo = req.ExpectedPayTo
+	return &PaymentVerification{Valid: true, PaymentID: "pay_1", Amount: req.ExpectedAmount}, nil
+}
+
+func TestRecipients_PathsPayDifferentWallets(t *testing.T) {
+	rail := &payToRail{EVMCryptoRail: NewEVMCryptoRail("", nil)}
+	registry := NewRailRegistry()
+	registry.Register(rail)
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		PricePerRequest: 100,
+		CryptoEnabled:   true,
+		CryptoPayTo:     "0x0000000000000000000000000000000000000001",
+		CryptoNetworks:  []NetworkType{NetworkBaseSepolia},
+		RailRegistry:    registry,
+		Recipients: RecipientsByPath(map[string]Recipient{
+			"/seller-a/": {PayTo: sellerAWallet},
+			"/seller-b/": {PayTo: sellerBWallet},
+		}),
+	})
+
+	for path, wallet := range map[string]string{"/seller-a/data": sellerAWallet, "/seller-b/data": sellerBWallet} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var response PaymentOptionsResponse
+		json.NewDecoder(w.Body).Decode(&response)
+		if len(response.Accepts) != 1 || response.Accepts[0].PayTo != wallet {
+			t.Errorf("%s: expected requirements paying %s, got %+v", path, wallet, response.Accepts)
+		}
+
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-PAYMENT", "payload")
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || rail.payTo != wallet {
+			t.Errorf("%s: expected payment verified against %s, got %d verifying %q", path, wallet, w.Code, rail.payTo)
+		}
+	}
+}
+
+func TestRecipients_FailClosed(t *testing.T) {
+	rail := &payToRail{EVMCryptoRail: NewEVMCryptoRail("", nil)}
+	registry := NewRailRegistry()
+	registry.Register(rail)
+	sink := NewInMemoryAuditSink()
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		PricePerRequest: 100,
+		CryptoEnabled:   true,
+		CryptoPayTo:     "0x0000000000000000000000000000000000000001",
+		CryptoNetworks:  []NetworkType{NetworkBaseSepolia},
+		RailRegistry:    registry,
+		Audit:           &AuditLog{Sink: sink},
+		Recipients: RecipientsByPath(map[string]Recipient{
+			"/seller-a/": {PayTo: sellerAWallet},
+			"/typo/":     {PayTo: "0xseller"},
+			"/connect/":  {PayTo: sellerBWallet, StripeAccount: "seller"},
+		}),
+	})
+
+	for _, path := range []string{"/unlisted/data", "/typo/data", "/connect/data"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-PAYMENT", "payload")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusServiceUnavailable || strings.Contains(w.Body.String(), "accepts") {
+			t.Errorf("%s: expected 503 without options, got %d: %s", path, w.Code, w.Body.String())
+		}
+	}
+	if rail.payTo != "" {
+		t.Errorf("Expected nothing verified, got a payment to %q", rail.payTo)
+	}
+	events := sink.Events()
+	if len(events) != 3 || events[0].Reason != "recipient_unresolved" {
+		t.Errorf("Expected 3 recipient_unresolved rejections audited, got %+v", events)
+	}
+}
+
+// connectStripe fakes Stripe Connect: intents are only found on the account
+// they were created on
+type connectStripe struct {
+	mu       sync.Mutex
+	accounts map[string]string // intent ID -> Stripe-Account it was created on
+}
+
+func (s *connectStripe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account := r.Header.Get("Stripe-Account")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "POST" && r.URL.Path == "/payment_intents" {
+		id := fmt.Sprintf("pi_%d", len(s.accounts)+1)
+		s.accounts[id] = account
+		fmt.Fprintf(w, `{"id":%q,"amount":1,"currency":"usd","status":"requires_payment_method","client_secret":"%s_secret_test"}`, id, id)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/payment_intents/")
+	if created, ok := s.accounts[id]; !ok || created != account {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"type":"invalid_request_error","code":"resource_missing","message":"No such payment_intent"}}`))
+		return
+	}
+	fmt.Fprintf(w, `{"id":%q,"amount":1,"currency":"usd","status":"succeeded"}`, id)
+}
+
+func TestRecipients_StripeConnectedAccount(t *testing.T) {
+	fake := &connectStripe{accounts: map[string]string{}}
+	stripeAPI := httptest.NewServer(fake)
+	defer stripeAPI.Close()
+	stripe := NewStripeRail("sk_test", "")
+	stripe.BaseURL = stripeAPI.URL
+	registry := NewRailRegistry()
+	registry.Register(stripe)
+
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		Price:        "0.01",
+		Currency:     "USD",
+		FiatEnabled:  true,
+		RailRegistry: registry,
+		Recipients: RecipientsByPath(map[string]Recipient{
+			"/seller-a/": {StripeAccount: "acct_sellerA"},
+			"/seller-b/": {StripeAccount: "acct_sellerB"},
+		}),
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/seller-a/data", nil))
+	var intentID string
+	var response PaymentOptionsResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	for _, option := range response.Options {
+		if option.Rail == RailStripe {
+			intentID, _, _ = strings.Cut(option.ClientSecret, "_secret")
+		}
+	}
+	if intentID == "" || fake.accounts[intentID] != "acct_sellerA" {
+		t.Fatalf("Expected an intent created on acct_sellerA, got %q on %q", intentID, fake.accounts[intentID])
+	}
+
+	proof, _ := json.Marshal(PaymentProof{Rail: RailStripe, PaymentIntentID: intentID})
+	present := func(path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-PAYMENT-PROOF", base64.StdEncoding.EncodeToString(proof))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := present("/seller-a/data"); code != http.StatusOK {
+		t.Errorf("Expected the connected account's payment accepted, got %d", code)
+	}
+
+	// Paid to seller A, it buys nothing from seller B
+	if code := present("/seller-b/data"); code != http.StatusPaymentRequired {
+		t.Errorf("Expected seller A's payment refused for seller B, got %d", code)
+	}
+}
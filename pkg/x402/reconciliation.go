@@ -0,0 +1,246 @@
+// Package x402 - Reconciliation
+// Finance reconciles what the middleware verified against what actually
+// settled. A ReconciliationReport totals the payment ledger by rail and
+// currency for a time range and lists the payments that need a look:
+// verified but never settled, reverted on-chain, or settled twice.
+package x402
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// PaymentStatusRefunded marks a ledger record whose payment was refunded
+const PaymentStatusRefunded = "refunded"
+
+// Reconciliation anomaly kinds
+const (
+	AnomalyOrphaned             = "orphaned"              // Verified but never settled within the grace period
+	AnomalyReverted             = "reverted"              // Settlement reverted after content was served
+	AnomalyDuplicateTransaction = "duplicate_transaction" // One transaction settles several payments
+	AnomalyMeteringMismatch     = "metering_mismatch"     // Metered revenue differs from the ledger
+)
+
+// defaultSettlementGrace is how long a verified payment may stay unsettled
+const defaultSettlementGrace = time.Hour
+
+// ReconciliationConfig is the data a ReconciliationReport is built from
+type ReconciliationConfig struct {
+	Ledger PaymentLedger
+
+	// Metering, if set, is checked against the ledger's verified revenue
+	Metering MeteringStore
+
+	// SettlementGrace is how long a payment may stay verified before it is
+	// reported as orphaned (default 1h)
+	SettlementGrace time.Duration
+
+	now func() time.Time
+}
+
+// ReconciliationAmount is a count of payments and their total
+type ReconciliationAmount struct {
+	Count  int   `json:"count"`
+	Amount int64 `json:"amount"`
+}
+
+func (a *ReconciliationAmount) add(amount int64) {
+	a.Count++
+	a.Amount += amount
+}
+
+// ReconciliationTotals are the payments of one rail and currency. Totals
+// are cumulative: Verified counts every accepted payment, Captured those
+// that settled (including later refunds), and Confirmed those mined.
+// Refunded counts payments refunded in whole or in part, and what was
+// refunded.
+type ReconciliationTotals struct {
+	Rail      string               `json:"rail"`
+	Currency  string               `json:"currency"`
+	Verified  ReconciliationAmount `json:"verified"`
+	Captured  ReconciliationAmount `json:"captured"`
+	Confirmed ReconciliationAmount `json:"confirmed"`
+	Refunded  ReconciliationAmount `json:"refunded"`
+	Reverted  ReconciliationAmount `json:"reverted"`
+	Orphaned  ReconciliationAmount `json:"orphaned"`
+}
+
+// ReconciliationAnomaly is a discrepancy needing investigation
+type ReconciliationAnomaly struct {
+	Kind          string   `json:"kind"`
+	PaymentIDs    []string `json:"paymentIds,omitempty"`
+	TransactionID string   `json:"transactionId,omitempty"`
+	Amount        int64    `json:"amount,omitempty"`
+	Message       string   `json:"message"`
+}
+
+// ReconciliationReport reconciles the ledger for [Start, End]
+type ReconciliationReport struct {
+	Start       time.Time               `json:"start"`
+	End         time.Time               `json:"end"`
+	GeneratedAt time.Time               `json:"generatedAt"`
+	Totals      []ReconciliationTotals  `json:"totals"`
+	Anomalies   []ReconciliationAnomaly `json:"anomalies"`
+
+	// MeteredRevenue is the metering store's revenue, when configured
+	MeteredRevenue *int64 `json:"meteredRevenue,omitempty"`
+}
+
+func (c ReconciliationConfig) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// Report reconciles the payments recorded between start and end
+func (c ReconciliationConfig) Report(start, end time.Time) (*ReconciliationReport, error) {
+	if c.Ledger == nil {
+		return nil, fmt.Errorf("x402: reconciliation requires a Ledger")
+	}
+	records, err := c.Ledger.List(LedgerFilter{StartTime: &start, EndTime: &end})
+	if err != nil {
+		return nil, err
+	}
+	// Oldest first so anomalies read chronologically
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp.Before(records[j].Timestamp)
+	})
+
+	now := c.clock()
+	grace := c.SettlementGrace
+	if grace <= 0 {
+		grace = defaultSettlementGrace
+	}
+
+	report := &ReconciliationReport{
+		Start:       start,
+		End:         end,
+		GeneratedAt: now,
+		Totals:      []ReconciliationTotals{},
+		Anomalies:   []ReconciliationAnomaly{},
+	}
+
+	totals := make(map[[2]string]*ReconciliationTotals)
+	byTransaction := make(map[string][]PaymentRecord)
+	var verifiedRevenue int64
+	currencies := make(map[string]bool)
+
+	for _, rec := range records {
+		if rec.Status == PaymentStatusFailed {
+			continue
+		}
+		rail := recordRail(rec)
+		key := [2]string{rail, rec.Currency}
+		t, ok := totals[key]
+		if !ok {
+			t = &ReconciliationTotals{Rail: rail, Currency: rec.Currency}
+			totals[key] = t
+		}
+
+		t.Verified.add(rec.Amount)
+		verifiedRevenue += rec.Amount
+		currencies[rec.Currency] = true
+
+		switch rec.Status {
+		case PaymentStatusSettled:
+			t.Captured.add(rec.Amount)
+		case PaymentStatusConfirmed:
+			t.Captured.add(rec.Amount)
+			t.Confirmed.add(rec.Amount)
+		case PaymentStatusRefunded:
+			t.Captured.add(rec.Amount)
+			t.Refunded.add(rec.Amount)
+		case PaymentStatusReverted:
+			t.Reverted.add(rec.Amount)
+			report.Anomalies = append(report.Anomalies, ReconciliationAnomaly{
+				Kind:          AnomalyReverted,
+				PaymentIDs:    []string{rec.ID},
+				TransactionID: rec.TransactionID,
+				Amount:        rec.Amount,
+				Message:       "settlement reverted after the payment was accepted",
+			})
+		case PaymentStatusVerified:
+			if now.Sub(rec.Timestamp) > grace {
+				t.Orphaned.add(rec.Amount)
+				report.Anomalies = append(report.Anomalies, ReconciliationAnomaly{
+					Kind:       AnomalyOrphaned,
+					PaymentIDs: []string{rec.ID},
+					Amount:     rec.Amount,
+					Message:    fmt.Sprintf("verified %s ago and never settled", now.Sub(rec.Timestamp).Round(time.Second)),
+				})
+			}
+		}
+		if rec.Refunded > 0 && rec.Status != PaymentStatusRefunded {
+			t.Refunded.add(rec.Refunded) // Partly refunded
+		}
+
+		if rec.TransactionID != "" && rec.Status != PaymentStatusReverted {
+			byTransaction[rec.TransactionID] = append(byTransaction[rec.TransactionID], rec)
+		}
+	}
+
+	txIDs := make([]string, 0, len(byTransaction))
+	for txID, recs := range byTransaction {
+		if len(recs) > 1 {
+			txIDs = append(txIDs, txID)
+		}
+	}
+	sort.Strings(txIDs)
+	for _, txID := range txIDs {
+		recs := byTransaction[txID]
+		anomaly := ReconciliationAnomaly{
+			Kind:          AnomalyDuplicateTransaction,
+			TransactionID: txID,
+			Message:       fmt.Sprintf("transaction is recorded for %d payments", len(recs)),
+		}
+		for _, rec := range recs {
+			anomaly.PaymentIDs = append(anomaly.PaymentIDs, rec.ID)
+			anomaly.Amount += rec.Amount
+		}
+		report.Anomalies = append(report.Anomalies, anomaly)
+	}
+
+	for _, t := range totals {
+		report.Totals = append(report.Totals, *t)
+	}
+	sort.Slice(report.Totals, func(i, j int) bool {
+		if report.Totals[i].Rail != report.Totals[j].Rail {
+			return report.Totals[i].Rail < report.Totals[j].Rail
+		}
+		return report.Totals[i].Currency < report.Totals[j].Currency
+	})
+
+	if c.Metering != nil {
+		metrics, err := c.Metering.GetMetrics(MetricsFilter{StartTime: &start, EndTime: &end})
+		if err != nil {
+			return nil, err
+		}
+		metered := metrics.TotalRevenue
+		report.MeteredRevenue = &metered
+
+		// Revenue in different currencies can't be compared as one number
+		if len(currencies) <= 1 && metered != verifiedRevenue {
+			report.Anomalies = append(report.Anomalies, ReconciliationAnomaly{
+				Kind:    AnomalyMeteringMismatch,
+				Amount:  metered - verifiedRevenue,
+				Message: fmt.Sprintf("metering recorded %d but the ledger verified %d", metered, verifiedRevenue),
+			})
+		}
+	}
+
+	return report, nil
+}
+
+// recordRail names the rail a ledger record was paid on
+func recordRail(rec PaymentRecord) string {
+	switch {
+	case rec.Rail != "":
+		return rec.Rail
+	case rec.Scheme != "":
+		return rec.Scheme
+	default:
+		return "unknown"
+	}
+}
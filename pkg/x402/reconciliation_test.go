@@ -0,0 +1,222 @@
+package x402
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var reconcileTime = time.Date(2026, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+// gappyLedger records a day of payments with deliberate gaps
+func gappyLedger() *InMemoryPaymentLedger {
+	ledger := NewInMemoryPaymentLedger(0)
+	at := func(hoursAgo int) time.Time { return reconcileTime.Add(-time.Duration(hoursAgo) * time.Hour) }
+
+	ledger.Record(PaymentRecord{ID: "confirmed", Rail: RailEVMCrypto, Currency: "USDC", Amount: 100, TransactionID: "0x1", Status: PaymentStatusConfirmed, Timestamp: at(10)})
+	ledger.Record(PaymentRecord{ID: "double", Rail: RailEVMCrypto, Currency: "USDC", Amount: 100, TransactionID: "0x1", Status: PaymentStatusSettled, Timestamp: at(9)})
+	ledger.Record(PaymentRecord{ID: "reverted", Rail: RailEVMCrypto, Currency: "USDC", Amount: 50, TransactionID: "0x2", Status: PaymentStatusReverted, Timestamp: at(8)})
+	ledger.Record(PaymentRecord{ID: "orphan", Rail: RailEVMCrypto, Currency: "USDC", Amount: 70, Status: PaymentStatusVerified, Timestamp: at(5)})
+	ledger.Record(PaymentRecord{ID: "recent", Rail: RailEVMCrypto, Currency: "USDC", Amount: 30, Status: PaymentStatusVerified, Timestamp: reconcileTime.Add(-time.Minute)})
+	ledger.Record(PaymentRecord{ID: "card", Rail: RailStripe, Currency: "USD", Amount: 500, TransactionID: "pi_1", Status: PaymentStatusRefunded, Timestamp: at(4)})
+	ledger.Record(PaymentRecord{ID: "declined", Rail: RailStripe, Currency: "USD", Amount: 500, Status: PaymentStatusFailed, Timestamp: at(3)})
+	ledger.Record(PaymentRecord{ID: "old", Rail: RailStripe, Currency: "USD", Amount: 900, Status: PaymentStatusVerified, Timestamp: at(48)})
+	return ledger
+}
+
+func TestReconciliationReport(t *testing.T) {
+	config := ReconciliationConfig{Ledger: gappyLedger(), now: func() time.Time { return reconcileTime }}
+	report, err := config.Report(reconcileTime.Add(-24*time.Hour), reconcileTime)
+	if err != nil {
+		t.Fatalf("Report failed: %v", err)
+	}
+
+	if len(report.Totals) != 2 {
+		t.Fatalf("Expected totals for 2 rails, got %+v", report.Totals)
+	}
+	crypto, card := report.Totals[0], report.Totals[1]
+	if crypto.Rail != RailEVMCrypto || crypto.Verified != (ReconciliationAmount{5, 350}) ||
+		crypto.Captured != (ReconciliationAmount{2, 200}) || crypto.Confirmed != (ReconciliationAmount{1, 100}) ||
+		crypto.Reverted != (ReconciliationAmount{1, 50}) || crypto.Orphaned != (ReconciliationAmount{1, 70}) {
+		t.Errorf("Unexpected crypto totals: %+v", crypto)
+	}
+	if card.Rail != RailStripe || card.Verified != (ReconciliationAmount{1, 500}) || card.Refunded != (ReconciliationAmount{1, 500}) {
+		t.Errorf("Expected the failed and out-of-range card payments to be excluded, got %+v", card)
+	}
+
+	anomalies := map[string][]string{}
+	for _, a := range report.Anomalies {
+		anomalies[a.Kind] = append(anomalies[a.Kind], a.PaymentIDs...)
+	}
+	want := map[string][]string{
+		AnomalyReverted:             {"reverted"},
+		AnomalyOrphaned:             {"orphan"},
+		AnomalyDuplicateTransaction: {"confirmed", "double"},
+	}
+	for kind, ids := range want {
+		got := anomalies[kind]
+		if len(got) != len(ids) || got[0] != ids[0] || got[len(got)-1] != ids[len(ids)-1] {
+			t.Errorf("Expected %s anomaly for %v, got %v", kind, ids, got)
+		}
+	}
+	if len(report.Anomalies) != 3 {
+		t.Errorf("Expected exactly 3 anomalies, got %+v", report.Anomalies)
+	}
+}
+
+func TestReconciliationPartialRefund(t *testing.T) {
+	ledger := NewInMemoryPaymentLedger(0)
+	ledger.Record(PaymentRecord{ID: "card", Rail: RailStripe, Currency: "USD", Amount: 500, Status: PaymentStatusSettled, Timestamp: reconcileTime.Add(-time.Hour)})
+	ledger.RecordRefund("card", 200)
+
+	config := ReconciliationConfig{Ledger: ledger, now: func() time.Time { return reconcileTime }}
+	report, err := config.Report(reconcileTime.Add(-24*time.Hour), reconcileTime)
+	if err != nil {
+		t.Fatalf("Report failed: %v", err)
+	}
+	card := report.Totals[0]
+	if card.Captured != (ReconciliationAmount{1, 500}) || card.Refunded != (ReconciliationAmount{1, 200}) {
+		t.Errorf("Expected 500 captured and 200 of it refunded, got %+v", card)
+	}
+}
+
+func TestReconciliationMeteringMismatch(t *testing.T) {
+	ledger := NewInMemoryPaymentLedger(0)
+	ledger.Record(PaymentRecord{Scheme: "exact", Currency: "USDC", Amount: 100, Timestamp: reconcileTime.Add(-time.Minute)})
+
+	metering := NewInMemoryMeteringStore(0, "USDC")
+	for i := 0; i < 2; i++ {
+		metering.RecordRequest(UsageMetric{Timestamp: reconcileTime.Add(-time.Minute), Endpoint: "/api/data", AmountPaid: 100, ResponseCode: http.StatusOK})
+	}
+
+	config := ReconciliationConfig{Ledger: ledger, Metering: metering, now: func() time.Time { return reconcileTime }}
+	report, err := config.Report(reconcileTime.Add(-time.Hour), reconcileTime)
+	if err != nil {
+		t.Fatalf("Report failed: %v", err)
+	}
+	if report.MeteredRevenue == nil || *report.MeteredRevenue != 200 {
+		t.Errorf("Expected metered revenue 200, got %v", report.MeteredRevenue)
+	}
+	if len(report.Anomalies) != 1 || report.Anomalies[0].Kind != AnomalyMeteringMismatch || report.Anomalies[0].Amount != 100 {
+		t.Errorf("Expected a metering mismatch of 100, got %+v", report.Anomalies)
+	}
+}
+
+func TestAdminHandler_Reconciliation(t *testing.T) {
+	handler, deps := newTestAdminHandler()
+	deps.Ledger.Record(PaymentRecord{ID: "stale", Rail: RailEVMCrypto, Currency: "USDC", Amount: 100, Timestamp: time.Now().Add(-3 * time.Hour)})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("GET", "/admin/reconciliation", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	var report ReconciliationReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if len(report.Anomalies) == 0 || report.Anomalies[0].Kind != AnomalyOrphaned || report.Anomalies[0].PaymentIDs[0] != "stale" {
+		t.Errorf("Expected the stale payment to be orphaned, got %+v", report.Anomalies)
+	}
+	// The payment was never metered either
+	if report.MeteredRevenue == nil || len(report.Anomalies) != 2 || report.Anomalies[1].Kind != AnomalyMeteringMismatch {
+		t.Errorf("Expected a metering mismatch, got %+v", report.Anomalies)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("GET", "/admin/reconciliation?start=yesterday", ""))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad start, got %d", w.Code)
+	}
+}
+
+func TestReconciliation_MeteringMatchesLedger(t *testing.T) {
+	ledger := NewInMemoryPaymentLedger(0)
+	metering := NewInMemoryMeteringStore(0, "USD")
+	config := testConfig()
+	config.Ledger = ledger
+	handler := MeteringMiddleware(Middleware(createTestHandler(), config), MeteringConfig{Store: metering, Currency: "USD"})
+
+	send := func(path string, headers map[string]string) {
+		req := httptest.NewRequest("GET", path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	for i := 0; i < 3; i++ {
+		send("/api/data", map[string]string{"Authorization": "Bearer valid_token", "X-Payer-Address": "0xpayer"})
+	}
+	send("/api/data", nil)
+	send("/public/docs", nil)
+	send("/public/docs", map[string]string{"X-Session-ID": "sess_123"})
+
+	report, err := ReconciliationConfig{Ledger: ledger, Metering: metering}.Report(time.Now().Add(-time.Hour), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Report failed: %v", err)
+	}
+	if report.MeteredRevenue == nil || *report.MeteredRevenue != 300 {
+		t.Errorf("Expected metered revenue 300, got %v", report.MeteredRevenue)
+	}
+	for _, anomaly := range report.Anomalies {
+		if anomaly.Kind == AnomalyMeteringMismatch {
+			t.Errorf("Expected metering to match the ledger, got %+v", anomaly)
+		}
+	}
+
+	records, _ := ledger.List(LedgerFilter{})
+	paid := map[string]bool{}
+	for _, record := range records {
+		paid[record.ID] = true
+	}
+	types := map[string]int{}
+	for _, metric := range metering.metrics {
+		types[metric.PaymentType]++
+		if metric.AmountPaid > 0 && !paid[metric.PaymentID] {
+			t.Errorf("Expected paid metric to link to a ledger record, got PaymentID %q", metric.PaymentID)
+		}
+		if metric.AmountPaid == 0 && metric.PaymentID != "" {
+			t.Errorf("Expected no PaymentID on a free request, got %q", metric.PaymentID)
+		}
+	}
+	if len(paid) != 3 || types[PaymentTypePerRequest] != 3 || types[PaymentTypeUnpaid] != 1 || types[PaymentTypeExempt] != 2 {
+		t.Errorf("Expected 3 paid, 1 unpaid and 2 exempt requests, got %v (%d ledger records)", types, len(paid))
+	}
+}
+
+func TestReconciliation_MultiSchemePaymentsInLedger(t *testing.T) {
+	registry := NewSchemeRegistry()
+	registry.Register(&recordingScheme{})
+	ledger := NewInMemoryPaymentLedger(0)
+	metering := NewInMemoryMeteringStore(0, "USDC")
+	handler := MeteringMiddleware(MultiSchemeMiddleware(createTestHandler(), MultiSchemeConfig{
+		Config:           Config{PayTo: "0xseller", PricePerRequest: 100, Currency: "USDC", Ledger: ledger},
+		AcceptedSchemes:  []SchemeType{SchemeExact},
+		AcceptedNetworks: []NetworkType{NetworkBaseMainnet},
+		SchemeRegistry:   registry,
+	}), MeteringConfig{Store: metering, Currency: "USDC"})
+
+	payload, _ := json.Marshal(PaymentPayload{Scheme: SchemeExact, Network: NetworkBaseMainnet, Payer: "0xagent"})
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-PAYMENT", base64.StdEncoding.EncodeToString(payload))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the payment accepted, got %d", w.Code)
+		}
+	}
+
+	records, _ := ledger.List(LedgerFilter{})
+	if len(records) != 2 || records[0].Amount != 100 || records[0].PayerID != "0xagent" || records[0].Network != string(NetworkBaseMainnet) {
+		t.Fatalf("Expected 2 ledger records of 100 from 0xagent on %s, got %+v", NetworkBaseMainnet, records)
+	}
+	for i, metric := range metering.metrics {
+		if metric.PaymentID == "" || (metric.PaymentID != records[0].ID && metric.PaymentID != records[1].ID) {
+			t.Errorf("Metric %d: expected a link to a ledger record, got PaymentID %q", i, metric.PaymentID)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Package x402 - Refund API
+// Rails could refund payments, but nothing exposed that over HTTP, so
+// support staff refunded from a shell on the server. PaymentRefunds looks a
+// payment up in the ledger, refunds it (in whole or in part) through the
+// rail that took it, or queues crypto refunds for sending by hand, records
+// the refund against the payment and stops its receipts being honored.
+// AdminHandler serves it at POST /admin/refunds.
+package x402
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// refundIdempotencyTTL is how long an Idempotency-Key replays its refund
+const refundIdempotencyTTL = 24 * time.Hour
+
+var (
+	// ErrAlreadyRefunded is returned for payments with nothing left to
+	// refund
+	ErrAlreadyRefunded = errors.New("payment already refunded")
+
+	// ErrRefundTooLarge is returned for refunds over what is left of the
+	// payment
+	ErrRefundTooLarge = errors.New("refund exceeds the refundable amount")
+
+	// ErrRefundUnsupported is returned for payments that have no rail to
+	// refund them, or a ledger that can't record the refund
+	ErrRefundUnsupported = errors.New("payment cannot be refunded")
+)
+
+// RefundRecorder is implemented by ledgers that record refunds against a
+// payment. Ledgers that only implement PaymentStatusUpdater can record
+// full refunds.
+type RefundRecorder interface {
+	// RecordRefund adds amount to the record's Refunded and returns the
+	// updated record
+	RecordRefund(id string, amount int64) (PaymentRecord, error)
+}
+
+// PaymentRefunds refunds ledger payments
+type PaymentRefunds struct {
+	Ledger PaymentLedger
+	Rails  *RailRegistry
+
+	// Queue, if set, takes refunds of crypto payments, which rails can't
+	// send back themselves
+	Queue *RefundQueue
+
+	// Receipts, if set, has the receipts of refunded payments revoked
+	Receipts *ReceiptCookies
+
+	// OnRefund, if set, is called after each refund, to withdraw anything
+	// else the payment was granted (sessions, API keys)
+	OnRefund func(ctx context.Context, record PaymentRecord, refund *PaymentRefund)
+
+	// Idempotency remembers refunds by Idempotency-Key (default in memory)
+	Idempotency IdempotencyStore
+
+	// Audit, if set, records each refund
+	Audit *AuditLog
+
+	// mu serializes refunds, so concurrent ones can't refund a payment
+	// twice over
+	mu           sync.Mutex
+	defaultStore IdempotencyStore
+}
+
+// Refund refunds req.Amount of payment req.PaymentID, or all that is left
+// of it if req.Amount is 0
+func (p *PaymentRefunds) Refund(ctx context.Context, req RefundPaymentRequest) (PaymentRecord, *PaymentRefund, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.refund(ctx, req)
+}
+
+// refund is Refund; the caller holds p.mu
+func (p *PaymentRefunds) refund(ctx context.Context, req RefundPaymentRequest) (PaymentRecord, *PaymentRefund, error) {
+	record, err := p.Ledger.Get(req.PaymentID)
+	if err != nil {
+		return record, nil, err
+	}
+	switch record.Status {
+	case PaymentStatusFailed, PaymentStatusReverted:
+		return record, nil, fmt.Errorf("%w: payment %s is %s", ErrRefundUnsupported, record.ID, record.Status)
+	}
+	refundable := record.Amount - record.Refunded
+	if record.Status == PaymentStatusRefunded || refundable <= 0 {
+		return record, nil, ErrAlreadyRefunded
+	}
+	amount := req.Amount
+	if amount == 0 {
+		amount = refundable
+	}
+	if amount > refundable {
+		return record, nil, fmt.Errorf("%w: %d requested, %d refundable", ErrRefundTooLarge, amount, refundable)
+	}
+
+	// Make sure the refund can be recorded before any money moves
+	recorder, canRecord := p.Ledger.(RefundRecorder)
+	updater, canUpdate := p.Ledger.(PaymentStatusUpdater)
+	if !canRecord && !(canUpdate && amount == refundable && record.Refunded == 0) {
+		return record, nil, fmt.Errorf("%w: the ledger can't record a partial refund", ErrRefundUnsupported)
+	}
+
+	refund, err := p.send(ctx, record, amount, req.Reason)
+	if err != nil {
+		return record, nil, err
+	}
+
+	if canRecord {
+		record, err = recorder.RecordRefund(record.ID, amount)
+	} else {
+		err = updater.UpdateStatus(record.ID, PaymentStatusRefunded)
+		record.Refunded, record.Status = amount, PaymentStatusRefunded
+	}
+	if err != nil {
+		// The money has moved; report the refund so it isn't repeated
+		return record, refund, fmt.Errorf("x402: refund %s of payment %s was made but not recorded: %w", refund.RefundID, record.ID, err)
+	}
+
+	p.Receipts.Revoke(record.ID)
+	if record.TransactionID != record.ID {
+		p.Receipts.Revoke(record.TransactionID)
+	}
+	if p.OnRefund != nil {
+		p.OnRefund(ctx, record, refund)
+	}
+	return record, refund, nil
+}
+
+// send refunds amount of record through its rail, or queues it
+func (p *PaymentRefunds) send(ctx context.Context, record PaymentRecord, amount int64, reason string) (*PaymentRefund, error) {
+	var rail PaymentRail
+	if p.Rails != nil && record.Rail != "" {
+		rail, _ = p.Rails.Get(record.Rail)
+	}
+
+	// Crypto payments, including those taken by Middleware without a rail
+	if (rail == nil && record.Network != "") || (rail != nil && rail.Type() == RailTypeCrypto) {
+		if p.Queue == nil {
+			return nil, fmt.Errorf("%w: crypto refunds need a RefundQueue", ErrRefundUnsupported)
+		}
+		id, err := p.Queue.RefundRecord(ctx, record, amount)
+		if err != nil {
+			return nil, err
+		}
+		return &PaymentRefund{Success: true, RefundID: id, Amount: amount, Status: "pending"}, nil
+	}
+	if rail == nil {
+		return nil, fmt.Errorf("%w: no rail %q registered", ErrRefundUnsupported, record.Rail)
+	}
+
+	paymentID := record.TransactionID
+	if paymentID == "" {
+		paymentID = record.ID
+	}
+	return rail.RefundPayment(ctx, &RefundPaymentRequest{PaymentID: paymentID, Amount: amount, Reason: reason})
+}
+
+// idempotency returns the store refunds are remembered in
+func (p *PaymentRefunds) idempotency() IdempotencyStore {
+	if p.Idempotency != nil {
+		return p.Idempotency
+	}
+	if p.defaultStore == nil {
+		p.defaultStore = NewInMemoryIdempotencyStore()
+	}
+	return p.defaultStore
+}
+
+// ServeHTTP refunds a payment: POST {"paymentId": "...", "amount": 100,
+// "reason": "..."}, with amount optional. A retried request with the same
+// Idempotency-Key gets the first answer instead of a second refund.
+func (p *PaymentRefunds) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req RefundPaymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PaymentID == "" || req.Amount < 0 {
+		http.Error(w, "Invalid request: paymentId required, amount must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := r.Header.Get("Idempotency-Key")
+	fingerprint := refundFingerprint(req)
+	if key != "" {
+		if record, _ := p.idempotency().Get("refund:" + key); record != nil {
+			if record.Headers["X-Refund-Request"] != fingerprint {
+				http.Error(w, "Idempotency-Key was used for a different refund", http.StatusConflict)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Idempotent-Replay", "true")
+			w.WriteHeader(record.StatusCode)
+			_, _ = w.Write(record.Body)
+			return
+		}
+	}
+
+	record, refund, err := p.refund(r.Context(), req)
+	if err != nil && refund == nil {
+		http.Error(w, err.Error(), refundErrorStatus(err))
+		return
+	}
+	if err != nil {
+		// Made but not recorded: answer with the refund, and remember it
+		// under the key, so it isn't made again
+		log.Print(err)
+		p.Audit.Record(r, AuditEvent{Decision: AuditRefunded, Reason: "admin_refund_unrecorded", Payer: record.PayerID, PaymentID: record.ID, TransactionID: refund.RefundID})
+	} else {
+		p.Audit.Record(r, AuditEvent{
+			Decision:        AuditRefunded,
+			Reason:          "admin_refund",
+			Rail:            record.Rail,
+			Payer:           record.PayerID,
+			PresentedAmount: refund.Amount,
+			Currency:        record.Currency,
+			PaymentID:       record.ID,
+			TransactionID:   refund.RefundID,
+		})
+	}
+
+	body, _ := json.Marshal(refund)
+	if key != "" {
+		_ = p.idempotency().Set("refund:"+key, &IdempotencyRecord{
+			Key:        key,
+			StatusCode: http.StatusOK,
+			Headers:    map[string]string{"X-Refund-Request": fingerprint},
+			Body:       body,
+			CreatedAt:  time.Now(),
+			ExpiresAt:  time.Now().Add(refundIdempotencyTTL),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+// refundFingerprint identifies a refund request, so an Idempotency-Key
+// can't be reused for a different one
+func refundFingerprint(req RefundPaymentRequest) string {
+	sum := sha256.Sum256([]byte(req.PaymentID + "\x00" + strconv.FormatInt(req.Amount, 10) + "\x00" + req.Reason))
+	return hex.EncodeToString(sum[:])
+}
+
+// refundErrorStatus is the HTTP status a failed refund is answered with
+func refundErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrAlreadyRefunded):
+		return http.StatusConflict
+	case errors.Is(err, ErrRefundTooLarge):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrRefundUnsupported):
+		return http.StatusUnprocessableEntity
+	}
+	return errorStatus(err)
+}
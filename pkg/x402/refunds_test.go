@@ -0,0 +1,141 @@
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// refundRail is a Stripe rail that records refunds instead of calling Stripe
+type refundRail struct {
+	*StripeRail
+	refunds []RefundPaymentRequest
+}
+
+func (f *refundRail) RefundPayment(ctx context.Context, req *RefundPaymentRequest) (*PaymentRefund, error) {
+	f.refunds = append(f.refunds, *req)
+	return &PaymentRefund{Success: true, RefundID: "re_" + req.PaymentID, Amount: req.Amount, Status: "succeeded"}, nil
+}
+
+func newRefundHandler() (http.Handler, *refundRail, *PaymentRefunds) {
+	rail := &refundRail{StripeRail: NewStripeRail("sk_test", "whsec_test")}
+	registry := NewRailRegistry()
+	registry.Register(rail)
+	ledger := NewInMemoryPaymentLedger(100)
+	ledger.Record(PaymentRecord{ID: "pay_card", Rail: RailStripe, Amount: 500, Currency: "USD", TransactionID: "pi_1", Status: PaymentStatusSettled})
+	ledger.Record(PaymentRecord{ID: "pay_usdc", Scheme: "exact", Network: "base-sepolia", PayerID: "0xpayer", Amount: 1000, Currency: "USDC"})
+	refunds := &PaymentRefunds{
+		Ledger:   ledger,
+		Rails:    registry,
+		Queue:    NewRefundQueue(),
+		Receipts: &ReceiptCookies{Secret: []byte("receipt-secret-key")},
+	}
+	return AdminHandler(AdminDeps{APIKey: "admin_secret", Ledger: ledger, Refunds: refunds}), rail, refunds
+}
+
+func postRefund(handler http.Handler, body, key string) (int, PaymentRefund) {
+	req := adminRequest("POST", "/admin/refunds", body)
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var refund PaymentRefund
+	json.NewDecoder(w.Body).Decode(&refund)
+	return w.Code, refund
+}
+
+func TestPaymentRefunds_Full(t *testing.T) {
+	handler, rail, refunds := newRefundHandler()
+
+	code, refund := postRefund(handler, `{"paymentId":"pay_card","reason":"requested_by_customer"}`, "")
+	if code != http.StatusOK || refund.RefundID != "re_pi_1" || refund.Amount != 500 {
+		t.Fatalf("Expected the whole payment refunded, got %d %+v", code, refund)
+	}
+	if len(rail.refunds) != 1 || rail.refunds[0] != (RefundPaymentRequest{PaymentID: "pi_1", Amount: 500, Reason: "requested_by_customer"}) {
+		t.Errorf("Expected the rail to refund the payment intent, got %+v", rail.refunds)
+	}
+	if record, _ := refunds.Ledger.Get("pay_card"); record.Status != PaymentStatusRefunded || record.Refunded != 500 {
+		t.Errorf("Expected the refund recorded, got %+v", record)
+	}
+	if !refunds.Receipts.isRevoked("pay_card") || !refunds.Receipts.isRevoked("pi_1") {
+		t.Error("Expected the payment's receipts revoked")
+	}
+
+	if code, _ := postRefund(handler, `{"paymentId":"pay_card"}`, ""); code != http.StatusConflict {
+		t.Errorf("Expected a refunded payment refused with 409, got %d", code)
+	}
+}
+
+func TestPaymentRefunds_Partial(t *testing.T) {
+	handler, rail, refunds := newRefundHandler()
+
+	if code, refund := postRefund(handler, `{"paymentId":"pay_card","amount":200}`, ""); code != http.StatusOK || refund.Amount != 200 {
+		t.Fatalf("Expected 200 of 500 refunded, got %d %+v", code, refund)
+	}
+	if record, _ := refunds.Ledger.Get("pay_card"); record.Status != PaymentStatusSettled || record.Refunded != 200 {
+		t.Errorf("Expected the payment still settled with 200 refunded, got %+v", record)
+	}
+	if code, _ := postRefund(handler, `{"paymentId":"pay_card","amount":301}`, ""); code != http.StatusBadRequest {
+		t.Errorf("Expected a refund over the 300 left refused with 400, got %d", code)
+	}
+	if code, refund := postRefund(handler, `{"paymentId":"pay_card"}`, ""); code != http.StatusOK || refund.Amount != 300 {
+		t.Errorf("Expected the 300 left refunded, got %d %+v", code, refund)
+	}
+	if record, _ := refunds.Ledger.Get("pay_card"); record.Status != PaymentStatusRefunded {
+		t.Errorf("Expected the payment refunded once all of it was, got %+v", record)
+	}
+	if len(rail.refunds) != 2 {
+		t.Errorf("Expected 2 rail refunds, got %d", len(rail.refunds))
+	}
+}
+
+func TestPaymentRefunds_UnknownPayment(t *testing.T) {
+	handler, rail, _ := newRefundHandler()
+	if code, _ := postRefund(handler, `{"paymentId":"pay_missing"}`, ""); code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", code)
+	}
+	if code, _ := postRefund(handler, `{"amount":100}`, ""); code != http.StatusBadRequest {
+		t.Errorf("Expected a request without paymentId refused with 400, got %d", code)
+	}
+	if len(rail.refunds) != 0 {
+		t.Errorf("Expected no rail refunds, got %+v", rail.refunds)
+	}
+}
+
+func TestPaymentRefunds_Idempotency(t *testing.T) {
+	handler, rail, _ := newRefundHandler()
+
+	first, refund := postRefund(handler, `{"paymentId":"pay_card","amount":100}`, "key-1")
+	second, replayed := postRefund(handler, `{"paymentId":"pay_card","amount":100}`, "key-1")
+	if first != http.StatusOK || second != http.StatusOK || replayed != refund {
+		t.Errorf("Expected the retry to replay the refund, got %d %+v then %d %+v", first, refund, second, replayed)
+	}
+	if len(rail.refunds) != 1 {
+		t.Errorf("Expected one rail refund, got %d", len(rail.refunds))
+	}
+	if code, _ := postRefund(handler, `{"paymentId":"pay_card","amount":200}`, "key-1"); code != http.StatusConflict {
+		t.Errorf("Expected a reused key with a different refund refused with 409, got %d", code)
+	}
+}
+
+func TestPaymentRefunds_CryptoQueued(t *testing.T) {
+	handler, _, refunds := newRefundHandler()
+
+	code, refund := postRefund(handler, `{"paymentId":"pay_usdc","amount":400}`, "")
+	if code != http.StatusOK || refund.Status != "pending" {
+		t.Fatalf("Expected the crypto refund queued, got %d %+v", code, refund)
+	}
+	pending := refunds.Queue.Pending()
+	if len(pending) != 1 || pending[0].ID != refund.RefundID || pending[0].PaymentID != "pay_usdc" ||
+		pending[0].WalletAddress != "0xpayer" || pending[0].Amount != 400 {
+		t.Errorf("Expected a queued refund of 400 to the payer, got %+v", pending)
+	}
+
+	refunds.Queue = nil
+	if code, _ := postRefund(handler, `{"paymentId":"pay_usdc"}`, ""); code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a crypto refund without a queue refused with 422, got %d", code)
+	}
+}
@@ -0,0 +1,53 @@
+// Package x402 - Resource Metadata
+// Agents decide whether a resource is worth paying for from the mimeType and
+// outputSchema of its payment requirements. Endpoints declare them on
+// APIEndpoint, or a config's ResourceDescriptor describes each request.
+package x402
+
+import (
+	"net/http"
+)
+
+// ResourceMeta describes what a paid resource returns
+type ResourceMeta struct {
+	MimeType string
+
+	// OutputSchema is a JSON schema of the response, e.g.
+	// {"type": "object", "properties": {...}}
+	OutputSchema map[string]interface{}
+}
+
+// ResourceDescriptor describes the resource a request is for
+type ResourceDescriptor func(r *http.Request) ResourceMeta
+
+// DescribeEndpoints returns a ResourceDescriptor serving the MimeType and
+// OutputSchema declared on the endpoint matching a request's path and method.
+// An endpoint without a Method matches any method, and its Path may have
+// ServeMux wildcards such as {id}.
+func DescribeEndpoints(endpoints []APIEndpoint) ResourceDescriptor {
+	return func(r *http.Request) ResourceMeta {
+		for _, ep := range endpoints {
+			if ep.matches(r.Method, r.URL.Path) {
+				return ResourceMeta{MimeType: ep.MimeType, OutputSchema: ep.OutputSchema}
+			}
+		}
+		return ResourceMeta{}
+	}
+}
+
+// describe returns the metadata for r and applies it to requirements
+func (d ResourceDescriptor) describe(r *http.Request, requirements []PaymentRequirements) ResourceMeta {
+	if d == nil {
+		return ResourceMeta{}
+	}
+	meta := d(r)
+	for i := range requirements {
+		if meta.MimeType != "" {
+			requirements[i].MimeType = meta.MimeType
+		}
+		if meta.OutputSchema != nil {
+			requirements[i].OutputSchema = meta.OutputSchema
+		}
+	}
+	return meta
+}
@@ -0,0 +1,78 @@
+package x402
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+var weatherSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"temperature": map[string]interface{}{"type": "number"},
+	},
+}
+
+var weatherEndpoints = []APIEndpoint{{
+	Path:         "/api/weather",
+	Method:       "GET",
+	MimeType:     "application/json",
+	OutputSchema: weatherSchema,
+}}
+
+func TestPaymentRequiredDescribesResource(t *testing.T) {
+	config := testConfig()
+	config.ResourceDescriptor = DescribeEndpoints(weatherEndpoints)
+	handler := Middleware(createTestHandler(), config)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/weather", nil))
+
+	header, _ := base64.StdEncoding.DecodeString(w.Header().Get("PAYMENT-REQUIRED"))
+	var fromHeader PaymentRequiredResponse
+	if err := json.Unmarshal(header, &fromHeader); err != nil {
+		t.Fatalf("Failed to decode PAYMENT-REQUIRED: %v", err)
+	}
+
+	for source, response := range map[string]PaymentRequiredResponse{"body": decodePaymentRequired(t, w), "header": fromHeader} {
+		req := response.Accepts[0]
+		if req.MimeType != "application/json" {
+			t.Errorf("Expected mime type in %s, got %q", source, req.MimeType)
+		}
+		if !reflect.DeepEqual(req.OutputSchema, weatherSchema) {
+			t.Errorf("Expected output schema in %s, got %v", source, req.OutputSchema)
+		}
+	}
+
+	// Undescribed endpoints keep the defaults
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/other", nil))
+	if req := decodePaymentRequired(t, w).Accepts[0]; req.MimeType != "" || req.OutputSchema != nil {
+		t.Errorf("Expected no metadata for /api/other, got %q %v", req.MimeType, req.OutputSchema)
+	}
+}
+
+func TestPaymentOptionsDescribeResource(t *testing.T) {
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		PricePerRequest: 100,
+		CryptoEnabled:   true,
+		CryptoNetworks:  []NetworkType{NetworkBaseSepolia},
+		ResourceDescriptor: func(r *http.Request) ResourceMeta {
+			return ResourceMeta{MimeType: "text/csv"}
+		},
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/export", nil))
+
+	var response PaymentOptionsResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response.MimeType != "text/csv" || response.Accepts[0].MimeType != "text/csv" {
+		t.Errorf("Expected text/csv, got %q and %q", response.MimeType, response.Accepts[0].MimeType)
+	}
+}
@@ -0,0 +1,222 @@
+// Package x402 - Adaptive Retry Guidance
+// Agents told to retry in a fixed 5 seconds all come back at once, and keep
+// coming back while a facilitator or Stripe is down. A RetryPolicy computes
+// each agent's RetryStrategy instead: exponential backoff on the agent's
+// X-Agent-Retry-Count with jitter and a cap, stretched when the rails are
+// slow (RailMetrics latency percentiles) or probing (half-open circuits),
+// and shouldRetry=false until the probe when every rail's circuit is open.
+// Retry-After and X-Recommended-Retry always carry the strategy's delay.
+package x402
+
+import (
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Retry policy defaults
+const (
+	DefaultRetryBaseDelay  = time.Second
+	DefaultRetryMaxDelay   = time.Minute
+	DefaultRetryMultiplier = 2.0
+	DefaultRetryMaxRetries = 5
+	DefaultRetryJitter     = 0.2
+)
+
+// RetryContext is what a RetryPolicy based its strategy on, for Override
+type RetryContext struct {
+	Status     int                     // The response being sent, e.g. 402 or 429
+	RetryCount int                     // From X-Agent-Retry-Count
+	Circuits   map[string]CircuitState // Each checked rail's circuit
+	Health     []RailHealth            // Each checked rail's recent calls
+}
+
+// RetryPolicy computes retry guidance for agents. The zero value uses the
+// defaults and ignores rail load; set CircuitBreaker and Metrics to the
+// ones the payment middleware reports to.
+type RetryPolicy struct {
+	// BaseDelay is the first retry's delay (default DefaultRetryBaseDelay),
+	// growing by Multiplier (default DefaultRetryMultiplier) per retry up
+	// to MaxDelay (default DefaultRetryMaxDelay)
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Multiplier float64
+
+	// MaxRetries is how many retries agents are told to make (default
+	// DefaultRetryMaxRetries); past it they are told to stop
+	MaxRetries int
+
+	// Jitter adds up to this fraction of the delay at random, so agents
+	// refused together don't retry together (default DefaultRetryJitter;
+	// negative disables)
+	Jitter float64
+
+	// CircuitBreaker and Metrics report rail load. Rails limits the rails
+	// checked (default: every rail either has seen).
+	CircuitBreaker *CircuitBreaker
+	Metrics        *RailMetrics
+	Rails          []string
+
+	// Override, if set, replaces or adjusts the computed strategy
+	Override func(ctx RetryContext, computed RetryStrategy) RetryStrategy
+
+	// random is stubbed in tests
+	random func() float64
+}
+
+func (p *RetryPolicy) baseDelay() time.Duration {
+	if p.BaseDelay > 0 {
+		return p.BaseDelay
+	}
+	return DefaultRetryBaseDelay
+}
+
+func (p *RetryPolicy) maxDelay() time.Duration {
+	if p.MaxDelay > 0 {
+		return p.MaxDelay
+	}
+	return DefaultRetryMaxDelay
+}
+
+func (p *RetryPolicy) multiplier() float64 {
+	if p.Multiplier > 1 {
+		return p.Multiplier
+	}
+	return DefaultRetryMultiplier
+}
+
+func (p *RetryPolicy) maxRetries() int {
+	if p.MaxRetries > 0 {
+		return p.MaxRetries
+	}
+	return DefaultRetryMaxRetries
+}
+
+func (p *RetryPolicy) jitter() float64 {
+	switch {
+	case p.Jitter < 0:
+		return 0
+	case p.Jitter == 0:
+		return DefaultRetryJitter
+	}
+	return p.Jitter
+}
+
+func (p *RetryPolicy) rand() float64 {
+	if p.random != nil {
+		return p.random()
+	}
+	return rand.Float64()
+}
+
+// rails are the rails whose load is checked
+func (p *RetryPolicy) rails() []string {
+	if len(p.Rails) > 0 {
+		return p.Rails
+	}
+	seen := map[string]bool{}
+	var rails []string
+	for _, rail := range p.CircuitBreaker.rails() {
+		seen[rail] = true
+		rails = append(rails, rail)
+	}
+	for _, health := range p.Metrics.Snapshot() {
+		if !seen[health.Rail] {
+			rails = append(rails, health.Rail)
+		}
+	}
+	return rails
+}
+
+// retryCount reads X-Agent-Retry-Count
+func retryCount(r *http.Request) int {
+	n, err := strconv.Atoi(r.Header.Get("X-Agent-Retry-Count"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Strategy returns the retry guidance for r, answered with status. A nil
+// policy uses the defaults.
+func (p *RetryPolicy) Strategy(r *http.Request, status int) RetryStrategy {
+	if p == nil {
+		p = &RetryPolicy{}
+	}
+	ctx := RetryContext{Status: status, RetryCount: retryCount(r), Circuits: map[string]CircuitState{}}
+
+	// Rail load: how long until an open circuit probes, the slowest rail's
+	// p95, and whether any rail is probing or mostly failing
+	open, reopen := 0, time.Duration(0)
+	var slowest time.Duration
+	degraded := false
+	rails := p.rails()
+	for _, rail := range rails {
+		state := p.CircuitBreaker.State(rail)
+		ctx.Circuits[rail] = state
+		switch state {
+		case CircuitOpen:
+			open++
+			reopen = max(reopen, p.CircuitBreaker.reopensIn(rail))
+		case CircuitHalfOpen:
+			degraded = true
+		}
+		if health, ok := p.Metrics.Health(rail); ok {
+			ctx.Health = append(ctx.Health, health)
+			slowest = max(slowest, time.Duration(health.P95LatencyMs*float64(time.Millisecond)))
+			degraded = degraded || (health.Calls > 0 && health.SuccessRate < 0.5)
+		}
+	}
+
+	strategy := RetryStrategy{
+		ShouldRetry:       true,
+		MaxRetries:        p.maxRetries(),
+		BackoffMultiplier: p.multiplier(),
+		Reason:            "Retry with payment attached",
+	}
+	if status == http.StatusTooManyRequests {
+		strategy.Reason = "Server is busy"
+	}
+
+	switch {
+	case len(rails) > 0 && open == len(rails):
+		// Nothing can take a payment until a circuit probes
+		strategy.ShouldRetry = false
+		strategy.RetryAfterSec = max(retrySeconds(reopen), retrySeconds(p.maxDelay()))
+		strategy.Reason = "Payment rails are unavailable"
+	case ctx.RetryCount >= strategy.MaxRetries:
+		strategy.ShouldRetry = false
+		strategy.RetryAfterSec = retrySeconds(p.maxDelay())
+		strategy.Reason = "Retry limit reached"
+	default:
+		step := float64(ctx.RetryCount)
+		if degraded || open > 0 {
+			step++
+			strategy.Reason = "Payment rails are degraded; back off"
+		}
+		delay := time.Duration(float64(p.baseDelay()) * math.Pow(p.multiplier(), step))
+		delay = max(delay, slowest)
+		delay += time.Duration(float64(delay) * p.jitter() * p.rand())
+		strategy.RetryAfterSec = retrySeconds(min(delay, p.maxDelay()))
+	}
+
+	if p.Override != nil {
+		strategy = p.Override(ctx, strategy)
+	}
+	return strategy
+}
+
+// retrySeconds rounds d up to whole seconds, at least 1
+func retrySeconds(d time.Duration) int {
+	return max(1, int(math.Ceil(d.Seconds())))
+}
+
+// setRetryHeaders sends strategy's delay as Retry-After and
+// X-Recommended-Retry
+func setRetryHeaders(w http.ResponseWriter, strategy RetryStrategy) {
+	retry := strconv.Itoa(strategy.RetryAfterSec)
+	w.Header().Set("Retry-After", retry)
+	w.Header().Set("X-Recommended-Retry", retry)
+}
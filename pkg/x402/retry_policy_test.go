@@ -0,0 +1,115 @@
+package x402
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// retryRequest is an agent's request on its nth retry
+func retryRequest(n int) *http.Request {
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-Agent-Retry-Count", strconv.Itoa(n))
+	return req
+}
+
+func TestRetryPolicy_BackoffGrows(t *testing.T) {
+	policy := &RetryPolicy{random: func() float64 { return 0.5 }}
+
+	previous := 0
+	for n := 0; n < DefaultRetryMaxRetries; n++ {
+		strategy := policy.Strategy(retryRequest(n), http.StatusPaymentRequired)
+		if !strategy.ShouldRetry || strategy.RetryAfterSec <= previous {
+			t.Fatalf("Expected retry %d to wait longer than %ds, got %+v", n, previous, strategy)
+		}
+		previous = strategy.RetryAfterSec
+	}
+
+	strategy := policy.Strategy(retryRequest(DefaultRetryMaxRetries), http.StatusPaymentRequired)
+	if strategy.ShouldRetry {
+		t.Errorf("Expected retries to stop after %d, got %+v", DefaultRetryMaxRetries, strategy)
+	}
+
+	// Jitter only ever adds, up to its fraction, and the cap holds
+	capped := &RetryPolicy{MaxDelay: 10 * time.Second, MaxRetries: 10, random: func() float64 { return 1 }}
+	if got := capped.Strategy(retryRequest(8), http.StatusPaymentRequired).RetryAfterSec; got != 10 {
+		t.Errorf("Expected the delay capped at 10s, got %d", got)
+	}
+}
+
+func TestRetryPolicy_OpenCircuitStopsRetries(t *testing.T) {
+	now := time.Now()
+	breaker := NewCircuitBreaker(1, 5*time.Minute)
+	breaker.now = func() time.Time { return now }
+	breaker.record(RailEVMCrypto, errors.New("facilitator unreachable"))
+	policy := &RetryPolicy{CircuitBreaker: breaker, random: func() float64 { return 0 }}
+
+	strategy := policy.Strategy(retryRequest(0), http.StatusPaymentRequired)
+	if strategy.ShouldRetry || strategy.RetryAfterSec != 300 {
+		t.Errorf("Expected no retry until the circuit probes in 300s, got %+v", strategy)
+	}
+
+	// With another rail still up, agents back off instead
+	breaker.record(RailStripe, nil)
+	strategy = policy.Strategy(retryRequest(0), http.StatusPaymentRequired)
+	if !strategy.ShouldRetry || strategy.RetryAfterSec != 2 {
+		t.Errorf("Expected one extra backoff step with a rail down, got %+v", strategy)
+	}
+}
+
+func TestRetryPolicy_SlowRails(t *testing.T) {
+	metrics := NewRailMetrics()
+	for i := 0; i < 10; i++ {
+		metrics.Observe(RailStripe, RailOpVerify, 3*time.Second, nil)
+	}
+	policy := &RetryPolicy{Metrics: metrics, random: func() float64 { return 0 }}
+
+	if got := policy.Strategy(retryRequest(0), http.StatusPaymentRequired).RetryAfterSec; got != 3 {
+		t.Errorf("Expected agents to wait out the rail's 3s p95, got %d", got)
+	}
+}
+
+func TestRetryPolicy_Override(t *testing.T) {
+	policy := &RetryPolicy{Override: func(ctx RetryContext, computed RetryStrategy) RetryStrategy {
+		if ctx.Status == http.StatusTooManyRequests {
+			computed.RetryAfterSec = 30
+		}
+		return computed
+	}}
+	if got := policy.Strategy(retryRequest(0), http.StatusTooManyRequests).RetryAfterSec; got != 30 {
+		t.Errorf("Expected the override's 30s, got %d", got)
+	}
+}
+
+func TestAIAgentMiddleware_RetryHintsMatchBody(t *testing.T) {
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		PricePerRequest: 100,
+		CryptoEnabled:   true,
+		CryptoNetworks:  []NetworkType{NetworkBaseSepolia},
+		RailRegistry:    NewRailRegistry(),
+	})
+	handler = AIAgentMiddleware(handler, Config{PricePerRequest: 100}, AIAgentConfig{
+		EnableAutoRetryHints: true,
+		RetryPolicy:          &RetryPolicy{Jitter: -1},
+	})
+
+	req := retryRequest(3)
+	req.Header.Set("X-AI-Agent", "true")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var response PaymentOptionsResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Invalid 402 body: %v", err)
+	}
+	if response.Extensions == nil || response.Extensions.Retry == nil || response.Extensions.Retry.RetryAfterSec != 8 {
+		t.Fatalf("Expected an 8s retry hint on the third retry, got %+v", response.Extensions)
+	}
+	if w.Header().Get("Retry-After") != "8" || w.Header().Get("X-Recommended-Retry") != "8" {
+		t.Errorf("Expected the headers to match the body, got %q and %q", w.Header().Get("Retry-After"), w.Header().Get("X-Recommended-Retry"))
+	}
+}
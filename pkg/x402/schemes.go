@@ -7,6 +7,7 @@ package x402
 import (
 	"context"
 	"fmt"
+	"log"
 	"sync"
 )
 
@@ -70,10 +71,16 @@ type PaymentPayload struct {
 	Resource  string      `json:"resource"`  // Resource being paid for
 	Timestamp int64       `json:"timestamp"` // Unix timestamp
 
+	// Protocol version and the 402's validUntil, echoed by some clients.
+	// Payloads are decoded strictly, so fields sent must be declared here.
+	X402Version int   `json:"x402Version,omitempty"`
+	ValidUntil  int64 `json:"validUntil,omitempty"`
+
 	// Crypto-specific fields
 	Signature string `json:"signature,omitempty"` // Payment signature (EIP-3009, etc.)
 	Payer     string `json:"payer,omitempty"`     // Payer address
 	Nonce     string `json:"nonce,omitempty"`     // Replay protection
+	Asset     string `json:"asset,omitempty"`     // Token paid with (contract or symbol)
 
 	// Fiat-specific fields (future)
 	CardToken       string `json:"cardToken,omitempty"`       // Tokenized card (Visa, etc.)
@@ -85,6 +92,7 @@ type PaymentPayload struct {
 type VerificationResult struct {
 	Valid   bool   `json:"valid"`
 	Message string `json:"message,omitempty"`
+	Reason  string `json:"reason,omitempty"` // Failure reason code when not valid
 
 	// Details
 	Scheme    SchemeType  `json:"scheme"`
@@ -118,19 +126,32 @@ type SettlementResult struct {
 type SchemeRegistry struct {
 	mu      sync.RWMutex
 	schemes map[SchemeType]PaymentScheme
+	frozen  bool
 }
 
-// NewSchemeRegistry creates a new scheme registry
+// NewSchemeRegistry creates a new, empty scheme registry
 func NewSchemeRegistry() *SchemeRegistry {
 	return &SchemeRegistry{
 		schemes: make(map[SchemeType]PaymentScheme),
 	}
 }
 
+// NewDefaultSchemeRegistry creates a new scheme registry holding the
+// standard schemes (exact EVM payments)
+func NewDefaultSchemeRegistry() *SchemeRegistry {
+	registry := NewSchemeRegistry()
+	registry.Register(&ExactEVMScheme{})
+	return registry
+}
+
 // Register registers a payment scheme
 func (r *SchemeRegistry) Register(scheme PaymentScheme) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if r.frozen {
+		log.Printf("x402: ignoring %s scheme registered on the deprecated DefaultRegistry; set MultiSchemeConfig.SchemeRegistry instead", scheme.Type())
+		return
+	}
 	r.schemes[scheme.Type()] = scheme
 }
 
@@ -178,8 +199,19 @@ func isWildcardMatch(pattern, network NetworkType) bool {
 	return len(network) > len(prefix) && string(network[:len(prefix)]) == string(prefix)
 }
 
-// DefaultRegistry is the global scheme registry
-var DefaultRegistry = NewSchemeRegistry()
+// DefaultRegistry holds the standard schemes and can't be changed.
+//
+// Deprecated: middlewares no longer read it. Set MultiSchemeConfig.SchemeRegistry,
+// e.g. to NewDefaultSchemeRegistry(), to choose the schemes a middleware
+// accepts.
+var DefaultRegistry = frozenSchemeRegistry()
+
+// frozenSchemeRegistry is a default registry that ignores Register
+func frozenSchemeRegistry() *SchemeRegistry {
+	registry := NewDefaultSchemeRegistry()
+	registry.frozen = true
+	return registry
+}
 
 // MultiSchemeConfig extends Config to support multiple payment schemes
 type MultiSchemeConfig struct {
@@ -200,14 +232,108 @@ type MultiSchemeConfig struct {
 	// FacilitatorURLs maps networks to their facilitator endpoints
 	FacilitatorURLs map[NetworkType]string
 
-	// SchemeRegistry is the registry of payment schemes (uses DefaultRegistry if nil)
+	// AcceptedAssets lists the tokens accepted on each network, in the order
+	// they are offered. Networks not listed accept Config.Asset. Prices are
+	// converted from Currency to each token's decimals.
+	AcceptedAssets map[NetworkType][]AssetRef
+
+	// SchemeRegistry is the registry of payment schemes. Nil uses a new
+	// NewDefaultSchemeRegistry() for this middleware alone.
 	SchemeRegistry *SchemeRegistry
+
+	// OnPaymentFailure is called whenever a presented payment is refused
+	OnPaymentFailure func(ctx context.Context, failure *PaymentFailure)
+
+	// Callbacks, if set, runs OnPaymentFailure, e.g. asynchronously. Its
+	// panics are recovered and logged either way.
+	Callbacks *CallbackRunner
+
+	// AccessPolicy, if set, refuses denied payers with 403 and serves free
+	// payers without charging them
+	AccessPolicy *AccessPolicy
+
+	// SyncFromFacilitator, once refreshed, replaces AcceptedSchemes and
+	// AcceptedNetworks with the facilitator's supported pairs
+	SyncFromFacilitator *FacilitatorSync
 }
 
-// BuildMultiSchemeRequirements generates PaymentRequirements for all accepted schemes/networks
+// BuildMultiSchemeRequirements generates PaymentRequirements for all accepted
+// schemes/networks: each scheme in declared order, on each network in declared
+// order (or in the facilitator's order once synced). Identical configs give
+// identical requirements, so clients can cache the 402.
 func (c *MultiSchemeConfig) BuildMultiSchemeRequirements(resource string) []PaymentRequirements {
 	var requirements []PaymentRequirements
 
+	maxTimeout := maxTimeoutOrDefault(c.MaxTimeoutSeconds)
+	expiresAt := paymentDeadline(c.clock(), maxTimeout).Unix()
+
+	description := c.Description
+	if description == "" {
+		description = priceDescription(c.PricePerRequest, c.Currency)
+	}
+
+	for _, kind := range c.acceptedKinds() {
+		// Get payment address for this network (or use default)
+		payTo := c.PayTo
+		if addr, ok := networkEntry(c.PaymentAddresses, kind.Network); ok {
+			payTo = addr
+		}
+
+		req := PaymentRequirements{
+			Scheme:            string(kind.Scheme),
+			Network:           string(kind.Network),
+			MaxAmountRequired: fmt.Sprintf("%d", c.PricePerRequest),
+			Resource:          resource,
+			Description:       description,
+			PayTo:             payTo,
+			MaxTimeoutSeconds: maxTimeout,
+			Asset:             c.Asset,
+			OutputSchema:      nil,
+			ExpiresAt:         expiresAt,
+		}
+
+		// Add facilitator URL if configured
+		if facilitatorURL, ok := networkEntry(c.FacilitatorURLs, kind.Network); ok {
+			if req.Extra == nil {
+				req.Extra = make(map[string]interface{})
+			}
+			req.Extra["facilitatorUrl"] = facilitatorURL
+		}
+
+		// One entry per accepted asset, each in its own decimals
+		assets := acceptedAssets(c.AcceptedAssets, kind.Network)
+		if len(assets) == 0 {
+			requirements = append(requirements, req)
+			continue
+		}
+		for _, asset := range assets {
+			entry := req
+			entry.Asset = asset.Contract
+			entry.MaxAmountRequired = c.assetAmount(asset)
+			entry.Extra = asset.extra()
+			for k, v := range req.Extra {
+				entry.Extra[k] = v
+			}
+			requirements = append(requirements, entry)
+		}
+	}
+
+	return requirements
+}
+
+// assetAmount is PricePerRequest, in Currency, converted to asset's decimals
+func (c *MultiSchemeConfig) assetAmount(asset AssetRef) string {
+	return scaleAmount(c.PricePerRequest, currencyDecimals(c.Currency), asset.Decimals).String()
+}
+
+// acceptedKinds returns the scheme/network pairs to advertise: the
+// facilitator's synced set if there is one, otherwise every accepted scheme
+// on every accepted network
+func (c *MultiSchemeConfig) acceptedKinds() []SupportedKind {
+	if kinds := c.SyncFromFacilitator.Kinds(); kinds != nil {
+		return kinds
+	}
+
 	schemes := c.AcceptedSchemes
 	if len(schemes) == 0 {
 		schemes = []SchemeType{SchemeExact}
@@ -218,49 +344,34 @@ func (c *MultiSchemeConfig) BuildMultiSchemeRequirements(resource string) []Paym
 		networks = []NetworkType{NetworkType(c.Network)}
 	}
 
-	maxTimeout := c.MaxTimeoutSeconds
-	if maxTimeout == 0 {
-		maxTimeout = 60
-	}
-
-	description := c.Description
-	if description == "" {
-		description = fmt.Sprintf("Payment of %d %s required", c.PricePerRequest, c.Currency)
-	}
-
+	var kinds []SupportedKind
 	for _, scheme := range schemes {
 		for _, network := range networks {
-			// Get payment address for this network (or use default)
-			payTo := c.PayTo
-			if addr, ok := c.PaymentAddresses[network]; ok {
-				payTo = addr
-			}
-
-			req := PaymentRequirements{
-				Scheme:            string(scheme),
-				Network:           string(network),
-				MaxAmountRequired: fmt.Sprintf("%d", c.PricePerRequest),
-				Resource:          resource,
-				Description:       description,
-				PayTo:             payTo,
-				MaxTimeoutSeconds: maxTimeout,
-				Asset:             c.Asset,
-				OutputSchema:      nil,
-			}
-
-			// Add facilitator URL if configured
-			if facilitatorURL, ok := c.FacilitatorURLs[network]; ok {
-				if req.Extra == nil {
-					req.Extra = make(map[string]interface{})
-				}
-				req.Extra["facilitatorUrl"] = facilitatorURL
-			}
-
-			requirements = append(requirements, req)
+			kinds = append(kinds, SupportedKind{X402Version: X402Version, Scheme: scheme, Network: network})
 		}
 	}
+	return kinds
+}
 
-	return requirements
+// networkEntry looks network up in m, which may key it in either form. An
+// exact key wins; otherwise the lowest matching key does, so the result does
+// not depend on map iteration order.
+func networkEntry[V any](m map[NetworkType]V, network NetworkType) (V, bool) {
+	if v, ok := m[network]; ok {
+		return v, true
+	}
+	var match NetworkType
+	found := false
+	for key := range m {
+		if sameNetwork(key, network) && (!found || key < match) {
+			match, found = key, true
+		}
+	}
+	if !found {
+		var zero V
+		return zero, false
+	}
+	return m[match], true
 }
 
 // Example scheme implementations (stubs for future)
@@ -326,19 +437,16 @@ func (s *StripeScheme) SupportedNetworks() []NetworkType {
 func (s *StripeScheme) Verify(ctx context.Context, payload *PaymentPayload, requirements *PaymentRequirements) (*VerificationResult, error) {
 	// Stripe verification is handled by the StripeRail in payment_rails.go
 	// This scheme is for compatibility with the scheme registry
-	return nil, fmt.Errorf("use StripeRail for Stripe payment verification")
+	return nil, fmt.Errorf("%w: use StripeRail for Stripe payment verification", ErrRailUnavailable)
 }
 
 func (s *StripeScheme) Settle(ctx context.Context, payload *PaymentPayload, requirements *PaymentRequirements) (*SettlementResult, error) {
 	// Stripe capture is handled by the StripeRail in payment_rails.go
-	return nil, fmt.Errorf("use StripeRail for Stripe payment capture")
+	return nil, fmt.Errorf("%w: use StripeRail for Stripe payment capture", ErrRailUnavailable)
 }
 
-// RegisterDefaultSchemes registers the default payment schemes
-func RegisterDefaultSchemes() {
-	DefaultRegistry.Register(&ExactEVMScheme{})
-}
-
-func init() {
-	RegisterDefaultSchemes()
-}
+// RegisterDefaultSchemes does nothing: DefaultRegistry always holds the
+// default schemes.
+//
+// Deprecated: use NewDefaultSchemeRegistry.
+func RegisterDefaultSchemes() {}
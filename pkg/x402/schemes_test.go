@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestSchemeRegistry(t *testing.T) {
@@ -262,7 +263,7 @@ func TestParsePaymentPayload(t *testing.T) {
 	jsonBytes, _ := json.Marshal(payload)
 	encoded := base64.StdEncoding.EncodeToString(jsonBytes)
 
-	parsed, err := parsePaymentPayload(encoded)
+	parsed, err := parsePaymentPayload(encoded, 0)
 	if err != nil {
 		t.Fatalf("Failed to parse payload: %v", err)
 	}
@@ -297,3 +298,137 @@ func TestDefaultRegistry_HasEVMScheme(t *testing.T) {
 		t.Error("Exact scheme should support Base network")
 	}
 }
+
+func TestMultiSchemeMiddleware_StableRequirements(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	config := MultiSchemeConfig{
+		Config: Config{
+			PayTo:           "0xdefault",
+			PricePerRequest: 1000,
+			Currency:        "USDC",
+			now:             func() time.Time { return now },
+		},
+		AcceptedSchemes:  []SchemeType{SchemeExact, SchemeUpto},
+		AcceptedNetworks: []NetworkType{NetworkBaseSepolia, NetworkBaseMainnet, NetworkPolygon},
+		PaymentAddresses: map[NetworkType]string{
+			"base-sepolia":     "0xtestnet",
+			NetworkBaseMainnet: "0xmainnet",
+			"polygon":          "0xpolygon",
+		},
+		FacilitatorURLs: map[NetworkType]string{
+			NetworkBaseSepolia: "https://sepolia.facilitator.example",
+			NetworkBaseMainnet: "https://facilitator.example",
+			NetworkPolygon:     "https://polygon.facilitator.example",
+		},
+	}
+	get402 := func(config MultiSchemeConfig) (string, PaymentRequiredResponse) {
+		handler := MultiSchemeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/test", nil))
+		header := rr.Header().Get("PAYMENT-REQUIRED")
+		decoded, _ := base64.StdEncoding.DecodeString(header)
+		var response PaymentRequiredResponse
+		if err := json.Unmarshal(decoded, &response); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		return header, response
+	}
+
+	first, response := get402(config)
+	for i := 0; i < 20; i++ {
+		if again, _ := get402(config); again != first {
+			t.Fatalf("Expected byte-identical PAYMENT-REQUIRED headers, got\n%s\n%s", first, again)
+		}
+	}
+
+	var order []string
+	for _, req := range response.Accepts {
+		order = append(order, req.Scheme+"/"+req.Network+"/"+req.PayTo)
+	}
+	want := []string{
+		"exact/" + string(NetworkBaseSepolia) + "/0xtestnet",
+		"exact/" + string(NetworkBaseMainnet) + "/0xmainnet",
+		"exact/" + string(NetworkPolygon) + "/0xpolygon",
+		"upto/" + string(NetworkBaseSepolia) + "/0xtestnet",
+		"upto/" + string(NetworkBaseMainnet) + "/0xmainnet",
+		"upto/" + string(NetworkPolygon) + "/0xpolygon",
+	}
+	if len(order) != len(want) {
+		t.Fatalf("Expected %d accepts, got %v", len(want), order)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Errorf("Expected accepts[%d] to be %s, got %s", i, want[i], order[i])
+		}
+	}
+
+	// The hash ignores expiry but tracks the offer
+	if response.RequirementsHash == "" {
+		t.Fatal("Expected a requirementsHash")
+	}
+	now = now.Add(time.Minute)
+	if _, later := get402(config); later.RequirementsHash != response.RequirementsHash || later.ValidUntil == response.ValidUntil {
+		t.Errorf("Expected the same hash for a later quote, got %s and %s", response.RequirementsHash, later.RequirementsHash)
+	}
+	config.PricePerRequest = 2000
+	if _, repriced := get402(config); repriced.RequirementsHash == response.RequirementsHash {
+		t.Error("Expected the hash to change with the price")
+	}
+}
+
+func TestNewDefaultSchemeRegistry_IsFresh(t *testing.T) {
+	a, b := NewDefaultSchemeRegistry(), NewDefaultSchemeRegistry()
+	if _, ok := a.Get(SchemeExact); !ok {
+		t.Fatal("Expected the exact scheme registered")
+	}
+
+	a.Register(&recordingScheme{})
+	if scheme, _ := b.Get(SchemeExact); scheme == nil {
+		t.Fatal("Expected the exact scheme in the second registry")
+	} else if _, ok := scheme.(*ExactEVMScheme); !ok {
+		t.Errorf("Expected the second registry unchanged, got %T", scheme)
+	}
+}
+
+func TestDefaultRegistry_IsFrozen(t *testing.T) {
+	DefaultRegistry.Register(&StripeScheme{})
+	if _, ok := DefaultRegistry.Get(SchemeStripePayment); ok {
+		t.Error("Expected schemes registered on DefaultRegistry ignored")
+	}
+}
+
+func TestMultiSchemeMiddleware_RegistriesAreIndependent(t *testing.T) {
+	newMiddleware := func(scheme *recordingScheme) http.Handler {
+		registry := NewSchemeRegistry()
+		registry.Register(scheme)
+		return MultiSchemeMiddleware(createTestHandler(), MultiSchemeConfig{
+			Config:           Config{PayTo: "0xseller", PricePerRequest: 100, Currency: "USDC"},
+			AcceptedSchemes:  []SchemeType{SchemeExact},
+			AcceptedNetworks: []NetworkType{NetworkBaseMainnet},
+			SchemeRegistry:   registry,
+		})
+	}
+	first, second := &recordingScheme{}, &recordingScheme{}
+	firstHandler, secondHandler := newMiddleware(first), newMiddleware(second)
+
+	payload, _ := json.Marshal(PaymentPayload{Scheme: SchemeExact, Network: NetworkBaseMainnet, Payer: "0xagent"})
+	pay := func(handler http.Handler) int {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-PAYMENT", base64.StdEncoding.EncodeToString(payload))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := pay(firstHandler); code != http.StatusOK {
+		t.Fatalf("Expected the first middleware to accept the payment, got %d", code)
+	}
+	if len(first.verified) != 1 || len(second.verified) != 0 {
+		t.Errorf("Expected only the first middleware's scheme used, got %d and %d", len(first.verified), len(second.verified))
+	}
+
+	pay(secondHandler)
+	if len(first.verified) != 1 || len(second.verified) != 1 {
+		t.Errorf("Expected only the second middleware's scheme used, got %d and %d", len(first.verified), len(second.verified))
+	}
+}
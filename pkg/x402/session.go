@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -39,18 +40,90 @@ type Session struct {
 	AllowedEndpoints []string          `json:"allowedEndpoints,omitempty"` // Empty = all endpoints
 	Metadata         map[string]string `json:"metadata,omitempty"`
 	Active           bool              `json:"active"`
+
+	// AutoRenew sessions are renewed from the customer's saved payment
+	// method when they run out (see SessionRenewal)
+	AutoRenew  bool   `json:"autoRenew,omitempty"`
+	CustomerID string `json:"customerId,omitempty"` // PaymentPrefsStore customer; defaults to PayerAddress
+	Renewals   int    `json:"renewals,omitempty"`
+
+	// Delegates are the identities (wallet addresses or agent IDs) the
+	// owner lets use the session via X-Delegate-ID, with the requests each
+	// has made
+	Delegates        map[string]int64 `json:"delegates,omitempty"`
+	DelegateRevision int              `json:"delegateRevision"` // Signed into delegate changes so they can't be replayed
+
+	// DelegateKeyHashes are the SHA-256 hashes of each delegate's
+	// X-Session-Key, and OwnerKeyHash of the owner's, which its requests
+	// need once the session has had delegates
+	DelegateKeyHashes map[string]string `json:"delegateKeyHashes,omitempty"`
+	OwnerKeyHash      string            `json:"ownerKeyHash,omitempty"`
 }
 
-// SessionStore interface for session storage
+// clone returns a copy of the session that shares no slices or maps with it
+func (s *Session) clone() *Session {
+	cp := *s
+	cp.AllowedEndpoints = append([]string(nil), s.AllowedEndpoints...)
+	if s.Metadata != nil {
+		cp.Metadata = make(map[string]string, len(s.Metadata))
+		for k, v := range s.Metadata {
+			cp.Metadata[k] = v
+		}
+	}
+	if s.Delegates != nil {
+		cp.Delegates = make(map[string]int64, len(s.Delegates))
+		for k, v := range s.Delegates {
+			cp.Delegates[k] = v
+		}
+	}
+	if s.DelegateKeyHashes != nil {
+		cp.DelegateKeyHashes = make(map[string]string, len(s.DelegateKeyHashes))
+		for k, v := range s.DelegateKeyHashes {
+			cp.DelegateKeyHashes[k] = v
+		}
+	}
+	return &cp
+}
+
+// SessionStore interface for session storage. Sessions returned by any
+// method must be copies, since requests read them while others update the
+// same session; changes are saved with UpdateSession.
 type SessionStore interface {
 	CreateSession(session *Session) error
 	GetSession(id string) (*Session, error)
 	UpdateSession(session *Session) error
 	DeleteSession(id string) error
 	ListSessionsByPayer(payerAddress string) ([]*Session, error)
+
+	// ListSessions returns up to limit sessions matching filter, oldest
+	// first, starting after pageToken ("" for the first page). The returned
+	// token fetches the next page and is "" on the last.
+	ListSessions(filter ListFilter, pageToken string, limit int) ([]*Session, string, error)
+
 	CleanExpired() error
 }
 
+// SessionConsumer is implemented by stores that can validate a session and
+// count a request against it atomically. Stores without it fall back to
+// GetSession and UpdateSession, which can overrun MaxRequests under load.
+type SessionConsumer interface {
+	ConsumeSession(id, path string) (*Session, error)
+}
+
+// DelegateConsumer is implemented by stores that can also check the key of
+// the delegate making a request, and count the request against it,
+// atomically (see session_delegates.go)
+type DelegateConsumer interface {
+	ConsumeSessionAs(id, path, delegate, key string) (*Session, error)
+}
+
+// SessionModifier is implemented by stores that can change a session under
+// their lock, so the change can't lose requests counted meanwhile. Stores
+// without it fall back to GetSession and UpdateSession.
+type SessionModifier interface {
+	ModifySession(id string, modify func(*Session) error) (*Session, error)
+}
+
 // SessionConfig configures session-based payments
 type SessionConfig struct {
 	Store              SessionStore
@@ -60,6 +133,27 @@ type SessionConfig struct {
 	PricePerRequest    int64         // Price per request in session
 	Currency           string
 	AllowedEndpoints   []string // Endpoints allowed for session access
+
+	// Tiers and Endpoint are advertised in the 402s of payment middleware
+	// inside SessionMiddleware, for requests without a session
+	Tiers    []SessionPricingTier
+	Endpoint string
+
+	// Alerts, if set, is told when a request-based session has used 90% of
+	// its requests (the response also carries X-Session-Low)
+	Alerts *SpendingAlerts
+
+	// Renewal, if set, renews auto-renewing sessions that have run out on
+	// their next request, and lets clients create them
+	Renewal *SessionRenewal
+
+	// WalletVerifier checks session owners' signatures on delegate changes
+	// at POST and DELETE .../sessions/{id}/delegates
+	WalletVerifier WalletVerifier
+
+	// Tenants, if set, keeps sessions separate for each tenant, in place of
+	// Store
+	Tenants *TenantStores
 }
 
 // SessionPricingTier defines pricing tiers for sessions
@@ -95,7 +189,7 @@ func (s *InMemorySessionStore) CreateSession(session *Session) error {
 	}
 	session.CreatedAt = time.Now()
 	session.Active = true
-	s.sessions[session.ID] = session
+	s.sessions[session.ID] = session.clone()
 	return nil
 }
 
@@ -106,9 +200,36 @@ func (s *InMemorySessionStore) GetSession(id string) (*Session, error) {
 
 	session, ok := s.sessions[id]
 	if !ok {
-		return nil, errors.New("session not found")
+		return nil, ErrSessionNotFound
 	}
-	return session, nil
+	return session.clone(), nil
+}
+
+// ConsumeSession validates session id for path and counts one request
+// against it under the store lock. It returns a copy of the updated session.
+func (s *InMemorySessionStore) ConsumeSession(id, path string) (*Session, error) {
+	return s.ConsumeSessionAs(id, path, "", "")
+}
+
+// ConsumeSessionAs is ConsumeSession for a request made by delegate ("" for
+// the owner) presenting key, which must be the key of one of the session's
+// delegates or, on a session that has one, the owner's
+func (s *InMemorySessionStore) ConsumeSessionAs(id, path, delegate, key string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	if err := validateSession(session, path); err != nil {
+		return nil, err
+	}
+	if err := checkDelegate(session, delegate, key); err != nil {
+		return nil, err
+	}
+	countSessionRequest(session, delegate)
+	return session.clone(), nil
 }
 
 // UpdateSession updates an existing session
@@ -117,12 +238,30 @@ func (s *InMemorySessionStore) UpdateSession(session *Session) error {
 	defer s.mu.Unlock()
 
 	if _, ok := s.sessions[session.ID]; !ok {
-		return errors.New("session not found")
+		return ErrSessionNotFound
 	}
-	s.sessions[session.ID] = session
+	s.sessions[session.ID] = session.clone()
 	return nil
 }
 
+// ModifySession applies modify to session id under the store lock, keeping
+// the change unless modify fails. It returns a copy of the changed session.
+func (s *InMemorySessionStore) ModifySession(id string, modify func(*Session) error) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	session := stored.clone()
+	if err := modify(session); err != nil {
+		return nil, err
+	}
+	s.sessions[id] = session
+	return session.clone(), nil
+}
+
 // DeleteSession removes a session
 func (s *InMemorySessionStore) DeleteSession(id string) error {
 	s.mu.Lock()
@@ -140,20 +279,38 @@ func (s *InMemorySessionStore) ListSessionsByPayer(payerAddress string) ([]*Sess
 	var result []*Session
 	for _, session := range s.sessions {
 		if session.PayerAddress == payerAddress {
-			result = append(result, session)
+			result = append(result, session.clone())
 		}
 	}
 	return result, nil
 }
 
-// CleanExpired removes expired sessions
+// ListSessions returns a page of sessions matching filter
+func (s *InMemorySessionStore) ListSessions(filter ListFilter, pageToken string, limit int) ([]*Session, string, error) {
+	s.mu.RLock()
+	now := time.Now()
+	var matched []*Session
+	for _, session := range s.sessions {
+		active := session.Active && now.Before(session.ExpiresAt)
+		if filter.matches([]string{session.PayerAddress}, active, session.CreatedAt) {
+			matched = append(matched, session.clone())
+		}
+	}
+	s.mu.RUnlock()
+
+	return paginate(matched, func(session *Session) pageKey {
+		return pageKey{created: session.CreatedAt, id: session.ID}
+	}, pageToken, limit)
+}
+
+// CleanExpired removes expired sessions, except those due to auto-renew
 func (s *InMemorySessionStore) CleanExpired() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	now := time.Now()
 	for id, session := range s.sessions {
-		if session.ExpiresAt.Before(now) {
+		if session.ExpiresAt.Before(now) && !session.AutoRenew {
 			delete(s.sessions, id)
 		}
 	}
@@ -169,40 +326,99 @@ func generateSessionID() string {
 
 // SessionMiddleware validates session-based access
 func SessionMiddleware(next http.Handler, config SessionConfig) http.Handler {
+	guard := &composition{name: "SessionMiddleware"}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An x402 middleware outside this one already handled payment
+		if guard.passThrough(w, r, next) {
+			return
+		}
+
 		sessionID := r.Header.Get("X-Session-ID")
 		if sessionID == "" {
-			// No session, try other payment methods
-			next.ServeHTTP(w, r)
+			// No session, try other payment methods, which offer one
+			next.ServeHTTP(w, advertise(r, PaymentExtensions{Sessions: &SubscriptionInfo{
+				Available:       true,
+				Tiers:           config.Tiers,
+				SessionEndpoint: config.Endpoint,
+			}}))
 			return
 		}
 
-		session, err := config.Store.GetSession(sessionID)
-		if err != nil {
+		// Validate session and count this request
+		store := config.Tenants.sessionsFor(r, config.Store)
+		session, err := config.Renewal.consume(r.Context(), store, sessionID, r.URL.Path, r.Header.Get(DelegateHeader), r.Header.Get(SessionKeyHeader))
+		if errors.Is(err, ErrSessionNotFound) {
 			sendSessionError(w, "invalid_session", "Session not found or invalid")
 			return
 		}
-
-		// Validate session
-		if err := validateSession(session, r.URL.Path); err != nil {
-			sendSessionError(w, "session_error", err.Error())
+		if errors.Is(err, ErrNotDelegate) {
+			sendSessionError(w, "not_delegate", err.Error())
 			return
 		}
-
-		// Increment usage for request-based sessions
-		if session.SessionType == SessionTypeRequests {
-			session.UsedRequests++
-			_ = config.Store.UpdateSession(session)
+		if err != nil {
+			sendSessionError(w, "session_error", err.Error())
+			return
 		}
 
 		// Add session info to response headers
-		w.Header().Set("X-Session-Remaining", formatSessionRemaining(session))
-		w.Header().Set("X-Session-Expires", session.ExpiresAt.Format(time.RFC3339))
+		setSessionHeaders(w, session)
+		warnSessionLow(w, config.Alerts, session)
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, decide(withSessionStatus(r, session), guard.name))
 	})
 }
 
+// consumeSession validates a session for path and counts one request against
+// request-based sessions, atomically if the store supports it
+func consumeSession(store SessionStore, id, path string) (*Session, error) {
+	return consumeSessionAs(store, id, path, "", "")
+}
+
+// consumeSessionAs is consumeSession for a request made by delegate ("" for
+// the owner) presenting key, which is also counted against the delegate
+func consumeSessionAs(store SessionStore, id, path, delegate, key string) (*Session, error) {
+	if consumer, ok := store.(DelegateConsumer); ok {
+		return consumer.ConsumeSessionAs(id, path, delegate, key)
+	}
+
+	session, err := store.GetSession(id)
+	if err != nil {
+		return nil, ErrSessionNotFound
+	}
+	if err := checkDelegate(session, delegate, key); err != nil {
+		return nil, err
+	}
+	if consumer, ok := store.(SessionConsumer); ok && delegate == "" {
+		return consumer.ConsumeSession(id, path)
+	}
+	if err := validateSession(session, path); err != nil {
+		return nil, err
+	}
+	if session.SessionType == SessionTypeRequests || delegate != "" {
+		countSessionRequest(session, delegate)
+		_ = store.UpdateSession(session)
+	}
+	return session, nil
+}
+
+// countSessionRequest counts a request against session and the delegate
+// that made it
+func countSessionRequest(session *Session, delegate string) {
+	if session.SessionType == SessionTypeRequests {
+		session.UsedRequests++
+	}
+	if delegate != "" {
+		session.Delegates[delegate]++
+	}
+}
+
+// setSessionHeaders reports a session's remaining usage and expiry
+func setSessionHeaders(w http.ResponseWriter, session *Session) {
+	w.Header().Set("X-Session-Remaining", formatSessionRemaining(session))
+	w.Header().Set("X-Session-Expires", session.ExpiresAt.Format(time.RFC3339))
+}
+
 // validateSession checks if a session is valid for the request
 func validateSession(session *Session, path string) error {
 	if !session.Active {
@@ -210,11 +426,11 @@ func validateSession(session *Session, path string) error {
 	}
 
 	if time.Now().After(session.ExpiresAt) {
-		return errors.New("session has expired")
+		return ErrSessionExpired
 	}
 
 	if session.SessionType == SessionTypeRequests && session.UsedRequests >= session.MaxRequests {
-		return errors.New("session request limit exceeded")
+		return ErrSessionLimitReached
 	}
 
 	// Check endpoint restrictions
@@ -296,6 +512,11 @@ type SessionCreateRequest struct {
 	MaxRequests  int64             `json:"maxRequests,omitempty"`
 	Endpoints    []string          `json:"endpoints,omitempty"`
 	Metadata     map[string]string `json:"metadata,omitempty"`
+
+	// AutoRenew asks for the session to be renewed from CustomerID's saved
+	// payment method when it runs out, if the server renews sessions
+	AutoRenew  bool   `json:"autoRenew,omitempty"`
+	CustomerID string `json:"customerId,omitempty"`
 }
 
 // SessionCreateResponse is returned when creating a session
@@ -305,11 +526,19 @@ type SessionCreateResponse struct {
 	SessionType       SessionType `json:"sessionType"`
 	MaxRequests       int64       `json:"maxRequests,omitempty"`
 	RemainingRequests int64       `json:"remainingRequests,omitempty"`
+	AutoRenew         bool        `json:"autoRenew,omitempty"`
 }
 
-// SessionHandler returns an HTTP handler for session management
-func SessionHandler(store SessionStore, config SessionConfig) http.HandlerFunc {
+// SessionHandler returns an HTTP handler for session management, using the
+// request tenant's store if config has Tenants
+func SessionHandler(sessions SessionStore, config SessionConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		store := config.Tenants.sessionsFor(r, sessions)
+		if rest, ok := strings.CutSuffix(r.URL.Path, "/delegates"); ok {
+			handleSessionDelegates(w, r, store, config.WalletVerifier, rest[strings.LastIndex(rest, "/")+1:])
+			return
+		}
+
 		switch r.Method {
 		case http.MethodPost:
 			handleCreateSession(w, r, store, config)
@@ -353,6 +582,8 @@ func handleCreateSession(w http.ResponseWriter, r *http.Request, store SessionSt
 		Currency:         config.Currency,
 		AllowedEndpoints: req.Endpoints,
 		Metadata:         req.Metadata,
+		AutoRenew:        req.AutoRenew && config.Renewal != nil,
+		CustomerID:       req.CustomerID,
 	}
 
 	if err := store.CreateSession(session); err != nil {
@@ -364,6 +595,7 @@ func handleCreateSession(w http.ResponseWriter, r *http.Request, store SessionSt
 		SessionID:   session.ID,
 		ExpiresAt:   session.ExpiresAt,
 		SessionType: session.SessionType,
+		AutoRenew:   session.AutoRenew,
 	}
 	if session.SessionType == SessionTypeRequests {
 		resp.MaxRequests = session.MaxRequests
@@ -386,10 +618,14 @@ func handleGetSession(w http.ResponseWriter, r *http.Request, store SessionStore
 	}
 
 	session, err := store.GetSession(sessionID)
-	if err != nil {
+	if errors.Is(err, ErrNotFound) {
 		http.Error(w, "Session not found", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		http.Error(w, "Failed to get session", errorStatus(err))
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(session)
@@ -402,8 +638,18 @@ func handleDeleteSession(w http.ResponseWriter, r *http.Request, store SessionSt
 		return
 	}
 
-	if err := store.DeleteSession(sessionID); err != nil {
-		http.Error(w, "Failed to delete session", http.StatusInternalServerError)
+	// Delegates know the session ID, so once there are any only the owner's
+	// key ends the session
+	session, err := store.GetSession(sessionID)
+	if err == nil && checkDelegate(session, "", r.Header.Get(SessionKeyHeader)) != nil {
+		http.Error(w, "Only the session owner may end it", http.StatusForbidden)
+		return
+	}
+	if err := store.DeleteSession(sessionID); errors.Is(err, ErrNotFound) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to delete session", errorStatus(err))
 		return
 	}
 
@@ -444,9 +690,13 @@ func EncodeSessionToken(session *Session) string {
 	return base64.StdEncoding.EncodeToString(data)
 }
 
-// DecodeSessionToken decodes a session token
+// DecodeSessionToken decodes a session token. Tokens over
+// DefaultMaxProofBytes, and tokens without a session ID, are refused.
 func DecodeSessionToken(token string) (*Session, error) {
-	data, err := base64.StdEncoding.DecodeString(token)
+	if err := checkProofSize(token, 0); err != nil {
+		return nil, err
+	}
+	data, err := decodeBase64(token)
 	if err != nil {
 		return nil, err
 	}
@@ -454,5 +704,8 @@ func DecodeSessionToken(token string) (*Session, error) {
 	if err := json.Unmarshal(data, &session); err != nil {
 		return nil, err
 	}
+	if session.ID == "" {
+		return nil, errors.New("session token has no session ID")
+	}
 	return &session, nil
 }
@@ -0,0 +1,232 @@
+// Package x402 - Session Delegation
+// A team buys one session with its treasury wallet and lets its agents, each
+// with its own address or agent ID, use it. The owner signs the list of
+// delegates it adds or revokes, and each delegate added gets its own key.
+// Delegates then send X-Delegate-ID and their key with the session ID, and
+// their requests are counted against the session and against each delegate.
+// Since delegates know the session ID, a session with delegates also needs
+// the owner's key for the owner's own requests. A revoked delegate's key is
+// refused on its next request.
+package x402
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// DelegateHeader names the delegate making a request on a session
+const DelegateHeader = "X-Delegate-ID"
+
+// SessionKeyHeader carries the key of the delegate making a request on a
+// session, or the owner's key on a session that has had delegates
+const SessionKeyHeader = "X-Session-Key"
+
+// ErrNotDelegate is returned for requests from identities the session owner
+// hasn't delegated to
+var ErrNotDelegate = errors.New("not a delegate of this session")
+
+// errStaleDelegates is returned for delegate changes signed against an old
+// DelegateRevision
+var errStaleDelegates = errors.New("session delegates changed; sign the current delegateRevision")
+
+// SessionDelegates reports a session's delegates and their usage
+type SessionDelegates struct {
+	SessionID string           `json:"sessionId"`
+	Revision  int              `json:"delegateRevision"`
+	Delegates map[string]int64 `json:"delegates"` // Delegate -> requests made
+
+	// Keys, in the response to adding delegates, are the X-Session-Key of
+	// each delegate added, and OwnerKey the owner's once the session first
+	// has delegates. Only their hashes are kept, so they are shown once.
+	Keys     map[string]string `json:"keys,omitempty"`
+	OwnerKey string            `json:"ownerKey,omitempty"`
+}
+
+// delegateChange is what a session's owner wallet signs to change its
+// delegates, encoded as JSON with the delegates sorted
+type delegateChange struct {
+	Action    string   `json:"action"` // "delegate" or "revoke"
+	SessionID string   `json:"sessionId"`
+	Revision  int      `json:"revision"`
+	Delegates []string `json:"delegates"`
+}
+
+// message returns the canonical JSON encoding of change
+func (change delegateChange) message() string {
+	change.Delegates = append([]string(nil), change.Delegates...)
+	sort.Strings(change.Delegates)
+	encoded, _ := json.Marshal(change)
+	return string(encoded)
+}
+
+// SessionDelegatesMessage is the message a session's owner wallet signs (sent
+// as X-Wallet-Signature) to add delegates at the session's DelegateRevision:
+// {"action":"delegate","sessionId":...,"revision":...,"delegates":[...]}
+// with the delegates sorted
+func SessionDelegatesMessage(sessionID string, revision int, delegates []string) string {
+	return delegateChange{Action: "delegate", SessionID: sessionID, Revision: revision, Delegates: delegates}.message()
+}
+
+// SessionRevokeMessage is the message a session's owner wallet signs to
+// revoke delegates at the session's DelegateRevision, as
+// SessionDelegatesMessage with the action "revoke"
+func SessionRevokeMessage(sessionID string, revision int, delegates []string) string {
+	return delegateChange{Action: "revoke", SessionID: sessionID, Revision: revision, Delegates: delegates}.message()
+}
+
+// checkDelegate fails unless key is the key of delegate, one of session's
+// delegates, or for delegate "" the owner's key on a session that has one
+func checkDelegate(session *Session, delegate, key string) error {
+	if delegate == "" {
+		if session.OwnerKeyHash != "" && !sessionKeyMatches(session.OwnerKeyHash, key) {
+			return ErrNotDelegate
+		}
+		return nil
+	}
+	if _, ok := session.Delegates[delegate]; !ok || !sessionKeyMatches(session.DelegateKeyHashes[delegate], key) {
+		return ErrNotDelegate
+	}
+	return nil
+}
+
+// newSessionKey returns a random session key and its hash
+func newSessionKey() (string, string) {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	key := "sk_" + hex.EncodeToString(b)
+	return key, hashSessionKey(key)
+}
+
+func hashSessionKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionKeyMatches reports whether key hashes to hash
+func sessionKeyMatches(hash, key string) bool {
+	return hash != "" && key != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(hashSessionKey(key))) == 1
+}
+
+// modifySession changes session id with modify, atomically if the store
+// supports it
+func modifySession(store SessionStore, id string, modify func(*Session) error) (*Session, error) {
+	if modifier, ok := store.(SessionModifier); ok {
+		return modifier.ModifySession(id, modify)
+	}
+	session, err := store.GetSession(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := modify(session); err != nil {
+		return nil, err
+	}
+	return session, store.UpdateSession(session)
+}
+
+// handleSessionDelegates serves .../sessions/{id}/delegates: GET reports
+// delegate usage, and POST and DELETE add and revoke the delegates listed in
+// the body, signed by the session owner's wallet
+func handleSessionDelegates(w http.ResponseWriter, r *http.Request, store SessionStore, verify WalletVerifier, sessionID string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	session, err := store.GetSession(sessionID)
+	if err != nil {
+		http.Error(w, `{"error":"session not found"}`, errorStatus(err))
+		return
+	}
+	if r.Method == http.MethodGet {
+		_ = json.NewEncoder(w).Encode(delegatesOf(session))
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Delegates []string `json:"delegates"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Delegates) == 0 {
+		http.Error(w, `{"error":"delegates required"}`, http.StatusBadRequest)
+		return
+	}
+	for _, delegate := range req.Delegates {
+		if strings.TrimSpace(delegate) == "" {
+			http.Error(w, `{"error":"delegates must not be empty"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	message := SessionDelegatesMessage(session.ID, session.DelegateRevision, req.Delegates)
+	if r.Method == http.MethodDelete {
+		message = SessionRevokeMessage(session.ID, session.DelegateRevision, req.Delegates)
+	}
+	signature := r.Header.Get("X-Wallet-Signature")
+	if verify == nil || session.PayerAddress == "" || signature == "" {
+		http.Error(w, `{"error":"only the session owner may change its delegates"}`, http.StatusForbidden)
+		return
+	}
+	if valid, err := verify(session.PayerAddress, message, signature); err != nil || !valid {
+		http.Error(w, `{"error":"only the session owner may change its delegates"}`, http.StatusForbidden)
+		return
+	}
+
+	var keys map[string]string
+	var ownerKey string
+	updated, err := modifySession(store, session.ID, func(s *Session) error {
+		if s.DelegateRevision != session.DelegateRevision {
+			return errStaleDelegates
+		}
+		keys, ownerKey = nil, ""
+		if s.Delegates == nil {
+			s.Delegates = make(map[string]int64)
+		}
+		if s.DelegateKeyHashes == nil {
+			s.DelegateKeyHashes = make(map[string]string)
+		}
+		for _, delegate := range req.Delegates {
+			if r.Method == http.MethodDelete {
+				delete(s.Delegates, delegate)
+				delete(s.DelegateKeyHashes, delegate)
+			} else if _, ok := s.Delegates[delegate]; !ok {
+				if keys == nil {
+					keys = make(map[string]string)
+				}
+				s.Delegates[delegate] = 0
+				keys[delegate], s.DelegateKeyHashes[delegate] = newSessionKey()
+			}
+		}
+		if r.Method == http.MethodPost && s.OwnerKeyHash == "" {
+			ownerKey, s.OwnerKeyHash = newSessionKey()
+		}
+		s.DelegateRevision++
+		return nil
+	})
+	if errors.Is(err, errStaleDelegates) {
+		http.Error(w, `{"error":"`+err.Error()+`"}`, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"failed to update delegates"}`, errorStatus(err))
+		return
+	}
+	delegates := delegatesOf(updated)
+	delegates.Keys, delegates.OwnerKey = keys, ownerKey
+	_ = json.NewEncoder(w).Encode(delegates)
+}
+
+// delegatesOf reports session's delegates
+func delegatesOf(session *Session) SessionDelegates {
+	delegates := session.Delegates
+	if delegates == nil {
+		delegates = map[string]int64{}
+	}
+	return SessionDelegates{SessionID: session.ID, Revision: session.DelegateRevision, Delegates: delegates}
+}
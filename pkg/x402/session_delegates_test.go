@@ -0,0 +1,162 @@
+package x402
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTreasurySession(t *testing.T) (*InMemorySessionStore, *Session, http.HandlerFunc, http.Handler) {
+	t.Helper()
+	store := NewInMemorySessionStore()
+	session := &Session{
+		PayerAddress: "0xtreasury",
+		SessionType:  SessionTypeRequests,
+		MaxRequests:  10,
+		ExpiresAt:    time.Now().Add(time.Hour),
+	}
+	store.CreateSession(session)
+
+	config := SessionConfig{Store: store, WalletVerifier: walletVerifier}
+	api := SessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), config)
+	return store, session, SessionHandler(store, config), api
+}
+
+// changeDelegates sends a delegate change signed by signer at revision
+func changeDelegates(handler http.Handler, method, sessionID, signer string, revision int, delegates ...string) *httptest.ResponseRecorder {
+	message := SessionDelegatesMessage(sessionID, revision, delegates)
+	if method == http.MethodDelete {
+		message = SessionRevokeMessage(sessionID, revision, delegates)
+	}
+	body, _ := json.Marshal(map[string][]string{"delegates": delegates})
+	req := httptest.NewRequest(method, "/sessions/"+sessionID+"/delegates", strings.NewReader(string(body)))
+	req.Header.Set("X-Wallet-Signature", "signed:"+signer+":"+message)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// addDelegates adds delegates as the owner at revision and returns the keys
+// issued
+func addDelegates(t *testing.T, handler http.Handler, sessionID string, revision int, delegates ...string) SessionDelegates {
+	t.Helper()
+	w := changeDelegates(handler, http.MethodPost, sessionID, "0xtreasury", revision, delegates...)
+	var resp SessionDelegates
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the owner to add delegates, got %d (%v)", w.Code, err)
+	}
+	return resp
+}
+
+func delegateRequest(api http.Handler, sessionID, delegate, key string) int {
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-Session-ID", sessionID)
+	req.Header.Set(DelegateHeader, delegate)
+	req.Header.Set(SessionKeyHeader, key)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestSessionDelegates_MetersDelegatedAccess(t *testing.T) {
+	store, session, handler, api := newTreasurySession(t)
+
+	added := addDelegates(t, handler, session.ID, 0, "0xagent1", "agent-2")
+	if len(added.Keys) != 2 || added.Keys["0xagent1"] == added.Keys["agent-2"] || added.OwnerKey == "" {
+		t.Fatalf("Expected a key per delegate and one for the owner, got %+v", added)
+	}
+
+	for _, delegate := range []string{"0xagent1", "0xagent1", "agent-2"} {
+		if code := delegateRequest(api, session.ID, delegate, added.Keys[delegate]); code != http.StatusOK {
+			t.Fatalf("Expected %s served on the session, got %d", delegate, code)
+		}
+	}
+
+	stored, _ := store.GetSession(session.ID)
+	if stored.UsedRequests != 3 || stored.Delegates["0xagent1"] != 2 || stored.Delegates["agent-2"] != 1 {
+		t.Errorf("Expected 3 requests, 2 by 0xagent1 and 1 by agent-2, got %d and %v", stored.UsedRequests, stored.Delegates)
+	}
+
+	// The session response reports per-delegate usage
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/sessions?id="+session.ID, nil))
+	var got Session
+	json.NewDecoder(w.Body).Decode(&got)
+	if got.Delegates["0xagent1"] != 2 {
+		t.Errorf("Expected delegate usage in the session response, got %v", got.Delegates)
+	}
+}
+
+func TestSessionDelegates_RevocationTakesEffectImmediately(t *testing.T) {
+	_, session, handler, api := newTreasurySession(t)
+	added := addDelegates(t, handler, session.ID, 0, "0xagent1", "agent-2")
+	key := added.Keys["0xagent1"]
+	if code := delegateRequest(api, session.ID, "0xagent1", key); code != http.StatusOK {
+		t.Fatalf("Expected the delegate served, got %d", code)
+	}
+
+	// Only the owner may revoke
+	if w := changeDelegates(handler, http.MethodDelete, session.ID, "0xagent1", 1, "0xagent1"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a delegate's own signature refused, got %d", w.Code)
+	}
+	if w := changeDelegates(handler, http.MethodDelete, session.ID, "0xtreasury", 1, "0xagent1"); w.Code != http.StatusOK {
+		t.Fatalf("Expected the owner to revoke, got %d: %s", w.Code, w.Body)
+	}
+	// Revoked, the delegate can't pass as the owner or another delegate
+	for name, code := range map[string]int{
+		"own key":      delegateRequest(api, session.ID, "0xagent1", key),
+		"as the owner": delegateRequest(api, session.ID, "", key),
+		"no key":       delegateRequest(api, session.ID, "", ""),
+		"as agent-2":   delegateRequest(api, session.ID, "agent-2", key),
+	} {
+		if code != http.StatusUnauthorized {
+			t.Errorf("%s: expected the revoked delegate refused, got %d", name, code)
+		}
+	}
+	if code := delegateRequest(api, session.ID, "", added.OwnerKey); code != http.StatusOK {
+		t.Errorf("Expected the owner served with its key, got %d", code)
+	}
+	req := httptest.NewRequest("DELETE", "/sessions?id="+session.ID, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected the session kept from a caller without the owner's key, got %d", w.Code)
+	}
+
+	// Replaying the original grant doesn't restore it
+	if w := changeDelegates(handler, http.MethodPost, session.ID, "0xtreasury", 0, "0xagent1"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a replayed grant refused, got %d", w.Code)
+	}
+}
+
+func TestSessionDelegates_RejectsUnlistedDelegate(t *testing.T) {
+	store, session, handler, api := newTreasurySession(t)
+	added := addDelegates(t, handler, session.ID, 0, "0xagent1")
+
+	if code := delegateRequest(api, session.ID, "0xstranger", added.Keys["0xagent1"]); code != http.StatusUnauthorized {
+		t.Errorf("Expected an unlisted delegate refused, got %d", code)
+	}
+	if stored, _ := store.GetSession(session.ID); stored.UsedRequests != 0 {
+		t.Errorf("Expected nothing counted for a refused delegate, got %d", stored.UsedRequests)
+	}
+}
+
+func TestSessionDelegatesMessage_Canonical(t *testing.T) {
+	// A delegate containing the old separator can't pose as two
+	joined := SessionDelegatesMessage("sess_1", 0, []string{"a,b"})
+	split := SessionDelegatesMessage("sess_1", 0, []string{"a", "b"})
+	if joined == split {
+		t.Errorf("Expected distinct messages, both were %s", joined)
+	}
+	if got := SessionDelegatesMessage("sess_1", 2, []string{"b", "a"}); got != `{"action":"delegate","sessionId":"sess_1","revision":2,"delegates":["a","b"]}` {
+		t.Errorf("Expected canonical JSON, got %s", got)
+	}
+	if SessionRevokeMessage("sess_1", 2, []string{"a"}) == SessionDelegatesMessage("sess_1", 2, []string{"a"}) {
+		t.Error("Expected revoking and delegating signed differently")
+	}
+}
@@ -0,0 +1,299 @@
+// Package x402 - Session Renewal
+// A session created with autoRenew doesn't turn its payer away when it runs
+// out. Its customer's saved card is charged off-session for the renewal tier
+// and the session starts over. A declined charge turns auto-renewal off and
+// tells the seller, and MaxRenewals bounds how often a session renews.
+// Sessions renew lazily on their first request after running out, or from a
+// worker calling RenewDue.
+package x402
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Session renewal event kinds
+const (
+	RenewalSucceeded = "renewed"
+	RenewalDeclined  = "declined" // The charge was refused; auto-renewal is now off
+	RenewalCapped    = "capped"   // MaxRenewals reached; auto-renewal is now off
+)
+
+var (
+	// ErrRenewalDeclined is returned when a session's renewal charge is
+	// refused, or its customer has no saved payment method
+	ErrRenewalDeclined = kindOf(ErrInvalidPayment, "session renewal declined")
+
+	// ErrRenewalLimitReached is returned for sessions already renewed
+	// MaxRenewals times
+	ErrRenewalLimitReached = kindOf(ErrExpired, "session renewal limit reached")
+
+	// errNotRenewable is returned for sessions without auto-renewal
+	errNotRenewable = errors.New("session does not auto-renew")
+)
+
+// SessionRenewalEvent reports a renewal to SessionRenewal.OnRenewal
+type SessionRenewalEvent struct {
+	Kind       string    `json:"kind"`
+	SessionID  string    `json:"sessionId"`
+	CustomerID string    `json:"customerId"`
+	Amount     int64     `json:"amount,omitempty"`
+	Currency   string    `json:"currency,omitempty"`
+	PaymentID  string    `json:"paymentId,omitempty"`
+	Renewals   int       `json:"renewals"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// SessionRenewal renews auto-renewing sessions by charging their customer's
+// saved payment method
+type SessionRenewal struct {
+	// Rail charges renewals off-session, e.g. a StripeRail
+	Rail PaymentRail
+
+	// Prefs holds each customer's Stripe customer and saved PaymentMethodID
+	Prefs PaymentPrefsStore
+
+	// Tier is what a renewal costs and buys: Duration from the renewal, and
+	// MaxRequests for request-based sessions
+	Tier SessionPricingTier
+
+	// MaxRenewals caps how many times a session renews (0 = no cap)
+	MaxRenewals int
+
+	// Ledger, if set, records every renewal charge, declined ones as failed
+	Ledger PaymentLedger
+
+	// OnRenewal, if set, is called when a session renews or its auto-renewal
+	// is turned off, e.g. to send the seller a webhook
+	OnRenewal func(SessionRenewalEvent)
+
+	// mu serializes renewals, so concurrent requests on a session that ran
+	// out charge it once
+	mu sync.Mutex
+
+	// now is stubbed in tests
+	now func() time.Time
+}
+
+func (s *SessionRenewal) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// renewable reports whether err means a session ran out and s might renew it
+func (s *SessionRenewal) renewable(err error) bool {
+	return s != nil && (errors.Is(err, ErrSessionExpired) || errors.Is(err, ErrSessionLimitReached))
+}
+
+// consume is consumeSessionAs, first renewing a session that has run out if
+// s can
+func (s *SessionRenewal) consume(ctx context.Context, store SessionStore, id, path, delegate, key string) (*Session, error) {
+	session, err := consumeSessionAs(store, id, path, delegate, key)
+	if !s.renewable(err) {
+		return session, err
+	}
+	if renewed, _ := s.Renew(ctx, store, id); renewed {
+		return consumeSessionAs(store, id, path, delegate, key)
+	}
+	return session, err
+}
+
+// due reports whether an auto-renewing session has run out at now
+func (session *Session) due(now time.Time) bool {
+	if !session.Active || !session.AutoRenew {
+		return false
+	}
+	if !now.Before(session.ExpiresAt) {
+		return true
+	}
+	return session.SessionType == SessionTypeRequests && session.UsedRequests >= session.MaxRequests
+}
+
+// customer is the PaymentPrefsStore customer a session's renewals charge
+func (session *Session) customer() string {
+	if session.CustomerID != "" {
+		return session.CustomerID
+	}
+	return session.PayerAddress
+}
+
+// Renew renews session id if it auto-renews and has run out, and reports
+// whether it did. A declined charge or the MaxRenewals cap turns the
+// session's auto-renewal off; an unreachable rail leaves it on, to try again.
+func (s *SessionRenewal) Renew(ctx context.Context, store SessionStore, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, err := store.GetSession(id)
+	if err != nil {
+		return false, err
+	}
+	if !session.AutoRenew {
+		return false, errNotRenewable
+	}
+	now := s.clock()
+	if !session.due(now) {
+		return false, nil // Renewed by a request that got here first
+	}
+
+	currency := s.Tier.Currency
+	if currency == "" {
+		currency = session.Currency
+	}
+	event := SessionRenewalEvent{
+		SessionID:  session.ID,
+		CustomerID: session.customer(),
+		Amount:     s.Tier.Price,
+		Currency:   currency,
+		Renewals:   session.Renewals,
+		Time:       now,
+	}
+
+	if s.MaxRenewals > 0 && session.Renewals >= s.MaxRenewals {
+		event.Amount, event.Currency = 0, ""
+		return false, s.stop(store, session, event, RenewalCapped, ErrRenewalLimitReached)
+	}
+
+	intent, err := s.charge(ctx, session, currency)
+	if errors.Is(err, ErrInvalidPayment) {
+		s.record(session, event, "", PaymentStatusFailed, err)
+		return false, s.stop(store, session, event, RenewalDeclined, fmt.Errorf("%w: %v", ErrRenewalDeclined, err))
+	}
+	if err != nil {
+		return false, fmt.Errorf("renew session %s: %w", id, err)
+	}
+
+	session.ExpiresAt = now.Add(s.Tier.Duration)
+	if s.Tier.MaxRequests > 0 {
+		session.MaxRequests = s.Tier.MaxRequests
+	}
+	session.UsedRequests = 0
+	session.AmountPaid += s.Tier.Price
+	session.Renewals++
+	if err := store.UpdateSession(session); err != nil {
+		return false, fmt.Errorf("save renewed session %s (payment %s): %w", id, intent.ID, err)
+	}
+
+	event.Kind, event.PaymentID, event.Renewals = RenewalSucceeded, intent.ID, session.Renewals
+	s.record(session, event, intent.ID, PaymentStatusVerified, nil)
+	s.notify(event)
+	return true, nil
+}
+
+// charge takes the renewal price from the session customer's saved payment
+// method. Stripe dedupes retries of the same renewal by idempotency key.
+func (s *SessionRenewal) charge(ctx context.Context, session *Session, currency string) (*PaymentIntent, error) {
+	var prefs *CustomerPaymentPrefs
+	if s.Prefs != nil {
+		var err error
+		if prefs, err = s.Prefs.Get(ctx, session.customer()); err != nil {
+			return nil, err
+		}
+	}
+	if prefs == nil || prefs.PaymentMethodID == "" {
+		return nil, kindOf(ErrInvalidPayment, "no saved payment method")
+	}
+
+	intent, err := s.Rail.CreatePaymentIntent(ctx, &PaymentIntentRequest{
+		Amount:          s.Tier.Price,
+		Currency:        currency,
+		Resource:        "session:" + session.ID,
+		Description:     "Session renewal",
+		CustomerID:      prefs.StripeCustomerID,
+		PaymentMethodID: prefs.PaymentMethodID,
+		OffSession:      true,
+		IdempotencyKey:  fmt.Sprintf("renew_%s_%d", session.ID, session.Renewals+1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if intent.Status != "succeeded" {
+		// e.g. requires_action: the card wants the customer present
+		return nil, kindOf(ErrInvalidPayment, "renewal payment "+intent.Status)
+	}
+	return intent, nil
+}
+
+// stop turns a session's auto-renewal off and reports why
+func (s *SessionRenewal) stop(store SessionStore, session *Session, event SessionRenewalEvent, kind string, reason error) error {
+	session.AutoRenew = false
+	if err := store.UpdateSession(session); err != nil {
+		return err
+	}
+	event.Kind, event.Error = kind, reason.Error()
+	s.notify(event)
+	return reason
+}
+
+// record adds a renewal charge to the ledger
+func (s *SessionRenewal) record(session *Session, event SessionRenewalEvent, paymentID, status string, err error) {
+	if s.Ledger == nil {
+		return
+	}
+	metadata := map[string]string{
+		"sessionId": session.ID,
+		"renewal":   strconv.Itoa(session.Renewals + 1),
+	}
+	if err != nil {
+		metadata["error"] = err.Error()
+	}
+	rail := ""
+	if s.Rail != nil {
+		rail = s.Rail.ID()
+	}
+	_, _ = s.Ledger.Record(PaymentRecord{
+		Timestamp:     event.Time,
+		Endpoint:      "session:" + session.ID,
+		Method:        "RENEW",
+		PayerID:       event.CustomerID,
+		Amount:        event.Amount,
+		Currency:      event.Currency,
+		Rail:          rail,
+		TransactionID: paymentID,
+		Status:        status,
+		Metadata:      metadata,
+	})
+}
+
+func (s *SessionRenewal) notify(event SessionRenewalEvent) {
+	if s.OnRenewal != nil {
+		s.OnRenewal(event)
+	}
+}
+
+// RenewDue renews every auto-renewing session in store that has run out,
+// for a worker to run periodically so idle sessions renew too. It returns
+// how many renewed, stopping early only if the rail can't be reached.
+func (s *SessionRenewal) RenewDue(ctx context.Context, store SessionStore) (int, error) {
+	renewed := 0
+	token := ""
+	for {
+		page, next, err := store.ListSessions(ListFilter{}, token, 100)
+		if err != nil {
+			return renewed, err
+		}
+		for _, session := range page {
+			if !session.due(s.clock()) {
+				continue
+			}
+			ok, err := s.Renew(ctx, store, session.ID)
+			if errors.Is(err, ErrRailUnavailable) {
+				return renewed, err
+			}
+			if ok {
+				renewed++
+			}
+		}
+		if next == "" {
+			return renewed, nil
+		}
+		token = next
+	}
+}
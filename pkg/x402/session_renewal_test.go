@@ -0,0 +1,169 @@
+package x402
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStripe answers PaymentIntent creation, declining when decline is set,
+// and records the forms it was sent
+type fakeStripe struct {
+	mu      sync.Mutex
+	decline bool
+	forms   []url.Values
+}
+
+func (f *fakeStripe) rail(t *testing.T) *StripeRail {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.forms = append(f.forms, r.PostForm)
+		if f.decline {
+			w.WriteHeader(http.StatusPaymentRequired)
+			fmt.Fprint(w, `{"error":{"type":"card_error","code":"card_declined","message":"Your card was declined."}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"id":"pi_renew_%d","amount":%s,"currency":"usd","status":"succeeded"}`, len(f.forms), r.PostForm.Get("amount"))
+	}))
+	t.Cleanup(server.Close)
+	stripe := NewStripeRail("sk_test", "")
+	stripe.BaseURL = server.URL
+	return stripe
+}
+
+func newRenewingSession(t *testing.T, stripe *StripeRail) (*InMemorySessionStore, *Session, *SessionRenewal, *[]SessionRenewalEvent) {
+	prefs := NewInMemoryPaymentPrefsStore()
+	prefs.Set(context.Background(), &CustomerPaymentPrefs{CustomerID: "cust_1", StripeCustomerID: "cus_123", PaymentMethodID: "pm_card"})
+
+	store := NewInMemorySessionStore()
+	session := &Session{
+		PayerAddress: "wallet_a",
+		CustomerID:   "cust_1",
+		SessionType:  SessionTypeRequests,
+		MaxRequests:  2,
+		UsedRequests: 2,
+		ExpiresAt:    time.Now().Add(time.Hour),
+		Currency:     "USD",
+		AutoRenew:    true,
+	}
+	store.CreateSession(session)
+
+	var events []SessionRenewalEvent
+	renewal := &SessionRenewal{
+		Rail:      stripe,
+		Prefs:     prefs,
+		Tier:      SessionPricingTier{Duration: time.Hour, MaxRequests: 5, Price: 500},
+		Ledger:    NewInMemoryPaymentLedger(0),
+		OnRenewal: func(e SessionRenewalEvent) { events = append(events, e) },
+	}
+	return store, session, renewal, &events
+}
+
+func sessionRequest(handler http.Handler, id string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/test", nil)
+	req.Header.Set("X-Session-ID", id)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestSessionRenewal_RenewsOnNextRequest(t *testing.T) {
+	fake := &fakeStripe{}
+	store, session, renewal, events := newRenewingSession(t, fake.rail(t))
+	handler := SessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), SessionConfig{Store: store, Renewal: renewal})
+
+	if w := sessionRequest(handler, session.ID); w.Code != http.StatusOK {
+		t.Fatalf("Expected the used-up session to renew and serve, got %d: %s", w.Code, w.Body)
+	}
+
+	if len(fake.forms) != 1 {
+		t.Fatalf("Expected one charge, got %d", len(fake.forms))
+	}
+	form := fake.forms[0]
+	if form.Get("customer") != "cus_123" || form.Get("payment_method") != "pm_card" || form.Get("off_session") != "true" || form.Get("amount") != "500" {
+		t.Errorf("Expected an off-session charge of 500 to the saved card, got %v", form)
+	}
+
+	renewed, _ := store.GetSession(session.ID)
+	if renewed.Renewals != 1 || renewed.UsedRequests != 1 || renewed.MaxRequests != 5 || renewed.AmountPaid != 500 {
+		t.Errorf("Expected a fresh 5-request period with this request counted, got %+v", renewed)
+	}
+	if len(*events) != 1 || (*events)[0].Kind != RenewalSucceeded || (*events)[0].PaymentID != "pi_renew_1" {
+		t.Errorf("Expected a renewed event, got %+v", *events)
+	}
+	records, _ := renewal.Ledger.List(LedgerFilter{})
+	if len(records) != 1 || records[0].TransactionID != "pi_renew_1" || records[0].Status != PaymentStatusVerified || records[0].Metadata["sessionId"] != session.ID {
+		t.Errorf("Expected the renewal in the ledger, got %+v", records)
+	}
+}
+
+func TestSessionRenewal_DeclineTurnsAutoRenewOff(t *testing.T) {
+	fake := &fakeStripe{decline: true}
+	store, session, renewal, events := newRenewingSession(t, fake.rail(t))
+	handler := SessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), SessionConfig{Store: store, Renewal: renewal})
+
+	if w := sessionRequest(handler, session.ID); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the session refused after a decline, got %d", w.Code)
+	}
+	stored, _ := store.GetSession(session.ID)
+	if stored.AutoRenew || stored.Renewals != 0 {
+		t.Errorf("Expected auto-renewal off and no renewal, got %+v", stored)
+	}
+	if len(*events) != 1 || (*events)[0].Kind != RenewalDeclined {
+		t.Errorf("Expected a declined event, got %+v", *events)
+	}
+	records, _ := renewal.Ledger.List(LedgerFilter{})
+	if len(records) != 1 || records[0].Status != PaymentStatusFailed {
+		t.Errorf("Expected the declined charge in the ledger, got %+v", records)
+	}
+
+	// No more charges are attempted
+	sessionRequest(handler, session.ID)
+	if len(fake.forms) != 1 {
+		t.Errorf("Expected no retry after a decline, got %d charges", len(fake.forms))
+	}
+}
+
+func TestSessionRenewal_RespectsMaxRenewals(t *testing.T) {
+	fake := &fakeStripe{}
+	store, session, renewal, events := newRenewingSession(t, fake.rail(t))
+	renewal.MaxRenewals = 1
+	now := time.Now()
+	renewal.now = func() time.Time { return now }
+
+	if n, err := renewal.RenewDue(context.Background(), store); n != 1 || err != nil {
+		t.Fatalf("Expected the worker to renew the session, got %d (%v)", n, err)
+	}
+
+	// Use up the renewed period
+	stored, _ := store.GetSession(session.ID)
+	stored.UsedRequests = stored.MaxRequests
+	store.UpdateSession(stored)
+
+	renewed, err := renewal.Renew(context.Background(), store, session.ID)
+	if renewed || !errors.Is(err, ErrRenewalLimitReached) {
+		t.Fatalf("Expected the cap to stop a second renewal, got %v (%v)", renewed, err)
+	}
+	stored, _ = store.GetSession(session.ID)
+	if stored.AutoRenew || stored.Renewals != 1 {
+		t.Errorf("Expected auto-renewal off after one renewal, got %+v", stored)
+	}
+	if len(fake.forms) != 1 {
+		t.Errorf("Expected one charge, got %d", len(fake.forms))
+	}
+	if len(*events) != 2 || (*events)[1].Kind != RenewalCapped {
+		t.Errorf("Expected renewed then capped events, got %+v", *events)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -40,6 +42,49 @@ func TestSessionStore_CreateAndRetrieve(t *testing.T) {
 	}
 }
 
+func TestSessionStore_ConcurrentGetAndConsume(t *testing.T) {
+	store := NewInMemorySessionStore()
+	session := &Session{
+		PayerAddress: "0xrace",
+		ExpiresAt:    time.Now().Add(time.Hour),
+		SessionType:  SessionTypeRequests,
+		MaxRequests:  50,
+		Metadata:     map[string]string{"plan": "burst"},
+	}
+	store.CreateSession(session)
+
+	var wg sync.WaitGroup
+	var consumed int64
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := store.ConsumeSession(session.ID, "/api/data"); err == nil {
+				atomic.AddInt64(&consumed, 1)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			got, err := store.GetSession(session.ID)
+			if err != nil {
+				t.Errorf("Failed to get session: %v", err)
+				return
+			}
+			json.Marshal(got)
+			got.Metadata["plan"] = "changed"
+		}()
+	}
+	wg.Wait()
+
+	final, _ := store.GetSession(session.ID)
+	if consumed != 50 || final.UsedRequests != 50 {
+		t.Errorf("Expected 50 consumed requests, got %d (stored %d)", consumed, final.UsedRequests)
+	}
+	if final.Metadata["plan"] != "burst" {
+		t.Errorf("Expected stored metadata to be unchanged, got %q", final.Metadata["plan"])
+	}
+}
+
 func TestSessionStore_ListByPayer(t *testing.T) {
 	store := NewInMemorySessionStore()
 
@@ -283,3 +328,133 @@ func TestMatchesPattern(t *testing.T) {
 		}
 	}
 }
+
+func TestConsumeSession_Concurrent(t *testing.T) {
+	store := NewInMemorySessionStore()
+	session := &Session{ExpiresAt: time.Now().Add(time.Hour), SessionType: SessionTypeRequests, MaxRequests: 5}
+	store.CreateSession(session)
+
+	var wg sync.WaitGroup
+	var allowed int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := consumeSession(store, session.ID, "/api"); err == nil {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 5 {
+		t.Errorf("Expected exactly 5 requests allowed, got %d", allowed)
+	}
+}
+
+func newSessionUnifiedHandler(store SessionStore, rail *recordingRail, afterPayment time.Duration) http.Handler {
+	registry := NewRailRegistry()
+	registry.Register(rail)
+	return UnifiedPaymentMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), UnifiedPaymentConfig{
+		PricePerRequest:     10000,
+		CryptoEnabled:       true,
+		CryptoNetworks:      []NetworkType{NetworkBaseSepolia},
+		RailRegistry:        registry,
+		EnableSessions:      true,
+		SessionStore:        store,
+		SessionAfterPayment: afterPayment,
+		SessionMaxRequests:  2,
+		SessionEndpoint:     "/sessions",
+		SessionTiers:        []SessionPricingTier{{Name: "hour", Duration: time.Hour, Price: 500000, SessionType: SessionTypeTime}},
+	})
+}
+
+func TestUnifiedSession_ValidSessionBypassesRails(t *testing.T) {
+	store := NewInMemorySessionStore()
+	session := &Session{ExpiresAt: time.Now().Add(time.Hour), SessionType: SessionTypeTime}
+	store.CreateSession(session)
+
+	rail := &recordingRail{EVMCryptoRail: NewEVMCryptoRail("", nil)}
+	handler := newSessionUnifiedHandler(store, rail, 0)
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-Session-Token", EncodeSessionToken(session))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+	if rr.Header().Get("X-Payment-Method") != "session" {
+		t.Errorf("Expected session payment method, got %q", rr.Header().Get("X-Payment-Method"))
+	}
+	if rail.expected != 0 {
+		t.Error("Expected no rail verification for a session request")
+	}
+}
+
+func TestUnifiedSession_ExhaustedSessionReturns402(t *testing.T) {
+	store := NewInMemorySessionStore()
+	session := &Session{ExpiresAt: time.Now().Add(time.Hour), SessionType: SessionTypeRequests, MaxRequests: 1, UsedRequests: 1}
+	store.CreateSession(session)
+
+	handler := newSessionUnifiedHandler(store, &recordingRail{EVMCryptoRail: NewEVMCryptoRail("", nil)}, 0)
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-Session-ID", session.ID)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected status 402, got %d", rr.Code)
+	}
+
+	var response PaymentOptionsResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !strings.Contains(response.Error, "request limit exceeded") {
+		t.Errorf("Expected error to explain the exhausted session, got %q", response.Error)
+	}
+	if response.Session == nil || response.Session.SessionEndpoint != "/sessions" || len(response.Session.Tiers) != 1 {
+		t.Fatalf("Expected session info in response, got %+v", response.Session)
+	}
+	if len(response.Accepts) != 1 || response.Accepts[0].Extra["subscription"] == nil {
+		t.Errorf("Expected subscription info in accepts, got %+v", response.Accepts)
+	}
+}
+
+func TestUnifiedSession_MintedAfterPayment(t *testing.T) {
+	store := NewInMemorySessionStore()
+	rail := &recordingRail{EVMCryptoRail: NewEVMCryptoRail("", nil)}
+	handler := newSessionUnifiedHandler(store, rail, 10*time.Minute)
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-PAYMENT", "payload")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	sessionID := rr.Header().Get("X-Session-ID")
+	if rr.Code != http.StatusOK || sessionID == "" {
+		t.Fatalf("Expected paid request to mint a session, got %d %q", rr.Code, sessionID)
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != sessionID || !cookies[0].HttpOnly {
+		t.Fatalf("Expected HttpOnly session cookie, got %+v", cookies)
+	}
+
+	// The cookie alone covers the next two requests, then payment is required
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/assets/app.js", nil)
+		req.AddCookie(cookies[0])
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		codes = append(codes, rr.Code)
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK || codes[2] != http.StatusPaymentRequired {
+		t.Errorf("Expected 200, 200, 402, got %v", codes)
+	}
+}
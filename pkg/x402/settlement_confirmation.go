@@ -0,0 +1,307 @@
+// Package x402 - Settlement Confirmation
+// A facilitator's /settle may answer once the transaction is broadcast, not
+// mined. With a ConfirmationPolicy, EVMCryptoRail polls the network's RPC
+// endpoint for the receipt so a transaction that later reverts is caught:
+// either before content is served, or in the background with the ledger
+// entry marked reverted and OnReverted called.
+package x402
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrConfirmationTimeout is returned when a settled transaction is not
+// confirmed within ConfirmationPolicy.MaxWait
+var ErrConfirmationTimeout = errors.New("transaction not confirmed in time")
+
+// ConfirmationPolicy controls how EVMCryptoRail waits for settlements to be
+// mined. Receipts are read from the rail's RPCEndpoints for the settled
+// network.
+type ConfirmationPolicy struct {
+	Confirmations int           // Blocks required, including the inclusion block (default 1)
+	PollInterval  time.Duration // Between receipt checks (default 2s)
+	MaxWait       time.Duration // Before giving up (default 60s)
+
+	// Async returns from CapturePayment right after broadcast and confirms in
+	// the background. Content is then served before confirmation; reverts are
+	// reported through Ledger and OnReverted.
+	Async bool
+
+	// Ledger, if set, gets an entry per settlement whose status moves to
+	// confirmed or reverted. Updates need a ledger implementing
+	// PaymentStatusUpdater.
+	Ledger PaymentLedger
+
+	// OnReverted is called when a settled transaction reverts
+	OnReverted func(ctx context.Context, failure *PaymentFailure)
+}
+
+func (p *ConfirmationPolicy) confirmations() int {
+	if p.Confirmations <= 0 {
+		return 1
+	}
+	return p.Confirmations
+}
+
+func (p *ConfirmationPolicy) pollInterval() time.Duration {
+	if p.PollInterval <= 0 {
+		return 2 * time.Second
+	}
+	return p.PollInterval
+}
+
+func (p *ConfirmationPolicy) maxWait() time.Duration {
+	if p.MaxWait <= 0 {
+		return 60 * time.Second
+	}
+	return p.MaxWait
+}
+
+// settlement is a broadcast transaction awaiting confirmation
+type settlement struct {
+	TransactionID string
+	Network       string
+	Payer         string
+	Amount        int64
+}
+
+// confirmSettlement applies the rail's ConfirmationPolicy to a broadcast
+// settlement. In sync mode capture is updated with the outcome; in async
+// mode confirmation continues in the background.
+func (e *EVMCryptoRail) confirmSettlement(ctx context.Context, s settlement, capture *PaymentCapture) {
+	policy := e.Confirmation
+	ledgerID := recordSettlement(policy.Ledger, s)
+	capture.LedgerID = ledgerID
+
+	if policy.Async {
+		// The request context ends with the response; confirmation outlives it
+		go e.finishConfirmation(context.Background(), s, ledgerID)
+		return
+	}
+
+	result, err := e.finishConfirmation(ctx, s, ledgerID)
+	capture.Settlement = result
+	if err != nil {
+		capture.Success = false
+		capture.Reason = FailureCaptureFailed
+		capture.Message = err.Error()
+	} else if !result.Success {
+		capture.Success = false
+		capture.Reason = FailureReverted
+		capture.Message = result.Message
+	}
+}
+
+// finishConfirmation waits for s, then updates the ledger and reports reverts
+func (e *EVMCryptoRail) finishConfirmation(ctx context.Context, s settlement, ledgerID string) (*SettlementResult, error) {
+	policy := e.Confirmation
+	result, err := e.awaitConfirmation(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	status := PaymentStatusConfirmed
+	if !result.Success {
+		status = PaymentStatusReverted
+		if policy.OnReverted != nil {
+			policy.OnReverted(ctx, &PaymentFailure{
+				Rail:            e.ID(),
+				Stage:           StageConfirm,
+				Reason:          FailureReverted,
+				Message:         s.TransactionID,
+				PresentedAmount: s.Amount,
+				ExpectedAmount:  s.Amount,
+				Payer:           s.Payer,
+			})
+		}
+	}
+	if updater, ok := policy.Ledger.(PaymentStatusUpdater); ok && ledgerID != "" {
+		_ = updater.UpdateStatus(ledgerID, status)
+	}
+	return result, nil
+}
+
+// awaitConfirmation polls for s's receipt until it has enough confirmations,
+// reverts, or MaxWait passes
+func (e *EVMCryptoRail) awaitConfirmation(ctx context.Context, s settlement) (*SettlementResult, error) {
+	policy := e.Confirmation
+	rpcURL := e.rpcEndpoint(s.Network)
+	if rpcURL == "" {
+		return nil, fmt.Errorf("no RPC endpoint configured for network %q", s.Network)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, policy.maxWait())
+	defer cancel()
+
+	for {
+		receipt, err := e.transactionReceipt(ctx, rpcURL, s.TransactionID)
+		if err == nil && receipt != nil {
+			if !receipt.succeeded() {
+				return &SettlementResult{
+					Success:       false,
+					Message:       "transaction reverted",
+					TransactionID: s.TransactionID,
+					BlockNumber:   receipt.blockNumber,
+				}, nil
+			}
+			head, err := e.blockNumber(ctx, rpcURL)
+			if err == nil && head >= receipt.blockNumber {
+				confirmations := int(head - receipt.blockNumber + 1)
+				if confirmations >= policy.confirmations() {
+					return &SettlementResult{
+						Success:       true,
+						TransactionID: s.TransactionID,
+						SettledAmount: strconv.FormatInt(s.Amount, 10),
+						SettledAt:     time.Now().Unix(),
+						BlockNumber:   receipt.blockNumber,
+						Confirmations: confirmations,
+					}, nil
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ErrConfirmationTimeout
+		case <-time.After(policy.pollInterval()):
+		}
+	}
+}
+
+// evmNetworkNames maps facilitator network names to CAIP-2 networks
+var evmNetworkNames = map[string]NetworkType{
+	"ethereum":     NetworkEthereumMainnet,
+	"base":         NetworkBaseMainnet,
+	"base-sepolia": NetworkBaseSepolia,
+	"optimism":     NetworkOptimism,
+	"arbitrum":     NetworkArbitrum,
+	"polygon":      NetworkPolygon,
+}
+
+// canonicalEVMNetwork returns the CAIP-2 form of a network name
+func canonicalEVMNetwork(network string) NetworkType {
+	if caip, ok := evmNetworkNames[network]; ok {
+		return caip
+	}
+	return NetworkType(network)
+}
+
+// rpcEndpoint returns the RPC endpoint for network, which may be named
+// either way in RPCEndpoints or by the facilitator
+func (e *EVMCryptoRail) rpcEndpoint(network string) string {
+	want := canonicalEVMNetwork(network)
+	for configured, url := range e.RPCEndpoints {
+		if canonicalEVMNetwork(string(configured)) == want {
+			return url
+		}
+	}
+	return ""
+}
+
+// txReceipt is the part of an eth_getTransactionReceipt result we use
+type txReceipt struct {
+	Status      string `json:"status"`
+	BlockNumber string `json:"blockNumber"`
+
+	blockNumber uint64
+}
+
+func (r *txReceipt) succeeded() bool {
+	return r.Status == "0x1"
+}
+
+// transactionReceipt returns the receipt for hash, or nil while it is pending
+func (e *EVMCryptoRail) transactionReceipt(ctx context.Context, rpcURL, hash string) (*txReceipt, error) {
+	var receipt *txReceipt
+	if err := e.rpcCall(ctx, rpcURL, "eth_getTransactionReceipt", []interface{}{hash}, &receipt); err != nil {
+		return nil, err
+	}
+	if receipt == nil || receipt.BlockNumber == "" {
+		return nil, nil
+	}
+	block, err := parseHexUint(receipt.BlockNumber)
+	if err != nil {
+		return nil, err
+	}
+	receipt.blockNumber = block
+	return receipt, nil
+}
+
+// blockNumber returns the latest block number
+func (e *EVMCryptoRail) blockNumber(ctx context.Context, rpcURL string) (uint64, error) {
+	var head string
+	if err := e.rpcCall(ctx, rpcURL, "eth_blockNumber", []interface{}{}, &head); err != nil {
+		return 0, err
+	}
+	return parseHexUint(head)
+}
+
+// rpcCall makes a JSON-RPC call and decodes its result into out
+func (e *EVMCryptoRail) rpcCall(ctx context.Context, rpcURL, method string, params []interface{}, out interface{}) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  method,
+		"params":  params,
+	})
+	req, err := http.NewRequestWithContext(ctx, "POST", rpcURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("RPC error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	var rpcResp struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(data, &rpcResp); err != nil {
+		return fmt.Errorf("failed to parse RPC response: %w", err)
+	}
+	if rpcResp.Error != nil {
+		return fmt.Errorf("RPC %s failed: %s", method, rpcResp.Error.Message)
+	}
+	return json.Unmarshal(rpcResp.Result, out)
+}
+
+// parseHexUint parses a 0x-prefixed hex quantity
+func parseHexUint(s string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+}
+
+// recordSettlement adds a settled entry for s to ledger, returning its ID
+func recordSettlement(ledger PaymentLedger, s settlement) string {
+	if ledger == nil {
+		return ""
+	}
+	record, err := ledger.Record(PaymentRecord{
+		Rail:          RailEVMCrypto,
+		PayerID:       s.Payer,
+		Amount:        s.Amount,
+		Scheme:        string(SchemeExact),
+		Network:       s.Network,
+		TransactionID: s.TransactionID,
+		Status:        PaymentStatusSettled,
+	})
+	if err != nil {
+		return ""
+	}
+	return record.ID
+}
@@ -0,0 +1,125 @@
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeChain serves a facilitator /settle that only broadcasts, and an RPC
+// endpoint whose receipt appears after pending polls
+type fakeChain struct {
+	mu      sync.Mutex
+	pending int    // receipt polls answered with null
+	status  string // receipt status once mined
+	head    uint64 // advances by one per eth_blockNumber
+}
+
+func (c *fakeChain) rail(t *testing.T, policy *ConfirmationPolicy) *EVMCryptoRail {
+	t.Helper()
+	facilitator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"success": true, "transaction": "0xtx", "network": "base-sepolia", "payer": "0xpayer"}`)
+	}))
+	rpc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var call struct {
+			Method string `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&call)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		switch call.Method {
+		case "eth_getTransactionReceipt":
+			if c.pending > 0 {
+				c.pending--
+				fmt.Fprint(w, `{"jsonrpc": "2.0", "id": 1, "result": null}`)
+				return
+			}
+			fmt.Fprintf(w, `{"jsonrpc": "2.0", "id": 1, "result": {"status": %q, "blockNumber": "0x10"}}`, c.status)
+		case "eth_blockNumber":
+			c.head++
+			fmt.Fprintf(w, `{"jsonrpc": "2.0", "id": 1, "result": "0x%x"}`, c.head)
+		}
+	}))
+	t.Cleanup(facilitator.Close)
+	t.Cleanup(rpc.Close)
+
+	rail := NewEVMCryptoRail(facilitator.URL, []NetworkType{NetworkBaseSepolia})
+	rail.RPCEndpoints[NetworkBaseSepolia] = rpc.URL
+	rail.Confirmation = policy
+	return rail
+}
+
+func TestCaptureWaitsForConfirmations(t *testing.T) {
+	ledger := NewInMemoryPaymentLedger(0)
+	chain := &fakeChain{pending: 2, status: "0x1", head: 0x0f}
+	rail := chain.rail(t, &ConfirmationPolicy{Confirmations: 3, PollInterval: time.Millisecond, MaxWait: time.Second, Ledger: ledger})
+
+	capture, err := rail.CapturePayment(context.Background(), &CapturePaymentRequest{PaymentID: "p1", Amount: 100})
+	if err != nil {
+		t.Fatalf("CapturePayment failed: %v", err)
+	}
+	if !capture.Success || capture.Settlement == nil {
+		t.Fatalf("Expected confirmed capture, got %+v", capture)
+	}
+	if capture.Settlement.BlockNumber != 0x10 || capture.Settlement.Confirmations != 3 {
+		t.Errorf("Expected block 16 with 3 confirmations, got %d with %d",
+			capture.Settlement.BlockNumber, capture.Settlement.Confirmations)
+	}
+
+	records, _ := ledger.List(LedgerFilter{})
+	if len(records) != 1 || records[0].Status != PaymentStatusConfirmed || records[0].TransactionID != "0xtx" {
+		t.Errorf("Expected one confirmed ledger entry, got %+v", records)
+	}
+}
+
+func TestCaptureRefusesRevertedSettlement(t *testing.T) {
+	chain := &fakeChain{status: "0x0"}
+	rail := chain.rail(t, &ConfirmationPolicy{PollInterval: time.Millisecond, MaxWait: time.Second})
+
+	capture, err := rail.CapturePayment(context.Background(), &CapturePaymentRequest{PaymentID: "p1", Amount: 100})
+	if err != nil {
+		t.Fatalf("CapturePayment failed: %v", err)
+	}
+	if capture.Success || capture.Reason != FailureReverted {
+		t.Errorf("Expected reverted capture to fail, got %+v", capture)
+	}
+}
+
+func TestAsyncConfirmationReportsRevert(t *testing.T) {
+	ledger := NewInMemoryPaymentLedger(0)
+	reverted := make(chan *PaymentFailure, 1)
+	chain := &fakeChain{pending: 1, status: "0x0"}
+	rail := chain.rail(t, &ConfirmationPolicy{
+		Async:        true,
+		PollInterval: time.Millisecond,
+		MaxWait:      time.Second,
+		Ledger:       ledger,
+		OnReverted:   func(ctx context.Context, failure *PaymentFailure) { reverted <- failure },
+	})
+
+	// Broadcast succeeds, so the capture does too
+	capture, err := rail.CapturePayment(context.Background(), &CapturePaymentRequest{PaymentID: "p1", Amount: 100})
+	if err != nil || !capture.Success {
+		t.Fatalf("Expected capture to succeed at broadcast, got %+v, %v", capture, err)
+	}
+
+	select {
+	case failure := <-reverted:
+		if failure.Stage != StageConfirm || failure.Reason != FailureReverted || failure.Payer != "0xpayer" {
+			t.Errorf("Expected revert failure for 0xpayer, got %+v", failure)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected OnReverted to be called")
+	}
+
+	records, _ := ledger.List(LedgerFilter{})
+	if len(records) != 1 || records[0].Status != PaymentStatusReverted {
+		t.Errorf("Expected the ledger entry to be marked reverted, got %+v", records)
+	}
+}
@@ -0,0 +1,244 @@
+// Package x402 - Spending Alerts
+// A pre-authorized budget lets an agent spend without a human in the loop, so
+// a runaway agent can drain it in minutes. SpendingAlerts watches each
+// budget's deductions against hourly, daily and rate-of-change thresholds,
+// notifies operators (callback or webhook) and can suspend the budget until
+// an admin resumes it through the admin API.
+package x402
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Spending alert kinds
+const (
+	AlertHourly = "hourly" // Spend in the last hour exceeded MaxPerHour
+	AlertDaily  = "daily"  // Spend in the last 24 hours exceeded MaxPerDay
+	AlertRate   = "rate"   // The last hour's spend grew RateMultiplier-fold
+)
+
+// SpendAlert reports a budget whose spend crossed a threshold, or a budget or
+// session running low (see AlertLowBalance)
+type SpendAlert struct {
+	Kind      string        `json:"kind"`
+	BudgetID  string        `json:"budgetId,omitempty"`
+	SessionID string        `json:"sessionId,omitempty"`
+	AgentID   string        `json:"agentId,omitempty"`
+	Spent     int64         `json:"spent"`     // Spend in the window (requests used, for sessions)
+	Threshold int64         `json:"threshold"` // The limit that was crossed
+	Remaining int64         `json:"remaining,omitempty"`
+	Window    time.Duration `json:"window"`
+	Currency  string        `json:"currency,omitempty"`
+	Suspended bool          `json:"suspended"` // The budget is now suspended
+	Time      time.Time     `json:"time"`
+}
+
+// SpendingAlerts watches pre-authorized budget spend. Each kind of alert
+// fires at most once per window for a budget.
+type SpendingAlerts struct {
+	// MaxPerHour and MaxPerDay alert when a budget spends more than this in
+	// a sliding hour or day (0 = off)
+	MaxPerHour int64
+	MaxPerDay  int64
+
+	// RateMultiplier alerts when the last hour's spend exceeds this multiple
+	// of the hour before, once it is at least RateMinimum (0 = off)
+	RateMultiplier float64
+	RateMinimum    int64
+
+	// OnAlert is called for each alert
+	OnAlert func(SpendAlert)
+
+	// Callbacks, if set, runs OnAlert, e.g. asynchronously. Its panics are
+	// recovered and logged either way.
+	Callbacks *CallbackRunner
+
+	// WebhookURL, if set, receives each alert as a JSON POST
+	WebhookURL string
+
+	// AutoSuspend suspends the budget when an alert fires; deductions are
+	// refused with BUDGET_SUSPENDED until an admin resumes it
+	AutoSuspend bool
+
+	// Audit, if set, records suspensions
+	Audit *AuditLog
+
+	mu        sync.Mutex
+	budgets   map[string]*budgetSpend
+	lastSweep time.Time
+
+	// now is stubbed in tests
+	now func() time.Time
+}
+
+// budgetSpend is one budget's recent spend in minute and hour buckets
+type budgetSpend struct {
+	minutes   [120]spendBucket
+	hours     [24]spendBucket
+	lastSeen  time.Time
+	lastAlert map[string]time.Time
+}
+
+// spendBucket holds the spend for one minute or hour, identified by slot
+type spendBucket struct {
+	slot   int64
+	amount int64
+}
+
+// webhookClient posts spending alerts
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+func (a *SpendingAlerts) clock() time.Time {
+	if a.now != nil {
+		return a.now()
+	}
+	return time.Now()
+}
+
+// record adds a deduction from budget (as returned by the store) and raises
+// any alerts it triggers
+func (a *SpendingAlerts) record(r *http.Request, store PreAuthStore, budget *PreAuthBudget, amount int64) {
+	if a == nil || budget == nil {
+		return
+	}
+	now := a.clock()
+	alerts := a.evaluate(budget, amount, now)
+
+	for _, alert := range alerts {
+		if a.AutoSuspend && store != nil {
+			changed, err := store.Suspend(budget.ID, "spending alert: "+alert.Kind)
+			if err != nil {
+				log.Printf("x402: suspend budget %s: %v", budget.ID, err)
+			} else {
+				alert.Suspended = true
+			}
+			if changed {
+				a.Audit.Record(r, AuditEvent{
+					Decision:  AuditSuspended,
+					Reason:    "spending_alert_" + alert.Kind,
+					Payer:     budget.AgentID,
+					PaymentID: budget.ID,
+					Currency:  budget.Currency,
+				})
+			}
+		}
+		a.notify(alert)
+	}
+}
+
+// evaluate updates the budget's buckets and returns the alerts due
+func (a *SpendingAlerts) evaluate(budget *PreAuthBudget, amount int64, now time.Time) []SpendAlert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.budgets == nil {
+		a.budgets = make(map[string]*budgetSpend)
+	}
+	a.sweep(now)
+
+	spend, ok := a.budgets[budget.ID]
+	if !ok {
+		spend = &budgetSpend{lastAlert: make(map[string]time.Time)}
+		a.budgets[budget.ID] = spend
+	}
+	spend.lastSeen = now
+
+	minute, hour := now.Unix()/60, now.Unix()/3600
+	addToBucket(&spend.minutes[minute%int64(len(spend.minutes))], minute, amount)
+	addToBucket(&spend.hours[hour%int64(len(spend.hours))], hour, amount)
+
+	lastHour := sumBuckets(spend.minutes[:], minute-59, minute)
+	previousHour := sumBuckets(spend.minutes[:], minute-119, minute-60)
+	lastDay := sumBuckets(spend.hours[:], hour-23, hour)
+
+	var alerts []SpendAlert
+	fire := func(kind string, spent, threshold int64, window time.Duration) {
+		if last, ok := spend.lastAlert[kind]; ok && now.Sub(last) < window {
+			return
+		}
+		spend.lastAlert[kind] = now
+		alerts = append(alerts, SpendAlert{
+			Kind:      kind,
+			BudgetID:  budget.ID,
+			AgentID:   budget.AgentID,
+			Spent:     spent,
+			Threshold: threshold,
+			Window:    window,
+			Currency:  budget.Currency,
+			Time:      now,
+		})
+	}
+
+	if a.MaxPerHour > 0 && lastHour > a.MaxPerHour {
+		fire(AlertHourly, lastHour, a.MaxPerHour, time.Hour)
+	}
+	if a.MaxPerDay > 0 && lastDay > a.MaxPerDay {
+		fire(AlertDaily, lastDay, a.MaxPerDay, 24*time.Hour)
+	}
+	if a.RateMultiplier > 0 && lastHour >= a.RateMinimum && float64(lastHour) > a.RateMultiplier*float64(previousHour) {
+		fire(AlertRate, lastHour, int64(a.RateMultiplier*float64(previousHour)), time.Hour)
+	}
+	return alerts
+}
+
+// sweep forgets budgets idle for a day, at most once an hour
+func (a *SpendingAlerts) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < time.Hour {
+		return
+	}
+	a.lastSweep = now
+	for id, spend := range a.budgets {
+		if now.Sub(spend.lastSeen) > 24*time.Hour {
+			delete(a.budgets, id)
+		}
+	}
+}
+
+// notify delivers alert to OnAlert and, in the background, the webhook
+func (a *SpendingAlerts) notify(alert SpendAlert) {
+	if onAlert := a.OnAlert; onAlert != nil {
+		a.Callbacks.run("OnAlert", func() { onAlert(alert) })
+	}
+	if a.WebhookURL == "" {
+		return
+	}
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return
+	}
+	go func() {
+		resp, err := webhookClient.Post(a.WebhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("x402: spending alert webhook failed: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("x402: spending alert webhook returned %s", resp.Status)
+		}
+	}()
+}
+
+// addToBucket adds amount to bucket, resetting it if it holds an older slot
+func addToBucket(bucket *spendBucket, slot, amount int64) {
+	if bucket.slot != slot {
+		*bucket = spendBucket{slot: slot}
+	}
+	bucket.amount += amount
+}
+
+// sumBuckets totals the buckets whose slots fall in [from, to]
+func sumBuckets(buckets []spendBucket, from, to int64) int64 {
+	var total int64
+	for _, bucket := range buckets {
+		if bucket.slot >= from && bucket.slot <= to {
+			total += bucket.amount
+		}
+	}
+	return total
+}
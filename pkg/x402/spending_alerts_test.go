@@ -0,0 +1,137 @@
+package x402
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpendingAlerts_BurstSuspendsBudget(t *testing.T) {
+	store := NewInMemoryPreAuthStore()
+	store.Create(&PreAuthBudget{AgentID: "agent-1", TotalBudget: 10000, Currency: "USD"})
+	budget, _ := store.GetByAgentID("agent-1")
+
+	webhook := make(chan SpendAlert, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert SpendAlert
+		json.NewDecoder(r.Body).Decode(&alert)
+		webhook <- alert
+	}))
+	defer hook.Close()
+
+	var mu sync.Mutex
+	var alerts []SpendAlert
+	sink := NewInMemoryAuditSink()
+	audit := &AuditLog{Sink: sink}
+	handler := AIFirstMiddleware(createTestHandler(), AIFirstConfig{
+		PreAuthStore:  store,
+		EnablePreAuth: true,
+		DefaultCost:   100,
+		Currency:      "USD",
+		Audit:         audit,
+		Alerts: &SpendingAlerts{
+			MaxPerHour:  500,
+			AutoSuspend: true,
+			WebhookURL:  hook.URL,
+			Audit:       audit,
+			OnAlert: func(alert SpendAlert) {
+				mu.Lock()
+				defer mu.Unlock()
+				alerts = append(alerts, alert)
+			},
+		},
+	})
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-Agent-ID", "agent-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// The sixth request crosses 500 in the hour: it is served, then the
+	// budget is suspended
+	for i := 0; i < 6; i++ {
+		if w := send(); w.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected 200, got %d", i, w.Code)
+		}
+	}
+	w := send()
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected the suspended budget to be refused with 403, got %d", w.Code)
+	}
+	var resp AIResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Error == nil || resp.Error.Code != ErrCodeBudgetSuspended {
+		t.Errorf("Expected BUDGET_SUSPENDED, got %+v", resp.Error)
+	}
+
+	mu.Lock()
+	if len(alerts) != 1 || alerts[0].Kind != AlertHourly || alerts[0].Spent != 600 || !alerts[0].Suspended {
+		t.Errorf("Expected one hourly alert at 600 with suspension, got %+v", alerts)
+	}
+	mu.Unlock()
+	select {
+	case alert := <-webhook:
+		if alert.BudgetID != budget.ID || alert.Kind != AlertHourly {
+			t.Errorf("Unexpected webhook alert %+v", alert)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the alert to be posted to the webhook")
+	}
+	if got, _ := store.Get(budget.ID); !got.Suspended || got.Remaining != 9400 {
+		t.Errorf("Expected a suspended budget with 9400 left, got %+v", got)
+	}
+
+	// An admin resumes it
+	admin := AdminHandler(AdminDeps{APIKey: "admin_secret", Budgets: store, Audit: audit})
+	aw := httptest.NewRecorder()
+	admin.ServeHTTP(aw, adminRequest("POST", "/admin/budgets", `{"id": "`+budget.ID+`", "suspended": false}`))
+	if aw.Code != http.StatusOK {
+		t.Fatalf("Expected the resume to succeed, got %d: %s", aw.Code, aw.Body.String())
+	}
+	if w := send(); w.Code != http.StatusOK {
+		t.Errorf("Expected requests to succeed after resuming, got %d", w.Code)
+	}
+
+	if got := auditDecisions(sink.Events()); got != "verified,verified,verified,verified,verified,verified,suspended,rejected,resumed,verified" {
+		t.Errorf("Unexpected audit trail %s", got)
+	}
+}
+
+func TestSpendingAlerts_RateAndDaily(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var fired []string
+	alerts := &SpendingAlerts{
+		MaxPerDay:      2000,
+		RateMultiplier: 3,
+		RateMinimum:    300,
+		OnAlert:        func(alert SpendAlert) { fired = append(fired, alert.Kind) },
+		now:            func() time.Time { return now },
+	}
+	budget := &PreAuthBudget{ID: "budget_1"}
+
+	// A steady 100 an hour, then a burst of 400 within one hour
+	for i := 0; i < 3; i++ {
+		alerts.record(nil, nil, budget, 100)
+		now = now.Add(time.Hour)
+	}
+	for i := 0; i < 4; i++ {
+		alerts.record(nil, nil, budget, 100)
+	}
+	if len(fired) != 1 || fired[0] != AlertRate {
+		t.Fatalf("Expected one rate alert, got %v", fired)
+	}
+
+	// The burst continues past the daily limit; the rate alert does not repeat
+	for i := 0; i < 14; i++ {
+		now = now.Add(time.Minute)
+		alerts.record(nil, nil, budget, 100)
+	}
+	if len(fired) != 2 || fired[1] != AlertDaily {
+		t.Errorf("Expected a daily alert after the rate alert, got %v", fired)
+	}
+}
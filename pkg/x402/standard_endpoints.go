@@ -0,0 +1,190 @@
+// Package x402 - Standard Endpoints
+// Sessions, budgets, discovery, pricing, metrics, onboarding and the Stripe
+// webhook each need a route and an exemption from payment. Doing that by
+// hand is easy to get wrong (exempting "/" exempts everything, since
+// ExemptPaths match by prefix), so MountStandardEndpoints does both.
+package x402
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultEndpointPrefix is where MountStandardEndpoints mounts handlers
+const DefaultEndpointPrefix = "/x402/"
+
+// StandardEndpointDeps are the handlers' dependencies. Endpoints whose
+// dependencies are nil are not mounted.
+type StandardEndpointDeps struct {
+	// SessionStore serves {prefix}session with SessionConfig
+	SessionStore  SessionStore
+	SessionConfig SessionConfig
+
+	// SessionTiers are served at {prefix}pricing
+	SessionTiers []SessionPricingTier
+
+	// AI serves {prefix}discovery, and {prefix}budget and
+	// {prefix}budget/history when it has a PreAuthStore
+	AI *AIFirstConfig
+
+	// TaskSpend serves {prefix}tasks/{id}/spend
+	TaskSpend TaskSpendStore
+
+	// Metering serves {prefix}metrics
+	Metering MeteringStore
+
+	// RailMetrics serves {prefix}metrics/rails for Prometheus
+	RailMetrics *RailMetrics
+
+	// Onboarding serves {prefix}payment-methods,
+	// {prefix}onboarding/preferences (GET, POST and DELETE),
+	// {prefix}onboarding/preferences/export and {prefix}onboarding/stripe/setup
+	Onboarding *OnboardingHandler
+
+	// Stripe serves its webhook at {prefix}stripe/webhook
+	Stripe *StripeRail
+
+	// PaymentHistory serves payers their payments at {prefix}payments/mine
+	PaymentHistory *PaymentHistoryConfig
+
+	// DiscoverySigner serves its public keys at /.well-known/x402, whatever
+	// the prefix
+	DiscoverySigner *DiscoverySigner
+}
+
+// MountOptions configures MountStandardEndpoints
+type MountOptions struct {
+	// Prefix for every route (default "/x402/")
+	Prefix string
+
+	// Exemptions gets each mounted path as an exact exemption (a prefix
+	// exemption for paths ending in "/"). Set the same list as the
+	// middleware config's DynamicExemptions.
+	Exemptions *ExemptionList
+}
+
+// MountStandardEndpoints registers the handlers deps provides on mux and
+// exempts their paths from payment. It returns the mounted paths, or an
+// error without mounting anything if a path is already registered.
+func MountStandardEndpoints(mux *http.ServeMux, deps StandardEndpointDeps, opts MountOptions) ([]string, error) {
+	prefix := opts.Prefix
+	if prefix == "" {
+		prefix = DefaultEndpointPrefix
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return nil, fmt.Errorf("x402: endpoint prefix %q must start with /", prefix)
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	routes := standardRoutes(deps)
+	paths := make([]string, 0, len(routes))
+	for _, route := range routes {
+		path := prefix + route.path
+		if strings.HasPrefix(route.path, "/") {
+			path = route.path
+		}
+		if _, pattern := mux.Handler(&http.Request{Method: http.MethodGet, URL: &url.URL{Path: path}}); pattern == path {
+			return nil, fmt.Errorf("x402: %s is already registered", path)
+		}
+		paths = append(paths, path)
+	}
+
+	for i, route := range routes {
+		if err := handleRoute(mux, paths[i], route.handler); err != nil {
+			return nil, err
+		}
+		switch {
+		case opts.Exemptions == nil:
+		case strings.HasSuffix(paths[i], "/"):
+			opts.Exemptions.Add(paths[i], 0)
+		default:
+			opts.Exemptions.AddExact(paths[i])
+		}
+	}
+	return paths, nil
+}
+
+// standardRoute is a handler and its path below the prefix, or its
+// absolute path if it starts with "/"
+type standardRoute struct {
+	path    string
+	handler http.Handler
+}
+
+func standardRoutes(deps StandardEndpointDeps) []standardRoute {
+	var routes []standardRoute
+	add := func(path string, handler http.Handler) {
+		routes = append(routes, standardRoute{path, handler})
+	}
+
+	if deps.SessionStore != nil {
+		add("session", SessionHandler(deps.SessionStore, deps.SessionConfig))
+	}
+	if len(deps.SessionTiers) > 0 {
+		add("pricing", PricingHandler(deps.SessionTiers))
+	}
+	if deps.AI != nil {
+		add("discovery", AIDiscoveryHandler(*deps.AI))
+		if deps.AI.PreAuthStore != nil {
+			add("budget", AIBudgetHandler(deps.AI.PreAuthStore, *deps.AI))
+			add("budget/history", AIBudgetHistoryHandler(deps.AI.PreAuthStore, *deps.AI))
+		}
+	}
+	if deps.TaskSpend != nil {
+		add("tasks/", TaskSpendHandler(deps.TaskSpend))
+	}
+	if deps.Metering != nil {
+		add("metrics", MetricsHandler(deps.Metering))
+	}
+	if deps.RailMetrics != nil {
+		add("metrics/rails", RailMetricsHandler(deps.RailMetrics))
+	}
+	if deps.Onboarding != nil {
+		add("payment-methods", http.HandlerFunc(deps.Onboarding.ListPaymentMethods))
+		add("onboarding/preferences", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet:
+				deps.Onboarding.GetPreferences(w, r)
+			case http.MethodPost:
+				deps.Onboarding.SetPreferredMethod(w, r)
+			case http.MethodDelete:
+				deps.Onboarding.DeletePreferences(w, r)
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		}))
+		add("onboarding/preferences/export", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			deps.Onboarding.ExportPreferences(w, r)
+		}))
+		add("onboarding/stripe/setup", http.HandlerFunc(deps.Onboarding.CreateStripeSetupIntent))
+	}
+	if deps.Stripe != nil {
+		add("stripe/webhook", deps.Stripe.WebhookHandler())
+	}
+	if deps.PaymentHistory != nil {
+		add("payments/mine", PaymentHistoryHandler(*deps.PaymentHistory))
+	}
+	if deps.DiscoverySigner != nil {
+		add(WellKnownPath, WellKnownHandler(deps.DiscoverySigner))
+	}
+	return routes
+}
+
+// handleRoute registers handler, reporting the mux's conflict panics as errors
+func handleRoute(mux *http.ServeMux, path string, handler http.Handler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("x402: cannot mount %s: %v", path, r)
+		}
+	}()
+	mux.Handle(path, handler)
+	return nil
+}
@@ -0,0 +1,74 @@
+package x402
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMountStandardEndpoints(t *testing.T) {
+	exemptions := NewExemptionList()
+	mux := http.NewServeMux()
+	mux.Handle("/", createTestHandler())
+
+	routes, err := MountStandardEndpoints(mux, StandardEndpointDeps{
+		SessionTiers: []SessionPricingTier{{Name: "hour", Duration: time.Hour, Price: 1000}},
+		AI:           &AIFirstConfig{PreAuthStore: NewInMemoryPreAuthStore()},
+		Metering:     NewInMemoryMeteringStore(0, "USD"),
+		Onboarding:   NewOnboardingHandler(UnifiedPaymentConfig{}, NewInMemoryPaymentPrefsStore()),
+	}, MountOptions{Exemptions: exemptions})
+	if err != nil {
+		t.Fatalf("MountStandardEndpoints failed: %v", err)
+	}
+
+	want := []string{"/x402/pricing", "/x402/discovery", "/x402/budget", "/x402/budget/history", "/x402/metrics",
+		"/x402/payment-methods", "/x402/onboarding/preferences", "/x402/onboarding/preferences/export", "/x402/onboarding/stripe/setup"}
+	if strings.Join(routes, " ") != strings.Join(want, " ") {
+		t.Errorf("Expected routes %v, got %v", want, routes)
+	}
+
+	config := testConfig()
+	config.DynamicExemptions = exemptions
+	handler := Middleware(mux, config)
+
+	for _, path := range []string{"/x402/pricing", "/x402/discovery", "/x402/metrics", "/x402/payment-methods"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected %s to be served without payment, got %d", path, w.Code)
+		}
+	}
+
+	// Exemptions are exact: neighbours of mounted routes still need payment
+	for _, path := range []string{"/api/data", "/x402/pricing/extra"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusPaymentRequired {
+			t.Errorf("Expected %s to require payment, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestMountStandardEndpoints_Conflict(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/api/metrics", createTestHandler())
+	exemptions := NewExemptionList()
+
+	_, err := MountStandardEndpoints(mux, StandardEndpointDeps{
+		SessionTiers: []SessionPricingTier{{Name: "hour", Duration: time.Hour, Price: 1000}},
+		Metering:     NewInMemoryMeteringStore(0, "USD"),
+	}, MountOptions{Prefix: "/api", Exemptions: exemptions})
+	if err == nil || !strings.Contains(err.Error(), "/api/metrics") {
+		t.Fatalf("Expected a conflict on /api/metrics, got %v", err)
+	}
+
+	// Nothing was mounted or exempted
+	if _, pattern := mux.Handler(httptest.NewRequest("GET", "/api/pricing", nil)); pattern == "/api/pricing" {
+		t.Error("Expected no routes to be mounted after a conflict")
+	}
+	if exemptions.IsExempt("/api/pricing") {
+		t.Error("Expected no exemptions after a conflict")
+	}
+}
@@ -0,0 +1,295 @@
+// Package x402 - ACH Bank Debits
+// High-value customers would rather pay by bank debit than lose 2.9% to card
+// fees. ACHRail takes payments through Stripe us_bank_account intents, which
+// stay "processing" for several business days before they succeed or fail.
+// A processing payment is either accepted optimistically (GrantWhileProcessing)
+// or refused until it settles. The payment_intent.processing, succeeded and
+// payment_failed webhooks move its ledger record along, and a failed debit
+// revokes the receipts it was granted.
+package x402
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RailStripeACH is the rail ID of ACHRail
+const RailStripeACH = "stripe-ach"
+
+// PaymentStatusProcessing is the ledger status of bank debits still settling
+const PaymentStatusProcessing = "processing"
+
+// DefaultACHSettlementNote is the settlement time shown in ACH 402 options
+const DefaultACHSettlementNote = "Bank debits take about 4 business days to settle"
+
+// DefaultACHFees is Stripe's list price for ACH Direct Debit: 0.8% capped at $5
+func DefaultACHFees() *FeeSchedule {
+	return &FeeSchedule{Default: Fee{Percent: 0.8, Max: 500}}
+}
+
+// ACHRail takes US bank debits through Stripe
+type ACHRail struct {
+	// Stripe is the account debits are made on. Its Metrics, Ledger and
+	// webhook secret are used for ACH too.
+	Stripe *StripeRail
+
+	// GrantWhileProcessing accepts debits still processing, trusting them to
+	// settle. Otherwise access is refused until the debit succeeds.
+	GrantWhileProcessing bool
+
+	// Fees estimates Stripe's fee in 402 options (default DefaultACHFees)
+	Fees *FeeSchedule
+
+	// SettlementNote tells buyers how long a debit takes (default
+	// DefaultACHSettlementNote)
+	SettlementNote string
+
+	// Receipts, if set, has the receipts of failed debits revoked
+	Receipts *ReceiptCookies
+
+	// OnRevoke, if set, is called with the payment ID of each failed debit,
+	// to withdraw anything else it was granted (sessions, API keys)
+	OnRevoke func(ctx context.Context, paymentID string)
+}
+
+// NewACHRail creates an ACH rail debiting through stripe
+func NewACHRail(stripe *StripeRail) *ACHRail {
+	return &ACHRail{Stripe: stripe}
+}
+
+func (a *ACHRail) ID() string {
+	return RailStripeACH
+}
+
+func (a *ACHRail) DisplayName() string {
+	return "US Bank Account (ACH)"
+}
+
+func (a *ACHRail) Type() RailType {
+	return RailTypeFiat
+}
+
+func (a *ACHRail) SupportedCurrencies() []string {
+	return []string{"USD"}
+}
+
+// CreatePaymentIntent creates a us_bank_account intent. Debits settle long
+// after any quote's deadline, so intents don't carry one.
+func (a *ACHRail) CreatePaymentIntent(ctx context.Context, req *PaymentIntentRequest) (*PaymentIntent, error) {
+	debit := *req
+	debit.PaymentMethodTypes = []string{"us_bank_account"}
+	debit.ExpiresAt = nil
+	intent, err := a.Stripe.CreatePaymentIntent(ctx, &debit)
+	if err != nil {
+		return nil, err
+	}
+	intent.Rail = a.ID()
+	return intent, nil
+}
+
+func (a *ACHRail) VerifyPayment(ctx context.Context, req *VerifyPaymentRequest) (*PaymentVerification, error) {
+	start := time.Now()
+	verification, err := a.verifyPayment(ctx, req)
+	a.Stripe.Metrics.observe(a.ID(), RailOpVerify, start, err)
+	return verification, err
+}
+
+func (a *ACHRail) verifyPayment(ctx context.Context, req *VerifyPaymentRequest) (*PaymentVerification, error) {
+	verification, err := a.Stripe.verifyPayment(ctx, req)
+	if err != nil || verification.Status != "processing" {
+		return verification, err
+	}
+
+	// A processing debit has the buyer's authorization but not their money
+	verification.Message = a.settlementNote()
+	if !a.GrantWhileProcessing {
+		return verification, nil
+	}
+	switch {
+	case !strings.EqualFold(verification.Currency, req.ExpectedCurrency):
+		verification.Reason = FailureCurrencyMismatch
+	case verification.Amount < req.ExpectedAmount:
+		verification.Reason = FailureAmountMismatch
+	default:
+		verification.Valid, verification.Reason = true, ""
+	}
+	return verification, nil
+}
+
+// CapturePayment has nothing to do: debits are confirmed by the buyer and
+// settle on their own
+func (a *ACHRail) CapturePayment(ctx context.Context, req *CapturePaymentRequest) (*PaymentCapture, error) {
+	return &PaymentCapture{
+		Success:       true,
+		TransactionID: req.PaymentID,
+		GrossAmount:   req.Amount,
+		NetAmount:     req.Amount - a.EstimateFee(req.Amount, req.Currency),
+		FeeAmount:     a.EstimateFee(req.Amount, req.Currency),
+		CapturedAt:    time.Now(),
+	}, nil
+}
+
+func (a *ACHRail) RefundPayment(ctx context.Context, req *RefundPaymentRequest) (*PaymentRefund, error) {
+	return a.Stripe.RefundPayment(ctx, req)
+}
+
+// EstimateFee returns Stripe's fee on a debit of amount
+func (a *ACHRail) EstimateFee(amount int64, currency string) int64 {
+	if a.Fees == nil {
+		return DefaultACHFees().Estimate(amount, currency, "")
+	}
+	return a.Fees.Estimate(amount, currency, "")
+}
+
+func (a *ACHRail) settlementNote() string {
+	if a.SettlementNote != "" {
+		return a.SettlementNote
+	}
+	return DefaultACHSettlementNote
+}
+
+// WebhookHandler follows debits through processing to success or failure.
+// Other events are handled as StripeRail's webhook would, so one endpoint
+// serves both.
+func (a *ACHRail) WebhookHandler() http.Handler {
+	stripeHandler := a.Stripe.WebhookHandler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read body", http.StatusBadRequest)
+			return
+		}
+
+		var event struct {
+			Type string `json:"type"`
+			Data struct {
+				Object stripeDebit `json:"object"`
+			} `json:"data"`
+		}
+		if json.Unmarshal(body, &event) != nil || !event.Data.Object.bankDebit() {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			stripeHandler.ServeHTTP(w, r)
+			return
+		}
+		eventID, ok := a.Stripe.acceptWebhook(w, body, r.Header.Get("Stripe-Signature"))
+		if !ok {
+			return
+		}
+
+		var handleErr error
+		debit := event.Data.Object
+		switch event.Type {
+		case "payment_intent.processing":
+			_, handleErr = a.book(debit, PaymentStatusProcessing)
+		case "payment_intent.succeeded":
+			_, handleErr = a.book(debit, PaymentStatusSettled)
+		case "payment_intent.payment_failed":
+			var failed bool
+			failed, handleErr = a.book(debit, PaymentStatusFailed)
+			if failed {
+				a.Receipts.Revoke(debit.ID)
+				if a.OnRevoke != nil {
+					a.OnRevoke(r.Context(), debit.ID)
+				}
+			}
+		}
+
+		// A failed update is retried by Stripe
+		if handleErr != nil {
+			a.Stripe.releaseEvent(eventID)
+			http.Error(w, "Failed to handle event", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// stripeDebit is a payment intent as its webhooks carry it
+type stripeDebit struct {
+	ID                 string            `json:"id"`
+	Amount             int64             `json:"amount"`
+	Currency           string            `json:"currency"`
+	Customer           string            `json:"customer"`
+	Metadata           map[string]string `json:"metadata"`
+	PaymentMethodTypes []string          `json:"payment_method_types"`
+}
+
+// bankDebit reports whether d is a us_bank_account intent
+func (d stripeDebit) bankDebit() bool {
+	for _, t := range d.PaymentMethodTypes {
+		if t == "us_bank_account" {
+			return true
+		}
+	}
+	return false
+}
+
+// book records d in the ledger with status, or moves its record there,
+// reporting whether it did. A record only moves forward, from processing
+// to settled or failed, so a late or replayed event can't undo an outcome.
+// Without a ledger every event is taken as it comes.
+func (a *ACHRail) book(d stripeDebit, status string) (bool, error) {
+	ledger := a.Stripe.Ledger
+	if ledger == nil {
+		return true, nil
+	}
+	if record, err := ledger.Get(d.ID); err == nil {
+		if !debitAdvances(record.Status, status) {
+			return false, nil
+		}
+		updater, ok := ledger.(PaymentStatusUpdater)
+		if !ok {
+			return false, fmt.Errorf("x402: ledger cannot update payment %s to %s", d.ID, status)
+		}
+		return true, updater.UpdateStatus(d.ID, status)
+	} else if !errors.Is(err, ErrPaymentRecordNotFound) {
+		return false, err
+	}
+	_, err := ledger.Record(PaymentRecord{
+		ID:            d.ID,
+		Endpoint:      d.Metadata["resource"],
+		PayerID:       d.Customer,
+		Amount:        d.Amount,
+		Currency:      strings.ToUpper(d.Currency),
+		Rail:          a.ID(),
+		TransactionID: d.ID,
+		Status:        status,
+	})
+	return err == nil, err
+}
+
+// debitAdvances reports whether a bank debit's record may move from status
+// from to status to: forward only, as verified, processing, then settled or
+// failed. Refunded and other statuses are final.
+func debitAdvances(from, to string) bool {
+	return debitStage(to) > debitStage(from)
+}
+
+// debitStage orders the statuses of a bank debit's record
+func debitStage(status string) int {
+	switch status {
+	case PaymentStatusVerified:
+		return 0
+	case PaymentStatusProcessing:
+		return 1
+	case PaymentStatusSettled, PaymentStatusFailed:
+		return 2
+	}
+	return 3
+}
+
+// settlementNote returns what rail says about how long its payments take to
+// settle, if anything
+func settlementNote(rail PaymentRail) string {
+	if ach, ok := rail.(*ACHRail); ok {
+		return ach.settlementNote()
+	}
+	return ""
+}
@@ -0,0 +1,222 @@
+package x402
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// achStripe mocks the Stripe API for one bank debit, pi_ach, whose status
+// the test moves along
+type achStripe struct {
+	mu     sync.Mutex
+	status string
+	forms  []url.Values
+}
+
+func (s *achStripe) setStatus(status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+func (s *achStripe) server(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost {
+			_ = r.ParseForm()
+			s.forms = append(s.forms, r.PostForm)
+			fmt.Fprintf(w, `{"id":"pi_ach","amount":%s,"currency":"usd","status":"requires_payment_method","client_secret":"pi_ach_secret"}`, r.PostForm.Get("amount"))
+			return
+		}
+		fmt.Fprintf(w, `{"id":"pi_ach","amount":100000,"currency":"usd","status":"%s","customer":"cus_corp"}`, s.status)
+	}))
+}
+
+// debitEvent is a webhook event for pi_ach
+func debitEvent(eventType string) string {
+	return fmt.Sprintf(`{"id":"evt_%[1]s","type":"%[1]s","data":{"object":{"id":"pi_ach","amount":100000,"currency":"usd","customer":"cus_corp","metadata":{"resource":"/api/reports"},"payment_method_types":["us_bank_account"]}}}`, eventType)
+}
+
+func deliver(t *testing.T, handler http.Handler, event string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, signedWebhook(testWebhookSecret, []byte(event)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the webhook accepted, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func newACHHandler(rail *ACHRail, receipts *ReceiptCookies) http.Handler {
+	registry := NewRailRegistry()
+	registry.Register(rail)
+	return UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		Price:          "1000.00",
+		Currency:       "USD",
+		FiatEnabled:    true,
+		RailRegistry:   registry,
+		ReceiptCookies: receipts,
+	})
+}
+
+func payByACH(handler http.Handler, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/reports", nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	} else {
+		proof, _ := json.Marshal(PaymentProof{Rail: RailStripeACH, PaymentIntentID: "pi_ach"})
+		req.Header.Set("X-PAYMENT-PROOF", base64.StdEncoding.EncodeToString(proof))
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestACHRail_Option(t *testing.T) {
+	stripe := &achStripe{status: "requires_payment_method"}
+	api := stripe.server(t)
+	defer api.Close()
+	stripeRail := NewStripeRail("sk_test", testWebhookSecret)
+	stripeRail.BaseURL = api.URL
+
+	w := httptest.NewRecorder()
+	newACHHandler(NewACHRail(stripeRail), nil).ServeHTTP(w, httptest.NewRequest("GET", "/api/reports", nil))
+	var response PaymentOptionsResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if len(response.Options) != 1 {
+		t.Fatalf("Expected the ACH option, got %+v", response.Options)
+	}
+	option := response.Options[0]
+	if option.Rail != RailStripeACH || option.Amount != 100000 || option.ClientSecret != "pi_ach_secret" {
+		t.Errorf("Expected a $1000 bank debit, got %+v", option)
+	}
+	if option.EstimatedFee != 500 || option.SettlementNote != DefaultACHSettlementNote {
+		t.Errorf("Expected the $5 capped fee and a settlement note, got %d and %q", option.EstimatedFee, option.SettlementNote)
+	}
+	form := stripe.forms[0]
+	if form.Get("payment_method_types[]") != "us_bank_account" || form.Get("metadata[expires_at]") != "" {
+		t.Errorf("Expected a us_bank_account intent without a deadline, got %v", form)
+	}
+}
+
+func TestACHRail_GrantWhileProcessingThenRevoke(t *testing.T) {
+	stripe := &achStripe{status: "processing"}
+	api := stripe.server(t)
+	defer api.Close()
+	stripeRail := NewStripeRail("sk_test", testWebhookSecret)
+	stripeRail.BaseURL = api.URL
+	ledger := NewInMemoryPaymentLedger(10)
+	stripeRail.Ledger = ledger
+
+	receipts := &ReceiptCookies{Secret: []byte("receipt-secret-key")}
+	var revoked []string
+	rail := NewACHRail(stripeRail)
+	rail.GrantWhileProcessing = true
+	rail.Receipts = receipts
+	rail.OnRevoke = func(ctx context.Context, paymentID string) { revoked = append(revoked, paymentID) }
+	handler := newACHHandler(rail, receipts)
+	webhooks := rail.WebhookHandler()
+
+	// A processing debit is trusted
+	w := payByACH(handler, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected a processing debit accepted, got %d: %s", w.Code, w.Body)
+	}
+	cookie := w.Result().Cookies()[0]
+	deliver(t, webhooks, debitEvent("payment_intent.processing"))
+	if record, _ := ledger.Get("pi_ach"); record.Status != PaymentStatusProcessing || record.Rail != RailStripeACH || record.Endpoint != "/api/reports" {
+		t.Errorf("Expected a processing ledger record, got %+v", record)
+	}
+	if w := payByACH(handler, cookie); w.Code != http.StatusOK {
+		t.Errorf("Expected the receipt accepted while the debit processes, got %d", w.Code)
+	}
+
+	// Until it bounces
+	stripe.setStatus("requires_payment_method")
+	deliver(t, webhooks, debitEvent("payment_intent.payment_failed"))
+	if record, _ := ledger.Get("pi_ach"); record.Status != PaymentStatusFailed {
+		t.Errorf("Expected the ledger record failed, got %q", record.Status)
+	}
+	if w := payByACH(handler, cookie); w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected the failed debit's receipt revoked, got %d", w.Code)
+	}
+	if len(revoked) != 1 || revoked[0] != "pi_ach" {
+		t.Errorf("Expected OnRevoke called for pi_ach, got %v", revoked)
+	}
+}
+
+func TestACHRail_HeldUntilSettled(t *testing.T) {
+	stripe := &achStripe{status: "processing"}
+	api := stripe.server(t)
+	defer api.Close()
+	stripeRail := NewStripeRail("sk_test", testWebhookSecret)
+	stripeRail.BaseURL = api.URL
+	ledger := NewInMemoryPaymentLedger(10)
+	stripeRail.Ledger = ledger
+	rail := NewACHRail(stripeRail)
+	handler := newACHHandler(rail, nil)
+	webhooks := rail.WebhookHandler()
+
+	deliver(t, webhooks, debitEvent("payment_intent.processing"))
+	w := payByACH(handler, nil)
+	var response PaymentOptionsResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusPaymentRequired || !strings.Contains(response.Error, "has not completed") {
+		t.Fatalf("Expected a processing debit held, got %d (%s)", w.Code, response.Error)
+	}
+
+	stripe.setStatus("succeeded")
+	deliver(t, webhooks, debitEvent("payment_intent.succeeded"))
+	if record, _ := ledger.Get("pi_ach"); record.Status != PaymentStatusSettled {
+		t.Errorf("Expected the ledger record settled, got %q", record.Status)
+	}
+	if w := payByACH(handler, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the settled debit accepted, got %d", w.Code)
+	}
+}
+
+func TestACHRail_StatusOnlyMovesForward(t *testing.T) {
+	stripeRail := NewStripeRail("sk_test", testWebhookSecret)
+	ledger := NewInMemoryPaymentLedger(10)
+	stripeRail.Ledger = ledger
+	receipts := &ReceiptCookies{Secret: []byte("receipt-secret-key")}
+	rail := NewACHRail(stripeRail)
+	rail.Receipts = receipts
+	webhooks := rail.WebhookHandler()
+
+	// A failed debit stays failed, whatever arrives after
+	deliver(t, webhooks, debitEvent("payment_intent.processing"))
+	deliver(t, webhooks, debitEvent("payment_intent.payment_failed"))
+	deliver(t, webhooks, strings.Replace(debitEvent("payment_intent.processing"), "evt_", "evt_late_", 1))
+	deliver(t, webhooks, debitEvent("payment_intent.succeeded"))
+	if record, _ := ledger.Get("pi_ach"); record.Status != PaymentStatusFailed {
+		t.Errorf("Expected the failed debit to stay failed, got %q", record.Status)
+	}
+
+	// And a settled one settled, keeping its receipts
+	ledger.Record(PaymentRecord{ID: "pi_settled", Rail: RailStripeACH, Status: PaymentStatusSettled})
+	failed := strings.NewReplacer(`"id":"pi_ach"`, `"id":"pi_settled"`, "evt_", "evt_settled_").Replace(debitEvent("payment_intent.payment_failed"))
+	deliver(t, webhooks, failed)
+	if record, _ := ledger.Get("pi_settled"); record.Status != PaymentStatusSettled || receipts.isRevoked("pi_settled") {
+		t.Errorf("Expected the settled debit untouched, got %q", record.Status)
+	}
+}
+
+func TestACHRail_WebhookPassesOtherEventsToStripe(t *testing.T) {
+	stripeRail := NewStripeRail("sk_test", testWebhookSecret)
+	stripeRail.Ledger = NewInMemoryPaymentLedger(10)
+	deliver(t, NewACHRail(stripeRail).WebhookHandler(), `{"id":"evt_cs_1","type":"checkout.session.completed","data":{"object":{"id":"cs_1","payment_status":"paid","amount_total":500,"currency":"usd"}}}`)
+	if _, err := stripeRail.Ledger.Get("cs_1"); err != nil {
+		t.Errorf("Expected the card event handled by the Stripe webhook, got %v", err)
+	}
+}
@@ -0,0 +1,431 @@
+// Package x402 - Stripe Checkout
+// Embedding Stripe.js is more than a simple seller needs. With
+// UnifiedPaymentConfig.StripeCheckout set, 402 responses also offer a
+// "stripe-checkout" option whose next action redirects the buyer to a
+// Stripe-hosted Checkout page. Stripe sends the buyer back to the resource
+// with the Checkout session ID and a signed state token naming the
+// resource; the middleware verifies the session once, and with
+// ReceiptCookies set, redirects to the clean resource URL with a receipt
+// cookie. StripeRail's webhook records checkout.session.completed in its
+// Ledger, so payments are booked even if the buyer never comes back.
+package x402
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RailStripeCheckout is the rail of 402 options paid on a Stripe Checkout
+// page. Buyers returning from it are verified by the stripe rail.
+const RailStripeCheckout = "stripe-checkout"
+
+// Query parameters Stripe sends returning buyers back with
+const (
+	CheckoutSessionParam = "x402_checkout_session"
+	CheckoutStateParam   = "x402_state"
+)
+
+// DefaultCheckoutStateTTL is how long a buyer has to complete a Checkout
+// page when StripeCheckout.StateTTL is 0
+const DefaultCheckoutStateTTL = time.Hour
+
+// checkoutReturnGrace is how long after a Checkout session expires a buyer
+// who paid at the last moment can still return with it
+const checkoutReturnGrace = 5 * time.Minute
+
+var (
+	// ErrInvalidCheckoutState is returned for state tokens that are
+	// malformed, tampered with or for another resource
+	ErrInvalidCheckoutState = kindOf(ErrInvalidPayment, "invalid checkout state")
+
+	// ErrCheckoutStateExpired is returned for returns long after the
+	// Checkout session expired
+	ErrCheckoutStateExpired = kindOf(ErrExpired, "checkout state has expired")
+
+	// ErrCheckoutUsed is returned for Checkout sessions already redeemed
+	ErrCheckoutUsed = kindOf(ErrInvalidPayment, "checkout session has already been used")
+)
+
+// CheckoutSessionRequest is a request for a hosted Checkout page
+type CheckoutSessionRequest struct {
+	Amount      int64  `json:"amount"` // In Currency's smallest unit
+	Currency    string `json:"currency"`
+	Description string `json:"description,omitempty"`
+	Resource    string `json:"resource"`
+
+	// Where Stripe sends the buyer after paying or giving up. SuccessURL may
+	// contain {CHECKOUT_SESSION_ID}.
+	SuccessURL string `json:"successUrl"`
+	CancelURL  string `json:"cancelUrl"`
+
+	// ClientReferenceID is returned with the session, e.g. a state token
+	ClientReferenceID string `json:"clientReferenceId,omitempty"`
+
+	// ExpiresAt is when the page stops accepting payment (Stripe requires
+	// 30 minutes to 24 hours from now)
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// CheckoutSession is a Stripe Checkout session
+type CheckoutSession struct {
+	ID                string            `json:"id"`
+	URL               string            `json:"url,omitempty"`
+	Status            string            `json:"status"`        // open, complete, expired
+	PaymentStatus     string            `json:"paymentStatus"` // paid, unpaid, no_payment_required
+	PaymentIntentID   string            `json:"paymentIntentId,omitempty"`
+	Amount            int64             `json:"amount"`
+	Currency          string            `json:"currency"`
+	Customer          string            `json:"customer,omitempty"`
+	ClientReferenceID string            `json:"clientReferenceId,omitempty"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+}
+
+// CheckoutRail is implemented by rails that can host a payment page
+type CheckoutRail interface {
+	CreateCheckoutSession(ctx context.Context, req *CheckoutSessionRequest) (*CheckoutSession, error)
+}
+
+// stripeCheckoutSession is a Checkout session as the Stripe API returns it
+type stripeCheckoutSession struct {
+	ID                string            `json:"id"`
+	URL               string            `json:"url"`
+	Status            string            `json:"status"`
+	PaymentStatus     string            `json:"payment_status"`
+	PaymentIntent     string            `json:"payment_intent"`
+	AmountTotal       int64             `json:"amount_total"`
+	Currency          string            `json:"currency"`
+	Customer          string            `json:"customer"`
+	ClientReferenceID string            `json:"client_reference_id"`
+	Metadata          map[string]string `json:"metadata"`
+}
+
+func (c stripeCheckoutSession) session() *CheckoutSession {
+	return &CheckoutSession{
+		ID:                c.ID,
+		URL:               c.URL,
+		Status:            c.Status,
+		PaymentStatus:     c.PaymentStatus,
+		PaymentIntentID:   c.PaymentIntent,
+		Amount:            c.AmountTotal,
+		Currency:          strings.ToUpper(c.Currency),
+		Customer:          c.Customer,
+		ClientReferenceID: c.ClientReferenceID,
+		Metadata:          c.Metadata,
+	}
+}
+
+// CreateCheckoutSession creates a one-off Checkout page for req's amount
+func (s *StripeRail) CreateCheckoutSession(ctx context.Context, req *CheckoutSessionRequest) (*CheckoutSession, error) {
+	name := req.Description
+	if name == "" {
+		name = req.Resource
+	}
+	form := url.Values{
+		"mode":                                   {"payment"},
+		"success_url":                            {req.SuccessURL},
+		"cancel_url":                             {req.CancelURL},
+		"line_items[0][quantity]":                {"1"},
+		"line_items[0][price_data][currency]":    {strings.ToLower(req.Currency)},
+		"line_items[0][price_data][unit_amount]": {strconv.FormatInt(stripeAmount(req.Amount, req.Currency), 10)},
+		"metadata[resource]":                     {req.Resource},
+	}
+	form.Set("line_items[0][price_data][product_data][name]", name)
+	if req.ClientReferenceID != "" {
+		form.Set("client_reference_id", req.ClientReferenceID)
+	}
+	if req.ExpiresAt != nil {
+		form.Set("expires_at", strconv.FormatInt(req.ExpiresAt.Unix(), 10))
+	}
+	for key, value := range req.Metadata {
+		form.Set("metadata["+key+"]", value)
+	}
+
+	var created stripeCheckoutSession
+	if err := s.postForm(ctx, "/checkout/sessions", form, &created); err != nil {
+		return nil, err
+	}
+	return created.session(), nil
+}
+
+// checkoutSession retrieves a Checkout session
+func (s *StripeRail) checkoutSession(ctx context.Context, id string) (*CheckoutSession, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", s.BaseURL+"/checkout/sessions/"+url.PathEscape(id), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+s.SecretKey)
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return nil, &StripeError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStripeError(resp.StatusCode, body)
+	}
+
+	var session stripeCheckoutSession
+	if err := json.Unmarshal(body, &session); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return session.session(), nil
+}
+
+// verifyCheckoutSession verifies a buyer returning from a Checkout page.
+// Checkout charges the buyer itself, so nothing is left to capture.
+func (s *StripeRail) verifyCheckoutSession(ctx context.Context, req *VerifyPaymentRequest) (*PaymentVerification, error) {
+	session, err := s.checkoutSession(ctx, req.CheckoutSessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	reason := ""
+	switch {
+	case session.ClientReferenceID != req.CheckoutState:
+		// A session paid for another request can't be replayed here
+		reason = FailureInvalidPayment
+	case session.Status == "expired":
+		reason = FailureExpired
+	case session.PaymentStatus != "paid":
+		reason = FailurePaymentIncomplete
+	case !strings.EqualFold(session.Currency, req.ExpectedCurrency):
+		reason = FailureCurrencyMismatch
+	case session.Amount < req.ExpectedAmount:
+		reason = FailureAmountMismatch
+	}
+
+	paymentID := session.PaymentIntentID
+	if paymentID == "" {
+		paymentID = session.ID
+	}
+	return &PaymentVerification{
+		Valid:      reason == "",
+		Message:    fmt.Sprintf("Checkout payment status: %s", session.PaymentStatus),
+		Reason:     reason,
+		PaymentID:  paymentID,
+		Amount:     session.Amount,
+		Currency:   session.Currency,
+		Payer:      session.Customer,
+		VerifiedAt: time.Now(),
+	}, nil
+}
+
+// recordCheckout books a completed Checkout session in s.Ledger. Stripe
+// retries webhooks, so a session already booked is left alone.
+func (s *StripeRail) recordCheckout(data json.RawMessage) error {
+	var event struct {
+		Object stripeCheckoutSession `json:"object"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+	session := event.Object.session()
+	if session.PaymentStatus != "paid" {
+		return nil // Delayed methods complete later with async_payment_succeeded
+	}
+	if _, err := s.Ledger.Get(session.ID); err == nil {
+		return nil
+	} else if !errors.Is(err, ErrPaymentRecordNotFound) {
+		return err
+	}
+	_, err := s.Ledger.Record(PaymentRecord{
+		ID:            session.ID,
+		Endpoint:      session.Metadata["resource"],
+		PayerID:       session.Customer,
+		Amount:        session.Amount,
+		Currency:      session.Currency,
+		Rail:          s.ID(),
+		TransactionID: session.PaymentIntentID,
+		Status:        PaymentStatusSettled,
+		Metadata:      map[string]string{"checkoutSession": session.ID},
+	})
+	return err
+}
+
+// StripeCheckout offers Stripe-hosted Checkout pages in 402 responses
+type StripeCheckout struct {
+	// Secret signs the state tokens buyers return with (HMAC-SHA256)
+	Secret []byte
+
+	// BaseURL is the public origin return URLs are built on, e.g.
+	// "https://example.com" (default: the request's scheme and Host, which
+	// behind a proxy may not be what buyers see)
+	BaseURL string
+
+	// StateTTL is how long a buyer has to pay on the Checkout page (default
+	// DefaultCheckoutStateTTL; Stripe allows 30 minutes to 24 hours)
+	StateTTL time.Duration
+
+	mu   sync.Mutex
+	used map[string]int64 // session ID -> state expiry of sessions redeemed
+
+	// now is stubbed in tests
+	now func() time.Time
+}
+
+// checkoutState is what a state token says
+type checkoutState struct {
+	Path      string `json:"path"`
+	Nonce     string `json:"nonce"`
+	ExpiresAt int64  `json:"expiresAt"` // Unix seconds, when the Checkout page expires
+}
+
+func (c *StripeCheckout) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+func (c *StripeCheckout) stateTTL() time.Duration {
+	if c.StateTTL > 0 {
+		return c.StateTTL
+	}
+	return DefaultCheckoutStateTTL
+}
+
+// returnURL is where Stripe sends the buyer back to for r, with query
+// added to r's own
+func (c *StripeCheckout) returnURL(r *http.Request, query string) string {
+	base := strings.TrimSuffix(c.BaseURL, "/")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	rawQuery := stripQueryParam(stripQueryParam(r.URL.RawQuery, CheckoutSessionParam), CheckoutStateParam)
+	if query != "" {
+		if rawQuery != "" {
+			rawQuery += "&"
+		}
+		rawQuery += query
+	}
+	if rawQuery == "" {
+		return base + r.URL.EscapedPath()
+	}
+	return base + r.URL.EscapedPath() + "?" + rawQuery
+}
+
+// option creates a Checkout page for r and returns the 402 option
+// redirecting to it, or nil if c is nil or the page can't be created
+func (c *StripeCheckout) option(r *http.Request, rail PaymentRail, amount int64, currency, description string) *PaymentOption {
+	if c == nil {
+		return nil
+	}
+	checkout, ok := rail.(CheckoutRail)
+	if !ok {
+		return nil
+	}
+
+	expires := c.clock().Add(c.stateTTL())
+	nonce := make([]byte, 8)
+	_, _ = rand.Read(nonce)
+	payload, _ := json.Marshal(checkoutState{Path: r.URL.Path, Nonce: hex.EncodeToString(nonce), ExpiresAt: expires.Unix()})
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	state := encoded + "." + base64.RawURLEncoding.EncodeToString(claimsMAC(encoded, c.Secret))
+
+	// Stripe fills in {CHECKOUT_SESSION_ID}, so it mustn't be escaped
+	session, err := checkout.CreateCheckoutSession(r.Context(), &CheckoutSessionRequest{
+		Amount:            amount,
+		Currency:          currency,
+		Description:       description,
+		Resource:          r.URL.Path,
+		SuccessURL:        c.returnURL(r, CheckoutSessionParam+"={CHECKOUT_SESSION_ID}&"+CheckoutStateParam+"="+state),
+		CancelURL:         c.returnURL(r, ""),
+		ClientReferenceID: state,
+		ExpiresAt:         &expires,
+	})
+	if err != nil || session.URL == "" {
+		return nil
+	}
+	return &PaymentOption{
+		Rail:         RailStripeCheckout,
+		DisplayName:  "Pay on a Stripe Checkout page",
+		Type:         RailTypeFiat,
+		Amount:       amount,
+		Currency:     currency,
+		EstimatedFee: estimateFee(rail, amount, currency),
+		NextAction:   &PaymentNextAction{Type: "redirect_to_url", RedirectURL: session.URL},
+	}
+}
+
+// checkState checks that state was issued for r's resource and is current
+func (c *StripeCheckout) checkState(r *http.Request, state string) error {
+	if c == nil {
+		return ErrInvalidCheckoutState
+	}
+	encoded, signature, ok := strings.Cut(state, ".")
+	if !ok {
+		return ErrInvalidCheckoutState
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, claimsMAC(encoded, c.Secret)) {
+		return ErrInvalidCheckoutState
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return ErrInvalidCheckoutState
+	}
+	var claims checkoutState
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Path != r.URL.Path {
+		return ErrInvalidCheckoutState
+	}
+	if !c.clock().Before(time.Unix(claims.ExpiresAt, 0).Add(checkoutReturnGrace)) {
+		return ErrCheckoutStateExpired
+	}
+	return nil
+}
+
+// claim redeems a verified Checkout session, which is honored once
+func (c *StripeCheckout) claim(sessionID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock()
+	if c.used == nil {
+		c.used = make(map[string]int64)
+	}
+	for id, expiry := range c.used {
+		if now.After(time.Unix(expiry, 0).Add(checkoutReturnGrace)) {
+			delete(c.used, id)
+		}
+	}
+	if _, ok := c.used[sessionID]; ok {
+		return ErrCheckoutUsed
+	}
+	// The state is current, so its session can't outlive the longest TTL
+	c.used[sessionID] = now.Add(c.stateTTL()).Unix()
+	return nil
+}
+
+// withoutCheckoutParams returns r without the parameters Stripe returned
+// the buyer with
+func withoutCheckoutParams(r *http.Request) *http.Request {
+	rawQuery := stripQueryParam(stripQueryParam(r.URL.RawQuery, CheckoutSessionParam), CheckoutStateParam)
+	if rawQuery == r.URL.RawQuery {
+		return r
+	}
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = rawQuery
+	r.RequestURI = r.URL.RequestURI()
+	return r
+}
@@ -0,0 +1,226 @@
+package x402
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCheckoutStripe mocks the Checkout API: sessions are created from the
+// posted form and come back paid for amount
+func newCheckoutStripe(t *testing.T, amount int64, forms *[]url.Values) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/checkout/sessions":
+			_ = r.ParseForm()
+			*forms = append(*forms, r.PostForm)
+			fmt.Fprintf(w, `{"id":"cs_%d","url":"https://checkout.stripe.com/c/pay/cs_%d","status":"open","payment_status":"unpaid"}`, len(*forms), len(*forms))
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/checkout/sessions/cs_"):
+			n := 0
+			fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/checkout/sessions/cs_"), "%d", &n)
+			if n < 1 || n > len(*forms) {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error":{"type":"invalid_request_error","message":"No such checkout.session"}}`)
+				return
+			}
+			session := map[string]interface{}{
+				"id":                  fmt.Sprintf("cs_%d", n),
+				"status":              "complete",
+				"payment_status":      "paid",
+				"payment_intent":      fmt.Sprintf("pi_%d", n),
+				"amount_total":        amount,
+				"currency":            "usd",
+				"customer":            "cus_buyer",
+				"client_reference_id": (*forms)[n-1].Get("client_reference_id"),
+			}
+			json.NewEncoder(w).Encode(session)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"type":"invalid_request_error","message":"Unrecognized request URL"}}`)
+		}
+	}))
+}
+
+func newCheckoutHandler(t *testing.T, stripeURL string, receipts *ReceiptCookies) http.Handler {
+	t.Helper()
+	rail := NewStripeRail("sk_test", "")
+	rail.BaseURL = stripeURL
+	registry := NewRailRegistry()
+	registry.Register(rail)
+	return UnifiedPaymentMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("article " + r.URL.RequestURI()))
+	}), UnifiedPaymentConfig{
+		Price:          "5.00",
+		Currency:       "USD",
+		Description:    "Premium article",
+		FiatEnabled:    true,
+		RailRegistry:   registry,
+		StripeCheckout: &StripeCheckout{Secret: []byte("checkout-secret"), BaseURL: "https://news.example.com"},
+		ReceiptCookies: receipts,
+	})
+}
+
+// successPath is the local request Stripe's redirect to form's success URL makes
+func successPath(t *testing.T, form url.Values, sessionID string) string {
+	t.Helper()
+	success := strings.Replace(form.Get("success_url"), "{CHECKOUT_SESSION_ID}", sessionID, 1)
+	u, err := url.Parse(success)
+	if err != nil || u.Host != "news.example.com" {
+		t.Fatalf("Expected a success URL on the seller's origin, got %q", success)
+	}
+	return u.RequestURI()
+}
+
+func TestStripeCheckout_RedirectRoundTrip(t *testing.T) {
+	var forms []url.Values
+	stripeAPI := newCheckoutStripe(t, 500, &forms)
+	defer stripeAPI.Close()
+	handler := newCheckoutHandler(t, stripeAPI.URL, &ReceiptCookies{Secret: []byte("receipt-secret-key")})
+
+	// The 402 offers the hosted page
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/articles/42?lang=en", nil))
+	var response PaymentOptionsResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	var checkout *PaymentOption
+	for i := range response.Options {
+		if response.Options[i].Rail == RailStripeCheckout {
+			checkout = &response.Options[i]
+		}
+	}
+	if w.Code != http.StatusPaymentRequired || checkout == nil {
+		t.Fatalf("Expected a %s option in the 402, got %d with %+v", RailStripeCheckout, w.Code, response.Options)
+	}
+	if checkout.NextAction == nil || checkout.NextAction.Type != "redirect_to_url" || checkout.NextAction.RedirectURL != "https://checkout.stripe.com/c/pay/cs_1" {
+		t.Errorf("Expected a redirect to the Checkout page, got %+v", checkout.NextAction)
+	}
+	form := forms[0]
+	if form.Get("mode") != "payment" || form.Get("line_items[0][price_data][unit_amount]") != "500" || form.Get("line_items[0][price_data][currency]") != "usd" {
+		t.Errorf("Expected a $5.00 payment session, got %v", form)
+	}
+	if form.Get("cancel_url") != "https://news.example.com/articles/42?lang=en" {
+		t.Errorf("Expected the buyer sent back to the resource on cancel, got %q", form.Get("cancel_url"))
+	}
+
+	// Stripe sends the buyer back; they land on the clean URL with a receipt
+	success := successPath(t, form, "cs_1")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", success, nil))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/articles/42?lang=en" {
+		t.Fatalf("Expected a redirect to the resource, got %d to %q: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != DefaultReceiptCookieName {
+		t.Fatalf("Expected a receipt cookie, got %+v", cookies)
+	}
+
+	req := httptest.NewRequest("GET", "/articles/42?lang=en", nil)
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "article /articles/42?lang=en" {
+		t.Errorf("Expected the article served on the receipt, got %d: %s", w.Code, w.Body)
+	}
+
+	// The return URL is honored once
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", success, nil))
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected a replayed return refused, got %d", w.Code)
+	}
+}
+
+func TestStripeCheckout_ReturnChecks(t *testing.T) {
+	var forms []url.Values
+	stripeAPI := newCheckoutStripe(t, 500, &forms)
+	defer stripeAPI.Close()
+	handler := newCheckoutHandler(t, stripeAPI.URL, nil)
+
+	for _, path := range []string{"/articles/1", "/articles/2"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	first := successPath(t, forms[0], "cs_1")
+	state := url.Values{}
+	state.Set(CheckoutSessionParam, "cs_1")
+	state.Set(CheckoutStateParam, forms[1].Get("client_reference_id"))
+
+	tests := []struct {
+		name string
+		path string
+		want int
+	}{
+		{"state for another resource", "/articles/2?" + first[strings.Index(first, "?")+1:], http.StatusPaymentRequired},
+		{"session created for another state", "/articles/2?" + state.Encode(), http.StatusPaymentRequired},
+		{"forged state", strings.Replace(first, "x402_state=", "x402_state=x", 1), http.StatusPaymentRequired},
+		{"paid", first, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d: %s", tt.name, tt.want, w.Code, w.Body)
+		}
+		if tt.want == http.StatusOK && w.Body.String() != "article /articles/1" {
+			t.Errorf("Expected the article served without the checkout parameters, got %q", w.Body)
+		}
+	}
+}
+
+func TestStripeCheckout_StateExpires(t *testing.T) {
+	now := time.Now()
+	checkout := &StripeCheckout{Secret: []byte("checkout-secret"), StateTTL: 30 * time.Minute, now: func() time.Time { return now }}
+	var forms []url.Values
+	stripeAPI := newCheckoutStripe(t, 500, &forms)
+	defer stripeAPI.Close()
+	rail := NewStripeRail("sk_test", "")
+	rail.BaseURL = stripeAPI.URL
+
+	r := httptest.NewRequest("GET", "/articles/1", nil)
+	if checkout.option(r, rail, 500, "USD", "") == nil {
+		t.Fatal("Expected a Checkout option")
+	}
+	if form := forms[0]; form.Get("expires_at") != fmt.Sprint(now.Add(30*time.Minute).Unix()) {
+		t.Errorf("Expected the page to expire with the state, got %q", form.Get("expires_at"))
+	}
+	state := forms[0].Get("client_reference_id")
+
+	now = now.Add(30*time.Minute + checkoutReturnGrace - time.Second)
+	if err := checkout.checkState(r, state); err != nil {
+		t.Errorf("Expected a late return within the grace period accepted, got %v", err)
+	}
+	now = now.Add(time.Second)
+	if err := checkout.checkState(r, state); err != ErrCheckoutStateExpired {
+		t.Errorf("Expected %v, got %v", ErrCheckoutStateExpired, err)
+	}
+}
+
+func TestStripeCheckout_WebhookRecordsLedger(t *testing.T) {
+	ledger := NewInMemoryPaymentLedger(10)
+	rail := NewStripeRail("sk_test", testWebhookSecret)
+	rail.Ledger = ledger
+
+	event := `{"id":"evt_cs_9","type":"checkout.session.completed","data":{"object":{"id":"cs_9","payment_status":"paid","payment_intent":"pi_9","amount_total":500,"currency":"usd","customer":"cus_buyer","metadata":{"resource":"/articles/42"}}}}`
+	for i := 0; i < 2; i++ { // Stripe retries deliveries
+		w := httptest.NewRecorder()
+		rail.WebhookHandler().ServeHTTP(w, signedWebhook(testWebhookSecret, []byte(event)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the webhook accepted, got %d", w.Code)
+		}
+	}
+
+	records, _ := ledger.List(LedgerFilter{})
+	if len(records) != 1 {
+		t.Fatalf("Expected the session recorded once, got %d records", len(records))
+	}
+	record := records[0]
+	if record.ID != "cs_9" || record.Amount != 500 || record.Currency != "USD" || record.Endpoint != "/articles/42" || record.TransactionID != "pi_9" || record.Status != PaymentStatusSettled {
+		t.Errorf("Expected a settled $5.00 record for /articles/42, got %+v", record)
+	}
+}
@@ -0,0 +1,480 @@
+// Package x402 - Stripe Subscriptions
+// Classic monthly (or yearly) subscriptions as an alternative to paying per
+// request. StripeRail creates the plan's Price and the customer's
+// Subscription; its webhook activates the subscription on invoice.paid and
+// deactivates it on customer.subscription.deleted. While a subscription is
+// active and under its request quota, X-Subscription-Token skips payment.
+package x402
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subscription errors, also used as the reason in 402 responses
+var (
+	ErrSubscriptionNotFound      = kindOf(ErrNotFound, "subscription not found")
+	ErrSubscriptionInactive      = errors.New("subscription is not active")
+	ErrSubscriptionQuotaExceeded = errors.New("subscription request quota exhausted for this period")
+)
+
+// SubscriptionTokenHeader carries the token returned by CreateSubscription
+const SubscriptionTokenHeader = "X-Subscription-Token"
+
+// SubscriptionCustomerHeader carries the Stripe customer ID when
+// SubscriptionConfig.AcceptCustomerID is set
+const SubscriptionCustomerHeader = "X-Stripe-Customer"
+
+// PaymentMethodSubscription is the X-Payment-Method of requests covered by a
+// subscription
+const PaymentMethodSubscription = "subscription"
+
+// SubscriptionStatus is the lifecycle state of a subscription
+type SubscriptionStatus string
+
+const (
+	SubscriptionPending  SubscriptionStatus = "pending"  // Created, first invoice not paid yet
+	SubscriptionActive   SubscriptionStatus = "active"   // Invoice paid for the current period
+	SubscriptionCanceled SubscriptionStatus = "canceled" // Deleted in Stripe
+)
+
+// SubscriptionPlan is a recurring price customers can subscribe to
+type SubscriptionPlan struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Amount   int64  `json:"amount"`   // Per interval, in the currency's smallest unit
+	Currency string `json:"currency"` // e.g. USD
+	Interval string `json:"interval"` // month or year
+
+	// RequestQuota is the number of requests per billing period (0 = unlimited)
+	RequestQuota int64 `json:"requestQuota,omitempty"`
+
+	// StripePriceID is the Stripe Price, from CreatePrice or the dashboard
+	StripePriceID string `json:"stripePriceId,omitempty"`
+}
+
+// Subscription is a customer's Stripe subscription to a plan
+type Subscription struct {
+	ID         string             `json:"id"` // Stripe subscription ID
+	CustomerID string             `json:"customerId"`
+	PlanID     string             `json:"planId"`
+	Status     SubscriptionStatus `json:"status"`
+
+	// Token is presented in X-Subscription-Token instead of paying
+	Token string `json:"token"`
+
+	RequestQuota       int64     `json:"requestQuota,omitempty"` // 0 = unlimited
+	UsedRequests       int64     `json:"usedRequests"`
+	CurrentPeriodStart time.Time `json:"currentPeriodStart,omitempty"`
+	CurrentPeriodEnd   time.Time `json:"currentPeriodEnd,omitempty"`
+	CreatedAt          time.Time `json:"createdAt"`
+}
+
+// Remaining returns the requests left this period, or -1 for unlimited
+func (s *Subscription) Remaining() int64 {
+	if s.RequestQuota == 0 {
+		return -1
+	}
+	if s.UsedRequests >= s.RequestQuota {
+		return 0
+	}
+	return s.RequestQuota - s.UsedRequests
+}
+
+// SubscriptionStore maps Stripe customers to their subscription.
+// ConsumeSubscription must check and count a request atomically so quotas
+// hold under concurrent requests.
+type SubscriptionStore interface {
+	SaveSubscription(sub *Subscription) error
+	GetSubscription(id string) (*Subscription, error)
+	GetSubscriptionByCustomer(customerID string) (*Subscription, error)
+	GetSubscriptionByToken(token string) (*Subscription, error)
+	ConsumeSubscription(id string) (*Subscription, error)
+}
+
+// InMemorySubscriptionStore is an in-memory SubscriptionStore. A customer
+// maps to their most recently activated subscription.
+type InMemorySubscriptionStore struct {
+	mu            sync.Mutex
+	subscriptions map[string]*Subscription
+	byCustomer    map[string]string
+	byToken       map[string]string
+}
+
+// NewInMemorySubscriptionStore creates an empty subscription store
+func NewInMemorySubscriptionStore() *InMemorySubscriptionStore {
+	return &InMemorySubscriptionStore{
+		subscriptions: make(map[string]*Subscription),
+		byCustomer:    make(map[string]string),
+		byToken:       make(map[string]string),
+	}
+}
+
+// SaveSubscription creates or replaces a subscription
+func (s *InMemorySubscriptionStore) SaveSubscription(sub *Subscription) error {
+	if sub.ID == "" {
+		return fmt.Errorf("subscription ID is required")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved := *sub
+	if old, ok := s.subscriptions[sub.ID]; ok && old.Token != saved.Token {
+		delete(s.byToken, old.Token)
+	}
+	s.subscriptions[saved.ID] = &saved
+	if saved.Token != "" {
+		s.byToken[saved.Token] = saved.ID
+	}
+	if _, mapped := s.byCustomer[saved.CustomerID]; !mapped || saved.Status == SubscriptionActive {
+		s.byCustomer[saved.CustomerID] = saved.ID
+	}
+	return nil
+}
+
+// GetSubscription returns a copy of a subscription
+func (s *InMemorySubscriptionStore) GetSubscription(id string) (*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(id)
+}
+
+// GetSubscriptionByCustomer returns the customer's subscription
+func (s *InMemorySubscriptionStore) GetSubscriptionByCustomer(customerID string) (*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(s.byCustomer[customerID])
+}
+
+// GetSubscriptionByToken returns the subscription with token
+func (s *InMemorySubscriptionStore) GetSubscriptionByToken(token string) (*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(s.byToken[token])
+}
+
+// ConsumeSubscription counts one request against an active subscription
+func (s *InMemorySubscriptionStore) ConsumeSubscription(id string) (*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscriptions[id]
+	if !ok {
+		return nil, ErrSubscriptionNotFound
+	}
+	if sub.Status != SubscriptionActive {
+		return nil, ErrSubscriptionInactive
+	}
+	if sub.Remaining() == 0 {
+		return nil, ErrSubscriptionQuotaExceeded
+	}
+	sub.UsedRequests++
+
+	consumed := *sub
+	return &consumed, nil
+}
+
+func (s *InMemorySubscriptionStore) get(id string) (*Subscription, error) {
+	sub, ok := s.subscriptions[id]
+	if !ok {
+		return nil, ErrSubscriptionNotFound
+	}
+	found := *sub
+	return &found, nil
+}
+
+// SubscriptionConfig connects StripeRail and the middleware to the plans and
+// subscription store. Share one value between both.
+type SubscriptionConfig struct {
+	Store SubscriptionStore
+	Plans []SubscriptionPlan
+
+	// Endpoint where clients subscribe, advertised in 402 responses
+	Endpoint string
+
+	// AcceptCustomerID also accepts the Stripe customer ID in
+	// X-Stripe-Customer. Only enable it when customer IDs are not exposed to
+	// other clients, since they are not secret like tokens.
+	AcceptCustomerID bool
+}
+
+// Plan returns the plan with id
+func (c *SubscriptionConfig) Plan(id string) (SubscriptionPlan, bool) {
+	for _, plan := range c.Plans {
+		if plan.ID == id {
+			return plan, true
+		}
+	}
+	return SubscriptionPlan{}, false
+}
+
+// planByPrice returns the plan billed with a Stripe Price
+func (c *SubscriptionConfig) planByPrice(priceID string) (SubscriptionPlan, bool) {
+	for _, plan := range c.Plans {
+		if plan.StripePriceID != "" && plan.StripePriceID == priceID {
+			return plan, true
+		}
+	}
+	return SubscriptionPlan{}, false
+}
+
+// consume counts a request against the subscription presented with r. It
+// returns nil, nil when none is presented.
+func (c *SubscriptionConfig) consume(r *http.Request) (*Subscription, error) {
+	if c == nil || c.Store == nil {
+		return nil, nil
+	}
+
+	var sub *Subscription
+	var err error
+	if token := r.Header.Get(SubscriptionTokenHeader); token != "" {
+		sub, err = c.Store.GetSubscriptionByToken(token)
+	} else if customer := r.Header.Get(SubscriptionCustomerHeader); customer != "" && c.AcceptCustomerID {
+		sub, err = c.Store.GetSubscriptionByCustomer(customer)
+	} else {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.Store.ConsumeSubscription(sub.ID)
+}
+
+// offer describes the plans for 402 responses
+func (c *SubscriptionConfig) offer() *SubscriptionOffer {
+	if c == nil || len(c.Plans) == 0 {
+		return nil
+	}
+	return &SubscriptionOffer{
+		Plans:       c.Plans,
+		Endpoint:    c.Endpoint,
+		TokenHeader: SubscriptionTokenHeader,
+	}
+}
+
+// SubscriptionOffer advertises subscription plans in 402 responses
+type SubscriptionOffer struct {
+	Plans       []SubscriptionPlan `json:"plans"`
+	Endpoint    string             `json:"endpoint,omitempty"`
+	TokenHeader string             `json:"tokenHeader"`
+}
+
+// setSubscriptionHeaders reports the requests left on a subscription
+func setSubscriptionHeaders(w http.ResponseWriter, sub *Subscription) {
+	remaining := "unlimited"
+	if n := sub.Remaining(); n >= 0 {
+		remaining = strconv.FormatInt(n, 10)
+	}
+	w.Header().Set("X-Subscription-Remaining", remaining)
+}
+
+// subscriptionMessage explains a subscription that could not be used in a
+// 402. Store errors other than the subscription errors above are not exposed.
+func subscriptionMessage(err error) string {
+	for _, known := range []error{ErrSubscriptionNotFound, ErrSubscriptionInactive, ErrSubscriptionQuotaExceeded} {
+		if errors.Is(err, known) {
+			return "Subscription cannot be used: " + known.Error()
+		}
+	}
+	return "Subscription cannot be used: subscription could not be checked"
+}
+
+// ===============================================
+// STRIPE SUBSCRIPTION API
+// ===============================================
+
+// CreatePrice creates a recurring Stripe Price (and its product) for plan
+// and returns the price ID to set as plan.StripePriceID
+func (s *StripeRail) CreatePrice(ctx context.Context, plan SubscriptionPlan) (string, error) {
+	interval := plan.Interval
+	if interval == "" {
+		interval = "month"
+	}
+	form := url.Values{
+		"unit_amount":         {strconv.FormatInt(plan.Amount, 10)},
+		"currency":            {strings.ToLower(plan.Currency)},
+		"recurring[interval]": {interval},
+		"product_data[name]":  {plan.Name},
+		"metadata[plan]":      {plan.ID},
+	}
+
+	var price struct {
+		ID string `json:"id"`
+	}
+	if err := s.postForm(ctx, "/prices", form, &price); err != nil {
+		return "", err
+	}
+	return price.ID, nil
+}
+
+// CreateSubscription subscribes a Stripe customer to planID and stores the
+// subscription as pending until its first invoice is paid. The returned
+// subscription's Token is what the customer presents in requests.
+func (s *StripeRail) CreateSubscription(ctx context.Context, customerID, planID string) (*Subscription, error) {
+	if s.Subscriptions == nil || s.Subscriptions.Store == nil {
+		return nil, fmt.Errorf("stripe subscriptions are not configured")
+	}
+	plan, ok := s.Subscriptions.Plan(planID)
+	if !ok {
+		return nil, fmt.Errorf("unknown subscription plan %q", planID)
+	}
+	if plan.StripePriceID == "" {
+		return nil, fmt.Errorf("subscription plan %q has no Stripe price", planID)
+	}
+
+	form := url.Values{
+		"customer":         {customerID},
+		"items[0][price]":  {plan.StripePriceID},
+		"metadata[plan]":   {plan.ID},
+		"payment_behavior": {"default_incomplete"},
+	}
+	var created struct {
+		ID       string `json:"id"`
+		Customer string `json:"customer"`
+	}
+	if err := s.postForm(ctx, "/subscriptions", form, &created); err != nil {
+		return nil, err
+	}
+
+	sub := &Subscription{
+		ID:           created.ID,
+		CustomerID:   customerID,
+		PlanID:       plan.ID,
+		Status:       SubscriptionPending,
+		Token:        generateSubscriptionToken(),
+		RequestQuota: plan.RequestQuota,
+		CreatedAt:    time.Now(),
+	}
+	if err := s.Subscriptions.Store.SaveSubscription(sub); err != nil {
+		return nil, fmt.Errorf("failed to save subscription: %w", err)
+	}
+	return sub, nil
+}
+
+// postForm POSTs a form to the Stripe API and decodes the response into out
+func (s *StripeRail) postForm(ctx context.Context, path string, form url.Values, out interface{}) error {
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", s.BaseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	httpReq.Header.Set("Authorization", "Bearer "+s.SecretKey)
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return &StripeError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return newStripeError(resp.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	return nil
+}
+
+// ===============================================
+// STRIPE SUBSCRIPTION WEBHOOKS
+// ===============================================
+
+// stripeInvoice is the part of an invoice.paid event used for activation
+type stripeInvoice struct {
+	Subscription string `json:"subscription"`
+	Customer     string `json:"customer"`
+	Lines        struct {
+		Data []struct {
+			Price struct {
+				ID string `json:"id"`
+			} `json:"price"`
+			Period struct {
+				Start int64 `json:"start"`
+				End   int64 `json:"end"`
+			} `json:"period"`
+		} `json:"data"`
+	} `json:"lines"`
+}
+
+// activateSubscription starts a new paid period: the subscription becomes
+// active and its quota resets. Subscriptions created outside
+// CreateSubscription (e.g. through Checkout) are added with a new token.
+func (s *StripeRail) activateSubscription(data json.RawMessage) error {
+	var event struct {
+		Object stripeInvoice `json:"object"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+	invoice := event.Object
+	if invoice.Subscription == "" {
+		return nil // Not a subscription invoice
+	}
+
+	sub, err := s.Subscriptions.Store.GetSubscription(invoice.Subscription)
+	if errors.Is(err, ErrSubscriptionNotFound) {
+		sub = &Subscription{
+			ID:         invoice.Subscription,
+			CustomerID: invoice.Customer,
+			Token:      generateSubscriptionToken(),
+			CreatedAt:  time.Now(),
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if len(invoice.Lines.Data) > 0 {
+		line := invoice.Lines.Data[0]
+		if plan, ok := s.Subscriptions.planByPrice(line.Price.ID); ok {
+			sub.PlanID = plan.ID
+			sub.RequestQuota = plan.RequestQuota
+		}
+		sub.CurrentPeriodStart = time.Unix(line.Period.Start, 0)
+		sub.CurrentPeriodEnd = time.Unix(line.Period.End, 0)
+	}
+	sub.Status = SubscriptionActive
+	sub.UsedRequests = 0
+	return s.Subscriptions.Store.SaveSubscription(sub)
+}
+
+// cancelSubscription deactivates a subscription deleted in Stripe
+func (s *StripeRail) cancelSubscription(data json.RawMessage) error {
+	var event struct {
+		Object struct {
+			ID string `json:"id"`
+		} `json:"object"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+
+	sub, err := s.Subscriptions.Store.GetSubscription(event.Object.ID)
+	if errors.Is(err, ErrSubscriptionNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sub.Status = SubscriptionCanceled
+	return s.Subscriptions.Store.SaveSubscription(sub)
+}
+
+// generateSubscriptionToken creates an unguessable subscription token
+func generateSubscriptionToken() string {
+	b := make([]byte, 24)
+	_, _ = rand.Read(b)
+	return "subtok_" + hex.EncodeToString(b)
+}
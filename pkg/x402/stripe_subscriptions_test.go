@@ -0,0 +1,243 @@
+package x402
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testWebhookSecret = "whsec_test"
+
+// newSubscriptionStripe fakes the Stripe price and subscription endpoints
+func newSubscriptionStripe(t *testing.T, subs *SubscriptionConfig) *StripeRail {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("Failed to parse form: %v", err)
+		}
+		switch r.URL.Path {
+		case "/prices":
+			if r.PostForm.Get("recurring[interval]") != "month" || r.PostForm.Get("unit_amount") != "1000" {
+				t.Errorf("Unexpected price form: %v", r.PostForm)
+			}
+			fmt.Fprint(w, `{"id": "price_basic"}`)
+		case "/subscriptions":
+			if r.PostForm.Get("items[0][price]") != "price_basic" {
+				t.Errorf("Expected subscription to price_basic, got %v", r.PostForm)
+			}
+			fmt.Fprintf(w, `{"id": "sub_1", "customer": %q, "status": "incomplete"}`, r.PostForm.Get("customer"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	rail := NewStripeRail("sk_test", testWebhookSecret)
+	rail.BaseURL = server.URL
+	rail.Subscriptions = subs
+	return rail
+}
+
+// testEventSeq numbers the webhook events tests send
+var testEventSeq atomic.Int64
+
+// signedWebhook is a webhook delivery of payload signed with secret now
+func signedWebhook(secret string, payload []byte) *http.Request {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + string(payload)))
+
+	req := httptest.NewRequest("POST", "/webhooks/stripe", strings.NewReader(string(payload)))
+	req.Header.Set("Stripe-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+// sendStripeEvent posts a new webhook event signed with secret
+func sendStripeEvent(rail *StripeRail, secret, eventType string, object interface{}) int {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"id":   fmt.Sprintf("evt_%d", testEventSeq.Add(1)),
+		"type": eventType,
+		"data": map[string]interface{}{"object": object},
+	})
+	w := httptest.NewRecorder()
+	rail.WebhookHandler().ServeHTTP(w, signedWebhook(secret, payload))
+	return w.Code
+}
+
+func paidInvoice(sub *Subscription) map[string]interface{} {
+	return map[string]interface{}{
+		"subscription": sub.ID,
+		"customer":     sub.CustomerID,
+		"lines": map[string]interface{}{
+			"data": []map[string]interface{}{{
+				"price":  map[string]string{"id": "price_basic"},
+				"period": map[string]int64{"start": 1700000000, "end": 1702592000},
+			}},
+		},
+	}
+}
+
+func subscriptionRequest(token string) *http.Request {
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set(SubscriptionTokenHeader, token)
+	return req
+}
+
+func TestSubscriptionActivationAndQuota(t *testing.T) {
+	subs := &SubscriptionConfig{
+		Store: NewInMemorySubscriptionStore(),
+		Plans: []SubscriptionPlan{{ID: "basic", Name: "Basic", Amount: 1000, Currency: "USD", Interval: "month", RequestQuota: 2}},
+	}
+	rail := newSubscriptionStripe(t, subs)
+
+	priceID, err := rail.CreatePrice(context.Background(), subs.Plans[0])
+	if err != nil || priceID != "price_basic" {
+		t.Fatalf("Expected price_basic, got %q, %v", priceID, err)
+	}
+	subs.Plans[0].StripePriceID = priceID
+
+	sub, err := rail.CreateSubscription(context.Background(), "cus_1", "basic")
+	if err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	if sub.Status != SubscriptionPending || sub.Token == "" {
+		t.Errorf("Expected pending subscription with a token, got %+v", sub)
+	}
+
+	registry := NewRailRegistry()
+	registry.Register(rail)
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		PricePerRequest: 100,
+		CryptoEnabled:   true,
+		CryptoNetworks:  []NetworkType{NetworkBaseSepolia},
+		RailRegistry:    registry,
+		Subscriptions:   subs,
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, subscriptionRequest(sub.Token))
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402 before the first invoice is paid, got %d", w.Code)
+	}
+
+	if code := sendStripeEvent(rail, "whsec_wrong", "invoice.paid", paidInvoice(sub)); code != http.StatusBadRequest {
+		t.Errorf("Expected badly signed webhook to be rejected, got %d", code)
+	}
+	if code := sendStripeEvent(rail, testWebhookSecret, "invoice.paid", paidInvoice(sub)); code != http.StatusOK {
+		t.Fatalf("Expected webhook to be accepted, got %d", code)
+	}
+
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, subscriptionRequest(sub.Token))
+		if w.Code != http.StatusOK || w.Header().Get("X-Payment-Method") != PaymentMethodSubscription {
+			t.Fatalf("Expected subscription access, got %d", w.Code)
+		}
+	}
+	if remaining := w.Header().Get("X-Subscription-Remaining"); remaining != "0" {
+		t.Errorf("Expected 0 requests remaining, got %q", remaining)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, subscriptionRequest(sub.Token))
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402 once the quota is used up, got %d", w.Code)
+	}
+	var response PaymentOptionsResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !strings.Contains(response.Error, ErrSubscriptionQuotaExceeded.Error()) {
+		t.Errorf("Expected quota message, got %q", response.Error)
+	}
+	if response.Subscriptions == nil || len(response.Subscriptions.Plans) != 1 || response.Subscriptions.Plans[0].ID != "basic" {
+		t.Errorf("Expected the basic plan to be advertised, got %+v", response.Subscriptions)
+	}
+
+	// A renewal resets the quota; deletion ends access
+	sendStripeEvent(rail, testWebhookSecret, "invoice.paid", paidInvoice(sub))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, subscriptionRequest(sub.Token))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected access after renewal, got %d", w.Code)
+	}
+
+	sendStripeEvent(rail, testWebhookSecret, "customer.subscription.deleted", map[string]string{"id": sub.ID})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, subscriptionRequest(sub.Token))
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 after cancellation, got %d", w.Code)
+	}
+}
+
+func TestStripeWebhook_FreshSignedEventsOnce(t *testing.T) {
+	store := NewInMemorySubscriptionStore()
+	sub := &Subscription{ID: "sub_1", CustomerID: "cus_1", Status: SubscriptionPending, Token: "tok"}
+	store.SaveSubscription(sub)
+	subs := &SubscriptionConfig{Store: store}
+
+	// No secret: nothing is trusted
+	unsigned := NewStripeRail("sk_test", "")
+	unsigned.Subscriptions = subs
+	if code := sendStripeEvent(unsigned, "", "invoice.paid", paidInvoice(sub)); code != http.StatusInternalServerError {
+		t.Errorf("Expected webhooks refused without a secret, got %d", code)
+	}
+	if err := (UnifiedPaymentConfig{FiatEnabled: true, Subscriptions: subs}).Validate(); err == nil {
+		t.Error("Expected Subscriptions without StripeWebhookSecret rejected")
+	}
+
+	rail := NewStripeRail("sk_test", testWebhookSecret)
+	rail.Subscriptions = subs
+
+	// A delivery signed outside the tolerance is refused
+	payload, _ := json.Marshal(map[string]interface{}{"id": "evt_paid", "type": "invoice.paid", "data": map[string]interface{}{"object": paidInvoice(sub)}})
+	rail.now = func() time.Time { return time.Now().Add(DefaultWebhookTolerance + time.Minute) }
+	w := httptest.NewRecorder()
+	rail.WebhookHandler().ServeHTTP(w, signedWebhook(testWebhookSecret, payload))
+	if stored, _ := store.GetSubscription("sub_1"); w.Code != http.StatusBadRequest || stored.Status == SubscriptionActive {
+		t.Errorf("Expected a stale delivery refused, got %d and %s", w.Code, stored.Status)
+	}
+	rail.now = nil
+
+	// A replay of a handled event is acknowledged but not handled again
+	w = httptest.NewRecorder()
+	rail.WebhookHandler().ServeHTTP(w, signedWebhook(testWebhookSecret, payload))
+	if stored, _ := store.GetSubscription("sub_1"); w.Code != http.StatusOK || stored.Status != SubscriptionActive {
+		t.Fatalf("Expected the event activating the subscription, got %d and %s", w.Code, stored.Status)
+	}
+	canceled, _ := store.GetSubscription("sub_1")
+	canceled.Status = SubscriptionCanceled
+	store.SaveSubscription(canceled)
+	w = httptest.NewRecorder()
+	rail.WebhookHandler().ServeHTTP(w, signedWebhook(testWebhookSecret, payload))
+	if stored, _ := store.GetSubscription("sub_1"); w.Code != http.StatusOK || stored.Status != SubscriptionCanceled {
+		t.Errorf("Expected a replayed event ignored, got %d and %s", w.Code, stored.Status)
+	}
+}
+
+func TestSubscriptionByCustomerID(t *testing.T) {
+	store := NewInMemorySubscriptionStore()
+	store.SaveSubscription(&Subscription{ID: "sub_1", CustomerID: "cus_1", Status: SubscriptionActive, Token: "tok"})
+
+	subs := &SubscriptionConfig{Store: store}
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set(SubscriptionCustomerHeader, "cus_1")
+
+	if sub, err := subs.consume(req); sub != nil || err != nil {
+		t.Errorf("Expected customer ID to be ignored by default, got %+v, %v", sub, err)
+	}
+	subs.AcceptCustomerID = true
+	if sub, err := subs.consume(req); err != nil || sub.ID != "sub_1" || sub.Remaining() != -1 {
+		t.Errorf("Expected unlimited subscription for cus_1, got %+v, %v", sub, err)
+	}
+}
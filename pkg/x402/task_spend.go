@@ -0,0 +1,240 @@
+// Package x402 - Agent Task Spend
+// Agents tag requests with X-Agent-Task-ID, but an orchestrator also needs to
+// know what a task cost in total ("task_123 spent 4000 over 40 requests").
+// The middlewares add each paid request to a TaskSpendStore, return the
+// running total in X-Task-Spent, and TaskSpendHandler serves the summary.
+// The in-memory store keeps a bounded set of recently active tasks.
+package x402
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TaskIDHeader names the agent task a request belongs to
+const TaskIDHeader = "X-Agent-Task-ID"
+
+// maxTaskIDLength bounds task IDs taken from requests; longer IDs are not tracked
+const maxTaskIDLength = 128
+
+// otherEndpoints collects spend on endpoints past a task's endpoint limit
+const otherEndpoints = "other"
+
+// ErrTaskNotFound is returned for tasks that were never seen or were evicted
+var ErrTaskNotFound = kindOf(ErrNotFound, "task not found")
+
+// TaskSpend summarizes what one agent task has paid. Amounts are summed as
+// charged, in the middleware's price units.
+type TaskSpend struct {
+	TaskID    string                    `json:"taskId"`
+	Spent     int64                     `json:"spent"`
+	Requests  int64                     `json:"requests"`
+	Currency  string                    `json:"currency,omitempty"`
+	Endpoints map[string]*EndpointSpend `json:"endpoints"` // "METHOD /path" -> spend
+	FirstSeen time.Time                 `json:"firstSeen"`
+	LastSeen  time.Time                 `json:"lastSeen"`
+}
+
+// EndpointSpend is a task's spend on one endpoint
+type EndpointSpend struct {
+	Spent    int64 `json:"spent"`
+	Requests int64 `json:"requests"`
+}
+
+func (t *TaskSpend) clone() *TaskSpend {
+	cp := *t
+	cp.Endpoints = make(map[string]*EndpointSpend, len(t.Endpoints))
+	for k, v := range t.Endpoints {
+		e := *v
+		cp.Endpoints[k] = &e
+	}
+	return &cp
+}
+
+// TaskSpendStore accumulates spend per task. Summaries returned by any
+// method must be copies.
+type TaskSpendStore interface {
+	// Add records one paid request and returns the task's updated summary
+	Add(taskID, endpoint string, amount int64, currency string) (*TaskSpend, error)
+
+	// Get returns a task's summary or ErrTaskNotFound
+	Get(taskID string) (*TaskSpend, error)
+}
+
+// TaskSpendLimits bound the memory an InMemoryTaskSpendStore uses
+type TaskSpendLimits struct {
+	// MaxTasks kept; the least recently active is evicted (default 10000)
+	MaxTasks int
+
+	// Retention drops tasks with no spend for this long (default 24h)
+	Retention time.Duration
+
+	// MaxEndpointsPerTask caps the breakdown; further endpoints are
+	// counted under "other" (default 50)
+	MaxEndpointsPerTask int
+}
+
+// InMemoryTaskSpendStore keeps recently active tasks in memory
+type InMemoryTaskSpendStore struct {
+	mu     sync.Mutex
+	limits TaskSpendLimits
+	ll     *list.List // most recently active first
+	tasks  map[string]*list.Element
+
+	// now is stubbed in tests
+	now func() time.Time
+}
+
+// NewInMemoryTaskSpendStore creates a task spend store with limits
+func NewInMemoryTaskSpendStore(limits TaskSpendLimits) *InMemoryTaskSpendStore {
+	if limits.MaxTasks <= 0 {
+		limits.MaxTasks = 10000
+	}
+	if limits.Retention <= 0 {
+		limits.Retention = 24 * time.Hour
+	}
+	if limits.MaxEndpointsPerTask <= 0 {
+		limits.MaxEndpointsPerTask = 50
+	}
+	return &InMemoryTaskSpendStore{
+		limits: limits,
+		ll:     list.New(),
+		tasks:  make(map[string]*list.Element),
+	}
+}
+
+func (s *InMemoryTaskSpendStore) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// Add records one paid request against taskID
+func (s *InMemoryTaskSpendStore) Add(taskID, endpoint string, amount int64, currency string) (*TaskSpend, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock()
+	s.expire(now)
+
+	var task *TaskSpend
+	if el, ok := s.tasks[taskID]; ok {
+		task = el.Value.(*TaskSpend)
+		s.ll.MoveToFront(el)
+	} else {
+		task = &TaskSpend{TaskID: taskID, Currency: currency, Endpoints: make(map[string]*EndpointSpend), FirstSeen: now}
+		s.tasks[taskID] = s.ll.PushFront(task)
+		if s.ll.Len() > s.limits.MaxTasks {
+			s.remove(s.ll.Back())
+		}
+	}
+
+	task.Spent += amount
+	task.Requests++
+	task.LastSeen = now
+
+	spend, ok := task.Endpoints[endpoint]
+	if !ok {
+		if len(task.Endpoints) >= s.limits.MaxEndpointsPerTask {
+			endpoint = otherEndpoints
+		}
+		if spend, ok = task.Endpoints[endpoint]; !ok {
+			spend = &EndpointSpend{}
+			task.Endpoints[endpoint] = spend
+		}
+	}
+	spend.Spent += amount
+	spend.Requests++
+	return task.clone(), nil
+}
+
+// Get returns taskID's summary
+func (s *InMemoryTaskSpendStore) Get(taskID string) (*TaskSpend, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(s.clock())
+	el, ok := s.tasks[taskID]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	return el.Value.(*TaskSpend).clone(), nil
+}
+
+// Len returns the number of tracked tasks
+func (s *InMemoryTaskSpendStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ll.Len()
+}
+
+// expire drops tasks idle for longer than the retention, oldest first
+func (s *InMemoryTaskSpendStore) expire(now time.Time) {
+	for el := s.ll.Back(); el != nil; el = s.ll.Back() {
+		if now.Sub(el.Value.(*TaskSpend).LastSeen) <= s.limits.Retention {
+			return
+		}
+		s.remove(el)
+	}
+}
+
+func (s *InMemoryTaskSpendStore) remove(el *list.Element) {
+	s.ll.Remove(el)
+	delete(s.tasks, el.Value.(*TaskSpend).TaskID)
+}
+
+// recordTaskSpend adds a paid request to its agent task, if it names one,
+// and reports the task's running total in X-Task-Spent
+func recordTaskSpend(store TaskSpendStore, w http.ResponseWriter, r *http.Request, amount int64, currency string) {
+	if store == nil {
+		return
+	}
+	taskID := r.Header.Get(TaskIDHeader)
+	if taskID == "" || len(taskID) > maxTaskIDLength {
+		return
+	}
+	task, err := store.Add(taskID, r.Method+" "+r.URL.Path, amount, currency)
+	if err != nil {
+		return
+	}
+	w.Header().Set("X-Task-Spent", strconv.FormatInt(task.Spent, 10))
+}
+
+// TaskSpendHandler serves GET .../tasks/{id}/spend with the task's summary.
+// Anyone who knows a task ID can read its spend, so mount it where agents
+// are authenticated or use unguessable task IDs.
+func TaskSpendHandler(store TaskSpendStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+			return
+		}
+
+		rest, ok := strings.CutSuffix(r.URL.Path, "/spend")
+		i := strings.LastIndex(rest, "/tasks/")
+		if !ok || i < 0 {
+			http.Error(w, `{"error":"expected /tasks/{id}/spend"}`, http.StatusNotFound)
+			return
+		}
+		taskID := rest[i+len("/tasks/"):]
+
+		task, err := store.Get(taskID)
+		if errors.Is(err, ErrTaskNotFound) {
+			http.Error(w, `{"error":"task not found"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, `{"error":"failed to load task"}`, http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(task)
+	}
+}
@@ -0,0 +1,104 @@
+package x402
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTaskSpend_AccumulatesAcrossRequests(t *testing.T) {
+	store := NewInMemoryTaskSpendStore(TaskSpendLimits{})
+	exemptions := NewExemptionList()
+	mux := http.NewServeMux()
+	mux.Handle("/", createTestHandler())
+	if _, err := MountStandardEndpoints(mux, StandardEndpointDeps{TaskSpend: store}, MountOptions{Exemptions: exemptions}); err != nil {
+		t.Fatalf("MountStandardEndpoints failed: %v", err)
+	}
+	config := testConfig()
+	config.TaskSpend = store
+	config.DynamicExemptions = exemptions
+	handler := Middleware(mux, config)
+
+	send := func(path, token, task string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("X-PAYMENT", token)
+		}
+		if task != "" {
+			req.Header.Set("X-Agent-Task-ID", task)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for i, path := range []string{"/api/search", "/api/search", "/api/summarize"} {
+		w := send(path, "valid_token", "task_123")
+		if want := []string{"100", "200", "300"}[i]; w.Header().Get("X-Task-Spent") != want {
+			t.Errorf("Request %d: expected X-Task-Spent %s, got %q", i, want, w.Header().Get("X-Task-Spent"))
+		}
+	}
+	send("/api/search", "", "task_123")              // Unpaid: not counted
+	send("/api/search", "valid_token", "")           // No task
+	send("/api/search", "valid_token", "task_other") // Another task
+
+	w := send("/x402/tasks/task_123/spend", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the summary without payment, got %d", w.Code)
+	}
+	var summary TaskSpend
+	if err := json.NewDecoder(w.Body).Decode(&summary); err != nil {
+		t.Fatalf("Invalid summary: %v", err)
+	}
+	if summary.Spent != 300 || summary.Requests != 3 || summary.Currency != "USD" {
+		t.Errorf("Expected 300 over 3 requests, got %+v", summary)
+	}
+	if e := summary.Endpoints["GET /api/search"]; e == nil || e.Spent != 200 || e.Requests != 2 {
+		t.Errorf("Expected 200 on /api/search, got %+v", e)
+	}
+	if e := summary.Endpoints["GET /api/summarize"]; e == nil || e.Spent != 100 {
+		t.Errorf("Expected 100 on /api/summarize, got %+v", e)
+	}
+
+	if w := send("/x402/tasks/unknown/spend", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown task, got %d", w.Code)
+	}
+}
+
+func TestInMemoryTaskSpendStore_Eviction(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewInMemoryTaskSpendStore(TaskSpendLimits{MaxTasks: 2, Retention: time.Hour, MaxEndpointsPerTask: 2})
+	store.now = func() time.Time { return now }
+
+	store.Add("a", "GET /x", 10, "USD")
+	store.Add("b", "GET /x", 10, "USD")
+	store.Add("a", "GET /y", 10, "USD") // a is now the most recently active
+	store.Add("c", "GET /x", 10, "USD") // evicts b
+
+	if _, err := store.Get("b"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("Expected the least recently active task to be evicted, got %v", err)
+	}
+	if task, err := store.Get("a"); err != nil || task.Spent != 20 {
+		t.Errorf("Expected a to be kept with 20 spent, got %+v %v", task, err)
+	}
+
+	// Endpoints past the cap are counted under "other"
+	task, _ := store.Add("a", "GET /z", 10, "USD")
+	if task.Endpoints[otherEndpoints] == nil || task.Endpoints[otherEndpoints].Spent != 10 || len(task.Endpoints) != 3 {
+		t.Errorf("Expected /z to be counted under other, got %v", task.Endpoints)
+	}
+
+	// Idle tasks expire after the retention
+	now = now.Add(30 * time.Minute)
+	store.Add("c", "GET /x", 10, "USD")
+	now = now.Add(45 * time.Minute)
+	if _, err := store.Get("a"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("Expected a to expire, got %v", err)
+	}
+	if store.Len() != 1 {
+		t.Errorf("Expected only c to remain, got %d tasks", store.Len())
+	}
+}
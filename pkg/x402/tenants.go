@@ -0,0 +1,201 @@
+// Package x402 - Tenants
+// One server can sell several customers' APIs. TenantStores gives each
+// tenant, named per request by a TenantResolver (e.g. from the Host or a
+// header), its own budget, session, payment preference and metering stores,
+// so IDs can't collide and records can't leak between tenants. Middlewares,
+// handlers and the admin API given a TenantStores use the request tenant's
+// stores in place of their own.
+package x402
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TenantResolver names the tenant a request is for ("" is the default
+// tenant)
+type TenantResolver func(r *http.Request) string
+
+// TenantFromHeader resolves tenants from a request header, e.g. X-Tenant-ID
+func TenantFromHeader(name string) TenantResolver {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// TenantFromHost resolves tenants from the request host, without its port
+func TenantFromHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+type tenantKey struct{}
+
+// WithTenant returns ctx for tenant, overriding the resolver for requests
+// carrying it
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFrom returns the tenant set on ctx by WithTenant or TenantMiddleware
+func TenantFrom(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok
+}
+
+// TenantStores keeps separate stores for each tenant, made on first use.
+// Nil constructors make in-memory stores; external stores typically prefix
+// their keys or tables with the tenant.
+type TenantStores struct {
+	Resolver TenantResolver
+
+	NewBudgets  func(tenant string) PreAuthStore
+	NewSessions func(tenant string) SessionStore
+	NewPrefs    func(tenant string) PaymentPrefsStore
+	NewMetering func(tenant string) MeteringStore
+
+	mu       sync.Mutex
+	budgets  map[string]PreAuthStore
+	sessions map[string]SessionStore
+	prefs    map[string]PaymentPrefsStore
+	metering map[string]MeteringStore
+}
+
+// NewTenantStores creates in-memory stores per tenant as named by resolver
+func NewTenantStores(resolver TenantResolver) *TenantStores {
+	return &TenantStores{Resolver: resolver}
+}
+
+// Tenant is the tenant r is for: the one on its context, or else the one
+// the resolver names
+func (t *TenantStores) Tenant(r *http.Request) string {
+	if tenant, ok := TenantFrom(r.Context()); ok {
+		return tenant
+	}
+	if t.Resolver == nil {
+		return ""
+	}
+	return t.Resolver(r)
+}
+
+// tenantStore returns tenant's store in stores, making it if needed
+func tenantStore[S any](t *TenantStores, stores *map[string]S, tenant string, newStore func(string) S, fallback func() S) S {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if store, ok := (*stores)[tenant]; ok {
+		return store
+	}
+	if *stores == nil {
+		*stores = make(map[string]S)
+	}
+	var store S
+	if newStore != nil {
+		store = newStore(tenant)
+	} else {
+		store = fallback()
+	}
+	(*stores)[tenant] = store
+	return store
+}
+
+// Budgets returns tenant's pre-authorized budget store
+func (t *TenantStores) Budgets(tenant string) PreAuthStore {
+	return tenantStore(t, &t.budgets, tenant, t.NewBudgets, func() PreAuthStore { return NewInMemoryPreAuthStore() })
+}
+
+// Sessions returns tenant's session store
+func (t *TenantStores) Sessions(tenant string) SessionStore {
+	return tenantStore(t, &t.sessions, tenant, t.NewSessions, func() SessionStore { return NewInMemorySessionStore() })
+}
+
+// Prefs returns tenant's payment preference store
+func (t *TenantStores) Prefs(tenant string) PaymentPrefsStore {
+	return tenantStore(t, &t.prefs, tenant, t.NewPrefs, func() PaymentPrefsStore { return NewInMemoryPaymentPrefsStore() })
+}
+
+// Metering returns tenant's metering store
+func (t *TenantStores) Metering(tenant string) MeteringStore {
+	return tenantStore(t, &t.metering, tenant, t.NewMetering, func() MeteringStore { return NewInMemoryMeteringStore(0, "") })
+}
+
+// Tenants lists the tenants with any store made so far
+func (t *TenantStores) Tenants() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for tenant := range t.budgets {
+		seen[tenant] = true
+	}
+	for tenant := range t.sessions {
+		seen[tenant] = true
+	}
+	for tenant := range t.prefs {
+		seen[tenant] = true
+	}
+	for tenant := range t.metering {
+		seen[tenant] = true
+	}
+	tenants := make([]string, 0, len(seen))
+	for tenant := range seen {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// budgetsFor is r's tenant's budget store, or fallback without tenants
+func (t *TenantStores) budgetsFor(r *http.Request, fallback PreAuthStore) PreAuthStore {
+	if t == nil {
+		return fallback
+	}
+	return t.Budgets(t.Tenant(r))
+}
+
+// sessionsFor is r's tenant's session store, or fallback without tenants
+func (t *TenantStores) sessionsFor(r *http.Request, fallback SessionStore) SessionStore {
+	if t == nil {
+		return fallback
+	}
+	return t.Sessions(t.Tenant(r))
+}
+
+// prefsFor is r's tenant's payment preference store, or fallback without
+// tenants
+func (t *TenantStores) prefsFor(r *http.Request, fallback PaymentPrefsStore) PaymentPrefsStore {
+	if t == nil {
+		return fallback
+	}
+	return t.Prefs(t.Tenant(r))
+}
+
+// meteringFor is r's tenant's metering store, or fallback without tenants
+func (t *TenantStores) meteringFor(r *http.Request, fallback MeteringStore) MeteringStore {
+	if t == nil {
+		return fallback
+	}
+	return t.Metering(t.Tenant(r))
+}
+
+// TenantMiddleware resolves each request's tenant once and puts it on the
+// request context, where TenantFrom reads it
+func TenantMiddleware(next http.Handler, tenants *TenantStores) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(WithTenant(r.Context(), tenants.Tenant(r))))
+	})
+}
+
+// MetricsHandler is MetricsHandler for each request's tenant
+func (t *TenantStores) MetricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		MetricsHandler(t.Metering(t.Tenant(r)))(w, r)
+	}
+}
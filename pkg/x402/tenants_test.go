@@ -0,0 +1,124 @@
+package x402
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tenantRequest(method, tenant, path, body string) *http.Request {
+	req := adminRequest(method, path, body)
+	req.Header.Set("X-Tenant-ID", tenant)
+	return req
+}
+
+func TestTenants_IsolateBudgets(t *testing.T) {
+	tenants := NewTenantStores(TenantFromHeader("X-Tenant-ID"))
+	config := AIFirstConfig{EnablePreAuth: true, DefaultCost: 100, Tenants: tenants}
+	budgets := AIBudgetHandler(nil, config)
+
+	// The same agent opens a budget with each tenant
+	for tenant, amount := range map[string]string{"acme": "1000", "globex": "500"} {
+		w := httptest.NewRecorder()
+		budgets.ServeHTTP(w, tenantRequest("POST", tenant, "/ai/budget", `{"agentId":"agent-1","budget":`+amount+`}`))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected a budget created for %s, got %d: %s", tenant, w.Code, w.Body)
+		}
+	}
+
+	api := AIFirstMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), config)
+	req := tenantRequest("GET", "acme", "/api/data", "")
+	req.Header.Set("X-Agent-ID", "agent-1")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Header().Get("X-Budget-Remaining") != "900" {
+		t.Fatalf("Expected acme's budget charged, got remaining %q", w.Header().Get("X-Budget-Remaining"))
+	}
+
+	acme, _ := tenants.Budgets("acme").GetByAgentID("agent-1")
+	globex, _ := tenants.Budgets("globex").GetByAgentID("agent-1")
+	if acme.Remaining != 900 || globex.Remaining != 500 {
+		t.Errorf("Expected only acme's budget charged, got acme %d and globex %d", acme.Remaining, globex.Remaining)
+	}
+	if _, err := tenants.Budgets("globex").Get(acme.ID); err == nil {
+		t.Error("Expected acme's budget ID unknown to globex")
+	}
+
+	// The admin API only lists the tenant's own budgets
+	admin := AdminHandler(AdminDeps{APIKey: "admin_secret", Tenants: tenants})
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, tenantRequest("GET", "globex", "/admin/budgets", ""))
+	var listed struct {
+		Budgets []PreAuthBudget `json:"budgets"`
+	}
+	json.NewDecoder(w.Body).Decode(&listed)
+	if len(listed.Budgets) != 1 || listed.Budgets[0].ID != globex.ID {
+		t.Errorf("Expected globex's budget alone, got %+v", listed.Budgets)
+	}
+}
+
+func TestTenants_IsolateMetrics(t *testing.T) {
+	tenants := NewTenantStores(TenantFromHeader("X-Tenant-ID"))
+	metered := MeteringMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), MeteringConfig{Tenants: tenants, PricePerRequest: 10})
+
+	for _, tenant := range []string{"acme", "acme", "globex"} {
+		req := tenantRequest("GET", tenant, "/api/data", "")
+		req.Header.Set("X-Agent-ID", "agent-1")
+		metered.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	admin := AdminHandler(AdminDeps{APIKey: "admin_secret", Tenants: tenants})
+	for tenant, want := range map[string]int64{"acme": 2, "globex": 1, "initech": 0} {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, tenantRequest("GET", tenant, "/admin/stats", ""))
+		var report MetricsReport
+		json.NewDecoder(w.Body).Decode(&report)
+		if report.TotalRequests != want {
+			t.Errorf("Expected %d requests for %s, got %d", want, tenant, report.TotalRequests)
+		}
+	}
+}
+
+func TestTenants_IsolateSessionsAndIdempotency(t *testing.T) {
+	tenants := NewTenantStores(TenantFromHost)
+	config := SessionConfig{Tenants: tenants}
+	session := &Session{PayerAddress: "0xabc", SessionType: SessionTypeUnlimited, ExpiresAt: time.Now().Add(time.Hour)}
+	tenants.Sessions("acme.example").CreateSession(session)
+
+	api := SessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), config)
+	for host, want := range map[string]int{"acme.example:443": http.StatusOK, "globex.example": http.StatusUnauthorized} {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Host = host
+		req.Header.Set("X-Session-ID", session.ID)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("Expected %d for the session on %s, got %d", want, host, w.Code)
+		}
+	}
+
+	// Idempotency keys don't replay another tenant's response
+	aiConfig := AIFirstConfig{EnableIdempotency: true, IdempotencyStore: NewInMemoryIdempotencyStore(), Tenants: tenants}
+	ai := AIFirstMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}), aiConfig)
+	for _, host := range []string{"acme.example", "globex.example"} {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Host = host
+		req.Header.Set("Idempotency-Key", "same-key")
+		w := httptest.NewRecorder()
+		ai.ServeHTTP(w, req)
+		if !strings.Contains(w.Body.String(), host) {
+			t.Errorf("Expected %s's own response, got %q", host, w.Body)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// Package x402 - Tiered Pricing
+// Volume discounts per payer: the more a payer has used this calendar month
+// (UTC), the cheaper each request. Usage comes from the metering store or
+// payment ledger through PayerUsage and is cached briefly per payer, so
+// pricing a request does not scan history every time.
+package x402
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TierBasis is what tier thresholds count
+type TierBasis string
+
+const (
+	TierByRequests TierBasis = "requests" // Paid requests this month
+	TierBySpend    TierBasis = "spend"    // Amount spent this month, in the price's smallest unit
+)
+
+// CurrentTierHeader tells clients which tier priced the request
+const CurrentTierHeader = "X-Current-Tier"
+
+// defaultTierName is reported for payers below the first tier
+const defaultTierName = "standard"
+
+// defaultTierCacheTTL bounds how stale a payer's cached usage may be
+const defaultTierCacheTTL = 30 * time.Second
+
+// PricingTier replaces the base price once a payer's monthly usage reaches From
+type PricingTier struct {
+	Name  string `json:"name"`
+	From  int64  `json:"from"`  // Monthly requests or spend at which the tier starts
+	Price int64  `json:"price"` // Per-request price, in the same unit as PricePerRequest
+}
+
+// PayerMonthUsage is a payer's usage since the start of the month
+type PayerMonthUsage struct {
+	Requests int64 `json:"requests"`
+	Spend    int64 `json:"spend"`
+}
+
+// PayerUsage reports a payer's usage since since
+type PayerUsage interface {
+	PayerUsageSince(payer string, since time.Time) (PayerMonthUsage, error)
+}
+
+// MeteringUsage reads payer usage from a MeteringStore. Requests answered
+// with 402 are not counted.
+type MeteringUsage struct {
+	Store MeteringStore
+}
+
+// PayerUsageSince implements PayerUsage
+func (m MeteringUsage) PayerUsageSince(payer string, since time.Time) (PayerMonthUsage, error) {
+	report, err := m.Store.GetMetrics(MetricsFilter{StartTime: &since, PayerID: payer})
+	if err != nil {
+		return PayerMonthUsage{}, err
+	}
+	return PayerMonthUsage{Requests: report.TotalRequests - report.PaymentRequired, Spend: report.TotalRevenue}, nil
+}
+
+// LedgerUsage reads payer usage from a PaymentLedger
+type LedgerUsage struct {
+	Ledger PaymentLedger
+}
+
+// PayerUsageSince implements PayerUsage
+func (l LedgerUsage) PayerUsageSince(payer string, since time.Time) (PayerMonthUsage, error) {
+	records, err := l.Ledger.List(LedgerFilter{PayerID: payer, StartTime: &since})
+	if err != nil {
+		return PayerMonthUsage{}, err
+	}
+	var usage PayerMonthUsage
+	for _, record := range records {
+		if record.Status == PaymentStatusFailed {
+			continue
+		}
+		usage.Requests++
+		usage.Spend += record.Amount
+	}
+	return usage, nil
+}
+
+// TieredPricing prices requests by the payer's monthly usage. Payers are
+// identified as for metering (X-Payer-Address, session, or API key). Unknown
+// payers, payers below the first tier, and failed usage lookups pay the base
+// price.
+type TieredPricing struct {
+	Basis TierBasis     // Default TierByRequests
+	Tiers []PricingTier // Ascending by From
+	Usage PayerUsage
+
+	// CacheTTL is how long a payer's usage is reused (default 30s). Requests
+	// granted in the meantime are added to the cached usage.
+	CacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*tierUsageEntry
+
+	// now is stubbed in tests
+	now func() time.Time
+}
+
+type tierUsageEntry struct {
+	usage     PayerMonthUsage
+	month     time.Time
+	fetchedAt time.Time
+}
+
+// Validate reports tiers that are out of order or negatively priced
+func (t *TieredPricing) Validate() error {
+	if t == nil {
+		return nil
+	}
+	if t.Usage == nil {
+		return fmt.Errorf("x402: TieredPricing requires Usage")
+	}
+	if t.Basis != "" && t.Basis != TierByRequests && t.Basis != TierBySpend {
+		return fmt.Errorf("x402: unknown tier basis %q", t.Basis)
+	}
+	for i, tier := range t.Tiers {
+		if tier.Price < 0 || tier.From < 0 {
+			return fmt.Errorf("x402: tier %q must not be negative", tier.Name)
+		}
+		if i > 0 && tier.From <= t.Tiers[i-1].From {
+			return fmt.Errorf("x402: tier %q must start above tier %q", tier.Name, t.Tiers[i-1].Name)
+		}
+	}
+	return nil
+}
+
+// Tier returns the tier that applies to payer, if any
+func (t *TieredPricing) Tier(payer string) (PricingTier, bool) {
+	if t == nil || payer == "" || len(t.Tiers) == 0 {
+		return PricingTier{}, false
+	}
+	usage, ok := t.usage(payer)
+	if !ok {
+		return PricingTier{}, false
+	}
+
+	count := usage.Requests
+	if t.Basis == TierBySpend {
+		count = usage.Spend
+	}
+	var current PricingTier
+	found := false
+	for _, tier := range t.Tiers {
+		if count < tier.From {
+			break
+		}
+		current, found = tier, true
+	}
+	return current, found
+}
+
+// price returns the per-request price for payer and the tier name to report
+func (t *TieredPricing) price(payer string, base int64) (int64, string) {
+	if tier, ok := t.Tier(payer); ok {
+		return tier.Price, tier.Name
+	}
+	return base, defaultTierName
+}
+
+// usage returns the payer's usage this month, from cache when fresh
+func (t *TieredPricing) usage(payer string) (PayerMonthUsage, bool) {
+	now := t.clock()
+	month := monthStart(now)
+
+	t.mu.Lock()
+	entry, ok := t.cache[payer]
+	ttl := t.CacheTTL
+	if ttl == 0 {
+		ttl = defaultTierCacheTTL
+	}
+	if ok && entry.month.Equal(month) && now.Sub(entry.fetchedAt) < ttl {
+		usage := entry.usage
+		t.mu.Unlock()
+		return usage, true
+	}
+	t.mu.Unlock()
+
+	usage, err := t.Usage.PayerUsageSince(payer, month)
+	if err != nil {
+		return PayerMonthUsage{}, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cache == nil {
+		t.cache = make(map[string]*tierUsageEntry)
+	}
+	t.cache[payer] = &tierUsageEntry{usage: usage, month: month, fetchedAt: now}
+	return usage, true
+}
+
+// record adds a granted request to the payer's cached usage so thresholds
+// take effect before the cache expires
+func (t *TieredPricing) record(payer string, amount int64) {
+	if t == nil || payer == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if entry, ok := t.cache[payer]; ok && entry.month.Equal(monthStart(t.clock())) {
+		entry.usage.Requests++
+		entry.usage.Spend += amount
+	}
+}
+
+func (t *TieredPricing) clock() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
+
+// monthStart returns the start of t's calendar month in UTC
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// applyTier sets the X-Current-Tier header and returns the request's price
+func applyTier(w http.ResponseWriter, r *http.Request, pricing *TieredPricing, base int64) (int64, string) {
+	if pricing == nil {
+		return base, ""
+	}
+	payer := extractPayerID(r)
+	price, name := pricing.price(payer, base)
+	w.Header().Set(CurrentTierHeader, name)
+	return price, payer
+}
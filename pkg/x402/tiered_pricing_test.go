@@ -0,0 +1,163 @@
+package x402
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func volumeTiers(usage PayerUsage) *TieredPricing {
+	return &TieredPricing{
+		Usage: usage,
+		Tiers: []PricingTier{
+			{Name: "volume", From: 3, Price: 80},
+			{Name: "bulk", From: 5, Price: 60},
+		},
+	}
+}
+
+func quotedPrice(t *testing.T, handler http.Handler, payer string) (string, string) {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-Payer-Address", payer)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected 402, got %d", w.Code)
+	}
+
+	var response PaymentRequiredResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return response.Accepts[0].MaxAmountRequired, w.Header().Get(CurrentTierHeader)
+}
+
+func TestTierCrossedMidMonthLowersNextQuote(t *testing.T) {
+	metering := NewInMemoryMeteringStore(100, "USD")
+	config := testConfig()
+	config.TieredPricing = volumeTiers(MeteringUsage{Store: metering})
+	handler := MeteringMiddleware(Middleware(createTestHandler(), config), MeteringConfig{Store: metering})
+
+	if price, tier := quotedPrice(t, handler, "0xheavy"); price != "100" || tier != "standard" {
+		t.Errorf("Expected standard price 100, got %s (%s)", price, tier)
+	}
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-Payer-Address", "0xheavy")
+		req.Header.Set("Authorization", "Bearer valid_token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected paid request to pass, got %d", w.Code)
+		}
+	}
+
+	// The cached usage counts the paid requests without waiting for the TTL
+	if price, tier := quotedPrice(t, handler, "0xheavy"); price != "80" || tier != "volume" {
+		t.Errorf("Expected volume price 80 after 3 requests, got %s (%s)", price, tier)
+	}
+	if price, _ := quotedPrice(t, handler, "0xlight"); price != "100" {
+		t.Errorf("Expected other payers to keep the standard price, got %s", price)
+	}
+}
+
+// countingUsage returns fixed usage for lookups within month and counts calls
+type countingUsage struct {
+	month time.Time
+	usage PayerMonthUsage
+	calls int
+}
+
+func (c *countingUsage) PayerUsageSince(payer string, since time.Time) (PayerMonthUsage, error) {
+	c.calls++
+	if !since.Equal(c.month) {
+		return PayerMonthUsage{}, nil
+	}
+	return c.usage, nil
+}
+
+func TestTierCacheAndUTCMonthRollover(t *testing.T) {
+	march := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	usage := &countingUsage{month: march, usage: PayerMonthUsage{Requests: 10}}
+	pricing := volumeTiers(usage)
+
+	// 23:30 on March 31 in New York is already April in UTC
+	newYork := time.FixedZone("EST", -5*3600)
+	now := time.Date(2026, time.March, 31, 12, 0, 0, 0, newYork)
+	pricing.now = func() time.Time { return now }
+
+	if tier, _ := pricing.Tier("0xheavy"); tier.Name != "bulk" {
+		t.Errorf("Expected bulk tier in March, got %q", tier.Name)
+	}
+	pricing.Tier("0xheavy")
+	if usage.calls != 1 {
+		t.Errorf("Expected cached usage within the TTL, got %d lookups", usage.calls)
+	}
+
+	now = time.Date(2026, time.March, 31, 23, 30, 0, 0, newYork)
+	if _, ok := pricing.Tier("0xheavy"); ok {
+		t.Error("Expected usage to reset when the UTC month rolls over")
+	}
+	if usage.calls != 2 {
+		t.Errorf("Expected a fresh lookup for the new month, got %d lookups", usage.calls)
+	}
+}
+
+func TestTierBySpendWithLedger(t *testing.T) {
+	ledger := NewInMemoryPaymentLedger(10)
+	ledger.Record(PaymentRecord{PayerID: "0xbig", Amount: 400, Status: PaymentStatusVerified})
+	ledger.Record(PaymentRecord{PayerID: "0xbig", Amount: 400, Status: PaymentStatusFailed})
+
+	pricing := &TieredPricing{
+		Basis: TierBySpend,
+		Usage: LedgerUsage{Ledger: ledger},
+		Tiers: []PricingTier{{Name: "gold", From: 300, Price: 50}},
+	}
+	if tier, ok := pricing.Tier("0xbig"); !ok || tier.Price != 50 {
+		t.Errorf("Expected gold tier from 400 spent, got %+v", tier)
+	}
+	if _, ok := pricing.Tier(""); ok {
+		t.Error("Expected unidentified payers to get no tier")
+	}
+}
+
+func TestUnifiedTierPricesVerification(t *testing.T) {
+	rail := &recordingRail{EVMCryptoRail: NewEVMCryptoRail("", nil)}
+	registry := NewRailRegistry()
+	registry.Register(rail)
+
+	handler := UnifiedPaymentMiddleware(createTestHandler(), UnifiedPaymentConfig{
+		PricePerRequest: 100,
+		CryptoEnabled:   true,
+		CryptoNetworks:  []NetworkType{NetworkBaseSepolia},
+		RailRegistry:    registry,
+		TieredPricing:   volumeTiers(&countingUsage{usage: PayerMonthUsage{Requests: 4}, month: monthStart(time.Now())}),
+	})
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("X-Payer-Address", "0xheavy")
+	req.Header.Set("X-PAYMENT", "payload")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || rail.expected != 80 || w.Header().Get(CurrentTierHeader) != "volume" {
+		t.Errorf("Expected verification at the volume price 80, got %d (status %d)", rail.expected, w.Code)
+	}
+}
+
+func TestTieredPricingValidate(t *testing.T) {
+	outOfOrder := volumeTiers(&countingUsage{})
+	outOfOrder.Tiers[1].From = 2
+	if err := outOfOrder.Validate(); err == nil {
+		t.Error("Expected tiers out of order to be rejected")
+	}
+
+	config := UnifiedPaymentConfig{Price: "0.01", CryptoEnabled: true, TieredPricing: volumeTiers(&countingUsage{})}
+	if err := config.Validate(); err == nil {
+		t.Error("Expected TieredPricing with Price to be rejected")
+	}
+}
@@ -7,10 +7,12 @@ package x402
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -22,36 +24,248 @@ import (
 // UnifiedPaymentConfig configures the unified payment middleware
 type UnifiedPaymentConfig struct {
 	// Basic config
-	PricePerRequest int64    // Amount in smallest unit (cents, wei, etc.)
+	PricePerRequest int64    // Amount in smallest unit (cents, wei, etc.); see Validate
 	Currency        string   // Primary currency (USD, USDC)
 	Description     string   // What the payment is for
 	ExemptPaths     []string // Paths that don't require payment
 
+	// DynamicExemptions are path exemptions that can change at runtime, such
+	// as those added by MountStandardEndpoints
+	DynamicExemptions *ExemptionList
+
+	// ExemptCIDRs lets internal callers whose client IP is in one of these
+	// networks through without payment (metered as "exempt-internal").
+	// TrustedProxies decide when X-Forwarded-For is believed.
+	ExemptCIDRs    []string
+	TrustedProxies []*net.IPNet
+
+	// ResourceDescriptor sets the mimeType and outputSchema advertised in
+	// 402s for each request (see DescribeEndpoints)
+	ResourceDescriptor ResourceDescriptor
+
+	// MaxTimeoutSeconds is how long a quote is valid (default 60). Stripe
+	// intents created for a 402 are canceled if still unpaid when presented
+	// after it, and crypto proofs presented after it are refused.
+	MaxTimeoutSeconds int
+
+	// VerificationTimeout and CaptureTimeout bound each rail call (default
+	// 5s and 10s, capped by MaxTimeoutSeconds)
+	VerificationTimeout time.Duration
+	CaptureTimeout      time.Duration
+
+	// FailMode decides what happens when a rail call times out: FailClosed
+	// (default) answers 402, FailOpen serves the request unpaid. Either way
+	// the failure is reported with reason rail_timeout.
+	FailMode string
+
+	// CircuitBreaker, if set, stops calling rails that keep failing: their
+	// calls fail fast into FailMode (reason rail_unavailable) and they are
+	// left out of 402 options until probes succeed
+	CircuitBreaker *CircuitBreaker
+
+	// Realm is the WWW-Authenticate realm on 402 responses (default "x402")
+	Realm string
+
+	// PayerHeaders names the request headers that tell next who paid, and
+	// optionally signs them (see VerifyGatewayClaims)
+	PayerHeaders PayerHeaders
+
+	// Audit, if set, records every payment decision
+	Audit *AuditLog
+
+	// TaskSpend, if set, totals paid requests per X-Agent-Task-ID and
+	// returns the running total in X-Task-Spent
+	TaskSpend TaskSpendStore
+
+	// Protocol names the x402 proof headers read and the requirements
+	// header written (see ProtocolProfile). Nil reads PAYMENT-SIGNATURE and
+	// X-PAYMENT and emits PAYMENT-REQUIRED and the JSON body.
+	Protocol *ProtocolProfile
+
+	// DiscoverySigner, if set, signs 402 requirements in
+	// X-Discovery-Signature (see WellKnownHandler for the public keys)
+	DiscoverySigner *DiscoverySigner
+
+	// BodyProof, if set, also reads payment proofs from a field of JSON
+	// request bodies, for clients that can't set headers
+	BodyProof *BodyProof
+
+	// MaxProofBytes is the largest payment proof decoded (default
+	// DefaultMaxProofBytes). Larger proofs, and proofs that can't be
+	// decoded, are answered with a 400 MALFORMED_PROOF.
+	MaxProofBytes int
+
+	// ReceiptCookies, if set, gives browsers that pay a signed receipt
+	// cookie and serves later requests carrying one without a new payment
+	ReceiptCookies *ReceiptCookies
+
+	// Price is the human price in Currency (e.g. "0.01"), converted to each
+	// rail's smallest unit: cents for Stripe, CryptoDecimals for the crypto
+	// asset (assumed pegged 1:1 to Currency)
+	Price string
+
+	// PriceByRail sets explicit amounts per rail ID in that rail's smallest
+	// unit, overriding Price and PricePerRequest
+	PriceByRail map[string]int64
+
+	// CurrencyConverter accepts payments made in other currencies by
+	// converting them to Currency during verification (optional)
+	CurrencyConverter CurrencyConverter
+
+	// CurrencyTolerance accepts converted payments up to this fraction short
+	// of the price, absorbing rate drift (e.g. 0.01 = 1%)
+	CurrencyTolerance float64
+
+	// RailCurrencies quotes fiat rails in a local currency, e.g.
+	// {"stripe": "EUR"}. Requires CurrencyConverter.
+	RailCurrencies map[string]string
+
 	// Crypto settings
 	CryptoEnabled  bool          // Enable crypto payments
 	CryptoPayTo    string        // Address to receive crypto payments
 	CryptoAsset    string        // Token contract (USDC, etc.)
 	CryptoScheme   string        // Payment scheme (exact, upto)
 	CryptoNetworks []NetworkType // Supported networks
+	CryptoDecimals int           // Decimals of CryptoAsset (default 6, as for USDC)
+
+	// CryptoAssets lists the tokens offered on each network, in the order
+	// they are shown; networks not listed offer CryptoAsset. Amounts are
+	// converted from CryptoDecimals to each token's decimals.
+	CryptoAssets map[NetworkType][]AssetRef
+
+	// Recipients, if set, names each request's recipient in place of
+	// CryptoPayTo, CryptoAsset and the platform's Stripe account, for
+	// gateways paying many sellers (see recipients.go). Requests it can't
+	// resolve are refused with 503.
+	Recipients RecipientResolver
 
 	// Fiat settings
-	FiatEnabled         bool   // Enable fiat payments
-	StripeSecretKey     string // Stripe API key
-	StripeWebhookSecret string // Stripe webhook secret
+	FiatEnabled         bool         // Enable fiat payments
+	StripeSecretKey     string       // Stripe API key
+	StripeWebhookSecret string       // Stripe webhook secret
+	StripeFees          *FeeSchedule // Stripe's fees (default DefaultStripeFees)
+
+	// StripeCheckout, if set, also offers a Stripe-hosted Checkout page and
+	// accepts buyers returning from it (see ReceiptCookies to keep them in)
+	StripeCheckout *StripeCheckout
 
 	// Facilitator for crypto verification
 	FacilitatorURL string
 
-	// Customer/session management
-	EnableSessions bool // Track customer sessions
-	SessionStore   SessionStore
+	// Customer/session management. With EnableSessions, requests carrying a
+	// valid X-Session-ID, X-Session-Token, or session cookie skip payment.
+	EnableSessions bool         // Track customer sessions
+	SessionStore   SessionStore // Default: in-memory
+
+	// SessionAfterPayment mints a session valid this long after each one-off
+	// payment, so browsers aren't charged for every asset (0 = disabled)
+	SessionAfterPayment time.Duration
+
+	// SessionMaxRequests caps requests on minted sessions (0 = time-based)
+	SessionMaxRequests int64
+
+	// SessionEndpoint and SessionTiers are advertised in 402 responses
+	SessionEndpoint string
+	SessionTiers    []SessionPricingTier
+
+	// SessionRenewal, if set, renews auto-renewing sessions that have run
+	// out on their next request
+	SessionRenewal *SessionRenewal
+
+	// FreeRevalidation doesn't charge conditional GETs and HEADs that next
+	// answers 304 Not Modified: the session request isn't counted, and a
+	// payment the rail captures separately isn't captured
+	FreeRevalidation bool
+
+	// Tenants, if set, keeps sessions, agent budgets and payment preferences
+	// separate for each tenant, in place of SessionStore, the agent
+	// PreAuthStore and the onboarding preference store
+	Tenants *TenantStores
+
+	// PaymentPrefs, if set, tailors 402 options to the request's customer
+	// (see payment_prefs.go): their preferred rail first and flagged
+	// preferred, without the rails they disabled. Tenants' preference stores
+	// take its place when set.
+	PaymentPrefs PaymentPrefsStore
+
+	// Customer names the request's customer (default
+	// DefaultCustomerResolver: X-Customer-ID, then the x402_customer cookie)
+	Customer CustomerResolver
+
+	// QuickPay also offers customers with a saved card a Stripe intent
+	// already attached to it, which the client confirms without collecting
+	// card details. Anyone naming a customer can pay with their card, so
+	// only enable it with a Customer resolver that authenticates them.
+	QuickPay bool
 
 	// Callbacks
 	OnPaymentSuccess func(ctx context.Context, payment *CompletedPayment)
-	OnPaymentFailed  func(ctx context.Context, err error, req *http.Request)
+	OnPaymentFailed  func(ctx context.Context, err error, req *http.Request) // Verify and capture only; err may be nil
+
+	// OnPaymentFailure receives the rail, stage, and reason of every refused payment
+	OnPaymentFailure func(ctx context.Context, failure *PaymentFailure)
+
+	// Callbacks, if set, runs the callbacks above, e.g. asynchronously.
+	// Callback panics are recovered and logged either way.
+	Callbacks *CallbackRunner
+
+	// Coupons, if set, discounts requests carrying a valid X-Coupon-Code
+	// header or coupon query parameter on every rail
+	Coupons CouponStore
 
-	// Rail registry (uses default if nil)
+	// Ledger, if set, records requests granted without a rail payment, such
+	// as with a free coupon, as zero-amount payments. Rails record their own
+	// payments (see ConfirmationPolicy.Ledger).
+	Ledger PaymentLedger
+
+	// AccessPolicy, if set, refuses denied payers with 403 and serves free
+	// payers without charging them
+	AccessPolicy *AccessPolicy
+
+	// TieredPricing, if set, replaces PricePerRequest with the payer's volume
+	// tier and reports it in X-Current-Tier. Requires PricePerRequest pricing.
+	TieredPricing *TieredPricing
+
+	// MethodPricing, if set, prices requests by HTTP method; free methods
+	// skip payment. Its prices require PricePerRequest pricing.
+	MethodPricing MethodPricing
+
+	// Quotes, if set, honors the price of a signed quote sent in
+	// X-Price-Quote (see quotes.go), once. Quoted prices are in
+	// PricePerRequest units, so it requires PricePerRequest pricing.
+	Quotes *QuoteSigner
+
+	// Subscriptions, if set, lets requests carrying the X-Subscription-Token
+	// of an active Stripe subscription skip payment while under quota, and
+	// advertises the plans in 402 responses
+	Subscriptions *SubscriptionConfig
+
+	// Extensions are advertised in every 402, along with those of the
+	// session and agent middlewares around this one (see PaymentExtensions)
+	Extensions *PaymentExtensions
+
+	// Rail registry (nil uses NewDefaultRailRegistry with this config)
 	RailRegistry *RailRegistry
+
+	// coupon is the coupon applied to the current request's copy of the config
+	coupon *Coupon
+
+	// quote is the price quote honored on the current request's copy of the
+	// config, claimed however the request is served
+	quote *PriceQuote
+
+	// stripeAccount is the connected account of the current request's recipient
+	stripeAccount string
+
+	// now is stubbed in tests
+	now func() time.Time
+}
+
+func (c UnifiedPaymentConfig) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
 }
 
 // CompletedPayment represents a successfully completed payment
@@ -78,12 +292,16 @@ type CustomerPaymentPrefs struct {
 	PreferredRail    string    `json:"preferredRail"`    // stripe, evm-crypto, etc.
 	PreferredNetwork string    `json:"preferredNetwork"` // For crypto
 	StripeCustomerID string    `json:"stripeCustomerId,omitempty"`
+	PaymentMethodID  string    `json:"paymentMethodId,omitempty"` // Saved Stripe payment method, for off-session charges
 	CryptoAddress    string    `json:"cryptoAddress,omitempty"`
+	DisabledRails    []string  `json:"disabledRails,omitempty"` // Rails left out of this customer's 402s
 	CreatedAt        time.Time `json:"createdAt"`
 	UpdatedAt        time.Time `json:"updatedAt"`
 }
 
-// PaymentPrefsStore stores customer payment preferences
+// PaymentPrefsStore stores customer payment preferences. Get must return a
+// copy, since handlers read it while other requests may Set the customer's
+// preferences.
 type PaymentPrefsStore interface {
 	Get(ctx context.Context, customerID string) (*CustomerPaymentPrefs, error)
 	Set(ctx context.Context, prefs *CustomerPaymentPrefs) error
@@ -109,14 +327,16 @@ func (s *InMemoryPaymentPrefsStore) Get(ctx context.Context, customerID string)
 	if !ok {
 		return nil, nil
 	}
-	return prefs, nil
+	found := *prefs
+	return &found, nil
 }
 
 func (s *InMemoryPaymentPrefsStore) Set(ctx context.Context, prefs *CustomerPaymentPrefs) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	prefs.UpdatedAt = time.Now()
-	s.prefs[prefs.CustomerID] = prefs
+	saved := *prefs
+	s.prefs[prefs.CustomerID] = &saved
 	return nil
 }
 
@@ -127,12 +347,36 @@ func (s *InMemoryPaymentPrefsStore) Delete(ctx context.Context, customerID strin
 	return nil
 }
 
+// ListPrefs returns a page of customers' preferences
+func (s *InMemoryPaymentPrefsStore) ListPrefs(ctx context.Context, pageToken string, limit int) ([]*CustomerPaymentPrefs, string, error) {
+	s.mu.RLock()
+	all := make([]*CustomerPaymentPrefs, 0, len(s.prefs))
+	for _, prefs := range s.prefs {
+		found := *prefs
+		all = append(all, &found)
+	}
+	s.mu.RUnlock()
+
+	return paginate(all, func(prefs *CustomerPaymentPrefs) pageKey {
+		return pageKey{created: prefs.CreatedAt, id: prefs.CustomerID}
+	}, pageToken, limit)
+}
+
 // ===============================================
 // UNIFIED PAYMENT MIDDLEWARE
 // ===============================================
 
-// UnifiedPaymentMiddleware creates middleware that accepts multiple payment rails
+// UnifiedPaymentMiddleware creates middleware that accepts multiple payment rails.
+// It panics if config.Validate fails, since ambiguous pricing would charge
+// different amounts per rail.
 func UnifiedPaymentMiddleware(next http.Handler, config UnifiedPaymentConfig) http.Handler {
+	if err := config.Validate(); err != nil {
+		panic(err)
+	}
+	internal, _ := parseExemptCIDRs(config.ExemptCIDRs)
+	guard := &composition{name: "UnifiedPaymentMiddleware"}
+	next = decided(next, guard.name)
+
 	// Set defaults
 	if config.Currency == "" {
 		config.Currency = "USD"
@@ -140,72 +384,379 @@ func UnifiedPaymentMiddleware(next http.Handler, config UnifiedPaymentConfig) ht
 	if config.CryptoScheme == "" {
 		config.CryptoScheme = "exact"
 	}
+	if config.EnableSessions && config.SessionStore == nil {
+		config.SessionStore = NewInMemorySessionStore()
+	}
 
 	// Get or create rail registry
 	registry := config.RailRegistry
 	if registry == nil {
-		registry = NewRailRegistry()
+		registry = NewDefaultRailRegistry(config)
+	}
 
-		// Register Stripe if enabled
-		if config.FiatEnabled && config.StripeSecretKey != "" {
-			registry.Register(NewStripeRail(config.StripeSecretKey, config.StripeWebhookSecret))
+	if err := validateRailFees(registry); err != nil {
+		panic(err)
+	}
+
+	// fail reports a refused payment and answers with a 402 explaining it
+	fail := func(w http.ResponseWriter, r *http.Request, config UnifiedPaymentConfig, failure *PaymentFailure) {
+		config.paymentFailed(r, failure)
+		if failure.Reason == FailureMalformedProof {
+			config.Audit.recordFailure(r, failure, "")
+			sendMalformedProof(w, failure.Err, config.MaxProofBytes)
+			return
 		}
+		sendPaymentOptions(w, r, config, registry, failure, "")
+	}
 
-		// Register EVM crypto if enabled
-		if config.CryptoEnabled && config.FacilitatorURL != "" {
-			registry.Register(NewEVMCryptoRail(config.FacilitatorURL, config.CryptoNetworks))
+	// timeout handles a rail call that ran out of time, or was skipped for an
+	// open circuit, according to FailMode
+	timeout := func(w http.ResponseWriter, r *http.Request, config UnifiedPaymentConfig, failure *PaymentFailure) {
+		if config.FailMode != FailOpen {
+			fail(w, r, config, failure)
+			return
 		}
+		reportFailure(config.Callbacks, config.OnPaymentFailure, r, failure)
+		config.Audit.Record(r, AuditEvent{
+			Decision:       AuditFailOpen,
+			Reason:         failure.Reason,
+			Stage:          failure.Stage,
+			Rail:           failure.Rail,
+			Payer:          failure.Payer,
+			RequiredAmount: failure.ExpectedAmount,
+			PayloadHash:    hashPayload(proofPayload(r, config.Protocol, config.MaxProofBytes)),
+		})
+		_ = config.Quotes.claim(config.quote)
+		next.ServeHTTP(w, r)
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check if path is exempt
-		if isExemptPath(r.URL.Path, config.ExemptPaths) {
-			next.ServeHTTP(w, r)
+		// An x402 middleware outside this one already handled payment
+		if guard.passThrough(w, r, next) {
+			return
+		}
+
+		// Only the middleware says who paid
+		config.PayerHeaders.strip(r)
+
+		// Check if path or method is exempt
+		if reason := exemption(r, config.ExemptPaths, config.DynamicExemptions, config.MethodPricing); reason != "" {
+			config.Audit.Record(r, AuditEvent{Decision: AuditExempt, Reason: reason})
+			next.ServeHTTP(w, reportExempt(r))
+			return
+		}
+
+		// So are internal callers
+		if serveInternal(w, r, internal, config.TrustedProxies, config.Audit, next) {
+			return
+		}
+		r = config.BodyProof.read(r)
+
+		// Build resource URL
+		resource := r.URL.Path
+		if r.URL.RawQuery != "" {
+			resource += "?" + r.URL.RawQuery
+		}
+
+		// Client IP policy applies before any payment is asked for
+		if servePayerPolicy(w, r, config.AccessPolicy, "", config.Audit, next) {
+			return
+		}
+
+		// A browser that already paid shows its receipt
+		if config.ReceiptCookies.serve(w, r, config.PayerHeaders, config.Audit, next) {
+			return
+		}
+
+		// A valid session covers the request without a new payment, and
+		// a 304 to a conditional request doesn't count against it
+		sessionProblem := ""
+		var replay *bufferedResponse
+		if sessionID := requestSessionID(r); config.EnableSessions && sessionID != "" {
+			store := config.Tenants.sessionsFor(r, config.SessionStore)
+			if config.FreeRevalidation && conditionalRequest(r) && sessionCovers(store, sessionID, r.URL.Path, r.Header.Get(DelegateHeader), r.Header.Get(SessionKeyHeader)) {
+				if replay = revalidate(w, r, next, config.Audit, "session", ""); replay == nil {
+					return
+				}
+			}
+			session, err := config.SessionRenewal.consume(r.Context(), store, sessionID, r.URL.Path, r.Header.Get(DelegateHeader), r.Header.Get(SessionKeyHeader))
+			if err == nil {
+				setSessionHeaders(w, session)
+				config.Audit.Record(r, AuditEvent{Decision: AuditVerified, Rail: "session"})
+				w.Header().Set("X-Payment-Verified", "true")
+				w.Header().Set("X-Payment-Method", "session")
+				replay.serve(w, r, next)
+				return
+			}
+			sessionProblem = err.Error()
+		}
+
+		// So does an active subscription with quota left
+		subscription, subscriptionErr := config.Subscriptions.consume(r)
+		if subscription != nil {
+			setSubscriptionHeaders(w, subscription)
+			config.Audit.Record(r, AuditEvent{Decision: AuditVerified, Rail: PaymentMethodSubscription})
+			w.Header().Set("X-Payment-Verified", "true")
+			w.Header().Set("X-Payment-Method", PaymentMethodSubscription)
+			replay.serve(w, r, next)
+			return
+		}
+
+		// The recipient, method, payer's tier, any quote and any coupon price this request on a per-request copy
+		config := config
+		if err := config.resolveRecipient(r); err != nil {
+			refuseUnresolvedRecipient(w, r, config.Audit, err)
+			return
+		}
+		config.PricePerRequest = scalePrice(r, config.MethodPricing.Price(r.Method, r.URL.Path, config.PricePerRequest))
+		var payer string
+		config.PricePerRequest, payer = applyTier(w, r, config.TieredPricing, config.PricePerRequest)
+		unquotedConfig := config
+		var quote *PriceQuote
+		var quoteErr error
+		config.PricePerRequest, quote, quoteErr = config.Quotes.price(r, config.Currency, config.PricePerRequest)
+		config.quote = quote
+		fullConfig := config
+		coupon, couponErr := requestCoupon(config.Coupons, r)
+		config.coupon = coupon
+
+		// A coupon covering the whole price skips payment
+		if coupon != nil && config.agentAmount() == 0 {
+			if err := config.Quotes.claim(quote); err != nil {
+				sendPaymentOptions(w, r, unquotedConfig, registry, nil, quoteMessage(err))
+				return
+			}
+			if _, err := config.Coupons.Redeem(coupon.Code, r.URL.Path); err != nil {
+				config.Quotes.release(quote)
+				sendPaymentOptions(w, r, fullConfig, registry, nil, couponMessage(err))
+				return
+			}
+			config.paymentSucceeded(r, &CompletedPayment{
+				ID:          generatePaymentRecordID(),
+				Rail:        PaymentMethodCoupon,
+				Amount:      0,
+				Currency:    config.Currency,
+				Resource:    resource,
+				Metadata:    couponMetadata(coupon),
+				CompletedAt: time.Now(),
+			})
+			config.Audit.Record(r, AuditEvent{Decision: AuditFree, Reason: PaymentMethodCoupon, Metadata: couponMetadata(coupon)})
+			w.Header().Set("X-Payment-Verified", "true")
+			w.Header().Set("X-Payment-Method", PaymentMethodCoupon)
+			r = recordPayment(Config{Currency: config.Currency, Ledger: config.Ledger}, r, PaymentMethodCoupon, "", coupon)
+			config.TieredPricing.record(payer, 0)
+			replay.serve(w, r, next)
 			return
 		}
 
 		// Check for payment proof in headers
-		paymentProof := extractPaymentProof(r)
+		paymentProof, err := extractPaymentProof(r, config.Protocol, config.MaxProofBytes)
+		if err != nil {
+			fail(w, r, config, &PaymentFailure{Stage: StageExtract, Reason: FailureMalformedProof, Resource: resource, Err: err})
+			return
+		}
 
 		if paymentProof == nil {
 			// No payment - return 402 with options
-			sendPaymentOptions(w, r, config, registry)
+			var problems []string
+			if sessionProblem != "" {
+				problems = append(problems, "Session cannot be used: "+sessionProblem)
+			}
+			if subscriptionErr != nil {
+				problems = append(problems, subscriptionMessage(subscriptionErr))
+			}
+			if quoteErr != nil {
+				problems = append(problems, quoteMessage(quoteErr))
+			}
+			if couponErr != nil {
+				problems = append(problems, couponMessage(couponErr))
+			}
+			sendPaymentOptions(w, r, config, registry, nil, strings.Join(problems, "; "))
 			return
 		}
 
 		// Get the appropriate rail
 		rail, ok := registry.Get(paymentProof.Rail)
 		if !ok {
-			sendPaymentOptions(w, r, config, registry)
+			fail(w, r, config, &PaymentFailure{
+				Rail:     paymentProof.Rail,
+				Stage:    StageExtract,
+				Reason:   FailureUnsupportedRail,
+				Resource: resource,
+			})
 			return
 		}
 
-		// Build resource URL
-		resource := r.URL.Path
-		if r.URL.RawQuery != "" {
-			resource += "?" + r.URL.RawQuery
+		// Verify payment in the rail's own units
+		amount := config.RailAmount(rail.ID(), rail.Type())
+
+		// A buyer back from Checkout must return to the resource they paid for
+		if paymentProof.CheckoutSessionID != "" {
+			if err := config.StripeCheckout.checkState(r, paymentProof.CheckoutState); err != nil {
+				reason := FailureInvalidPayment
+				if errors.Is(err, ErrExpired) {
+					reason = FailureExpired
+				}
+				fail(w, r, config, &PaymentFailure{
+					Rail:           rail.ID(),
+					Stage:          StageExtract,
+					Reason:         reason,
+					Resource:       resource,
+					ExpectedAmount: amount,
+					Err:            err,
+				})
+				return
+			}
 		}
 
-		// Verify payment
-		verification, err := rail.VerifyPayment(r.Context(), &VerifyPaymentRequest{
-			PaymentPayload:   paymentProof.Payload,
-			PaymentIntentID:  paymentProof.PaymentIntentID,
-			PaymentToken:     paymentProof.Token,
-			ExpectedAmount:   config.PricePerRequest,
-			ExpectedCurrency: config.Currency,
-			ExpectedPayTo:    config.CryptoPayTo,
-			Resource:         resource,
+		// Payments presented after the quote's deadline must be re-quoted
+		if paymentExpired(paymentProof.deadline(config.MaxTimeoutSeconds), config.clock()) {
+			fail(w, r, config, &PaymentFailure{
+				Rail:           rail.ID(),
+				Stage:          StageVerify,
+				Reason:         FailureExpired,
+				Resource:       resource,
+				ExpectedAmount: amount,
+			})
+			return
+		}
+		// A rail whose circuit is open fails fast, as if it had timed out
+		if !config.CircuitBreaker.allow(rail.ID()) {
+			timeout(w, r, config, &PaymentFailure{
+				Rail:           rail.ID(),
+				Stage:          StageVerify,
+				Reason:         FailureCircuitOpen,
+				Resource:       resource,
+				ExpectedAmount: amount,
+				Err:            ErrCircuitOpen,
+			})
+			return
+		}
+		verifyTimeout := railTimeout(config.VerificationTimeout, DefaultVerificationTimeout, config.MaxTimeoutSeconds)
+		verification, err := callWithTimeout(r.Context(), verifyTimeout, func(ctx context.Context) (*PaymentVerification, error) {
+			return rail.VerifyPayment(ctx, &VerifyPaymentRequest{
+				PaymentPayload:    paymentProof.Payload,
+				PaymentIntentID:   paymentProof.PaymentIntentID,
+				PaymentToken:      paymentProof.Token,
+				CheckoutSessionID: paymentProof.CheckoutSessionID,
+				CheckoutState:     paymentProof.CheckoutState,
+				ExpectedAmount:    amount,
+				ExpectedCurrency:  config.Currency,
+				ExpectedPayTo:     config.CryptoPayTo,
+				StripeAccount:     config.stripeAccount,
+				Resource:          resource,
+			})
 		})
+		config.CircuitBreaker.record(rail.ID(), err)
+		if isTimeout(err) {
+			timeout(w, r, config, &PaymentFailure{
+				Rail:           rail.ID(),
+				Stage:          StageVerify,
+				Reason:         FailureTimeout,
+				Resource:       resource,
+				ExpectedAmount: amount,
+				Err:            err,
+			})
+			return
+		}
+
+		// Payments in another currency are judged by their converted value
+		captureAmount := amount
+		if err == nil && verification != nil && verification.Reason == FailureCurrencyMismatch && config.CurrencyConverter != nil {
+			if convertVerification(r.Context(), config, verification, amount) {
+				captureAmount = verification.Amount
+			}
+		}
 
 		if err != nil || !verification.Valid {
-			if config.OnPaymentFailed != nil {
-				config.OnPaymentFailed(r.Context(), err, r)
+			failure := &PaymentFailure{
+				Rail:           rail.ID(),
+				Stage:          StageVerify,
+				Reason:         FailureRailError,
+				Resource:       resource,
+				ExpectedAmount: amount,
+				Err:            err,
+			}
+			if verification != nil {
+				failure.Reason = verification.Reason
+				if failure.Reason == "" {
+					failure.Reason = FailureInvalidPayment
+				}
+				failure.Message = verification.Message
+				failure.PresentedAmount = verification.Amount
+				failure.Payer = verification.Payer
+			}
+			fail(w, r, config, failure)
+			return
+		}
+
+		// Denied payers are refused and free payers served without capture
+		if servePayerPolicy(w, r, config.AccessPolicy, verification.Payer, config.Audit, next) {
+			return
+		}
+
+		// A Checkout session pays for one return
+		if paymentProof.CheckoutSessionID != "" {
+			if err := config.StripeCheckout.claim(paymentProof.CheckoutSessionID); err != nil {
+				fail(w, r, config, &PaymentFailure{
+					Rail:            rail.ID(),
+					Stage:           StageVerify,
+					Reason:          FailureInvalidPayment,
+					Message:         err.Error(),
+					Resource:        resource,
+					PresentedAmount: verification.Amount,
+					ExpectedAmount:  amount,
+					Payer:           verification.Payer,
+					Err:             err,
+				})
+				return
+			}
+		}
+		config.Audit.Record(r, AuditEvent{
+			Decision:        AuditVerified,
+			Rail:            rail.ID(),
+			Payer:           verification.Payer,
+			RequiredAmount:  amount,
+			PresentedAmount: verification.Amount,
+			Currency:        config.Currency,
+			PayloadHash:     hashPayload(paymentProof.payload()),
+			PaymentID:       verification.PaymentID,
+			Metadata:        couponMetadata(coupon),
+		})
+
+		config.PayerHeaders.set(r, GatewayClaims{
+			Payer:     verification.Payer,
+			Rail:      rail.ID(),
+			Amount:    amount,
+			Resource:  resource,
+			Timestamp: config.clock().Unix(),
+		})
+
+		// A conditional request is answered before capture, and a 304 is
+		// never captured
+		if config.FreeRevalidation && verification.RequiresCapture && replay == nil && conditionalRequest(r) {
+			if replay = revalidate(w, r, next, config.Audit, rail.ID(), verification.Payer); replay == nil {
+				return
 			}
-			sendPaymentOptions(w, r, config, registry)
+		}
+
+		// Count the quote and coupon before capture so a used quote or an
+		// exhausted coupon is never charged
+		if err := config.Quotes.claim(quote); err != nil {
+			sendPaymentOptions(w, r, unquotedConfig, registry, nil, quoteMessage(err))
 			return
 		}
+		if coupon != nil {
+			if _, err := config.Coupons.Redeem(coupon.Code, r.URL.Path); err != nil {
+				config.Quotes.release(quote)
+				sendPaymentOptions(w, r, fullConfig, registry, nil, couponMessage(err))
+				return
+			}
+			w.Header().Set("X-Coupon-Applied", coupon.Code)
+		}
 
 		// Capture payment if needed
+		settled := RequestPaymentInfo{Paid: true, PaymentID: verification.PaymentID, Rail: rail.ID(), Network: verification.Network, Gross: captureAmount, Net: captureAmount, Currency: verification.Currency}
 		if verification.RequiresCapture {
 			// Parse settlement data if present
 			var settlementData map[string]interface{}
@@ -215,35 +766,109 @@ func UnifiedPaymentMiddleware(next http.Handler, config UnifiedPaymentConfig) ht
 				}
 			}
 
-			capture, err := rail.CapturePayment(r.Context(), &CapturePaymentRequest{
-				PaymentID:      verification.PaymentID,
-				Amount:         config.PricePerRequest,
-				SettlementData: settlementData,
+			if !config.CircuitBreaker.allow(rail.ID()) {
+				config.Quotes.release(quote)
+				timeout(w, r, config, &PaymentFailure{
+					Rail:            rail.ID(),
+					Stage:           StageCapture,
+					Reason:          FailureCircuitOpen,
+					Resource:        resource,
+					PresentedAmount: verification.Amount,
+					ExpectedAmount:  amount,
+					Payer:           verification.Payer,
+					Err:             ErrCircuitOpen,
+				})
+				return
+			}
+			captureTimeout := railTimeout(config.CaptureTimeout, DefaultCaptureTimeout, config.MaxTimeoutSeconds)
+			capture, err := callWithTimeout(r.Context(), captureTimeout, func(ctx context.Context) (*PaymentCapture, error) {
+				return rail.CapturePayment(ctx, &CapturePaymentRequest{
+					PaymentID:      verification.PaymentID,
+					Amount:         captureAmount,
+					Currency:       verification.Currency,
+					SettlementData: settlementData,
+					StripeAccount:  config.stripeAccount,
+				})
 			})
+			config.CircuitBreaker.record(rail.ID(), err)
+			if isTimeout(err) {
+				config.Quotes.release(quote)
+				timeout(w, r, config, &PaymentFailure{
+					Rail:            rail.ID(),
+					Stage:           StageCapture,
+					Reason:          FailureTimeout,
+					Resource:        resource,
+					PresentedAmount: verification.Amount,
+					ExpectedAmount:  amount,
+					Payer:           verification.Payer,
+					Err:             err,
+				})
+				return
+			}
 
 			if err != nil || !capture.Success {
-				if config.OnPaymentFailed != nil {
-					config.OnPaymentFailed(r.Context(), err, r)
+				config.Quotes.release(quote)
+				failure := &PaymentFailure{
+					Rail:            rail.ID(),
+					Stage:           StageCapture,
+					Reason:          FailureRailError,
+					Resource:        resource,
+					PresentedAmount: verification.Amount,
+					ExpectedAmount:  amount,
+					Payer:           verification.Payer,
+					Err:             err,
 				}
-				sendPaymentOptions(w, r, config, registry)
+				if capture != nil {
+					failure.Reason = FailureCaptureFailed
+					if capture.Reason != "" {
+						failure.Reason = capture.Reason
+					}
+					failure.Message = capture.Message
+				}
+				fail(w, r, config, failure)
 				return
 			}
 
-			// Call success callback
-			if config.OnPaymentSuccess != nil {
-				config.OnPaymentSuccess(r.Context(), &CompletedPayment{
-					ID:            verification.PaymentID,
-					Rail:          rail.ID(),
-					Type:          rail.Type(),
-					Amount:        capture.GrossAmount,
-					Currency:      verification.Currency,
-					Resource:      resource,
-					Payer:         verification.Payer,
-					TransactionID: capture.TransactionID,
-					CompletedAt:   time.Now(),
-				})
+			settled.Gross, settled.Fee, settled.Net = capture.GrossAmount, capture.FeeAmount, capture.NetAmount
+			settled.TransactionID = capture.TransactionID
+			if capture.LedgerID != "" {
+				settled.PaymentID = capture.LedgerID
 			}
+
+			config.Audit.Record(r, AuditEvent{
+				Decision:        AuditCaptured,
+				Rail:            rail.ID(),
+				Payer:           verification.Payer,
+				RequiredAmount:  amount,
+				PresentedAmount: capture.GrossAmount,
+				Currency:        verification.Currency,
+				PaymentID:       verification.PaymentID,
+				TransactionID:   capture.TransactionID,
+			})
+
+			// Call success callback
+			config.paymentSucceeded(r, &CompletedPayment{
+				ID:            verification.PaymentID,
+				Rail:          rail.ID(),
+				Type:          rail.Type(),
+				Amount:        capture.GrossAmount,
+				Currency:      verification.Currency,
+				Resource:      resource,
+				Payer:         verification.Payer,
+				TransactionID: capture.TransactionID,
+				Metadata:      couponMetadata(coupon),
+				CompletedAt:   time.Now(),
+			})
+		}
+
+		config.TieredPricing.record(payer, amount)
+
+		if config.EnableSessions && config.SessionAfterPayment > 0 {
+			mintSession(w, r, config, verification, amount)
 		}
+		receipt := config.ReceiptCookies.issue(w, r, rail.ID(), verification.Payer, verification.PaymentID)
+
+		recordTaskSpend(config.TaskSpend, w, r, amount, verification.Currency)
 
 		// Payment verified - add headers and continue
 		w.Header().Set("X-Payment-Verified", "true")
@@ -251,7 +876,20 @@ func UnifiedPaymentMiddleware(next http.Handler, config UnifiedPaymentConfig) ht
 		w.Header().Set("X-Payment-ID", verification.PaymentID)
 		w.Header().Set("X-Payment-Timestamp", time.Now().Format(time.RFC3339))
 
-		next.ServeHTTP(w, r)
+		// Report the settlement to metering, composed inside or outside
+		r = reportPayment(r, settled)
+
+		// Buyers back from Checkout land on the resource's own URL, their
+		// receipt cookie paying for it from then on
+		if paymentProof.CheckoutSessionID != "" {
+			r = withoutCheckoutParams(r)
+			if receipt {
+				http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+				return
+			}
+		}
+
+		replay.serve(w, r, next)
 	})
 }
 
@@ -266,35 +904,79 @@ type PaymentProof struct {
 	// For fiat: payment intent ID or token
 	PaymentIntentID string `json:"paymentIntentId,omitempty"`
 	Token           string `json:"token,omitempty"`
+
+	// For Stripe Checkout: the session and state the buyer returned with
+	CheckoutSessionID string `json:"checkoutSessionId,omitempty"`
+	CheckoutState     string `json:"checkoutState,omitempty"`
+
+	// ValidUntil echoes the 402's validUntil (optional)
+	ValidUntil int64 `json:"validUntil,omitempty"`
+}
+
+// deadline returns when the proof stops being accepted (zero if unknown).
+// Stripe intents carry their own deadline, checked by StripeRail.
+func (p *PaymentProof) deadline(maxTimeout int) time.Time {
+	if p.ValidUntil > 0 {
+		return time.Unix(p.ValidUntil, 0)
+	}
+	if p.Payload == "" {
+		return time.Time{}
+	}
+	return proofDeadline(p.Payload, maxTimeout)
+}
+
+// payload returns the credential the proof presents
+func (p *PaymentProof) payload() string {
+	switch {
+	case p == nil:
+		return ""
+	case p.Payload != "":
+		return p.Payload
+	case p.PaymentIntentID != "":
+		return p.PaymentIntentID
+	case p.CheckoutSessionID != "":
+		return p.CheckoutSessionID
+	}
+	return p.Token
+}
+
+// proofPayload returns the credential presented on r, if any
+func proofPayload(r *http.Request, protocol *ProtocolProfile, maxBytes int) string {
+	proof, _ := extractPaymentProof(r, protocol, maxBytes)
+	return proof.payload()
 }
 
-// extractPaymentProof extracts payment proof from request headers
-func extractPaymentProof(r *http.Request) *PaymentProof {
+// extractPaymentProof extracts payment proof from request headers. It
+// returns nil if none is present and an error if X-PAYMENT-PROOF is malformed
+// or a proof is over maxBytes (0 = DefaultMaxProofBytes).
+// x402 proofs are read from protocol's proof headers (PAYMENT-SIGNATURE and
+// X-PAYMENT if it is nil).
+func extractPaymentProof(r *http.Request, protocol *ProtocolProfile, maxBytes int) (*PaymentProof, error) {
 	// Check X-PAYMENT-PROOF header (unified format)
 	if proofHeader := r.Header.Get("X-PAYMENT-PROOF"); proofHeader != "" {
-		decoded, err := base64.StdEncoding.DecodeString(proofHeader)
-		if err == nil {
-			var proof PaymentProof
-			if json.Unmarshal(decoded, &proof) == nil {
-				return &proof
-			}
+		if err := checkProofSize(proofHeader, maxBytes); err != nil {
+			return nil, err
 		}
-	}
-
-	// Check PAYMENT-SIGNATURE header (x402 crypto format)
-	if paymentSig := r.Header.Get("PAYMENT-SIGNATURE"); paymentSig != "" {
-		return &PaymentProof{
-			Rail:    "evm-crypto",
-			Payload: paymentSig,
+		decoded, err := decodeBase64(proofHeader)
+		if err != nil {
+			return nil, fmt.Errorf("decode X-PAYMENT-PROOF: %w", err)
+		}
+		var proof PaymentProof
+		if err := decodeProofJSON(decoded, &proof); err != nil {
+			return nil, fmt.Errorf("parse X-PAYMENT-PROOF: %w", err)
 		}
+		return &proof, nil
 	}
 
-	// Check X-PAYMENT header (x402 v1 format)
-	if xPayment := r.Header.Get("X-PAYMENT"); xPayment != "" {
+	// Check the protocol's proof headers (x402 crypto format)
+	if payload := protocol.proof(r); payload != "" {
+		if err := checkProofSize(payload, maxBytes); err != nil {
+			return nil, err
+		}
 		return &PaymentProof{
 			Rail:    "evm-crypto",
-			Payload: xPayment,
-		}
+			Payload: payload,
+		}, nil
 	}
 
 	// Check X-STRIPE-PAYMENT-INTENT header (Stripe format)
@@ -302,7 +984,7 @@ func extractPaymentProof(r *http.Request) *PaymentProof {
 		return &PaymentProof{
 			Rail:            "stripe",
 			PaymentIntentID: stripePI,
-		}
+		}, nil
 	}
 
 	// Check query parameters (for redirects from Stripe checkout)
@@ -310,36 +992,59 @@ func extractPaymentProof(r *http.Request) *PaymentProof {
 		return &PaymentProof{
 			Rail:            "stripe",
 			PaymentIntentID: pi,
-		}
+		}, nil
 	}
 
-	return nil
+	// And for buyers returning from a Stripe Checkout page
+	if session := r.URL.Query().Get(CheckoutSessionParam); session != "" {
+		return &PaymentProof{
+			Rail:              "stripe",
+			CheckoutSessionID: session,
+			CheckoutState:     r.URL.Query().Get(CheckoutStateParam),
+		}, nil
+	}
+
+	return nil, nil
 }
 
-// sendPaymentOptions sends a 402 response with all available payment options
-func sendPaymentOptions(w http.ResponseWriter, r *http.Request, config UnifiedPaymentConfig, registry *RailRegistry) {
+// sendPaymentOptions sends a 402 response with all available payment options.
+// If a presented payment was refused, failure explains why in the error and
+// code; otherwise message, if set, explains why a session or coupon was.
+func sendPaymentOptions(w http.ResponseWriter, r *http.Request, config UnifiedPaymentConfig, registry *RailRegistry, failure *PaymentFailure, message string) {
 	resource := r.URL.Path
 	if r.URL.RawQuery != "" {
 		resource += "?" + r.URL.RawQuery
 	}
+	maxTimeout := maxTimeoutOrDefault(config.MaxTimeoutSeconds)
+	validUntil := paymentDeadline(config.clock(), maxTimeout)
 
 	var options []PaymentOption
 	var accepts []PaymentRequirements
+	prefs := config.customerPrefs(r)
 
-	// Add crypto options
-	if config.CryptoEnabled {
+	// Add crypto options, unless the rail's circuit is open
+	if config.CryptoEnabled && config.CircuitBreaker.available(RailEVMCrypto) && prefs.allows(RailEVMCrypto) {
+		cryptoAmount := config.RailAmount(RailEVMCrypto, RailTypeCrypto)
+		cryptoRail, _ := registry.Get(RailEVMCrypto)
 		for _, network := range config.CryptoNetworks {
+			if assets := acceptedAssets(config.CryptoAssets, network); len(assets) > 0 {
+				assetOptions, assetAccepts := config.assetOptions(cryptoRail, network, assets, cryptoAmount, resource, maxTimeout, validUntil.Unix())
+				options = append(options, assetOptions...)
+				accepts = append(accepts, assetAccepts...)
+				continue
+			}
+
 			option := PaymentOption{
-				Rail:         "evm-crypto",
+				Rail:         RailEVMCrypto,
 				DisplayName:  fmt.Sprintf("Pay with Crypto (%s)", networkDisplayName(network)),
 				Type:         RailTypeCrypto,
 				Scheme:       config.CryptoScheme,
 				Network:      string(network),
-				Amount:       config.PricePerRequest,
+				Amount:       cryptoAmount,
 				Currency:     config.Currency,
 				PayTo:        config.CryptoPayTo,
 				Asset:        config.CryptoAsset,
-				EstimatedFee: 0, // Gas paid by sender
+				EstimatedFee: estimateFee(cryptoRail, cryptoAmount, config.Currency), // Gas paid by sender
 			}
 			options = append(options, option)
 
@@ -350,12 +1055,13 @@ func sendPaymentOptions(w http.ResponseWriter, r *http.Request, config UnifiedPa
 			accepts = append(accepts, PaymentRequirements{
 				Scheme:            config.CryptoScheme,
 				Network:           string(network),
-				MaxAmountRequired: fmt.Sprintf("%d", config.PricePerRequest),
+				MaxAmountRequired: fmt.Sprintf("%d", cryptoAmount),
 				Resource:          resource,
 				Description:       config.Description,
 				PayTo:             config.CryptoPayTo,
-				MaxTimeoutSeconds: 60,
+				MaxTimeoutSeconds: maxTimeout,
 				Asset:             config.CryptoAsset,
+				ExpiresAt:         validUntil.Unix(),
 				Extra: map[string]interface{}{
 					// EIP-712 domain info for direct signing
 					"name":    domainName,
@@ -367,59 +1073,206 @@ func sendPaymentOptions(w http.ResponseWriter, r *http.Request, config UnifiedPa
 	}
 
 	// Add Stripe option
-	if config.FiatEnabled && config.StripeSecretKey != "" {
-		stripeRail := NewStripeRail(config.StripeSecretKey, config.StripeWebhookSecret)
+	if stripeRail, ok := registry.Get(RailStripe); ok && config.FiatEnabled && config.CircuitBreaker.available(RailStripe) && prefs.allows(RailStripe) {
+		fiatAmount, fiatCurrency := config.localQuote(r.Context(), RailStripe, config.RailAmount(RailStripe, RailTypeFiat))
+		fiatAmount = stripeAmount(fiatAmount, fiatCurrency)
+
+		// The customer's saved card, ahead of entering a new one. Saved
+		// cards are the platform's, so not for connected accounts' sales.
+		if config.QuickPay && prefs.quickPay() && config.stripeAccount == "" {
+			intent, err := stripeRail.CreatePaymentIntent(r.Context(), &PaymentIntentRequest{
+				Amount:          fiatAmount,
+				Currency:        fiatCurrency,
+				Resource:        resource,
+				Description:     config.Description,
+				Metadata:        map[string]string{"resource": resource},
+				CustomerID:      prefs.StripeCustomerID,
+				PaymentMethodID: prefs.PaymentMethodID,
+				ExpiresAt:       &validUntil,
+			})
+			if err == nil {
+				options = append(options, PaymentOption{
+					Rail:         RailStripe,
+					DisplayName:  "Pay with saved card",
+					Type:         RailTypeFiat,
+					Amount:       fiatAmount,
+					Currency:     fiatCurrency,
+					ClientSecret: intent.ClientSecret,
+					EstimatedFee: estimateFee(stripeRail, fiatAmount, fiatCurrency),
+					SavedCard:    true,
+				})
+			}
+		}
 
 		// Create payment intent
 		intent, err := stripeRail.CreatePaymentIntent(r.Context(), &PaymentIntentRequest{
-			Amount:      config.PricePerRequest,
-			Currency:    config.Currency,
+			Amount:      fiatAmount,
+			Currency:    fiatCurrency,
 			Resource:    resource,
 			Description: config.Description,
 			Metadata: map[string]string{
 				"resource": resource,
 			},
+			ExpiresAt:     &validUntil,
+			StripeAccount: config.stripeAccount,
 		})
 
 		if err == nil {
-			// Calculate estimated Stripe fee (2.9% + $0.30)
-			estimatedFee := int64(float64(config.PricePerRequest)*0.029) + 30
+			estimatedFee := estimateFee(stripeRail, fiatAmount, fiatCurrency)
 
 			option := PaymentOption{
-				Rail:         "stripe",
+				Rail:         RailStripe,
 				DisplayName:  "Pay with Card (Visa, Mastercard)",
 				Type:         RailTypeFiat,
-				Amount:       config.PricePerRequest,
-				Currency:     config.Currency,
+				Amount:       fiatAmount,
+				Currency:     fiatCurrency,
 				ClientSecret: intent.ClientSecret,
 				EstimatedFee: estimatedFee,
 			}
 			options = append(options, option)
 		}
+
+		// And a hosted Checkout page, for sellers without Stripe.js. Checkout
+		// sessions are the platform's, so not for connected accounts' sales.
+		if config.stripeAccount == "" {
+			if option := config.StripeCheckout.option(r, stripeRail, fiatAmount, fiatCurrency, config.Description); option != nil {
+				options = append(options, *option)
+			}
+		}
+	}
+
+	// Add a bank debit option, for US dollar prices
+	if achRail, ok := registry.Get(RailStripeACH); ok && config.FiatEnabled && strings.EqualFold(config.Currency, "USD") && config.CircuitBreaker.available(RailStripeACH) && prefs.allows(RailStripeACH) {
+		achAmount := config.RailAmount(RailStripeACH, RailTypeFiat)
+		intent, err := achRail.CreatePaymentIntent(r.Context(), &PaymentIntentRequest{
+			Amount:      achAmount,
+			Currency:    config.Currency,
+			Resource:    resource,
+			Description: config.Description,
+			Metadata: map[string]string{
+				"resource": resource,
+			},
+			StripeAccount: config.stripeAccount,
+		})
+		if err == nil {
+			options = append(options, PaymentOption{
+				Rail:           RailStripeACH,
+				DisplayName:    "Pay by Bank Transfer (ACH)",
+				Type:           RailTypeFiat,
+				Amount:         achAmount,
+				Currency:       config.Currency,
+				ClientSecret:   intent.ClientSecret,
+				EstimatedFee:   estimateFee(achRail, achAmount, config.Currency),
+				SettlementNote: settlementNote(achRail),
+			})
+		}
 	}
 
+	prefs.order(options, accepts)
+	meta := config.ResourceDescriptor.describe(r, accepts)
+
 	// Build response
 	response := PaymentOptionsResponse{
-		X402Version: X402Version,
-		Options:     options,
-		Accepts:     accepts,
-		Resource:    resource,
-		Description: config.Description,
-		Error:       "Payment required - select a payment method",
+		X402Version:  X402Version,
+		Options:      options,
+		Accepts:      accepts,
+		Resource:     resource,
+		Description:  config.Description,
+		MimeType:     meta.MimeType,
+		OutputSchema: meta.OutputSchema,
+		Error:        "Payment required - select a payment method",
+		ValidUntil:   validUntil.Unix(),
+	}
+	if failure != nil {
+		message = failure.PublicMessage()
+		response.Code = failure.ErrorCode()
+	}
+	if message != "" {
+		response.Error = message + " - select a payment method"
+	}
+	ext := config.Extensions
+	if config.EnableSessions {
+		sessions := &SubscriptionInfo{
+			Available:       true,
+			Tiers:           config.SessionTiers,
+			SessionEndpoint: config.SessionEndpoint,
+		}
+		ext = (&PaymentExtensions{Sessions: sessions}).merge(ext)
+	}
+	if ext = extensionsFor(r, ext); ext != nil {
+		ext.apply(response.Accepts)
+		response.Session = ext.Sessions
+		rest := *ext
+		rest.Sessions = nil
+		response.Extensions = rest.merge(nil)
 	}
 
-	// Encode for PAYMENT-REQUIRED header
-	responseJSON, _ := json.Marshal(response)
-	paymentRequiredHeader := base64.StdEncoding.EncodeToString(responseJSON)
+	response.Subscriptions = config.Subscriptions.offer()
+	response.RequirementsHash = requirementsHash(response.Accepts)
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("PAYMENT-REQUIRED", paymentRequiredHeader)
+	required := make(map[string]int64, len(options))
+	for _, option := range options {
+		required[option.Rail] = option.Amount
+	}
+	config.Audit.recordPaymentRequired(r, failure, proofPayload(r, config.Protocol, config.MaxProofBytes), AuditEvent{Required: required, Currency: config.Currency})
+	config.DiscoverySigner.sign(w, response)
+	config.Protocol.writePaymentRequired(w, config.Realm, requirementSchemes(response.Accepts), response)
+}
+
+// ===============================================
+// UNIFIED SESSIONS
+// ===============================================
+
+// sessionCookieName carries minted sessions for browsers, which can't add
+// X-Session-ID to asset requests
+const sessionCookieName = "x402_session"
+
+// requestSessionID returns the session presented by r, if any. Session
+// tokens are only used for their ID; the store is the source of truth.
+func requestSessionID(r *http.Request) string {
+	if id := r.Header.Get("X-Session-ID"); id != "" {
+		return id
+	}
+	if token := r.Header.Get("X-Session-Token"); token != "" {
+		if session, err := DecodeSessionToken(token); err == nil {
+			return session.ID
+		}
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
 
-	// Add CORS headers for browser clients
-	w.Header().Set("Access-Control-Expose-Headers", "PAYMENT-REQUIRED")
+// mintSession creates a short session after a one-off payment and returns it
+// in headers and a cookie
+func mintSession(w http.ResponseWriter, r *http.Request, config UnifiedPaymentConfig, verification *PaymentVerification, amount int64) {
+	session := &Session{
+		PayerAddress: verification.Payer,
+		ExpiresAt:    time.Now().Add(config.SessionAfterPayment),
+		SessionType:  SessionTypeTime,
+		AmountPaid:   amount,
+		Currency:     verification.Currency,
+	}
+	if config.SessionMaxRequests > 0 {
+		session.SessionType = SessionTypeRequests
+		session.MaxRequests = config.SessionMaxRequests
+	}
+	if err := config.Tenants.sessionsFor(r, config.SessionStore).CreateSession(session); err != nil {
+		return
+	}
 
-	w.WriteHeader(http.StatusPaymentRequired)
-	_ = json.NewEncoder(w).Encode(response)
+	w.Header().Set("X-Session-ID", session.ID)
+	setSessionHeaders(w, session)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    session.ID,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
 }
 
 // networkDisplayName returns a human-friendly name for a network
@@ -463,13 +1316,23 @@ type AIAgentPaymentConfig struct {
 
 	// Pre-authorized payment methods
 	PreAuthStore PreAuthStore
+
+	// Alerts, if set, watches pre-authorized budget spend
+	Alerts *SpendingAlerts
 }
 
 // AIAgentPaymentMiddleware adds AI agent payment support to the unified middleware
 func AIAgentPaymentMiddleware(next http.Handler, config UnifiedPaymentConfig, agentConfig AIAgentPaymentConfig) http.Handler {
 	unified := UnifiedPaymentMiddleware(next, config)
+	price := config.agentAmount()
+	guard := &composition{name: "AIAgentPaymentMiddleware"}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An x402 middleware outside this one already handled payment
+		if guard.passThrough(w, r, next) {
+			return
+		}
+
 		// Check if this is an AI agent
 		if !isAIAgent(r) {
 			unified.ServeHTTP(w, r)
@@ -485,40 +1348,42 @@ func AIAgentPaymentMiddleware(next http.Handler, config UnifiedPaymentConfig, ag
 			agentID = r.Header.Get("X-Agent-ID")
 		}
 
-		if agentConfig.PreAuthStore != nil && agentID != "" {
-			preAuth, err := agentConfig.PreAuthStore.GetByAgentID(agentID)
+		budgets := config.Tenants.budgetsFor(r, agentConfig.PreAuthStore)
+		if budgets != nil && agentID != "" {
+			preAuth, err := budgets.GetByAgentID(agentID)
 			if err == nil && preAuth != nil {
-				// Check if agent has sufficient pre-auth budget
-				if preAuth.Remaining >= config.PricePerRequest {
-					// Deduct from pre-auth
-					err := agentConfig.PreAuthStore.Deduct(preAuth.ID, config.PricePerRequest)
-					if err == nil {
-						// Payment covered by pre-auth - get updated budget
-						updatedPreAuth, _ := agentConfig.PreAuthStore.Get(preAuth.ID)
-						remaining := int64(0)
-						if updatedPreAuth != nil {
-							remaining = updatedPreAuth.Remaining
-						}
-
-						// Payment covered by pre-auth
-						w.Header().Set("X-Payment-Verified", "true")
-						w.Header().Set("X-Payment-Method", "pre-auth")
-						w.Header().Set("X-Remaining-Budget", fmt.Sprintf("%d", remaining))
-						next.ServeHTTP(w, r)
-						return
-					}
+				// Deduct from pre-auth if it covers the price
+				updated, err := deductBudget(budgets, preAuth.ID, price, r, "")
+				if errors.Is(err, ErrBudgetSuspended) {
+					config.Audit.Record(r, AuditEvent{Decision: AuditRejected, Reason: "budget_suspended", Payer: agentID, RequiredAmount: price, PaymentID: preAuth.ID})
+					sendAIError(w, config.Realm, generateRequestID(r), time.Now(), budgetSuspendedError(updated))
+					return
+				}
+				if err == nil {
+					// Payment covered by pre-auth
+					config.Audit.Record(r, AuditEvent{Decision: AuditVerified, Rail: "pre-auth", Payer: agentID, RequiredAmount: price, PaymentID: preAuth.ID})
+					w.Header().Set("X-Payment-Verified", "true")
+					w.Header().Set("X-Payment-Method", "pre-auth")
+					w.Header().Set("X-Remaining-Budget", fmt.Sprintf("%d", updated.Remaining))
+					agentConfig.Alerts.record(r, budgets, updated, price)
+					warnLowBalance(w, agentConfig.Alerts, updated, price)
+					r = reportPayment(r, RequestPaymentInfo{Paid: true, Type: PaymentTypeBudget, PaymentID: preAuth.ID, Gross: price, Net: price, Currency: config.Currency})
+					next.ServeHTTP(w, decide(withBudgetStatus(r, updated), guard.name))
+					return
 				}
 			}
 		}
 
 		// Check agent budget constraints
-		if agentInfo.AgentBudget > 0 && agentInfo.AgentBudget < config.PricePerRequest {
+		if agentInfo.AgentBudget > 0 && agentInfo.AgentBudget < price {
 			// Agent budget is insufficient
+			config.Audit.Record(r, AuditEvent{Decision: AuditPaymentRequired, Reason: "agent_budget", RequiredAmount: price, Currency: config.Currency})
 			w.Header().Set("Content-Type", "application/json")
+			setPaymentRequiredHeaders(w, config.Realm, nil, config.Protocol)
 			w.WriteHeader(http.StatusPaymentRequired)
 			_ = json.NewEncoder(w).Encode(map[string]interface{}{
 				"error":           "Insufficient agent budget",
-				"required":        config.PricePerRequest,
+				"required":        price,
 				"agentBudget":     agentInfo.AgentBudget,
 				"currency":        config.Currency,
 				"suggestedAction": "Increase budget or use different payment method",
@@ -540,10 +1405,26 @@ type OnboardingHandler struct {
 	config   UnifiedPaymentConfig
 	registry *RailRegistry
 	prefs    PaymentPrefsStore
+
+	// AdminKey lets admins (X-Admin-Key or Authorization: Bearer) delete and
+	// export any customer's data
+	AdminKey string
+
+	// Authenticate names the customer a request is authenticated as, e.g.
+	// from the seller's login session. Customers may delete and export only
+	// their own data; without it only admins can.
+	Authenticate CustomerResolver
+
+	// Ledger, if set, adds the customer's payments to data exports
+	Ledger PaymentLedger
 }
 
-// NewOnboardingHandler creates a new onboarding handler
+// NewOnboardingHandler creates a new onboarding handler. A nil prefs uses
+// config.PaymentPrefs, so 402s see the preferences customers save.
 func NewOnboardingHandler(config UnifiedPaymentConfig, prefs PaymentPrefsStore) *OnboardingHandler {
+	if prefs == nil {
+		prefs = config.PaymentPrefs
+	}
 	registry := config.RailRegistry
 	if registry == nil {
 		registry = NewRailRegistry()
@@ -588,6 +1469,8 @@ func (h *OnboardingHandler) SetPreferredMethod(w http.ResponseWriter, r *http.Re
 		Rail       string `json:"rail"`
 		Network    string `json:"network,omitempty"`
 		CryptoAddr string `json:"cryptoAddress,omitempty"`
+
+		DisabledRails []string `json:"disabledRails,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -600,16 +1483,23 @@ func (h *OnboardingHandler) SetPreferredMethod(w http.ResponseWriter, r *http.Re
 		http.Error(w, "Unknown payment rail", http.StatusBadRequest)
 		return
 	}
+	for _, rail := range req.DisabledRails {
+		if rail == req.Rail {
+			http.Error(w, "Preferred rail cannot be disabled", http.StatusBadRequest)
+			return
+		}
+	}
 
 	prefs := &CustomerPaymentPrefs{
 		CustomerID:       req.CustomerID,
 		PreferredRail:    req.Rail,
 		PreferredNetwork: req.Network,
 		CryptoAddress:    req.CryptoAddr,
+		DisabledRails:    req.DisabledRails,
 		CreatedAt:        time.Now(),
 	}
 
-	if err := h.prefs.Set(r.Context(), prefs); err != nil {
+	if err := h.config.Tenants.prefsFor(r, h.prefs).Set(r.Context(), prefs); err != nil {
 		http.Error(w, "Failed to save preferences", http.StatusInternalServerError)
 		return
 	}
@@ -656,7 +1546,7 @@ func (h *OnboardingHandler) GetPreferences(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	prefs, err := h.prefs.Get(r.Context(), customerID)
+	prefs, err := h.config.Tenants.prefsFor(r, h.prefs).Get(r.Context(), customerID)
 	if err != nil {
 		http.Error(w, "Failed to get preferences", http.StatusInternalServerError)
 		return
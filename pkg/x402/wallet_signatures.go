@@ -0,0 +1,63 @@
+// Package x402 - Wallet Signatures
+// Budget closing, session delegates and payment history let a payer prove
+// they own a wallet by signing a message. WalletVerifier left the check to
+// the seller; VerifyPersonalSign is one for EVM wallets, checking the
+// personal_sign (EIP-191) signatures that wallets and agent SDKs produce.
+package x402
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/siddimore/x402-seller-middleware/internal/secp256k1"
+)
+
+// PersonalSignHash is the hash an EVM wallet signs for personal_sign of
+// message (EIP-191 version 0x45)
+func PersonalSignHash(message string) []byte {
+	return secp256k1.Keccak256([]byte("\x19Ethereum Signed Message:\n" + strconv.Itoa(len(message)) + message))
+}
+
+// RecoverPersonalSigner returns the checksummed address whose personal_sign
+// of message is signature (65 bytes of hex, with or without 0x)
+func RecoverPersonalSigner(message, signature string) (string, error) {
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "0x"))
+	if err != nil || len(sig) != 65 {
+		return "", errors.New("signature must be 65 bytes of hex")
+	}
+	addr, err := secp256k1.Recover(PersonalSignHash(message), sig)
+	if err != nil {
+		return "", err
+	}
+	return ChecksumAddress("0x" + hex.EncodeToString(addr)), nil
+}
+
+// VerifyPersonalSign is a WalletVerifier for EVM wallets: it reports whether
+// signature is address's personal_sign of message. Malformed signatures are
+// errors; a signature by another wallet is not.
+func VerifyPersonalSign(address, message, signature string) (bool, error) {
+	signer, err := RecoverPersonalSigner(message, signature)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(signer, address), nil
+}
+
+// ChecksumAddress returns the EIP-55 mixed-case form of an EVM address, or
+// address unchanged if it isn't one
+func ChecksumAddress(address string) string {
+	lower := strings.ToLower(strings.TrimPrefix(address, "0x"))
+	if _, err := hex.DecodeString(lower); err != nil || len(lower) != 40 {
+		return address
+	}
+	hash := hex.EncodeToString(secp256k1.Keccak256([]byte(lower)))
+	out := []byte(lower)
+	for i, c := range out {
+		if c >= 'a' && hash[i] >= '8' {
+			out[i] = c - 'a' + 'A'
+		}
+	}
+	return "0x" + string(out)
+}
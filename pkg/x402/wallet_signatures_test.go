@@ -0,0 +1,59 @@
+package x402
+
+import (
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/siddimore/x402-seller-middleware/internal/secp256k1"
+)
+
+// personalSign signs message the way an EVM wallet's personal_sign does
+func personalSign(t *testing.T, key *big.Int, message string) string {
+	t.Helper()
+	sig, err := secp256k1.Sign(PersonalSignHash(message), key)
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	return "0x" + hex.EncodeToString(sig)
+}
+
+func TestChecksumAddress(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"},
+		{"0xFB6916095CA1DF60BB79CE92CE3EA74C37C5D359", "0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359"},
+		{"0xdbF03B407c01E7cD3CBea99509d93f8DDDC8C6FB", "0xdbF03B407c01E7cD3CBea99509d93f8DDDC8C6FB"},
+		{"0xpayer", "0xpayer"},
+		{"cus_123", "cus_123"},
+	}
+	for _, tt := range tests {
+		if got := ChecksumAddress(tt.in); got != tt.want {
+			t.Errorf("ChecksumAddress(%q): expected %q, got %q", tt.in, tt.want, got)
+		}
+	}
+}
+
+func TestVerifyPersonalSign(t *testing.T) {
+	key := big.NewInt(1)
+	address := "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf"
+	signature := personalSign(t, key, "hello")
+
+	if signer, err := RecoverPersonalSigner("hello", signature); err != nil || signer != address {
+		t.Errorf("Expected %s to have signed, got %q %v", address, signer, err)
+	}
+	if ok, err := VerifyPersonalSign("0x7e5f4552091a69125d5dfcb7b8c2659029395bdf", "hello", signature); err != nil || !ok {
+		t.Errorf("Expected the signature valid for the lowercase address, got %v %v", ok, err)
+	}
+	if ok, err := VerifyPersonalSign(address, "goodbye", signature); err != nil || ok {
+		t.Errorf("Expected the signature invalid for another message, got %v %v", ok, err)
+	}
+	other := personalSign(t, big.NewInt(2), "hello")
+	if ok, err := VerifyPersonalSign(address, "hello", other); err != nil || ok {
+		t.Errorf("Expected another wallet's signature invalid, got %v %v", ok, err)
+	}
+	if _, err := VerifyPersonalSign(address, "hello", "0x1234"); err == nil {
+		t.Error("Expected a malformed signature to be an error")
+	}
+}
@@ -64,7 +64,7 @@ sleep 1
 
 # Start gateway
 echo "Starting gateway on :8402..."
-./bin/x402-gateway -backend=http://localhost:3000 -payment-url=https://pay.example.com -exempt=/health,/api/public &
+./bin/x402-gateway -backend=http://localhost:3000 -payment-url=https://pay.example.com -exempt=/health,/api/public -test-mode &
 GATEWAY_PID=$!
 sleep 1
 
@@ -145,12 +145,12 @@ else
 fi
 
 echo ""
-echo "Test 2e: Query parameter token"
+echo "Test 2e: Query parameter token ignored by default"
 HTTP_CODE=$(curl -s -o /dev/null -w "%{http_code}" "http://localhost:8402/api/data?payment_token=valid_xyz")
-if [ "$HTTP_CODE" = "200" ]; then
-    pass "Query parameter token accepted"
+if [ "$HTTP_CODE" = "402" ]; then
+    pass "Query parameter token ignored"
 else
-    fail "Expected 200, got $HTTP_CODE"
+    fail "Expected 402, got $HTTP_CODE"
 fi
 
 echo ""